@@ -1,18 +1,54 @@
 package main
 
 import (
-	"fmt"
 	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"python"
 )
 
 var verbose_output = flag.Bool("v", false, "verbose output")
 var show_version = flag.Bool("V", false, "show version information and exit")
 
+// Runs the module in the file at path, as the main module of a new interpreter, which
+// imports modules from the directory the file is in.
+func runFile(path string) os.Error {
+	interp := python.NewInterpreter()
+	interp.Path = []string{filepath.Dir(path)}
+
+	mod, err := interp.LoadFile("__main__", path)
+	if err != nil {
+		return err
+	}
+	interp.AddModule(mod)
+
+	m := interp.NewMachine()
+	result, err := m.RunModule(mod)
+	if err != nil {
+		if m.Traceback != nil {
+			return os.NewError(m.Traceback.String())
+		}
+		return err
+	}
+	if *verbose_output && result != nil {
+		fmt.Println(result.AsString())
+	}
+	return nil
+}
+
 func main() {
 	flag.Parse()
-	
+
 	if *show_version {
 		fmt.Printf("gopython version 0.1\n")
-	}		
+		return
+	}
+
+	for _, path := range flag.Args() {
+		if err := runFile(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 }
-	
@@ -0,0 +1,62 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file picks the assembler for a machine.  Each backend has its own
+   instruction emitters, but they all build code in a buffer, and bind labels
+   in it, the same way.
+*/
+
+package python
+
+import (
+        "bytes"
+        "os"
+        "runtime"
+)
+
+// The parts of an in-memory assembler that don't depend on the machine.
+type Assembler interface {
+    Bytes() []byte
+    Len() int
+    
+    Here() JmpDst
+    Bind(l *Label) os.Error
+    LinkJump(src JmpSrc, dst JmpDst) os.Error
+    
+    Align(n int)
+    Quad(v uint64)
+}
+
+// Returned when there is no assembler for a machine.
+var UnsupportedArch = os.NewError("no assembler for this architecture")
+
+// Returns a new assembler for goarch, which is named as in runtime.GOARCH.
+func NewAssembler(goarch string) (Assembler, os.Error) {
+    switch goarch {
+        case "386":
+            return &X86Buffer{Buffer: new(bytes.Buffer)}, nil
+        case "amd64":
+            return &X86Buffer{Buffer: new(bytes.Buffer), IsX64: true}, nil
+        case "arm64":
+            return &Arm64Buffer{Buffer: new(bytes.Buffer)}, nil
+    }
+    return nil, UnsupportedArch
+}
+
+// Returns a new assembler for the machine the interpreter was built for.
+func HostAssembler() (Assembler, os.Error) {
+    return NewAssembler(runtime.GOARCH)
+}
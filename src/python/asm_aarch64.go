@@ -0,0 +1,659 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the ARM64 in-memory assembler,
+   the peer of the x86 one for Apple Silicon and ARM servers.  Every
+   instruction is one little-endian 32-bit word.  The emitters follow the ARM
+   operand order, destination first, and are named after the instruction and
+   the kinds of its operands, R for a general register, D for a double
+   precision floating point register, M for memory at an offset from a base
+   register, P for memory at a label, addressed relative to the program
+   counter, and I for an immediate, so LdrRM loads a 64-bit value from memory
+   into a register.  All the general register forms work on 64-bit values.
+*/
+
+package python
+
+import "bytes"
+import "encoding/binary"
+import "fmt"
+import "os"
+
+const (
+	arm64_x0 RegisterId = iota
+	arm64_x1
+	arm64_x2
+	arm64_x3
+	arm64_x4
+	arm64_x5
+	arm64_x6
+	arm64_x7
+	arm64_x8
+	arm64_x9
+	arm64_x10
+	arm64_x11
+	arm64_x12
+	arm64_x13
+	arm64_x14
+	arm64_x15
+	arm64_x16
+	arm64_x17
+	arm64_x18
+	arm64_x19
+	arm64_x20
+	arm64_x21
+	arm64_x22
+	arm64_x23
+	arm64_x24
+	arm64_x25
+	arm64_x26
+	arm64_x27
+	arm64_x28
+	arm64_x29
+	arm64_x30
+
+	// Register 31 is the stack pointer when it is the base of a memory operand
+	// or an operand of AddRRI and SubRRI, and the zero register everywhere else.
+	arm64_sp  = 31
+	arm64_xzr = 31
+
+	arm64_fp = arm64_x29
+	arm64_lr = arm64_x30
+)
+
+// The floating point registers are numbered from 0 to 31 too.  Only the low
+// eight are named, since they are the ones the calling convention passes
+// arguments in.
+const (
+	arm64_d0 RegisterId = iota
+	arm64_d1
+	arm64_d2
+	arm64_d3
+	arm64_d4
+	arm64_d5
+	arm64_d6
+	arm64_d7
+)
+
+const (
+	arm64_conditionEQ = iota
+	arm64_conditionNE
+	arm64_conditionHS
+	arm64_conditionLO
+	arm64_conditionMI
+	arm64_conditionPL
+	arm64_conditionVS
+	arm64_conditionVC
+	arm64_conditionHI
+	arm64_conditionLS
+	arm64_conditionGE
+	arm64_conditionLT
+	arm64_conditionGT
+	arm64_conditionLE
+	arm64_conditionAL
+)
+
+// Instruction templates, with the operand fields zero.
+const (
+	arm64_ADD_imm  uint32 = 0x91000000
+	arm64_SUB_imm         = 0xD1000000
+	arm64_SUBS_imm        = 0xF1000000
+	arm64_ADDS_imm        = 0xB1000000
+	arm64_ADD_reg         = 0x8B000000
+	arm64_SUB_reg         = 0xCB000000
+	arm64_SUBS_reg        = 0xEB000000
+	arm64_AND_reg         = 0x8A000000
+	arm64_ANDS_reg        = 0xEA000000
+	arm64_ORR_reg         = 0xAA000000
+	arm64_ORN_reg         = 0xAA200000
+	arm64_EOR_reg         = 0xCA000000
+	arm64_MADD            = 0x9B000000
+	arm64_MSUB            = 0x9B008000
+	arm64_SDIV            = 0x9AC00C00
+	arm64_LSLV            = 0x9AC02000
+	arm64_LSRV            = 0x9AC02400
+	arm64_ASRV            = 0x9AC02800
+	arm64_SBFM            = 0x93400000
+	arm64_UBFM            = 0xD3400000
+	arm64_CSINC           = 0x9A800400
+	arm64_MOVN            = 0x92800000
+	arm64_MOVZ            = 0xD2800000
+	arm64_MOVK            = 0xF2800000
+
+	arm64_LDR_imm         = 0xF9400000
+	arm64_STR_imm         = 0xF9000000
+	arm64_LDUR            = 0xF8400000
+	arm64_STUR            = 0xF8000000
+	arm64_LDR_lit         = 0x58000000
+	arm64_LDP             = 0xA9400000
+	arm64_STP             = 0xA9000000
+	arm64_LDP_post        = 0xA8C00000
+	arm64_STP_pre         = 0xA9800000
+	arm64_ADR             = 0x10000000
+
+	arm64_LDR_d_imm       = 0xFD400000
+	arm64_STR_d_imm       = 0xFD000000
+	arm64_LDUR_d          = 0xFC400000
+	arm64_STUR_d          = 0xFC000000
+	arm64_LDR_d_lit       = 0x5C000000
+	arm64_LDP_d           = 0x6D400000
+	arm64_STP_d           = 0x6D000000
+
+	arm64_B               = 0x14000000
+	arm64_BL              = 0x94000000
+	arm64_B_cond          = 0x54000000
+	arm64_CBZ             = 0xB4000000
+	arm64_CBNZ            = 0xB5000000
+	arm64_BR              = 0xD61F0000
+	arm64_BLR             = 0xD63F0000
+	arm64_RET             = 0xD65F0000
+	arm64_BRK             = 0xD4200000
+	arm64_NOP             = 0xD503201F
+
+	arm64_FADD            = 0x1E602800
+	arm64_FSUB            = 0x1E603800
+	arm64_FMUL            = 0x1E600800
+	arm64_FDIV            = 0x1E601800
+	arm64_FSQRT           = 0x1E61C000
+	arm64_FMOV_reg        = 0x1E604000
+	arm64_FMOV_to_gpr     = 0x9E660000
+	arm64_FMOV_from_gpr   = 0x9E670000
+	arm64_SCVTF           = 0x9E620000
+	arm64_FCVTZS          = 0x9E780000
+	arm64_FCMP            = 0x1E602000
+)
+
+/*******************************************************************
+ * Instruction buffer 
+ *******************************************************************/
+type Arm64Buffer struct {
+    *bytes.Buffer
+}
+
+func (buf *Arm64Buffer) emit(ins uint32) {
+    binary.Write(buf, binary.LittleEndian, ins)
+}
+
+/*******************************************************************
+ * Instruction formatting functions
+ *******************************************************************/
+
+// Formats an instruction with a destination and up to two source registers.
+func (buf *Arm64Buffer) fmtRRR(op uint32, rd, rn, rm RegisterId) {
+    buf.emit(op | uint32(rm & 31) << 16 | uint32(rn & 31) << 5 | uint32(rd & 31))
+}
+
+// Formats an add or subtract of a 12-bit unsigned immediate, optionally shifted left by
+// 12 bits.  Other immediates have to be loaded into a register first.
+func (buf *Arm64Buffer) fmtImm12(op uint32, rd, rn RegisterId, imm int64) {
+    var shift uint32
+    if imm & 0xfff != 0 || imm < 0 {
+        if imm < 0 || imm > 0xfff {
+            panic(fmt.Sprintf("arm64: immediate %d can't be encoded", imm))
+        }
+    } else if imm > 0xfff {
+        if imm > 0xfff << 12 {
+            panic(fmt.Sprintf("arm64: immediate %d can't be encoded", imm))
+        }
+        imm >>= 12
+        shift = 1
+    }
+    buf.emit(op | shift << 22 | uint32(imm) << 10 | uint32(rn & 31) << 5 | uint32(rd & 31))
+}
+
+// Formats a load or store at offset from base.  Offsets that are a non-negative multiple
+// of the access size use the scaled form, and small offsets the unscaled one.
+func (buf *Arm64Buffer) fmtMem(scaled, unscaled uint32, rt, base RegisterId, offset int) {
+    if offset >= 0 && offset % 8 == 0 && offset / 8 < 4096 {
+        buf.emit(scaled | uint32(offset / 8) << 10 | uint32(base & 31) << 5 | uint32(rt & 31))
+        return
+    }
+    if offset < -256 || offset > 255 {
+        panic(fmt.Sprintf("arm64: memory offset %d can't be encoded", offset))
+    }
+    buf.emit(unscaled | uint32(offset & 0x1ff) << 12 | uint32(base & 31) << 5 | uint32(rt & 31))
+}
+
+// Formats a load or store of a pair of registers.
+func (buf *Arm64Buffer) fmtPair(op uint32, rt, rt2, base RegisterId, offset int) {
+    if offset % 8 != 0 || offset < -512 || offset > 504 {
+        panic(fmt.Sprintf("arm64: pair offset %d can't be encoded", offset))
+    }
+    buf.emit(op | uint32(offset / 8 & 0x7f) << 15 | uint32(rt2 & 31) << 10 |
+             uint32(base & 31) << 5 | uint32(rt & 31))
+}
+
+// Formats an instruction whose target is patched by LinkJump, and returns its source.
+func (buf *Arm64Buffer) fmtBranch(ins uint32) JmpSrc {
+    src := JmpSrc{buf.Len(), false}
+    buf.emit(ins)
+    return src
+}
+
+/*******************************************************************
+ * Instruction emitters
+ *******************************************************************/
+
+func (buf *Arm64Buffer) MovRR(rd, rm RegisterId) {
+    buf.fmtRRR(arm64_ORR_reg, rd, arm64_xzr, rm)
+}
+
+func (buf *Arm64Buffer) MovzRI(rd RegisterId, imm uint16, shift uint) {
+    buf.emit(arm64_MOVZ | uint32(shift / 16) << 21 | uint32(imm) << 5 | uint32(rd & 31))
+}
+
+func (buf *Arm64Buffer) MovkRI(rd RegisterId, imm uint16, shift uint) {
+    buf.emit(arm64_MOVK | uint32(shift / 16) << 21 | uint32(imm) << 5 | uint32(rd & 31))
+}
+
+// Loads any 64-bit constant into rd, with a movz or movn and a movk for each 16 bits
+// that the first doesn't already set.
+func (buf *Arm64Buffer) MovRI(rd RegisterId, imm uint64) {
+    zeros, ones := 0, 0
+    for shift := uint(0); shift < 64; shift += 16 {
+        switch uint16(imm >> shift) {
+            case 0:
+                zeros++
+            case 0xffff:
+                ones++
+        }
+    }
+    
+    // Start from all ones when more of the chunks are ones than zeros.
+    fill, first := uint16(0), uint32(arm64_MOVZ)
+    if ones > zeros {
+        fill, first = 0xffff, arm64_MOVN
+    }
+    
+    emitted := false
+    for shift := uint(0); shift < 64; shift += 16 {
+        chunk := uint16(imm >> shift)
+        if chunk == fill {
+            continue
+        }
+        if !emitted {
+            buf.emit(first | uint32(shift / 16) << 21 | uint32(chunk ^ fill) << 5 | uint32(rd & 31))
+            emitted = true
+        } else {
+            buf.MovkRI(rd, chunk, shift)
+        }
+    }
+    if !emitted {
+        buf.emit(first | uint32(rd & 31))
+    }
+}
+
+func (buf *Arm64Buffer) AddRRR(rd, rn, rm RegisterId) {
+    buf.fmtRRR(arm64_ADD_reg, rd, rn, rm)
+}
+
+// Adds an immediate, which may be negative.  Register 31 is sp here, so AddRRI(rd, sp, 0)
+// copies the stack pointer.
+func (buf *Arm64Buffer) AddRRI(rd, rn RegisterId, imm int64) {
+    if imm < 0 {
+        buf.fmtImm12(arm64_SUB_imm, rd, rn, -imm)
+        return
+    }
+    buf.fmtImm12(arm64_ADD_imm, rd, rn, imm)
+}
+
+func (buf *Arm64Buffer) SubRRR(rd, rn, rm RegisterId) {
+    buf.fmtRRR(arm64_SUB_reg, rd, rn, rm)
+}
+
+func (buf *Arm64Buffer) SubRRI(rd, rn RegisterId, imm int64) {
+    buf.AddRRI(rd, rn, -imm)
+}
+
+func (buf *Arm64Buffer) MulRRR(rd, rn, rm RegisterId) {
+    buf.emit(arm64_MADD | uint32(rm & 31) << 16 | arm64_xzr << 10 | uint32(rn & 31) << 5 | uint32(rd & 31))
+}
+
+// Computes ra - rn * rm, which gives the remainder of a division.
+func (buf *Arm64Buffer) MsubRRRR(rd, rn, rm, ra RegisterId) {
+    buf.emit(arm64_MSUB | uint32(rm & 31) << 16 | uint32(ra & 31) << 10 | uint32(rn & 31) << 5 | uint32(rd & 31))
+}
+
+// Divides signed values, rounding towards zero.  Dividing by zero gives zero rather than
+// trapping, so callers check the divisor themselves.
+func (buf *Arm64Buffer) SdivRRR(rd, rn, rm RegisterId) {
+    buf.fmtRRR(arm64_SDIV, rd, rn, rm)
+}
+
+func (buf *Arm64Buffer) NegRR(rd, rm RegisterId) {
+    buf.fmtRRR(arm64_SUB_reg, rd, arm64_xzr, rm)
+}
+
+func (buf *Arm64Buffer) AndRRR(rd, rn, rm RegisterId) {
+    buf.fmtRRR(arm64_AND_reg, rd, rn, rm)
+}
+
+func (buf *Arm64Buffer) OrrRRR(rd, rn, rm RegisterId) {
+    buf.fmtRRR(arm64_ORR_reg, rd, rn, rm)
+}
+
+func (buf *Arm64Buffer) EorRRR(rd, rn, rm RegisterId) {
+    buf.fmtRRR(arm64_EOR_reg, rd, rn, rm)
+}
+
+func (buf *Arm64Buffer) MvnRR(rd, rm RegisterId) {
+    buf.fmtRRR(arm64_ORN_reg, rd, arm64_xzr, rm)
+}
+
+func (buf *Arm64Buffer) LslRRR(rd, rn, rm RegisterId) {
+    buf.fmtRRR(arm64_LSLV, rd, rn, rm)
+}
+
+func (buf *Arm64Buffer) LsrRRR(rd, rn, rm RegisterId) {
+    buf.fmtRRR(arm64_LSRV, rd, rn, rm)
+}
+
+func (buf *Arm64Buffer) AsrRRR(rd, rn, rm RegisterId) {
+    buf.fmtRRR(arm64_ASRV, rd, rn, rm)
+}
+
+func (buf *Arm64Buffer) LslRRI(rd, rn RegisterId, shift uint) {
+    shift &= 63
+    buf.emit(arm64_UBFM | uint32(-shift & 63) << 16 | uint32(63 - shift) << 10 |
+             uint32(rn & 31) << 5 | uint32(rd & 31))
+}
+
+func (buf *Arm64Buffer) AsrRRI(rd, rn RegisterId, shift uint) {
+    buf.emit(arm64_SBFM | uint32(shift & 63) << 16 | 63 << 10 | uint32(rn & 31) << 5 | uint32(rd & 31))
+}
+
+func (buf *Arm64Buffer) CmpRR(rn, rm RegisterId) {
+    buf.fmtRRR(arm64_SUBS_reg, arm64_xzr, rn, rm)
+}
+
+func (buf *Arm64Buffer) CmpRI(rn RegisterId, imm int64) {
+    if imm < 0 {
+        buf.fmtImm12(arm64_ADDS_imm, arm64_xzr, rn, -imm)
+        return
+    }
+    buf.fmtImm12(arm64_SUBS_imm, arm64_xzr, rn, imm)
+}
+
+func (buf *Arm64Buffer) TstRR(rn, rm RegisterId) {
+    buf.fmtRRR(arm64_ANDS_reg, arm64_xzr, rn, rm)
+}
+
+// Sets rd to 1 if the condition holds, and to 0 if it doesn't.
+func (buf *Arm64Buffer) CsetR(rd RegisterId, cond uint8) {
+    buf.emit(arm64_CSINC | arm64_xzr << 16 | uint32(cond ^ 1) << 12 | arm64_xzr << 5 | uint32(rd & 31))
+}
+
+func (buf *Arm64Buffer) LdrRM(rt, base RegisterId, offset int) {
+    buf.fmtMem(arm64_LDR_imm, arm64_LDUR, rt, base, offset)
+}
+
+func (buf *Arm64Buffer) StrRM(rt, base RegisterId, offset int) {
+    buf.fmtMem(arm64_STR_imm, arm64_STUR, rt, base, offset)
+}
+
+func (buf *Arm64Buffer) LdpRRM(rt, rt2, base RegisterId, offset int) {
+    buf.fmtPair(arm64_LDP, rt, rt2, base, offset)
+}
+
+func (buf *Arm64Buffer) StpRRM(rt, rt2, base RegisterId, offset int) {
+    buf.fmtPair(arm64_STP, rt, rt2, base, offset)
+}
+
+// Pushes a pair of registers, keeping sp 16-byte aligned as the architecture requires.
+func (buf *Arm64Buffer) PushPairRR(rt, rt2 RegisterId) {
+    buf.fmtPair(arm64_STP_pre, rt, rt2, arm64_sp, -16)
+}
+
+func (buf *Arm64Buffer) PopPairRR(rt, rt2 RegisterId) {
+    buf.fmtPair(arm64_LDP_post, rt, rt2, arm64_sp, 16)
+}
+
+func (buf *Arm64Buffer) B() JmpSrc {
+    return buf.fmtBranch(arm64_B)
+}
+
+func (buf *Arm64Buffer) Bcond(cond uint8) JmpSrc {
+    return buf.fmtBranch(arm64_B_cond | uint32(cond & 15))
+}
+
+func (buf *Arm64Buffer) Bl() JmpSrc {
+    return buf.fmtBranch(arm64_BL)
+}
+
+func (buf *Arm64Buffer) Cbz(rt RegisterId) JmpSrc {
+    return buf.fmtBranch(arm64_CBZ | uint32(rt & 31))
+}
+
+func (buf *Arm64Buffer) Cbnz(rt RegisterId) JmpSrc {
+    return buf.fmtBranch(arm64_CBNZ | uint32(rt & 31))
+}
+
+func (buf *Arm64Buffer) BrR(rn RegisterId) {
+    buf.emit(arm64_BR | uint32(rn & 31) << 5)
+}
+
+func (buf *Arm64Buffer) BlrR(rn RegisterId) {
+    buf.emit(arm64_BLR | uint32(rn & 31) << 5)
+}
+
+// Returns to the address in the link register.
+func (buf *Arm64Buffer) Ret() {
+    buf.emit(arm64_RET | uint32(arm64_lr) << 5)
+}
+
+func (buf *Arm64Buffer) Brk(imm uint16) {
+    buf.emit(arm64_BRK | uint32(imm) << 5)
+}
+
+func (buf *Arm64Buffer) Nop() {
+    buf.emit(arm64_NOP)
+}
+
+/*******************************************************************
+ * Floating point emitters
+ *******************************************************************/
+
+func (buf *Arm64Buffer) FaddDDD(dd, dn, dm RegisterId) {
+    buf.fmtRRR(arm64_FADD, dd, dn, dm)
+}
+
+func (buf *Arm64Buffer) FsubDDD(dd, dn, dm RegisterId) {
+    buf.fmtRRR(arm64_FSUB, dd, dn, dm)
+}
+
+func (buf *Arm64Buffer) FmulDDD(dd, dn, dm RegisterId) {
+    buf.fmtRRR(arm64_FMUL, dd, dn, dm)
+}
+
+func (buf *Arm64Buffer) FdivDDD(dd, dn, dm RegisterId) {
+    buf.fmtRRR(arm64_FDIV, dd, dn, dm)
+}
+
+func (buf *Arm64Buffer) FsqrtDD(dd, dn RegisterId) {
+    buf.fmtRRR(arm64_FSQRT, dd, dn, 0)
+}
+
+func (buf *Arm64Buffer) FmovDD(dd, dn RegisterId) {
+    buf.fmtRRR(arm64_FMOV_reg, dd, dn, 0)
+}
+
+// Moves the bits of a double into a general register, and back.
+func (buf *Arm64Buffer) FmovRD(rd, dn RegisterId) {
+    buf.fmtRRR(arm64_FMOV_to_gpr, rd, dn, 0)
+}
+
+func (buf *Arm64Buffer) FmovDR(dd, rn RegisterId) {
+    buf.fmtRRR(arm64_FMOV_from_gpr, dd, rn, 0)
+}
+
+// Converts a signed integer to a double.
+func (buf *Arm64Buffer) ScvtfDR(dd, rn RegisterId) {
+    buf.fmtRRR(arm64_SCVTF, dd, rn, 0)
+}
+
+// Converts a double to a signed integer, rounding towards zero.
+func (buf *Arm64Buffer) FcvtzsRD(rd, dn RegisterId) {
+    buf.fmtRRR(arm64_FCVTZS, rd, dn, 0)
+}
+
+// Compares two doubles.  An unordered comparison sets the C and V flags, so the VS
+// condition detects a NaN.
+func (buf *Arm64Buffer) FcmpDD(dn, dm RegisterId) {
+    buf.fmtRRR(arm64_FCMP, 0, dn, dm)
+}
+
+func (buf *Arm64Buffer) LdrDM(dt, base RegisterId, offset int) {
+    buf.fmtMem(arm64_LDR_d_imm, arm64_LDUR_d, dt, base, offset)
+}
+
+func (buf *Arm64Buffer) StrDM(dt, base RegisterId, offset int) {
+    buf.fmtMem(arm64_STR_d_imm, arm64_STUR_d, dt, base, offset)
+}
+
+func (buf *Arm64Buffer) LdpDDM(dt, dt2, base RegisterId, offset int) {
+    buf.fmtPair(arm64_LDP_d, dt, dt2, base, offset)
+}
+
+func (buf *Arm64Buffer) StpDDM(dt, dt2, base RegisterId, offset int) {
+    buf.fmtPair(arm64_STP_d, dt, dt2, base, offset)
+}
+
+// Pads the code with brk until its length is a multiple of n, which must be a power
+// of two.
+func (buf *Arm64Buffer) Align(n int) {
+    for buf.Len() % n != 0 {
+        buf.Brk(0)
+    }
+}
+
+func (buf *Arm64Buffer) Quad(v uint64) {
+    binary.Write(buf, binary.LittleEndian, v)
+}
+
+/*******************************************************************
+ * Labels and relocations
+ *******************************************************************/
+
+// The source of an ARM64 jump is the offset of the instruction itself, rather than of
+// the end of its displacement as on x86, and LinkJump works out which field to patch
+// from the instruction there.
+
+// Returns the current end of the code, as a jump destination.
+func (buf *Arm64Buffer) Here() (JmpDst) {
+    return JmpDst{buf.Len(), false}
+}
+
+// Patches the instruction at src so that it refers to dst.
+func (buf *Arm64Buffer) LinkJump(src JmpSrc, dst JmpDst) (os.Error) {
+    code := buf.Bytes()
+    if src.offset < 0 || src.offset + 4 > len(code) || dst.offset < 0 || dst.offset > len(code) {
+        return os.NewError(fmt.Sprintf("arm64: jump at %d to %d is outside the %d bytes of code",
+                                       src.offset, dst.offset, len(code)))
+    }
+    
+    ins := binary.LittleEndian.Uint32(code[src.offset:])
+    rel := int64(dst.offset) - int64(src.offset)
+    words := rel >> 2
+    switch {
+        case ins & 0x9F000000 == arm64_ADR:
+            if rel < -1<<20 || rel >= 1<<20 {
+                return JumpOutOfRange
+            }
+            ins = ins &^ 0x60FFFFE0 | uint32(rel & 3) << 29 | uint32(rel >> 2 & 0x7ffff) << 5
+        
+        case ins & 0x7C000000 == arm64_B:
+            if words < -1<<25 || words >= 1<<25 {
+                return JumpOutOfRange
+            }
+            ins = ins &^ 0x03FFFFFF | uint32(words & 0x3ffffff)
+        
+        case ins & 0xFF000010 == arm64_B_cond,
+             ins & 0x7E000000 == arm64_CBZ & 0x7E000000,
+             ins & 0xBB000000 == arm64_LDR_lit & 0xBB000000:
+            if words < -1<<18 || words >= 1<<18 {
+                return JumpOutOfRange
+            }
+            ins = ins &^ 0x00FFFFE0 | uint32(words & 0x7ffff) << 5
+        
+        default:
+            return os.NewError(fmt.Sprintf("arm64: no jump at %d", src.offset))
+    }
+    
+    binary.LittleEndian.PutUint32(code[src.offset:], ins)
+    return nil
+}
+
+// Binds the label to the current end of the code, and patches the jumps to it.
+func (buf *Arm64Buffer) Bind(l *Label) (os.Error) {
+    if l.bound {
+        return LabelRebound
+    }
+    
+    l.dst, l.bound = buf.Here(), true
+    pending := l.pending
+    l.pending = nil
+    for _, src := range pending {
+        if err := buf.LinkJump(src, l.dst); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Links the instruction at src to the label, now if it is bound, or when it is.
+func (buf *Arm64Buffer) Use(src JmpSrc, l *Label) (os.Error) {
+    l.dst.used = true
+    if l.bound {
+        return buf.LinkJump(src, l.dst)
+    }
+    
+    l.pending = append(l.pending, src)
+    return nil
+}
+
+func (buf *Arm64Buffer) BTo(l *Label) (os.Error) {
+    return buf.Use(buf.B(), l)
+}
+
+func (buf *Arm64Buffer) BcondTo(cond uint8, l *Label) (os.Error) {
+    return buf.Use(buf.Bcond(cond), l)
+}
+
+func (buf *Arm64Buffer) BlTo(l *Label) (os.Error) {
+    return buf.Use(buf.Bl(), l)
+}
+
+func (buf *Arm64Buffer) CbzTo(rt RegisterId, l *Label) (os.Error) {
+    return buf.Use(buf.Cbz(rt), l)
+}
+
+func (buf *Arm64Buffer) CbnzTo(rt RegisterId, l *Label) (os.Error) {
+    return buf.Use(buf.Cbnz(rt), l)
+}
+
+// Loads the 64-bit value at the label, which must be within a megabyte.
+func (buf *Arm64Buffer) LdrRP(rt RegisterId, l *Label) (os.Error) {
+    return buf.Use(buf.fmtBranch(arm64_LDR_lit | uint32(rt & 31)), l)
+}
+
+func (buf *Arm64Buffer) LdrDP(dt RegisterId, l *Label) (os.Error) {
+    return buf.Use(buf.fmtBranch(arm64_LDR_d_lit | uint32(dt & 31)), l)
+}
+
+// Loads the address of the label.
+func (buf *Arm64Buffer) AdrRP(rd RegisterId, l *Label) (os.Error) {
+    return buf.Use(buf.fmtBranch(arm64_ADR | uint32(rd & 31)), l)
+}
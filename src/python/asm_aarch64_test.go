@@ -0,0 +1,191 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the ARM64 assembler, against the machine code a real assembler
+  produces for each instruction.
+
+*/
+
+package python
+
+import (
+        "bytes"
+        "encoding/binary"
+        "testing"
+)
+
+type arm64Test struct {
+    name    string
+    emit    func(buf *Arm64Buffer)
+    want    []uint32
+}
+
+var arm64Tests = []arm64Test {
+    {"mov x0, x1", func(b *Arm64Buffer) { b.MovRR(arm64_x0, arm64_x1) }, []uint32{0xaa0103e0}},
+    {"movz x0, #0x1234", func(b *Arm64Buffer) { b.MovzRI(arm64_x0, 0x1234, 0) }, []uint32{0xd2824680}},
+    {"movk x0, #0x1234, lsl #16", func(b *Arm64Buffer) { b.MovkRI(arm64_x0, 0x1234, 16) }, []uint32{0xf2a24680}},
+    {"mov x0, #0x12345678", func(b *Arm64Buffer) { b.MovRI(arm64_x0, 0x12345678) }, []uint32{0xd28acf00, 0xf2a24680}},
+    {"mov x0, #0", func(b *Arm64Buffer) { b.MovRI(arm64_x0, 0) }, []uint32{0xd2800000}},
+    {"mov x0, #-1", func(b *Arm64Buffer) { b.MovRI(arm64_x0, ^uint64(0)) }, []uint32{0x92800000}},
+    {"movn x1, #0xedcb", func(b *Arm64Buffer) { b.MovRI(arm64_x1, 0xffffffffffff1234) }, []uint32{0x929db961}},
+    {"add x0, x1, x2", func(b *Arm64Buffer) { b.AddRRR(arm64_x0, arm64_x1, arm64_x2) }, []uint32{0x8b020020}},
+    {"add x0, x0, #1", func(b *Arm64Buffer) { b.AddRRI(arm64_x0, arm64_x0, 1) }, []uint32{0x91000400}},
+    {"add x0, x1, #1, lsl #12", func(b *Arm64Buffer) { b.AddRRI(arm64_x0, arm64_x1, 0x1000) }, []uint32{0x91400420}},
+    {"sub x0, x1, #8", func(b *Arm64Buffer) { b.AddRRI(arm64_x0, arm64_x1, -8) }, []uint32{0xd1002020}},
+    {"mov x29, sp", func(b *Arm64Buffer) { b.AddRRI(arm64_fp, arm64_sp, 0) }, []uint32{0x910003fd}},
+    {"sub sp, sp, #32", func(b *Arm64Buffer) { b.SubRRI(arm64_sp, arm64_sp, 32) }, []uint32{0xd10083ff}},
+    {"sub x3, x4, x5", func(b *Arm64Buffer) { b.SubRRR(arm64_x3, arm64_x4, arm64_x5) }, []uint32{0xcb050083}},
+    {"mul x0, x1, x2", func(b *Arm64Buffer) { b.MulRRR(arm64_x0, arm64_x1, arm64_x2) }, []uint32{0x9b027c20}},
+    {"msub x0, x1, x2, x3", func(b *Arm64Buffer) { b.MsubRRRR(arm64_x0, arm64_x1, arm64_x2, arm64_x3) }, []uint32{0x9b028c20}},
+    {"sdiv x0, x1, x2", func(b *Arm64Buffer) { b.SdivRRR(arm64_x0, arm64_x1, arm64_x2) }, []uint32{0x9ac20c20}},
+    {"neg x0, x1", func(b *Arm64Buffer) { b.NegRR(arm64_x0, arm64_x1) }, []uint32{0xcb0103e0}},
+    {"and x0, x1, x2", func(b *Arm64Buffer) { b.AndRRR(arm64_x0, arm64_x1, arm64_x2) }, []uint32{0x8a020020}},
+    {"orr x0, x1, x2", func(b *Arm64Buffer) { b.OrrRRR(arm64_x0, arm64_x1, arm64_x2) }, []uint32{0xaa020020}},
+    {"eor x0, x1, x2", func(b *Arm64Buffer) { b.EorRRR(arm64_x0, arm64_x1, arm64_x2) }, []uint32{0xca020020}},
+    {"mvn x0, x1", func(b *Arm64Buffer) { b.MvnRR(arm64_x0, arm64_x1) }, []uint32{0xaa2103e0}},
+    {"lsl x0, x1, x2", func(b *Arm64Buffer) { b.LslRRR(arm64_x0, arm64_x1, arm64_x2) }, []uint32{0x9ac22020}},
+    {"asr x0, x1, x2", func(b *Arm64Buffer) { b.AsrRRR(arm64_x0, arm64_x1, arm64_x2) }, []uint32{0x9ac22820}},
+    {"lsl x0, x1, #3", func(b *Arm64Buffer) { b.LslRRI(arm64_x0, arm64_x1, 3) }, []uint32{0xd37df020}},
+    {"asr x0, x1, #1", func(b *Arm64Buffer) { b.AsrRRI(arm64_x0, arm64_x1, 1) }, []uint32{0x9341fc20}},
+    {"cmp x0, x1", func(b *Arm64Buffer) { b.CmpRR(arm64_x0, arm64_x1) }, []uint32{0xeb01001f}},
+    {"cmp x0, #10", func(b *Arm64Buffer) { b.CmpRI(arm64_x0, 10) }, []uint32{0xf100281f}},
+    {"cmn x0, #1", func(b *Arm64Buffer) { b.CmpRI(arm64_x0, -1) }, []uint32{0xb100041f}},
+    {"tst x0, x1", func(b *Arm64Buffer) { b.TstRR(arm64_x0, arm64_x1) }, []uint32{0xea01001f}},
+    {"cset x0, eq", func(b *Arm64Buffer) { b.CsetR(arm64_x0, arm64_conditionEQ) }, []uint32{0x9a9f17e0}},
+    {"ldr x0, [x1, #8]", func(b *Arm64Buffer) { b.LdrRM(arm64_x0, arm64_x1, 8) }, []uint32{0xf9400420}},
+    {"ldr x2, [sp]", func(b *Arm64Buffer) { b.LdrRM(arm64_x2, arm64_sp, 0) }, []uint32{0xf94003e2}},
+    {"ldur x0, [x1, #3]", func(b *Arm64Buffer) { b.LdrRM(arm64_x0, arm64_x1, 3) }, []uint32{0xf8403020}},
+    {"stur x0, [x29, #-8]", func(b *Arm64Buffer) { b.StrRM(arm64_x0, arm64_fp, -8) }, []uint32{0xf81f83a0}},
+    {"stp x29, x30, [sp, #-16]!", func(b *Arm64Buffer) { b.PushPairRR(arm64_fp, arm64_lr) }, []uint32{0xa9bf7bfd}},
+    {"ldp x29, x30, [sp], #16", func(b *Arm64Buffer) { b.PopPairRR(arm64_fp, arm64_lr) }, []uint32{0xa8c17bfd}},
+    {"stp x19, x20, [sp, #16]", func(b *Arm64Buffer) { b.StpRRM(arm64_x19, arm64_x20, arm64_sp, 16) }, []uint32{0xa90153f3}},
+    {"stp d8, d9, [sp, #32]", func(b *Arm64Buffer) { b.StpDDM(8, 9, arm64_sp, 32) }, []uint32{0x6d0227e8}},
+    {"blr x16", func(b *Arm64Buffer) { b.BlrR(arm64_x16) }, []uint32{0xd63f0200}},
+    {"br x17", func(b *Arm64Buffer) { b.BrR(arm64_x17) }, []uint32{0xd61f0220}},
+    {"ret", func(b *Arm64Buffer) { b.Ret() }, []uint32{0xd65f03c0}},
+    {"brk #0", func(b *Arm64Buffer) { b.Brk(0) }, []uint32{0xd4200000}},
+    {"nop", func(b *Arm64Buffer) { b.Nop() }, []uint32{0xd503201f}},
+    {"fadd d0, d1, d2", func(b *Arm64Buffer) { b.FaddDDD(arm64_d0, arm64_d1, arm64_d2) }, []uint32{0x1e622820}},
+    {"fsub d0, d1, d2", func(b *Arm64Buffer) { b.FsubDDD(arm64_d0, arm64_d1, arm64_d2) }, []uint32{0x1e623820}},
+    {"fmul d0, d0, d1", func(b *Arm64Buffer) { b.FmulDDD(arm64_d0, arm64_d0, arm64_d1) }, []uint32{0x1e610800}},
+    {"fdiv d0, d0, d1", func(b *Arm64Buffer) { b.FdivDDD(arm64_d0, arm64_d0, arm64_d1) }, []uint32{0x1e611800}},
+    {"fsqrt d0, d1", func(b *Arm64Buffer) { b.FsqrtDD(arm64_d0, arm64_d1) }, []uint32{0x1e61c020}},
+    {"fmov d0, d1", func(b *Arm64Buffer) { b.FmovDD(arm64_d0, arm64_d1) }, []uint32{0x1e604020}},
+    {"fmov x0, d1", func(b *Arm64Buffer) { b.FmovRD(arm64_x0, arm64_d1) }, []uint32{0x9e660020}},
+    {"fmov d0, x1", func(b *Arm64Buffer) { b.FmovDR(arm64_d0, arm64_x1) }, []uint32{0x9e670020}},
+    {"scvtf d0, x1", func(b *Arm64Buffer) { b.ScvtfDR(arm64_d0, arm64_x1) }, []uint32{0x9e620020}},
+    {"fcvtzs x0, d1", func(b *Arm64Buffer) { b.FcvtzsRD(arm64_x0, arm64_d1) }, []uint32{0x9e780020}},
+    {"fcmp d0, d1", func(b *Arm64Buffer) { b.FcmpDD(arm64_d0, arm64_d1) }, []uint32{0x1e612000}},
+    {"ldr d0, [x1, #16]", func(b *Arm64Buffer) { b.LdrDM(arm64_d0, arm64_x1, 16) }, []uint32{0xfd400820}},
+    {"str d1, [sp, #8]", func(b *Arm64Buffer) { b.StrDM(arm64_d1, arm64_sp, 8) }, []uint32{0xfd0007e1}},
+}
+
+// Returns the instruction words as the little-endian bytes the assembler emits.
+func arm64Words(words ...uint32) []byte {
+    code := make([]byte, 4 * len(words))
+    for i, w := range words {
+        binary.LittleEndian.PutUint32(code[4 * i:], w)
+    }
+    return code
+}
+
+func TestArm64Assembler(t *testing.T) {
+    for _, test := range arm64Tests {
+        buf := &Arm64Buffer{new(bytes.Buffer)}
+        test.emit(buf)
+        if want := arm64Words(test.want...); !bytes.Equal(buf.Bytes(), want) {
+            t.Errorf("%s: expected % x, got % x", test.name, want, buf.Bytes())
+        }
+    }
+}
+
+func TestArm64Labels(t *testing.T) {
+    buf := &Arm64Buffer{new(bytes.Buffer)}
+    
+    top, done, fn, constant := new(Label), new(Label), new(Label), new(Label)
+    buf.Bind(top)
+    buf.AddRRI(arm64_x0, arm64_x0, 1)
+    if err := buf.CbzTo(arm64_x0, done); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if err := buf.BcondTo(arm64_conditionNE, top); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    buf.BlTo(fn)
+    buf.Bind(done)
+    buf.Ret()
+    
+    buf.Bind(fn)
+    buf.LdrRP(arm64_x1, constant)
+    buf.Ret()
+    buf.Align(8)
+    buf.Bind(constant)
+    buf.Quad(0x1122334455667788)
+    
+    want := arm64Words(0x91000400,
+                       0xb4000060,
+                       0x54ffffc1,
+                       0x94000002,
+                       0xd65f03c0,
+                       0x58000061,
+                       0xd65f03c0,
+                       0xd4200000,
+                       0x55667788, 0x11223344)
+    if !bytes.Equal(buf.Bytes(), want) {
+        t.Errorf("expected % x, got % x", want, buf.Bytes())
+    }
+    
+    if err := buf.Bind(top); err != LabelRebound {
+        t.Errorf("expected rebinding a label to fail, got %v", err)
+    }
+    if err := buf.LinkJump(JmpSrc{0, false}, buf.Here()); err == nil {
+        t.Errorf("expected linking an add to fail")
+    }
+}
+
+func TestArm64LabelFar(t *testing.T) {
+    buf := &Arm64Buffer{new(bytes.Buffer)}
+    
+    // A conditional branch reaches a megabyte, and an adr the same.
+    far, address := new(Label), new(Label)
+    buf.AdrRP(arm64_x0, address)
+    buf.Nop()
+    buf.Bind(address)
+    buf.BcondTo(arm64_conditionEQ, far)
+    for i := 0; i < 1<<18; i++ {
+        buf.Nop()
+    }
+    if err := buf.Bind(far); err != JumpOutOfRange {
+        t.Errorf("expected the branch to be out of range, got %v", err)
+    }
+    if code := buf.Bytes()[:4]; !bytes.Equal(code, arm64Words(0x10000040)) {
+        t.Errorf("expected adr x0, #8, got % x", code)
+    }
+}
+
+func TestNewAssembler(t *testing.T) {
+    for _, arch := range []string{"386", "amd64", "arm64"} {
+        if _, err := NewAssembler(arch); err != nil {
+            t.Errorf("%s: unexpected error: %v", arch, err)
+        }
+    }
+    if buf, _ := NewAssembler("amd64"); !buf.(*X86Buffer).IsX64 {
+        t.Errorf("expected the amd64 assembler to be x86-64")
+    }
+    if _, err := NewAssembler("mips"); err != UnsupportedArch {
+        t.Errorf("expected mips to be unsupported, got %v", err)
+    }
+}
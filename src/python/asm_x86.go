@@ -15,12 +15,24 @@
    --------------------------------------------------------------------
 
    This file provides the implementation of the x86 in-memory assembler.
+   The instruction emitters follow the AT&T operand order, source first, and
+   are named after the instruction, its operand size and the kinds of its
+   operands, R for a register, M for memory at an offset from a base
+   register and I for an immediate, so MovlMR loads a 32-bit value from
+   memory into a register.  S is memory at offset + base + index * scale, and
+   P is memory at a label, addressed relative to the instruction pointer.  The
+   q and P forms only exist on x86-64.  An immediate is encoded in the
+   shortest form that holds it, so the same emitter may produce a byte, a
+   sign extended 32-bit value or, for MovqIR, a full 64-bit one.
 */
 
 package python
 
 import "bytes"
 import "encoding/binary"
+import "fmt"
+import "math"
+import "os"
 
 type RegisterId uint8
 
@@ -84,6 +96,7 @@ type OneByteOpcodeId uint8
 const (
 	x86_ADD_EvGv                     OneByteOpcodeId = 0x01
 	x86_ADD_GvEv                     = 0x03
+	x86_ADD_EAXIv                    = 0x05
 	x86_OR_EvGv                      = 0x09
 	x86_OR_GvEv                      = 0x0B
 	x86_2BYTE_ESCAPE                 = 0x0F
@@ -98,12 +111,15 @@ const (
 	x86_CMP_GvEv                     = 0x3B
 	x64_PRE_REX                      = 0x40
 	x86_PUSH_EAX                     = 0x50
-	x86_Px86_EAX                     = 0x58
+	x86_POP_EAX                      = 0x58
 	x64_MOVSXD_GvEv                  = 0x63
 	x86_PRE_OPERAND_SIZE             = 0x66
 	x86_PRE_SSE_66                   = 0x66
 	x86_PUSH_Iz                      = 0x68
 	x86_IMUL_GvEvIz                  = 0x69
+	x86_PUSH_Ib                      = 0x6A
+	x86_IMUL_GvEvIb                  = 0x6B
+	x86_JCC_rel8                     = 0x70
 	x86_GROUP1_EbIb                  = 0x80
 	x86_GROUP1_EvIz                  = 0x81
 	x86_GROUP1_EvIb                  = 0x83
@@ -125,7 +141,9 @@ const (
 	x86_GROUP2_EvCL                  = 0xD3
 	x86_CALL_rel32                   = 0xE8
 	x86_JMP_rel32                    = 0xE9
+	x86_JMP_rel8                     = 0xEB
 	x86_PRE_SSE_F2                   = 0xF2
+	x86_PRE_SSE_F3                   = 0xF3
 	x86_HLT                          = 0xF4
 	x86_GROUP3_EbIb                  = 0xF6
 	x86_GROUP3_Ev                    = 0xF7
@@ -139,6 +157,7 @@ type TwoByteOpcodeId uint8
 const (
 	x86_MOVSD_VsdWsd    TwoByteOpcodeId = 0x10
 	x86_MOVSD_WsdVsd    = 0x11
+	x86_CMOVCC          = 0x40
 	x86_CVTSI2SD_VsdEd  = 0x2A
 	x86_CVTTSD2SI_GdWsd = 0x2C
 	x86_UCOMISD_VsdWsd  = 0x2E
@@ -149,7 +168,9 @@ const (
 	x86_SQRTSD_VsdWsd   = 0x51
 	x86_XORPD_VpdWpd    = 0x57
 	x86_MOVD_VdEd       = 0x6E
+	x86_MOVDQU_VdqWdq   = 0x6F
 	x86_MOVD_EdVd       = 0x7E
+	x86_MOVDQU_WdqVdq   = 0x7F
 	x86_JCC_rel32       = 0x80
 	x86_SETCC           = 0x90
 	x86_IMUL_GvEv       = 0xAF
@@ -166,6 +187,10 @@ func setccOpcode(cond uint8) TwoByteOpcodeId {
 	return (TwoByteOpcodeId)(x86_SETCC + cond)
 }
 
+func cmovccOpcode(cond uint8) TwoByteOpcodeId {
+	return (TwoByteOpcodeId)(x86_CMOVCC + cond)
+}
+
 type GroupOpcodeId uint8
 
 const (
@@ -223,8 +248,11 @@ type X86Buffer struct {
  * Instruction formatting structures
  *******************************************************************/
 
+// The end of a jump, or call, whose displacement is patched once its destination is
+// known.  Short jumps have an 8-bit displacement, and the others a 32-bit one.
 type JmpSrc struct {
 	offset int
+	short  bool
 }
 
 type JmpDst struct {
@@ -296,7 +324,7 @@ func (buf *X86Buffer) registerModRM(reg, rm RegisterId) {
 
 func (buf *X86Buffer) memoryModRM(reg, base RegisterId, offset int32) {
     // A base of esp or r12 would be interpreted as a sib, so force a sib with no index & put the base in there.
-    if (buf.IsX64 && ((base == hasSib) || (base == hasSib2))) || (base == hasSib) { 
+    if base == hasSib || base == hasSib2 { 
         if (offset==0) { // No need to check if the base is noBase, since we know it is hasSib!
             buf.putModRmSib(ModRmMemoryNoDisp, reg, base, noIndex, 0)
         } else if (canSignExtend8to32(offset)) {
@@ -307,7 +335,8 @@ func (buf *X86Buffer) memoryModRM(reg, base RegisterId, offset int32) {
             binary.Write(buf, binary.LittleEndian, offset)
         }
     } else {
-        if (buf.IsX64 && (offset!=0 && (base != noBase) && (base != noBase2))) || (offset!=0 && (base != noBase)) { 
+        // A base of ebp or r13 without a displacement would be an absolute address, so they always get one.
+        if offset == 0 && base != noBase && base != noBase2 { 
             buf.putModRm(ModRmMemoryNoDisp, reg, base)
         } else if (canSignExtend8to32(offset)) {
             buf.putModRm(ModRmMemoryDisp8, reg, base)
@@ -321,7 +350,7 @@ func (buf *X86Buffer) memoryModRM(reg, base RegisterId, offset int32) {
 
 func (buf *X86Buffer) memoryModRMOffset32(reg, base RegisterId, offset int32) {
     // A base of esp or r12 would be interpreted as a sib, so force a sib with no index & put the base in there.
-    if (buf.IsX64 && (base == hasSib) || (base == hasSib2)) || (base == hasSib) {
+    if base == hasSib || base == hasSib2 {
         buf.putModRmSib(ModRmMemoryDisp32, reg, base, noIndex, 0)
         binary.Write(buf, binary.LittleEndian, offset)
     } else {
@@ -331,7 +360,7 @@ func (buf *X86Buffer) memoryModRMOffset32(reg, base RegisterId, offset int32) {
 }
 
 func (buf *X86Buffer) memoryModRMOffsetScale32(reg, base, index RegisterId, scale, offset int32) {
-    if (buf.IsX64 && offset!=0 && (base != noBase) && (base != noBase2)) || (offset!=0 && (base != noBase)) {
+    if offset == 0 && base != noBase && base != noBase2 {
         buf.putModRmSib(ModRmMemoryNoDisp, reg, base, index, scale)
     } else if (canSignExtend8to32(offset)) {
         buf.putModRmSib(ModRmMemoryDisp8, reg, base, index, scale)
@@ -348,6 +377,31 @@ func (buf *X86Buffer) memoryModRMAddress32(reg RegisterId, address int32) {
     binary.Write(buf, binary.LittleEndian, address)
 }
 
+// The encoding of the scale of an index, which is 1, 2, 4 or 8.
+func scaleBits(scale int32) int32 {
+    switch scale {
+        case 1:
+            return 0
+        case 2:
+            return 1
+        case 4:
+            return 2
+        case 8:
+            return 3
+    }
+    panic(fmt.Sprintf("x86: an index can't be scaled by %d", scale))
+}
+
+// Addresses memory at the label, relative to the end of the instruction, which is where the
+// displacement ends since none of the P forms have an immediate.  Returns where to patch.
+func (buf *X86Buffer) memoryModRMRip(reg RegisterId) JmpSrc {
+    if !buf.IsX64 {
+        panic("x86: addressing relative to the instruction pointer needs x86-64")
+    }
+    buf.putModRm(ModRmMemoryNoDisp, reg, noBase)
+    return immediateRel32(buf.Buffer)
+}
+
 // Check to see if we can extend the value 
 func canSignExtend8to32(value int32) bool {
     return value == int32(int8(value))
@@ -375,8 +429,13 @@ func immediate64(buf *bytes.Buffer, imm int64) {
 }
 
 func immediateRel32(buf *bytes.Buffer) JmpSrc {
-    binary.Write(buf, binary.LittleEndian, 0)
-    return JmpSrc { buf.Len() }
+    binary.Write(buf, binary.LittleEndian, int32(0))
+    return JmpSrc { buf.Len(), false }
+}
+
+func immediateRel8(buf *bytes.Buffer) JmpSrc {
+    buf.WriteByte(0)
+    return JmpSrc { buf.Len(), true }
 }
 
 // Registers r8 & above require a REX prefixe.
@@ -424,3 +483,883 @@ func (buf *X86Buffer) emitRexIf(condition bool, r, x, b RegisterId) {
 func (buf *X86Buffer) emitRexIfNeeded(r, x, b RegisterId) {
     buf.emitRexIf(buf.regRequiresRex(r) || buf.regRequiresRex(x) || buf.regRequiresRex(b), r, x, b);
 }
+
+// Word-sized operands:
+//
+// These methods format operations on 32-bit operands, or on 64-bit ones, which always
+// have a REX prefix with REX.W set.  A REX prefix is only planted for 32-bit operands if
+// a register operand, or the base of an address, is r8 or above.
+
+func (buf *X86Buffer) fmtOp(opcode OneByteOpcodeId, reg, rm RegisterId) {
+    buf.emitRexIfNeeded(reg, 0, rm)
+    buf.WriteByte(byte(opcode))
+    buf.registerModRM(reg, rm)
+}
+
+func (buf *X86Buffer) fmtOpMem(opcode OneByteOpcodeId, reg, base RegisterId, offset int32) {
+    buf.emitRexIfNeeded(reg, 0, base)
+    buf.WriteByte(byte(opcode))
+    buf.memoryModRM(reg, base, offset)
+}
+
+func (buf *X86Buffer) fmtOpIndex(opcode OneByteOpcodeId, reg, base, index RegisterId, scale, offset int32) {
+    if index == noIndex {
+        panic("x86: esp can't be an index")
+    }
+    buf.emitRexIfNeeded(reg, index, base)
+    buf.WriteByte(byte(opcode))
+    buf.memoryModRMOffsetScale32(reg, base, index, scaleBits(scale), offset)
+}
+
+// Formats an operation whose register is in the low bits of the opcode.
+func (buf *X86Buffer) fmtOpReg(opcode OneByteOpcodeId, reg RegisterId) {
+    buf.emitRexIfNeeded(0, 0, reg)
+    buf.WriteByte(byte(opcode) + byte(reg & 7))
+}
+
+func (buf *X86Buffer) fmtExtOp(opcode TwoByteOpcodeId, reg, rm RegisterId) {
+    buf.emitRexIfNeeded(reg, 0, rm)
+    buf.WriteByte(x86_2BYTE_ESCAPE)
+    buf.WriteByte(byte(opcode))
+    buf.registerModRM(reg, rm)
+}
+
+func (buf *X86Buffer) fmtExtOpMem(opcode TwoByteOpcodeId, reg, base RegisterId, offset int32) {
+    buf.emitRexIfNeeded(reg, 0, base)
+    buf.WriteByte(x86_2BYTE_ESCAPE)
+    buf.WriteByte(byte(opcode))
+    buf.memoryModRM(reg, base, offset)
+}
+
+func (buf *X86Buffer) fmtOp64(opcode OneByteOpcodeId, reg, rm RegisterId) {
+    buf.emitRexW(reg, 0, rm)
+    buf.WriteByte(byte(opcode))
+    buf.registerModRM(reg, rm)
+}
+
+func (buf *X86Buffer) fmtOp64Mem(opcode OneByteOpcodeId, reg, base RegisterId, offset int32) {
+    buf.emitRexW(reg, 0, base)
+    buf.WriteByte(byte(opcode))
+    buf.memoryModRM(reg, base, offset)
+}
+
+func (buf *X86Buffer) fmtOp64Index(opcode OneByteOpcodeId, reg, base, index RegisterId, scale, offset int32) {
+    if index == noIndex {
+        panic("x86: rsp can't be an index")
+    }
+    buf.emitRexW(reg, index, base)
+    buf.WriteByte(byte(opcode))
+    buf.memoryModRMOffsetScale32(reg, base, index, scaleBits(scale), offset)
+}
+
+func (buf *X86Buffer) fmtOp64Rip(opcode OneByteOpcodeId, reg RegisterId) JmpSrc {
+    buf.emitRexW(reg, 0, 0)
+    buf.WriteByte(byte(opcode))
+    return buf.memoryModRMRip(reg)
+}
+
+func (buf *X86Buffer) fmtExtOp64(opcode TwoByteOpcodeId, reg, rm RegisterId) {
+    buf.emitRexW(reg, 0, rm)
+    buf.WriteByte(x86_2BYTE_ESCAPE)
+    buf.WriteByte(byte(opcode))
+    buf.registerModRM(reg, rm)
+}
+
+// Formats an operation of group 1 with an immediate, which is a byte if it fits in one.
+// An operation on eax with a larger immediate has a shorter form, without a ModRM byte.
+func (buf *X86Buffer) fmtGroup1(op GroupOpcodeId, imm int32, dst RegisterId, w bool) {
+    if dst == x86_eax && !canSignExtend8to32(imm) {
+        if w {
+            buf.emitRexW(0, 0, 0)
+        }
+        buf.WriteByte(byte(x86_ADD_EAXIv) + byte(op) << 3)
+        immediate32(buf.Buffer, imm)
+        return
+    }
+
+    var opcode OneByteOpcodeId = x86_GROUP1_EvIz
+    if canSignExtend8to32(imm) {
+        opcode = x86_GROUP1_EvIb
+    }
+    
+    if w {
+        buf.fmtOp64(opcode, RegisterId(op), dst)
+    } else {
+        buf.fmtOp(opcode, RegisterId(op), dst)
+    }
+    
+    if canSignExtend8to32(imm) {
+        immediate(buf.Buffer, int8(imm))
+    } else {
+        immediate32(buf.Buffer, imm)
+    }
+}
+
+// Formats an operation of group 1 on memory with an immediate.
+func (buf *X86Buffer) fmtGroup1Mem(op GroupOpcodeId, imm int32, offset int32, base RegisterId, w bool) {
+    var opcode OneByteOpcodeId = x86_GROUP1_EvIz
+    if canSignExtend8to32(imm) {
+        opcode = x86_GROUP1_EvIb
+    }
+    
+    if w {
+        buf.fmtOp64Mem(opcode, RegisterId(op), base, offset)
+    } else {
+        buf.fmtOpMem(opcode, RegisterId(op), base, offset)
+    }
+    
+    if canSignExtend8to32(imm) {
+        immediate(buf.Buffer, int8(imm))
+    } else {
+        immediate32(buf.Buffer, imm)
+    }
+}
+
+// Formats a shift of group 2 by an immediate, which has a shorter form for a shift by 1.
+func (buf *X86Buffer) fmtGroup2(op GroupOpcodeId, imm int8, dst RegisterId, w bool) {
+    var opcode OneByteOpcodeId = x86_GROUP2_EvIb
+    if imm == 1 {
+        opcode = x86_GROUP2_Ev1
+    }
+    
+    if w {
+        buf.fmtOp64(opcode, RegisterId(op), dst)
+    } else {
+        buf.fmtOp(opcode, RegisterId(op), dst)
+    }
+    
+    if imm != 1 {
+        immediate(buf.Buffer, imm)
+    }
+}
+
+/*******************************************************************
+ * Stack operations
+ *******************************************************************/
+
+func (buf *X86Buffer) Push(reg RegisterId) {
+    buf.fmtOpReg(x86_PUSH_EAX, reg)
+}
+
+func (buf *X86Buffer) Pop(reg RegisterId) {
+    buf.fmtOpReg(x86_POP_EAX, reg)
+}
+
+// Pushes imm, sign extended, as a byte if it fits in one.
+func (buf *X86Buffer) PushI(imm int32) {
+    if canSignExtend8to32(imm) {
+        buf.WriteByte(x86_PUSH_Ib)
+        immediate(buf.Buffer, int8(imm))
+        return
+    }
+    buf.WriteByte(x86_PUSH_Iz)
+    immediate32(buf.Buffer, imm)
+}
+
+/*******************************************************************
+ * Moves
+ *******************************************************************/
+
+func (buf *X86Buffer) MovlRR(src, dst RegisterId) {
+    buf.fmtOp(x86_MOV_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) MovlMR(offset int32, base, dst RegisterId) {
+    buf.fmtOpMem(x86_MOV_GvEv, dst, base, offset)
+}
+
+func (buf *X86Buffer) MovlRM(src RegisterId, offset int32, base RegisterId) {
+    buf.fmtOpMem(x86_MOV_EvGv, src, base, offset)
+}
+
+func (buf *X86Buffer) MovlIR(imm int32, dst RegisterId) {
+    buf.fmtOpReg(x86_MOV_EAXIv, dst)
+    immediate32(buf.Buffer, imm)
+}
+
+func (buf *X86Buffer) MovlIM(imm int32, offset int32, base RegisterId) {
+    buf.fmtOpMem(x86_GROUP11_EvIz, x86_GROUP11_MOV, base, offset)
+    immediate32(buf.Buffer, imm)
+}
+
+func (buf *X86Buffer) MovqRR(src, dst RegisterId) {
+    buf.fmtOp64(x86_MOV_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) MovqMR(offset int32, base, dst RegisterId) {
+    buf.fmtOp64Mem(x86_MOV_GvEv, dst, base, offset)
+}
+
+func (buf *X86Buffer) MovqRM(src RegisterId, offset int32, base RegisterId) {
+    buf.fmtOp64Mem(x86_MOV_EvGv, src, base, offset)
+}
+
+// Stores imm, sign extended to 64 bits.
+func (buf *X86Buffer) MovqIM(imm int32, offset int32, base RegisterId) {
+    buf.fmtOp64Mem(x86_GROUP11_EvIz, x86_GROUP11_MOV, base, offset)
+    immediate32(buf.Buffer, imm)
+}
+
+// Loads a 64-bit immediate with the shortest form that holds it: a 32-bit move, which
+// clears the upper half, a 32-bit immediate sign extended to 64 bits, or movabs.
+func (buf *X86Buffer) MovqIR(imm int64, dst RegisterId) {
+    switch {
+    case imm >= 0 && imm <= math.MaxUint32:
+        buf.MovlIR(int32(uint32(imm)), dst)
+    case imm == int64(int32(imm)):
+        buf.fmtOp64(x86_GROUP11_EvIz, x86_GROUP11_MOV, dst)
+        immediate32(buf.Buffer, int32(imm))
+    default:
+        buf.MovabsqIR(imm, dst)
+    }
+}
+
+// Loads a full 64-bit immediate, always with the 10-byte form.
+func (buf *X86Buffer) MovabsqIR(imm int64, dst RegisterId) {
+    buf.emitRexW(0, 0, dst)
+    buf.WriteByte(byte(x86_MOV_EAXIv) + byte(dst & 7))
+    immediate64(buf.Buffer, imm)
+}
+
+func (buf *X86Buffer) MovlSR(offset int32, base, index RegisterId, scale int32, dst RegisterId) {
+    buf.fmtOpIndex(x86_MOV_GvEv, dst, base, index, scale, offset)
+}
+
+func (buf *X86Buffer) MovlRS(src RegisterId, offset int32, base, index RegisterId, scale int32) {
+    buf.fmtOpIndex(x86_MOV_EvGv, src, base, index, scale, offset)
+}
+
+func (buf *X86Buffer) MovqSR(offset int32, base, index RegisterId, scale int32, dst RegisterId) {
+    buf.fmtOp64Index(x86_MOV_GvEv, dst, base, index, scale, offset)
+}
+
+func (buf *X86Buffer) MovqRS(src RegisterId, offset int32, base, index RegisterId, scale int32) {
+    buf.fmtOp64Index(x86_MOV_EvGv, src, base, index, scale, offset)
+}
+
+// Loads the 64-bit value at the label l, which may be bound later.
+func (buf *X86Buffer) MovqPR(l *Label, dst RegisterId) (os.Error) {
+    return buf.Use(buf.fmtOp64Rip(x86_MOV_GvEv, dst), l)
+}
+
+// Zero extends the byte register src into dst.
+func (buf *X86Buffer) MovzblRR(src, dst RegisterId) {
+    buf.fmtExtOp8(x86_MOVZX_GvEb, dst, src)
+}
+
+func (buf *X86Buffer) LealMR(offset int32, base, dst RegisterId) {
+    buf.fmtOpMem(x86_LEA, dst, base, offset)
+}
+
+func (buf *X86Buffer) LeaqMR(offset int32, base, dst RegisterId) {
+    buf.fmtOp64Mem(x86_LEA, dst, base, offset)
+}
+
+func (buf *X86Buffer) LealSR(offset int32, base, index RegisterId, scale int32, dst RegisterId) {
+    buf.fmtOpIndex(x86_LEA, dst, base, index, scale, offset)
+}
+
+func (buf *X86Buffer) LeaqSR(offset int32, base, index RegisterId, scale int32, dst RegisterId) {
+    buf.fmtOp64Index(x86_LEA, dst, base, index, scale, offset)
+}
+
+// Loads the address of the label l.
+func (buf *X86Buffer) LeaqPR(l *Label, dst RegisterId) (os.Error) {
+    return buf.Use(buf.fmtOp64Rip(x86_LEA, dst), l)
+}
+
+/*******************************************************************
+ * Integer arithmetic
+ *******************************************************************/
+
+func (buf *X86Buffer) AddlRR(src, dst RegisterId) {
+    buf.fmtOp(x86_ADD_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) AddlMR(offset int32, base, dst RegisterId) {
+    buf.fmtOpMem(x86_ADD_GvEv, dst, base, offset)
+}
+
+func (buf *X86Buffer) AddlIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_ADD, imm, dst, false)
+}
+
+func (buf *X86Buffer) AddlRM(src RegisterId, offset int32, base RegisterId) {
+    buf.fmtOpMem(x86_ADD_EvGv, src, base, offset)
+}
+
+func (buf *X86Buffer) AddlIM(imm int32, offset int32, base RegisterId) {
+    buf.fmtGroup1Mem(x86_GROUP1_OP_ADD, imm, offset, base, false)
+}
+
+func (buf *X86Buffer) AddlSR(offset int32, base, index RegisterId, scale int32, dst RegisterId) {
+    buf.fmtOpIndex(x86_ADD_GvEv, dst, base, index, scale, offset)
+}
+
+func (buf *X86Buffer) SublRR(src, dst RegisterId) {
+    buf.fmtOp(x86_SUB_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) SublIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_SUB, imm, dst, false)
+}
+
+func (buf *X86Buffer) AndlRR(src, dst RegisterId) {
+    buf.fmtOp(x86_AND_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) AndlIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_AND, imm, dst, false)
+}
+
+func (buf *X86Buffer) OrlRR(src, dst RegisterId) {
+    buf.fmtOp(x86_OR_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) OrlIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_OR, imm, dst, false)
+}
+
+func (buf *X86Buffer) XorlRR(src, dst RegisterId) {
+    buf.fmtOp(x86_XOR_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) XorlIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_XOR, imm, dst, false)
+}
+
+// Multiplies dst by src.
+func (buf *X86Buffer) ImulRR(src, dst RegisterId) {
+    buf.fmtExtOp(x86_IMUL_GvEv, dst, src)
+}
+
+// Sets dst to src multiplied by imm, which is a byte if it fits in one.
+func (buf *X86Buffer) ImulIRR(imm int32, src, dst RegisterId) {
+    if canSignExtend8to32(imm) {
+        buf.fmtOp(x86_IMUL_GvEvIb, dst, src)
+        immediate(buf.Buffer, int8(imm))
+        return
+    }
+    buf.fmtOp(x86_IMUL_GvEvIz, dst, src)
+    immediate32(buf.Buffer, imm)
+}
+
+func (buf *X86Buffer) NeglR(dst RegisterId) {
+    buf.fmtOp(x86_GROUP3_Ev, x86_GROUP3_OP_NEG, dst)
+}
+
+func (buf *X86Buffer) NotlR(dst RegisterId) {
+    buf.fmtOp(x86_GROUP3_Ev, x86_GROUP3_OP_NOT, dst)
+}
+
+// Sign extends eax into edx, ready for IdivlR.
+func (buf *X86Buffer) Cdq() {
+    buf.WriteByte(x86_CDQ)
+}
+
+// Divides edx:eax by divisor, leaving the quotient in eax and the remainder in edx.
+func (buf *X86Buffer) IdivlR(divisor RegisterId) {
+    buf.fmtOp(x86_GROUP3_Ev, x86_GROUP3_OP_IDIV, divisor)
+}
+
+func (buf *X86Buffer) ShllIR(imm int8, dst RegisterId) {
+    buf.fmtGroup2(x86_GROUP2_OP_SHL, imm, dst, false)
+}
+
+func (buf *X86Buffer) ShrlIR(imm int8, dst RegisterId) {
+    buf.fmtGroup2(x86_GROUP2_OP_SHR, imm, dst, false)
+}
+
+func (buf *X86Buffer) SarlIR(imm int8, dst RegisterId) {
+    buf.fmtGroup2(x86_GROUP2_OP_SAR, imm, dst, false)
+}
+
+// Shifts dst by the count in cl.
+func (buf *X86Buffer) ShllCLR(dst RegisterId) {
+    buf.fmtOp(x86_GROUP2_EvCL, x86_GROUP2_OP_SHL, dst)
+}
+
+func (buf *X86Buffer) SarlCLR(dst RegisterId) {
+    buf.fmtOp(x86_GROUP2_EvCL, x86_GROUP2_OP_SAR, dst)
+}
+
+func (buf *X86Buffer) AddqRR(src, dst RegisterId) {
+    buf.fmtOp64(x86_ADD_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) AddqIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_ADD, imm, dst, true)
+}
+
+func (buf *X86Buffer) AddqMR(offset int32, base, dst RegisterId) {
+    buf.fmtOp64Mem(x86_ADD_GvEv, dst, base, offset)
+}
+
+func (buf *X86Buffer) AddqRM(src RegisterId, offset int32, base RegisterId) {
+    buf.fmtOp64Mem(x86_ADD_EvGv, src, base, offset)
+}
+
+func (buf *X86Buffer) AddqIM(imm int32, offset int32, base RegisterId) {
+    buf.fmtGroup1Mem(x86_GROUP1_OP_ADD, imm, offset, base, true)
+}
+
+func (buf *X86Buffer) AddqSR(offset int32, base, index RegisterId, scale int32, dst RegisterId) {
+    buf.fmtOp64Index(x86_ADD_GvEv, dst, base, index, scale, offset)
+}
+
+func (buf *X86Buffer) SubqRR(src, dst RegisterId) {
+    buf.fmtOp64(x86_SUB_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) SubqIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_SUB, imm, dst, true)
+}
+
+func (buf *X86Buffer) AndqRR(src, dst RegisterId) {
+    buf.fmtOp64(x86_AND_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) AndqIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_AND, imm, dst, true)
+}
+
+func (buf *X86Buffer) OrqRR(src, dst RegisterId) {
+    buf.fmtOp64(x86_OR_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) OrqIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_OR, imm, dst, true)
+}
+
+func (buf *X86Buffer) XorqRR(src, dst RegisterId) {
+    buf.fmtOp64(x86_XOR_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) XorqIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_XOR, imm, dst, true)
+}
+
+func (buf *X86Buffer) ImulqRR(src, dst RegisterId) {
+    buf.fmtExtOp64(x86_IMUL_GvEv, dst, src)
+}
+
+func (buf *X86Buffer) ImulqIRR(imm int32, src, dst RegisterId) {
+    if canSignExtend8to32(imm) {
+        buf.fmtOp64(x86_IMUL_GvEvIb, dst, src)
+        immediate(buf.Buffer, int8(imm))
+        return
+    }
+    buf.fmtOp64(x86_IMUL_GvEvIz, dst, src)
+    immediate32(buf.Buffer, imm)
+}
+
+func (buf *X86Buffer) NegqR(dst RegisterId) {
+    buf.fmtOp64(x86_GROUP3_Ev, x86_GROUP3_OP_NEG, dst)
+}
+
+func (buf *X86Buffer) NotqR(dst RegisterId) {
+    buf.fmtOp64(x86_GROUP3_Ev, x86_GROUP3_OP_NOT, dst)
+}
+
+// Sign extends rax into rdx, ready for IdivqR.
+func (buf *X86Buffer) Cqo() {
+    buf.emitRexW(0, 0, 0)
+    buf.WriteByte(x86_CDQ)
+}
+
+func (buf *X86Buffer) IdivqR(divisor RegisterId) {
+    buf.fmtOp64(x86_GROUP3_Ev, x86_GROUP3_OP_IDIV, divisor)
+}
+
+func (buf *X86Buffer) SarqIR(imm int8, dst RegisterId) {
+    buf.fmtGroup2(x86_GROUP2_OP_SAR, imm, dst, true)
+}
+
+/*******************************************************************
+ * Comparisons
+ *******************************************************************/
+
+// Sets the flags from dst - src.
+func (buf *X86Buffer) CmplRR(src, dst RegisterId) {
+    buf.fmtOp(x86_CMP_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) CmplIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_CMP, imm, dst, false)
+}
+
+// Sets the flags from dst - the value in memory.
+func (buf *X86Buffer) CmplMR(offset int32, base, dst RegisterId) {
+    buf.fmtOpMem(x86_CMP_GvEv, dst, base, offset)
+}
+
+// Sets the flags from the value in memory - src.
+func (buf *X86Buffer) CmplRM(src RegisterId, offset int32, base RegisterId) {
+    buf.fmtOpMem(x86_CMP_EvGv, src, base, offset)
+}
+
+func (buf *X86Buffer) CmplIM(imm int32, offset int32, base RegisterId) {
+    buf.fmtGroup1Mem(x86_GROUP1_OP_CMP, imm, offset, base, false)
+}
+
+func (buf *X86Buffer) CmplSR(offset int32, base, index RegisterId, scale int32, dst RegisterId) {
+    buf.fmtOpIndex(x86_CMP_GvEv, dst, base, index, scale, offset)
+}
+
+func (buf *X86Buffer) CmpqRR(src, dst RegisterId) {
+    buf.fmtOp64(x86_CMP_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) CmpqIR(imm int32, dst RegisterId) {
+    buf.fmtGroup1(x86_GROUP1_OP_CMP, imm, dst, true)
+}
+
+func (buf *X86Buffer) CmpqMR(offset int32, base, dst RegisterId) {
+    buf.fmtOp64Mem(x86_CMP_GvEv, dst, base, offset)
+}
+
+func (buf *X86Buffer) CmpqRM(src RegisterId, offset int32, base RegisterId) {
+    buf.fmtOp64Mem(x86_CMP_EvGv, src, base, offset)
+}
+
+func (buf *X86Buffer) CmpqIM(imm int32, offset int32, base RegisterId) {
+    buf.fmtGroup1Mem(x86_GROUP1_OP_CMP, imm, offset, base, true)
+}
+
+// Sets the flags from src & dst.
+func (buf *X86Buffer) TestlRR(src, dst RegisterId) {
+    buf.fmtOp(x86_TEST_EvGv, src, dst)
+}
+
+func (buf *X86Buffer) TestqRR(src, dst RegisterId) {
+    buf.fmtOp64(x86_TEST_EvGv, src, dst)
+}
+
+// Sets the byte register dst to 1 if the condition holds, and to 0 if it doesn't.
+func (buf *X86Buffer) Setcc(cond uint8, dst RegisterId) {
+    buf.fmtExtGroupOp8(setccOpcode(cond), 0, dst)
+}
+
+// Moves src to dst if the condition holds, and leaves dst alone if it doesn't.  Every
+// processor with SSE2 has the conditional moves.
+func (buf *X86Buffer) Cmovcc(cond uint8, src, dst RegisterId) {
+    buf.fmtExtOp(cmovccOpcode(cond), dst, src)
+}
+
+func (buf *X86Buffer) Cmovqcc(cond uint8, src, dst RegisterId) {
+    buf.fmtExtOp64(cmovccOpcode(cond), dst, src)
+}
+
+/*******************************************************************
+ * Control flow
+ *
+ * The relative jumps and calls are emitted with a displacement of 0, and
+ * return the place to patch once the target is known.
+ *******************************************************************/
+
+func (buf *X86Buffer) Jmp() JmpSrc {
+    buf.WriteByte(x86_JMP_rel32)
+    return immediateRel32(buf.Buffer)
+}
+
+func (buf *X86Buffer) Jcc(cond uint8) JmpSrc {
+    buf.WriteByte(x86_2BYTE_ESCAPE)
+    buf.WriteByte(byte(jccRel32(cond)))
+    return immediateRel32(buf.Buffer)
+}
+
+// The short jumps only reach 127 bytes forward or 128 bytes back.
+func (buf *X86Buffer) JmpShort() JmpSrc {
+    buf.WriteByte(x86_JMP_rel8)
+    return immediateRel8(buf.Buffer)
+}
+
+func (buf *X86Buffer) JccShort(cond uint8) JmpSrc {
+    buf.WriteByte(x86_JCC_rel8 + cond)
+    return immediateRel8(buf.Buffer)
+}
+
+func (buf *X86Buffer) Call() JmpSrc {
+    buf.WriteByte(x86_CALL_rel32)
+    return immediateRel32(buf.Buffer)
+}
+
+// Calls the address in reg.
+func (buf *X86Buffer) CallR(reg RegisterId) {
+    buf.fmtOp(x86_GROUP5_Ev, x86_GROUP5_OP_CALLN, reg)
+}
+
+// Calls the address stored at offset from base.
+func (buf *X86Buffer) CallM(offset int32, base RegisterId) {
+    buf.fmtOpMem(x86_GROUP5_Ev, x86_GROUP5_OP_CALLN, base, offset)
+}
+
+// Jumps to the address in reg.
+func (buf *X86Buffer) JmpR(reg RegisterId) {
+    buf.fmtOp(x86_GROUP5_Ev, x86_GROUP5_OP_JMPN, reg)
+}
+
+func (buf *X86Buffer) Ret() {
+    buf.WriteByte(x86_RET)
+}
+
+func (buf *X86Buffer) Int3() {
+    buf.WriteByte(x86_INT3)
+}
+
+/*******************************************************************
+ * SSE2 scalar double operations, on the xmm registers
+ *******************************************************************/
+
+func (buf *X86Buffer) fmtSse(prefix byte, opcode TwoByteOpcodeId, reg, rm RegisterId) {
+    buf.WriteByte(prefix)
+    buf.fmtExtOp(opcode, reg, rm)
+}
+
+func (buf *X86Buffer) MovsdRR(src, dst RegisterId) {
+    buf.fmtSse(x86_PRE_SSE_F2, x86_MOVSD_VsdWsd, dst, src)
+}
+
+func (buf *X86Buffer) MovsdMR(offset int32, base, dst RegisterId) {
+    buf.WriteByte(x86_PRE_SSE_F2)
+    buf.fmtExtOpMem(x86_MOVSD_VsdWsd, dst, base, offset)
+}
+
+func (buf *X86Buffer) MovsdRM(src RegisterId, offset int32, base RegisterId) {
+    buf.WriteByte(x86_PRE_SSE_F2)
+    buf.fmtExtOpMem(x86_MOVSD_WsdVsd, src, base, offset)
+}
+
+// Loads all 128 bits of an xmm register, from memory that needn't be aligned.
+func (buf *X86Buffer) MovdquMR(offset int32, base, dst RegisterId) {
+    buf.WriteByte(x86_PRE_SSE_F3)
+    buf.fmtExtOpMem(x86_MOVDQU_VdqWdq, dst, base, offset)
+}
+
+func (buf *X86Buffer) MovdquRM(src RegisterId, offset int32, base RegisterId) {
+    buf.WriteByte(x86_PRE_SSE_F3)
+    buf.fmtExtOpMem(x86_MOVDQU_WdqVdq, src, base, offset)
+}
+
+func (buf *X86Buffer) MovsdSR(offset int32, base, index RegisterId, scale int32, dst RegisterId) {
+    if index == noIndex {
+        panic("x86: esp can't be an index")
+    }
+    buf.WriteByte(x86_PRE_SSE_F2)
+    buf.emitRexIfNeeded(dst, index, base)
+    buf.WriteByte(x86_2BYTE_ESCAPE)
+    buf.WriteByte(byte(x86_MOVSD_VsdWsd))
+    buf.memoryModRMOffsetScale32(dst, base, index, scaleBits(scale), offset)
+}
+
+// Loads the double at the label l.
+func (buf *X86Buffer) MovsdPR(l *Label, dst RegisterId) (os.Error) {
+    buf.WriteByte(x86_PRE_SSE_F2)
+    buf.emitRexIfNeeded(dst, 0, 0)
+    buf.WriteByte(x86_2BYTE_ESCAPE)
+    buf.WriteByte(byte(x86_MOVSD_VsdWsd))
+    return buf.Use(buf.memoryModRMRip(dst), l)
+}
+
+func (buf *X86Buffer) AddsdRR(src, dst RegisterId) {
+    buf.fmtSse(x86_PRE_SSE_F2, x86_ADDSD_VsdWsd, dst, src)
+}
+
+func (buf *X86Buffer) SubsdRR(src, dst RegisterId) {
+    buf.fmtSse(x86_PRE_SSE_F2, x86_SUBSD_VsdWsd, dst, src)
+}
+
+func (buf *X86Buffer) MulsdRR(src, dst RegisterId) {
+    buf.fmtSse(x86_PRE_SSE_F2, x86_MULSD_VsdWsd, dst, src)
+}
+
+func (buf *X86Buffer) DivsdRR(src, dst RegisterId) {
+    buf.fmtSse(x86_PRE_SSE_F2, x86_DIVSD_VsdWsd, dst, src)
+}
+
+func (buf *X86Buffer) SqrtsdRR(src, dst RegisterId) {
+    buf.fmtSse(x86_PRE_SSE_F2, x86_SQRTSD_VsdWsd, dst, src)
+}
+
+// Sets the flags from comparing dst with src, as an unsigned comparison would.
+func (buf *X86Buffer) UcomisdRR(src, dst RegisterId) {
+    buf.fmtSse(x86_PRE_SSE_66, x86_UCOMISD_VsdWsd, dst, src)
+}
+
+func (buf *X86Buffer) XorpdRR(src, dst RegisterId) {
+    buf.fmtSse(x86_PRE_SSE_66, x86_XORPD_VpdWpd, dst, src)
+}
+
+// Converts the 32-bit integer in the register src to a double in the xmm register dst.
+func (buf *X86Buffer) Cvtsi2sdRR(src, dst RegisterId) {
+    buf.fmtSse(x86_PRE_SSE_F2, x86_CVTSI2SD_VsdEd, dst, src)
+}
+
+// Converts the double in the xmm register src to a 32-bit integer in dst, truncating it.
+func (buf *X86Buffer) Cvttsd2siRR(src, dst RegisterId) {
+    buf.fmtSse(x86_PRE_SSE_F2, x86_CVTTSD2SI_GdWsd, dst, src)
+}
+
+func (buf *X86Buffer) Cvtsi2sdqRR(src, dst RegisterId) {
+    buf.WriteByte(x86_PRE_SSE_F2)
+    buf.fmtExtOp64(x86_CVTSI2SD_VsdEd, dst, src)
+}
+
+func (buf *X86Buffer) Cvttsd2siqRR(src, dst RegisterId) {
+    buf.WriteByte(x86_PRE_SSE_F2)
+    buf.fmtExtOp64(x86_CVTTSD2SI_GdWsd, dst, src)
+}
+
+// Moves the bits of the register src to the xmm register dst.
+func (buf *X86Buffer) MovqRX(src, dst RegisterId) {
+    buf.WriteByte(x86_PRE_SSE_66)
+    buf.fmtExtOp64(x86_MOVD_VdEd, dst, src)
+}
+
+// Moves the bits of the xmm register src to the register dst.
+func (buf *X86Buffer) MovqXR(src, dst RegisterId) {
+    buf.WriteByte(x86_PRE_SSE_66)
+    buf.fmtExtOp64(x86_MOVD_EdVd, src, dst)
+}
+
+/*******************************************************************
+ * Data, for constant pools
+ *******************************************************************/
+
+// Pads the code with int3 until its length is a multiple of n.
+func (buf *X86Buffer) Align(n int) {
+    for buf.Len() % n != 0 {
+        buf.Int3()
+    }
+}
+
+func (buf *X86Buffer) Quad(v uint64) {
+    binary.Write(buf, binary.LittleEndian, v)
+}
+
+/*******************************************************************
+ * Labels and relocations
+ *******************************************************************/
+
+// Returned when a jump's displacement can't reach its destination.
+var JumpOutOfRange = os.NewError("jump displacement out of range")
+
+// Returned when a label is bound a second time.
+var LabelRebound = os.NewError("label is already bound")
+
+// A place in the code that jumps can refer to before it is bound.  The jumps to it
+// are recorded until it is, and then patched.
+type Label struct {
+    dst     JmpDst
+    bound   bool
+    pending []JmpSrc
+}
+
+// Returns true once the label has been bound.
+func (l *Label) Bound() (bool) {
+    return l.bound
+}
+
+// Returns the offset the label is bound to, or -1 if it isn't bound yet.
+func (l *Label) Offset() (int) {
+    if !l.bound {
+        return -1
+    }
+    return l.dst.offset
+}
+
+// Returns the current end of the code, as a jump destination.
+func (buf *X86Buffer) Here() (JmpDst) {
+    return JmpDst{buf.Len(), false}
+}
+
+// Patches the displacement of the jump at src so that it lands on dst.
+func (buf *X86Buffer) LinkJump(src JmpSrc, dst JmpDst) (os.Error) {
+    code := buf.Bytes()
+    width := 4
+    if src.short {
+        width = 1
+    }
+    
+    if src.offset < width || src.offset > len(code) || dst.offset < 0 || dst.offset > len(code) {
+        return os.NewError(fmt.Sprintf("x86: jump at %d to %d is outside the %d bytes of code",
+                                       src.offset, dst.offset, len(code)))
+    }
+    
+    rel := int64(dst.offset) - int64(src.offset)
+    if src.short {
+        if rel < -128 || rel > 127 {
+            return JumpOutOfRange
+        }
+        code[src.offset - 1] = byte(int8(rel))
+        return nil
+    }
+    
+    if rel < -1<<31 || rel > 1<<31 - 1 {
+        return JumpOutOfRange
+    }
+    binary.LittleEndian.PutUint32(code[src.offset - 4:], uint32(int32(rel)))
+    return nil
+}
+
+// Binds the label to the current end of the code, and patches the jumps to it.
+func (buf *X86Buffer) Bind(l *Label) (os.Error) {
+    if l.bound {
+        return LabelRebound
+    }
+    
+    l.dst, l.bound = buf.Here(), true
+    pending := l.pending
+    l.pending = nil
+    for _, src := range pending {
+        if err := buf.LinkJump(src, l.dst); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Links the jump at src to the label, now if it is bound, or when it is.
+func (buf *X86Buffer) Use(src JmpSrc, l *Label) (os.Error) {
+    l.dst.used = true
+    if l.bound {
+        return buf.LinkJump(src, l.dst)
+    }
+    
+    l.pending = append(l.pending, src)
+    return nil
+}
+
+// Returns true if a short jump emitted now would reach the bound label l.
+func (buf *X86Buffer) reachesShort(l *Label) (bool) {
+    return l.bound && buf.Len() + 2 - l.dst.offset <= 128
+}
+
+// Jumps to the label, with a short jump if it is bound and near enough.
+func (buf *X86Buffer) JmpTo(l *Label) (os.Error) {
+    if buf.reachesShort(l) {
+        return buf.Use(buf.JmpShort(), l)
+    }
+    return buf.Use(buf.Jmp(), l)
+}
+
+func (buf *X86Buffer) JccTo(cond uint8, l *Label) (os.Error) {
+    if buf.reachesShort(l) {
+        return buf.Use(buf.JccShort(cond), l)
+    }
+    return buf.Use(buf.Jcc(cond), l)
+}
+
+// Jumps forward to the label with a short jump, which Bind fails to patch if the label
+// is bound too far away.
+func (buf *X86Buffer) JmpShortTo(l *Label) (os.Error) {
+    return buf.Use(buf.JmpShort(), l)
+}
+
+func (buf *X86Buffer) JccShortTo(cond uint8, l *Label) (os.Error) {
+    return buf.Use(buf.JccShort(cond), l)
+}
+
+func (buf *X86Buffer) CallTo(l *Label) (os.Error) {
+    return buf.Use(buf.Call(), l)
+}
@@ -0,0 +1,534 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file decodes the machine code in an X86Buffer back into AT&T
+   assembly, so that the code the JIT generates can be read without an
+   external disassembler.  It only knows the instructions the assembler
+   emits.  Each instruction is printed with its offset and its bytes, like:
+
+            0:  55                        push %rbp
+            1:  48 89 e5                  movq %rsp,%rbp
+            4:  0f 84 10 00 00 00         je 0x1a
+
+   Jumps and calls show the offset they land on, and memory addressed
+   relative to the instruction pointer shows the offset it refers to.  A byte
+   that doesn't start a known instruction is printed as .byte, and decoding
+   carries on after it.
+*/
+
+package python
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+// Returned when the code ends in the middle of an instruction.
+var TruncatedInstruction = os.NewError("x86: the code ends in the middle of an instruction")
+
+var x86Registers8 = [16]string{"al", "cl", "dl", "bl", "spl", "bpl", "sil", "dil",
+                               "r8b", "r9b", "r10b", "r11b", "r12b", "r13b", "r14b", "r15b"}
+var x86RegistersHigh8 = [8]string{"al", "cl", "dl", "bl", "ah", "ch", "dh", "bh"}
+var x86Registers16 = [16]string{"ax", "cx", "dx", "bx", "sp", "bp", "si", "di",
+                                "r8w", "r9w", "r10w", "r11w", "r12w", "r13w", "r14w", "r15w"}
+var x86Registers32 = [16]string{"eax", "ecx", "edx", "ebx", "esp", "ebp", "esi", "edi",
+                                "r8d", "r9d", "r10d", "r11d", "r12d", "r13d", "r14d", "r15d"}
+var x86Registers64 = [16]string{"rax", "rcx", "rdx", "rbx", "rsp", "rbp", "rsi", "rdi",
+                                "r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15"}
+
+var x86ConditionNames = [16]string{"o", "no", "b", "ae", "e", "ne", "be", "a",
+                                   "s", "ns", "p", "np", "l", "ge", "le", "g"}
+
+// The operations of the one-byte arithmetic opcodes, and of group 1, in the order of
+// their opcode bits.
+var x86AluNames = [8]string{"add", "or", "adc", "sbb", "and", "sub", "xor", "cmp"}
+var x86ShiftNames = [8]string{"rol", "ror", "rcl", "rcr", "shl", "shr", "sal", "sar"}
+var x86Group3Names = [8]string{"test", "test", "not", "neg", "mul", "imul", "div", "idiv"}
+
+// The operations on scalar doubles, with an F2 prefix, by their second opcode byte.
+var x86SseNames = map[byte]string{
+    x86_SQRTSD_VsdWsd: "sqrtsd",
+    x86_ADDSD_VsdWsd:  "addsd",
+    x86_MULSD_VsdWsd:  "mulsd",
+    x86_SUBSD_VsdWsd:  "subsd",
+    x86_DIVSD_VsdWsd:  "divsd",
+}
+
+// The state of decoding a single instruction.
+type x86Decoder struct {
+    code    []byte
+    pos     int
+    x64     bool
+    err     os.Error
+
+    rex     byte
+    opsize  bool
+    rep     byte
+
+    // Set when an operand is addressed relative to the instruction pointer, which can
+    // only be resolved once the whole instruction is decoded.
+    rip     bool
+    ripDisp int32
+}
+
+func (d *x86Decoder) byte() (byte) {
+    if d.pos >= len(d.code) {
+        d.err = TruncatedInstruction
+        return 0
+    }
+    b := d.code[d.pos]
+    d.pos++
+    return b
+}
+
+func (d *x86Decoder) int32() (int32) {
+    if d.pos + 4 > len(d.code) {
+        d.err = TruncatedInstruction
+        d.pos = len(d.code)
+        return 0
+    }
+    v := int32(binary.LittleEndian.Uint32(d.code[d.pos:]))
+    d.pos += 4
+    return v
+}
+
+func (d *x86Decoder) int64() (int64) {
+    if d.pos + 8 > len(d.code) {
+        d.err = TruncatedInstruction
+        d.pos = len(d.code)
+        return 0
+    }
+    v := int64(binary.LittleEndian.Uint64(d.code[d.pos:]))
+    d.pos += 8
+    return v
+}
+
+func (d *x86Decoder) rexW() (bool) {
+    return d.rex & 8 != 0
+}
+
+// The high bit of a register number, from the REX bit mask of the REX prefix.
+func (d *x86Decoder) rexBit(mask byte) (int) {
+    if d.rex & mask != 0 {
+        return 8
+    }
+    return 0
+}
+
+// Returns the suffix of a mnemonic for the operand size.
+func (d *x86Decoder) suffix() (string) {
+    switch {
+        case d.rexW():
+            return "q"
+        case d.opsize:
+            return "w"
+    }
+    return "l"
+}
+
+// Returns the name of the register n at the operand size.
+func (d *x86Decoder) register(n int) (string) {
+    switch {
+        case d.rexW():
+            return "%" + x86Registers64[n]
+        case d.opsize:
+            return "%" + x86Registers16[n]
+    }
+    return "%" + x86Registers32[n]
+}
+
+// Returns the name of the register n as an address, a pointer, or a stack slot.
+func (d *x86Decoder) addressRegister(n int) (string) {
+    if d.x64 {
+        return "%" + x86Registers64[n]
+    }
+    return "%" + x86Registers32[n]
+}
+
+// Returns the name of the byte register n, which is one of ah..bh for 4..7 unless the
+// instruction has a REX prefix.
+func (d *x86Decoder) byteRegister(n int) (string) {
+    if d.rex == 0 && n < 8 {
+        return "%" + x86RegistersHigh8[n]
+    }
+    return "%" + x86Registers8[n]
+}
+
+func (d *x86Decoder) xmmRegister(n int) (string) {
+    return fmt.Sprintf("%%xmm%d", n)
+}
+
+// Formats a displacement or an immediate, in decimal if it is small, and in hex if not.
+func x86Number(v int64) (string) {
+    if v > -256 && v < 256 {
+        return fmt.Sprint(v)
+    }
+    if v < 0 {
+        return fmt.Sprintf("-0x%x", uint64(-v))
+    }
+    return fmt.Sprintf("0x%x", v)
+}
+
+// Decodes a ModRM byte, and the SIB byte and displacement that follow it.  Returns the
+// register of the reg field, and the operand of the rm field, which is named by name if
+// it is a register.
+func (d *x86Decoder) modrm(name func(int) string) (int, string) {
+    b := d.byte()
+    mod, reg, rm := int(b >> 6), int((b >> 3) & 7), int(b & 7)
+    reg |= d.rexBit(4)
+
+    if mod == ModRmRegister {
+        return reg, name(rm | d.rexBit(1))
+    }
+    return reg, d.memory(mod, rm)
+}
+
+// Formats the memory operand of the mod and rm fields of a ModRM byte.
+func (d *x86Decoder) memory(mod, rm int) (string) {
+    var disp int32
+    base, index, scale := -1, -1, 1
+
+    switch {
+        case rm == int(hasSib):
+            sib := d.byte()
+            scale = 1 << (sib >> 6)
+            index = int((sib >> 3) & 7) | d.rexBit(2)
+            if index == int(noIndex) {
+                index = -1
+            }
+            base = int(sib & 7) | d.rexBit(1)
+            if sib & 7 == byte(noBase) && mod == ModRmMemoryNoDisp {
+                base = -1
+                disp = d.int32()
+            }
+        case rm == int(noBase) && mod == ModRmMemoryNoDisp:
+            disp = d.int32()
+            if d.x64 {
+                d.rip, d.ripDisp = true, disp
+                return x86Number(int64(disp)) + "(%rip)"
+            }
+            return x86Number(int64(disp))
+        default:
+            base = rm | d.rexBit(1)
+    }
+
+    switch mod {
+        case ModRmMemoryDisp8:
+            disp = int32(int8(d.byte()))
+        case ModRmMemoryDisp32:
+            disp = d.int32()
+    }
+
+    s := ""
+    if mod != ModRmMemoryNoDisp || base == -1 {
+        s = x86Number(int64(disp))
+    }
+    switch {
+        case index != -1 && base != -1:
+            s += fmt.Sprintf("(%v,%v,%d)", d.addressRegister(base), d.addressRegister(index), scale)
+        case index != -1:
+            s += fmt.Sprintf("(,%v,%d)", d.addressRegister(index), scale)
+        case base != -1:
+            s += "(" + d.addressRegister(base) + ")"
+    }
+    return s
+}
+
+// Formats the destination of a relative jump or call, which is relative to the end of
+// the instruction.
+func (d *x86Decoder) target(rel int32) (string) {
+    return fmt.Sprintf("0x%x", d.pos + int(rel))
+}
+
+// Decodes the instruction that starts after its prefixes, and returns its text, or ""
+// if it isn't one the assembler emits.
+func (d *x86Decoder) instruction() (string) {
+    op := d.byte()
+
+    switch {
+        // The arithmetic operations, with a register source or destination.
+        case op < 0x40 && (op & 7 == 1 || op & 7 == 3):
+            reg, rm := d.modrm(d.register)
+            name := x86AluNames[op >> 3] + d.suffix()
+            if op & 7 == 1 {
+                return fmt.Sprintf("%v %v,%v", name, d.register(reg), rm)
+            }
+            return fmt.Sprintf("%v %v,%v", name, rm, d.register(reg))
+        case op < 0x40 && op & 7 == 5:
+            return fmt.Sprintf("%v%v $%v,%v", x86AluNames[op >> 3], d.suffix(), x86Number(int64(d.int32())), d.register(0))
+        case op >= x86_PUSH_EAX && op < x86_PUSH_EAX + 8:
+            return "push " + d.addressRegister(int(op & 7) | d.rexBit(1))
+        case op >= x86_POP_EAX && op < x86_POP_EAX + 8:
+            return "pop " + d.addressRegister(int(op & 7) | d.rexBit(1))
+        case op >= x86_JCC_rel8 && op < x86_JCC_rel8 + 16:
+            rel := int32(int8(d.byte()))
+            return "j" + x86ConditionNames[op & 15] + " " + d.target(rel)
+        case op >= x86_MOV_EAXIv && op < x86_MOV_EAXIv + 8:
+            dst := int(op & 7) | d.rexBit(1)
+            if d.rexW() {
+                return fmt.Sprintf("movabsq $%v,%v", x86Number(d.int64()), d.register(dst))
+            }
+            return fmt.Sprintf("movl $%v,%v", x86Number(int64(d.int32())), d.register(dst))
+    }
+
+    switch op {
+        case x64_MOVSXD_GvEv:
+            reg, rm := d.modrm(func(n int) string { return "%" + x86Registers32[n] })
+            return fmt.Sprintf("movslq %v,%v", rm, d.register(reg))
+        case x86_PUSH_Iz:
+            return "push $" + x86Number(int64(d.int32()))
+        case x86_PUSH_Ib:
+            return "push $" + x86Number(int64(int8(d.byte())))
+        case x86_IMUL_GvEvIz, x86_IMUL_GvEvIb:
+            reg, rm := d.modrm(d.register)
+            imm := int64(0)
+            if op == x86_IMUL_GvEvIb {
+                imm = int64(int8(d.byte()))
+            } else {
+                imm = int64(d.int32())
+            }
+            return fmt.Sprintf("imul%v $%v,%v,%v", d.suffix(), x86Number(imm), rm, d.register(reg))
+        case x86_GROUP1_EvIz, x86_GROUP1_EvIb:
+            reg, rm := d.modrm(d.register)
+            imm := int64(0)
+            if op == x86_GROUP1_EvIb {
+                imm = int64(int8(d.byte()))
+            } else {
+                imm = int64(d.int32())
+            }
+            return fmt.Sprintf("%v%v $%v,%v", x86AluNames[reg & 7], d.suffix(), x86Number(imm), rm)
+        case x86_TEST_EvGv, x86_XCHG_EvGv, x86_MOV_EvGv:
+            name := map[byte]string{x86_TEST_EvGv: "test", x86_XCHG_EvGv: "xchg", x86_MOV_EvGv: "mov"}[op]
+            reg, rm := d.modrm(d.register)
+            return fmt.Sprintf("%v%v %v,%v", name, d.suffix(), d.register(reg), rm)
+        case x86_MOV_GvEv, x86_LEA:
+            name := "mov"
+            if op == x86_LEA {
+                name = "lea"
+            }
+            reg, rm := d.modrm(d.register)
+            return fmt.Sprintf("%v%v %v,%v", name, d.suffix(), rm, d.register(reg))
+        case x86_GROUP1A_Ev:
+            _, rm := d.modrm(d.addressRegister)
+            return "pop " + rm
+        case x86_CDQ:
+            if d.rexW() {
+                return "cqto"
+            }
+            return "cltd"
+        case x86_GROUP2_EvIb, x86_GROUP2_Ev1, x86_GROUP2_EvCL:
+            reg, rm := d.modrm(d.register)
+            name := x86ShiftNames[reg & 7] + d.suffix()
+            switch op {
+                case x86_GROUP2_EvIb:
+                    return fmt.Sprintf("%v $%v,%v", name, int8(d.byte()), rm)
+                case x86_GROUP2_EvCL:
+                    return fmt.Sprintf("%v %%cl,%v", name, rm)
+            }
+            return fmt.Sprintf("%v $1,%v", name, rm)
+        case x86_RET:
+            return "ret"
+        case x86_GROUP11_EvIz:
+            _, rm := d.modrm(d.register)
+            return fmt.Sprintf("mov%v $%v,%v", d.suffix(), x86Number(int64(d.int32())), rm)
+        case x86_INT3:
+            return "int3"
+        case x86_CALL_rel32:
+            return "call " + d.target(d.int32())
+        case x86_JMP_rel32:
+            return "jmp " + d.target(d.int32())
+        case x86_JMP_rel8:
+            return "jmp " + d.target(int32(int8(d.byte())))
+        case x86_HLT:
+            return "hlt"
+        case x86_GROUP3_Ev:
+            reg, rm := d.modrm(d.register)
+            name := x86Group3Names[reg & 7] + d.suffix()
+            if reg & 7 == x86_GROUP3_OP_TEST {
+                return fmt.Sprintf("%v $%v,%v", name, x86Number(int64(d.int32())), rm)
+            }
+            return name + " " + rm
+        case x86_GROUP5_Ev:
+            reg, rm := d.modrm(d.addressRegister)
+            switch reg & 7 {
+                case x86_GROUP5_OP_CALLN:
+                    return "call *" + rm
+                case x86_GROUP5_OP_JMPN:
+                    return "jmp *" + rm
+                case x86_GROUP5_OP_PUSH:
+                    return "push " + rm
+            }
+        case x86_2BYTE_ESCAPE:
+            return d.extended()
+    }
+    return ""
+}
+
+// Decodes an instruction with a two-byte opcode, after its escape byte.
+func (d *x86Decoder) extended() (string) {
+    op := d.byte()
+
+    switch {
+        case op >= x86_JCC_rel32 && op < x86_JCC_rel32 + 16:
+            return "j" + x86ConditionNames[op & 15] + " " + d.target(d.int32())
+        case op >= x86_SETCC && op < x86_SETCC + 16:
+            _, rm := d.modrm(d.byteRegister)
+            return "set" + x86ConditionNames[op & 15] + " " + rm
+        case op >= x86_CMOVCC && op < x86_CMOVCC + 16:
+            reg, rm := d.modrm(d.register)
+            return fmt.Sprintf("cmov%v%v %v,%v", x86ConditionNames[op & 15], d.suffix(), rm, d.register(reg))
+    }
+
+    // The SSE operations move between xmm registers, and between them and memory or the
+    // general registers.
+    xmm := func(name string, to bool) (string) {
+        reg, rm := d.modrm(d.xmmRegister)
+        if to {
+            return fmt.Sprintf("%v %v,%v", name, d.xmmRegister(reg), rm)
+        }
+        return fmt.Sprintf("%v %v,%v", name, rm, d.xmmRegister(reg))
+    }
+
+    switch {
+        case d.rep == x86_PRE_SSE_F2 && (op == byte(x86_MOVSD_VsdWsd) || op == x86_MOVSD_WsdVsd):
+            return xmm("movsd", op == x86_MOVSD_WsdVsd)
+        case d.rep == x86_PRE_SSE_F2 && x86SseNames[op] != "":
+            return xmm(x86SseNames[op], false)
+        case d.rep == x86_PRE_SSE_F3 && (op == x86_MOVDQU_VdqWdq || op == x86_MOVDQU_WdqVdq):
+            return xmm("movdqu", op == x86_MOVDQU_WdqVdq)
+        case d.opsize && op == x86_UCOMISD_VsdWsd:
+            return xmm("ucomisd", false)
+        case d.opsize && op == x86_XORPD_VpdWpd:
+            return xmm("xorpd", false)
+        case d.rep == x86_PRE_SSE_F2 && op == x86_CVTSI2SD_VsdEd:
+            name := "cvtsi2sd"
+            if d.rexW() {
+                name = "cvtsi2sdq"
+            }
+            reg, rm := d.modrm(d.register)
+            return fmt.Sprintf("%v %v,%v", name, rm, d.xmmRegister(reg))
+        case d.rep == x86_PRE_SSE_F2 && op == x86_CVTTSD2SI_GdWsd:
+            name := "cvttsd2si"
+            if d.rexW() {
+                name = "cvttsd2siq"
+            }
+            reg, rm := d.modrm(d.xmmRegister)
+            return fmt.Sprintf("%v %v,%v", name, rm, d.register(reg))
+        case d.opsize && (op == x86_MOVD_VdEd || op == x86_MOVD_EdVd):
+            // The operand size prefix selects SSE here, so the integer register is
+            // named by REX.W alone.
+            name := "movd"
+            if d.rexW() {
+                name = "movq"
+            }
+            d.opsize = false
+            reg, rm := d.modrm(d.register)
+            if op == x86_MOVD_EdVd {
+                return fmt.Sprintf("%v %v,%v", name, d.xmmRegister(reg), rm)
+            }
+            return fmt.Sprintf("%v %v,%v", name, rm, d.xmmRegister(reg))
+        case d.opsize && op == x86_PEXTRW_GdUdIb:
+            d.opsize = false
+            reg, rm := d.modrm(d.xmmRegister)
+            return fmt.Sprintf("pextrw $%v,%v,%v", d.byte(), rm, d.register(reg))
+        case d.rep != 0:
+            return ""
+    }
+
+    switch op {
+        case x86_IMUL_GvEv:
+            reg, rm := d.modrm(d.register)
+            return fmt.Sprintf("imul%v %v,%v", d.suffix(), rm, d.register(reg))
+        case x86_MOVZX_GvEb:
+            reg, rm := d.modrm(d.byteRegister)
+            return fmt.Sprintf("movzb%v %v,%v", d.suffix(), rm, d.register(reg))
+        case x86_MOVZX_GvEw:
+            reg, rm := d.modrm(func(n int) string { return "%" + x86Registers16[n] })
+            return fmt.Sprintf("movzw%v %v,%v", d.suffix(), rm, d.register(reg))
+    }
+    return ""
+}
+
+// Decodes the instruction at pc in the code, which is x86-64 code if x64 is set.  Returns
+// its text and its length in bytes.  An unknown instruction is returned as a .byte of its
+// first byte, with a length of 1.
+func DecodeX86(code []byte, pc int, x64 bool) (string, int, os.Error) {
+    d := &x86Decoder{code: code, pos: pc, x64: x64}
+
+prefixes:
+    for d.pos < len(code) {
+        b := code[d.pos]
+        switch {
+            case b == x86_PRE_OPERAND_SIZE:
+                d.opsize = true
+            case b == x86_PRE_SSE_F2 || b == x86_PRE_SSE_F3:
+                d.rep = b
+            case x64 && b & 0xf0 == x64_PRE_REX:
+                // A REX prefix must be the last prefix.
+                d.rex = b
+                d.pos++
+                break prefixes
+            default:
+                break prefixes
+        }
+        d.pos++
+    }
+
+    text := d.instruction()
+    if d.err != nil {
+        return "", 0, d.err
+    }
+    if text == "" {
+        return fmt.Sprintf(".byte 0x%02x", code[pc]), 1, nil
+    }
+    if d.rip {
+        text += fmt.Sprintf("  # 0x%x", d.pos + int(d.ripDisp))
+    }
+    return text, d.pos - pc, nil
+}
+
+// Writes the instructions of the x86 code to w, one per line, with their offsets and
+// bytes.  Code that ends in the middle of an instruction is written as .byte, and the
+// error is returned after it.
+func DisassembleX86(code []byte, x64 bool, w io.Writer) (os.Error) {
+    for pc := 0; pc < len(code); {
+        text, n, err := DecodeX86(code, pc, x64)
+        if err != nil {
+            for ; pc < len(code); pc++ {
+                fmt.Fprintf(w, "%6x:  %-24v  .byte 0x%02x\n", pc, fmt.Sprintf("%02x", code[pc]), code[pc])
+            }
+            return err
+        }
+
+        hex := make([]string, n)
+        for i, b := range code[pc:pc + n] {
+            hex[i] = fmt.Sprintf("%02x", b)
+        }
+        if _, err := fmt.Fprintf(w, "%6x:  %-24v  %v\n", pc, strings.Join(hex, " "), text); err != nil {
+            return err
+        }
+        pc += n
+    }
+    return nil
+}
+
+// Writes the instructions in the buffer to w.
+func (buf *X86Buffer) Disassemble(w io.Writer) (os.Error) {
+    return DisassembleX86(buf.Bytes(), buf.IsX64, w)
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the x86 disassembler.
+
+*/
+
+package python
+
+import (
+        "bytes"
+        "strings"
+        "testing"
+)
+
+var disTests = []struct {
+    x64     bool
+    emit    func(buf *X86Buffer)
+    want    string
+}{
+    {false, func(b *X86Buffer) { b.Push(x86_ebp) }, "push %ebp"},
+    {false, func(b *X86Buffer) { b.MovlMR(8, x86_ebp, x86_eax) }, "movl 8(%ebp),%eax"},
+    {false, func(b *X86Buffer) { b.MovlRM(x86_eax, 0x100, x86_ebx) }, "movl %eax,0x100(%ebx)"},
+    {false, func(b *X86Buffer) { b.MovlMR(0, x86_ecx, x86_eax) }, "movl (%ecx),%eax"},
+    {false, func(b *X86Buffer) { b.MovlMR(4, x86_esp, x86_eax) }, "movl 4(%esp),%eax"},
+    {false, func(b *X86Buffer) { b.MovlIR(0x12345678, x86_eax) }, "movl $0x12345678,%eax"},
+    {false, func(b *X86Buffer) { b.AddlIR(1, x86_eax) }, "addl $1,%eax"},
+    {false, func(b *X86Buffer) { b.SublIR(-1, x86_esp) }, "subl $-1,%esp"},
+    {false, func(b *X86Buffer) { b.ImulIRR(10, x86_ecx, x86_eax) }, "imull $10,%ecx,%eax"},
+    {false, func(b *X86Buffer) { b.ImulIRR(0x1000, x86_ecx, x86_eax) }, "imull $0x1000,%ecx,%eax"},
+    {false, func(b *X86Buffer) { b.PushI(1) }, "push $1"},
+    {false, func(b *X86Buffer) { b.IdivlR(x86_ecx) }, "idivl %ecx"},
+    {false, func(b *X86Buffer) { b.ShllIR(1, x86_eax) }, "shll $1,%eax"},
+    {false, func(b *X86Buffer) { b.ShllCLR(x86_eax) }, "shll %cl,%eax"},
+    {false, func(b *X86Buffer) { b.Setcc(x86_conditionE, x86_eax) }, "sete %al"},
+    {false, func(b *X86Buffer) { b.MovzblRR(x86_eax, x86_eax) }, "movzbl %al,%eax"},
+    {false, func(b *X86Buffer) { b.CallM(8, x86_esi) }, "call *8(%esi)"},
+    {false, func(b *X86Buffer) { b.MovlSR(0x100, x86_ebp, x86_eax, 2, x86_ecx) }, "movl 0x100(%ebp,%eax,2),%ecx"},
+    {false, func(b *X86Buffer) { b.MovsdMR(8, x86_ebp, vec_xmm0) }, "movsd 8(%ebp),%xmm0"},
+    {false, func(b *X86Buffer) { b.MovsdRM(vec_xmm0, 0, x86_esp) }, "movsd %xmm0,(%esp)"},
+    {false, func(b *X86Buffer) { b.Cvttsd2siRR(vec_xmm1, x86_eax) }, "cvttsd2si %xmm1,%eax"},
+    {false, func(b *X86Buffer) { b.UcomisdRR(vec_xmm1, vec_xmm0) }, "ucomisd %xmm1,%xmm0"},
+
+    {true, func(b *X86Buffer) { b.Push(x64_r12) }, "push %r12"},
+    {true, func(b *X86Buffer) { b.MovqRR(x86_esp, x86_ebp) }, "movq %rsp,%rbp"},
+    {true, func(b *X86Buffer) { b.MovqIR(0x1122334455667788, x64_r9) }, "movabsq $0x1122334455667788,%r9"},
+    {true, func(b *X86Buffer) { b.MovlRM(x64_r9, 0, x64_r12) }, "movl %r9d,(%r12)"},
+    {true, func(b *X86Buffer) { b.MovqIM(-1, 8, x64_r15) }, "movq $-1,8(%r15)"},
+    {true, func(b *X86Buffer) { b.MovqRS(x64_r8, -8, x86_ebp, x64_r12, 8) }, "movq %r8,-8(%rbp,%r12,8)"},
+    {true, func(b *X86Buffer) { b.SubqIR(16, x86_esp) }, "subq $16,%rsp"},
+    {true, func(b *X86Buffer) { b.AddqIR(0x1000, x86_eax) }, "addq $0x1000,%rax"},
+    {true, func(b *X86Buffer) { b.MovqIR(-1, x86_eax) }, "movq $-1,%rax"},
+    {true, func(b *X86Buffer) { b.Cqo() }, "cqto"},
+    {true, func(b *X86Buffer) { b.CallR(x64_r11) }, "call *%r11"},
+    {true, func(b *X86Buffer) { b.Setcc(x86_conditionL, x86_esi) }, "setl %sil"},
+    {true, func(b *X86Buffer) { b.Cmovqcc(x86_conditionGE, x86_eax, x64_r12) }, "cmovgeq %rax,%r12"},
+    {true, func(b *X86Buffer) { b.Cvtsi2sdqRR(x86_eax, vec_xmm1) }, "cvtsi2sdq %rax,%xmm1"},
+    {true, func(b *X86Buffer) { b.MovqXR(vec_xmm0, x86_eax) }, "movq %xmm0,%rax"},
+    {true, func(b *X86Buffer) { b.MovdquMR(-32, x86_ebp, 15) }, "movdqu -32(%rbp),%xmm15"},
+}
+
+func TestDecodeX86(t *testing.T) {
+    for _, test := range disTests {
+        buf := &X86Buffer{Buffer: new(bytes.Buffer), IsX64: test.x64}
+        test.emit(buf)
+        text, n, err := DecodeX86(buf.Bytes(), 0, test.x64)
+        if err != nil || text != test.want || n != buf.Len() {
+            t.Errorf("% x: expected %q of %d bytes, got %q of %d bytes (%v)", buf.Bytes(), test.want, buf.Len(), text, n, err)
+        }
+    }
+}
+
+// Everything the assembler emits decodes to a single instruction.
+func TestDecodeX86Assembler(t *testing.T) {
+    for _, test := range asmTests {
+        buf := &X86Buffer{Buffer: new(bytes.Buffer), IsX64: test.x64}
+        test.emit(buf)
+        text, n, err := DecodeX86(buf.Bytes(), 0, test.x64)
+        if err != nil || n != buf.Len() || strings.HasPrefix(text, ".byte") {
+            t.Errorf("%s: decoded %q of %d bytes from % x (%v)", test.name, text, n, buf.Bytes(), err)
+        }
+    }
+}
+
+func TestDisassembleX86(t *testing.T) {
+    buf := &X86Buffer{Buffer: new(bytes.Buffer), IsX64: true}
+    pool, done := new(Label), new(Label)
+    buf.Push(x86_ebp)
+    buf.JccTo(x86_conditionE, done)
+    buf.MovqPR(pool, x86_eax)
+    buf.Bind(done)
+    buf.Ret()
+    buf.Align(8)
+    buf.Bind(pool)
+    buf.WriteByte(0x06)
+
+    out := new(bytes.Buffer)
+    if err := buf.Disassemble(out); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    want := "     0:  55                        push %rbp\n" +
+            "     1:  0f 84 07 00 00 00         je 0xe\n" +
+            "     7:  48 8b 05 02 00 00 00      movq 2(%rip),%rax  # 0x10\n" +
+            "     e:  c3                        ret\n" +
+            "     f:  cc                        int3\n" +
+            "    10:  06                        .byte 0x06\n"
+    if out.String() != want {
+        t.Errorf("expected:\n%v\ngot:\n%v", want, out.String())
+    }
+
+    out.Reset()
+    if err := DisassembleX86([]byte{0xc3, 0x48, 0x8b}, true, out); err != TruncatedInstruction {
+        t.Errorf("expected a truncated instruction, got %v", err)
+    }
+    if !strings.HasSuffix(out.String(), "     2:  8b                        .byte 0x8b\n") {
+        t.Errorf("expected the truncated bytes, got:\n%v", out.String())
+    }
+}
@@ -0,0 +1,302 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the x86 assembler, against the machine code a real assembler
+  produces for each instruction.
+
+*/
+
+package python
+
+import (
+        "bytes"
+        "testing"
+)
+
+type asmTest struct {
+    name    string
+    x64     bool
+    emit    func(buf *X86Buffer)
+    want    []byte
+}
+
+var asmTests = []asmTest {
+    {"push %ebp", false, func(b *X86Buffer) { b.Push(x86_ebp) }, []byte{0x55}},
+    {"pop %ebp", false, func(b *X86Buffer) { b.Pop(x86_ebp) }, []byte{0x5d}},
+    {"push $1", false, func(b *X86Buffer) { b.PushI(1) }, []byte{0x6a, 0x01}},
+    {"push $0x1000", false, func(b *X86Buffer) { b.PushI(0x1000) }, []byte{0x68, 0x00, 0x10, 0x00, 0x00}},
+    {"movl %eax,%ecx", false, func(b *X86Buffer) { b.MovlRR(x86_eax, x86_ecx) }, []byte{0x89, 0xc1}},
+    {"movl 8(%ebp),%eax", false, func(b *X86Buffer) { b.MovlMR(8, x86_ebp, x86_eax) }, []byte{0x8b, 0x45, 0x08}},
+    {"movl 0(%ebp),%eax", false, func(b *X86Buffer) { b.MovlMR(0, x86_ebp, x86_eax) }, []byte{0x8b, 0x45, 0x00}},
+    {"movl (%ecx),%eax", false, func(b *X86Buffer) { b.MovlMR(0, x86_ecx, x86_eax) }, []byte{0x8b, 0x01}},
+    {"movl 4(%esp),%eax", false, func(b *X86Buffer) { b.MovlMR(4, x86_esp, x86_eax) }, []byte{0x8b, 0x44, 0x24, 0x04}},
+    {"movl %eax,-4(%ebp)", false, func(b *X86Buffer) { b.MovlRM(x86_eax, -4, x86_ebp) }, []byte{0x89, 0x45, 0xfc}},
+    {"movl %eax,0x100(%ebx)", false, func(b *X86Buffer) { b.MovlRM(x86_eax, 0x100, x86_ebx) }, []byte{0x89, 0x83, 0x00, 0x01, 0x00, 0x00}},
+    {"movl $0x12345678,%eax", false, func(b *X86Buffer) { b.MovlIR(0x12345678, x86_eax) }, []byte{0xb8, 0x78, 0x56, 0x34, 0x12}},
+    {"movzbl %al,%eax", false, func(b *X86Buffer) { b.MovzblRR(x86_eax, x86_eax) }, []byte{0x0f, 0xb6, 0xc0}},
+    {"leal 8(%ebp),%eax", false, func(b *X86Buffer) { b.LealMR(8, x86_ebp, x86_eax) }, []byte{0x8d, 0x45, 0x08}},
+    {"addl %ecx,%eax", false, func(b *X86Buffer) { b.AddlRR(x86_ecx, x86_eax) }, []byte{0x01, 0xc8}},
+    {"addl $1,%eax", false, func(b *X86Buffer) { b.AddlIR(1, x86_eax) }, []byte{0x83, 0xc0, 0x01}},
+    {"addl $0x1000,%ecx", false, func(b *X86Buffer) { b.AddlIR(0x1000, x86_ecx) }, []byte{0x81, 0xc1, 0x00, 0x10, 0x00, 0x00}},
+    {"subl %edx,%eax", false, func(b *X86Buffer) { b.SublRR(x86_edx, x86_eax) }, []byte{0x29, 0xd0}},
+    {"subl $-1,%esp", false, func(b *X86Buffer) { b.SublIR(-1, x86_esp) }, []byte{0x83, 0xec, 0xff}},
+    {"andl %ecx,%eax", false, func(b *X86Buffer) { b.AndlRR(x86_ecx, x86_eax) }, []byte{0x21, 0xc8}},
+    {"orl $2,%edx", false, func(b *X86Buffer) { b.OrlIR(2, x86_edx) }, []byte{0x83, 0xca, 0x02}},
+    {"xorl %eax,%eax", false, func(b *X86Buffer) { b.XorlRR(x86_eax, x86_eax) }, []byte{0x31, 0xc0}},
+    {"imull %ecx,%eax", false, func(b *X86Buffer) { b.ImulRR(x86_ecx, x86_eax) }, []byte{0x0f, 0xaf, 0xc1}},
+    {"imull $10,%ecx,%eax", false, func(b *X86Buffer) { b.ImulIRR(10, x86_ecx, x86_eax) }, []byte{0x6b, 0xc1, 0x0a}},
+    {"imull $128,%ecx,%eax", false, func(b *X86Buffer) { b.ImulIRR(128, x86_ecx, x86_eax) }, []byte{0x69, 0xc1, 0x80, 0x00, 0x00, 0x00}},
+    {"negl %eax", false, func(b *X86Buffer) { b.NeglR(x86_eax) }, []byte{0xf7, 0xd8}},
+    {"notl %ecx", false, func(b *X86Buffer) { b.NotlR(x86_ecx) }, []byte{0xf7, 0xd1}},
+    {"cltd", false, func(b *X86Buffer) { b.Cdq() }, []byte{0x99}},
+    {"idivl %ecx", false, func(b *X86Buffer) { b.IdivlR(x86_ecx) }, []byte{0xf7, 0xf9}},
+    {"shll $1,%eax", false, func(b *X86Buffer) { b.ShllIR(1, x86_eax) }, []byte{0xd1, 0xe0}},
+    {"sarl $3,%eax", false, func(b *X86Buffer) { b.SarlIR(3, x86_eax) }, []byte{0xc1, 0xf8, 0x03}},
+    {"shrl $4,%edx", false, func(b *X86Buffer) { b.ShrlIR(4, x86_edx) }, []byte{0xc1, 0xea, 0x04}},
+    {"shll %cl,%eax", false, func(b *X86Buffer) { b.ShllCLR(x86_eax) }, []byte{0xd3, 0xe0}},
+    {"cmpl %ecx,%eax", false, func(b *X86Buffer) { b.CmplRR(x86_ecx, x86_eax) }, []byte{0x39, 0xc8}},
+    {"cmpl $100,%eax", false, func(b *X86Buffer) { b.CmplIR(100, x86_eax) }, []byte{0x83, 0xf8, 0x64}},
+    {"testl %eax,%eax", false, func(b *X86Buffer) { b.TestlRR(x86_eax, x86_eax) }, []byte{0x85, 0xc0}},
+    {"sete %al", false, func(b *X86Buffer) { b.Setcc(x86_conditionE, x86_eax) }, []byte{0x0f, 0x94, 0xc0}},
+    {"setnp %dl", false, func(b *X86Buffer) { b.Setcc(x86_conditionNP, x86_edx) }, []byte{0x0f, 0x9b, 0xc2}},
+    {"cmove %ecx,%eax", false, func(b *X86Buffer) { b.Cmovcc(x86_conditionE, x86_ecx, x86_eax) }, []byte{0x0f, 0x44, 0xc1}},
+    {"cmovp %edx,%eax", false, func(b *X86Buffer) { b.Cmovcc(x86_conditionP, x86_edx, x86_eax) }, []byte{0x0f, 0x4a, 0xc2}},
+    {"jmp", false, func(b *X86Buffer) { b.Jmp() }, []byte{0xe9, 0x00, 0x00, 0x00, 0x00}},
+    {"je", false, func(b *X86Buffer) { b.Jcc(x86_conditionE) }, []byte{0x0f, 0x84, 0x00, 0x00, 0x00, 0x00}},
+    {"call", false, func(b *X86Buffer) { b.Call() }, []byte{0xe8, 0x00, 0x00, 0x00, 0x00}},
+    {"call *8(%esi)", false, func(b *X86Buffer) { b.CallM(8, x86_esi) }, []byte{0xff, 0x56, 0x08}},
+    {"movl $5,4(%esi)", false, func(b *X86Buffer) { b.MovlIM(5, 4, x86_esi) }, []byte{0xc7, 0x46, 0x04, 0x05, 0x00, 0x00, 0x00}},
+    {"call *%eax", false, func(b *X86Buffer) { b.CallR(x86_eax) }, []byte{0xff, 0xd0}},
+    {"jmp *%ecx", false, func(b *X86Buffer) { b.JmpR(x86_ecx) }, []byte{0xff, 0xe1}},
+    {"ret", false, func(b *X86Buffer) { b.Ret() }, []byte{0xc3}},
+    {"int3", false, func(b *X86Buffer) { b.Int3() }, []byte{0xcc}},
+    {"addsd %xmm1,%xmm0", false, func(b *X86Buffer) { b.AddsdRR(vec_xmm1, vec_xmm0) }, []byte{0xf2, 0x0f, 0x58, 0xc1}},
+    {"mulsd %xmm2,%xmm3", false, func(b *X86Buffer) { b.MulsdRR(vec_xmm2, vec_xmm3) }, []byte{0xf2, 0x0f, 0x59, 0xda}},
+    {"movsd 8(%ebp),%xmm0", false, func(b *X86Buffer) { b.MovsdMR(8, x86_ebp, vec_xmm0) }, []byte{0xf2, 0x0f, 0x10, 0x45, 0x08}},
+    {"movsd %xmm0,(%esp)", false, func(b *X86Buffer) { b.MovsdRM(vec_xmm0, 0, x86_esp) }, []byte{0xf2, 0x0f, 0x11, 0x04, 0x24}},
+    {"cvtsi2sd %eax,%xmm2", false, func(b *X86Buffer) { b.Cvtsi2sdRR(x86_eax, vec_xmm2) }, []byte{0xf2, 0x0f, 0x2a, 0xd0}},
+    {"cvttsd2si %xmm1,%eax", false, func(b *X86Buffer) { b.Cvttsd2siRR(vec_xmm1, x86_eax) }, []byte{0xf2, 0x0f, 0x2c, 0xc1}},
+    {"ucomisd %xmm1,%xmm0", false, func(b *X86Buffer) { b.UcomisdRR(vec_xmm1, vec_xmm0) }, []byte{0x66, 0x0f, 0x2e, 0xc1}},
+    {"xorpd %xmm0,%xmm0", false, func(b *X86Buffer) { b.XorpdRR(vec_xmm0, vec_xmm0) }, []byte{0x66, 0x0f, 0x57, 0xc0}},
+
+    {"movl 8(%ebx,%ecx,4),%eax", false, func(b *X86Buffer) { b.MovlSR(8, x86_ebx, x86_ecx, 4, x86_eax) }, []byte{0x8b, 0x44, 0x8b, 0x08}},
+    {"movl %eax,(%esi,%edi,1)", false, func(b *X86Buffer) { b.MovlRS(x86_eax, 0, x86_esi, x86_edi, 1) }, []byte{0x89, 0x04, 0x3e}},
+    {"movl 0x100(%ebp,%eax,2),%ecx", false, func(b *X86Buffer) { b.MovlSR(0x100, x86_ebp, x86_eax, 2, x86_ecx) }, []byte{0x8b, 0x8c, 0x45, 0x00, 0x01, 0x00, 0x00}},
+    {"leal (%eax,%eax,8),%edx", false, func(b *X86Buffer) { b.LealSR(0, x86_eax, x86_eax, 8, x86_edx) }, []byte{0x8d, 0x14, 0xc0}},
+    {"addl %eax,8(%ebp)", false, func(b *X86Buffer) { b.AddlRM(x86_eax, 8, x86_ebp) }, []byte{0x01, 0x45, 0x08}},
+    {"addl $1,8(%ebp)", false, func(b *X86Buffer) { b.AddlIM(1, 8, x86_ebp) }, []byte{0x83, 0x45, 0x08, 0x01}},
+    {"addl 4(%esi,%ebx,4),%eax", false, func(b *X86Buffer) { b.AddlSR(4, x86_esi, x86_ebx, 4, x86_eax) }, []byte{0x03, 0x44, 0x9e, 0x04}},
+    {"cmpl 8(%ebp),%eax", false, func(b *X86Buffer) { b.CmplMR(8, x86_ebp, x86_eax) }, []byte{0x3b, 0x45, 0x08}},
+    {"cmpl %eax,8(%ebp)", false, func(b *X86Buffer) { b.CmplRM(x86_eax, 8, x86_ebp) }, []byte{0x39, 0x45, 0x08}},
+    {"cmpl $0x1000,(%ecx)", false, func(b *X86Buffer) { b.CmplIM(0x1000, 0, x86_ecx) }, []byte{0x81, 0x39, 0x00, 0x10, 0x00, 0x00}},
+    {"cmpl (%edx,%ecx,1),%eax", false, func(b *X86Buffer) { b.CmplSR(0, x86_edx, x86_ecx, 1, x86_eax) }, []byte{0x3b, 0x04, 0x0a}},
+    {"movsd (%eax,%ecx,8),%xmm1", false, func(b *X86Buffer) { b.MovsdSR(0, x86_eax, x86_ecx, 8, vec_xmm1) }, []byte{0xf2, 0x0f, 0x10, 0x0c, 0xc8}},
+
+    {"push %r12", true, func(b *X86Buffer) { b.Push(x64_r12) }, []byte{0x41, 0x54}},
+    {"pop %rbp", true, func(b *X86Buffer) { b.Pop(x86_ebp) }, []byte{0x5d}},
+    {"movq %rsp,%rbp", true, func(b *X86Buffer) { b.MovqRR(x86_esp, x86_ebp) }, []byte{0x48, 0x89, 0xe5}},
+    {"movq %r8,%rax", true, func(b *X86Buffer) { b.MovqRR(x64_r8, x86_eax) }, []byte{0x4c, 0x89, 0xc0}},
+    {"movq 16(%rdi),%rax", true, func(b *X86Buffer) { b.MovqMR(16, x86_edi, x86_eax) }, []byte{0x48, 0x8b, 0x47, 0x10}},
+    {"movq %rax,-8(%rbp)", true, func(b *X86Buffer) { b.MovqRM(x86_eax, -8, x86_ebp) }, []byte{0x48, 0x89, 0x45, 0xf8}},
+    {"movabsq", true, func(b *X86Buffer) { b.MovqIR(0x1122334455667788, x64_r9) }, []byte{0x49, 0xb9, 0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11}},
+    {"movl %r9d,(%r12)", true, func(b *X86Buffer) { b.MovlRM(x64_r9, 0, x64_r12) }, []byte{0x45, 0x89, 0x0c, 0x24}},
+    {"movl 8(%r13),%eax", true, func(b *X86Buffer) { b.MovlMR(8, x64_r13, x86_eax) }, []byte{0x41, 0x8b, 0x45, 0x08}},
+    {"movl (%r13),%eax", true, func(b *X86Buffer) { b.MovlMR(0, x64_r13, x86_eax) }, []byte{0x41, 0x8b, 0x45, 0x00}},
+    {"movl $1,%r10d", true, func(b *X86Buffer) { b.MovlIR(1, x64_r10) }, []byte{0x41, 0xba, 0x01, 0x00, 0x00, 0x00}},
+    {"leaq 8(%rsp),%rsi", true, func(b *X86Buffer) { b.LeaqMR(8, x86_esp, x86_esi) }, []byte{0x48, 0x8d, 0x74, 0x24, 0x08}},
+    {"addq %rcx,%rax", true, func(b *X86Buffer) { b.AddqRR(x86_ecx, x86_eax) }, []byte{0x48, 0x01, 0xc8}},
+    {"subq $16,%rsp", true, func(b *X86Buffer) { b.SubqIR(16, x86_esp) }, []byte{0x48, 0x83, 0xec, 0x10}},
+    {"addq $0x1000,%r11", true, func(b *X86Buffer) { b.AddqIR(0x1000, x64_r11) }, []byte{0x49, 0x81, 0xc3, 0x00, 0x10, 0x00, 0x00}},
+    {"imulq %r8,%rax", true, func(b *X86Buffer) { b.ImulqRR(x64_r8, x86_eax) }, []byte{0x49, 0x0f, 0xaf, 0xc0}},
+    {"cmpq %rsi,%rdi", true, func(b *X86Buffer) { b.CmpqRR(x86_esi, x86_edi) }, []byte{0x48, 0x39, 0xf7}},
+    {"negq %rdx", true, func(b *X86Buffer) { b.NegqR(x86_edx) }, []byte{0x48, 0xf7, 0xda}},
+    {"cqto", true, func(b *X86Buffer) { b.Cqo() }, []byte{0x48, 0x99}},
+    {"idivq %rcx", true, func(b *X86Buffer) { b.IdivqR(x86_ecx) }, []byte{0x48, 0xf7, 0xf9}},
+    {"sarq $63,%rax", true, func(b *X86Buffer) { b.SarqIR(63, x86_eax) }, []byte{0x48, 0xc1, 0xf8, 0x3f}},
+    {"testq %rax,%rax", true, func(b *X86Buffer) { b.TestqRR(x86_eax, x86_eax) }, []byte{0x48, 0x85, 0xc0}},
+    {"call *16(%r15)", true, func(b *X86Buffer) { b.CallM(16, x64_r15) }, []byte{0x41, 0xff, 0x57, 0x10}},
+    {"movq $-1,8(%r15)", true, func(b *X86Buffer) { b.MovqIM(-1, 8, x64_r15) }, []byte{0x49, 0xc7, 0x47, 0x08, 0xff, 0xff, 0xff, 0xff}},
+    {"notq %rax", true, func(b *X86Buffer) { b.NotqR(x86_eax) }, []byte{0x48, 0xf7, 0xd0}},
+    {"andq %rbx,%rax", true, func(b *X86Buffer) { b.AndqRR(x86_ebx, x86_eax) }, []byte{0x48, 0x21, 0xd8}},
+    {"call *%r11", true, func(b *X86Buffer) { b.CallR(x64_r11) }, []byte{0x41, 0xff, 0xd3}},
+    {"setl %sil", true, func(b *X86Buffer) { b.Setcc(x86_conditionL, x86_esi) }, []byte{0x40, 0x0f, 0x9c, 0xc6}},
+    {"cmovlq %r9,%rbx", true, func(b *X86Buffer) { b.Cmovqcc(x86_conditionL, x64_r9, x86_ebx) }, []byte{0x49, 0x0f, 0x4c, 0xd9}},
+    {"cmovgeq %rax,%r12", true, func(b *X86Buffer) { b.Cmovqcc(x86_conditionGE, x86_eax, x64_r12) }, []byte{0x4c, 0x0f, 0x4d, 0xe0}},
+    {"addsd %xmm1,%xmm0", true, func(b *X86Buffer) { b.AddsdRR(vec_xmm1, vec_xmm0) }, []byte{0xf2, 0x0f, 0x58, 0xc1}},
+    {"cvtsi2sdq %rax,%xmm1", true, func(b *X86Buffer) { b.Cvtsi2sdqRR(x86_eax, vec_xmm1) }, []byte{0xf2, 0x48, 0x0f, 0x2a, 0xc8}},
+    {"cvttsd2siq %xmm0,%rax", true, func(b *X86Buffer) { b.Cvttsd2siqRR(vec_xmm0, x86_eax) }, []byte{0xf2, 0x48, 0x0f, 0x2c, 0xc0}},
+    {"movq %rax,%xmm0", true, func(b *X86Buffer) { b.MovqRX(x86_eax, vec_xmm0) }, []byte{0x66, 0x48, 0x0f, 0x6e, 0xc0}},
+    {"movq %xmm0,%rax", true, func(b *X86Buffer) { b.MovqXR(vec_xmm0, x86_eax) }, []byte{0x66, 0x48, 0x0f, 0x7e, 0xc0}},
+    {"movdqu %xmm6,-16(%rbp)", true, func(b *X86Buffer) { b.MovdquRM(vec_xmm6, -16, x86_ebp) }, []byte{0xf3, 0x0f, 0x7f, 0x75, 0xf0}},
+    {"movdqu -32(%rbp),%xmm15", true, func(b *X86Buffer) { b.MovdquMR(-32, x86_ebp, 15) }, []byte{0xf3, 0x44, 0x0f, 0x6f, 0x7d, 0xe0}},
+    {"movq (%rax,%r9,8),%rdx", true, func(b *X86Buffer) { b.MovqSR(0, x86_eax, x64_r9, 8, x86_edx) }, []byte{0x4a, 0x8b, 0x14, 0xc8}},
+    {"movq (%r13,%rcx,1),%rax", true, func(b *X86Buffer) { b.MovqSR(0, x64_r13, x86_ecx, 1, x86_eax) }, []byte{0x49, 0x8b, 0x44, 0x0d, 0x00}},
+    {"movq %r8,-8(%rbp,%r12,8)", true, func(b *X86Buffer) { b.MovqRS(x64_r8, -8, x86_ebp, x64_r12, 8) }, []byte{0x4e, 0x89, 0x44, 0xe5, 0xf8}},
+    {"leaq 16(%rsp,%rax,2),%rcx", true, func(b *X86Buffer) { b.LeaqSR(16, x86_esp, x86_eax, 2, x86_ecx) }, []byte{0x48, 0x8d, 0x4c, 0x44, 0x10}},
+    {"addq $0x1000,(%rdi)", true, func(b *X86Buffer) { b.AddqIM(0x1000, 0, x86_edi) }, []byte{0x48, 0x81, 0x07, 0x00, 0x10, 0x00, 0x00}},
+    {"addq 8(%r15),%rax", true, func(b *X86Buffer) { b.AddqMR(8, x64_r15, x86_eax) }, []byte{0x49, 0x03, 0x47, 0x08}},
+    {"addq %rax,(%rsp)", true, func(b *X86Buffer) { b.AddqRM(x86_eax, 0, x86_esp) }, []byte{0x48, 0x01, 0x04, 0x24}},
+    {"addq (%rdi,%rsi,8),%rax", true, func(b *X86Buffer) { b.AddqSR(0, x86_edi, x86_esi, 8, x86_eax) }, []byte{0x48, 0x03, 0x04, 0xf7}},
+    {"cmpq $0,-8(%rbp)", true, func(b *X86Buffer) { b.CmpqIM(0, -8, x86_ebp) }, []byte{0x48, 0x83, 0x7d, 0xf8, 0x00}},
+    {"cmpq 16(%rbx),%r10", true, func(b *X86Buffer) { b.CmpqMR(16, x86_ebx, x64_r10) }, []byte{0x4c, 0x3b, 0x53, 0x10}},
+    {"cmpq %rax,(%r12)", true, func(b *X86Buffer) { b.CmpqRM(x86_eax, 0, x64_r12) }, []byte{0x49, 0x39, 0x04, 0x24}},
+    {"movsd 8(%r12),%xmm0", true, func(b *X86Buffer) { b.MovsdMR(8, x64_r12, vec_xmm0) }, []byte{0xf2, 0x41, 0x0f, 0x10, 0x44, 0x24, 0x08}},
+}
+
+// The immediates at the edges of each encoding, which must take the shortest form.
+var asmImmediateTests = []asmTest {
+    {"pushq $-128", true, func(b *X86Buffer) { b.PushI(-128) }, []byte{0x6a, 0x80}},
+    {"pushq $127", true, func(b *X86Buffer) { b.PushI(127) }, []byte{0x6a, 0x7f}},
+    {"pushq $128", true, func(b *X86Buffer) { b.PushI(128) }, []byte{0x68, 0x80, 0x00, 0x00, 0x00}},
+    {"imull $-128,%ecx,%eax", false, func(b *X86Buffer) { b.ImulIRR(-128, x86_ecx, x86_eax) }, []byte{0x6b, 0xc1, 0x80}},
+    {"imulq $127,%r9,%rdx", true, func(b *X86Buffer) { b.ImulqIRR(127, x64_r9, x86_edx) }, []byte{0x49, 0x6b, 0xd1, 0x7f}},
+    {"imulq $0x1000,%rcx,%rax", true, func(b *X86Buffer) { b.ImulqIRR(0x1000, x86_ecx, x86_eax) }, []byte{0x48, 0x69, 0xc1, 0x00, 0x10, 0x00, 0x00}},
+    {"movl $0,%eax", true, func(b *X86Buffer) { b.MovqIR(0, x86_eax) }, []byte{0xb8, 0x00, 0x00, 0x00, 0x00}},
+    {"movl $0xffffffff,%r9d", true, func(b *X86Buffer) { b.MovqIR(0xffffffff, x64_r9) }, []byte{0x41, 0xb9, 0xff, 0xff, 0xff, 0xff}},
+    {"movq $-1,%rax", true, func(b *X86Buffer) { b.MovqIR(-1, x86_eax) }, []byte{0x48, 0xc7, 0xc0, 0xff, 0xff, 0xff, 0xff}},
+    {"movq $-0x80000000,%r12", true, func(b *X86Buffer) { b.MovqIR(-0x80000000, x64_r12) }, []byte{0x49, 0xc7, 0xc4, 0x00, 0x00, 0x00, 0x80}},
+    {"movabsq $0x100000000,%rdx", true, func(b *X86Buffer) { b.MovqIR(0x100000000, x86_edx) }, []byte{0x48, 0xba, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}},
+    {"movabsq $1,%rax", true, func(b *X86Buffer) { b.MovabsqIR(1, x86_eax) }, []byte{0x48, 0xb8, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+    {"addq $127,%rax", true, func(b *X86Buffer) { b.AddqIR(127, x86_eax) }, []byte{0x48, 0x83, 0xc0, 0x7f}},
+    {"addq $128,%rax", true, func(b *X86Buffer) { b.AddqIR(128, x86_eax) }, []byte{0x48, 0x05, 0x80, 0x00, 0x00, 0x00}},
+    {"addq $-128,%rax", true, func(b *X86Buffer) { b.AddqIR(-128, x86_eax) }, []byte{0x48, 0x83, 0xc0, 0x80}},
+    {"addq $-129,%rax", true, func(b *X86Buffer) { b.AddqIR(-129, x86_eax) }, []byte{0x48, 0x05, 0x7f, 0xff, 0xff, 0xff}},
+    {"orq $1,%rcx", true, func(b *X86Buffer) { b.OrqIR(1, x86_ecx) }, []byte{0x48, 0x83, 0xc9, 0x01}},
+    {"orq $0x100,%r8", true, func(b *X86Buffer) { b.OrqIR(0x100, x64_r8) }, []byte{0x49, 0x81, 0xc8, 0x00, 0x01, 0x00, 0x00}},
+    {"andq $-16,%rsp", true, func(b *X86Buffer) { b.AndqIR(-16, x86_esp) }, []byte{0x48, 0x83, 0xe4, 0xf0}},
+    {"andq $0x7fffffff,%rax", true, func(b *X86Buffer) { b.AndqIR(0x7fffffff, x86_eax) }, []byte{0x48, 0x25, 0xff, 0xff, 0xff, 0x7f}},
+    {"xorq $-1,%rdx", true, func(b *X86Buffer) { b.XorqIR(-1, x86_edx) }, []byte{0x48, 0x83, 0xf2, 0xff}},
+    {"xorq $0x12345,%r11", true, func(b *X86Buffer) { b.XorqIR(0x12345, x64_r11) }, []byte{0x49, 0x81, 0xf3, 0x45, 0x23, 0x01, 0x00}},
+    {"subq $127,%r15", true, func(b *X86Buffer) { b.SubqIR(127, x64_r15) }, []byte{0x49, 0x83, 0xef, 0x7f}},
+    {"subq $-129,%rbx", true, func(b *X86Buffer) { b.SubqIR(-129, x86_ebx) }, []byte{0x48, 0x81, 0xeb, 0x7f, 0xff, 0xff, 0xff}},
+    {"cmpq $-128,%rsi", true, func(b *X86Buffer) { b.CmpqIR(-128, x86_esi) }, []byte{0x48, 0x83, 0xfe, 0x80}},
+    {"cmpq $128,%rdi", true, func(b *X86Buffer) { b.CmpqIR(128, x86_edi) }, []byte{0x48, 0x81, 0xff, 0x80, 0x00, 0x00, 0x00}},
+    {"cmpl $0x1000,%eax", false, func(b *X86Buffer) { b.CmplIR(0x1000, x86_eax) }, []byte{0x3d, 0x00, 0x10, 0x00, 0x00}},
+}
+
+func TestAssembler(t *testing.T) {
+    for _, test := range append(asmTests, asmImmediateTests...) {
+        buf := &X86Buffer{Buffer: new(bytes.Buffer), IsX64: test.x64}
+        test.emit(buf)
+        if !bytes.Equal(buf.Bytes(), test.want) {
+            t.Errorf("%s: expected % x, got % x", test.name, test.want, buf.Bytes())
+        }
+    }
+}
+
+func TestRipRelative(t *testing.T) {
+    buf := &X86Buffer{Buffer: new(bytes.Buffer), IsX64: true}
+    pool, half := new(Label), new(Label)
+    
+    buf.MovqPR(pool, x86_eax)
+    buf.LeaqPR(pool, x64_r9)
+    buf.MovsdPR(half, vec_xmm1)
+    buf.Ret()
+    
+    buf.Align(8)
+    buf.Bind(pool)
+    buf.Quad(0x1122334455667788)
+    buf.Bind(half)
+    buf.Quad(0x3fe0000000000000)
+    
+    want := []byte{0x48, 0x8b, 0x05, 0x11, 0x00, 0x00, 0x00,
+                   0x4c, 0x8d, 0x0d, 0x0a, 0x00, 0x00, 0x00,
+                   0xf2, 0x0f, 0x10, 0x0d, 0x0a, 0x00, 0x00, 0x00,
+                   0xc3,
+                   0xcc,
+                   0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11,
+                   0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xe0, 0x3f}
+    if !bytes.Equal(buf.Bytes(), want) {
+        t.Errorf("expected % x, got % x", want, buf.Bytes())
+    }
+}
+
+func TestJumpSource(t *testing.T) {
+    buf := &X86Buffer{Buffer: new(bytes.Buffer)}
+    buf.Push(x86_ebp)
+    src := buf.Jcc(x86_conditionNE)
+    if src.offset != buf.Len() {
+        t.Errorf("expected the jump source at the end of the jump, %d, got %d", buf.Len(), src.offset)
+    }
+}
+
+func TestLabels(t *testing.T) {
+    buf := &X86Buffer{Buffer: new(bytes.Buffer)}
+    
+    // A forward conditional jump, patched when the label is bound.
+    done := new(Label)
+    if err := buf.JccTo(x86_conditionE, done); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    buf.AddlIR(1, x86_eax)
+    if err := buf.Bind(done); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    
+    // A backward jump, which is near enough to be short.
+    top := new(Label)
+    buf.Bind(top)
+    buf.Int3()
+    if err := buf.JmpTo(top); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    buf.Ret()
+    
+    want := []byte{0x0f, 0x84, 0x03, 0x00, 0x00, 0x00,
+                   0x83, 0xc0, 0x01,
+                   0xcc,
+                   0xeb, 0xfd,
+                   0xc3}
+    if !bytes.Equal(buf.Bytes(), want) {
+        t.Errorf("expected % x, got % x", want, buf.Bytes())
+    }
+    if done.Offset() != 9 || top.Offset() != 9 {
+        t.Errorf("expected both labels at 9, got %d and %d", done.Offset(), top.Offset())
+    }
+    
+    if err := buf.Bind(top); err != LabelRebound {
+        t.Errorf("expected rebinding a label to fail, got %v", err)
+    }
+}
+
+func TestLabelFar(t *testing.T) {
+    buf := &X86Buffer{Buffer: new(bytes.Buffer)}
+    
+    // A backward jump too far away for a short one.
+    top := new(Label)
+    buf.Bind(top)
+    for i := 0; i < 200; i++ {
+        buf.Int3()
+    }
+    buf.JmpTo(top)
+    if code := buf.Bytes()[200:]; !bytes.Equal(code, []byte{0xe9, 0x33, 0xff, 0xff, 0xff}) {
+        t.Errorf("expected a 32-bit jump back 205 bytes, got % x", code)
+    }
+    
+    // A short forward jump that can't reach.
+    far := new(Label)
+    buf.JmpShortTo(far)
+    for i := 0; i < 200; i++ {
+        buf.Int3()
+    }
+    if err := buf.Bind(far); err != JumpOutOfRange {
+        t.Errorf("expected the short jump to be out of range, got %v", err)
+    }
+    
+    if err := buf.LinkJump(JmpSrc{buf.Len() + 4, false}, buf.Here()); err == nil {
+        t.Errorf("expected a jump outside the code to fail")
+    }
+}
@@ -1,4 +1,4 @@
-/* 
+/*
    Copyright 2010 Christopher Nelson
 
    Licensed under the Apache License, Version 2.0 (the "License");
@@ -14,34 +14,339 @@
    limitations under the License.
    --------------------------------------------------------------------
 
-   The parser package implements a simple library for parsing EBNF
-   grammars.
-   
    The ast objects are the internal representation of the abstract syntax tree
    of the Python language.  These may be quite different than the CPython ast.
 */
 
-package parser
+package python
 
+import "big"
+
+// Every node in the tree knows the span of source text that produced it.
 type Ast interface {
-    Next() Node*
-    Prev() Node*
+    Pos() Position
+    End() Position
+
+    node() *Node
 }
 
+// The data common to every node.  Start is the position of the first character
+// of the node, Stop is the position just after the last character.
 type Node struct {
-    Parent  Ast*
-    Op      int
+    Start, Stop Position
 }
 
-type LiteralIntNode {
-    *Node
-    Value int
-} 
+func (n *Node) Pos() Position { return n.Start }
+func (n *Node) End() Position { return n.Stop }
+func (n *Node) node() *Node   { return n }
+
+///////// Expressions ///////////
+
+type NameNode struct {
+    Node
+    Id string
+}
 
-type LiteralStringNode {
-    *Node
+type LiteralIntNode struct {
+    Node
+    Value *big.Int
+}
+
+// The value of a string literal is the text between the quotes.  Escapes
+// are not processed.
+type LiteralStringNode struct {
+    Node
     Value string
+    Raw   bool
+}
+
+// An f-string.  Values holds the literal text and the replacement fields, in
+// order, as LiteralStringNodes and FormattedValueNodes.
+type JoinedStrNode struct {
+    Node
+    Values []Ast
+}
+
+// A single replacement field in an f-string, like {value!r:>{width}}.  Conversion is
+// -1 when there is none, otherwise one of 'r', 's' or 'a'.  FormatSpec is a
+// JoinedStrNode, or nil when there is no format spec.
+type FormattedValueNode struct {
+    Node
+    Value      Ast
+    Conversion int
+    FormatSpec Ast
+}
+
+// Binary operations, including the boolean "and" and "or".
+type BinOpNode struct {
+    Node
+    Op          string
+    Left, Right Ast
+}
+
+type UnaryOpNode struct {
+    Node
+    Op      string
+    Operand Ast
+}
+
+// A chained comparison like a < b <= c.
+type CompareNode struct {
+    Node
+    Left        Ast
+    Ops         []string
+    Comparators []Ast
 }
 
+// The conditional expression "Body if Test else Orelse".
+type IfExpNode struct {
+    Node
+    Test, Body, Orelse Ast
+}
 
+type CallNode struct {
+    Node
+    Func     Ast
+    Args     []Ast
+    Keywords []*KeywordNode
+}
 
+// A keyword argument in a call.
+type KeywordNode struct {
+    Node
+    Arg   string
+    Value Ast
+}
+
+// A "*args" or "**kwargs" argument in a call.
+type StarredNode struct {
+    Node
+    Op    string
+    Value Ast
+}
+
+type AttributeNode struct {
+    Node
+    Value Ast
+    Attr  string
+}
+
+type SubscriptNode struct {
+    Node
+    Value, Index Ast
+}
+
+// The "lower:upper:step" part of a subscript.  Missing parts are nil.
+type SliceNode struct {
+    Node
+    Lower, Upper, Step Ast
+}
+
+type TupleNode struct {
+    Node
+    Elts []Ast
+}
+
+type ListNode struct {
+    Node
+    Elts []Ast
+}
+
+type DictNode struct {
+    Node
+    Keys, Values []Ast
+}
+
+///////// Statements ///////////
+
+// TypeIgnores holds the lines that have a "# type: ignore" comment.
+type ModuleNode struct {
+    Node
+    Body        []Ast
+    TypeIgnores []int
+}
+
+type ExprStmtNode struct {
+    Node
+    Value Ast
+}
+
+// Assignment "a = b = value".  TypeComment holds the text after "# type:" in
+// a comment on the same line, if there is one.  The same goes for the other nodes
+// with a TypeComment.
+type AssignNode struct {
+    Node
+    Targets     []Ast
+    Value       Ast
+    TypeComment string
+}
+
+// Augmented assignment like "a += value".  Op is the binary operator, without the '='.
+type AugAssignNode struct {
+    Node
+    Target Ast
+    Op     string
+    Value  Ast
+}
+
+type ReturnNode struct {
+    Node
+    Value Ast
+}
+
+type PassNode struct {
+    Node
+}
+
+type BreakNode struct {
+    Node
+}
+
+type ContinueNode struct {
+    Node
+}
+
+type IfNode struct {
+    Node
+    Test         Ast
+    Body, Orelse []Ast
+}
+
+type WhileNode struct {
+    Node
+    Test         Ast
+    Body, Orelse []Ast
+}
+
+type ForNode struct {
+    Node
+    Target, Iter Ast
+    Body, Orelse []Ast
+    TypeComment  string
+}
+
+// A single parameter in a function definition.  Star is "", "*" or "**".
+type ArgNode struct {
+    Node
+    Name        string
+    Star        string
+    Annotation  Ast
+    Default     Ast
+    TypeComment string
+}
+
+// The TypeComment of a function is its signature, as in "(int, str) -> bool".
+type FunctionDefNode struct {
+    Node
+    Name        string
+    Args        []*ArgNode
+    Returns     Ast
+    Body        []Ast
+    TypeComment string
+}
+
+type ClassDefNode struct {
+    Node
+    Name  string
+    Bases []Ast
+    Body  []Ast
+}
+
+// Walk traverses the tree rooted at n in depth-first order.  The children of a
+// node are only visited if f returns true for it.
+func Walk(n Ast, f func(Ast) bool) {
+    if n == nil || !f(n) {
+        return
+    }
+
+    walkList := func(l []Ast) {
+        for _, c := range l {
+            Walk(c, f)
+        }
+    }
+
+    switch n := n.(type) {
+        case *JoinedStrNode:
+            walkList(n.Values)
+        case *FormattedValueNode:
+            Walk(n.Value, f)
+            Walk(n.FormatSpec, f)
+        case *BinOpNode:
+            Walk(n.Left, f)
+            Walk(n.Right, f)
+        case *UnaryOpNode:
+            Walk(n.Operand, f)
+        case *CompareNode:
+            Walk(n.Left, f)
+            walkList(n.Comparators)
+        case *IfExpNode:
+            Walk(n.Body, f)
+            Walk(n.Test, f)
+            Walk(n.Orelse, f)
+        case *CallNode:
+            Walk(n.Func, f)
+            walkList(n.Args)
+            for _, k := range n.Keywords {
+                Walk(k, f)
+            }
+        case *KeywordNode:
+            Walk(n.Value, f)
+        case *StarredNode:
+            Walk(n.Value, f)
+        case *AttributeNode:
+            Walk(n.Value, f)
+        case *SubscriptNode:
+            Walk(n.Value, f)
+            Walk(n.Index, f)
+        case *SliceNode:
+            Walk(n.Lower, f)
+            Walk(n.Upper, f)
+            Walk(n.Step, f)
+        case *TupleNode:
+            walkList(n.Elts)
+        case *ListNode:
+            walkList(n.Elts)
+        case *DictNode:
+            for i := range n.Keys {
+                Walk(n.Keys[i], f)
+                Walk(n.Values[i], f)
+            }
+        case *ModuleNode:
+            walkList(n.Body)
+        case *ExprStmtNode:
+            Walk(n.Value, f)
+        case *AssignNode:
+            walkList(n.Targets)
+            Walk(n.Value, f)
+        case *AugAssignNode:
+            Walk(n.Target, f)
+            Walk(n.Value, f)
+        case *ReturnNode:
+            Walk(n.Value, f)
+        case *IfNode:
+            Walk(n.Test, f)
+            walkList(n.Body)
+            walkList(n.Orelse)
+        case *WhileNode:
+            Walk(n.Test, f)
+            walkList(n.Body)
+            walkList(n.Orelse)
+        case *ForNode:
+            Walk(n.Target, f)
+            Walk(n.Iter, f)
+            walkList(n.Body)
+            walkList(n.Orelse)
+        case *ArgNode:
+            Walk(n.Annotation, f)
+            Walk(n.Default, f)
+        case *FunctionDefNode:
+            for _, a := range n.Args {
+                Walk(a, f)
+            }
+            Walk(n.Returns, f)
+            walkList(n.Body)
+        case *ClassDefNode:
+            walkList(n.Bases)
+            walkList(n.Body)
+    }
+}
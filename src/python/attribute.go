@@ -0,0 +1,279 @@
+/*
+   Copyright 2010 Christopher Nelson
+   
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+       
+       http://www.apache.org/licenses/LICENSE-2.0
+   
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+   
+   This file provides the attribute lookup of the machine, which is what
+   a.x, a.x = v and getattr() do.  Most objects just give their attributes,
+   but an attribute of a class, or of an instance of it, may be a descriptor,
+   which decides what getting, setting and deleting it does, as in Python:
+     
+     - A data descriptor in the class of an instance, one with __set__ or
+       __delete__, comes before the attributes of the instance.
+     - An attribute of the instance comes before anything else in its class.
+     - Any other descriptor in the class is bound by its __get__, which is
+       how property, staticmethod and classmethod work.
+   
+   A descriptor is either a built-in object that implements Descriptor, or
+   an instance of a class that defines __get__.
+
+   That is what object.__getattribute__ does.  A class can define its own
+   __getattribute__, which is called for every attribute of its instances in
+   its place, and __getattr__, which is called for the ones that getting
+   raises an AttributeError for.
+*/
+
+package python
+
+import (
+        "fmt"
+        "os"
+)
+
+// Returns true if attr, found in a class, is a data descriptor.
+func isDataDescriptor(attr Object) (bool) {
+    switch d := attr.(type) {
+        case DataDescriptor:
+            return true
+        case *InstanceObject:
+            _, set := d.Class.Lookup("__set__")
+            _, del := d.Class.Lookup("__delete__")
+            return set || del
+    }
+    return false
+}
+
+// Returns what getting attr, found in the class owner, gives, which is attr itself if
+// it isn't a descriptor.  instance is nil when the attribute is got from the class.
+func (m *Machine) bindAttribute(attr, instance Object, owner *TypeObject) (Object, os.Error) {
+    switch d := attr.(type) {
+        case Descriptor:
+            return d.Get(m, instance, owner)
+        case *InstanceObject:
+            if get, present := d.Class.Lookup("__get__"); present {
+                return m.callNested(get, []Object{d, orNone(instance), owner})
+            }
+    }
+    return attr, nil
+}
+
+// Sets the attribute of instance that the data descriptor attr describes to value, or
+// deletes it if value is nil.
+func (m *Machine) assignAttribute(attr, instance, value Object) (os.Error) {
+    if d, ok := attr.(DataDescriptor); ok {
+        if value == nil {
+            return d.Delete(m, instance)
+        }
+        return d.Set(m, instance, value)
+    }
+    
+    name, args := "__set__", []Object{attr, instance, value}
+    if value == nil {
+        name, args = "__delete__", args[:2]
+    }
+    method, present := attr.(*InstanceObject).Class.Lookup(name)
+    if !present {
+        return Raise(AttributeErrorClass, name)
+    }
+    _, err := m.callNested(method, args)
+    return err
+}
+
+func noAttribute(obj Object, name string) (os.Error) {
+    if c, ok := obj.(*TypeObject); ok {
+        return Raise(AttributeErrorClass, fmt.Sprintf("type object '%v' has no attribute '%v'", c.Name, name))
+    }
+    return Raise(AttributeErrorClass, fmt.Sprintf("'%v' has no attribute '%v'", obj.AsString(), name))
+}
+
+// object.__getattribute__, which does the lookup of genericAttr.  It calls the machine,
+// so it can only go in object once the class has been initialized.
+var objectGetAttribute *BuiltinFunctionObject
+
+func init() {
+    objectGetAttribute = NewBuiltinFunction("__getattribute__", func(m *Machine, args []Object) (Object, os.Error) {
+        name, err := attributeName("__getattribute__", args, 2, 2)
+        if err != nil {
+            return nil, err
+        }
+        return m.genericAttr(args[0], name)
+    })
+    ObjectClass.SetAttr("__getattribute__", objectGetAttribute)
+}
+
+// Returns the attribute name of obj, as getattr() does.  The __getattribute__ and
+// __getattr__ of the class of an instance are called with the instance and the name.
+func (m *Machine) getAttr(obj Object, name string) (Object, os.Error) {
+    o, ok := obj.(*InstanceObject)
+    if !ok {
+        return m.genericAttr(obj, name)
+    }
+    
+    var value Object
+    var err os.Error
+    if get, _ := o.Class.Lookup("__getattribute__"); get != Object(objectGetAttribute) {
+        value, err = m.callNested(get, []Object{o, NewString(name)})
+    } else {
+        value, err = m.genericAttr(o, name)
+    }
+    if err == nil || !IsException(err, AttributeErrorClass) {
+        return value, err
+    }
+    if fallback, present := o.Class.Lookup("__getattr__"); present {
+        return m.callNested(fallback, []Object{o, NewString(name)})
+    }
+    return nil, err
+}
+
+// Returns the attribute name of obj, going through the descriptors in the class of an
+// instance, or in a class and its bases.
+func (m *Machine) genericAttr(obj Object, name string) (Object, os.Error) {
+    switch o := obj.(type) {
+        case *InstanceObject:
+            if name == "__class__" {
+                return o.Class, nil
+            }
+            attr, in_class := o.Class.Lookup(name)
+            if in_class && isDataDescriptor(attr) {
+                return m.bindAttribute(attr, o, o.Class)
+            }
+            if value, present := o.ObjectData.GetAttr(name); present {
+                return value, nil
+            }
+            if in_class {
+                return m.bindAttribute(attr, o, o.Class)
+            }
+        
+        case *TypeObject:
+            if value, present := o.typeAttr(name); present {
+                return value, nil
+            }
+            if attr, present := o.Lookup(name); present {
+                return m.bindAttribute(attr, nil, o)
+            }
+        
+        default:
+            if value, present := obj.GetAttr(name); present {
+                return value, nil
+            }
+    }
+    return nil, noAttribute(obj, name)
+}
+
+// The built-in classes are shared by every interpreter in the process, so a program
+// can't change their attributes, which would change them for the others too.  Returns
+// a TypeError if obj is one of them.
+func checkMutable(obj Object, name string) (os.Error) {
+    var class string
+    switch c := obj.(type) {
+        case *TypeObject:
+            if !c.builtin && c != ObjectClass {
+                return nil
+            }
+            class = c.Name
+        case *ExceptionClassObject:
+            class = c.Name
+        default:
+            return nil
+    }
+    return Raise(TypeErrorClass, fmt.Sprintf("cannot set '%v' attribute of immutable type '%v'", name, class))
+}
+
+// Sets the attribute name of obj to value, as setattr() does.
+func (m *Machine) setAttr(obj Object, name string, value Object) (os.Error) {
+    if o, ok := obj.(*InstanceObject); ok {
+        if attr, present := o.Class.Lookup(name); present && isDataDescriptor(attr) {
+            return m.assignAttribute(attr, o, value)
+        }
+    }
+    if err := checkMutable(obj, name); err != nil {
+        return err
+    }
+    obj.SetAttr(name, value)
+    return nil
+}
+
+// Deletes the attribute name of obj, as delattr() does.
+func (m *Machine) delAttr(obj Object, name string) (os.Error) {
+    if o, ok := obj.(*InstanceObject); ok {
+        if attr, present := o.Class.Lookup(name); present && isDataDescriptor(attr) {
+            return m.assignAttribute(attr, o, nil)
+        }
+    }
+    if err := checkMutable(obj, name); err != nil {
+        return err
+    }
+    if d, ok := obj.(interface { objectData() (*ObjectData) }); ok && d.objectData().DelAttr(name) {
+        return nil
+    }
+    return noAttribute(obj, name)
+}
+
+// Returns the name argument of getattr(), setattr(), delattr() and hasattr().
+func attributeName(fn string, args []Object, min, max int) (string, os.Error) {
+    if len(args) < min || len(args) > max {
+        if min == max {
+            return "", Raise(TypeErrorClass, fmt.Sprintf("%v expected %v arguments, got %v", fn, min, len(args)))
+        }
+        return "", Raise(TypeErrorClass, fmt.Sprintf("%v expected %v to %v arguments, got %v", fn, min, max, len(args)))
+    }
+    name, ok := args[1].(*StringObject)
+    if !ok {
+        return "", Raise(TypeErrorClass, fmt.Sprintf("attribute name must be string, not '%v'", args[1].AsString()))
+    }
+    return name.Value, nil
+}
+
+// Adds getattr(), setattr(), delattr() and hasattr() to the builtins of the interpreter.
+func (interp *Interpreter) addAttributeBuiltins() {
+    interp.Builtins["getattr"] = NewBuiltinFunction("getattr", func(m *Machine, args []Object) (Object, os.Error) {
+        name, err := attributeName("getattr", args, 2, 3)
+        if err != nil {
+            return nil, err
+        }
+        value, err := m.getAttr(args[0], name)
+        if err != nil && len(args) == 3 && IsException(err, AttributeErrorClass) {
+            return args[2], nil
+        }
+        return value, err
+    })
+    
+    interp.Builtins["setattr"] = NewBuiltinFunction("setattr", func(m *Machine, args []Object) (Object, os.Error) {
+        name, err := attributeName("setattr", args, 3, 3)
+        if err != nil {
+            return nil, err
+        }
+        return None, m.setAttr(args[0], name, args[2])
+    })
+    
+    interp.Builtins["delattr"] = NewBuiltinFunction("delattr", func(m *Machine, args []Object) (Object, os.Error) {
+        name, err := attributeName("delattr", args, 2, 2)
+        if err != nil {
+            return nil, err
+        }
+        return None, m.delAttr(args[0], name)
+    })
+    
+    interp.Builtins["hasattr"] = NewBuiltinFunction("hasattr", func(m *Machine, args []Object) (Object, os.Error) {
+        name, err := attributeName("hasattr", args, 2, 2)
+        if err != nil {
+            return nil, err
+        }
+        _, err = m.getAttr(args[0], name)
+        if err != nil && !IsException(err, AttributeErrorClass) {
+            return nil, err
+        }
+        return pyBool(err == nil), nil
+    })
+}
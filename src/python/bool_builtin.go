@@ -0,0 +1,53 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the bool built-in type.  In Python bool derives from
+   int, and its only instances are True and False, which are 1 and 0 and
+   can be used wherever an int can.  So True and False are ints marked as
+   bools, and only their class and the way they are written differ from
+   the ints 1 and 0.  The result of an operation on them is an int.
+*/
+
+package python
+
+// The class of True and False.
+var BoolClass = newBuiltinSubclass("bool", IntClass)
+
+// There is only one True and one False, so they can be compared by identity.
+var (
+    True    = newBool(1)
+    False   = newBool(0)
+)
+
+func newBool(v int64) (*IntObject) {
+    b := NewInt(v)
+    b.isBool = true
+    
+    return b
+}
+
+// Returns True or False.
+func pyBool(b bool) (*IntObject) {
+    if b {
+        return True
+    }
+    return False
+}
+
+// Returns true if the int is True or False.
+func (o *IntObject) IsBool() (bool) {
+    return o.isBool
+}
@@ -0,0 +1,226 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the execution budget, which bounds what a single
+   run of the machine can do, so code that isn't trusted can be run safely.
+   A budget limits the instructions the machine executes, the depth of the
+   calls it makes, and the objects its instructions allocate and their size.  The counts
+   don't depend on timing or on other machines, so the same code with the
+   same budget always stops at the same instruction.
+*/
+
+package python
+
+import (
+    "os"
+)
+
+// Returned by RunBudget when the code exceeds one of the limits of its budget.
+var BudgetExceeded = os.NewError("BudgetExceeded: execution budget exhausted")
+
+// The limits of a run of the machine, where 0 means no limit, or what a run used.
+type Budget struct {
+    // The instructions executed, counting those whose predicate skips them.
+    Instructions    int
+    
+    // The frames on the stack, counting the outermost one and the frames of the
+    // machines that resumed a generator or a coroutine.
+    CallDepth       int
+    
+    // The objects made by the instructions.  Objects made by builtin functions aren't
+    // counted, nor are the frames of calls.
+    Objects         int
+    
+    // The bytes of the results of the arithmetic, including that of builtin functions
+    // like sum(), and of the ranges made by range().  They are estimated from the
+    // operands, before the result is made, so a run is stopped before it makes a
+    // string or a list or an int too big for its budget, not after.
+    Memory          int
+}
+
+// The budget of a run, shared by the machines resuming generators and coroutines for
+// it.
+type budget struct {
+    limits  Budget
+    used    Budget
+}
+
+// The opcodes whose instructions make an object when they execute.
+var allocates = [64]bool{
+    LEN:            true,
+    MAKECLOSURE:    true,
+    GETITER:        true,
+    BUILDLIST:      true,
+    BUILDTUPLE:     true,
+    BUILDDICT:      true,
+    BUILDSET:       true,
+    BOXI:           true,
+    BOXL:           true,
+    BOXF:           true,
+    BOXS:           true,
+    BOXB:           true,
+    ADD:            true,
+    SUB:            true,
+    MUL:            true,
+    DIV:            true,
+    FDIV:           true,
+    MOD:            true,
+    NEG:            true,
+    POS:            true,
+    INVERT:         true,
+}
+
+// Runs c as Run does, within the limits of the budget, and returns what the run used
+// as well.  The run fails with BudgetExceeded at the instruction that would exceed
+// the budget.
+func (m *Machine) RunBudget(c *CodeObject, limits Budget) (Object, Budget, os.Error) {
+    b := &budget{limits: limits}
+    m.budget, m.budgetDepth = b, 0
+    defer func() {
+        m.budget = nil
+    }()
+    
+    b.enter(len(m.Frames) + 1)
+    result, err := m.Run(c)
+    return result, b.used, err
+}
+
+// Charges the budget for an instruction with the opcode op, which runs if its predicate
+// lets it.
+func (b *budget) charge(op uint32, runs bool) (os.Error) {
+    b.used.Instructions++
+    if b.limits.Instructions > 0 && b.used.Instructions > b.limits.Instructions {
+        return BudgetExceeded
+    }
+    
+    if runs && allocates[op] {
+        b.used.Objects++
+        if b.limits.Objects > 0 && b.used.Objects > b.limits.Objects {
+            return BudgetExceeded
+        }
+    }
+    return nil
+}
+
+// Records that the stack is depth frames deep, and returns BudgetExceeded if that is
+// too deep.
+func (b *budget) enter(depth int) (os.Error) {
+    if depth > b.used.CallDepth {
+        b.used.CallDepth = depth
+    }
+    if b.limits.CallDepth > 0 && depth > b.limits.CallDepth {
+        return BudgetExceeded
+    }
+    return nil
+}
+
+// Charges the budget for size bytes the run is about to allocate.
+func (b *budget) allocate(size int) (os.Error) {
+    b.used.Memory = addSize(b.used.Memory, size)
+    if b.limits.Memory > 0 && b.used.Memory > b.limits.Memory {
+        return BudgetExceeded
+    }
+    return nil
+}
+
+// Charges the budget of the run, if it has one, for size bytes.
+func (m *Machine) allocate(size int) (os.Error) {
+    if m.budget == nil {
+        return nil
+    }
+    return m.budget.allocate(size)
+}
+
+// The size of a word, which is what a number or a reference to an object takes.
+const wordSize = 8
+
+// Returns about how many bytes the result of the built-in arithmetic op on l and r
+// takes.  A repeated sequence is as long as the sequence times the repeats, and the
+// digits of a product are those of the operands added.  The other operations make
+// results no bigger than their operands.
+func resultSize(op uint32, l, r Object) (int) {
+    switch op {
+        case ADD:
+            return addSize(objectSize(l), objectSize(r))
+        case MUL:
+            if n, ok := r.(*IntObject); ok && isSequence(l) {
+                return repeatSize(objectSize(l), n)
+            }
+            if n, ok := l.(*IntObject); ok && isSequence(r) {
+                return repeatSize(objectSize(r), n)
+            }
+            return addSize(objectSize(l), objectSize(r))
+    }
+    return wordSize
+}
+
+// Returns about how many bytes l ** r takes, as resultSize does for the arithmetic.
+func powerSize(l, r Object) (int) {
+    base, ok := l.(*IntObject)
+    exponent, is_int := r.(*IntObject)
+    if ok && is_int {
+        if bits := base.AsInt().BitLen(); bits > 1 {
+            return addSize(repeatSize(bits, exponent) / 8, wordSize)
+        }
+    }
+    return wordSize
+}
+
+func isSequence(o Object) (bool) {
+    switch o.(type) {
+        case *StringObject, *ListObject, *TupleObject:
+            return true
+    }
+    return false
+}
+
+// Returns about how many bytes o takes: a byte for each character of a string, a word
+// for each item of a list or a tuple, and at least a word for a number.
+func objectSize(o Object) (int) {
+    switch v := o.(type) {
+        case *StringObject:
+            return len(v.Value)
+        case *ListObject:
+            return len(v.Items) * wordSize
+        case *TupleObject:
+            return len(v.Items) * wordSize
+        case *IntObject:
+            if v.Big != nil {
+                return (v.Big.BitLen() + 7) / 8
+            }
+    }
+    return wordSize
+}
+
+// Returns size repeated n times, which is nothing for a negative n, and the largest int
+// for an n too large to make the result of.
+func repeatSize(size int, n *IntObject) (int) {
+    switch {
+        case n.Sign() <= 0:
+            return 0
+        case !n.IsSmall() || size > 0 && n.Small > int64(maxInt / size):
+            return maxInt
+    }
+    return size * int(n.Small)
+}
+
+// Returns a + b, or the largest int if that is too large.
+func addSize(a, b int) (int) {
+    if a > maxInt - b {
+        return maxInt
+    }
+    return a + b
+}
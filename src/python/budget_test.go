@@ -0,0 +1,167 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the execution budget.
+
+*/
+
+package python
+
+import (
+        "big"
+        "testing"
+)
+
+func TestBudget(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 10)
+    
+    m := new (Machine)
+    result, used, err := m.RunBudget(s, Budget{})
+    if err != nil || result.AsString() != "55" {
+        t.Fatalf("expected 55, got %v, %v", result, err)
+    }
+    if used.Instructions == 0 || used.Objects == 0 || used.CallDepth != 1 {
+        t.Errorf("expected the run to count what it used, got %+v", used)
+    }
+    
+    // The counts are the same each time, so a budget of exactly what was used is enough,
+    // and a budget of any less isn't.
+    if _, again, err := new (Machine).RunBudget(s, used); err != nil || again != used {
+        t.Errorf("expected the run to fit its own budget, got %+v, %v", again, err)
+    }
+    limits := []Budget{
+        Budget{Instructions: used.Instructions - 1},
+        Budget{Objects: used.Objects - 1},
+    }
+    for _, limit := range limits {
+        m := new (Machine)
+        if _, _, err = m.RunBudget(s, limit); err != BudgetExceeded || m.Traceback == nil {
+            t.Errorf("expected %+v to be exceeded, got %v", limit, err)
+        }
+        
+        // The budget only applies to the run it was given to.
+        m.NextInstruction = 0
+        m.Frames = nil
+        if _, err = m.Run(s); err != nil {
+            t.Errorf("unexpected error: %v", err)
+        }
+    }
+}
+
+func TestBudgetCallDepth(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    writeFactorial(s)
+    
+    m := new (Machine)
+    m.BindGlobal("one", intObject(1))
+    m.BindGlobal("n", intObject(10))
+    result, used, err := m.RunBudget(s, Budget{})
+    if err != nil || result.AsString() != "3628800" || used.CallDepth != 11 {
+        t.Fatalf("expected 10! with a depth of 11, got %v, %+v, %v", result, used, err)
+    }
+    
+    m = new (Machine)
+    m.BindGlobal("one", intObject(1))
+    m.BindGlobal("n", intObject(10))
+    if _, _, err = m.RunBudget(s, Budget{CallDepth: 10}); err != BudgetExceeded {
+        t.Errorf("expected the calls to exceed the budget, got %v", err)
+    }
+}
+
+// A generator counts towards the budget of the run that resumes it.
+func TestBudgetGenerator(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    _, result, err := callTestFunction(mod, newTestGenerator(mod), []Object{intObject(7)}, nil, nil)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    
+    s := new (CodeObject)
+    s.Init()
+    s.WriteConst(result, 1, false, 0)
+    s.WriteGetIter(1, 2, false, 0)
+    loop := s.Here()
+    exit := s.WriteForIter(2, false, 0)
+    s.PatchJump(s.WriteJump(false, 0), loop)
+    s.PatchJump(exit, s.Here())
+    s.WriteHalt(1, false, 0)
+    
+    if _, used, err := new (Machine).RunBudget(s, Budget{}); err == nil || used.CallDepth != 2 || used.Objects < 2 {
+        t.Errorf("expected the generator to be counted, and to fail, got %+v, %v", used, err)
+    }
+}
+
+// Returns code that calls the builtin fn with l and r, or applies op to them if fn is
+// empty.
+func writeBudgetOperation(op uint32, fn string, l, r Object) (*CodeObject) {
+    s := new (CodeObject)
+    s.Init()
+    s.WriteConst(l, 2, false, 0)
+    s.WriteConst(r, 3, false, 0)
+    if fn != "" {
+        s.WriteLoad(fn, 1, false, 0)
+        s.WriteCallFunction(1, 2, 0, 4, false, 0)
+    } else {
+        s.WriteAluIns(op, 2, 3, 4, false, 0)
+    }
+    s.WriteHalt(4, false, 0)
+    return s
+}
+
+// The memory of a result is charged before it is made, so an operation that makes
+// something huge fails at once, rather than after making it.
+func TestBudgetMemory(t *testing.T) {
+    huge := NewBigInt(new (big.Int).Lsh(big.NewInt(1), 80000))
+    pair := NewList([]Object{intObject(1), intObject(2)})
+    lists := NewList([]Object{pair, pair, pair, pair, pair, pair, pair, pair})
+    
+    tests := []struct {
+        op      uint32
+        fn      string
+        l, r    Object
+        limit   int
+    }{
+        {MUL, "", NewString("ab"), intObject(1 << 40), 1 << 20},
+        {MUL, "", intObject(1 << 40), NewTuple([]Object{None}), 1 << 20},
+        {MUL, "", pair, intObject(1 << 40), 1 << 20},
+        {MUL, "", huge, huge, 15000},
+        {ADD, "", NewString("abc"), NewString("abc"), 5},
+        {0, "pow", intObject(3), intObject(1 << 30), 1 << 20},
+        {0, "sum", NewList([]Object{lists, lists, lists}), NewList(nil), 200},
+        {0, "range", intObject(0), intObject(10), 16},
+    }
+    for i, test := range tests {
+        s := writeBudgetOperation(test.op, test.fn, test.l, test.r)
+        m := NewInterpreter().NewMachine()
+        if _, used, err := m.RunBudget(s, Budget{Memory: test.limit}); err != BudgetExceeded {
+            t.Errorf("test %v: expected a limit of %v bytes to be exceeded, got %+v, %v", i, test.limit, used, err)
+        }
+    }
+    
+    // What a run allocates is counted when there is no limit.
+    s := writeBudgetOperation(MUL, "", NewString("ab"), intObject(3))
+    result, used, err := NewInterpreter().NewMachine().RunBudget(s, Budget{})
+    if err != nil || result.AsString() != "ababab" || used.Memory != 6 {
+        t.Errorf("expected ababab in 6 bytes, got %v in %v, %v", result, used.Memory, err)
+    }
+    if _, _, err = NewInterpreter().NewMachine().RunBudget(s, Budget{Memory: 6}); err != nil {
+        t.Errorf("a run should fit the memory it uses, got %v", err)
+    }
+}
@@ -0,0 +1,175 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the builtin function object
+   type, which is a function written in Go that Python code can call.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+type BuiltinFunctionObject struct {
+    ObjectData
+    
+    // The name of the function, and the Go function that is called with the
+    // machine that calls it and the arguments.  Returning nil returns None.
+    // FnKeywords, if it is set, is called in the place of Fn with the keyword
+    // arguments too.
+    Name        string
+    Fn          func(m *Machine, args []Object) (Object, os.Error)
+    FnKeywords  func(m *Machine, args []Object, kwnames []string, kwargs []Object) (Object, os.Error)
+}
+
+func NewBuiltinFunction(name string, fn func(m *Machine, args []Object) (Object, os.Error)) (*BuiltinFunctionObject) {
+    f := new(BuiltinFunctionObject)
+    f.ObjectData.Init()
+    f.Name = name
+    f.Fn = fn
+    
+    return f
+}
+
+// Makes a builtin function that takes keyword arguments.
+func NewBuiltinFunctionKeywords(name string, fn func(m *Machine, args []Object, kwnames []string, kwargs []Object) (Object, os.Error)) (*BuiltinFunctionObject) {
+    f := new(BuiltinFunctionObject)
+    f.ObjectData.Init()
+    f.Name = name
+    f.FnKeywords = fn
+    
+    return f
+}
+
+// Calls the Go function.  Builtin functions only take positional arguments, unless
+// they were made by NewBuiltinFunctionKeywords.
+func (o *BuiltinFunctionObject) Call(m *Machine, args []Object, kwnames []string, kwargs []Object) (Object, os.Error) {
+    if o.FnKeywords != nil {
+        return o.FnKeywords(m, args, kwnames, kwargs)
+    }
+    if len(kwnames) > 0 {
+        return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() takes no keyword arguments", o.Name))
+    }
+    return o.Fn(m, args)
+}
+
+// A builtin function can't be converted to a number
+func (o *BuiltinFunctionObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *BuiltinFunctionObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert builtin function to string
+func (o *BuiltinFunctionObject) AsString() (string) {
+    return fmt.Sprintf("<built-in function %v>", o.Name)
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A builtin function is only equal to itself, and builtin functions are not ordered.
+func (o *BuiltinFunctionObject) Eq(r Object) (Object) {
+    f, ok := r.(*BuiltinFunctionObject)
+    return pyBool(ok && f == o)
+}
+
+func (o *BuiltinFunctionObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *BuiltinFunctionObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *BuiltinFunctionObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *BuiltinFunctionObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *BuiltinFunctionObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *BuiltinFunctionObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BuiltinFunctionObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BuiltinFunctionObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BuiltinFunctionObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BuiltinFunctionObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BuiltinFunctionObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BuiltinFunctionObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *BuiltinFunctionObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BuiltinFunctionObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BuiltinFunctionObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A builtin function is always true
+func (o *BuiltinFunctionObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *BuiltinFunctionObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *BuiltinFunctionObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *BuiltinFunctionObject) AsBool() (bool) {
+    return o.IsTrue()
+}
@@ -0,0 +1,309 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the builtins that aren't about one type of object:
+   print(), len(), repr() and type(), which call the __len__, __repr__ and
+   __str__ methods of instances, as in Python.  The other builtins are
+   added by the files of the types they are about.
+
+   It also provides the classes of the built-in objects, which are what
+   type() gives and what isinstance() checks them against.  They derive
+   from object, except for bool, which derives from int, and can't be
+   derived from or called, except for type itself, yet.  Objects of the
+   other built-in types are only instances of object.
+*/
+
+package python
+
+import (
+        "bytes"
+        "fmt"
+        "io"
+        "os"
+)
+
+var (
+    TypeClass               = newBuiltinClass("type")
+    IntClass                = newBuiltinClass("int")
+    FloatClass              = newBuiltinClass("float")
+    ComplexClass            = newBuiltinClass("complex")
+    StrClass                = newBuiltinClass("str")
+    ListClass               = newBuiltinClass("list")
+    TupleClass              = newBuiltinClass("tuple")
+    DictClass               = newBuiltinClass("dict")
+    SetClass                = newBuiltinClass("set")
+    RangeClass              = newBuiltinClass("range")
+    SliceClass              = newBuiltinClass("slice")
+    NoneTypeClass           = newBuiltinClass("NoneType")
+    FunctionClass           = newBuiltinClass("function")
+    BuiltinFunctionClass    = newBuiltinClass("builtin_function_or_method")
+    MethodClass             = newBuiltinClass("method")
+    GeneratorClass          = newBuiltinClass("generator")
+    ModuleClass             = newBuiltinClass("module")
+)
+
+func newBuiltinClass(name string) (*TypeObject) {
+    c := new(TypeObject)
+    c.ObjectData.Init()
+    c.Name = name
+    c.Bases = []*TypeObject{ObjectClass}
+    c.Mro = []*TypeObject{c, ObjectClass}
+    c.builtin = true
+    
+    return c
+}
+
+// Makes a built-in class that derives from the built-in class base.
+func newBuiltinSubclass(name string, base *TypeObject) (*TypeObject) {
+    c := newBuiltinClass(name)
+    c.Bases = []*TypeObject{base}
+    c.Mro = append([]*TypeObject{c}, base.Mro...)
+    
+    return c
+}
+
+// Returns the class of o, as type() does.  The class of an exception is an exception
+// class, which isn't a TypeObject.
+func typeOf(o Object) (Object) {
+    switch v := o.(type) {
+        case *InstanceObject:
+            return v.Class
+        case *BaseExceptionObject:
+            return v.Class
+        case *TypeObject, *ExceptionClassObject:
+            return TypeClass
+        case *IntObject:
+            if v.IsBool() {
+                return BoolClass
+            }
+            return IntClass
+        case *FloatObject:
+            return FloatClass
+        case *ComplexObject:
+            return ComplexClass
+        case *StringObject:
+            return StrClass
+        case *ListObject:
+            return ListClass
+        case *TupleObject:
+            return TupleClass
+        case *DictObject:
+            return DictClass
+        case *SetObject:
+            return SetClass
+        case *RangeObject:
+            return RangeClass
+        case *SliceObject:
+            return SliceClass
+        case *NoneObject:
+            return NoneTypeClass
+        case *FunctionObject:
+            return FunctionClass
+        case *BuiltinFunctionObject, *GoFuncObject:
+            return BuiltinFunctionClass
+        case *BoundMethodObject:
+            return MethodClass
+        case *GeneratorObject:
+            return GeneratorClass
+        case *ModuleObject:
+            return ModuleClass
+    }
+    return ObjectClass
+}
+
+// Returns the name of the class of o, as error messages give it.
+func typeName(o Object) (string) {
+    switch c := typeOf(o).(type) {
+        case *TypeObject:
+            return c.Name
+        case *ExceptionClassObject:
+            return c.Name
+    }
+    return "object"
+}
+
+// Calls type with args, which gives the class of an object, or makes a class from its
+// name, a tuple of its bases and a dict of its namespace, as a class statement does.
+func callType(args []Object, kwnames []string) (Object, os.Error) {
+    if len(kwnames) > 0 {
+        return nil, Raise(TypeErrorClass, "type() takes no keyword arguments")
+    }
+    switch len(args) {
+        case 1:
+            return typeOf(args[0]), nil
+        case 3:
+            name, name_ok := args[0].(*StringObject)
+            bases, bases_ok := args[1].(*TupleObject)
+            namespace, namespace_ok := args[2].(*DictObject)
+            if !name_ok || !bases_ok || !namespace_ok {
+                return nil, Raise(TypeErrorClass, "type() arguments must be a str, a tuple and a dict")
+            }
+            return NewType(name.Value, bases.Items, namespace)
+    }
+    return nil, Raise(TypeErrorClass, "type() takes 1 or 3 arguments")
+}
+
+// Calls the method name of the class of the instance o, if it has one, which has to
+// return a string, as __repr__ and __str__ do.  present is false if it doesn't.
+func (m *Machine) stringMethod(o Object, name string) (s string, present bool, err os.Error) {
+    i, ok := o.(*InstanceObject)
+    if !ok {
+        return "", false, nil
+    }
+    method, present := i.Class.Lookup(name)
+    if !present {
+        return "", false, nil
+    }
+    
+    result, err := m.callNested(method, []Object{i})
+    if err != nil {
+        return "", true, err
+    }
+    value, ok := result.(*StringObject)
+    if !ok {
+        return "", true, Raise(TypeErrorClass, fmt.Sprintf("%v returned non-string (type %v)", name, typeName(result)))
+    }
+    return value.Value, true, nil
+}
+
+// Returns o as Python writes it, as repr() does.
+func (m *Machine) repr(o Object) (string, os.Error) {
+    if s, present, err := m.stringMethod(o, "__repr__"); present {
+        return s, err
+    }
+    return o.Repr(), nil
+}
+
+// Returns o as str() does, which is its repr() unless its class defines __str__.
+func (m *Machine) str(o Object) (string, os.Error) {
+    if s, present, err := m.stringMethod(o, "__str__"); present {
+        return s, err
+    }
+    if _, ok := o.(*InstanceObject); ok {
+        return m.repr(o)
+    }
+    return o.Str(), nil
+}
+
+// Returns the number of items of o, as len() does.
+func (m *Machine) length(o Object) (int, os.Error) {
+    i, ok := o.(*InstanceObject)
+    if !ok {
+        return o.Len()
+    }
+    method, present := i.Class.Lookup("__len__")
+    if !present {
+        return 0, Raise(TypeErrorClass, fmt.Sprintf("object of type '%v' has no len()", i.Class.Name))
+    }
+    
+    result, err := m.callNested(method, []Object{i})
+    if err != nil {
+        return 0, err
+    }
+    n, ok := result.(*IntObject)
+    switch {
+        case !ok:
+            return 0, Raise(TypeErrorClass, fmt.Sprintf("'%v' object cannot be interpreted as an integer", typeName(result)))
+        case n.Sign() < 0:
+            return 0, Raise(ValueErrorClass, "__len__() should return >= 0")
+        case !n.IsSmall() || int64(int(n.Small)) != n.Small:
+            return 0, Raise(OverflowErrorClass, "cannot fit 'int' into an index-sized integer")
+    }
+    return int(n.Small), nil
+}
+
+// Returns the string argument of print() named name, which is def if it is None.
+func printArgument(name string, arg Object, def string) (string, os.Error) {
+    switch s := arg.(type) {
+        case *StringObject:
+            return s.Value, nil
+        case *NoneObject:
+            return def, nil
+    }
+    return "", Raise(TypeErrorClass, fmt.Sprintf("%v must be None or a string, not %v", name, typeName(arg)))
+}
+
+// Adds print(), len(), repr() and type() to the builtins of the interpreter, with the
+// classes of the built-in objects that have a name in Python.
+func (interp *Interpreter) addBuiltins() {
+    for _, c := range []*TypeObject{TypeClass, IntClass, BoolClass, FloatClass, ComplexClass, StrClass, ListClass, TupleClass, DictClass, SetClass} {
+        interp.Builtins[c.Name] = c
+    }
+    
+    // print() writes to the Stdout of the interpreter of the machine.
+    interp.Builtins["print"] = NewBuiltinFunctionKeywords("print", func(m *Machine, args []Object, kwnames []string, kwargs []Object) (Object, os.Error) {
+        sep, end := " ", "\n"
+        for i, name := range kwnames {
+            var err os.Error
+            switch name {
+                case "sep":
+                    sep, err = printArgument(name, kwargs[i], " ")
+                case "end":
+                    end, err = printArgument(name, kwargs[i], "\n")
+                case "flush":
+                default:
+                    err = Raise(TypeErrorClass, fmt.Sprintf("'%v' is an invalid keyword argument for print()", name))
+            }
+            if err != nil {
+                return nil, err
+            }
+        }
+        
+        var buf bytes.Buffer
+        for i, arg := range args {
+            if i > 0 {
+                buf.WriteString(sep)
+            }
+            s, err := m.str(arg)
+            if err != nil {
+                return nil, err
+            }
+            buf.WriteString(s)
+        }
+        buf.WriteString(end)
+        
+        var out io.Writer = os.Stdout
+        if m.Interpreter != nil && m.Interpreter.Stdout != nil {
+            out = m.Interpreter.Stdout
+        }
+        if _, err := out.Write(buf.Bytes()); err != nil {
+            return nil, Raise(OSErrorClass, err.String())
+        }
+        return None, nil
+    })
+    
+    interp.Builtins["len"] = NewBuiltinFunction("len", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 1 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("len() takes exactly one argument (%v given)", len(args)))
+        }
+        n, err := m.length(args[0])
+        if err != nil {
+            return nil, err
+        }
+        return NewInt(int64(n)), nil
+    })
+    
+    interp.Builtins["repr"] = NewBuiltinFunction("repr", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 1 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("repr() takes exactly one argument (%v given)", len(args)))
+        }
+        s, err := m.repr(args[0])
+        if err != nil {
+            return nil, err
+        }
+        return NewString(s), nil
+    })
+}
@@ -28,6 +28,19 @@ const (
     NOP = iota          // 0 - 15 are "special" instructions
     NEW        
     LEN
+    HALT
+    RET
+    CALLFN
+    MAKECLOSURE
+    GETITER
+    FORITER
+    BUILDLIST
+    BUILDTUPLE
+    BUILDDICT
+    BUILDSET
+    MOVE
+    YIELD
+    AWAIT
 )
 
 const (    
@@ -43,6 +56,11 @@ const (
     UNBOXF
     UNBOXS
     UNBOXB
+    JMP
+    CALL
+    CONST
+    LOADDEREF
+    STOREDEREF
 )
 
 const ( 
@@ -57,42 +75,206 @@ const (
     DIV
     FDIV
     MOD
+    EQ
+    NE
+    LT
+    LE
+    GT
+    GE
+    STOREINDEX
+    NEG
+    POS
+    INVERT
+    NOT
+    IALU
+    FALU
 )
 
-// A code stream contains all the code for one module
-type CodeStream struct {
+const (
+    LOADALU = 57 + iota // 57-62 are superinstructions, which are only made by Fuse
+    CONSTALU
+    CMPJMP
+)
+
+// 63 enters a loop compiled by the JIT, and is only made by patching the head of a
+// hot loop.
+const ENTERJIT = 63
+
+// A code object holds the code of one function, class body or module body, together with
+// everything its instructions refer to by index: the names of the variables it uses and
+// its constants.  The names are bound in a frame when the code runs, not here, so the
+// same code object can be run by any number of frames at once.
+type CodeObject struct {
     *bytes.Buffer
-        
-    Strings         map[string]uint16
-    StringCounter   uint16
     
-    Locals          map[uint16]Object
-    Globals         map[uint16]Object        
+    Name            string
+    
+    // The file the code was compiled from, and the line of its first instruction.
+    Filename        string
+    FirstLine       int
+    
+    // Maps each instruction back to its source line, as written by SetLine.  The table
+    // is a list of byte pairs, each of which moves on by an unsigned number of
+    // instructions and then a signed number of lines, like the lnotab of CPython.
+    LineTable       []byte
+    lastLineAddr    uint32
+    lastLine        int
+    
+    Names           []string
+    NameIndices     map[string]uint16
+    Constants       []Object
+    constantIndices map[Object]uint16
+    
+    // The module the code was made by, whose pool its names and constants come from.
+    module          *ModuleCode
+    
+    // The number of registers and spill slots a frame needs to run the code, and the
+    // number of parameters it takes.  The parameters are the first NumParams names.
+    // Code that doesn't say how many registers it needs gets MaxRegisters.
+    NumRegisters    int
+    NumSpillSlots   int
+    NumParams       int
+    
+    // Whether the function takes *args and **kwargs.  Their names follow the names of
+    // the parameters, in that order.
+    VarArgs         bool
+    VarKeywords     bool
+    
+    // Whether calling the function makes a generator, which runs the code as it is
+    // iterated over, or a coroutine, which runs it as an event loop gets to it, rather
+    // than running it.
+    Generator       bool
+    Coroutine       bool
+    
+    // The names of the variables kept in cells, as worked out by AnalyzeScopes.  The
+    // cell variables are bound here and used by nested functions, and the free
+    // variables are bound in an enclosing function.  LOADDEREF and STOREDEREF refer
+    // to the cells by their index in the cell variables followed by the free ones.
+    CellVars        []string
+    FreeVars        []string
+    
+    // The instructions, decoded by Decoded, and the number of registers they name.
+    decoded         []DecodedIns
+    usedRegisters   int
+    
+    // The heads of the loops the JIT has compiled, which are patched to ENTERJIT in
+    // the decoded instructions.
+    jitted          map[uint32]*jitLoop
 }
 
-func (s *CodeStream) Init() {
-    s.Buffer    = new (bytes.Buffer)
-    s.Strings   = make(map[string]uint16, 16)
-    s.Locals    = make(map[uint16]Object, 16)
-    s.Globals   = make(map[uint16]Object, 16)
+func (s *CodeObject) Init() {
+    s.Buffer        = new (bytes.Buffer)
+    s.NameIndices   = make(map[string]uint16, 16)
 }
 
-// Name a variable for the scope.  This inserts a name into the strings table
-func (s *CodeStream) Name(name string) (uint16) {
-    var value uint16
-    var present bool
+// A compiled module is a collection of code objects.  The first one is the body of the
+// module, which runs with Globals as its scope.
+type ModuleCode struct {
+    Name            string
+    Code            []*CodeObject
+    Globals         map[string]Object
+    
+    // The strings and the constants of the code objects, as described in constants.go.
+    pool            *constantPool
+}
+
+func (mod *ModuleCode) Init(name string) {
+    mod.Name        = name
+    mod.Globals     = make(map[string]Object, 16)
+    mod.pool        = nil
+}
+
+// Adds a new, empty code object to the module.
+func (mod *ModuleCode) NewCode(name string) (*CodeObject) {
+    s := new (CodeObject)
+    s.Init()
+    s.Name = name
+    s.module = mod
     
-    value, present = s.Strings[name]
+    mod.Code = append(mod.Code, s)
+    return s
+}
+
+// Copies the cell and free variables of the scope into the code.
+func (s *CodeObject) SetScope(scope *Scope) {
+    s.CellVars = scope.CellVars
+    s.FreeVars = scope.FreeVars
+}
+
+// Returns the index of the cell holding the variable name, and whether there is one.
+func (s *CodeObject) DerefIndex(name string) (uint16, bool) {
+    for i, cell := range s.CellVars {
+        if cell == name {
+            return uint16(i), true
+        }
+    }
+    for i, free := range s.FreeVars {
+        if free == name {
+            return uint16(len(s.CellVars) + i), true
+        }
+    }
+    return 0, false
+}
+
+// Returns the name of the variable in the cell with the index i.
+func (s *CodeObject) DerefName(i uint16) (string) {
+    if int(i) < len(s.CellVars) {
+        return s.CellVars[i]
+    }
+    return s.FreeVars[int(i)-len(s.CellVars)]
+}
+
+// Name a variable for the scope.  This inserts a name into the strings table
+func (s *CodeObject) NameIndex(name string) (uint16) {
+    value, present := s.NameIndices[name]
     
     if !present {
-        value = s.StringCounter
-        s.Strings[name] = value
-        s.StringCounter++
+        if s.module != nil {
+            name = s.module.InternString(name)
+        }
+        value = uint16(len(s.Names))
+        s.NameIndices[name] = value
+        s.Names = append(s.Names, name)
     }
     
     return value
 }
 
+// Adds a constant to the code, and returns its index.  A literal that the module of the
+// code already has is replaced by the one it has, and a constant the code already has
+// gets the index it has.
+func (s *CodeObject) Constant(o Object) (uint16) {
+    if s.module != nil {
+        o = s.module.InternConstant(o)
+    }
+    if i, present := s.constantIndices[o]; present {
+        return i
+    }
+    
+    if s.constantIndices == nil {
+        s.constantIndices = make(map[Object]uint16)
+    }
+    s.Constants = append(s.Constants, o)
+    s.constantIndices[o] = uint16(len(s.Constants) - 1)
+    return uint16(len(s.Constants) - 1)
+}
+
+// LOADDEREF loads the variable in the cell with the index in the immediate, and
+// STOREDEREF stores register in it.
+func (s *CodeObject) WriteLoadDeref(cell, register uint32, pred_bit bool, pred_reg uint32) {
+    var instruction uint32
+    
+    instruction = LOADDEREF | (cell << immediate_val_shift) | (register << imm_target_reg_shift)
+    binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))
+}
+
+func (s *CodeObject) WriteStoreDeref(cell, register uint32, pred_bit bool, pred_reg uint32) {
+    var instruction uint32
+    
+    instruction = STOREDEREF | (cell << immediate_val_shift) | (register << imm_target_reg_shift)
+    binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))
+}
+
 // Updates the predicate field of any instruction
 func predicate(instruction uint32, pred_bit bool, pred_reg uint32) (uint32) {
     if pred_bit {
@@ -101,33 +283,339 @@ func predicate(instruction uint32, pred_bit bool, pred_reg uint32) (uint32) {
     return instruction | (pred_reg << pred_reg_shift)
 }
 
-// Bind a name to the local variable context.
-func (s *CodeStream) BindLocal(n string, o Object) {
-    id := s.Name(n)
-    s.Locals[id] = o
-}
-
-func (s *CodeStream) WriteLoad(name string, register uint32, pred_bit bool, pred_reg uint32) {
+func (s *CodeObject) WriteLoad(name string, register uint32, pred_bit bool, pred_reg uint32) {
     var instruction uint32
     
-    value :=  s.Name(name)
+    value :=  s.NameIndex(name)
     
     instruction = LOAD | (uint32(value) << immediate_val_shift) | (register << imm_target_reg_shift)    
     binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))    
 }
 
-func (s *CodeStream) WriteBind(name string, register uint32, pred_bit bool, pred_reg uint32) {
+func (s *CodeObject) WriteBind(name string, register uint32, pred_bit bool, pred_reg uint32) {
     var instruction uint32
     
-    value :=  s.Name(name)
+    value :=  s.NameIndex(name)
     
     instruction = BIND | (uint32(value) << immediate_val_shift) | (register << imm_target_reg_shift)    
     binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))    
 }
 
-func (s *CodeStream) WriteAluIns(op, reg1, reg2, target_reg uint32, pred_bit bool, pred_reg uint32) {
+// CONST loads the constant with the index in the immediate.
+func (s *CodeObject) WriteConst(o Object, register uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteConstIndex(s.Constant(o), register, pred_bit, pred_reg)
+}
+
+// Loads a constant that is already in the code, by its index.
+func (s *CodeObject) WriteConstIndex(index uint16, register uint32, pred_bit bool, pred_reg uint32) {
+    var instruction uint32
+    
+    instruction = CONST | (uint32(index) << immediate_val_shift) | (register << imm_target_reg_shift)
+    binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))
+}
+
+func (s *CodeObject) WriteAluIns(op, reg1, reg2, target_reg uint32, pred_bit bool, pred_reg uint32) {
     var instruction uint32
     
     instruction = op | (reg1<<source_reg1_shift) | (reg2<<source_reg2_shift) | (target_reg<<target_reg_shift)    
     binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))    
 }
+
+// Writes the arithmetic instruction op, one of ADD to MOD, of an augmented assignment.  It
+// sets the in-place flag, so the left operand is changed in place if it can be.
+func (s *CodeObject) WriteInPlaceAluIns(op, reg1, reg2, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    var instruction uint32
+    
+    instruction = op | (reg1<<source_reg1_shift) | (reg2<<source_reg2_shift) | (target_reg<<target_reg_shift) | inplace_mask
+    binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))
+}
+
+// The index of the next instruction to be written, to use as a jump target.
+func (s *CodeObject) Here() (uint32) {
+    return uint32(s.Len() / 4)
+}
+
+// Returns the instructions of the code, decoded.  They are only decoded again once more
+// code has been written, or a jump has been patched, which undoes the patches of the
+// JIT.
+func (s *CodeObject) Decoded() ([]DecodedIns) {
+    code := s.Bytes()
+    if len(s.decoded) == len(code)/4 {
+        return s.decoded
+    }
+    
+    s.decoded = make([]DecodedIns, len(code)/4)
+    s.usedRegisters = 0
+    s.dropJitted()
+    for i := range s.decoded {
+        s.decoded[i] = Decode(binary.LittleEndian.Uint32(code[i*4:]))
+        if n := int(s.decoded[i].highestRegister())+1; n > s.usedRegisters {
+            s.usedRegisters = n
+        }
+    }
+    return s.decoded
+}
+
+// Returns the number of registers a frame needs to run the code.
+func (s *CodeObject) RegisterCount() (int) {
+    if s.NumRegisters == 0 {
+        return MaxRegisters
+    }
+    return s.NumRegisters
+}
+
+// Records that the instructions written from now on come from the source line.
+func (s *CodeObject) SetLine(line int) {
+    if s.FirstLine == 0 {
+        s.FirstLine = line
+        s.lastLine = line
+    }
+    
+    addr_delta := s.Here() - s.lastLineAddr
+    line_delta := line - s.lastLine
+    if line_delta == 0 {
+        return
+    }
+    
+    // Each pair can only move so far, so big steps take several.
+    for addr_delta > 255 {
+        s.LineTable = append(s.LineTable, 255, 0)
+        addr_delta -= 255
+    }
+    for line_delta > 127 {
+        s.LineTable = append(s.LineTable, byte(addr_delta), 127)
+        addr_delta = 0
+        line_delta -= 127
+    }
+    for line_delta < -128 {
+        s.LineTable = append(s.LineTable, byte(addr_delta), byte(0x80))
+        addr_delta = 0
+        line_delta += 128
+    }
+    s.LineTable = append(s.LineTable, byte(addr_delta), byte(int8(line_delta)))
+    
+    s.lastLineAddr = s.Here()
+    s.lastLine = line
+}
+
+// Returns the source line of the instruction at pc, or 0 if the code has no lines.
+func (s *CodeObject) Line(pc uint32) (int) {
+    addr, line := uint32(0), s.FirstLine
+    for i := 0; i+1 < len(s.LineTable); i += 2 {
+        addr += uint32(s.LineTable[i])
+        if addr > pc {
+            break
+        }
+        line += int(int8(s.LineTable[i+1]))
+    }
+    return line
+}
+
+// Identifies a jump whose target is filled in later by PatchJump.
+type JumpFixup uint32
+
+// JMP uses the immediate format, with the index of the target instruction as the
+// immediate.  It is made conditional by its predicate, like any other instruction.  The
+// target is left at 0, and the jump has to be patched once the target is known.
+func (s *CodeObject) WriteJump(pred_bit bool, pred_reg uint32) (JumpFixup) {
+    fixup := JumpFixup(s.Here())
+    binary.Write(s, binary.LittleEndian, predicate(JMP, pred_bit, pred_reg))
+    return fixup
+}
+
+// Sets the target of a jump written by WriteJump.
+func (s *CodeObject) PatchJump(fixup JumpFixup, target uint32) {
+    code := s.Bytes()[fixup*4:]
+    instruction := binary.LittleEndian.Uint32(code)
+    
+    instruction = (instruction &^ immediate_val_mask) | (target << immediate_val_shift)
+    binary.LittleEndian.PutUint32(code, instruction)
+    s.decoded = nil
+}
+
+// EQ, NE, LT, LE, GT and GE use the register format, but their target is a predicate
+// register, which is set to the result of comparing reg1 with reg2.  The target field
+// has an extra bit for it, since there are 32 predicate registers.
+func (s *CodeObject) WriteCompare(op, reg1, reg2, pred_target uint32, pred_bit bool, pred_reg uint32) {
+    var instruction uint32
+    
+    instruction = op | (reg1<<source_reg1_shift) | (reg2<<source_reg2_shift) | (pred_target<<target_reg_shift)
+    binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))
+}
+
+// CALL uses the immediate format, like JMP, and its register is the one that receives
+// the value returned.  The target has to be patched like the target of a jump.
+func (s *CodeObject) WriteCall(result_reg uint32, pred_bit bool, pred_reg uint32) (JumpFixup) {
+    fixup := JumpFixup(s.Here())
+    binary.Write(s, binary.LittleEndian, predicate(CALL | (result_reg << imm_target_reg_shift), pred_bit, pred_reg))
+    return fixup
+}
+
+// Special instructions use the register format.  NEW creates an instance of the class in
+// class_reg.
+func (s *CodeObject) WriteNew(class_reg, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(NEW, class_reg, 0, target_reg, pred_bit, pred_reg)
+}
+
+// HALT stops the machine, and returns the value in reg.
+func (s *CodeObject) WriteHalt(reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(HALT, reg, 0, 0, pred_bit, pred_reg)
+}
+
+// RET returns the value in reg from the current call.
+func (s *CodeObject) WriteRet(reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(RET, reg, 0, 0, pred_bit, pred_reg)
+}
+
+// CALLFN calls the function in fn_reg, and puts the value it returns in result_reg.
+// The nargs positional arguments are in the registers after fn_reg, followed by the
+// values of the nkw keyword arguments, and then a tuple of their names, if there are
+// any.  The count of keyword arguments is kept in the top bits.
+//
+// The function receives its parameters in its registers from r1 on, followed by
+// *args and **kwargs, and they are also bound to their names.
+func (s *CodeObject) WriteCallFunction(fn_reg, nargs, nkw, result_reg uint32, pred_bit bool, pred_reg uint32) {
+    var instruction uint32
+    
+    instruction = CALLFN | (fn_reg<<source_reg1_shift) | (nargs<<source_reg2_shift) | (result_reg<<target_reg_shift) | (nkw<<call_kw_shift)
+    binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))
+}
+
+// MAKECLOSURE makes a copy of the function in fn_reg, which is usually a constant,
+// that captures the cells of its free variables from the current frame, and puts it
+// in target_reg.
+func (s *CodeObject) WriteMakeClosure(fn_reg, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(MAKECLOSURE, fn_reg, 0, target_reg, pred_bit, pred_reg)
+}
+
+// GETITER puts an iterator over the object in reg into target_reg.
+func (s *CodeObject) WriteGetIter(reg, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(GETITER, reg, 0, target_reg, pred_bit, pred_reg)
+}
+
+// FORITER advances the iterator in iter_reg, and puts the next item in the register after
+// it.  Once the iterator is exhausted it jumps instead, to the target in the immediate,
+// so it has the layout of the immediate format.  The target has to be patched like the
+// target of a jump.
+func (s *CodeObject) WriteForIter(iter_reg uint32, pred_bit bool, pred_reg uint32) (JumpFixup) {
+    fixup := JumpFixup(s.Here())
+    binary.Write(s, binary.LittleEndian, predicate(FORITER | (iter_reg << imm_target_reg_shift), pred_bit, pred_reg))
+    return fixup
+}
+
+// BUILDLIST, BUILDTUPLE, BUILDDICT and BUILDSET gather the values in count registers,
+// starting with first_reg, into a new container, and put it in target_reg.  The count
+// takes the place of the second source.  A dict takes its keys and values from
+// alternate registers, so count is the number of entries, and it reads twice as many
+// registers.
+func (s *CodeObject) WriteBuild(op, first_reg, count, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(op, first_reg, count, target_reg, pred_bit, pred_reg)
+}
+
+// NEG, POS and INVERT put -reg, +reg and ~reg into target_reg.
+func (s *CodeObject) WriteUnary(op, reg, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(op, reg, 0, target_reg, pred_bit, pred_reg)
+}
+
+// NOT sets the predicate register pred_target to the opposite of the truth value of reg,
+// like a comparison.
+func (s *CodeObject) WriteNot(reg, pred_target uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(NOT, reg, 0, pred_target, pred_bit, pred_reg)
+}
+
+// MOVE copies the value in reg into target_reg.
+func (s *CodeObject) WriteMove(reg, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(MOVE, reg, 0, target_reg, pred_bit, pred_reg)
+}
+
+// YIELD suspends the generator that is running, which passes the value in reg out to
+// whatever resumed it.  When the generator is resumed again, target_reg gets the value
+// sent in, which is None for __next__.
+func (s *CodeObject) WriteYield(reg, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(YIELD, reg, 0, target_reg, pred_bit, pred_reg)
+}
+
+// AWAIT waits for the coroutine or the future in reg to finish, and puts its result in
+// target_reg.  While it waits, the coroutine that is running is suspended.
+func (s *CodeObject) WriteAwait(reg, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(AWAIT, reg, 0, target_reg, pred_bit, pred_reg)
+}
+
+// LEN puts the length of the object in reg into target_reg.
+func (s *CodeObject) WriteLen(reg, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(LEN, reg, 0, target_reg, pred_bit, pred_reg)
+}
+
+// INDEX puts obj_reg[key_reg] into target_reg.
+func (s *CodeObject) WriteIndex(obj_reg, key_reg, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(INDEX, obj_reg, key_reg, target_reg, pred_bit, pred_reg)
+}
+
+// STOREINDEX sets obj_reg[key_reg] to value_reg.  Like SET, it has no result, so the
+// value goes in the target field.
+func (s *CodeObject) WriteStoreIndex(obj_reg, key_reg, value_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(STOREINDEX, obj_reg, key_reg, value_reg, pred_bit, pred_reg)
+}
+
+// GET puts the attribute of obj_reg named by the string in name_reg into target_reg.
+func (s *CodeObject) WriteGet(obj_reg, name_reg, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(GET, obj_reg, name_reg, target_reg, pred_bit, pred_reg)
+}
+
+// SET sets the attribute of obj_reg named by the string in name_reg to value_reg.  The
+// value goes in the target field, since SET has no result.
+func (s *CodeObject) WriteSet(obj_reg, name_reg, value_reg uint32, pred_bit bool, pred_reg uint32) {
+    s.WriteAluIns(SET, obj_reg, name_reg, value_reg, pred_bit, pred_reg)
+}
+
+// BOXI, BOXL, BOXF, BOXS and BOXB use the immediate format.  They wrap the raw value in
+// the raw register named by the immediate in an object, and put it in register.  Each
+// kind of raw value has its own bank of registers in the frame: int64s for BOXI,
+// big.Ints for BOXL, float64s for BOXF and strings for BOXS.  The raw registers of BOXB
+// are the predicate registers, and it boxes a bool as the int 0 or 1.
+func (s *CodeObject) WriteBox(op, raw_reg, register uint32, pred_bit bool, pred_reg uint32) {
+    var instruction uint32
+    
+    instruction = op | (raw_reg << immediate_val_shift) | (register << imm_target_reg_shift)
+    binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))
+}
+
+// The UNBOX instructions are the reverse of the BOX instructions.  They take the raw value
+// out of the object in register, and put it in the raw register named by the immediate.
+// UNBOXI fails if the int doesn't fit in an int64, and UNBOXB takes the truth value of
+// any object.
+func (s *CodeObject) WriteUnbox(op, register, raw_reg uint32, pred_bit bool, pred_reg uint32) {
+    var instruction uint32
+    
+    instruction = op | (raw_reg << immediate_val_shift) | (register << imm_target_reg_shift)
+    binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))
+}
+
+// IALU and FALU do arithmetic on the raw int64 or float64 registers, so a value can stay
+// unboxed from the UNBOX that produces it to the BOX that gives it to code expecting
+// an object.  They use the register format, and the operation is one of the arithmetic
+// opcodes ADD, SUB, MUL, DIV, FDIV and MOD, kept in the top bits.  An int operation that
+// overflows fails, rather than going on with the wrong value.
+func (s *CodeObject) WriteRawAluIns(op, alu_op, reg1, reg2, target_reg uint32, pred_bit bool, pred_reg uint32) {
+    var instruction uint32
+    
+    instruction = op | (reg1<<source_reg1_shift) | (reg2<<source_reg2_shift) | (target_reg<<target_reg_shift) | (alu_op<<raw_op_shift)
+    binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))
+}
+
+// SPILL and FILL move a register to and from a spill slot.  They use the register format,
+// with the register as the first source, but a slot needs more than four bits, so it
+// takes the place of the second source and the target.
+func (s *CodeObject) WriteSpill(register, slot uint32, pred_bit bool, pred_reg uint32) {
+    var instruction uint32
+    
+    instruction = SPILL | (register << source_reg1_shift) | (slot << spill_slot_shift)
+    binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))
+}
+
+func (s *CodeObject) WriteFill(slot, register uint32, pred_bit bool, pred_reg uint32) {
+    var instruction uint32
+    
+    instruction = FILL | (register << source_reg1_shift) | (slot << spill_slot_shift)
+    binary.Write(s, binary.LittleEndian, predicate(instruction, pred_bit, pred_reg))
+}
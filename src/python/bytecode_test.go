@@ -30,7 +30,7 @@ var sample_instructions = []uint32{0x00003010, 0x00015091, 0x00543026}
 
 func TestEncodeInstructions(t *testing.T) {
     
-    s := new (CodeStream)
+    s := new (CodeObject)
     s.Init()
 
     s.WriteLoad("a", 3, false, 0)
@@ -46,3 +46,110 @@ func TestEncodeInstructions(t *testing.T) {
 	    }
 	}
 }
+
+func TestEncodeInstructionFormats(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+
+    s.WriteNew(2, 7, false, 0)
+    s.WriteLen(3, 4, false, 0)
+    s.WriteIndex(1, 2, 3, false, 0)
+    s.WriteGet(1, 2, 3, false, 0)
+    s.WriteSet(1, 2, 3, false, 0)
+    s.WriteBox(BOXF, 5, 6, false, 0)
+    s.WriteUnbox(UNBOXI, 6, 5, true, 2)
+    s.WriteSpill(4, 300, false, 0)
+    s.WriteFill(300, 4, false, 0)
+    s.WriteRawAluIns(FALU, MOD, 1, 2, 3, false, 0)
+
+    expected := []uint32{
+        NEW | 2<<12 | 7<<20,
+        LEN | 3<<12 | 4<<20,
+        INDEX | 1<<12 | 2<<16 | 3<<20,
+        GET | 1<<12 | 2<<16 | 3<<20,
+        SET | 1<<12 | 2<<16 | 3<<20,
+        BOXF | 5<<16 | 6<<12,
+        UNBOXI | 1<<6 | 2<<7 | 5<<16 | 6<<12,
+        SPILL | 4<<12 | 300<<16,
+        FILL | 4<<12 | 300<<16,
+        FALU | 1<<12 | 2<<16 | 3<<20 | MOD<<24,
+    }
+
+    for i, wanted := range expected {
+        var instruction uint32
+        binary.Read(s, binary.LittleEndian, &instruction)
+
+        if instruction != wanted {
+            t.Errorf("instruction %v: expected '%#08x', got '%#08x'\n", i, wanted, instruction)
+        }
+    }
+}
+
+func TestLineTable(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    
+    // The line of each instruction, with big steps forwards and backwards.
+    lines := []int{3, 3, 4, 400, 400, 2, 5, 5, 5}
+    for _, line := range lines {
+        s.SetLine(line)
+        s.WriteHalt(0, false, 0)
+    }
+    for i := 0; i < 300; i++ {
+        s.WriteHalt(0, false, 0)
+    }
+    s.SetLine(1)
+    s.WriteHalt(0, false, 0)
+    
+    for pc, line := range lines {
+        if l := s.Line(uint32(pc)); l != line {
+            t.Errorf("instruction %v: expected line %v, got %v", pc, line, l)
+        }
+    }
+    if l := s.Line(s.Here()-2); l != 5 {
+        t.Errorf("expected the run of instructions to stay on line 5, got %v", l)
+    }
+    if l := s.Line(s.Here()-1); l != 1 {
+        t.Errorf("expected the last instruction to be on line 1, got %v", l)
+    }
+    if len(s.LineTable) > 24 {
+        t.Errorf("expected a compact line table, got %v bytes", len(s.LineTable))
+    }
+}
+
+func TestConstantPool(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    f, g := mod.NewCode("f"), mod.NewCode("g")
+    
+    one := f.Constant(intObject(1))
+    if f.Constant(intObject(1)) != one || f.Constant(NewString("1")) == one {
+        t.Errorf("equal literals should share an index, and only equal ones")
+    }
+    g.Constant(NewString("x"))
+    if g.Constants[g.Constant(intObject(1))] != f.Constants[one] {
+        t.Errorf("code objects should share the constants of their module")
+    }
+    
+    half := new (FloatObject)
+    half.Value = 1
+    if f.Constant(half) == one {
+        t.Errorf("a float should not be pooled with the int it is equal to")
+    }
+    pair := func() (Object) {
+        return NewTuple([]Object{intObject(1), NewString("a")})
+    }
+    if f.Constant(pair()) != f.Constant(pair()) {
+        t.Errorf("equal tuples should be pooled")
+    }
+    fn := NewFunction(g, nil, mod.Globals)
+    if f.Constant(fn) == f.Constant(NewFunction(g, nil, mod.Globals)) || f.Constant(fn) != f.Constant(fn) {
+        t.Errorf("only the same function should share an index")
+    }
+    
+    f.NameIndex("name" + "1")
+    g.NameIndex("name1")
+    if f.Names[0] != g.Names[0] || mod.InternString("name1") != f.Names[0] {
+        t.Errorf("names should be interned by the module")
+    }
+}
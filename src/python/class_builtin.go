@@ -0,0 +1,543 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the classes that Python code
+   defines, and of their instances.  A class is made from what a class
+   statement gives: its name, its bases and the namespace its body leaves.
+   The namespace becomes the attributes of the class.  Its method
+   resolution order is worked out from the bases with the C3 linearization,
+   as in Python, and an attribute of the class is looked up in each class
+   of it in turn.  An attribute of an instance is looked up in the instance,
+   and then in its class.  Every class derives from object.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+// A class.  Mro is the class followed by the classes it derives from, in the order
+// their attributes are looked up.  builtin is true for the classes of the built-in
+// objects, which are described in builtins.go.
+type TypeObject struct {
+    ObjectData
+    Name    string
+    Bases   []*TypeObject
+    Mro     []*TypeObject
+    builtin bool
+}
+
+// The class every class derives from.
+var ObjectClass = newObjectClass()
+
+func newObjectClass() (*TypeObject) {
+    c := new(TypeObject)
+    c.ObjectData.Init()
+    c.Name = "object"
+    c.Mro = []*TypeObject{c}
+    
+    return c
+}
+
+// Makes the class name, with the classes bases as its bases, and the entries of the
+// namespace, whose keys must be strings, as its attributes.  A class with no bases
+// derives from object.
+func NewType(name string, bases []Object, namespace *DictObject) (*TypeObject, os.Error) {
+    c := new(TypeObject)
+    c.ObjectData.Init()
+    c.Name = name
+    
+    for _, b := range bases {
+        base, ok := b.(*TypeObject)
+        if !ok {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("bases must be classes, not '%v'", b.AsString()))
+        }
+        if base.builtin {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("type '%v' is not an acceptable base type", base.Name))
+        }
+        for _, other := range c.Bases {
+            if other == base {
+                return nil, Raise(TypeErrorClass, fmt.Sprintf("duplicate base class %v", base.Name))
+            }
+        }
+        c.Bases = append(c.Bases, base)
+    }
+    if len(c.Bases) == 0 {
+        c.Bases = []*TypeObject{ObjectClass}
+    }
+    
+    mro, err := linearize(c)
+    if err != nil {
+        return nil, err
+    }
+    c.Mro = mro
+    
+    if namespace != nil {
+        for i, key := range namespace.Keys {
+            s, ok := key.(*StringObject)
+            if !ok {
+                return nil, Raise(TypeErrorClass, fmt.Sprintf("the names in the namespace of a class must be strings, not '%v'", key.AsString()))
+            }
+            c.SetAttr(s.Value, namespace.Values[i])
+        }
+    }
+    return c, nil
+}
+
+// Returns the C3 linearization of c, which is c followed by the merge of the
+// linearizations of its bases and the list of its bases.  The merge takes the first
+// head of the lists that isn't in the tail of any of them, until the lists are empty.
+func linearize(c *TypeObject) ([]*TypeObject, os.Error) {
+    var lists [][]*TypeObject
+    for _, base := range c.Bases {
+        lists = append(lists, base.Mro)
+    }
+    lists = append(lists, c.Bases)
+    
+    mro := []*TypeObject{c}
+    for {
+        var next *TypeObject
+        empty := true
+        for _, list := range lists {
+            if len(list) == 0 {
+                continue
+            }
+            empty = false
+            if !inTail(list[0], lists) {
+                next = list[0]
+                break
+            }
+        }
+        if empty {
+            return mro, nil
+        }
+        if next == nil {
+            return nil, Raise(TypeErrorClass, "Cannot create a consistent method resolution order (MRO)")
+        }
+        
+        mro = append(mro, next)
+        for i, list := range lists {
+            if len(list) > 0 && list[0] == next {
+                lists[i] = list[1:]
+            }
+        }
+    }
+    return mro, nil
+}
+
+// Returns true if c is in the tail of any of the lists.  The lists the merge has
+// already emptied have no tail.
+func inTail(c *TypeObject, lists [][]*TypeObject) (bool) {
+    for _, list := range lists {
+        if len(list) == 0 {
+            continue
+        }
+        for _, other := range list[1:] {
+            if other == c {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Returns true if c is base or derives from it.
+func (c *TypeObject) IsSubclass(base *TypeObject) (bool) {
+    for _, other := range c.Mro {
+        if other == base {
+            return true
+        }
+    }
+    return false
+}
+
+// Looks the attribute name up in the classes of the method resolution order.
+func (c *TypeObject) Lookup(name string) (value Object, present bool) {
+    for _, class := range c.Mro {
+        if value, present = class.ObjectData.GetAttr(name); present {
+            return
+        }
+    }
+    return nil, false
+}
+
+func (c *TypeObject) GetAttr(name string) (value Object, present bool) {
+    if value, present = c.typeAttr(name); present {
+        return
+    }
+    return c.Lookup(name)
+}
+
+// Returns the attributes every class has, which aren't in its namespace.  They hide
+// the ones that are.
+func (c *TypeObject) typeAttr(name string) (Object, bool) {
+    switch name {
+        case "__name__":
+            return NewString(c.Name), true
+        case "__bases__":
+            return classTuple(c.Bases), true
+        case "__mro__":
+            return classTuple(c.Mro), true
+    }
+    return nil, false
+}
+
+func classTuple(classes []*TypeObject) (*TupleObject) {
+    items := make([]Object, len(classes))
+    for i, c := range classes {
+        items[i] = c
+    }
+    return NewTuple(items)
+}
+
+// Makes an instance of the class, and calls its __init__ method, if it has one, with the
+// instance and the arguments.  Calling type is type(), and the other classes of the
+// built-in objects can't be called yet.
+func (c *TypeObject) Call(m *Machine, args []Object, kwnames []string, kwargs []Object) (Object, os.Error) {
+    if c == TypeClass {
+        return callType(args, kwnames)
+    }
+    if c.builtin {
+        return nil, Raise(TypeErrorClass, fmt.Sprintf("cannot create '%v' instances", c.Name))
+    }
+    
+    o := NewInstance(c)
+    
+    init, present := c.Lookup("__init__")
+    if !present {
+        if len(args) > 0 || len(kwnames) > 0 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() takes no arguments", c.Name))
+        }
+        return o, nil
+    }
+    
+    result, err := m.callNestedKeywords(init, append([]Object{o}, args...), kwnames, kwargs)
+    if err != nil {
+        return nil, err
+    }
+    if result != None {
+        return nil, Raise(TypeErrorClass, "__init__() should return None")
+    }
+    return o, nil
+}
+
+// A class can't be converted to a number
+func (o *TypeObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *TypeObject) AsFloat() (float64) {
+    return 0
+}
+
+func (o *TypeObject) AsString() (string) {
+    return fmt.Sprintf("<class '%v'>", o.Name)
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A class is only equal to itself, and classes are not ordered.
+func (o *TypeObject) Eq(r Object) (Object) {
+    c, ok := r.(*TypeObject)
+    return pyBool(ok && c == o)
+}
+
+func (o *TypeObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *TypeObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *TypeObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *TypeObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *TypeObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *TypeObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TypeObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TypeObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TypeObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TypeObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TypeObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TypeObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *TypeObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TypeObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TypeObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TypeObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *TypeObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *TypeObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *TypeObject) AsBool() (bool) {
+    return o.IsTrue()
+}
+
+// An instance of a class Python code defined.
+type InstanceObject struct {
+    ObjectData
+    Class *TypeObject
+}
+
+func NewInstance(c *TypeObject) (*InstanceObject) {
+    o := new(InstanceObject)
+    o.ObjectData.Init()
+    o.Class = c
+    
+    return o
+}
+
+// Looks the attribute name up in the instance, and then in its class.
+func (o *InstanceObject) GetAttr(name string) (value Object, present bool) {
+    if name == "__class__" {
+        return o.Class, true
+    }
+    if value, present = o.ObjectData.GetAttr(name); present {
+        return
+    }
+    return o.Class.Lookup(name)
+}
+
+// An instance can't be converted to a number
+func (o *InstanceObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *InstanceObject) AsFloat() (float64) {
+    return 0
+}
+
+func (o *InstanceObject) AsString() (string) {
+    return fmt.Sprintf("<%v object>", o.Class.Name)
+}
+
+///////// Rich Comparison Interface ///////////
+
+// An instance is equal to itself.  Anything else is left to the methods of the class,
+// which the machine calls before it gets here.
+func (o *InstanceObject) Eq(r Object) (Object) {
+    if r == Object(o) {
+        return pyBool(true)
+    }
+    return NotImplemented
+}
+
+func (o *InstanceObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *InstanceObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *InstanceObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *InstanceObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *InstanceObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+// The arithmetic of an instance is done by the methods of its class, which the machine
+// calls, so the instance itself supports none.
+func (o *InstanceObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *InstanceObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *InstanceObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *InstanceObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *InstanceObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *InstanceObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *InstanceObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *InstanceObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *InstanceObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *InstanceObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *InstanceObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *InstanceObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *InstanceObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *InstanceObject) AsBool() (bool) {
+    return o.IsTrue()
+}
+
+// Returns true if the class c is one of classes, or derives from one of them.  classes
+// is a class, or a tuple of classes and tuples.  fn names the builtin in the errors.
+func subclassOf(c Object, classes Object, fn string) (bool, os.Error) {
+    switch base := classes.(type) {
+        case *TupleObject:
+            for _, item := range base.Items {
+                if ok, err := subclassOf(c, item, fn); ok || err != nil {
+                    return ok, err
+                }
+            }
+            return false, nil
+        
+        case *TypeObject:
+            if base == ObjectClass {
+                return true, nil
+            }
+            class, ok := c.(*TypeObject)
+            return ok && class.IsSubclass(base), nil
+        
+        case *ExceptionClassObject:
+            class, ok := c.(*ExceptionClassObject)
+            return ok && class.IsSubclass(base), nil
+    }
+    return false, Raise(TypeErrorClass, fmt.Sprintf("%v() arg 2 must be a class or tuple of classes", fn))
+}
+
+// Returns true if o is an instance of one of classes, or of a class derived from one of
+// them, as isinstance does.  Every object is an instance of object.
+func IsInstance(o Object, classes Object) (bool, os.Error) {
+    return subclassOf(typeOf(o), classes, "isinstance")
+}
+
+// Returns true if the class c is one of classes, or derives from one of them, as
+// issubclass does.
+func IsSubclass(c Object, classes Object) (bool, os.Error) {
+    switch c.(type) {
+        case *TypeObject, *ExceptionClassObject:
+            return subclassOf(c, classes, "issubclass")
+    }
+    return false, Raise(TypeErrorClass, "issubclass() arg 1 must be a class")
+}
+
+// Adds object, isinstance() and issubclass() to the builtins of the interpreter.
+func (interp *Interpreter) addClassBuiltins() {
+    interp.Builtins["object"] = ObjectClass
+    
+    interp.Builtins["isinstance"] = NewBuiltinFunction("isinstance", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 2 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("isinstance expected 2 arguments, got %v", len(args)))
+        }
+        ok, err := IsInstance(args[0], args[1])
+        if err != nil {
+            return nil, err
+        }
+        return pyBool(ok), nil
+    })
+    
+    interp.Builtins["issubclass"] = NewBuiltinFunction("issubclass", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 2 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("issubclass expected 2 arguments, got %v", len(args)))
+        }
+        ok, err := IsSubclass(args[0], args[1])
+        if err != nil {
+            return nil, err
+        }
+        return pyBool(ok), nil
+    })
+}
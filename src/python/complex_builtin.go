@@ -0,0 +1,279 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the complex built-in object
+   type.  An int or a float mixed with a complex is promoted to a complex,
+   as in Python, and complex numbers are not ordered.
+*/
+
+package python
+
+import (
+        "big"
+        "cmath"
+        "fmt"
+        "math"
+        "os"
+        "strings"
+)
+
+type ComplexObject struct {
+    ObjectData
+    Value complex128
+}
+
+func NewComplex(v complex128) (*ComplexObject) {
+    o := new (ComplexObject)
+    o.ObjectData.Init()
+    o.Value = v
+
+    return o
+}
+
+// Returns the value of o as a complex, and false if o isn't a number.
+func asComplex(o Object) (complex128, bool) {
+    switch n := o.(type) {
+        case *ComplexObject:
+            return n.Value, true
+        case *IntObject, *FloatObject:
+            return complex(n.AsFloat(), 0), true
+    }
+    return 0, false
+}
+
+// A complex can't be converted to an int or a float, and the machine doesn't try to,
+// so these give the real part.
+func (o *ComplexObject) AsInt() (*big.Int) {
+    return big.NewInt(int64(real(o.Value)))
+}
+
+func (o *ComplexObject) AsFloat() (float64) {
+    return real(o.Value)
+}
+
+// Convert complex to string, the way Python writes it.  A complex with a real part of
+// positive zero is written as its imaginary part alone.
+func (o *ComplexObject) AsString() (string) {
+    im := complexPart(imag(o.Value)) + "j"
+    if real(o.Value) == 0 && !math.Signbit(real(o.Value)) {
+        return im
+    }
+    if !strings.HasPrefix(im, "-") {
+        im = "+" + im
+    }
+    return "(" + complexPart(real(o.Value)) + im + ")"
+}
+
+// Returns a part of a complex as Python writes it, which is the repr of the float
+// without the ".0" of an integral one.
+func complexPart(v float64) (string) {
+    s := floatRepr(v)
+    if strings.HasSuffix(s, ".0") {
+        s = s[:len(s)-2]
+    }
+    return s
+}
+
+// Returns the magnitude of the complex, which is what abs() gives.
+func (o *ComplexObject) Abs() (Object) {
+    return NewFloat(cmath.Abs(o.Value))
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A complex is equal to an int or a float with the same real part and no imaginary
+// part, which is compared with an int exactly, as a float is.  Complex numbers aren't
+// ordered, so the machine raises a TypeError for the other comparisons.
+func (o *ComplexObject) Eq(r Object) (Object) {
+    if _, is_int := r.(*IntObject); is_int {
+        return pyBool(imag(o.Value) == 0 && compareFloat(EQ, real(o.Value), r).IsTrue())
+    }
+    v, ok := asComplex(r)
+    if !ok {
+        return NotImplemented
+    }
+    return pyBool(o.Value == v)
+}
+
+func (o *ComplexObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *ComplexObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ComplexObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ComplexObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ComplexObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *ComplexObject) Add(r Object) (Object, os.Error) {
+    v, ok := asComplex(r)
+    if !ok {
+        return nil, nil
+    }
+    return NewComplex(o.Value + v), nil
+}
+
+func (o *ComplexObject) Sub(r Object) (Object, os.Error) {
+    v, ok := asComplex(r)
+    if !ok {
+        return nil, nil
+    }
+    return NewComplex(o.Value - v), nil
+}
+
+func (o *ComplexObject) Mul(r Object) (Object, os.Error) {
+    v, ok := asComplex(r)
+    if !ok {
+        return nil, nil
+    }
+    return NewComplex(o.Value * v), nil
+}
+
+func (o *ComplexObject) Div(r Object) (Object, os.Error) {
+    v, ok := asComplex(r)
+    if !ok {
+        return nil, nil
+    }
+    if v == 0 {
+        return nil, Raise(ZeroDivisionErrorClass, "complex division by zero")
+    }
+    return NewComplex(o.Value / v), nil
+}
+
+// Python 3 doesn't have floor division or modulo of complex numbers.
+func (o *ComplexObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, Raise(TypeErrorClass, "can't take floor of complex number.")
+}
+
+func (o *ComplexObject) Mod(r Object) (Object, os.Error) {
+    return nil, Raise(TypeErrorClass, "can't mod complex numbers.")
+}
+
+func (o *ComplexObject) Pow(r Object) (Object, os.Error) {
+    v, ok := asComplex(r)
+    if !ok {
+        return nil, nil
+    }
+    if o.Value == 0 && (real(v) < 0 || imag(v) != 0) {
+        return nil, Raise(ZeroDivisionErrorClass, "0.0 to a negative or complex power")
+    }
+    return NewComplex(cmath.Pow(o.Value, v)), nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *ComplexObject) Neg() (Object, os.Error) {
+    return NewComplex(-o.Value), nil
+}
+
+func (o *ComplexObject) Pos() (Object, os.Error) {
+    return o, nil
+}
+
+func (o *ComplexObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ComplexObject) IsTrue() (bool) {
+    return o.Value != 0
+}
+
+///////// Protocol Interface ///////////
+
+// The hash of a complex with no imaginary part is the hash of its real part, as in
+// Python, so that it is the hash of the equal int or float.
+func (o *ComplexObject) Hash() (uint64, os.Error) {
+    h := floatHash(real(o.Value)) + 1000003*floatHash(imag(o.Value))
+    if int64(h) == -1 {
+        h--
+    }
+    return h, nil
+}
+
+func (o *ComplexObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *ComplexObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *ComplexObject) AsBool() (bool) {
+    return o.IsTrue()
+}
+
+// pow(), which the translated CPython code also calls for **, since there is no
+// instruction for it.
+var powBuiltin = NewBuiltinFunction("pow", func(m *Machine, args []Object) (Object, os.Error) {
+    switch len(args) {
+        case 2:
+            return m.power(args[0], args[1])
+        case 3:
+            base, b_int := args[0].(*IntObject)
+            exp, e_int := args[1].(*IntObject)
+            mod, m_int := args[2].(*IntObject)
+            if !b_int || !e_int || !m_int {
+                return nil, Raise(TypeErrorClass, "pow() 3rd argument not allowed unless all arguments are integers")
+            }
+            return base.PowMod(exp, mod)
+    }
+    return nil, Raise(TypeErrorClass, fmt.Sprintf("pow() takes 2 or 3 arguments (%v given)", len(args)))
+})
+
+// Adds abs(), pow() and divmod() to the builtins of the interpreter.
+func (interp *Interpreter) addNumberBuiltins() {
+    interp.Builtins["abs"] = NewBuiltinFunction("abs", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 1 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("abs() takes exactly one argument (%v given)", len(args)))
+        }
+        switch n := args[0].(type) {
+            case *ComplexObject:
+                return n.Abs(), nil
+            case *IntObject:
+                if n.Sign() < 0 {
+                    return n.Neg()
+                }
+                return n, nil
+            case *FloatObject:
+                if n.Value < 0 {
+                    return n.Neg()
+                }
+                return n, nil
+        }
+        return nil, Raise(TypeErrorClass, fmt.Sprintf("bad operand type for abs(): '%v'", args[0].AsString()))
+    })
+    
+    interp.Builtins["pow"] = powBuiltin
+    
+    interp.Builtins["divmod"] = NewBuiltinFunction("divmod", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 2 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("divmod() takes exactly 2 arguments (%v given)", len(args)))
+        }
+        return m.divmod(args[0], args[1])
+    })
+}
@@ -0,0 +1,125 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the pool that the code objects of a module share.
+   The pool interns the strings the code uses as names, so a name used by
+   many functions is only kept once, and the literal constants, so that the
+   same literal is only kept once however many times it appears.  Each code
+   object still refers to its constants by their index in its own table,
+   which is what the immediates of its CONST instructions hold, but the
+   entries of the tables are the objects in the pool.  A saved module writes
+   the strings and the constants once, and the tables of its code objects as
+   indices into them.
+*/
+
+package python
+
+import (
+        "fmt"
+        "math"
+)
+
+// The strings and the constants of a module, each kept once.
+type constantPool struct {
+    Strings     []string
+    Objects     []Object
+    
+    strings     map[string]int
+    objects     map[string]int
+}
+
+func newConstantPool() (*constantPool) {
+    p := new (constantPool)
+    p.strings = make(map[string]int)
+    p.objects = make(map[string]int)
+    return p
+}
+
+// Returns the key under which a literal is kept in a pool, and false if o isn't a
+// literal.  Ints and floats that are equal have different keys, as do 0.0 and -0.0.
+func constantKey(o Object) (string, bool) {
+    switch c := o.(type) {
+        case *IntObject:
+            if c.IsBool() {
+                return "b" + c.String(), true
+            }
+            return "i" + c.String(), true
+        case *FloatObject:
+            return fmt.Sprintf("f%x", math.Float64bits(c.Value)), true
+        case *ComplexObject:
+            return fmt.Sprintf("c%x:%x", math.Float64bits(real(c.Value)), math.Float64bits(imag(c.Value))), true
+        case *StringObject:
+            return "s" + c.Value, true
+        case *NoneObject:
+            return "n", true
+        case *TupleObject:
+            key := fmt.Sprintf("t%v", len(c.Items))
+            for _, item := range c.Items {
+                k, ok := constantKey(item)
+                if !ok {
+                    return "", false
+                }
+                key += fmt.Sprintf(":%v:%v", len(k), k)
+            }
+            return key, true
+    }
+    return "", false
+}
+
+// Returns the index of s in the pool, adding it if it isn't there yet.
+func (p *constantPool) stringIndex(s string) (int) {
+    i, present := p.strings[s]
+    if !present {
+        i = len(p.Strings)
+        p.strings[s] = i
+        p.Strings = append(p.Strings, s)
+    }
+    return i
+}
+
+// Returns the index of o in the pool.  A literal equal to one already in the pool gets
+// the index of that one, and anything else is added.
+func (p *constantPool) objectIndex(o Object) (int) {
+    key, ok := constantKey(o)
+    if ok {
+        if i, present := p.objects[key]; present {
+            return i
+        }
+        p.objects[key] = len(p.Objects)
+    }
+    p.Objects = append(p.Objects, o)
+    return len(p.Objects) - 1
+}
+
+func (mod *ModuleCode) constantPool() (*constantPool) {
+    if mod.pool == nil {
+        mod.pool = newConstantPool()
+    }
+    return mod.pool
+}
+
+// Returns the copy of s kept by the module.
+func (mod *ModuleCode) InternString(s string) (string) {
+    p := mod.constantPool()
+    return p.Strings[p.stringIndex(s)]
+}
+
+// Returns the constant kept by the module that is equal to o, which is o itself if o
+// isn't a literal or the module doesn't have one equal to it yet.
+func (mod *ModuleCode) InternConstant(o Object) (Object) {
+    p := mod.constantPool()
+    return p.Objects[p.objectIndex(o)]
+}
@@ -0,0 +1,429 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the conversion of Go values to Python objects and
+   back, which is how Go code gives values to Python code and gets them
+   out of it, and how Go functions are called from Python code.  FromGo
+   makes the object for a Go value, ToGo sets a Go variable of any type
+   from an object, and ToInt64, ToFloat64, ToString, ToSlice and ToMap give
+   the Go values of the common kinds.  Values are converted by their kind:
+
+     - Go integers are Python ints, and an int that doesn't fit the Go
+       integer is an OverflowError.
+     - Go floats and complex numbers are Python floats and complex numbers.
+       An int converts to a Go float too.
+     - Go bools are Python ints, as bools are here, and any object converts
+       to a Go bool by its truth.
+     - Go strings are Python strings.
+     - Go slices and arrays are lists, and anything that can be iterated
+       over converts to a Go slice.
+     - Go maps are dicts.
+     - Go structs are dicts of their exported fields, by name, or by the
+       name a python:"name" tag gives, and a field tagged python:"-" is
+       left out.  A dict, or an instance with the fields as attributes,
+       converts to a Go struct, and the fields it doesn't have are zero.
+     - Go functions are Go function objects, as gofunc_builtin.go describes.
+     - A nil pointer or interface is None, and any other pointer is what it
+       points to.
+     - An object converts to a Go interface it implements, such as Object,
+       as itself, and to an empty interface as the Go value of its kind.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "math"
+        "os"
+        "reflect"
+)
+
+var (
+    objectType  = reflect.TypeOf((*Object)(nil)).Elem()
+    errorType   = reflect.TypeOf((*os.Error)(nil)).Elem()
+    anyType     = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// Returns the object for the Go value v.  It panics if v has no object, such as a
+// channel, as NewGoFunc does with something that isn't a function.
+func FromGo(v interface{}) (Object) {
+    o, err := fromGo(reflect.ValueOf(v))
+    if err != nil {
+        panic("python: FromGo: " + err.String())
+    }
+    return o
+}
+
+// Sets the Go variable ptr points to from the object o, which gives a TypeError if o
+// doesn't convert to the type of the variable, and an OverflowError if it is an int
+// that doesn't fit.  It panics if ptr isn't a pointer.
+func ToGo(o Object, ptr interface{}) (os.Error) {
+    p := reflect.ValueOf(ptr)
+    if p.Kind() != reflect.Ptr || p.IsNil() {
+        panic(fmt.Sprintf("python: ToGo into %T, which isn't a pointer", ptr))
+    }
+    
+    v, err := toGo(o, p.Type().Elem())
+    if err != nil {
+        return err
+    }
+    p.Elem().Set(v)
+    return nil
+}
+
+func ToInt64(o Object) (int64, os.Error) {
+    var i int64
+    err := ToGo(o, &i)
+    return i, err
+}
+
+func ToFloat64(o Object) (float64, os.Error) {
+    var f float64
+    err := ToGo(o, &f)
+    return f, err
+}
+
+func ToString(o Object) (string, os.Error) {
+    var s string
+    err := ToGo(o, &s)
+    return s, err
+}
+
+// Returns the items of o, which can be anything that can be iterated over, as the Go
+// values an empty interface gives.
+func ToSlice(o Object) ([]interface{}, os.Error) {
+    var items []interface{}
+    err := ToGo(o, &items)
+    return items, err
+}
+
+// Returns the entries of the dict o, with the Go values an empty interface gives.
+func ToMap(o Object) (map[interface{}]interface{}, os.Error) {
+    var m map[interface{}]interface{}
+    err := ToGo(o, &m)
+    return m, err
+}
+
+// Returns the object for the Go value v, or a TypeError if it has none.
+func fromGo(v reflect.Value) (Object, os.Error) {
+    if !v.IsValid() {
+        return None, nil
+    }
+    
+    switch v.Kind() {
+        case reflect.Interface, reflect.Ptr:
+            if v.IsNil() {
+                return None, nil
+            }
+            if o, ok := v.Interface().(Object); ok {
+                return o, nil
+            }
+            return fromGo(v.Elem())
+        
+        case reflect.Func:
+            if v.IsNil() {
+                return None, nil
+            }
+            return NewGoFunc(v.Type().String(), v.Interface()), nil
+        
+        case reflect.Bool:
+            return pyBool(v.Bool()), nil
+        
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+            return NewInt(v.Int()), nil
+        
+        case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+            u := v.Uint()
+            if u <= math.MaxInt64 {
+                return NewInt(int64(u)), nil
+            }
+            x := big.NewInt(int64(u >> 1))
+            x.Lsh(x, 1)
+            return NewBigInt(x.Add(x, big.NewInt(int64(u & 1)))), nil
+        
+        case reflect.Float32, reflect.Float64:
+            return NewFloat(v.Float()), nil
+        
+        case reflect.Complex64, reflect.Complex128:
+            return NewComplex(v.Complex()), nil
+        
+        case reflect.String:
+            return NewString(v.String()), nil
+        
+        case reflect.Slice, reflect.Array:
+            items := make([]Object, v.Len())
+            for i := range items {
+                item, err := fromGo(v.Index(i))
+                if err != nil {
+                    return nil, err
+                }
+                items[i] = item
+            }
+            return NewList(items), nil
+        
+        case reflect.Map:
+            d := NewDict()
+            for _, k := range v.MapKeys() {
+                key, err := fromGo(k)
+                if err != nil {
+                    return nil, err
+                }
+                value, err := fromGo(v.MapIndex(k))
+                if err != nil {
+                    return nil, err
+                }
+                if err = d.Set(key, value); err != nil {
+                    return nil, err
+                }
+            }
+            return d, nil
+        
+        case reflect.Struct:
+            d := NewDict()
+            t := v.Type()
+            for i := 0; i < t.NumField(); i++ {
+                name := fieldName(t.Field(i))
+                if name == "" {
+                    continue
+                }
+                value, err := fromGo(v.Field(i))
+                if err != nil {
+                    return nil, err
+                }
+                d.Set(NewString(name), value)
+            }
+            return d, nil
+    }
+    return nil, Raise(TypeErrorClass, fmt.Sprintf("can't convert Go %v to a Python object", v.Type()))
+}
+
+// Returns the Go value of the type t for the object o.
+func toGo(o Object, t reflect.Type) (reflect.Value, os.Error) {
+    if t.Kind() == reflect.Interface && t != anyType {
+        if !reflect.TypeOf(o).Implements(t) {
+            return reflect.Value{}, noConversion(o, t)
+        }
+        return reflect.ValueOf(o), nil
+    }
+    
+    v := reflect.New(t).Elem()
+    switch t.Kind() {
+        case reflect.Interface:
+            if o == None {
+                return v, nil
+            }
+            if i, ok := o.(*IntObject); ok && !i.IsSmall() {
+                v.Set(reflect.ValueOf(i.AsInt()))
+                break
+            }
+            natural, err := toGo(o, naturalType(o))
+            if err != nil {
+                return v, err
+            }
+            v.Set(natural)
+        
+        case reflect.Bool:
+            v.SetBool(o.IsTrue())
+        
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+            i, ok := o.(*IntObject)
+            if !ok {
+                return v, noConversion(o, t)
+            }
+            if !i.IsSmall() || v.OverflowInt(i.Small) {
+                return v, Raise(OverflowErrorClass, fmt.Sprintf("Python int too large to convert to Go %v", t))
+            }
+            v.SetInt(i.Small)
+        
+        case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+            i, ok := o.(*IntObject)
+            if !ok {
+                return v, noConversion(o, t)
+            }
+            if i.Sign() < 0 {
+                return v, Raise(OverflowErrorClass, fmt.Sprintf("can't convert negative int to Go %v", t))
+            }
+            if !i.IsSmall() || v.OverflowUint(uint64(i.Small)) {
+                return v, Raise(OverflowErrorClass, fmt.Sprintf("Python int too large to convert to Go %v", t))
+            }
+            v.SetUint(uint64(i.Small))
+        
+        case reflect.Float32, reflect.Float64:
+            switch o.(type) {
+                case *IntObject, *FloatObject:
+                    v.SetFloat(o.AsFloat())
+                default:
+                    return v, noConversion(o, t)
+            }
+        
+        case reflect.Complex64, reflect.Complex128:
+            c, ok := asComplex(o)
+            if !ok {
+                return v, noConversion(o, t)
+            }
+            v.SetComplex(c)
+        
+        case reflect.String:
+            s, ok := o.(*StringObject)
+            if !ok {
+                return v, noConversion(o, t)
+            }
+            v.SetString(s.Value)
+        
+        case reflect.Slice:
+            items, ok := goItems(o)
+            if !ok {
+                return v, noConversion(o, t)
+            }
+            v.Set(reflect.MakeSlice(t, len(items), len(items)))
+            for i, item := range items {
+                elem, err := toGo(item, t.Elem())
+                if err != nil {
+                    return v, err
+                }
+                v.Index(i).Set(elem)
+            }
+        
+        case reflect.Map:
+            d, ok := o.(*DictObject)
+            if !ok {
+                return v, noConversion(o, t)
+            }
+            v.Set(reflect.MakeMap(t))
+            for i, key := range d.Keys {
+                k, err := toGo(key, t.Key())
+                if err != nil {
+                    return v, err
+                }
+                value, err := toGo(d.Values[i], t.Elem())
+                if err != nil {
+                    return v, err
+                }
+                v.SetMapIndex(k, value)
+            }
+        
+        case reflect.Struct:
+            switch o.(type) {
+                case *DictObject, *InstanceObject:
+                default:
+                    return v, noConversion(o, t)
+            }
+            for i := 0; i < t.NumField(); i++ {
+                name := fieldName(t.Field(i))
+                if name == "" {
+                    continue
+                }
+                value, present := structField(o, name)
+                if !present {
+                    continue
+                }
+                field, err := toGo(value, t.Field(i).Type)
+                if err != nil {
+                    return v, err
+                }
+                v.Field(i).Set(field)
+            }
+        
+        case reflect.Ptr:
+            if o == None {
+                return v, nil
+            }
+            elem, err := toGo(o, t.Elem())
+            if err != nil {
+                return v, err
+            }
+            v.Set(reflect.New(t.Elem()))
+            v.Elem().Set(elem)
+        
+        default:
+            return v, noConversion(o, t)
+    }
+    return v, nil
+}
+
+// Returns the type of the Go value o converts to as an empty interface, other than a
+// big int, which is a *big.Int.  Objects with no Go value of their own are themselves.
+func naturalType(o Object) (reflect.Type) {
+    switch v := o.(type) {
+        case *IntObject:
+            if v.IsBool() {
+                return reflect.TypeOf(false)
+            }
+            return reflect.TypeOf(int64(0))
+        case *FloatObject:
+            return reflect.TypeOf(float64(0))
+        case *ComplexObject:
+            return reflect.TypeOf(complex128(0))
+        case *StringObject:
+            return reflect.TypeOf("")
+        case *ListObject, *TupleObject:
+            return reflect.TypeOf([]interface{}(nil))
+        case *DictObject:
+            return reflect.TypeOf(map[interface{}]interface{}(nil))
+    }
+    return objectType
+}
+
+// Returns the name of the field f of a struct in Python, which is "" if it is left out
+// because it is unexported or tagged python:"-".
+func fieldName(f reflect.StructField) (string) {
+    if f.PkgPath != "" {
+        return ""
+    }
+    switch tag := f.Tag.Get("python"); tag {
+        case "-":
+            return ""
+        case "":
+            return f.Name
+        default:
+            return tag
+    }
+    return ""
+}
+
+// Returns the value of the field name of a struct in the dict or instance o.
+func structField(o Object, name string) (Object, bool) {
+    if d, ok := o.(*DictObject); ok {
+        return d.Get(NewString(name))
+    }
+    return o.GetAttr(name)
+}
+
+// Returns the items of o if it can be iterated over.
+func goItems(o Object) ([]Object, bool) {
+    switch s := o.(type) {
+        case *ListObject:
+            return s.Items, true
+        case *TupleObject:
+            return s.Items, true
+        case Iterable:
+            var items []Object
+            it := s.Iter()
+            for {
+                item, ok := it.Next()
+                if !ok {
+                    return items, true
+                }
+                items = append(items, item)
+            }
+    }
+    return nil, false
+}
+
+func noConversion(o Object, t reflect.Type) (os.Error) {
+    return Raise(TypeErrorClass, fmt.Sprintf("can't convert '%v' to Go %v", typeName(o), t))
+}
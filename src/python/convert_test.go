@@ -0,0 +1,160 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the conversion of Go values to objects and back.
+
+*/
+
+package python
+
+import (
+        "fmt"
+        "math"
+        "strings"
+        "testing"
+)
+
+type person struct {
+    Name    string
+    Age     int     `python:"age"`
+    Friend  *person
+    Skipped int     `python:"-"`
+    secret  int
+}
+
+func TestFromGo(t *testing.T) {
+    var none *person
+    list := NewList(nil)
+    
+    tests := []struct {
+        value   interface{}
+        repr    string
+    }{
+        {nil, "None"},
+        {none, "None"},
+        {int8(-3), "-3"},
+        {uint64(math.MaxUint64), "18446744073709551615"},
+        {true, "True"},
+        {1.5, "1.5"},
+        {complex(0, 2), "2j"},
+        {"a", "'a'"},
+        {[]int{1, 2}, "[1, 2]"},
+        {[2]string{"a", "b"}, "['a', 'b']"},
+        {map[string][]int{"a": {1}}, "{'a': [1]}"},
+        {person{Name: "Ann", Age: 30, Skipped: 1, secret: 2}, "{'Name': 'Ann', 'age': 30, 'Friend': None}"},
+        {&person{Name: "Bo", Friend: &person{Name: "Cy"}}, "{'Name': 'Bo', 'age': 0, 'Friend': {'Name': 'Cy', 'age': 0, 'Friend': None}}"},
+        {list, "[]"},
+    }
+    for i, test := range tests {
+        if o := FromGo(test.value); o.Repr() != test.repr {
+            t.Errorf("value %v: expected %v, got %v", i, test.repr, o.Repr())
+        }
+    }
+    
+    if FromGo(list) != Object(list) {
+        t.Errorf("an object should convert to itself")
+    }
+    double := FromGo(func(x int) int { return 2 * x })
+    if result, err := new (Machine).CallObject(double, []Object{intObject(4)}); err != nil || result.Repr() != "8" {
+        t.Errorf("expected the Go function to give 8, got %v, %v", result, err)
+    }
+    
+    defer func() {
+        if recover() == nil {
+            t.Errorf("FromGo of a channel should panic")
+        }
+    }()
+    FromGo(make(chan int))
+}
+
+func TestToGo(t *testing.T) {
+    huge, _ := intObject(1 << 62).Mul(intObject(4))
+    
+    if i, err := ToInt64(intObject(-7)); err != nil || i != -7 {
+        t.Errorf("expected -7, got %v, %v", i, err)
+    }
+    if _, err := ToInt64(huge); err == nil || !strings.HasPrefix(err.String(), "OverflowError") {
+        t.Errorf("expected an OverflowError for 2**64, got %v", err)
+    }
+    if _, err := ToInt64(NewString("1")); err == nil || !strings.HasPrefix(err.String(), "TypeError") {
+        t.Errorf("expected a TypeError for a string, got %v", err)
+    }
+    if f, err := ToFloat64(intObject(2)); err != nil || f != 2 {
+        t.Errorf("expected 2.0, got %v, %v", f, err)
+    }
+    if s, err := ToString(NewString("héllo")); err != nil || s != "héllo" {
+        t.Errorf("expected héllo, got %v, %v", s, err)
+    }
+    
+    r, _ := NewRange(0, 3, 1)
+    items, err := ToSlice(r)
+    if err != nil || fmt.Sprint(items) != "[0 1 2]" {
+        t.Errorf("expected [0 1 2], got %v, %v", items, err)
+    }
+    if _, ok := items[0].(int64); !ok {
+        t.Errorf("ints should be int64 in an empty interface, got %T", items[0])
+    }
+    
+    d := NewDict()
+    d.Set(NewString("a"), NewList([]Object{floatObject(0.5), None}))
+    m, err := ToMap(d)
+    if err != nil || fmt.Sprint(m) != "map[a:[0.5 <nil>]]" {
+        t.Errorf("expected map[a:[0.5 <nil>]], got %v, %v", m, err)
+    }
+    if _, err := ToMap(NewList(nil)); err == nil {
+        t.Errorf("a list shouldn't convert to a map")
+    }
+    
+    // A struct is set from a dict, or from the attributes of an instance, and the fields
+    // they don't have are left zero.
+    friend := NewInstance(ObjectClass)
+    friend.SetAttr("Name", NewString("Cy"))
+    d = NewDict()
+    d.Set(NewString("Name"), NewString("Bo"))
+    d.Set(NewString("age"), intObject(41))
+    d.Set(NewString("Skipped"), intObject(1))
+    d.Set(NewString("Friend"), friend)
+    var p person
+    if err := ToGo(d, &p); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if p.Name != "Bo" || p.Age != 41 || p.Skipped != 0 || p.Friend == nil || p.Friend.Name != "Cy" || p.Friend.Friend != nil {
+        t.Errorf("expected Bo, 41, with the friend Cy, got %+v", p)
+    }
+    d.Set(NewString("age"), NewString("old"))
+    if err := ToGo(d, &p); err == nil || !strings.HasPrefix(err.String(), "TypeError") {
+        t.Errorf("expected a TypeError for a string age, got %v", err)
+    }
+    if err := ToGo(intObject(1), &p); err == nil {
+        t.Errorf("an int shouldn't convert to a struct")
+    }
+    
+    // Values come back from Go as they went in.
+    var o Object
+    if err := ToGo(friend, &o); err != nil || o != Object(friend) {
+        t.Errorf("an object should convert to Object as itself, got %v, %v", o, err)
+    }
+    if back := FromGo(p.Friend); back.Repr() != "{'Name': 'Cy', 'age': 0, 'Friend': None}" {
+        t.Errorf("expected the friend back as a dict, got %v", back.Repr())
+    }
+    
+    defer func() {
+        if recover() == nil {
+            t.Errorf("ToGo into something that isn't a pointer should panic")
+        }
+    }()
+    ToGo(intObject(1), 0)
+}
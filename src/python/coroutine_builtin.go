@@ -0,0 +1,155 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the coroutine built-in object
+   type.  Calling an async function makes a coroutine, which keeps the frame
+   of the function like a generator does.  The coroutine is suspended while
+   an AWAIT in it waits for a future, and an event loop resumes it once the
+   future is done.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+type CoroutineObject struct {
+    ObjectData
+    suspendedFrame
+}
+
+func NewCoroutine(f Frame) (*CoroutineObject) {
+    c := new(CoroutineObject)
+    c.ObjectData.Init()
+    c.kind = "coroutine"
+    c.frame = f
+    
+    return c
+}
+
+// Runs the coroutine until it waits, and returns the future it waits for.  It fails
+// with StopIteration once it has returned, and Value is what it returned.
+func (o *CoroutineObject) Send(value Object) (Object, os.Error) {
+    return o.resume(nil, value)
+}
+
+// A coroutine can't be converted to a number
+func (o *CoroutineObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *CoroutineObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert coroutine to string
+func (o *CoroutineObject) AsString() (string) {
+    return fmt.Sprintf("<coroutine object %v>", o.frame.Code.Name)
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A coroutine is only equal to itself, and coroutines are not ordered.
+func (o *CoroutineObject) Eq(r Object) (Object) {
+    c, ok := r.(*CoroutineObject)
+    return pyBool(ok && c == o)
+}
+
+func (o *CoroutineObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *CoroutineObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *CoroutineObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *CoroutineObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *CoroutineObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *CoroutineObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *CoroutineObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *CoroutineObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *CoroutineObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *CoroutineObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *CoroutineObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *CoroutineObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *CoroutineObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *CoroutineObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *CoroutineObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A coroutine is always true
+func (o *CoroutineObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *CoroutineObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *CoroutineObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *CoroutineObject) AsBool() (bool) {
+    return o.IsTrue()
+}
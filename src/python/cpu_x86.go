@@ -0,0 +1,122 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module finds out which instruction set extensions the processor the
+   interpreter runs on has, with the CPUID instruction, so that the code
+   generator only uses the ones that are there.  Every x86-64 processor has
+   SSE2, but a 32-bit x86 may not, and then raw floats aren't kept in xmm
+   registers at all: they stay boxed, and the arithmetic on them is left to the
+   helpers, rather than done with the x87.
+
+   AVX needs the operating system to save the upper halves of the ymm
+   registers too, which XGETBV reports, so it is only reported when both the
+   processor and the operating system support it.
+*/
+
+package python
+
+import "runtime"
+
+// The instruction set extensions of an x86 processor.
+type X86Features struct {
+    SSE2    bool
+    SSE3    bool
+    SSSE3   bool
+    SSE41   bool
+    SSE42   bool
+    POPCNT  bool
+    AVX     bool
+    AVX2    bool
+    FMA     bool
+    BMI2    bool
+}
+
+// The features every x86-64 processor has.
+var X86_64Baseline = &X86Features{SSE2: true}
+
+// The bits of the CPUID leaves, and of XCR0, that the features are read from.
+const (
+    cpuid1_EDX_SSE2     = 1 << 26
+    cpuid1_ECX_SSE3     = 1 << 0
+    cpuid1_ECX_SSSE3    = 1 << 9
+    cpuid1_ECX_FMA      = 1 << 12
+    cpuid1_ECX_SSE41    = 1 << 19
+    cpuid1_ECX_SSE42    = 1 << 20
+    cpuid1_ECX_POPCNT   = 1 << 23
+    cpuid1_ECX_OSXSAVE  = 1 << 27
+    cpuid1_ECX_AVX      = 1 << 28
+    cpuid7_EBX_AVX2     = 1 << 5
+    cpuid7_EBX_BMI2     = 1 << 8
+
+    // The xmm and ymm state, which the operating system must save for AVX.
+    xcr0_AVX_STATE      = 6
+)
+
+// Reads the features of a processor with cpuid, which runs the CPUID instruction for a
+// leaf and subleaf, and xgetbv, which reads XCR0.
+func x86FeaturesFrom(cpuid func(leaf, sub uint32) (eax, ebx, ecx, edx uint32), xgetbv func() (eax, edx uint32)) *X86Features {
+    f := new(X86Features)
+    max, _, _, _ := cpuid(0, 0)
+    if max < 1 {
+        return f
+    }
+
+    _, _, ecx, edx := cpuid(1, 0)
+    f.SSE2 = edx & cpuid1_EDX_SSE2 != 0
+    f.SSE3 = ecx & cpuid1_ECX_SSE3 != 0
+    f.SSSE3 = ecx & cpuid1_ECX_SSSE3 != 0
+    f.SSE41 = ecx & cpuid1_ECX_SSE41 != 0
+    f.SSE42 = ecx & cpuid1_ECX_SSE42 != 0
+    f.POPCNT = ecx & cpuid1_ECX_POPCNT != 0
+
+    if ecx & cpuid1_ECX_OSXSAVE != 0 {
+        xcr0, _ := xgetbv()
+        f.AVX = ecx & cpuid1_ECX_AVX != 0 && xcr0 & xcr0_AVX_STATE == xcr0_AVX_STATE
+    }
+    f.FMA = f.AVX && ecx & cpuid1_ECX_FMA != 0
+
+    if max >= 7 {
+        _, ebx, _, _ := cpuid(7, 0)
+        f.AVX2 = f.AVX && ebx & cpuid7_EBX_AVX2 != 0
+        f.BMI2 = ebx & cpuid7_EBX_BMI2 != 0
+    }
+    return f
+}
+
+// Returns a copy of the target whose code only uses the features f.
+func (t *X86Target) WithFeatures(f *X86Features) *X86Target {
+    c := *t
+    c.Features = f
+    return &c
+}
+
+// Returns true if the code may use the SSE2 instructions.  A target without features
+// assumes it can, like every x86-64.
+func (t *X86Target) HasSSE2() bool {
+    return t.Features == nil || t.Features.SSE2
+}
+
+// Returns the target for the machine the interpreter runs on, with its calling convention
+// on x86-64 and the features of its processor, or nil if it isn't an x86.
+func HostX86Target() *X86Target {
+    switch runtime.GOARCH {
+        case "386":
+            return X86_32.WithFeatures(HostX86Features())
+        case "amd64":
+            return X86_64.WithConvention(ConventionFor(runtime.GOOS)).WithFeatures(HostX86Features())
+    }
+    return nil
+}
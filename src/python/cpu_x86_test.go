@@ -0,0 +1,102 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the x86 feature detection.
+
+*/
+
+package python
+
+import (
+        "bytes"
+        "runtime"
+        "testing"
+)
+
+// Returns a CPUID that reports the registers of each leaf in leaves.
+func fakeCpuid(leaves map[uint32][4]uint32) func(leaf, sub uint32) (uint32, uint32, uint32, uint32) {
+    return func(leaf, sub uint32) (uint32, uint32, uint32, uint32) {
+        r := leaves[leaf]
+        return r[0], r[1], r[2], r[3]
+    }
+}
+
+func TestX86Features(t *testing.T) {
+    xgetbv := func() (uint32, uint32) { return 7, 0 }
+
+    // A processor with AVX2, whose operating system saves the ymm registers.
+    f := x86FeaturesFrom(fakeCpuid(map[uint32][4]uint32{
+        0: {7, 0, 0, 0},
+        1: {0, 0, cpuid1_ECX_SSE3 | cpuid1_ECX_SSE42 | cpuid1_ECX_OSXSAVE | cpuid1_ECX_AVX, cpuid1_EDX_SSE2},
+        7: {0, cpuid7_EBX_AVX2 | cpuid7_EBX_BMI2, 0, 0},
+    }), xgetbv)
+    if !f.SSE2 || !f.SSE3 || f.SSSE3 || !f.SSE42 || !f.AVX || !f.AVX2 || !f.BMI2 {
+        t.Errorf("expected SSE2, SSE3, SSE4.2, AVX, AVX2 and BMI2, got %+v", *f)
+    }
+
+    // The same processor, but the operating system doesn't save the ymm registers.
+    f = x86FeaturesFrom(fakeCpuid(map[uint32][4]uint32{
+        0: {7, 0, 0, 0},
+        1: {0, 0, cpuid1_ECX_AVX, cpuid1_EDX_SSE2},
+        7: {0, cpuid7_EBX_AVX2, 0, 0},
+    }), xgetbv)
+    if !f.SSE2 || f.AVX || f.AVX2 {
+        t.Errorf("expected SSE2 without AVX, got %+v", *f)
+    }
+
+    // A processor too old for leaf 1.
+    f = x86FeaturesFrom(fakeCpuid(map[uint32][4]uint32{}), xgetbv)
+    if f.SSE2 {
+        t.Errorf("expected no features, got %+v", *f)
+    }
+}
+
+func TestHostX86Features(t *testing.T) {
+    f := HostX86Features()
+    switch runtime.GOARCH {
+        case "amd64":
+            if f == nil || !f.SSE2 {
+                t.Errorf("expected an x86-64 to have SSE2, got %+v", f)
+            }
+        case "386":
+        default:
+            if f != nil || HostX86Target() != nil {
+                t.Errorf("expected no x86 features on %v", runtime.GOARCH)
+            }
+    }
+}
+
+func TestGenerateX86WithoutSSE2(t *testing.T) {
+    build := func() *SsaContext {
+        ctx := new (SsaContext)
+        ctx.Init()
+        ctx.Store("x", ctx.Eval(SSA_ADD, ctx.LoadFloat(1.5), ctx.LoadFloat(2.5)))
+        ctx.Return(-1)
+        return ctx
+    }
+    addsd := []byte{0xf2, 0x0f, 0x58}
+
+    if code := generateX86(t, build(), X86_32); !bytes.Contains(code, addsd) {
+        t.Errorf("expected an inline add with SSE2, got % x", code)
+    }
+    code := generateX86(t, build(), X86_32.WithFeatures(&X86Features{}))
+    if bytes.Contains(code, addsd) || bytes.Contains(code, []byte{0x0f, 0x10}) {
+        t.Errorf("expected no SSE2 instructions, got % x", code)
+    }
+    if !bytes.Contains(code, []byte{0xff, 0x56, 4 * X86_HELPER_BINARY}) {
+        t.Errorf("expected the floats to be added by a helper, got % x", code)
+    }
+}
@@ -0,0 +1,38 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file is only built on 386 and amd64, whose CPUID and XGETBV are in
+   cpuid_386.s and cpuid_amd64.s.
+*/
+
+package python
+
+// Runs CPUID for the leaf and subleaf.
+func cpuid(leaf, sub uint32) (eax, ebx, ecx, edx uint32)
+
+// Reads XCR0, which is only there if CPUID says the operating system uses XSAVE.
+func xgetbv() (eax, edx uint32)
+
+// The features of the processor, read once.
+var hostX86Features *X86Features
+
+// Returns the features of the processor the interpreter runs on.
+func HostX86Features() *X86Features {
+    if hostX86Features == nil {
+        hostX86Features = x86FeaturesFrom(cpuid, xgetbv)
+    }
+    return hostX86Features
+}
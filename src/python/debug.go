@@ -0,0 +1,163 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements breakpoints and watchpoints, which are the core of
+   an interactive debugger.  A breakpoint stops the machine before it runs
+   the instruction at an address in a code object, and a watchpoint stops it
+   after a local or a global with a name is bound.  Either way the break
+   handler is called with the frame, and decides whether the machine carries
+   on or pauses.  A machine that pauses returns Paused from Run, with all of
+   its state kept, and running it again carries on where it paused, without
+   stopping at the same breakpoint again straight away.
+
+   Breakpoints and watchpoints only apply to the frames of the machine, and
+   not to the generators and coroutines it resumes, which run on machines of
+   their own.
+*/
+
+package python
+
+import (
+    "os"
+)
+
+// Returned by Run when the break handler pauses the machine.
+var Paused = os.NewError("paused by the debugger")
+
+// The kinds of break event.
+const (
+    BreakPoint = iota
+    BreakWatch
+)
+
+// An event passed to the break handler.  Frame is the frame the machine stopped in, and
+// is only valid until the handler returns.  Instruction is the address of the
+// instruction about to run at a breakpoint, or of the instruction that bound the name
+// of a watchpoint, and Line is its source line.  A watch event has the name that was
+// bound, with the value it had before, which is nil if it had none, and its new value.
+type BreakEvent struct {
+    Kind        int
+    Frame       *Frame
+    Instruction uint32
+    Line        int
+    Name        string
+    Old, Value  Object
+}
+
+type debugger struct {
+    breakpoints map[*CodeObject]map[uint32]bool
+    watches     map[string]bool
+    handler     func(event BreakEvent) (bool)
+    
+    // Set when a watch event pauses the machine, and when a breakpoint does, so the
+    // machine doesn't stop at the same breakpoint as soon as it is run again.
+    pause       bool
+    resumed     bool
+}
+
+func (m *Machine) debugger() (*debugger) {
+    if m.debug == nil {
+        m.debug = &debugger{breakpoints: make(map[*CodeObject]map[uint32]bool), watches: make(map[string]bool)}
+    }
+    return m.debug
+}
+
+// Sets the function called when the machine stops at a breakpoint or a watchpoint.  The
+// machine carries on if it returns true, and pauses if it returns false.  Without a
+// handler, the machine always pauses.
+func (m *Machine) SetBreakHandler(fn func(event BreakEvent) (bool)) {
+    m.debugger().handler = fn
+}
+
+// Stops the machine before it runs the instruction at address in c.
+func (m *Machine) SetBreakpoint(c *CodeObject, address uint32) {
+    d := m.debugger()
+    if d.breakpoints[c] == nil {
+        d.breakpoints[c] = make(map[uint32]bool)
+    }
+    d.breakpoints[c][address] = true
+}
+
+func (m *Machine) ClearBreakpoint(c *CodeObject, address uint32) {
+    if m.debug == nil {
+        return
+    }
+    if addresses := m.debug.breakpoints[c]; addresses != nil {
+        addresses[address] = false, false
+    }
+}
+
+// Stops the machine after it binds a local or a global called name.
+func (m *Machine) Watch(name string) {
+    m.debugger().watches[name] = true
+}
+
+func (m *Machine) Unwatch(name string) {
+    if m.debug != nil {
+        m.debug.watches[name] = false, false
+    }
+}
+
+// Calls the handler with the event, and returns whether the machine should pause.
+func (d *debugger) stop(event BreakEvent) (bool) {
+    if d.handler == nil {
+        return true
+    }
+    return !d.handler(event)
+}
+
+// Returns true if the machine should pause at a breakpoint before the instruction at
+// NextInstruction.
+func (d *debugger) breakpoint(m *Machine) (bool) {
+    if d.resumed {
+        d.resumed = false
+        return false
+    }
+    
+    pc := m.NextInstruction
+    if !d.breakpoints[m.Code][pc] {
+        return false
+    }
+    if d.stop(BreakEvent{Kind: BreakPoint, Frame: &m.Frame, Instruction: pc, Line: m.Code.Line(pc)}) {
+        d.resumed = true
+        return true
+    }
+    return false
+}
+
+// Sends a watch event if the name with the index imm in the code of f is watched, once
+// it has been bound to value in place of old.
+func (d *debugger) bound(m *Machine, f *Frame, imm uint16, old, value Object) {
+    name := f.Code.Names[imm]
+    if !d.watches[name] {
+        return
+    }
+    
+    pc := m.NextInstruction-1
+    event := BreakEvent{BreakWatch, f, pc, f.Code.Line(pc), name, old, value}
+    if d.stop(event) {
+        d.pause = true
+    }
+}
+
+// Returns true, once, if a watch event has paused the machine.
+func (d *debugger) paused() (bool) {
+    if d.pause {
+        d.pause = false
+        return true
+    }
+    return false
+}
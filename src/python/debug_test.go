@@ -0,0 +1,107 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for breakpoints and watchpoints.
+
+*/
+
+package python
+
+import (
+        "testing"
+)
+
+func TestBreakpoint(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 3)
+    
+    // The loop starts with the comparison at address 4, which runs once more than the
+    // body does.
+    hits := 0
+    m := new (Machine)
+    m.SetBreakpoint(s, 4)
+    m.SetBreakHandler(func(e BreakEvent) (bool) {
+        if e.Kind != BreakPoint || e.Instruction != 4 || e.Frame.Code != s {
+            t.Errorf("unexpected event %+v", e)
+        }
+        hits++
+        return true
+    })
+    if result, err := m.Run(s); err != nil || result.AsString() != "6" || hits != 4 {
+        t.Errorf("expected 6 after 4 breaks, got %v, %v after %v", result, err, hits)
+    }
+    
+    // Without a handler, the machine pauses each time, and carries on when it is run again.
+    m = new (Machine)
+    m.SetBreakpoint(s, 4)
+    pauses := 0
+    result, err := m.Run(s)
+    for ; err == Paused; result, err = m.Run(s) {
+        if m.NextInstruction != 4 {
+            t.Errorf("expected the machine to pause at 4, not %v", m.NextInstruction)
+        }
+        pauses++
+    }
+    if err != nil || result.AsString() != "6" || pauses != 4 {
+        t.Errorf("expected 6 after 4 pauses, got %v, %v after %v", result, err, pauses)
+    }
+    
+    m.ClearBreakpoint(s, 4)
+    m.NextInstruction = 0
+    if _, err = m.Run(s); err != nil {
+        t.Errorf("a cleared breakpoint should not pause the machine, got %v", err)
+    }
+}
+
+func TestWatch(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    s.WriteConst(intObject(1), 1, false, 0)
+    s.WriteBind("x", 1, false, 0)
+    s.WriteBind("y", 1, false, 0)
+    s.WriteConst(intObject(2), 1, false, 0)
+    s.WriteBind("x", 1, false, 0)
+    s.WriteHalt(1, false, 0)
+    
+    var seen []string
+    m := new (Machine)
+    m.Watch("x")
+    m.SetBreakHandler(func(e BreakEvent) (bool) {
+        old := "nil"
+        if e.Old != nil {
+            old = e.Old.AsString()
+        }
+        seen = append(seen, e.Name + " " + old + " " + e.Value.AsString())
+        return len(seen) > 1
+    })
+    
+    if _, err := m.Run(s); err != Paused || m.Globals["x"].AsString() != "1" || m.NextInstruction != 2 {
+        t.Fatalf("expected the machine to pause after x was bound, got %v", err)
+    }
+    if result, err := m.Run(s); err != nil || result.AsString() != "2" {
+        t.Errorf("expected 2, got %v, %v", result, err)
+    }
+    if len(seen) != 2 || seen[0] != "x nil 1" || seen[1] != "x 1 2" {
+        t.Errorf("unexpected watch events %v", seen)
+    }
+    
+    m.Unwatch("x")
+    m.NextInstruction = 0
+    if _, err := m.Run(s); err != nil || len(seen) != 2 {
+        t.Errorf("x should not be watched any more, got %v", err)
+    }
+}
@@ -0,0 +1,121 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements deoptimization, which hands a compiled loop back to
+   the interpreter when an assumption the compiled code made fails, like an int
+   staying small enough for a machine register.  The compiled code takes a
+   side exit, which describes the interpreter's frame at the point where it
+   left: the instruction to carry on at, and the values of the registers and
+   the spill slots the interpreter needs.  The machine rebuilds the frame from
+   it, and carries on dispatching from there.
+
+   A compiled handler takes a side exit by returning it as its error.  A loop
+   whose compiled code keeps taking side exits is no better off compiled, so
+   once it has taken MaxSideExits of them, it is retired from the code cache,
+   and the loop is left to the interpreter for the signature it was compiled
+   for.
+*/
+
+package python
+
+import (
+    "fmt"
+    "os"
+)
+
+// The number of side exits a compiled loop takes before it is given up on.
+const MaxSideExits = 100
+
+// The kinds of value a side exit restores.  An object goes in a register, or in a spill
+// slot, and raw values go in the raw registers of their bank.
+const (
+    EXIT_OBJECT = iota
+    EXIT_INT
+    EXIT_FLOAT
+)
+
+// A value of the frame that a side exit restores.  Register is the register of the
+// value's bank, or the spill slot if Spill is set.  Only objects are spilled.
+type ExitValue struct {
+    Kind        int
+    Register    uint32
+    Spill       bool
+    
+    Object      Object
+    Int         int64
+    Float       float64
+}
+
+// The state the interpreter continues from after a side exit, which carries on at the
+// instruction PC of the frame the compiled code ran in.  Reason says which assumption
+// failed.
+type SideExit struct {
+    PC          uint32
+    Reason      string
+    Values      []ExitValue
+}
+
+func (e *SideExit) String() (string) {
+    return fmt.Sprintf("side exit to instruction %v: %v", e.PC, e.Reason)
+}
+
+// Checks that the frame f has somewhere to put each of the values of exit.
+func (f *Frame) checkExit(exit *SideExit) (os.Error) {
+    if int(exit.PC) >= len(f.Code.Decoded()) {
+        return os.NewError(fmt.Sprintf("side exit to instruction %v, which doesn't exist", exit.PC))
+    }
+    
+    for _, v := range exit.Values {
+        n := 0
+        switch {
+            case v.Kind == EXIT_OBJECT && v.Spill:
+                n = len(f.Spill)
+            case v.Kind == EXIT_OBJECT:
+                n = len(f.Register)
+            case v.Kind == EXIT_INT && !v.Spill:
+                n = len(f.Ints)
+            case v.Kind == EXIT_FLOAT && !v.Spill:
+                n = len(f.Floats)
+        }
+        if int(v.Register) >= n {
+            return os.NewError(fmt.Sprintf("side exit to instruction %v restores a value the frame has no room for", exit.PC))
+        }
+    }
+    return nil
+}
+
+// Rebuilds the frame f from the side exit, and continues at its instruction.  The frame
+// is left as it was if the exit doesn't fit it.
+func (m *Machine) deoptimize(f *Frame, exit *SideExit) (os.Error) {
+    if err := f.checkExit(exit); err != nil {
+        return err
+    }
+    
+    for _, v := range exit.Values {
+        switch {
+            case v.Kind == EXIT_OBJECT && v.Spill:
+                f.Spill[v.Register] = v.Object
+            case v.Kind == EXIT_OBJECT:
+                f.Register[v.Register] = v.Object
+            case v.Kind == EXIT_INT:
+                f.Ints[v.Register] = v.Int
+            case v.Kind == EXIT_FLOAT:
+                f.Floats[v.Register] = v.Float
+        }
+    }
+    m.NextInstruction = exit.PC
+    return nil
+}
@@ -0,0 +1,490 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of property, staticmethod and
+   classmethod, the built-in descriptors.  A property calls functions to get,
+   set and delete the attribute of an instance it describes.  A static method
+   gives its function as it is, and a class method binds its function to the
+   class, whether they are got from the class or from an instance of it.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+// A property.  Fget, Fset and Fdel are called to get, set and delete the attribute of
+// an instance it describes, and are None if the property doesn't have them.
+type PropertyObject struct {
+    ObjectData
+    Fget, Fset, Fdel, Doc Object
+}
+
+func NewProperty(fget, fset, fdel, doc Object) (*PropertyObject) {
+    p := new(PropertyObject)
+    p.ObjectData.Init()
+    p.Fget, p.Fset, p.Fdel, p.Doc = orNone(fget), orNone(fset), orNone(fdel), orNone(doc)
+    
+    return p
+}
+
+// Got from its class, a property gives itself.
+func (o *PropertyObject) Get(m *Machine, instance Object, owner *TypeObject) (Object, os.Error) {
+    if instance == nil {
+        return o, nil
+    }
+    if o.Fget == None {
+        return nil, Raise(AttributeErrorClass, "unreadable attribute")
+    }
+    return m.callNested(o.Fget, []Object{instance})
+}
+
+func (o *PropertyObject) Set(m *Machine, instance, value Object) (os.Error) {
+    if o.Fset == None {
+        return Raise(AttributeErrorClass, "can't set attribute")
+    }
+    _, err := m.callNested(o.Fset, []Object{instance, value})
+    return err
+}
+
+func (o *PropertyObject) Delete(m *Machine, instance Object) (os.Error) {
+    if o.Fdel == None {
+        return Raise(AttributeErrorClass, "can't delete attribute")
+    }
+    _, err := m.callNested(o.Fdel, []Object{instance})
+    return err
+}
+
+// The getter, setter and deleter methods of a property return a copy of it with
+// another function, which is how @x.setter gives the property x a setter.
+func (o *PropertyObject) GetAttr(name string) (value Object, present bool) {
+    switch name {
+        case "fget":
+            return o.Fget, true
+        case "fset":
+            return o.Fset, true
+        case "fdel":
+            return o.Fdel, true
+        case "__doc__":
+            return o.Doc, true
+        case "getter", "setter", "deleter":
+            return NewBuiltinFunction(name, func(m *Machine, args []Object) (Object, os.Error) {
+                if len(args) != 1 {
+                    return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() takes exactly one argument (%v given)", name, len(args)))
+                }
+                p := NewProperty(o.Fget, o.Fset, o.Fdel, o.Doc)
+                switch name {
+                    case "getter":
+                        p.Fget = args[0]
+                    case "setter":
+                        p.Fset = args[0]
+                    case "deleter":
+                        p.Fdel = args[0]
+                }
+                return p, nil
+            }), true
+    }
+    return o.ObjectData.GetAttr(name)
+}
+
+// A property can't be converted to a number
+func (o *PropertyObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *PropertyObject) AsFloat() (float64) {
+    return 0
+}
+
+func (o *PropertyObject) AsString() (string) {
+    return "<property object>"
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A property is only equal to itself, and properties are not ordered.
+func (o *PropertyObject) Eq(r Object) (Object) {
+    p, ok := r.(*PropertyObject)
+    return pyBool(ok && p == o)
+}
+
+func (o *PropertyObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *PropertyObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *PropertyObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *PropertyObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *PropertyObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *PropertyObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *PropertyObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *PropertyObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *PropertyObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *PropertyObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *PropertyObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *PropertyObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *PropertyObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *PropertyObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *PropertyObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *PropertyObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *PropertyObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *PropertyObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *PropertyObject) AsBool() (bool) {
+    return o.IsTrue()
+}
+
+// A static method, which gives its function as it is.
+type StaticMethodObject struct {
+    ObjectData
+    Fn Object
+}
+
+func NewStaticMethod(fn Object) (*StaticMethodObject) {
+    s := new(StaticMethodObject)
+    s.ObjectData.Init()
+    s.Fn = fn
+    
+    return s
+}
+
+func (o *StaticMethodObject) Get(m *Machine, instance Object, owner *TypeObject) (Object, os.Error) {
+    return o.Fn, nil
+}
+
+func (o *StaticMethodObject) GetAttr(name string) (value Object, present bool) {
+    if name == "__func__" {
+        return o.Fn, true
+    }
+    return o.ObjectData.GetAttr(name)
+}
+
+// A static method can't be converted to a number
+func (o *StaticMethodObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *StaticMethodObject) AsFloat() (float64) {
+    return 0
+}
+
+func (o *StaticMethodObject) AsString() (string) {
+    return fmt.Sprintf("<staticmethod(%v)>", o.Fn.Repr())
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A static method is only equal to itself, and static methods are not ordered.
+func (o *StaticMethodObject) Eq(r Object) (Object) {
+    p, ok := r.(*StaticMethodObject)
+    return pyBool(ok && p == o)
+}
+
+func (o *StaticMethodObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *StaticMethodObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *StaticMethodObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *StaticMethodObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *StaticMethodObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *StaticMethodObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *StaticMethodObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *StaticMethodObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *StaticMethodObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *StaticMethodObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *StaticMethodObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *StaticMethodObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *StaticMethodObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *StaticMethodObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *StaticMethodObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *StaticMethodObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *StaticMethodObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *StaticMethodObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *StaticMethodObject) AsBool() (bool) {
+    return o.IsTrue()
+}
+
+// A class method, which binds its function to the class it is got from, or to the
+// class of the instance it is got from.
+type ClassMethodObject struct {
+    ObjectData
+    Fn Object
+}
+
+func NewClassMethod(fn Object) (*ClassMethodObject) {
+    c := new(ClassMethodObject)
+    c.ObjectData.Init()
+    c.Fn = fn
+    
+    return c
+}
+
+func (o *ClassMethodObject) Get(m *Machine, instance Object, owner *TypeObject) (Object, os.Error) {
+    return NewBoundMethod(o.Fn, owner), nil
+}
+
+func (o *ClassMethodObject) GetAttr(name string) (value Object, present bool) {
+    if name == "__func__" {
+        return o.Fn, true
+    }
+    return o.ObjectData.GetAttr(name)
+}
+
+// A class method can't be converted to a number
+func (o *ClassMethodObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *ClassMethodObject) AsFloat() (float64) {
+    return 0
+}
+
+func (o *ClassMethodObject) AsString() (string) {
+    return fmt.Sprintf("<classmethod(%v)>", o.Fn.Repr())
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A class method is only equal to itself, and class methods are not ordered.
+func (o *ClassMethodObject) Eq(r Object) (Object) {
+    p, ok := r.(*ClassMethodObject)
+    return pyBool(ok && p == o)
+}
+
+func (o *ClassMethodObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *ClassMethodObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ClassMethodObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ClassMethodObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ClassMethodObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *ClassMethodObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ClassMethodObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ClassMethodObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ClassMethodObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ClassMethodObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ClassMethodObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ClassMethodObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *ClassMethodObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ClassMethodObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ClassMethodObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ClassMethodObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *ClassMethodObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *ClassMethodObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *ClassMethodObject) AsBool() (bool) {
+    return o.IsTrue()
+}
+
+// Adds property(), staticmethod() and classmethod() to the builtins of the interpreter.
+func (interp *Interpreter) addDescriptorBuiltins() {
+    interp.Builtins["property"] = NewBuiltinFunction("property", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) > 4 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("property expected at most 4 arguments, got %v", len(args)))
+        }
+        fns := make([]Object, 4)
+        copy(fns, args)
+        return NewProperty(fns[0], fns[1], fns[2], fns[3]), nil
+    })
+    
+    interp.Builtins["staticmethod"] = NewBuiltinFunction("staticmethod", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 1 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("staticmethod expected 1 argument, got %v", len(args)))
+        }
+        return NewStaticMethod(args[0]), nil
+    })
+    
+    interp.Builtins["classmethod"] = NewBuiltinFunction("classmethod", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 1 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("classmethod expected 1 argument, got %v", len(args)))
+        }
+        return NewClassMethod(args[0]), nil
+    })
+}
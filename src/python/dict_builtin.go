@@ -0,0 +1,261 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the dict built-in object
+   type.  The entries are kept in the order they were added, as in Python,
+   and an index from the hash of each key to the entries with that hash
+   finds a key by comparing it to those entries only.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+        "strings"
+)
+
+type DictObject struct {
+    ObjectData
+    Keys    []Object
+    Values  []Object
+    index   map[uint64][]int
+    
+    // The key the strings in the dict are hashed with, which is the default one if
+    // it is nil.  See hash.go.
+    key     *sipKey
+}
+
+func NewDict() (*DictObject) {
+    d := new(DictObject)
+    d.ObjectData.Init()
+    
+    return d
+}
+
+// Returns true if a and b are the same key, given that they have the same hash.
+// Numbers that are equal are the same key, whatever their type, as in Python.
+func sameKey(a, b Object) (bool) {
+    if s, ok := a.(*StringObject); ok {
+        if t, ok := b.(*StringObject); ok {
+            return s.Value == t.Value
+        }
+    }
+    return equal(a, b)
+}
+
+// Returns the index of the entry for key, or -1 if there is none, and the hash of key.
+// A key that can't be hashed gives a TypeError.
+func (o *DictObject) find(key Object) (int, uint64, os.Error) {
+    h, err := hashObject(key, o.key)
+    if err != nil {
+        return -1, 0, err
+    }
+    for _, i := range o.index[h] {
+        if sameKey(o.Keys[i], key) {
+            return i, h, nil
+        }
+    }
+    return -1, h, nil
+}
+
+// Returns the value for key.  A key that can't be hashed is never present.
+func (o *DictObject) Get(key Object) (value Object, present bool) {
+    if i, _, _ := o.find(key); i >= 0 {
+        return o.Values[i], true
+    }
+    return nil, false
+}
+
+// Sets the value for key, replacing the value it has, if any.
+func (o *DictObject) Set(key, value Object) (os.Error) {
+    i, h, err := o.find(key)
+    if err != nil {
+        return err
+    }
+    if i >= 0 {
+        o.Values[i] = value
+        return nil
+    }
+    
+    if o.index == nil {
+        o.index = make(map[uint64][]int)
+    }
+    o.index[h] = append(o.index[h], len(o.Keys))
+    o.Keys = append(o.Keys, key)
+    o.Values = append(o.Values, value)
+    return nil
+}
+
+// Returns the value for key, or a KeyError if there is none.
+func (o *DictObject) GetItem(key Object) (Object, os.Error) {
+    i, _, err := o.find(key)
+    if err != nil {
+        return nil, err
+    }
+    if i < 0 {
+        return nil, Raise(KeyErrorClass, fmt.Sprintf("%v", key.AsString()))
+    }
+    return o.Values[i], nil
+}
+
+func (o *DictObject) SetItem(key, value Object) (os.Error) {
+    return o.Set(key, value)
+}
+
+// Iterating over a dict gives its keys, in the order they were added.
+func (o *DictObject) Iter() (Iterator) {
+    return NewIterator(o.Keys)
+}
+
+// A dict can't be converted to a number
+func (o *DictObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *DictObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert dict to string
+func (o *DictObject) AsString() (string) {
+    items := make([]string, len(o.Keys))
+    for i, key := range o.Keys {
+        items[i] = key.AsString() + ": " + o.Values[i].AsString()
+    }
+    
+    return "{" + strings.Join(items, ", ") + "}"
+}
+
+///////// Rich Comparison Interface ///////////
+
+// Two dicts are equal if they have the same keys, with equal values.
+func (o *DictObject) Eq(r Object) (Object) {
+    d, ok := r.(*DictObject)
+    if !ok {
+        return NotImplemented
+    }
+    if len(d.Keys) != len(o.Keys) {
+        return pyBool(false)
+    }
+    
+    for i, key := range o.Keys {
+        if value, present := d.Get(key); !present || !equal(o.Values[i], value) {
+            return pyBool(false)
+        }
+    }
+    return pyBool(true)
+}
+
+func (o *DictObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+// Dicts are not ordered.
+func (o *DictObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *DictObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *DictObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *DictObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *DictObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *DictObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *DictObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *DictObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *DictObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *DictObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *DictObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *DictObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *DictObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *DictObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A dict is true unless it is empty
+func (o *DictObject) IsTrue() (bool) {
+    return len(o.Keys) > 0
+}
+
+///////// Protocol Interface ///////////
+
+// A dict can be changed, so it can't be hashed.
+func (o *DictObject) Hash() (uint64, os.Error) {
+    return 0, Raise(TypeErrorClass, "unhashable type: 'dict'")
+}
+
+// The keys and values are written as Python writes them, so strings are quoted.
+func (o *DictObject) Repr() (string) {
+    items := make([]string, len(o.Keys))
+    for i, key := range o.Keys {
+        items[i] = key.Repr() + ": " + o.Values[i].Repr()
+    }
+    
+    return "{" + strings.Join(items, ", ") + "}"
+}
+
+func (o *DictObject) Str() (string) {
+    return o.Repr()
+}
+
+func (o *DictObject) Len() (int, os.Error) {
+    return len(o.Keys), nil
+}
+
+func (o *DictObject) AsBool() (bool) {
+    return o.IsTrue()
+}
@@ -0,0 +1,235 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module prints the instructions of a code object in a readable form,
+   in the style of Python's dis module, for debugging generated code.  Each
+   instruction is printed with its index, its predicate, its mnemonic and its
+   operands, with names, constants and cells resolved, like:
+
+            3  (!p1)  JMP         9
+            4         LOAD        r2, 1 (total)
+            5         ADD         r2, r3 -> r2
+
+   If the code has a line table, the source line is printed in front of the
+   first instruction of each line.
+*/
+
+package python
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+var opcodeNames = [64]string{
+    NOP:            "NOP",
+    NEW:            "NEW",
+    LEN:            "LEN",
+    HALT:           "HALT",
+    RET:            "RET",
+    CALLFN:         "CALLFN",
+    MAKECLOSURE:    "MAKECLOSURE",
+    GETITER:        "GETITER",
+    FORITER:        "FORITER",
+    BUILDLIST:      "BUILDLIST",
+    BUILDTUPLE:     "BUILDTUPLE",
+    BUILDDICT:      "BUILDDICT",
+    BUILDSET:       "BUILDSET",
+    MOVE:           "MOVE",
+    YIELD:          "YIELD",
+    AWAIT:          "AWAIT",
+    LOAD:           "LOAD",
+    BIND:           "BIND",
+    BOXI:           "BOXI",
+    BOXL:           "BOXL",
+    BOXF:           "BOXF",
+    BOXS:           "BOXS",
+    BOXB:           "BOXB",
+    UNBOXI:         "UNBOXI",
+    UNBOXL:         "UNBOXL",
+    UNBOXF:         "UNBOXF",
+    UNBOXS:         "UNBOXS",
+    UNBOXB:         "UNBOXB",
+    JMP:            "JMP",
+    CALL:           "CALL",
+    CONST:          "CONST",
+    LOADDEREF:      "LOADDEREF",
+    STOREDEREF:     "STOREDEREF",
+    INDEX:          "INDEX",
+    SPILL:          "SPILL",
+    FILL:           "FILL",
+    SET:            "SET",
+    GET:            "GET",
+    ADD:            "ADD",
+    SUB:            "SUB",
+    MUL:            "MUL",
+    DIV:            "DIV",
+    FDIV:           "FDIV",
+    MOD:            "MOD",
+    EQ:             "EQ",
+    NE:             "NE",
+    LT:             "LT",
+    LE:             "LE",
+    GT:             "GT",
+    GE:             "GE",
+    STOREINDEX:     "STOREINDEX",
+    NEG:            "NEG",
+    POS:            "POS",
+    INVERT:         "INVERT",
+    NOT:            "NOT",
+    IALU:           "IALU",
+    FALU:           "FALU",
+    LOADALU:        "LOADALU",
+    CONSTALU:       "CONSTALU",
+    CMPJMP:         "CMPJMP",
+    ENTERJIT:       "ENTERJIT",
+}
+
+// Returns the mnemonic of the opcode op.
+func OpcodeName(op uint32) (string) {
+    if op < uint32(len(opcodeNames)) && opcodeNames[op] != "" {
+        return opcodeNames[op]
+    }
+    return fmt.Sprintf("OP%v", op)
+}
+
+// The prefix for each kind of raw register used by BOX and UNBOX.
+func rawRegisterPrefix(op uint32) (string) {
+    switch op {
+        case BOXI, UNBOXI: return "i"
+        case BOXL, UNBOXL: return "l"
+        case BOXF, UNBOXF: return "f"
+        case BOXS, UNBOXS: return "s"
+    }
+    return "p"
+}
+
+// Formats the operands of a single instruction of the code c.
+func formatOperands(c *CodeObject, ins *DecodedIns) (string) {
+    name := func(i uint16) (string) {
+        if int(i) < len(c.Names) {
+            return fmt.Sprintf("%v (%v)", i, c.Names[i])
+        }
+        return fmt.Sprint(i)
+    }
+    
+    switch ins.Op {
+        case NOP:
+            return ""
+        case HALT, RET:
+            return fmt.Sprintf("r%v", ins.Reg1)
+        case NEW, LEN, GETITER, MAKECLOSURE, MOVE, YIELD, AWAIT, NEG, POS, INVERT:
+            return fmt.Sprintf("r%v -> r%v", ins.Reg1, ins.Reg3)
+        case NOT:
+            return fmt.Sprintf("r%v -> p%v", ins.Reg1, ins.Reg3)
+        case CALLFN:
+            return fmt.Sprintf("r%v(%v, %v kw) -> r%v", ins.Reg1, ins.Reg2, ins.Imm, ins.Reg3)
+        case FORITER:
+            return fmt.Sprintf("r%v -> r%v, exit %v", ins.Reg1, ins.Reg1+1, ins.Imm)
+        case BUILDLIST, BUILDTUPLE, BUILDSET:
+            return fmt.Sprintf("r%v x %v -> r%v", ins.Reg1, ins.Reg2, ins.Reg3)
+        case BUILDDICT:
+            return fmt.Sprintf("r%v x %v pairs -> r%v", ins.Reg1, ins.Reg2, ins.Reg3)
+        case LOAD, BIND:
+            return fmt.Sprintf("r%v, %v", ins.Reg3, name(ins.Imm))
+        case CONST:
+            if int(ins.Imm) < len(c.Constants) {
+                return fmt.Sprintf("r%v, %v (%v)", ins.Reg3, ins.Imm, c.Constants[ins.Imm].AsString())
+            }
+            return fmt.Sprintf("r%v, %v", ins.Reg3, ins.Imm)
+        case LOADDEREF, STOREDEREF:
+            if int(ins.Imm) < len(c.CellVars)+len(c.FreeVars) {
+                return fmt.Sprintf("r%v, cell %v (%v)", ins.Reg3, ins.Imm, c.DerefName(ins.Imm))
+            }
+            return fmt.Sprintf("r%v, cell %v", ins.Reg3, ins.Imm)
+        case JMP:
+            return fmt.Sprint(ins.Imm)
+        case CALL:
+            return fmt.Sprintf("%v -> r%v", ins.Imm, ins.Reg3)
+        case BOXI, BOXL, BOXF, BOXS, BOXB:
+            return fmt.Sprintf("%v%v -> r%v", rawRegisterPrefix(ins.Op), ins.Imm, ins.Reg3)
+        case UNBOXI, UNBOXL, UNBOXF, UNBOXS, UNBOXB:
+            return fmt.Sprintf("r%v -> %v%v", ins.Reg3, rawRegisterPrefix(ins.Op), ins.Imm)
+        case IALU, FALU:
+            p := "i"
+            if ins.Op == FALU {
+                p = "f"
+            }
+            return fmt.Sprintf("%v %v%v, %v%v -> %v%v", OpcodeName(uint32(ins.Imm)), p, ins.Reg1, p, ins.Reg2, p, ins.Reg3)
+        case SPILL:
+            return fmt.Sprintf("r%v -> slot %v", ins.Reg1, ins.Imm)
+        case FILL:
+            return fmt.Sprintf("slot %v -> r%v", ins.Imm, ins.Reg1)
+        case EQ, NE, LT, LE, GT, GE:
+            return fmt.Sprintf("r%v, r%v -> p%v", ins.Reg1, ins.Reg2, ins.Reg3)
+        case ADD, SUB, MUL, DIV, FDIV, MOD:
+            if ins.Imm != 0 {
+                return fmt.Sprintf("r%v, r%v -> r%v in place", ins.Reg1, ins.Reg2, ins.Reg3)
+            }
+        case SET, STOREINDEX:
+            // The value is in the target field.
+            return fmt.Sprintf("r%v, r%v <- r%v", ins.Reg1, ins.Reg2, ins.Reg3)
+    }
+    
+    return fmt.Sprintf("r%v, r%v -> r%v", ins.Reg1, ins.Reg2, ins.Reg3)
+}
+
+// Formats a single instruction of the code c, without its index or the trailing newline.
+func formatInstruction(c *CodeObject, ins *DecodedIns) (string) {
+    pred := ""
+    if ins.PredReg != 0 {
+        pred = fmt.Sprintf("(p%v)", ins.PredReg)
+        if !ins.PredExec {
+            pred = fmt.Sprintf("(!p%v)", ins.PredReg)
+        }
+    }
+    
+    // A superinstruction is shown with the operands of its first instruction, like
+    // CMPJMP(LT).
+    name := OpcodeName(ins.Op)
+    if ins.Fused != 0 {
+        first := *ins
+        first.Op, first.Fused = ins.Fused, 0
+        name = fmt.Sprintf("%v(%v)", name, OpcodeName(first.Op))
+        ins = &first
+    }
+    
+    return fmt.Sprintf("%-6v %-11v %v", pred, name, formatOperands(c, ins))
+}
+
+// Writes the instructions of the code c to w, one per line.  If the code has a line
+// table, the first instruction of each source line is preceded by the line number.
+func Disassemble(c *CodeObject, w io.Writer) (os.Error) {
+    last_line := 0
+    for i, ins := range c.Decoded() {
+        line := fmt.Sprintf("%6v  %v", i, formatInstruction(c, &ins))
+        if c.FirstLine > 0 {
+            source, number := c.Line(uint32(i)), ""
+            if source != last_line {
+                number = fmt.Sprint(source)
+                last_line = source
+            }
+            line = fmt.Sprintf("%4v %v", number, line)
+        }
+        if _, err := fmt.Fprintln(w, strings.TrimRight(line, " ")); err != nil {
+            return err
+        }
+    }
+    
+    return nil
+}
@@ -0,0 +1,61 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the disassembler.
+
+*/
+
+package python
+
+import (
+        "bytes"
+        "testing"
+)
+
+func TestDisassemble(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    s.WriteLoad("total", 1, false, 0)
+    s.WriteConst(NewString("x"), 2, false, 0)
+    s.WriteCompare(LT, 1, 2, 17, false, 0)
+    s.WriteJump(false, 17)
+    s.WriteAluIns(ADD,1,2,3,true,2)
+    s.WriteCallFunction(4, 2, 1, 9, false, 0)
+    s.WriteRawAluIns(IALU, FDIV, 1, 2, 3, false, 0)
+    s.WriteUnbox(UNBOXF, 3, 4, false, 0)
+    s.WriteSet(1, 2, 3, false, 0)
+    s.WriteHalt(3, false, 0)
+    
+    expected := `     0         LOAD        r1, 0 (total)
+     1         CONST       r2, 0 (x)
+     2         LT          r1, r2 -> p17
+     3  (!p17) JMP         0
+     4  (p2)   ADD         r1, r2 -> r3
+     5         CALLFN      r4(2, 1 kw) -> r9
+     6         IALU        FDIV i1, i2 -> i3
+     7         UNBOXF      r3 -> f4
+     8         SET         r1, r2 <- r3
+     9         HALT        r3
+`
+    
+    buf := new (bytes.Buffer)
+    if err := Disassemble(s, buf); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if buf.String() != expected {
+        t.Errorf("expected:\n%v\ngot:\n%v", expected, buf.String())
+    }
+}
@@ -0,0 +1,197 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the event loop built-in object
+   type, which runs coroutines as tasks.  The loop keeps a queue of the
+   functions that are ready to be called.  Running a task is one of them:
+   it resumes the coroutine of the task until the coroutine waits for a
+   future, and the task is queued again once the future is done.  Each task
+   has a future of its own for the result of its coroutine, so one task can
+   await another.
+*/
+
+package python
+
+import (
+        "big"
+        "os"
+)
+
+type EventLoopObject struct {
+    ObjectData
+    
+    ready       []func()
+}
+
+func NewEventLoop() (*EventLoopObject) {
+    l := new(EventLoopObject)
+    l.ObjectData.Init()
+    
+    return l
+}
+
+// Queues fn to be called by the loop, after the functions already queued.
+func (o *EventLoopObject) CallSoon(fn func()) {
+    o.ready = append(o.ready, fn)
+}
+
+// Queues the coroutine c to run as a task, and returns the future of its result.
+func (o *EventLoopObject) CreateTask(c *CoroutineObject) (*FutureObject) {
+    f := NewFuture()
+    o.CallSoon(func() { o.step(c, f) })
+    return f
+}
+
+// Resumes the coroutine c of a task until it waits, or until it finishes, which sets
+// the future f of the task.
+func (o *EventLoopObject) step(c *CoroutineObject, f *FutureObject) {
+    value, err := c.resume(nil, None)
+    switch {
+        case err == StopIteration:
+            f.SetResult(c.Value)
+            return
+        case err != nil:
+            f.SetError(err)
+            return
+    }
+    
+    if waiting, ok := value.(*FutureObject); ok {
+        waiting.AddDoneCallback(func() { o.CallSoon(func() { o.step(c, f) }) })
+        return
+    }
+    o.CallSoon(func() { o.step(c, f) })
+}
+
+// Runs c as a task, and calls the functions that are ready until it has finished.  It
+// returns the value c returned, or the error it failed with.  It fails if there is
+// nothing left to do before c has finished, since c would wait forever.
+func (o *EventLoopObject) RunUntilComplete(c *CoroutineObject) (Object, os.Error) {
+    f := o.CreateTask(c)
+    for !f.Done {
+        if len(o.ready) == 0 {
+            return nil, Raise(RuntimeErrorClass, "the event loop stopped before the coroutine finished")
+        }
+        fn := o.ready[0]
+        o.ready = o.ready[1:]
+        fn()
+    }
+    return f.Result, f.Err
+}
+
+// An event loop can't be converted to a number
+func (o *EventLoopObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *EventLoopObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert event loop to string
+func (o *EventLoopObject) AsString() (string) {
+    return "<event loop>"
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A event loop is only equal to itself, and event loops are not ordered.
+func (o *EventLoopObject) Eq(r Object) (Object) {
+    l, ok := r.(*EventLoopObject)
+    return pyBool(ok && l == o)
+}
+
+func (o *EventLoopObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *EventLoopObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *EventLoopObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *EventLoopObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *EventLoopObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *EventLoopObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *EventLoopObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *EventLoopObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *EventLoopObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *EventLoopObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *EventLoopObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *EventLoopObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *EventLoopObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *EventLoopObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *EventLoopObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A event loop is always true
+func (o *EventLoopObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *EventLoopObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *EventLoopObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *EventLoopObject) AsBool() (bool) {
+    return o.IsTrue()
+}
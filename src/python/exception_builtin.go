@@ -14,21 +14,369 @@
    limitations under the License.
    --------------------------------------------------------------------
 
-   This file provides the implementation of the integer built-in object
-   type.
+   This file provides the implementation of the BaseException built-in
+   object type, and of the classes of the built-in exceptions.  The classes
+   form a tree with BaseException at the root, as in Python.  An exception
+   is an os.Error too, so the machine returns it when the code raises it,
+   and its String gives the name of its class and its message, the way
+   Python prints an exception.
 */
 
 package python
 
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+// The class of an exception.  Calling the class makes an exception of that class.
+type ExceptionClassObject struct {
+    ObjectData
+    Name string
+    Base *ExceptionClassObject
+}
+
+func newExceptionClass(name string, base *ExceptionClassObject) (*ExceptionClassObject) {
+    c := new(ExceptionClassObject)
+    c.ObjectData.Init()
+    c.Name = name
+    c.Base = base
+    
+    exceptionClasses = append(exceptionClasses, c)
+    return c
+}
+
+// The classes of the built-in exceptions, in the order they are declared.
+var exceptionClasses []*ExceptionClassObject
+
+var (
+    BaseExceptionClass      = newExceptionClass("BaseException", nil)
+    SystemExitClass         = newExceptionClass("SystemExit", BaseExceptionClass)
+    KeyboardInterruptClass  = newExceptionClass("KeyboardInterrupt", BaseExceptionClass)
+    GeneratorExitClass      = newExceptionClass("GeneratorExit", BaseExceptionClass)
+    ExceptionClass          = newExceptionClass("Exception", BaseExceptionClass)
+    StopIterationClass      = newExceptionClass("StopIteration", ExceptionClass)
+    ArithmeticErrorClass    = newExceptionClass("ArithmeticError", ExceptionClass)
+    OverflowErrorClass      = newExceptionClass("OverflowError", ArithmeticErrorClass)
+    ZeroDivisionErrorClass  = newExceptionClass("ZeroDivisionError", ArithmeticErrorClass)
+    AttributeErrorClass     = newExceptionClass("AttributeError", ExceptionClass)
+    ImportErrorClass        = newExceptionClass("ImportError", ExceptionClass)
+    LookupErrorClass        = newExceptionClass("LookupError", ExceptionClass)
+    IndexErrorClass         = newExceptionClass("IndexError", LookupErrorClass)
+    KeyErrorClass           = newExceptionClass("KeyError", LookupErrorClass)
+    NameErrorClass          = newExceptionClass("NameError", ExceptionClass)
+    OSErrorClass            = newExceptionClass("OSError", ExceptionClass)
+    TimeoutErrorClass       = newExceptionClass("TimeoutError", OSErrorClass)
+    RuntimeErrorClass       = newExceptionClass("RuntimeError", ExceptionClass)
+    RecursionErrorClass     = newExceptionClass("RecursionError", RuntimeErrorClass)
+    NotImplementedErrorClass = newExceptionClass("NotImplementedError", RuntimeErrorClass)
+    TypeErrorClass          = newExceptionClass("TypeError", ExceptionClass)
+    ValueErrorClass         = newExceptionClass("ValueError", ExceptionClass)
+    InvalidStateErrorClass  = newExceptionClass("InvalidStateError", ExceptionClass)
+)
+
+// Returns true if c is base or derives from it.
+func (c *ExceptionClassObject) IsSubclass(base *ExceptionClassObject) (bool) {
+    for ; c != nil; c = c.Base {
+        if c == base {
+            return true
+        }
+    }
+    return false
+}
+
+// Makes an exception of the class, with args as its arguments.  Exception classes
+// only take positional arguments.
+func (c *ExceptionClassObject) Call(m *Machine, args []Object, kwnames []string, kwargs []Object) (Object, os.Error) {
+    if len(kwnames) > 0 {
+        return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() takes no keyword arguments", c.Name))
+    }
+    return NewException(c, args...), nil
+}
+
+func (c *ExceptionClassObject) GetAttr(name string) (value Object, present bool) {
+    if "__name__"==name {
+        return NewString(c.Name), true
+    }
+    
+    return c.ObjectData.GetAttr(name)
+}
+
+// An exception class can't be converted to a number
+func (o *ExceptionClassObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *ExceptionClassObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert exception class to string
+func (o *ExceptionClassObject) AsString() (string) {
+    return fmt.Sprintf("<class '%v'>", o.Name)
+}
+
+///////// Rich Comparison Interface ///////////
+
+// An exception class is only equal to itself, and exception classes are not ordered.
+func (o *ExceptionClassObject) Eq(r Object) (Object) {
+    t, ok := r.(*ExceptionClassObject)
+    return pyBool(ok && t == o)
+}
+
+func (o *ExceptionClassObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *ExceptionClassObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ExceptionClassObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ExceptionClassObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ExceptionClassObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *ExceptionClassObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ExceptionClassObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ExceptionClassObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ExceptionClassObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ExceptionClassObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ExceptionClassObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ExceptionClassObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *ExceptionClassObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ExceptionClassObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ExceptionClassObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// An exception class is always true
+func (o *ExceptionClassObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *ExceptionClassObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *ExceptionClassObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *ExceptionClassObject) AsBool() (bool) {
+    return o.IsTrue()
+}
+
+// Adds the classes of the built-in exceptions to the builtins of the interpreter.
+func (interp *Interpreter) addExceptionBuiltins() {
+    for _, c := range exceptionClasses {
+        interp.Builtins[c.Name] = c
+    }
+}
+
 type BaseExceptionObject struct {
     ObjectData
-    args Object 
+    Class *ExceptionClassObject
+    args *TupleObject
+}
+
+// Makes an exception of the class c, with args as its arguments.
+func NewException(c *ExceptionClassObject, args ...Object) (*BaseExceptionObject) {
+    e := new(BaseExceptionObject)
+    e.ObjectData.Init()
+    e.Class = c
+    e.args = NewTuple(args)
+    
+    return e
+}
+
+func NewBaseException(args []Object) (*BaseExceptionObject) {
+    return NewException(BaseExceptionClass, args...)
+}
+
+// Returns an exception of the class c with the message as its argument, for Go code
+// to return as the error the code raises.
+func Raise(c *ExceptionClassObject, message string) (os.Error) {
+    return NewException(c, NewString(message))
+}
+
+// Returns true if err is an exception of the class c, or of a class derived from it.
+func IsException(err os.Error, c *ExceptionClassObject) (bool) {
+    e, ok := err.(*BaseExceptionObject)
+    return ok && e.Class.IsSubclass(c)
+}
+
+// Returns the name of the class and the message, as Python prints the exception.
+func (e *BaseExceptionObject) String() (string) {
+    if s := e.Str(); s != "" {
+        return e.Class.Name + ": " + s
+    }
+    return e.Class.Name
 }
 
 func (e *BaseExceptionObject) GetAttr(name string) (value Object, present bool) {
     if "args"==name {
         return e.args, true    
     }
+    if "__class__"==name {
+        return e.Class, true
+    }
     
-    return nil, false
-}
\ No newline at end of file
+    return e.ObjectData.GetAttr(name)
+}
+
+// An exception can't be converted to a number
+func (o *BaseExceptionObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *BaseExceptionObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert exception to string, which is its argument if it has just the one, as in
+// Python.
+func (o *BaseExceptionObject) AsString() (string) {
+    switch len(o.args.Items) {
+        case 0:
+            return ""
+        case 1:
+            return o.args.Items[0].Str()
+    }
+    return o.args.Str()
+}
+
+///////// Rich Comparison Interface ///////////
+
+// An exception is only equal to itself, and exceptions are not ordered.
+func (o *BaseExceptionObject) Eq(r Object) (Object) {
+    t, ok := r.(*BaseExceptionObject)
+    return pyBool(ok && t == o)
+}
+
+func (o *BaseExceptionObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *BaseExceptionObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *BaseExceptionObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *BaseExceptionObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *BaseExceptionObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *BaseExceptionObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BaseExceptionObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BaseExceptionObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BaseExceptionObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BaseExceptionObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BaseExceptionObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BaseExceptionObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *BaseExceptionObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BaseExceptionObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BaseExceptionObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// An exception is always true
+func (o *BaseExceptionObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *BaseExceptionObject) Repr() (string) {
+    if len(o.args.Items) == 1 {
+        return o.Class.Name + "(" + o.args.Items[0].Repr() + ")"
+    }
+    return o.Class.Name + o.args.Repr()
+}
+
+func (o *BaseExceptionObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *BaseExceptionObject) AsBool() (bool) {
+    return o.IsTrue()
+}
@@ -23,6 +23,10 @@ package python
 import (
         "big"
         "fmt"
+        "math"
+        "os"
+        "strconv"
+        "strings"
 )
 
 type FloatObject struct {
@@ -30,6 +34,14 @@ type FloatObject struct {
     Value float64 
 }
 
+func NewFloat(v float64) (*FloatObject) {
+    f := new (FloatObject)
+    f.ObjectData.Init()
+    f.Value = v
+    
+    return f
+}
+
 // Convert float to int
 func (o *FloatObject) AsInt() (*big.Int) {
     return big.NewInt(int64(o.Value))
@@ -47,76 +59,258 @@ func (o *FloatObject) AsString() (string) {
 
 ///////// Rich Comparison Interface ///////////
 
-func (o *FloatObject) Lt(r Object) (bool) {
-    return o.Value < r.AsFloat()
+// Compares the float v with r, an int or a float, with op, and returns NotImplemented
+// for anything else.  An int isn't rounded to a float, since the float nearest to it
+// may be equal to it when it isn't: 2**53 + 1 == 2.0**53 is False.  A NaN is unequal
+// to everything, and isn't less or greater than anything.
+func compareFloat(op uint32, v float64, r Object) (Object) {
+    switch n := r.(type) {
+        case *FloatObject:
+            if math.IsNaN(v) || math.IsNaN(n.Value) {
+                return pyBool(op == NE)
+            }
+            switch {
+                case v < n.Value:
+                    return comparison(op, -1)
+                case v > n.Value:
+                    return comparison(op, 1)
+            }
+            return comparison(op, 0)
+        case *IntObject:
+            if math.IsNaN(v) {
+                return pyBool(op == NE)
+            }
+            return comparison(op, floatIntCmp(v, n))
+    }
+    return NotImplemented
 }
 
-func (o *FloatObject) Gt(r Object) (bool) {
-    return o.Value > r.AsFloat()
+// Returns -1, 0 or 1 as the float v, which isn't a NaN, is less than, equal to or
+// greater than the int i.  Every int that fits in the 53 bits of a float is a float
+// exactly, so those are compared as floats, and the rest are compared with the int
+// below v: if v is above it, v is above any int it is greater than or equal to.
+func floatIntCmp(v float64, i *IntObject) (int) {
+    const exact = 1 << 53
+    
+    switch {
+        case math.IsInf(v, 1):
+            return 1
+        case math.IsInf(v, -1):
+            return -1
+        case i.Big == nil && i.Small >= -exact && i.Small <= exact:
+            f := float64(i.Small)
+            switch {
+                case v < f:
+                    return -1
+                case v > f:
+                    return 1
+            }
+            return 0
+    }
+    
+    floor := math.Floor(v)
+    c := floatToBig(floor).Cmp(i.AsInt())
+    if c == 0 && floor != v {
+        return 1
+    }
+    return c
 }
 
-func (o *FloatObject) Eq(r Object) (bool) {
-    return o.Value == r.AsFloat()
+// Returns the finite float v, which has no fraction, as a big int.  A float that big is
+// its 53 bit mantissa shifted left.
+func floatToBig(v float64) (*big.Int) {
+    if math.Fabs(v) < 1 << 62 {
+        return big.NewInt(int64(v))
+    }
+    m, e := math.Frexp(v)
+    b := big.NewInt(int64(m * (1 << 53)))
+    
+    return b.Lsh(b, uint(e - 53))
 }
 
-func (o *FloatObject) Neq(r Object) (bool) {
-    return o.Value != r.AsFloat()
+func (o *FloatObject) Lt(r Object) (Object) {
+    return compareFloat(LT, o.Value, r)
 }
 
-func (o *FloatObject) Lte(r Object) (bool) {
-    return o.Value <= r.AsFloat()
+func (o *FloatObject) Gt(r Object) (Object) {
+    return compareFloat(GT, o.Value, r)
 }
 
-func (o *FloatObject) Gte(r Object) (bool) {
-    return o.Value >= r.AsFloat()
+func (o *FloatObject) Eq(r Object) (Object) {
+    return compareFloat(EQ, o.Value, r)
+}
+
+// A NaN isn't equal to anything, so it is unequal to everything.
+func (o *FloatObject) Neq(r Object) (Object) {
+    return compareFloat(NE, o.Value, r)
+}
+
+func (o *FloatObject) Lte(r Object) (Object) {
+    return compareFloat(LE, o.Value, r)
+}
+
+func (o *FloatObject) Gte(r Object) (Object) {
+    return compareFloat(GE, o.Value, r)
 }
 
 ///////// Binary Arithmetic Interface ///////////
 
-func (o *FloatObject) Add(r Object) (Object) {
-    result := new (FloatObject)
-    result.Value = o.Value + r.AsFloat()
+// Executes the arithmetic opcode op on the float and r, which has to be an int or a
+// float.
+func (o *FloatObject) arithmetic(op uint32, r Object) (Object, os.Error) {
+    switch r.(type) {
+        case *IntObject, *FloatObject:
+        default:
+            return nil, nil
+    }
+    
+    v, err := rawFloatArithmetic(op, o.Value, r.AsFloat())
+    if err != nil {
+        return nil, err
+    }
     
-    return result
+    return NewFloat(v), nil
 }
 
-func (o *FloatObject) Sub(r Object) (Object) {
-    result := new (FloatObject)
-    result.Value = o.Value - r.AsFloat()
+// Returns l // r and l % r, for r other than 0, as Python works them out.  The
+// remainder has the sign of r, and the quotient is worked out from l less the
+// remainder, which is exact, rather than by flooring l / r, which can round up to the
+// next integer, as 1 / 0.1 does.
+func floatDivMod(l, r float64) (q, m float64) {
+    m = math.Fmod(l, r)
+    div := (l - m) / r
+    if m != 0 {
+        if (r < 0) != (m < 0) {
+            m += r
+            div -= 1
+        }
+    } else {
+        m = math.Copysign(0, r)
+    }
     
-    return result
+    if div == 0 {
+        return math.Copysign(0, l/r), m
+    }
+    q = math.Floor(div)
+    if div-q > 0.5 {
+        q += 1
+    }
+    return q, m
 }
 
-func (o *FloatObject) Mul(r Object) (Object) {
-    result := new (FloatObject)
-    result.Value = o.Value * r.AsFloat()
-    
-    return result
+func (o *FloatObject) Add(r Object) (Object, os.Error) {
+    return o.arithmetic(ADD, r)
+}
+
+func (o *FloatObject) Sub(r Object) (Object, os.Error) {
+    return o.arithmetic(SUB, r)
 }
 
-func (o *FloatObject) Div(r Object) (Object) {
-    result := new (FloatObject)
-    result.Value = o.Value / r.AsFloat()
+func (o *FloatObject) Mul(r Object) (Object, os.Error) {
+    return o.arithmetic(MUL, r)
+}
+
+func (o *FloatObject) Div(r Object) (Object, os.Error) {
+    return o.arithmetic(DIV, r)
+}
+
+// Python says that the result of floor division of floats is a float with an integral
+// value.
+func (o *FloatObject) FloorDiv(r Object) (Object, os.Error) {
+    return o.arithmetic(FDIV, r)
+}
+
+func (o *FloatObject) Mod(r Object) (Object, os.Error) {
+    return o.arithmetic(MOD, r)
+}
+
+// A negative float to a fractional power is a complex, as in Python.  A negative
+// power of zero can't be taken.
+func (o *FloatObject) Pow(r Object) (Object, os.Error) {
+    switch r.(type) {
+        case *IntObject, *FloatObject:
+        default:
+            return nil, nil
+    }
     
-    return result
+    p := r.AsFloat()
+    if o.Value == 0 && p < 0 {
+        return nil, Raise(ZeroDivisionErrorClass, "0.0 cannot be raised to a negative power")
+    }
+    if o.Value < 0 && p != math.Floor(p) {
+        return NewComplex(complex(o.Value, 0)).Pow(r)
+    }
+    
+    return NewFloat(math.Pow(o.Value, p)), nil
 }
 
-func (o *FloatObject) FloorDiv(r Object) (Object) {
-    // Python says that the result of floor division
-    // is always an integer.
-    result := new (IntObject)
-    result.Int = big.NewInt(int64(o.Value / r.AsFloat()))
+// divmod(o, r), the tuple of o // r and o % r.
+func (o *FloatObject) Divmod(r Object) (Object, os.Error) {
+    q, err := o.FloorDiv(r)
+    if q == nil || err != nil {
+        return nil, err
+    }
+    m, err := o.Mod(r)
+    if err != nil {
+        return nil, err
+    }
     
-    return result
+    return NewTuple([]Object{q, m}), nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *FloatObject) Neg() (Object, os.Error) {
+    return NewFloat(-o.Value), nil
+}
+
+func (o *FloatObject) Pos() (Object, os.Error) {
+    return o, nil
+}
+
+func (o *FloatObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FloatObject) IsTrue() (bool) {
+    return o.Value != 0
 }
 
-func (o *FloatObject) Mod(r Object) (Object) {
-    // We actually need to throw an exception, since
-    // you can't mod two float objects.
-    result := new (FloatObject)
-    result.Value = 0
+///////// Protocol Interface ///////////
+
+// Returns v the way Python writes a float, which always has a point or an exponent.
+func floatRepr(v float64) (string) {
+    switch {
+        case math.IsInf(v, 1):
+            return "inf"
+        case math.IsInf(v, -1):
+            return "-inf"
+        case math.IsNaN(v):
+            return "nan"
+    }
     
-    return result
+    if a := math.Fabs(v); a != 0 && (a < 1e-4 || a >= 1e16) {
+        return strconv.Ftoa64(v, 'e', -1)
+    }
+    s := strconv.Ftoa64(v, 'f', -1)
+    if strings.IndexRune(s, '.') < 0 {
+        s += ".0"
+    }
+    return s
+}
+
+func (o *FloatObject) Hash() (uint64, os.Error) {
+    return floatHash(o.Value), nil
 }
 
+func (o *FloatObject) Repr() (string) {
+    return floatRepr(o.Value)
+}
 
+func (o *FloatObject) Str() (string) {
+    return floatRepr(o.Value)
+}
+
+func (o *FloatObject) AsBool() (bool) {
+    return o.IsTrue()
+}
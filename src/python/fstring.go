@@ -0,0 +1,201 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   Parsing of f-strings.  The scanner returns an f-string as a single String
+   token.  Here we split the token into its literal text and replacement fields,
+   and run the expression in each field through its own parser, so that the
+   positions of the expression nodes point into the original file.
+*/
+
+package python
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Parses the contents of an f-string token, text[first:last], into literal and
+// formatted value nodes.  pos is the position of the token.  depth counts how
+// many format specs we are nested inside of.
+func (p *Parser) parseFString(text string, first, last int, pos Position, depth int) []Ast {
+    parts := make([]Ast, 0, 4)
+
+    literal := ""
+    literal_start := first
+
+    flush := func(end int) {
+        if literal != "" {
+            n := new(LiteralStringNode)
+            n.Value = literal
+            n.Start, n.Stop = endOf(pos, text[0:literal_start]), endOf(pos, text[0:end])
+            parts = append(parts, n)
+        }
+        literal = ""
+    }
+
+    for i := first; i < last; {
+        switch {
+            case strings.HasPrefix(text[i:last], "{{"):
+                literal += "{"
+                i += 2
+
+            case strings.HasPrefix(text[i:last], "}}"):
+                literal += "}"
+                i += 2
+
+            case text[i] == '{':
+                flush(i)
+                var field Ast
+                field, i = p.parseReplacementField(text, i, last, pos, depth)
+                parts = append(parts, field)
+                literal_start = i
+
+            case text[i] == '}':
+                p.failAt(endOf(pos, text[0:i]), "f-string: single '}' is not allowed")
+
+            default:
+                literal += text[i : i+1]
+                i++
+        }
+    }
+    flush(last)
+
+    return parts
+}
+
+// Parses the replacement field starting at the '{' at text[start], and returns
+// it along with the offset just past its closing '}'.
+func (p *Parser) parseReplacementField(text string, start, last int, pos Position, depth int) (Ast, int) {
+    if depth > 1 {
+        p.failAt(endOf(pos, text[0:start]), "f-string: expressions nested too deeply")
+    }
+
+    n := new(FormattedValueNode)
+    n.Conversion = -1
+
+    // Find the end of the expression.  Brackets and strings inside of the
+    // expression may contain any of the characters that end it.
+    i := start + 1
+    nesting := 0
+    for ; i < last; i++ {
+        c := text[i]
+        if nesting == 0 && (c == '}' || c == ':' || (c == '!' && !strings.HasPrefix(text[i:last], "!="))) {
+            break
+        }
+
+        switch c {
+            case '(', '[', '{':
+                nesting++
+            case ')', ']', '}':
+                nesting--
+            case '\'', '"':
+                end := strings.Index(text[i+1:last], text[i:i+1])
+                if end < 0 {
+                    p.failAt(endOf(pos, text[0:i]), "f-string: unterminated string")
+                }
+                i += end + 1
+        }
+    }
+
+    if i >= last {
+        p.failAt(endOf(pos, text[0:start]), "f-string: expecting '}'")
+    }
+
+    n.Value = p.parseFieldExpression(text, start+1, i, pos)
+
+    if text[i] == '!' {
+        if i+1 >= last || strings.Index("rsa", text[i+1:i+2]) < 0 {
+            p.failAt(endOf(pos, text[0:i]), "f-string: invalid conversion character: expected 's', 'r', or 'a'")
+        }
+        n.Conversion = int(text[i+1])
+        i += 2
+    }
+
+    if i < last && text[i] == ':' {
+        // The format spec runs to the matching close brace, and may itself
+        // contain replacement fields.
+        spec_start := i + 1
+        nesting = 0
+        for i = spec_start; i < last; i++ {
+            if text[i] == '{' {
+                nesting++
+            } else if text[i] == '}' {
+                if nesting == 0 {
+                    break
+                }
+                nesting--
+            }
+        }
+
+        spec := new(JoinedStrNode)
+        spec.Values = p.parseFString(text, spec_start, i, pos, depth+1)
+        spec.Start, spec.Stop = endOf(pos, text[0:spec_start]), endOf(pos, text[0:i])
+        n.FormatSpec = spec
+    }
+
+    if i >= last || text[i] != '}' {
+        p.failAt(endOf(pos, text[0:start]), "f-string: expecting '}'")
+    }
+    i++
+
+    n.Start, n.Stop = endOf(pos, text[0:start]), endOf(pos, text[0:i])
+    return n, i
+}
+
+// Parses the expression text[first:last] of a replacement field.
+func (p *Parser) parseFieldExpression(text string, first, last int, pos Position) Ast {
+    // Leading whitespace would look like an indent to the scanner.
+    for first < last && strings.Index(" \t\r\n", text[first:first+1]) >= 0 {
+        first++
+    }
+
+    if strings.TrimSpace(text[first:last]) == "" {
+        p.failAt(endOf(pos, text[0:first]), "f-string: empty expression not allowed")
+    }
+
+    // The expression is parsed as if it were wrapped in brackets, so it can
+    // span lines in a triple quoted string.
+    sub := new(Parser)
+    sub.filename = pos.Filename
+    sub.Error = func(sub *Parser, pos Position, msg string) {
+        p.error(pos, "f-string: "+msg)
+    }
+    sub.tokenize(pos.Filename, strings.NewReader("("+text[first:last]+")"), endOf(pos, text[0:first-1]))
+
+    value := sub.parseAtom()
+    if sub.peek().Tok != EOF {
+        sub.fail(fmt.Sprintf("unexpected '%s'", sub.peek().Text))
+    }
+
+    return value
+}
+
+// Merges adjacent literals, which come from concatenating a plain string
+// with an f-string.
+func joinLiterals(parts []Ast) []Ast {
+    out := parts[0:0]
+    for _, part := range parts {
+        if n, ok := part.(*LiteralStringNode); ok && len(out) > 0 {
+            if prev, ok := out[len(out)-1].(*LiteralStringNode); ok {
+                prev.Value += n.Value
+                prev.Stop = n.Stop
+                continue
+            }
+        }
+        out = append(out, part)
+    }
+    return out
+}
@@ -0,0 +1,240 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the function built-in object
+   type, and the way the arguments of a call are matched up with the
+   parameters of the function.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+type FunctionObject struct {
+    ObjectData
+    
+    // The code of the function, the values of its last len(Defaults) parameters when
+    // they aren't passed, and the globals of the module that defined it.
+    Code        *CodeObject
+    Defaults    []Object
+    Globals     map[string]Object
+    
+    // The cells of the free variables of the code, in the same order.
+    Closure     []*Cell
+}
+
+// A cell holds a variable that is shared between a function and the functions nested
+// in it.  Value is nil until the variable is bound.
+type Cell struct {
+    Value       Object
+}
+
+func NewFunction(code *CodeObject, defaults []Object, globals map[string]Object) (*FunctionObject) {
+    f := new(FunctionObject)
+    f.ObjectData.Init()
+    f.Code = code
+    f.Defaults = defaults
+    f.Globals = globals
+    
+    return f
+}
+
+// Matches the arguments of a call up with the parameters of the function, and returns
+// the value of each parameter, in order.  The parameters are the first NumParams names
+// of the code.  If the function takes *args, a tuple of the positional arguments left
+// over follows them, and if it takes **kwargs, a dict of the keyword arguments left
+// over comes last.
+func (o *FunctionObject) bindArguments(args []Object, kwnames []string, kwargs []Object) ([]Object, os.Error) {
+    code := o.Code
+    values := make([]Object, code.NumParams)
+    
+    n := len(args)
+    if n > code.NumParams {
+        if !code.VarArgs {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() takes %v positional arguments but %v were given", code.Name, code.NumParams, len(args)))
+        }
+        n = code.NumParams
+    }
+    copy(values, args[0:n])
+    
+    var extra *DictObject
+    if code.VarKeywords {
+        extra = NewDict()
+    }
+    
+    for i, name := range kwnames {
+        index, present := code.NameIndices[name]
+        if !present || int(index) >= code.NumParams {
+            if extra == nil {
+                return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() got an unexpected keyword argument '%v'", code.Name, name))
+            }
+            extra.Set(NewString(name), kwargs[i])
+            continue
+        }
+        
+        if values[index] != nil {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() got multiple values for argument '%v'", code.Name, name))
+        }
+        values[index] = kwargs[i]
+    }
+    
+    // The defaults belong to the last parameters.
+    first_default := code.NumParams - len(o.Defaults)
+    for i := range values {
+        if values[i] != nil {
+            continue
+        }
+        if i < first_default {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() missing required argument '%v'", code.Name, code.Names[i]))
+        }
+        values[i] = o.Defaults[i-first_default]
+    }
+    
+    if code.VarArgs {
+        rest := make([]Object, len(args)-n)
+        copy(rest, args[n:])
+        values = append(values, NewTuple(rest))
+    }
+    if extra != nil {
+        values = append(values, extra)
+    }
+    
+    return values, nil
+}
+
+// Calls the function from Go, on a machine of its own.  The machine calls a function
+// in a frame of its own instead.
+func (o *FunctionObject) Call(m *Machine, args []Object, kwnames []string, kwargs []Object) (Object, os.Error) {
+    return m.callNestedKeywords(o, args, kwnames, kwargs)
+}
+
+// A function got from an instance is bound to it, so that calling the method calls the
+// function with the instance.  Got from the class, it is the function itself.
+func (o *FunctionObject) Get(m *Machine, instance Object, owner *TypeObject) (Object, os.Error) {
+    if instance == nil {
+        return o, nil
+    }
+    return NewBoundMethod(o, instance), nil
+}
+
+// A function can't be converted to a number
+func (o *FunctionObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *FunctionObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert function to string
+func (o *FunctionObject) AsString() (string) {
+    return fmt.Sprintf("<function %v>", o.Code.Name)
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A function is only equal to itself, and functions are not ordered.
+func (o *FunctionObject) Eq(r Object) (Object) {
+    f, ok := r.(*FunctionObject)
+    return pyBool(ok && f == o)
+}
+
+func (o *FunctionObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *FunctionObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *FunctionObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *FunctionObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *FunctionObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *FunctionObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FunctionObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FunctionObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FunctionObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FunctionObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FunctionObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FunctionObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *FunctionObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FunctionObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FunctionObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A function is always true
+func (o *FunctionObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *FunctionObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *FunctionObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *FunctionObject) AsBool() (bool) {
+    return o.IsTrue()
+}
@@ -0,0 +1,102 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements superinstructions, which fuse a pair of
+   instructions that often run one after the other into one, so the pair
+   costs a single trip around the dispatch loop.  Fusing is a pass over the
+   decoded code, after it has been compiled, so the code written to a file
+   doesn't change.  The first instruction of a pair is replaced by the
+   superinstruction, which keeps its operands, and runs it and then the
+   second one, which is left where it was, so a jump to it still works.
+
+   The pairs fused are a LOAD or a CONST followed by an arithmetic
+   instruction, and a comparison followed by a jump.  Given a profile, only
+   the pairs that ran often enough are fused.  While the machine is traced or
+   has breakpoints, a superinstruction only runs its first instruction, so
+   that the second one is seen on its own.
+*/
+
+package python
+
+import (
+    "os"
+)
+
+// Returns the superinstruction that fuses the instructions a and b, or 0 if they
+// can't be fused.
+func superinstruction(a, b *DecodedIns) (uint32) {
+    arithmetic := b.Op >= ADD && b.Op <= MOD
+    switch {
+        case a.Op == LOAD && arithmetic:
+            return LOADALU
+        case a.Op == CONST && arithmetic:
+            return CONSTALU
+        case a.Op >= EQ && a.Op <= GE && b.Op == JMP:
+            return CMPJMP
+    }
+    return 0
+}
+
+// Fuses the pairs of instructions of the code that can be fused, and returns how many
+// it fused.  If p isn't nil, a pair is only fused if its first instruction was
+// dispatched at least min times in the profile.  Code that has been fused is decoded
+// again, without the superinstructions, if more code is written to it.
+func (c *CodeObject) Fuse(p *Profile, min uint64) (int) {
+    code := c.Decoded()
+    n := 0
+    for pc := 0; pc+1 < len(code); pc++ {
+        a := &code[pc]
+        op := superinstruction(a, &code[pc+1])
+        if op == 0 || p != nil && p.Count(c, uint32(pc)) < min {
+            continue
+        }
+        
+        a.Fused = a.Op
+        a.Op = op
+        n++
+        
+        // The second instruction can't start another pair, since it doesn't run on
+        // its own.
+        pc++
+    }
+    return n
+}
+
+// Fuses the code objects of the module, as Fuse does, and returns how many pairs it
+// fused.
+func (mod *ModuleCode) Fuse(p *Profile, min uint64) (int) {
+    n := 0
+    for _, c := range mod.Code {
+        n += c.Fuse(p, min)
+    }
+    return n
+}
+
+// Runs the first instruction of a superinstruction, and then the second one, unless
+// the first one jumped, or the machine is traced or has breakpoints.
+func execFused(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    next := m.NextInstruction
+    
+    ins.Op, ins.Fused = ins.Fused, 0
+    if err := m.handler(ins.Op)(m, f, ins); err != nil {
+        return err
+    }
+    
+    if m.NextInstruction != next || m.Halted || m.trace != nil || m.debug != nil {
+        return nil
+    }
+    return m.Dispatch(m.Code)
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for superinstructions.
+
+*/
+
+package python
+
+import (
+        "bytes"
+        "strings"
+        "testing"
+)
+
+func TestFuse(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 100)
+    
+    m := new (Machine)
+    m.SetProfiling(true)
+    if _, err := m.Run(s); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    p := m.Profile()
+    
+    // Only the comparison and the exit of the loop run often enough to be fused.  The
+    // last constant and the add after it are a pair too, but run once.
+    if n := s.Fuse(p, 50); n != 1 || s.Decoded()[4].Op != CMPJMP || s.Decoded()[2].Op != CONST {
+        t.Fatalf("expected the comparison and the jump to be fused, fused %v", n)
+    }
+    out := new (bytes.Buffer)
+    Disassemble(s, out)
+    if !strings.Contains(out.String(), "CMPJMP(GT)  r3, r1 -> p1") {
+        t.Errorf("expected the superinstruction to be disassembled, got:\n%v", out)
+    }
+    
+    // The fused code computes the same sum, in fewer trips around the dispatch loop, and
+    // dispatches the same instructions.
+    m = new (Machine)
+    m.SetProfiling(true)
+    m.StepLimit = int(p.Total) - 50
+    if result, err := m.Run(s); err != nil || result.AsString() != "5050" {
+        t.Errorf("expected 5050, got %v, %v", result, err)
+    }
+    if m.Profile().Total != p.Total || m.Profile().Opcodes[CMPJMP] != p.Opcodes[GT] {
+        t.Errorf("expected %v instructions, got %v", p.Total, m.Profile().Total)
+    }
+    
+    // A traced machine sees each instruction on its own.
+    lines := 0
+    m = new (Machine)
+    m.SetTrace(func(e TraceEvent) {
+        lines++
+    })
+    if result, err := m.Run(s); err != nil || result.AsString() != "5050" || lines != 2 {
+        t.Errorf("expected 5050 and a call and a return, got %v, %v and %v events", result, err, lines)
+    }
+    
+    // Without a profile, every pair is fused.
+    s = new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 100)
+    if n := s.Fuse(nil, 0); n != 2 {
+        t.Errorf("expected 2 pairs to be fused, fused %v", n)
+    }
+    if result, err := new (Machine).Run(s); err != nil || result.AsString() != "5050" {
+        t.Errorf("expected 5050, got %v, %v", result, err)
+    }
+}
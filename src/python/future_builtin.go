@@ -0,0 +1,196 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the future built-in object
+   type.  A future holds a result that isn't there yet.  A coroutine that
+   awaits a future which isn't done is suspended, until something else sets
+   the result.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+type FutureObject struct {
+    ObjectData
+    
+    // Set once the future has a result, or has failed with Err.
+    Done        bool
+    Result      Object
+    Err         os.Error
+    
+    // The functions to call when the future is done.
+    callbacks   []func()
+}
+
+func NewFuture() (*FutureObject) {
+    f := new(FutureObject)
+    f.ObjectData.Init()
+    
+    return f
+}
+
+// Calls fn once the future is done, or right away if it already is.
+func (o *FutureObject) AddDoneCallback(fn func()) {
+    if o.Done {
+        fn()
+        return
+    }
+    o.callbacks = append(o.callbacks, fn)
+}
+
+// Sets the result of the future, which is then done.  A future's result can only be set
+// once.
+func (o *FutureObject) SetResult(value Object) (os.Error) {
+    return o.finish(value, nil)
+}
+
+// Makes the future fail with err, which is then done.
+func (o *FutureObject) SetError(err os.Error) (os.Error) {
+    return o.finish(nil, err)
+}
+
+func (o *FutureObject) finish(value Object, err os.Error) (os.Error) {
+    if o.Done {
+        return Raise(InvalidStateErrorClass, "the future is already done")
+    }
+    
+    o.Done = true
+    o.Result = value
+    o.Err = err
+    
+    callbacks := o.callbacks
+    o.callbacks = nil
+    for _, fn := range callbacks {
+        fn()
+    }
+    return nil
+}
+
+// A future can't be converted to a number
+func (o *FutureObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *FutureObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert future to string
+func (o *FutureObject) AsString() (string) {
+    switch {
+        case !o.Done:
+            return "<future pending>"
+        case o.Err != nil:
+            return fmt.Sprintf("<future failed: %v>", o.Err)
+    }
+    return fmt.Sprintf("<future result=%v>", o.Result.AsString())
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A future is only equal to itself, and futures are not ordered.
+func (o *FutureObject) Eq(r Object) (Object) {
+    f, ok := r.(*FutureObject)
+    return pyBool(ok && f == o)
+}
+
+func (o *FutureObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *FutureObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *FutureObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *FutureObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *FutureObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *FutureObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FutureObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FutureObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FutureObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FutureObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FutureObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FutureObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *FutureObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FutureObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *FutureObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A future is always true
+func (o *FutureObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *FutureObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *FutureObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *FutureObject) AsBool() (bool) {
+    return o.IsTrue()
+}
@@ -0,0 +1,253 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements finalization, so that objects wrapping external
+   resources, like files and sockets, get cleaned up, and objects with a
+   __del__ method get it called, once nothing uses them any more.  Go's
+   garbage collector finds them, but Go runs finalizers on a goroutine of its
+   own, at any time, so they only queue the work, and the interpreter does it
+   at safe points, between instructions: when its machines have made
+   Threshold objects since the last time, when collect() of the gc module is
+   called, and, for the cleanups, when the interpreter shuts down.
+
+   A cleanup registered with Finalize doesn't refer to its object, but to a
+   sentinel that only the object refers to, so it is run even if the object
+   is part of a reference cycle, which Go doesn't finalize.  An object with a
+   __del__ method is finalized itself, since the method needs the object, so
+   as in Python 2, it is never finalized if it is part of a cycle.
+*/
+
+package python
+
+import (
+    "fmt"
+    "os"
+    "runtime"
+    "sync"
+)
+
+// The number of objects the machines of an interpreter make between the runs of the
+// finalizers that are due, unless the gc module sets another.
+const DefaultGcThreshold = 700
+
+// Refers to the cleanups of an object.  Only the object refers to it, so it is garbage
+// once the object is.
+type sentinel struct {
+    ids     []int
+}
+
+// The finalization state of an interpreter.
+type collector struct {
+    // Held by the Go finalizers while they queue work, since they don't hold the lock
+    // of the interpreter.
+    lock        sync.Mutex
+    due         []int
+    dying       []Object
+    
+    // The cleanups that haven't run yet, by id.
+    cleanups    map[int]func()
+    next        int
+    
+    enabled     bool
+    threshold   int
+    allocations int
+}
+
+func newCollector() (*collector) {
+    return &collector{cleanups: make(map[int]func()), enabled: true, threshold: DefaultGcThreshold}
+}
+
+// Arranges for cleanup to be called once o is no longer used, or when the interpreter
+// shuts down, whichever comes first.  cleanup must not refer to o, or o will never be
+// garbage.  Only objects with ObjectData can be finalized.
+func (interp *Interpreter) Finalize(o Object, cleanup func()) (os.Error) {
+    d, ok := o.(interface { objectData() (*ObjectData) })
+    if !ok {
+        return Raise(TypeErrorClass, fmt.Sprintf("'%v' can't be finalized", o.AsString()))
+    }
+    
+    c := interp.gc
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    
+    data := d.objectData()
+    if data.sentinel == nil {
+        s := new (sentinel)
+        runtime.SetFinalizer(s, func(s *sentinel) {
+            c.lock.Lock()
+            c.due = append(c.due, s.ids...)
+            c.lock.Unlock()
+        })
+        data.sentinel = s
+    }
+    c.next++
+    c.cleanups[c.next] = cleanup
+    data.sentinel.ids = append(data.sentinel.ids, c.next)
+    return nil
+}
+
+// Arranges for the __del__ method of o to be called once o is no longer used, if it
+// has one.
+func (interp *Interpreter) finalizeDel(o Object) {
+    if _, present := o.GetAttr("__del__"); !present {
+        return
+    }
+    
+    c := interp.gc
+    runtime.SetFinalizer(o, nil)
+    runtime.SetFinalizer(o, func(o Object) {
+        c.lock.Lock()
+        c.dying = append(c.dying, o)
+        c.lock.Unlock()
+    })
+}
+
+// Counts an object made by m, and runs the finalizers that are due once the machines
+// have made enough of them.
+func (interp *Interpreter) allocated(m *Machine) {
+    c := interp.gc
+    c.allocations++
+    if c.enabled && c.allocations >= c.threshold {
+        c.allocations = 0
+        interp.runFinalizers(m)
+    }
+}
+
+// Runs the cleanups and the __del__ methods that are due, and returns how many it ran.
+// The __del__ methods run on a machine of their own, which shares the lock of m, if
+// it holds it.  An error in a __del__ method is reported, and otherwise ignored, as in
+// Python.
+func (interp *Interpreter) runFinalizers(m *Machine) (int) {
+    c := interp.gc
+    c.lock.Lock()
+    due, dying := c.due, c.dying
+    c.due, c.dying = nil, nil
+    var cleanups []func()
+    for _, id := range due {
+        if cleanup, present := c.cleanups[id]; present {
+            cleanups = append(cleanups, cleanup)
+            c.cleanups[id] = nil, false
+        }
+    }
+    c.lock.Unlock()
+    
+    for _, cleanup := range cleanups {
+        cleanup()
+    }
+    for _, o := range dying {
+        sub := interp.NewMachine()
+        sub.locked = m != nil && m.locked
+        del, err := sub.getAttr(o, "__del__")
+        if err != nil {
+            continue
+        }
+        if _, err := sub.CallObject(del, nil); err != nil {
+            fmt.Fprintf(os.Stderr, "Exception ignored in: %v.__del__\n%v\n", o.AsString(), err.String())
+        }
+    }
+    return len(cleanups) + len(dying)
+}
+
+// Collects the garbage, and runs the finalizers of the objects that turn out to be
+// garbage, and of any that were already due.  Returns how many finalizers ran.  The
+// finalizers Go queues while this runs may only run the next time.
+func (interp *Interpreter) collect(m *Machine) (int) {
+    m.Blocking(func() {
+        runtime.GC()
+        runtime.Gosched()
+    })
+    interp.gc.allocations = 0
+    return interp.runFinalizers(m)
+}
+
+// Collects the garbage, as collect() of the gc module does, for Go code that doesn't
+// hold the lock of the interpreter.
+func (interp *Interpreter) Collect() (int) {
+    m := interp.NewMachine()
+    defer m.lock()()
+    return interp.collect(m)
+}
+
+// Runs every cleanup that hasn't run yet, whether or not its object is still used, so
+// the resources the interpreter holds are released.  Go code must not hold the lock
+// of the interpreter when it shuts it down.
+func (interp *Interpreter) Shutdown() {
+    interp.Lock()
+    defer interp.Unlock()
+    
+    c := interp.gc
+    c.lock.Lock()
+    cleanups := c.cleanups
+    c.cleanups = make(map[int]func())
+    c.due = nil
+    c.lock.Unlock()
+    
+    for _, cleanup := range cleanups {
+        cleanup()
+    }
+}
+
+// Adds the gc module to the modules of the interpreter.
+func (interp *Interpreter) addGcModule() {
+    mod := new (ModuleCode)
+    mod.Init("gc")
+    c := interp.gc
+    
+    noArgs := func(name string, fn func(m *Machine) (Object)) {
+        mod.Globals[name] = NewBuiltinFunction(name, func(m *Machine, args []Object) (Object, os.Error) {
+            if len(args) != 0 {
+                return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() takes no arguments (%v given)", name, len(args)))
+            }
+            return fn(m), nil
+        })
+    }
+    noArgs("collect", func(m *Machine) (Object) {
+        return pyInt(int64(interp.collect(m)))
+    })
+    noArgs("enable", func(m *Machine) (Object) {
+        c.enabled = true
+        return None
+    })
+    noArgs("disable", func(m *Machine) (Object) {
+        c.enabled = false
+        return None
+    })
+    noArgs("isenabled", func(m *Machine) (Object) {
+        return pyBool(c.enabled)
+    })
+    
+    // There is only one generation, so the counts and the thresholds of the others are
+    // always 0.
+    noArgs("get_count", func(m *Machine) (Object) {
+        return NewTuple([]Object{pyInt(int64(c.allocations)), pyInt(0), pyInt(0)})
+    })
+    noArgs("get_threshold", func(m *Machine) (Object) {
+        return NewTuple([]Object{pyInt(int64(c.threshold)), pyInt(0), pyInt(0)})
+    })
+    mod.Globals["set_threshold"] = NewBuiltinFunction("set_threshold", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) < 1 || len(args) > 3 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("set_threshold() takes 1 to 3 arguments (%v given)", len(args)))
+        }
+        n, ok := args[0].(*IntObject)
+        if !ok || n.Sign() <= 0 {
+            return nil, Raise(ValueErrorClass, "the threshold must be a positive int")
+        }
+        c.threshold = int(n.Int64())
+        return None, nil
+    })
+    
+    interp.Modules["gc"] = mod
+}
@@ -0,0 +1,133 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for finalization and the gc module.
+
+*/
+
+package python
+
+import (
+        "os"
+        "testing"
+        "time"
+)
+
+// Collects the garbage until done returns true, and returns false if it never does.
+func collectUntil(interp *Interpreter, done func() (bool)) (bool) {
+    for i := 0; i < 100 && !done(); i++ {
+        interp.Collect()
+        time.Sleep(1e6)
+    }
+    return done()
+}
+
+func TestFinalize(t *testing.T) {
+    interp := NewInterpreter()
+    closed := make(map[string]bool)
+    
+    // The cleanup runs even though the object refers to itself.
+    d := NewDict()
+    d.Set(NewString("self"), d)
+    if err := interp.Finalize(d, func() { closed["cycle"] = true }); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    d = nil
+    if !collectUntil(interp, func() (bool) { return closed["cycle"] }) {
+        t.Errorf("the cleanup of an object in a cycle should run")
+    }
+    
+    // Shutting down runs the cleanups of the objects still in use, once.
+    live := NewList([]Object{})
+    interp.Finalize(live, func() { closed["live"] = !closed["live"] })
+    interp.Finalize(live, func() { closed["again"] = true })
+    interp.Shutdown()
+    interp.Shutdown()
+    if !closed["live"] || !closed["again"] || live == nil {
+        t.Errorf("shutting down should run the cleanups once, got %v", closed)
+    }
+}
+
+// Builds code that sets the __del__ attribute of obj to del.
+func newSetDel() (*CodeObject) {
+    s := new (CodeObject)
+    s.Init()
+    s.WriteLoad("obj", 1, false, 0)
+    s.WriteConst(NewString("__del__"), 2, false, 0)
+    s.WriteLoad("del", 3, false, 0)
+    s.WriteSet(1, 2, 3, false, 0)
+    s.WriteConst(None, 1, false, 0)
+    s.WriteHalt(1, false, 0)
+    return s
+}
+
+func TestDel(t *testing.T) {
+    interp := NewInterpreter()
+    deleted := false
+    interp.Builtins["del"] = NewBuiltinFunction("del", func(m *Machine, args []Object) (Object, os.Error) {
+        deleted = true
+        return nil, nil
+    })
+    
+    m := interp.NewMachine()
+    m.BindGlobal("obj", NewDict())
+    if _, err := m.Run(newSetDel()); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    m = nil
+    if !collectUntil(interp, func() (bool) { return deleted }) {
+        t.Errorf("__del__ should be called once the object is garbage")
+    }
+}
+
+func TestGcModule(t *testing.T) {
+    interp := NewInterpreter()
+    gc, err := interp.Import("gc")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    m := interp.NewMachine()
+    call := func(name string, args ...Object) (string) {
+        result, err := m.CallObject(gc.Globals[name], args)
+        if err != nil {
+            return err.String()
+        }
+        return result.AsString()
+    }
+    
+    // The sum loop makes an object for each add and subtract.
+    s := new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 10)
+    call("collect")
+    _, used, _ := interp.NewMachine().RunBudget(s, Budget{})
+    if got, want := call("get_count"), "(" + pyInt(int64(used.Objects)).AsString() + ", 0, 0)"; got != want {
+        t.Errorf("expected the count to be %v, got %v", want, got)
+    }
+    if got := call("collect"); got != "0" || call("get_count") != "(0, 0, 0)" {
+        t.Errorf("expected nothing to be collected, and the count to be reset, got %v", got)
+    }
+    
+    if call("disable"); call("isenabled") != "0" {
+        t.Errorf("expected the collector to be disabled")
+    }
+    if call("set_threshold", intObject(10)); call("get_threshold") != "(10, 0, 0)" {
+        t.Errorf("expected the threshold to be 10, got %v", call("get_threshold"))
+    }
+    if got := call("set_threshold", intObject(0)); got[0:10] != "ValueError" {
+        t.Errorf("expected a ValueError, got %v", got)
+    }
+}
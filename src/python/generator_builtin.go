@@ -0,0 +1,273 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the generator built-in object
+   type.  Calling a generator function doesn't run its code, but makes a
+   generator that keeps the frame the code runs in.  Each time the generator
+   is resumed, a machine of its own runs the frame until a YIELD suspends it
+   again, and the frame, with its registers and its spill area, is saved
+   in the generator for the next time.  Coroutines are suspended and resumed
+   the same way.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+// Returned by Send when the generator has finished.
+var StopIteration os.Error = NewException(StopIterationClass)
+
+// A frame that runs a bit at a time, as the code of a generator or a coroutine does.
+type suspendedFrame struct {
+    // What runs the frame, for the errors, and the interpreter it runs for.
+    kind        string
+    interp      *Interpreter
+    
+    // The suspended frame, the frames of the calls it was in the middle of, and the
+    // instruction it resumes at.  The register sendReg gets the value sent in.
+    frame       Frame
+    frames      []Frame
+    pc          uint32
+    sendReg     uint32
+    
+    started     bool
+    running     bool
+    finished    bool
+    
+    // Set by YIELD and AWAIT, to tell a suspended frame from one that has returned.
+    // AWAIT runs again when the frame is resumed, and takes the value sent in from
+    // sent, rather than from a register.
+    yielded     bool
+    awaiting    bool
+    sent        Object
+    
+    // The value the frame returned, once it has finished, and the error it failed
+    // with, if it did.
+    Value       Object
+    Err         os.Error
+}
+
+// Runs the frame until it yields, and returns the value it yielded.  It fails with
+// StopIteration once it has returned.  The machine parent that resumes it, if any,
+// passes on its hooks and what is left of its recursion limit.
+func (o *suspendedFrame) resume(parent *Machine, value Object) (Object, os.Error) {
+    switch {
+        case o.finished:
+            return nil, StopIteration
+        case o.running:
+            return nil, Raise(ValueErrorClass, fmt.Sprintf("%v already executing", o.kind))
+        case !o.started && value != nil && value != None:
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("can't send non-None value to a just-started %v", o.kind))
+    }
+    if value == nil {
+        value = None
+    }
+    
+    m := new (Machine)
+    m.Interpreter = o.interp
+    if parent != nil {
+        if err := parent.inherit(m); err != nil {
+            return nil, err
+        }
+    }
+    
+    m.Frame = o.frame
+    m.Frames = o.frames
+    m.NextInstruction = o.pc
+    m.suspended = o
+    if m.budget != nil {
+        if err := m.budget.enter(m.budgetDepth + len(m.Frames) + 1); err != nil {
+            return nil, err
+        }
+    }
+    switch {
+        case o.awaiting:
+            o.sent = value
+        case o.started:
+            m.Register[o.sendReg] = value
+    }
+    
+    o.started = true
+    o.running = true
+    o.awaiting = false
+    result, err := m.Run(m.Code)
+    o.running = false
+    o.sent = nil
+    
+    switch {
+        case err != nil:
+            o.finished = true
+            o.Err = err
+            return nil, err
+        case !o.yielded:
+            if result == nil {
+                result = None
+            }
+            o.finished = true
+            o.Value = result
+            return nil, StopIteration
+    }
+    
+    o.yielded = false
+    o.frame = m.Frame
+    o.frames = m.Frames
+    o.pc = m.NextInstruction
+    return result, nil
+}
+
+type GeneratorObject struct {
+    ObjectData
+    suspendedFrame
+}
+
+func NewGenerator(f Frame) (*GeneratorObject) {
+    g := new(GeneratorObject)
+    g.ObjectData.Init()
+    g.kind = "generator"
+    g.frame = f
+    
+    return g
+}
+
+// Resumes the generator, with value as the value of the YIELD it is suspended at, and
+// returns the next value it yields.
+func (o *GeneratorObject) Send(value Object) (Object, os.Error) {
+    return o.resume(nil, value)
+}
+
+// A generator is its own iterator, as in Python.
+func (o *GeneratorObject) Iter() (Iterator) {
+    return o
+}
+
+// Returns the next value the generator yields, or false once it has finished.  If it
+// fails, Err is the error.
+func (o *GeneratorObject) Next() (Object, bool) {
+    value, err := o.resume(nil, None)
+    if err != nil {
+        return nil, false
+    }
+    return value, true
+}
+
+// A generator can't be converted to a number
+func (o *GeneratorObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *GeneratorObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert generator to string
+func (o *GeneratorObject) AsString() (string) {
+    return fmt.Sprintf("<generator object %v>", o.frame.Code.Name)
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A generator is only equal to itself, and generators are not ordered.
+func (o *GeneratorObject) Eq(r Object) (Object) {
+    g, ok := r.(*GeneratorObject)
+    return pyBool(ok && g == o)
+}
+
+func (o *GeneratorObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *GeneratorObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *GeneratorObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *GeneratorObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *GeneratorObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *GeneratorObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GeneratorObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GeneratorObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GeneratorObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GeneratorObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GeneratorObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GeneratorObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *GeneratorObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GeneratorObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GeneratorObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A generator is always true
+func (o *GeneratorObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *GeneratorObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *GeneratorObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *GeneratorObject) AsBool() (bool) {
+    return o.IsTrue()
+}
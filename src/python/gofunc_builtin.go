@@ -0,0 +1,229 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the Go function object type,
+   which lets Python code call any Go function, such as
+
+     interp.Builtins["upper"] = NewGoFunc("upper", strings.ToUpper)
+
+   The arguments are converted to the types of the parameters, and the
+   results back to objects, as convert.go describes.  A function with no
+   results returns None, and one with several returns a tuple of them.  An
+   os.Error as the last result isn't returned, but raised if it isn't nil:
+   as itself if it is an exception, and as a RuntimeError otherwise.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+        "reflect"
+)
+
+type GoFuncObject struct {
+    ObjectData
+    Name    string
+    Fn      reflect.Value
+}
+
+// Makes a function named name that calls fn, which has to be a Go function.
+func NewGoFunc(name string, fn interface{}) (*GoFuncObject) {
+    v := reflect.ValueOf(fn)
+    if v.Kind() != reflect.Func || v.IsNil() {
+        panic(fmt.Sprintf("python: NewGoFunc of %T, which isn't a function", fn))
+    }
+    
+    f := new(GoFuncObject)
+    f.ObjectData.Init()
+    f.Name = name
+    f.Fn = v
+    
+    return f
+}
+
+// Calls the Go function with the arguments converted to the types of its parameters.
+// Go functions only take positional arguments.
+func (o *GoFuncObject) Call(m *Machine, args []Object, kwnames []string, kwargs []Object) (Object, os.Error) {
+    if len(kwnames) > 0 {
+        return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() takes no keyword arguments", o.Name))
+    }
+    
+    t := o.Fn.Type()
+    fixed := t.NumIn()
+    if t.IsVariadic() {
+        fixed--
+    }
+    switch {
+        case t.IsVariadic() && len(args) < fixed:
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() takes at least %v arguments (%v given)", o.Name, fixed, len(args)))
+        case !t.IsVariadic() && len(args) != fixed:
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("%v() takes %v arguments (%v given)", o.Name, fixed, len(args)))
+    }
+    
+    in := make([]reflect.Value, len(args))
+    for i, arg := range args {
+        var param reflect.Type
+        if i < fixed {
+            param = t.In(i)
+        } else {
+            param = t.In(fixed).Elem()
+        }
+        v, err := toGo(arg, param)
+        if err != nil {
+            return nil, err
+        }
+        in[i] = v
+    }
+    
+    out := o.Fn.Call(in)
+    if n := len(out); n > 0 && t.Out(n-1) == errorType {
+        if !out[n-1].IsNil() {
+            return nil, goError(out[n-1].Interface().(os.Error))
+        }
+        out = out[:n-1]
+    }
+    
+    switch len(out) {
+        case 0:
+            return None, nil
+        case 1:
+            return fromGo(out[0])
+    }
+    items := make([]Object, len(out))
+    for i, v := range out {
+        item, err := fromGo(v)
+        if err != nil {
+            return nil, err
+        }
+        items[i] = item
+    }
+    return NewTuple(items), nil
+}
+
+// Returns the exception an error a Go function returned raises.
+func goError(err os.Error) (os.Error) {
+    if _, ok := err.(*BaseExceptionObject); ok {
+        return err
+    }
+    return Raise(RuntimeErrorClass, err.String())
+}
+
+// A Go function can't be converted to a number
+func (o *GoFuncObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *GoFuncObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert Go function to string
+func (o *GoFuncObject) AsString() (string) {
+    return fmt.Sprintf("<go function %v>", o.Name)
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A Go function is only equal to itself, and Go functions are not ordered.
+func (o *GoFuncObject) Eq(r Object) (Object) {
+    f, ok := r.(*GoFuncObject)
+    return pyBool(ok && f == o)
+}
+
+func (o *GoFuncObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *GoFuncObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *GoFuncObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *GoFuncObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *GoFuncObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *GoFuncObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GoFuncObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GoFuncObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GoFuncObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GoFuncObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GoFuncObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GoFuncObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *GoFuncObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GoFuncObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *GoFuncObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A Go function is always true
+func (o *GoFuncObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *GoFuncObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *GoFuncObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *GoFuncObject) AsBool() (bool) {
+    return o.IsTrue()
+}
@@ -0,0 +1,257 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the hashing that dicts and sets find their keys with,
+   which follows the rules of Python:
+
+     - Numbers are hashed modulo the prime 2**61-1, so numbers that are equal
+       have the same hash whatever their type, and hash(1) == hash(1.0).
+     - Strings and bytes are hashed with SipHash-1-3 and a 128 bit key that
+       is random, so that what a script puts in a dict can't be chosen to
+       collide.  Setting PYTHONHASHSEED to a number fixes the key, and 0 gives
+       the key Python uses for it, so the hashes are those of CPython.
+
+   Each interpreter has a key of its own.  Objects don't know the interpreter
+   they belong to, so the dicts and sets its machines build, and hash(), hash
+   strings with the key of the interpreter, and everything else hashes them
+   with a default key, which is made the same way.
+*/
+
+package python
+
+import (
+        "crypto/rand"
+        "encoding/binary"
+        "fmt"
+        "io"
+        "math"
+        "os"
+        "strconv"
+)
+
+// Numbers are hashed modulo the prime 2**61-1, as in Python, so that numbers that are
+// equal have the same hash whatever their type.
+const hashModulus = 1<<61 - 1
+
+// Returns the hash of the number with the magnitude x, modulo hashModulus, and the
+// sign negative.  -1 is never a hash, as in Python.
+func numberHash(x uint64, negative bool) (uint64) {
+    h := int64(x)
+    if negative {
+        h = -h
+    }
+    if h == -1 {
+        h = -2
+    }
+    return uint64(h)
+}
+
+// Returns the hash of the rational number v is, modulo hashModulus, as Python does, so
+// that a float with an integral value has the hash of the int.
+func floatHash(v float64) (uint64) {
+    switch {
+        case math.IsInf(v, 1):
+            return 314159
+        case math.IsInf(v, -1):
+            return numberHash(314159, true)
+        case math.IsNaN(v):
+            return 0
+    }
+
+    // Take the mantissa 28 bits at a time, multiplying by 2**28 modulo 2**61-1 as
+    // we go, which is a rotation of the 61 bits.
+    m, e := math.Frexp(math.Fabs(v))
+    var x uint64
+    for m != 0 {
+        x = (x<<28)&hashModulus | x>>(61-28)
+        m *= 1 << 28
+        e -= 28
+        y := uint64(m)
+        m -= float64(y)
+        x += y
+        if x >= hashModulus {
+            x -= hashModulus
+        }
+    }
+
+    // Multiply by 2**e.
+    if e >= 0 {
+        e %= 61
+    } else {
+        e = 61 - 1 - (-1-e)%61
+    }
+    x = (x<<uint(e))&hashModulus | x>>uint(61-e)
+
+    return numberHash(x, v < 0)
+}
+
+// The key strings and bytes are hashed with.
+type sipKey [2]uint64
+
+// The key of the dicts and sets made outside of an interpreter, and of the strings
+// hashed on their own.
+var defaultHashKey = newSipKey()
+
+// Returns a key fixed by PYTHONHASHSEED, if it is set to a number, and a random one
+// otherwise.
+func newSipKey() (*sipKey) {
+    k := new(sipKey)
+    if s := os.Getenv("PYTHONHASHSEED"); s != "" && s != "random" {
+        if seed, err := strconv.Atoui64(s); err == nil {
+            k.seed(seed)
+            return k
+        }
+    }
+
+    var buf [16]byte
+    if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+        panic(fmt.Sprintf("can't seed the string hash: %v", err))
+    }
+    k[0] = binary.LittleEndian.Uint64(buf[:8])
+    k[1] = binary.LittleEndian.Uint64(buf[8:])
+    return k
+}
+
+// Sets the key from a seed, as PYTHONHASHSEED does.  A seed of 0 is the key Python uses
+// for it, and any other seed is spread over the 128 bits of the key.
+func (k *sipKey) seed(seed uint64) {
+    k[0], k[1] = 0, 0
+    if seed == 0 {
+        return
+    }
+    for i := range k {
+        // splitmix64
+        seed += 0x9e3779b97f4a7c15
+        z := seed
+        z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+        z = (z ^ z>>27) * 0x94d049bb133111eb
+        k[i] = z ^ z>>31
+    }
+}
+
+// Fixes the key the interpreter hashes strings and bytes with, as PYTHONHASHSEED does.
+// It has to be called before any dict or set of the interpreter has a string in it,
+// since they won't find the strings they have after it.
+func (interp *Interpreter) SetHashSeed(seed uint64) {
+    interp.hashKey.seed(seed)
+}
+
+func sipRound(v0, v1, v2, v3 uint64) (uint64, uint64, uint64, uint64) {
+    v0 += v1
+    v1 = v1<<13 | v1>>51
+    v1 ^= v0
+    v0 = v0<<32 | v0>>32
+    v2 += v3
+    v3 = v3<<16 | v3>>48
+    v3 ^= v2
+    v0 += v3
+    v3 = v3<<21 | v3>>43
+    v3 ^= v0
+    v2 += v1
+    v1 = v1<<17 | v1>>47
+    v1 ^= v2
+    v2 = v2<<32 | v2>>32
+    return v0, v1, v2, v3
+}
+
+// Returns the SipHash-1-3 of s with the key k, which is what Python hashes strings and
+// bytes with.
+func sipHash(k *sipKey, s string) (uint64) {
+    v0 := k[0] ^ 0x736f6d6570736575
+    v1 := k[1] ^ 0x646f72616e646f6d
+    v2 := k[0] ^ 0x6c7967656e657261
+    v3 := k[1] ^ 0x7465646279746573
+
+    // The last word has the length in its top byte, under what is left of s.
+    last := uint64(len(s)) << 56
+    for ; len(s) >= 8; s = s[8:] {
+        var word uint64
+        for i := 7; i >= 0; i-- {
+            word = word<<8 | uint64(s[i])
+        }
+        v3 ^= word
+        v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+        v0 ^= word
+    }
+    for i := 0; i < len(s); i++ {
+        last |= uint64(s[i]) << (8 * uint(i))
+    }
+    v3 ^= last
+    v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+    v0 ^= last
+
+    v2 ^= 0xff
+    for i := 0; i < 3; i++ {
+        v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+    }
+    return v0 ^ v1 ^ v2 ^ v3
+}
+
+// Returns the hash of the string s with the key k, or the default key if k is nil.
+// The empty string hashes to 0 and -1 is never a hash, as in Python.  A string is
+// hashed by its UTF-8 bytes, so only the hashes of ASCII strings are those of CPython.
+func hashString(k *sipKey, s string) (uint64) {
+    if len(s) == 0 {
+        return 0
+    }
+    if k == nil {
+        k = defaultHashKey
+    }
+    h := sipHash(k, s)
+    if int64(h) == -1 {
+        h--
+    }
+    return h
+}
+
+// Returns the hash of b, which is the hash of the string with the same bytes.
+func hashBytes(k *sipKey, b []byte) (uint64) {
+    return hashString(k, string(b))
+}
+
+// Returns the hash of o, with the strings in it hashed with the key k, or the default
+// key if k is nil.
+func hashObject(o Object, k *sipKey) (uint64, os.Error) {
+    switch v := o.(type) {
+        case *StringObject:
+            return hashString(k, v.Value), nil
+        case *TupleObject:
+            return v.hash(k)
+    }
+    return o.Hash()
+}
+
+// Returns the key the machine hashes strings with, which is the key of its interpreter.
+func (m *Machine) hashKey() (*sipKey) {
+    if m.Interpreter == nil {
+        return nil
+    }
+    return m.Interpreter.hashKey
+}
+
+// Adds hash() to the builtins of the interpreter.
+func (interp *Interpreter) addHashBuiltins() {
+    interp.Builtins["hash"] = NewBuiltinFunction("hash", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 1 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("hash() takes exactly one argument (%v given)", len(args)))
+        }
+        h, err := hashObject(args[0], m.hashKey())
+        if err != nil {
+            return nil, err
+        }
+        return NewInt(int64(h)), nil
+    })
+}
@@ -14,34 +14,111 @@
    limitations under the License.
    --------------------------------------------------------------------
 
+
    This file provides the implementation of the integer built-in object
-   type.
+   type.  An int is kept in an int64 while it fits in one, so that most
+   arithmetic doesn't allocate a big.Int, and is promoted to a big.Int when
+   an operation overflows.
 */
 
 package python
 
-import "big"
+import (
+        "big"
+        "math"
+        "os"
+        "strconv"
+)
 
+// Small holds the value while it fits in an int64, and Big is nil.  Once it doesn't,
+// Big holds it, and Small isn't used.  An int that fits is never kept in Big, so each
+// value has a single representation.  isBool is only set for True and False.
 type IntObject struct {
     ObjectData
-    *big.Int 
+    Small   int64
+    Big     *big.Int
+    isBool  bool
 }
 
+// The ints from smallIntMin to smallIntMax are the ones programs use the most, so each
+// interpreter makes them once, and the constants of its modules share them.  See
+// Interpreter.Int.
+const smallIntMin = -5
+const smallIntMax = 256
+
+// Returns a new int of 0.
 func NewIntObject() (*IntObject) {
+    return NewInt(0)
+}
+
+func NewInt(v int64) (*IntObject) {
     r := new (IntObject)
-    r.Int = big.NewInt(0)
+    r.ObjectData.Init()
+    r.Small = v
     
     return r
 }
 
-// Convert int to int (identity transform)
+// Returns a new int of v, which the int may keep, so v mustn't be changed afterwards.
+func NewBigInt(v *big.Int) (*IntObject) {
+    if v.Cmp(minInt64) >= 0 && v.Cmp(maxInt64) <= 0 {
+        return NewInt(v.Int64())
+    }
+    
+    r := new (IntObject)
+    r.ObjectData.Init()
+    r.Big = v
+    
+    return r
+}
+
+// Returns true if the int fits in an int64.
+func (o *IntObject) IsSmall() (bool) {
+    return o.Big == nil
+}
+
+// Returns the value of the int, truncated to 64 bits if it doesn't fit.
+func (o *IntObject) Int64() (int64) {
+    if o.Big != nil {
+        return o.Big.Int64()
+    }
+    return o.Small
+}
+
+func (o *IntObject) Sign() (int) {
+    switch {
+        case o.Big != nil:
+            return o.Big.Sign()
+        case o.Small < 0:
+            return -1
+        case o.Small > 0:
+            return 1
+    }
+    return 0
+}
+
+func (o *IntObject) String() (string) {
+    if o.Big != nil {
+        return o.Big.String()
+    }
+    return strconv.Itoa64(o.Small)
+}
+
+// Returns the value as a big.Int, which may be the int's own, so it mustn't be changed.
 func (o *IntObject) AsInt() (*big.Int) {
-    return o.Int
+    if o.Big != nil {
+        return o.Big
+    }
+    return big.NewInt(o.Small)
 }
 
-// Convert int to float
+// Convert int to float.  An int too large for a float is an infinity.
 func (o *IntObject) AsFloat() (float64) {
-    return float64(o.Int64())
+    if o.Big != nil {
+        f, _ := strconv.Atof64(o.Big.String())
+        return f
+    }
+    return float64(o.Small)
 }
 
 // Convert int to string
@@ -49,81 +126,340 @@ func (o *IntObject) AsString() (string) {
     return o.String()
 }
 
+// The checked arithmetic of the int64s of small ints.  ok is false if the result
+// overflows.
+
+func addInt64(l, r int64) (result int64, ok bool) {
+    result = l + r
+    return result, (l >= 0) != (r >= 0) || (result >= 0) == (l >= 0)
+}
+
+func subInt64(l, r int64) (result int64, ok bool) {
+    result = l - r
+    return result, (l >= 0) == (r >= 0) || (result >= 0) == (l >= 0)
+}
+
+func mulInt64(l, r int64) (result int64, ok bool) {
+    result = l * r
+    return result, l == 0 || result/l == r && !(l == -1 && r == math.MinInt64)
+}
+
+// Returns l // r and l % r, as floorDivMod does, for r other than 0.
+func floorDivModInt64(l, r int64) (q, m int64, ok bool) {
+    if l == math.MinInt64 && r == -1 {
+        return 0, 0, false
+    }
+    q, m = l / r, l % r
+    if m != 0 && (m < 0) != (r < 0) {
+        q, m = q-1, m+r
+    }
+    return q, m, true
+}
+
+// Raises l to the power r, which isn't negative, by squaring.
+func powInt64(l, r int64) (result int64, ok bool) {
+    result = 1
+    for r > 0 {
+        if r&1 == 1 {
+            if result, ok = mulInt64(result, l); !ok {
+                return
+            }
+        }
+        r >>= 1
+        if r > 0 {
+            if l, ok = mulInt64(l, l); !ok {
+                return
+            }
+        }
+    }
+    return result, true
+}
+
+// Compares the int with r, using the int64s if both are small.
+func (o *IntObject) cmp(r Object) (int) {
+    if p, ok := r.(*IntObject); ok && o.Big == nil && p.Big == nil {
+        switch {
+            case o.Small < p.Small:
+                return -1
+            case o.Small > p.Small:
+                return 1
+        }
+        return 0
+    }
+    return o.AsInt().Cmp(r.AsInt())
+}
 
 ///////// Rich Comparison Interface ///////////
 
-func (o *IntObject) Lt(r Object) (bool) {
-    return o.Cmp(r.AsInt()) == -1
+// An int is compared with an int or a float, which compares them exactly, as the float
+// sees it.  A complex compares itself with an int, so anything else is NotImplemented.
+func (o *IntObject) compare(op uint32, r Object) (Object) {
+    switch n := r.(type) {
+        case *IntObject:
+            return comparison(op, o.cmp(r))
+        case *FloatObject:
+            return compareFloat(reflectedCompares[op], n.Value, o)
+    }
+    return NotImplemented
 }
 
-func (o *IntObject) Gt(r Object) (bool) {
-    return o.Cmp(r.AsInt()) == 1
+func (o *IntObject) Lt(r Object) (Object) {
+    return o.compare(LT, r)
 }
 
-func (o *IntObject) Eq(r Object) (bool) {
-    return o.Cmp(r.AsInt()) == 0
+func (o *IntObject) Gt(r Object) (Object) {
+    return o.compare(GT, r)
 }
 
-func (o *IntObject) Neq(r Object) (bool) {
-    return o.Cmp(r.AsInt()) != 0
+func (o *IntObject) Eq(r Object) (Object) {
+    return o.compare(EQ, r)
 }
 
-func (o *IntObject) Lte(r Object) (bool) {
-    return o.Cmp(r.AsInt()) <= 0
+func (o *IntObject) Neq(r Object) (Object) {
+    return o.compare(NE, r)
 }
 
-func (o *IntObject) Gte(r Object) (bool) {
-    return o.Cmp(r.AsInt()) >= 0
+func (o *IntObject) Lte(r Object) (Object) {
+    return o.compare(LE, r)
+}
+
+func (o *IntObject) Gte(r Object) (Object) {
+    return o.compare(GE, r)
 }
 
 ///////// Binary Arithmetic Interface ///////////
 
-func (o *IntObject) Add(r Object) (Object) {
-    result := NewIntObject()
-    result.Int.Add(o.Int, r.AsInt())
+// The operations on ints only take an int on the right.  An int and a float on the
+// left is promoted to a float before it gets here.  Two small ints are worked on as
+// int64s, unless the result overflows, and everything else as big.Ints.
+
+func (o *IntObject) Add(r Object) (Object, os.Error) {
+    p, ok := r.(*IntObject)
+    if !ok {
+        return nil, nil
+    }
+    if o.Big == nil && p.Big == nil {
+        if v, ok := addInt64(o.Small, p.Small); ok {
+            return NewInt(v), nil
+        }
+    }
     
-    return result
+    return NewBigInt(new (big.Int).Add(o.AsInt(), p.AsInt())), nil
 }
 
-func (o *IntObject) Sub(r Object) (Object) {
-    result := NewIntObject()
-    result.Int.Sub(o.Int, r.AsInt())
+func (o *IntObject) Sub(r Object) (Object, os.Error) {
+    p, ok := r.(*IntObject)
+    if !ok {
+        return nil, nil
+    }
+    if o.Big == nil && p.Big == nil {
+        if v, ok := subInt64(o.Small, p.Small); ok {
+            return NewInt(v), nil
+        }
+    }
     
-    return result
+    return NewBigInt(new (big.Int).Sub(o.AsInt(), p.AsInt())), nil
 }
 
-func (o *IntObject) Mul(r Object) (Object) {
-    result := NewIntObject()
-    result.Int.Mul(o.Int, r.AsInt())
+func (o *IntObject) Mul(r Object) (Object, os.Error) {
+    p, ok := r.(*IntObject)
+    if !ok {
+        return nil, nil
+    }
+    if o.Big == nil && p.Big == nil {
+        if v, ok := mulInt64(o.Small, p.Small); ok {
+            return NewInt(v), nil
+        }
+    }
     
-    return result
+    return NewBigInt(new (big.Int).Mul(o.AsInt(), p.AsInt())), nil
 }
 
-func (o *IntObject) Div(r Object) (Object) {
+func (o *IntObject) Div(r Object) (Object, os.Error) {
     // Python says that the result of a '/' operation
     // is always a FloatObject, irregardless of whether
     // the input is an integer or float
-    result := new (FloatObject)
-    result.Value = float64(o.Int.Int64()) / r.AsFloat()
+    p, ok := r.(*IntObject)
+    if !ok {
+        return nil, nil
+    }
+    if p.Sign() == 0 {
+        return nil, Raise(ZeroDivisionErrorClass, "division by zero")
+    }
+    
+    return NewFloat(o.AsFloat() / p.AsFloat()), nil
+}
+
+// Returns the quotient and the remainder of a and b, rounded towards negative
+// infinity, as in Python.  big.Int rounds towards zero, or by Euclid.
+func floorDivMod(a, b *big.Int) (*big.Int, *big.Int) {
+    q, m := new (big.Int), new (big.Int)
+    q.QuoRem(a, b, m)
+    if m.Sign() != 0 && m.Sign() != b.Sign() {
+        q.Sub(q, big.NewInt(1))
+        m.Add(m, b)
+    }
+    return q, m
+}
+
+// Returns o // p and o % p, or raises a ZeroDivisionError.
+func (o *IntObject) divMod(p *IntObject) (q, m *IntObject, err os.Error) {
+    if p.Sign() == 0 {
+        return nil, nil, Raise(ZeroDivisionErrorClass, "integer division or modulo by zero")
+    }
+    if o.Big == nil && p.Big == nil {
+        if q, m, ok := floorDivModInt64(o.Small, p.Small); ok {
+            return NewInt(q), NewInt(m), nil
+        }
+    }
     
-    return result
+    big_q, big_m := floorDivMod(o.AsInt(), p.AsInt())
+    return NewBigInt(big_q), NewBigInt(big_m), nil
 }
 
-func (o *IntObject) FloorDiv(r Object) (Object) {
+func (o *IntObject) FloorDiv(r Object) (Object, os.Error) {
     // This is the // operation, which results in an 
     // integer.
-    result := NewIntObject()    
-    result.Int.Div(o.Int, r.AsInt())
+    p, ok := r.(*IntObject)
+    if !ok {
+        return nil, nil
+    }
+    
+    q, _, err := o.divMod(p)
+    if err != nil {
+        return nil, err
+    }
+    return q, nil
+}
+
+// The result of % has the sign of the right operand.
+func (o *IntObject) Mod(r Object) (Object, os.Error) {
+    p, ok := r.(*IntObject)
+    if !ok {
+        return nil, nil
+    }
+    
+    _, m, err := o.divMod(p)
+    if err != nil {
+        return nil, err
+    }
+    return m, nil
+}
+
+// A negative power of an int is a float, as in Python.
+func (o *IntObject) Pow(r Object) (Object, os.Error) {
+    p, ok := r.(*IntObject)
+    if !ok {
+        return nil, nil
+    }
+    if p.Sign() < 0 {
+        return NewFloat(o.AsFloat()).Pow(r)
+    }
+    if o.Big == nil && p.Big == nil {
+        if v, ok := powInt64(o.Small, p.Small); ok {
+            return NewInt(v), nil
+        }
+    }
+    
+    return NewBigInt(new (big.Int).Exp(o.AsInt(), p.AsInt(), nil)), nil
+}
+
+// pow(o, p, mod), which is o ** p % mod, without working out the whole power.  The
+// result has the sign of mod, as for %.
+func (o *IntObject) PowMod(p, mod *IntObject) (Object, os.Error) {
+    if mod.Sign() == 0 {
+        return nil, Raise(ValueErrorClass, "pow() 3rd argument cannot be 0")
+    }
+    if p.Sign() < 0 {
+        return nil, Raise(ValueErrorClass, "pow() 2nd argument cannot be negative when 3rd argument specified")
+    }
+    
+    result := new (big.Int).Exp(o.AsInt(), p.AsInt(), new (big.Int).Abs(mod.AsInt()))
+    _, result = floorDivMod(result, mod.AsInt())
+    
+    return NewBigInt(result), nil
+}
+
+// divmod(o, r), the tuple of o // r and o % r.
+func (o *IntObject) Divmod(r Object) (Object, os.Error) {
+    p, ok := r.(*IntObject)
+    if !ok {
+        return nil, nil
+    }
     
-    return result
+    q, m, err := o.divMod(p)
+    if err != nil {
+        return nil, err
+    }
+    return NewTuple([]Object{q, m}), nil
 }
 
-func (o *IntObject) Mod(r Object) (Object) {
-    result := NewIntObject()
-    result.Int.Mod(o.Int, r.AsInt())
+///////// Unary Arithmetic Interface ///////////
+
+func (o *IntObject) Neg() (Object, os.Error) {
+    if o.Big == nil && o.Small != math.MinInt64 {
+        return NewInt(-o.Small), nil
+    }
     
-    return result
+    return NewBigInt(new (big.Int).Neg(o.AsInt())), nil
 }
 
+// +True is 1, an int rather than a bool.
+func (o *IntObject) Pos() (Object, os.Error) {
+    if o.isBool {
+        return NewInt(o.Small), nil
+    }
+    return o, nil
+}
 
+// ~x is -x - 1, as for a two's complement integer of any size.
+func (o *IntObject) Invert() (Object, os.Error) {
+    if o.Big == nil {
+        return NewInt(^o.Small), nil
+    }
+    
+    result := new (big.Int).Neg(o.Big)
+    result.Sub(result, big.NewInt(1))
+    
+    return NewBigInt(result), nil
+}
 
+func (o *IntObject) IsTrue() (bool) {
+    return o.Sign() != 0
+}
+
+///////// Protocol Interface ///////////
+
+func (o *IntObject) Hash() (uint64, os.Error) {
+    if o.Big == nil {
+        x := uint64(o.Small)
+        if o.Small < 0 {
+            x = -x
+        }
+        return numberHash(x % hashModulus, o.Small < 0), nil
+    }
+    
+    x := new (big.Int).Abs(o.Big)
+    x.Mod(x, big.NewInt(hashModulus))
+    
+    return numberHash(uint64(x.Int64()), o.Sign() < 0), nil
+}
+
+// A bool is written as True or False, though it is 1 or 0 when it is used as a number.
+func (o *IntObject) Repr() (string) {
+    switch {
+        case o.isBool && o.Small != 0:
+            return "True"
+        case o.isBool:
+            return "False"
+    }
+    return o.AsString()
+}
+
+func (o *IntObject) Str() (string) {
+    return o.Repr()
+}
+
+func (o *IntObject) AsBool() (bool) {
+    return o.IsTrue()
+}
@@ -0,0 +1,277 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the interpreter, which holds everything that the
+   modules run by it share: the builtins, the modules that have been
+   imported and the table of interned strings.  Nothing that code run by one
+   interpreter can change is shared with another, so a program can run as
+   many interpreters side by side as it likes, each on a goroutine of its
+   own.
+
+   The machines of one interpreter can run on several goroutines too, as
+   Python threads do.  The objects of an interpreter, such as its lists and
+   dicts, are not safe to change from several goroutines at once, so they
+   are protected by a single lock of the interpreter, like the global
+   interpreter lock of CPython.  A machine holds the lock while it runs, and
+   lets go of it now and then, and while it waits, so the others get their
+   turn.
+*/
+
+package python
+
+import (
+        "bytes"
+        "fmt"
+        "io"
+        "io/ioutil"
+        "os"
+        "path/filepath"
+        "strings"
+        "sync"
+)
+
+// The number of instructions a machine runs before it lets the other machines of its
+// interpreter have the lock.
+const SwitchInterval = 100
+
+type Interpreter struct {
+    // The names every module can use without binding them, which are looked up once
+    // a name isn't found in the globals.
+    Builtins    map[string]Object
+    
+    // The modules that have been imported, by name, and the directories Import
+    // looks for them in.
+    Modules     map[string]*ModuleCode
+    Path        []string
+    
+    // Where print() writes, which is os.Stdout if it is nil.
+    Stdout      io.Writer
+    
+    // The interned strings, by value, and the small ints, which the constants of the
+    // modules share, so loading them doesn't make new objects.  They belong to the
+    // interpreter, as attributes can be set on them.
+    strings     map[string]*StringObject
+    ints        []IntObject
+    
+    // The key strings are hashed with, as described in hash.go.
+    hashKey     *sipKey
+    
+    // The finalizers, as described in gc.go.
+    gc          *collector
+    
+    lock        sync.Mutex
+}
+
+func NewInterpreter() (*Interpreter) {
+    interp := new (Interpreter)
+    interp.Builtins = map[string]Object{"None": None, "NotImplemented": NotImplemented}
+    interp.Modules = make(map[string]*ModuleCode)
+    interp.strings = make(map[string]*StringObject)
+    interp.ints = make([]IntObject, smallIntMax - smallIntMin + 1)
+    for i := range interp.ints {
+        interp.ints[i].ObjectData.Init()
+        interp.ints[i].Small = int64(i + smallIntMin)
+    }
+    interp.hashKey = newSipKey()
+    interp.gc = newCollector()
+    interp.addBuiltins()
+    interp.addExceptionBuiltins()
+    interp.addNumberBuiltins()
+    interp.addHashBuiltins()
+    interp.addSliceBuiltins()
+    interp.addRangeBuiltins()
+    interp.addIteratorBuiltins()
+    interp.addClassBuiltins()
+    interp.addDescriptorBuiltins()
+    interp.addAttributeBuiltins()
+    interp.addThreadBuiltins()
+    interp.addGcModule()
+    
+    return interp
+}
+
+// Takes the lock of the interpreter.  Go code has to hold it to use the objects of the
+// interpreter while its machines may be running.  A machine that is running holds it
+// already.
+func (interp *Interpreter) Lock() {
+    interp.lock.Lock()
+}
+
+func (interp *Interpreter) Unlock() {
+    interp.lock.Unlock()
+}
+
+// Returns the string object for s.  Every string interned with the same value is the
+// same object.
+func (interp *Interpreter) Intern(s string) (*StringObject) {
+    o, present := interp.strings[s]
+    if !present {
+        o = NewString(s)
+        interp.strings[s] = o
+    }
+    return o
+}
+
+// Returns an int of v, which is the one the interpreter shares if v is a small int.
+func (interp *Interpreter) Int(v int64) (*IntObject) {
+    if v < smallIntMin || v > smallIntMax {
+        return NewInt(v)
+    }
+    return &interp.ints[v - smallIntMin]
+}
+
+// Returns o, with the strings in it, if it is a string or a tuple, interned, and the
+// small ints in it shared.
+func (interp *Interpreter) internConstant(o Object) (Object) {
+    switch c := o.(type) {
+        case *StringObject:
+            return interp.Intern(c.Value)
+        case *IntObject:
+            if !c.IsBool() && c.IsSmall() && c.Small >= smallIntMin && c.Small <= smallIntMax {
+                return interp.Int(c.Small)
+            }
+        case *TupleObject:
+            for i, item := range c.Items {
+                c.Items[i] = interp.internConstant(item)
+            }
+    }
+    return o
+}
+
+// Returns a machine that runs code for the interpreter.
+func (interp *Interpreter) NewMachine() (*Machine) {
+    m := new (Machine)
+    m.Interpreter = interp
+    
+    return m
+}
+
+// Adds the module to the modules of the interpreter, under its name, and interns the
+// strings and shares the small ints among its constants.  Go code has to hold the lock
+// of the interpreter to add a module while its machines may be running.
+func (interp *Interpreter) AddModule(mod *ModuleCode) {
+    for _, c := range mod.Code {
+        for i, o := range c.Constants {
+            c.Constants[i] = interp.internConstant(o)
+        }
+    }
+    interp.Modules[mod.Name] = mod
+}
+
+// Loads the module name from the file at path.  A .pyc file compiled by CPython is
+// translated.  The compiled form of a file is kept next to it, and is used as long as
+// the file hasn't changed, so a .pyc file is only translated again when it changes.
+func (interp *Interpreter) LoadFile(name, path string) (*ModuleCode, os.Error) {
+    src, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    fi, err := os.Stat(path)
+    if err != nil {
+        return nil, err
+    }
+    
+    stamp := StampSource(src, fi.Mtime_ns)
+    mod, err := LoadCached(CachePath(path), stamp)
+    if err == nil {
+        mod.Name = name
+        return mod, nil
+    }
+    
+    if strings.HasSuffix(path, ".pyc") {
+        py, err := ReadPyc(bytes.NewBuffer(src))
+        if err != nil {
+            return nil, err
+        }
+        mod, err := TranslatePyc(name, py)
+        if err != nil {
+            return nil, err
+        }
+        
+        // The cache only saves translating the module the next time, so a module that
+        // can't be cached, say in a directory that can't be written, is still loaded.
+        mod.SaveCached(CachePath(path), stamp)
+        return mod, nil
+    }
+    
+    // The syntax errors are returned, rather than written to os.Stderr.
+    var errors []string
+    p := new (Parser).Init(path, bytes.NewBuffer(src))
+    p.Error = func(p *Parser, pos Position, msg string) {
+        errors = append(errors, fmt.Sprintf("%v: %v", pos, msg))
+    }
+    p.Parse()
+    if len(errors) > 0 {
+        return nil, os.NewError(strings.Join(errors, "\n"))
+    }
+    return nil, os.NewError(fmt.Sprintf("%v: there is no compiled module for the source: %v", path, err))
+}
+
+// Returns the module name, importing it if it hasn't been imported yet.  The module
+// is looked for in each directory of Path in turn, as a source file and then as a
+// .pyc file, and the first that loads is run.  If none of the files found loads, the
+// error is the one the first of them failed with.  A module whose body fails isn't
+// kept.  Import takes the lock of the interpreter to look the module up and to add it,
+// and the machine that runs the module takes it again, so Import must not be called by
+// Go code that holds it.
+func (interp *Interpreter) Import(name string) (*ModuleCode, os.Error) {
+    interp.Lock()
+    mod, present := interp.Modules[name]
+    interp.Unlock()
+    if present {
+        return mod, nil
+    }
+    
+    var load_err os.Error
+    for _, dir := range interp.Path {
+        for _, ext := range []string{".py", ".pyc"} {
+            path := filepath.Join(dir, name+ext)
+            if _, err := os.Stat(path); err != nil {
+                continue
+            }
+            
+            mod, err := interp.LoadFile(name, path)
+            if err != nil {
+                if load_err == nil {
+                    load_err = err
+                }
+                continue
+            }
+            
+            // Another machine may have imported the module while it was loaded.
+            interp.Lock()
+            if other, present := interp.Modules[name]; present {
+                interp.Unlock()
+                return other, nil
+            }
+            interp.AddModule(mod)
+            interp.Unlock()
+            
+            if _, err := interp.NewMachine().RunModule(mod); err != nil {
+                interp.Lock()
+                interp.Modules[name] = nil, false
+                interp.Unlock()
+                return nil, err
+            }
+            return mod, nil
+        }
+    }
+    
+    if load_err != nil {
+        return nil, load_err
+    }
+    return nil, Raise(ImportErrorClass, fmt.Sprintf("No module named '%v'", name))
+}
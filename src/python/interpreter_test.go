@@ -0,0 +1,280 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the interpreter.
+
+*/
+
+package python
+
+import (
+        "io/ioutil"
+        "os"
+        "path"
+        "strings"
+        "testing"
+)
+
+func TestInterpreterBuiltins(t *testing.T) {
+    interp := NewInterpreter()
+    interp.Builtins["answer"] = intObject(42)
+    
+    s := new (CodeObject)
+    s.Init()
+    s.WriteLoad("answer", 1, false, 0)
+    s.WriteHalt(1, false, 0)
+    
+    result, err := interp.NewMachine().Run(s)
+    if err != nil || result.AsString() != "42" {
+        t.Errorf("expected the builtin answer to be 42, got %v, %v", result, err)
+    }
+    
+    // A global hides the builtin, and a machine without an interpreter has no builtins.
+    m := interp.NewMachine()
+    m.BindGlobal("answer", intObject(1))
+    if result, err = m.Run(s); err != nil || result.AsString() != "1" {
+        t.Errorf("expected the global answer to be 1, got %v, %v", result, err)
+    }
+    if _, err = new (Machine).Run(s); err == nil {
+        t.Errorf("a machine without an interpreter shouldn't find answer")
+    }
+    
+    if interp.Intern("x") != interp.Intern("x") || interp.Intern("x") == NewInterpreter().Intern("x") {
+        t.Errorf("interned strings should be shared by an interpreter, and only by it")
+    }
+    if interp.Int(256) != interp.Int(256) || interp.Int(257) == interp.Int(257) || interp.Int(1) == NewInterpreter().Int(1) || NewInt(1) == NewInt(1) {
+        t.Errorf("the small ints should be shared by an interpreter, and only by it")
+    }
+    
+    // The constants of the modules of an interpreter are its own strings and small ints.
+    mod := new (ModuleCode)
+    mod.Init("caches")
+    a, b := mod.NewCode("a"), mod.NewCode("b")
+    for _, c := range []*CodeObject{a, b} {
+        c.WriteConst(NewInt(7), 1, false, 0)
+        c.WriteConst(NewString("x"), 2, false, 0)
+    }
+    interp.AddModule(mod)
+    for _, c := range []*CodeObject{a, b} {
+        if c.Constants[0] != Object(interp.Int(7)) || c.Constants[1] != Object(interp.Intern("x")) {
+            t.Errorf("the constants of %v should be shared, got %v", c.Name, c.Constants)
+        }
+    }
+}
+
+func TestInterpreterImport(t *testing.T) {
+    a, b := NewInterpreter(), NewInterpreter()
+    a.Path = []string{"test_data"}
+    b.Path = []string{"test_data"}
+    
+    // The source of the module has no compiled form, so the .pyc file is used.
+    mod, err := a.Import("pyc_sample")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if again, _ := a.Import("pyc_sample"); again != mod {
+        t.Errorf("importing a module again should give the module already imported")
+    }
+    if got := mod.Globals["z"]; got == nil || got.AsString() != "7" {
+        t.Errorf("expected the module to have run, and bound z to 7, got %v", got)
+    }
+    
+    // Each interpreter has its own copy of the module.
+    other, err := b.Import("pyc_sample")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    mod.Globals["z"] = intObject(0)
+    if other == mod || other.Globals["z"].AsString() != "7" {
+        t.Errorf("interpreters should not share modules")
+    }
+    
+    if _, err = a.Import("missing"); err == nil || !strings.HasPrefix(err.String(), "ImportError") {
+        t.Errorf("importing a missing module should be an ImportError, got %v", err)
+    }
+    if _, err = a.Import("pyc_try"); err == nil {
+        t.Errorf("importing a module that can't be translated should fail")
+    }
+    if _, present := a.Modules["pyc_try"]; present {
+        t.Errorf("a module that failed to import should not be kept")
+    }
+    
+    // The syntax errors of a source file are in the error.
+    if _, err = a.Import("bad_syntax"); err == nil || !strings.Contains(err.String(), "bad_syntax.py:2:0: unexpected") {
+        t.Errorf("expected the syntax error of bad_syntax.py, got %v", err)
+    }
+}
+
+// A translated .pyc file is cached next to it, and the cache is used until the file
+// changes.
+func TestLoadFileCache(t *testing.T) {
+    dir := path.Join(os.TempDir(), "gpyc_load_test")
+    os.RemoveAll(dir)
+    if err := os.Mkdir(dir, 0755); err != nil {
+        t.Fatalf("can't make %v: %v", dir, err)
+    }
+    defer os.RemoveAll(dir)
+    
+    pyc, _ := ioutil.ReadFile("test_data/pyc_sample.pyc")
+    file := path.Join(dir, "sample.pyc")
+    ioutil.WriteFile(file, pyc, 0644)
+    
+    interp := NewInterpreter()
+    mod, err := interp.LoadFile("sample", file)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    fi, _ := os.Stat(file)
+    stamp := StampSource(pyc, fi.Mtime_ns)
+    cached, err := LoadCached(CachePath(file), stamp)
+    if err != nil || len(cached.Code) != len(mod.Code) {
+        t.Fatalf("the translated module should have been cached, got %v", err)
+    }
+    if names, _ := ioutil.ReadDir(dir); len(names) != 2 {
+        t.Errorf("the temporary file of the cache should be gone, found %v files", len(names))
+    }
+    
+    // The cache is used, rather than the .pyc file, as long as the file is the same.
+    newSavedModule().SaveCached(CachePath(file), stamp)
+    if mod, err = interp.LoadFile("sample", file); err != nil || mod.Name != "sample" || mod.Code[0].Filename != "saved.py" {
+        t.Errorf("expected the cached module, got %v", err)
+    }
+    m := interp.NewMachine()
+    if _, err := m.RunModule(mod); err != nil {
+        t.Errorf("the cached module failed: %v", err)
+    }
+}
+
+// Interpreters can run side by side, since they share nothing.
+func TestInterpreterConcurrency(t *testing.T) {
+    done := make(chan string)
+    for i := 0; i < 4; i++ {
+        go func() {
+            interp := NewInterpreter()
+            interp.Path = []string{"test_data"}
+            mod, err := interp.Import("pyc_generator")
+            if err != nil {
+                done <- err.String()
+                return
+            }
+            done <- mod.Globals["total"].AsString()
+        }()
+    }
+    for i := 0; i < 4; i++ {
+        if got := <-done; got != "10" {
+            t.Errorf("expected each interpreter to compute 10, got %v", got)
+        }
+    }
+}
+
+// Builds def count(lock, n), which adds n to counts["n"] a step at a time, holding lock
+// for each step, and returns 0.
+func newCountFunction(mod *ModuleCode) (*FunctionObject) {
+    s := mod.NewCode("count")
+    s.NameIndex("lock")
+    s.NameIndex("n")
+    s.NumParams = 2
+    
+    s.WriteConst(intObject(1), 9, false, 0)
+    s.WriteConst(intObject(0), 10, false, 0)
+    s.WriteConst(NewString("n"), 7, false, 0)
+    top := s.Here()
+    s.WriteConst(NewString("acquire"), 3, false, 0)
+    s.WriteGet(1, 3, 4, false, 0)
+    s.WriteCallFunction(4, 0, 0, 5, false, 0)
+    s.WriteLoad("counts", 6, false, 0)
+    s.WriteIndex(6, 7, 8, false, 0)
+    s.WriteAluIns(ADD,8,9,8,false,0)
+    s.WriteStoreIndex(6, 7, 8, false, 0)
+    s.WriteConst(NewString("release"), 3, false, 0)
+    s.WriteGet(1, 3, 4, false, 0)
+    s.WriteCallFunction(4, 0, 0, 5, false, 0)
+    s.WriteAluIns(SUB,2,9,2,false,0)
+    s.WriteCompare(GT, 2, 10, 11, false, 0)
+    s.PatchJump(s.WriteJump(true, 11), top)
+    s.WriteRet(2, false, 0)
+    
+    return NewFunction(s, nil, mod.Globals)
+}
+
+func TestInterpreterThreads(t *testing.T) {
+    interp := NewInterpreter()
+    mod := new (ModuleCode)
+    mod.Init("test")
+    counts := NewDict()
+    counts.Set(NewString("n"), intObject(0))
+    mod.Globals["counts"] = counts
+    count := newCountFunction(mod)
+    
+    m := interp.NewMachine()
+    lock, err := m.CallObject(interp.Builtins["allocate_lock"], nil)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    
+    // The threads hold the lock of the interpreter in turn, and the lock they share
+    // keeps them from losing each other's updates.
+    var threads []*ThreadObject
+    for i := 0; i < 4; i++ {
+        args := NewTuple([]Object{lock, intObject(500)})
+        thread, err := m.CallObject(interp.Builtins["start_new_thread"], []Object{count, args})
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        threads = append(threads, thread.(*ThreadObject))
+    }
+    for _, thread := range threads {
+        result, err := m.CallObject(thread.Attrs["join"], nil)
+        if err != nil || result.AsString() != "0" {
+            t.Errorf("expected the thread to return 0, got %v, %v", result, err)
+        }
+    }
+    if got := counts.Values[0].AsString(); got != "2000" {
+        t.Errorf("expected the threads to count to 2000, got %v", got)
+    }
+    
+    // A thread that fails keeps the error, for join to return.
+    thread := interp.StartThread(count, []Object{intObject(1), intObject(1)})
+    thread.Wait()
+    if _, err = m.CallObject(thread.Attrs["join"], nil); err == nil || err != thread.Err {
+        t.Errorf("expected join to return the error the thread failed with, got %v", err)
+    }
+}
+
+func TestLock(t *testing.T) {
+    m := NewInterpreter().NewMachine()
+    l := NewLock()
+    
+    call := func(name string, args ...Object) (string) {
+        result, err := m.CallObject(l.Attrs[name], args)
+        if err != nil {
+            return err.String()
+        }
+        return result.AsString()
+    }
+    if got := call("release"); !strings.HasPrefix(got, "RuntimeError") {
+        t.Errorf("releasing a lock that isn't held should be a RuntimeError, got %v", got)
+    }
+    if got := call("acquire"); got != "1" || call("locked") != "1" {
+        t.Errorf("expected acquire to take the lock, got %v", got)
+    }
+    if got := call("acquire", intObject(0)); got != "0" {
+        t.Errorf("acquire shouldn't wait when told not to block, got %v", got)
+    }
+    if got := call("release"); got != "None" || call("locked") != "0" {
+        t.Errorf("expected release to let go of the lock, got %v", got)
+    }
+}
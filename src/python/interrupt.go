@@ -0,0 +1,138 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module lets the program embedding the machine stop the code it runs.
+   Interrupt asks the machine to stop as if the user had pressed Ctrl-C, and a
+   deadline stops it once the time is up.  Both set a flag that the dispatch
+   loop polls before each instruction, which costs two atomic loads, and the
+   machine fails at the instruction it was about to execute, with
+   KeyboardInterrupt or TimeoutError, so the traceback shows where the code
+   was stopped.  A machine waiting for a lock or a thread isn't executing
+   instructions, so they also wake it, and the wait fails the same way.
+*/
+
+package python
+
+import (
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Returned by Run when the machine is interrupted.
+var KeyboardInterrupt os.Error = NewException(KeyboardInterruptClass)
+
+// Returned by Run when the deadline of the machine has passed.
+var TimeoutError = Raise(TimeoutErrorClass, "deadline exceeded")
+
+// The flags that Interrupt and the timer of the deadline set, from other goroutines,
+// and the channel they wake a blocking wait with.
+type signals struct {
+    interrupted int32
+    expired     int32
+    
+    wake        chan bool
+    makeWake    sync.Once
+}
+
+// Returns the channel that receives a value when a flag is set.  It holds one value, so
+// a flag set while nothing waits wakes the next wait, which then polls the flags.
+func (s *signals) wakeup() (chan bool) {
+    s.makeWake.Do(func() {
+        s.wake = make(chan bool, 1)
+    })
+    return s.wake
+}
+
+// Sets the flag, and wakes the machine if it is waiting.
+func (s *signals) raise(flag *int32) {
+    atomic.StoreInt32(flag, 1)
+    select {
+        case s.wakeup() <- true:
+        default:
+    }
+}
+
+// Returns the flags the machine polls.  A machine resuming a generator or a coroutine
+// polls those of the machine that resumed it.
+func (m *Machine) signals() (*signals) {
+    if m.shared != nil {
+        return m.shared
+    }
+    return &m.own
+}
+
+// Makes the machine stop with KeyboardInterrupt before the next instruction it
+// executes.  Interrupt can be called from any goroutine, and the machine only stops
+// once for each call.
+func (m *Machine) Interrupt() {
+    s := m.signals()
+    s.raise(&s.interrupted)
+}
+
+// Makes the machine stop with TimeoutError once the time, in nanoseconds since the
+// epoch, has come, and fail each time it is run after that.  A deadline of 0 means
+// there is none.  SetDeadline must not be called while the machine is running.
+func (m *Machine) SetDeadline(ns int64) {
+    if m.deadline != nil {
+        m.deadline.Stop()
+        m.deadline = nil
+    }
+    
+    s := m.signals()
+    atomic.StoreInt32(&s.expired, 0)
+    if ns != 0 {
+        m.deadline = time.AfterFunc(ns - time.Nanoseconds(), func() {
+            s.raise(&s.expired)
+        })
+    }
+}
+
+// Sets the deadline of the machine to ns nanoseconds from now.
+func (m *Machine) SetTimeout(ns int64) {
+    m.SetDeadline(time.Nanoseconds() + ns)
+}
+
+// Returns the error the machine stops with, if it has been interrupted or its deadline
+// has passed.  The interruption is cleared, so the machine can be run again, but the
+// deadline isn't.
+func (m *Machine) poll() (os.Error) {
+    s := m.signals()
+    if atomic.LoadInt32(&s.expired) != 0 {
+        return TimeoutError
+    }
+    if atomic.LoadInt32(&s.interrupted) != 0 && atomic.CompareAndSwapInt32(&s.interrupted, 1, 0) {
+        return KeyboardInterrupt
+    }
+    return nil
+}
+
+// Calls wait with the lock of the interpreter released, as Blocking does, until it
+// returns true.  wait has to wait on the channel it is given as well as on what it
+// waits for, and return false if the channel wakes it, so the machine can give up the
+// wait with the error it stops with when it is interrupted or its deadline passes.
+func (m *Machine) BlockingWait(wait func(wake <-chan bool) (bool)) (err os.Error) {
+    s := m.signals()
+    m.Blocking(func() {
+        for !wait(s.wakeup()) {
+            if err = m.poll(); err != nil {
+                return
+            }
+        }
+    })
+    return
+}
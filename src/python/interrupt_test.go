@@ -0,0 +1,160 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for interrupting the machine and for deadlines.
+
+*/
+
+package python
+
+import (
+        "os"
+        "testing"
+        "time"
+)
+
+// Writes a loop that never ends.
+func writeEndlessLoop(s *CodeObject) {
+    s.WriteConst(intObject(1), 1, false, 0)
+    top := s.Here()
+    s.WriteAluIns(ADD,1,1,2,false,0)
+    s.PatchJump(s.WriteJump(false, 0), top)
+}
+
+func TestInterrupt(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    writeEndlessLoop(s)
+    
+    m := new (Machine)
+    go func() {
+        time.Sleep(1e6)
+        m.Interrupt()
+    }()
+    if _, err := m.Run(s); err != KeyboardInterrupt || m.Traceback == nil {
+        t.Fatalf("expected the loop to be interrupted, got %v", err)
+    }
+    
+    // The interruption is cleared once the machine has stopped.
+    m.StepLimit = 100
+    if _, err := m.Run(s); err != StepLimitExceeded {
+        t.Errorf("expected the loop to carry on after the interruption, got %v", err)
+    }
+    
+    m.Interrupt()
+    if _, err := m.Run(s); err != KeyboardInterrupt {
+        t.Errorf("expected the machine to stop straight away, got %v", err)
+    }
+}
+
+func TestDeadline(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    writeEndlessLoop(s)
+    
+    m := new (Machine)
+    m.SetTimeout(1e6)
+    if _, err := m.Run(s); err != TimeoutError || m.Traceback == nil {
+        t.Fatalf("expected the loop to time out, got %v", err)
+    }
+    if _, err := m.Run(s); err != TimeoutError {
+        t.Errorf("a machine whose deadline has passed should fail each time it runs, got %v", err)
+    }
+    
+    m.SetDeadline(0)
+    m.StepLimit = 100
+    if _, err := m.Run(s); err != StepLimitExceeded {
+        t.Errorf("expected the deadline to be cleared, got %v", err)
+    }
+}
+
+// A generator is stopped by interrupting the machine that resumed it.
+func TestInterruptGenerator(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    s := mod.NewCode("gen")
+    s.Generator = true
+    writeEndlessLoop(s)
+    
+    _, result, err := callTestFunction(mod, NewFunction(s, nil, mod.Globals), nil, nil, nil)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    
+    m := new (Machine)
+    m.Interrupt()
+    if _, err = result.(*GeneratorObject).resume(m, None); err != KeyboardInterrupt {
+        t.Errorf("expected the generator to be interrupted, got %v", err)
+    }
+}
+
+// Returns code that calls fn, which takes no arguments.
+func writeCallNoArgs(fn Object) (*CodeObject) {
+    s := new (CodeObject)
+    s.Init()
+    s.WriteConst(fn, 1, false, 0)
+    s.WriteCallFunction(1, 0, 0, 2, false, 0)
+    s.WriteHalt(2, false, 0)
+    return s
+}
+
+// A machine waiting for a lock or a thread gives up the wait when it is interrupted or
+// its deadline passes.
+func TestInterruptBlockingWait(t *testing.T) {
+    interp := NewInterpreter()
+    l := NewLock()
+    l.TryAcquire()
+    acquire, _ := l.GetAttr("acquire")
+    
+    m := interp.NewMachine()
+    go func() {
+        time.Sleep(1e6)
+        m.Interrupt()
+    }()
+    if _, err := m.Run(writeCallNoArgs(acquire)); err != KeyboardInterrupt || m.Traceback == nil {
+        t.Errorf("expected the wait for the lock to be interrupted, got %v", err)
+    }
+    if l.TryAcquire() {
+        t.Errorf("the lock should still be held by its owner")
+    }
+    
+    // The thread waits until the test is done, without holding the lock of the
+    // interpreter.
+    stop := make(chan bool)
+    defer close(stop)
+    forever := NewBuiltinFunction("forever", func(m *Machine, args []Object) (Object, os.Error) {
+        m.Blocking(func() {
+            <-stop
+        })
+        return None, nil
+    })
+    join, _ := interp.StartThread(forever, nil).GetAttr("join")
+    
+    m = interp.NewMachine()
+    m.SetTimeout(1e6)
+    if _, err := m.Run(writeCallNoArgs(join)); err != TimeoutError {
+        t.Errorf("expected the join to time out, got %v", err)
+    }
+    
+    // An interruption that was already handled doesn't stop a later wait.
+    m = interp.NewMachine()
+    m.Interrupt()
+    m.poll()
+    l.Release()
+    if _, err := m.Run(writeCallNoArgs(acquire)); err != nil || !l.Locked() {
+        t.Errorf("expected the lock to be taken, got %v", err)
+    }
+}
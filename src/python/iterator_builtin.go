@@ -0,0 +1,249 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the iterator built-in object
+   type, which steps through the items of the sequence built-ins, and of the
+   builtins that iterate: iter(), next(), sum(), min() and max().
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+type IteratorObject struct {
+    ObjectData
+    
+    // The items left are the ones from Index on.
+    Items   []Object
+    Index   int
+}
+
+func NewIterator(items []Object) (*IteratorObject) {
+    it := new(IteratorObject)
+    it.ObjectData.Init()
+    it.Items = items
+    
+    return it
+}
+
+// An iterator is its own iterator, as in Python.
+func (o *IteratorObject) Iter() (Iterator) {
+    return o
+}
+
+// Returns the next item, or false once there are no more.
+func (o *IteratorObject) Next() (Object, bool) {
+    if o.Index >= len(o.Items) {
+        return nil, false
+    }
+    
+    o.Index++
+    return o.Items[o.Index-1], true
+}
+
+// An iterator can't be converted to a number
+func (o *IteratorObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *IteratorObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert iterator to string
+func (o *IteratorObject) AsString() (string) {
+    return fmt.Sprintf("<iterator at %v of %v>", o.Index, len(o.Items))
+}
+
+///////// Rich Comparison Interface ///////////
+
+// An iterator is only equal to itself, and iterators are not ordered.
+func (o *IteratorObject) Eq(r Object) (Object) {
+    it, ok := r.(*IteratorObject)
+    return pyBool(ok && it == o)
+}
+
+func (o *IteratorObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *IteratorObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *IteratorObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *IteratorObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *IteratorObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *IteratorObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *IteratorObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *IteratorObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *IteratorObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *IteratorObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *IteratorObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *IteratorObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *IteratorObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *IteratorObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *IteratorObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// An iterator is always true, even once it is exhausted
+func (o *IteratorObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *IteratorObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *IteratorObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *IteratorObject) AsBool() (bool) {
+    return o.IsTrue()
+}
+
+// Returns the smallest of the items of args, or the largest if op is GT, as min() and
+// max() do.  A single argument is iterated.  fn names the builtin in the errors.
+func extreme(m *Machine, fn string, op uint32, args []Object) (Object, os.Error) {
+    if len(args) == 0 {
+        return nil, Raise(TypeErrorClass, fmt.Sprintf("%v expected at least 1 argument, got 0", fn))
+    }
+    var items Object = NewTuple(args)
+    if len(args) == 1 {
+        items = args[0]
+    }
+    
+    var result Object
+    err := m.forEach(items, func(item Object) (os.Error) {
+        if result == nil {
+            result = item
+            return nil
+        }
+        better, err := m.richCompare(op, item, result)
+        if err == nil && better.IsTrue() {
+            result = item
+        }
+        return err
+    })
+    if err == nil && result == nil {
+        err = Raise(ValueErrorClass, fmt.Sprintf("%v() iterable argument is empty", fn))
+    }
+    return result, err
+}
+
+// Adds iter(), next(), sum(), min() and max() to the builtins of the interpreter.
+func (interp *Interpreter) addIteratorBuiltins() {
+    interp.Builtins["iter"] = NewBuiltinFunction("iter", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 1 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("iter expected 1 argument, got %v", len(args)))
+        }
+        return m.iter(args[0])
+    })
+    
+    interp.Builtins["next"] = NewBuiltinFunction("next", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) < 1 || len(args) > 2 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("next expected 1 or 2 arguments, got %v", len(args)))
+        }
+        value, more, err := m.next(args[0])
+        switch {
+            case err != nil:
+                return nil, err
+            case more:
+                return value, nil
+            case len(args) == 2:
+                return args[1], nil
+        }
+        return nil, StopIteration
+    })
+    
+    interp.Builtins["sum"] = NewBuiltinFunction("sum", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) < 1 || len(args) > 2 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("sum expected 1 or 2 arguments, got %v", len(args)))
+        }
+        var total Object = NewInt(0)
+        if len(args) == 2 {
+            total = args[1]
+        }
+        if _, ok := total.(*StringObject); ok {
+            return nil, Raise(TypeErrorClass, "sum() can't sum strings [use ''.join(seq) instead]")
+        }
+        
+        err := m.forEach(args[0], func(item Object) (err os.Error) {
+            total, err = m.binaryOp(ADD, total, item)
+            return
+        })
+        if err != nil {
+            return nil, err
+        }
+        return total, nil
+    })
+    
+    interp.Builtins["min"] = NewBuiltinFunction("min", func(m *Machine, args []Object) (Object, os.Error) {
+        return extreme(m, "min", LT, args)
+    })
+    
+    interp.Builtins["max"] = NewBuiltinFunction("max", func(m *Machine, args []Object) (Object, os.Error) {
+        return extreme(m, "max", GT, args)
+    })
+}
@@ -0,0 +1,272 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the JIT hook of the machine.  Once a JIT is set, the
+   machine counts the jumps back to the head of each loop, and when a loop has
+   been entered by a jump back often enough, it hands the loop to the compiler
+   of the JIT.  If the compiler returns a handler, the instruction at the head
+   of the loop is patched to ENTERJIT, which runs the handler in its place,
+   on every machine that runs the code, until the code is decoded again.  The
+   compiled loops are kept in a code cache, see jit_cache.go.  A JIT that
+   specializes counts each loop separately for each signature of the registers
+   it is entered with, and a head only enters a compiled loop for the signature
+   of the frame, or one compiled without a signature.
+
+   The compiled handler starts with the machine at the head of the loop, and
+   the machine carries on from wherever it leaves NextInstruction, usually the
+   instruction after the loop.  It can return JitBailout instead, when a guard
+   on the values in the registers fails before it has done anything, and the
+   head is interpreted as if it had never been patched, or a side exit, as
+   described in deopt.go, once it has.  While the machine is traced, profiled, has
+   breakpoints or a budget, the compiled code isn't entered, so that each
+   instruction is still seen and counted.
+*/
+
+package python
+
+import (
+    "fmt"
+    "os"
+)
+
+// The number of times a loop is entered by a jump back before it is compiled, if
+// SetJit isn't given one.
+const DefaultJitThreshold = 1000
+
+// Returned by a compiled handler to have the machine interpret the loop instead.
+var JitBailout = os.NewError("JIT bailout")
+
+// A loop that has become hot.  Head is the target of the jump back, and End is the
+// address of the jump, so the body of the loop is the instructions from Head to End.
+// Count is the number of times the loop was entered by a jump back.  Signature is the
+// LoopSignature of the frame that made the loop hot, if the JIT specializes.
+type HotLoop struct {
+    Code        *CodeObject
+    Head, End   uint32
+    Count       int
+    Signature   string
+}
+
+// Compiles a hot loop into a handler that runs it, or returns nil if it can't compile
+// the loop, which is then left to the interpreter.  An error stops the machine.
+type LoopCompiler func(loop HotLoop) (Handler, os.Error)
+
+// Compiles a hot loop for the types in its signature, like a LoopCompiler.
+type SpecializingCompiler func(loop HotLoop) (*CompiledLoop, os.Error)
+
+// The JIT of a machine, with the number of times each loop head has been jumped back
+// to with each signature, by code object.  A loop that is compiled, or retired, is no
+// longer counted.
+type jit struct {
+    threshold   int
+    compile     SpecializingCompiler
+    specialize  bool
+    cache       *CodeCache
+    counts      map[*CodeObject]map[loopKey]int
+}
+
+type loopKey struct {
+    head        uint32
+    signature   string
+}
+
+// A loop head that has been patched to ENTERJIT, with the instruction it replaced and
+// the compiled loops it enters, by signature.
+type jitLoop struct {
+    ins         DecodedIns
+    specs       map[string]*CacheEntry
+}
+
+// Sets the compiler that hot loops are handed to once they have been jumped back to
+// threshold times, or turns the JIT off if compile is nil.  A threshold of 0 means the
+// DefaultJitThreshold.  Loops that were compiled before stay compiled.  The loops are
+// compiled without a signature, and kept in a cache without a limit.
+func (m *Machine) SetJit(threshold int, compile LoopCompiler) {
+    if compile == nil {
+        m.jit = nil
+        return
+    }
+    m.setJit(threshold, func(loop HotLoop) (*CompiledLoop, os.Error) {
+        run, err := compile(loop)
+        if run == nil {
+            return nil, err
+        }
+        return &CompiledLoop{Run: run}, err
+    }, false, nil)
+}
+
+// Sets the compiler that hot loops are handed to like SetJit, but counts and compiles
+// each loop for each signature it is entered with, and keeps the compiled loops in
+// cache, or in a cache without a limit if cache is nil.
+func (m *Machine) SetSpecializingJit(threshold int, compile SpecializingCompiler, cache *CodeCache) {
+    if compile == nil {
+        m.jit = nil
+        return
+    }
+    m.setJit(threshold, compile, true, cache)
+}
+
+func (m *Machine) setJit(threshold int, compile SpecializingCompiler, specialize bool, cache *CodeCache) {
+    if threshold <= 0 {
+        threshold = DefaultJitThreshold
+    }
+    if cache == nil {
+        cache = NewCodeCache(0)
+    }
+    m.jit = &jit{threshold, compile, specialize, cache, make(map[*CodeObject]map[loopKey]int)}
+}
+
+// Returns the code cache of the machine's JIT, or nil if it has none.
+func (m *Machine) JitCache() (*CodeCache) {
+    if m.jit == nil {
+        return nil
+    }
+    return m.jit.cache
+}
+
+// Drops the compiled loops that assume the global name stays bound, since it is being
+// bound again.
+func (m *Machine) invalidateGlobal(name string) {
+    if m.jit != nil {
+        m.jit.cache.InvalidateGlobal(name)
+    }
+}
+
+// Returns true if the machine can run compiled code, which it can unless something is
+// watching the instructions it executes.
+func (m *Machine) entersJit() (bool) {
+    return m.trace == nil && m.debug == nil && m.profile == nil && m.budget == nil
+}
+
+// Counts the jump at end in c back to head, from the frame f, and compiles the loop once
+// it is hot.
+func (j *jit) backEdge(c *CodeObject, f *Frame, head, end uint32) (os.Error) {
+    signature := ""
+    if j.specialize {
+        signature = LoopSignature(f)
+    }
+    if j.cache.Lookup(c, head, signature) != nil || j.cache.Retired(c, head, signature) {
+        return nil
+    }
+    
+    counts := j.counts[c]
+    if counts == nil {
+        counts = make(map[loopKey]int)
+        j.counts[c] = counts
+    }
+    
+    key := loopKey{head, signature}
+    n := counts[key] + 1
+    if n < j.threshold {
+        counts[key] = n
+        return nil
+    }
+    
+    counts[key] = 0, false
+    loop, err := j.compile(HotLoop{c, head, end, n, signature})
+    if err != nil || loop == nil || j.cache.Add(c, head, signature, loop) == nil {
+        j.cache.Retire(c, head, signature)
+    }
+    return err
+}
+
+// Patches the instruction at head to enter the compiled loops, if it isn't already, and
+// returns the patched loop.
+func (c *CodeObject) patchLoop(head uint32) (*jitLoop) {
+    if loop := c.jitted[head]; loop != nil {
+        return loop
+    }
+    
+    code := c.Decoded()
+    if c.jitted == nil {
+        c.jitted = make(map[uint32]*jitLoop)
+    }
+    loop := &jitLoop{code[head], make(map[string]*CacheEntry)}
+    c.jitted[head] = loop
+    code[head].Op, code[head].Fused = ENTERJIT, 0
+    return loop
+}
+
+// Puts back the instruction the loop head at pc was patched over.
+func (c *CodeObject) unpatchLoop(pc uint32) {
+    if loop := c.jitted[pc]; loop != nil {
+        c.Decoded()[pc] = loop.ins
+        c.jitted[pc] = nil, false
+    }
+}
+
+// Forgets the compiled loops of the code, which is being decoded again, and drops them
+// from their caches.
+func (c *CodeObject) dropJitted() {
+    jitted := c.jitted
+    c.jitted = nil
+    for _, loop := range jitted {
+        for _, e := range loop.specs {
+            e.cache.remove(e)
+        }
+    }
+}
+
+// Returns the compiled loop to enter from the frame f, which is the one compiled for
+// its signature, or else one compiled without a signature, or nil if there is neither.
+func (loop *jitLoop) find(f *Frame) (*CacheEntry) {
+    generic := loop.specs[""]
+    if generic != nil && len(loop.specs) == 1 {
+        return generic
+    }
+    if e := loop.specs[LoopSignature(f)]; e != nil {
+        return e
+    }
+    return generic
+}
+
+// Returns the instruction that the loop head at pc was patched over.
+func (c *CodeObject) unpatched(pc uint32) (*DecodedIns) {
+    if loop := c.jitted[pc]; loop != nil {
+        return &loop.ins
+    }
+    return &c.Decoded()[pc]
+}
+
+// Runs the compiled loop whose head was just dispatched, or interprets the head if the
+// compiled code bails out, or there is none for the frame, or carries on where a side
+// exit of the compiled code says.
+func execEnterJit(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    pc := m.NextInstruction-1
+    loop := f.Code.jitted[pc]
+    if loop == nil {
+        return os.NewError(fmt.Sprintf("instruction %v enters a loop that wasn't compiled", pc))
+    }
+    
+    e := loop.find(f)
+    if e == nil {
+        return m.handler(loop.ins.Op)(m, f, loop.ins)
+    }
+    
+    e.cache.touch(e)
+    err := e.Run(m, f, loop.ins)
+    if exit, ok := err.(*SideExit); ok {
+        if e.exits++; e.exits >= MaxSideExits {
+            e.cache.Retire(e.Code, e.Head, e.Signature)
+        }
+        return m.deoptimize(f, exit)
+    }
+    if err != JitBailout {
+        return err
+    }
+    m.NextInstruction = pc+1
+    return m.handler(loop.ins.Op)(m, f, loop.ins)
+}
@@ -0,0 +1,243 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the code cache of the JIT, which holds the compiled
+   loops.  A loop is compiled for the types of the values in the registers of
+   the frame that made it hot, its signature, so a loop head can have a compiled
+   loop for each signature it has become hot with.  The cache keeps them by code
+   object, head and signature, and accounts for the bytes of machine code each
+   one takes.  When a new loop doesn't fit in the limit of the cache, the loops
+   that were entered least recently are evicted until it does.
+
+   A compiled loop can assume that the globals it reads stay bound to the
+   objects they were bound to when it was compiled.  Binding one of those names
+   again invalidates the loop, which is dropped from the cache.  A class is
+   bound to its name when it is defined, so redefining a class invalidates the
+   loops that used it the same way.  A head whose last compiled loop is dropped
+   is unpatched, and the loop can become hot again, and be compiled for the new
+   bindings.
+
+   The machines that share globals should share a cache, so that each one
+   invalidates the loops the others compiled.
+*/
+
+package python
+
+import (
+    "container/list"
+    "fmt"
+    "strings"
+)
+
+// A compiled loop.  Size is the number of bytes of machine code it takes, at Addr if it
+// has been put in memory, and Globals are the names of the globals whose bindings the
+// code assumes don't change.
+type CompiledLoop struct {
+    Run         Handler
+    Addr        uintptr
+    Size        int
+    Globals     []string
+}
+
+// A compiled loop in a cache, for the loop at Head in Code, entered with the types in
+// Signature.
+type CacheEntry struct {
+    CompiledLoop
+    Code        *CodeObject
+    Head        uint32
+    Signature   string
+
+    // The number of side exits the loop has taken.
+    exits       int
+
+    cache       *CodeCache
+    element     *list.Element
+}
+
+type cacheKey struct {
+    code        *CodeObject
+    head        uint32
+    signature   string
+}
+
+// The compiled loops of one or more machines.  Limit is the most bytes of machine code
+// the cache holds, or 0 if it has no limit.  The loops added to the cache are written to
+// PerfMap, if it has one.
+type CodeCache struct {
+    Limit       int
+    PerfMap     *PerfMap
+
+    // The number of loops evicted to make room, and dropped because a global they
+    // assumed was bound again.
+    Evictions       int
+    Invalidations   int
+
+    size        int
+    entries     map[cacheKey]*CacheEntry
+
+    // The entries, with the one entered most recently at the front.
+    lru         *list.List
+
+    // The entries that assume each global stays bound.
+    globals     map[string]map[*CacheEntry]bool
+
+    // The loops that are no longer compiled, because the compiler declined them or
+    // they took too many side exits.
+    retired     map[cacheKey]bool
+}
+
+// Returns an empty cache that holds up to limit bytes of machine code, or any amount if
+// limit is 0.
+func NewCodeCache(limit int) (*CodeCache) {
+    return &CodeCache{Limit: limit,
+                      entries: make(map[cacheKey]*CacheEntry),
+                      lru: list.New(),
+                      globals: make(map[string]map[*CacheEntry]bool),
+                      retired: make(map[cacheKey]bool)}
+}
+
+// Returns the bytes of machine code in the cache.
+func (cc *CodeCache) Size() (int) {
+    return cc.size
+}
+
+// Returns the number of compiled loops in the cache.
+func (cc *CodeCache) Len() (int) {
+    return len(cc.entries)
+}
+
+// Returns the compiled loop at head in c for the signature, or nil if there isn't one.
+func (cc *CodeCache) Lookup(c *CodeObject, head uint32, signature string) (*CacheEntry) {
+    return cc.entries[cacheKey{c, head, signature}]
+}
+
+// Returns true if the loop at head in c is no longer compiled for the signature.
+func (cc *CodeCache) Retired(c *CodeObject, head uint32, signature string) (bool) {
+    return cc.retired[cacheKey{c, head, signature}]
+}
+
+// Adds the compiled loop at head in c for the signature, evicting the loops entered
+// least recently to make room, and patches the head to enter it.  Returns nil if the loop
+// is bigger than the cache.
+func (cc *CodeCache) Add(c *CodeObject, head uint32, signature string, loop *CompiledLoop) (*CacheEntry) {
+    if cc.Limit > 0 && loop.Size > cc.Limit {
+        return nil
+    }
+
+    key := cacheKey{c, head, signature}
+    if old := cc.entries[key]; old != nil {
+        cc.remove(old)
+    }
+    for cc.Limit > 0 && cc.size + loop.Size > cc.Limit {
+        cc.remove(cc.lru.Back().Value.(*CacheEntry))
+        cc.Evictions++
+    }
+
+    e := &CacheEntry{CompiledLoop: *loop, Code: c, Head: head, Signature: signature, cache: cc}
+    e.element = cc.lru.PushFront(e)
+    cc.entries[key] = e
+    cc.size += e.Size
+    for _, name := range e.Globals {
+        if cc.globals[name] == nil {
+            cc.globals[name] = make(map[*CacheEntry]bool)
+        }
+        cc.globals[name][e] = true
+    }
+
+    c.patchLoop(head).specs[signature] = e
+    if cc.PerfMap != nil && e.Addr != 0 {
+        cc.PerfMap.Add(e.Addr, e.Size, PerfName(c, head))
+    }
+    return e
+}
+
+// Marks the entry as entered most recently.
+func (cc *CodeCache) touch(e *CacheEntry) {
+    cc.lru.MoveToFront(e.element)
+}
+
+// Drops the entry from the cache, and unpatches its head if it was the last loop
+// compiled there.
+func (cc *CodeCache) remove(e *CacheEntry) {
+    key := cacheKey{e.Code, e.Head, e.Signature}
+    if cc.entries[key] != e {
+        return
+    }
+
+    cc.entries[key] = nil, false
+    cc.lru.Remove(e.element)
+    cc.size -= e.Size
+    for _, name := range e.Globals {
+        if deps := cc.globals[name]; deps != nil {
+            deps[e] = false, false
+            if len(deps) == 0 {
+                cc.globals[name] = nil, false
+            }
+        }
+    }
+
+    if loop := e.Code.jitted[e.Head]; loop != nil && loop.specs[e.Signature] == e {
+        loop.specs[e.Signature] = nil, false
+        if len(loop.specs) == 0 {
+            e.Code.unpatchLoop(e.Head)
+        }
+    }
+}
+
+// Drops the compiled loop at head in c for the signature, if there is one, and keeps it
+// from being compiled again.
+func (cc *CodeCache) Retire(c *CodeObject, head uint32, signature string) {
+    key := cacheKey{c, head, signature}
+    if e := cc.entries[key]; e != nil {
+        cc.remove(e)
+    }
+    cc.retired[key] = true
+}
+
+// Drops the compiled loops that assume the global name stays bound, and returns how
+// many there were.
+func (cc *CodeCache) InvalidateGlobal(name string) (int) {
+    deps := cc.globals[name]
+    n := len(deps)
+    for e := range deps {
+        cc.remove(e)
+    }
+    cc.Invalidations += n
+    return n
+}
+
+// Drops every compiled loop of the code c.
+func (cc *CodeCache) InvalidateCode(c *CodeObject) {
+    for key, e := range cc.entries {
+        if key.code == c {
+            cc.remove(e)
+        }
+    }
+}
+
+// Returns the signature of the values in the registers of the frame, which names the
+// type of each one, or - for an empty register.
+func LoopSignature(f *Frame) (string) {
+    types := make([]string, len(f.Register))
+    for i, o := range f.Register {
+        if o == nil {
+            types[i] = "-"
+        } else {
+            types[i] = fmt.Sprintf("%T", o)
+        }
+    }
+    return strings.Join(types, ",")
+}
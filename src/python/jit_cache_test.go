@@ -0,0 +1,145 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the code cache of the JIT.
+
+*/
+
+package python
+
+import (
+        "os"
+        "testing"
+)
+
+func bailoutLoop(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    return JitBailout
+}
+
+func sumLoops(n int) ([]*CodeObject) {
+    code := make([]*CodeObject, n)
+    for i := range code {
+        code[i] = new (CodeObject)
+        code[i].Init()
+        writeSumLoop(code[i], 100)
+    }
+    return code
+}
+
+func TestCodeCache(t *testing.T) {
+    code := sumLoops(3)
+
+    // The loops that were entered least recently are evicted to make room.
+    cc := NewCodeCache(100)
+    a := cc.Add(code[0], 4, "", &CompiledLoop{Run: bailoutLoop, Size: 40})
+    b := cc.Add(code[1], 4, "", &CompiledLoop{Run: bailoutLoop, Size: 40})
+    if cc.Size() != 80 || cc.Len() != 2 || code[0].Decoded()[4].Op != ENTERJIT {
+        t.Fatalf("expected two patched loops in 80 bytes, got %v in %v", cc.Len(), cc.Size())
+    }
+    cc.touch(a)
+    cc.Add(code[2], 4, "", &CompiledLoop{Run: bailoutLoop, Size: 40})
+    if cc.Lookup(code[1], 4, "") != nil || cc.Lookup(code[0], 4, "") != a || cc.Evictions != 1 {
+        t.Errorf("expected %v to be evicted, got %v evictions", b, cc.Evictions)
+    }
+    if code[1].Decoded()[4].Op != GT || cc.Size() != 80 {
+        t.Errorf("expected the evicted head to be unpatched, and 80 bytes, got %v", cc.Size())
+    }
+    if cc.Add(code[1], 4, "", &CompiledLoop{Run: bailoutLoop, Size: 200}) != nil {
+        t.Errorf("expected a loop bigger than the cache to be refused")
+    }
+
+    // A head with loops for more than one signature stays patched until the last goes.
+    code = sumLoops(3)
+    cc = NewCodeCache(0)
+    cc.Add(code[0], 4, "x", &CompiledLoop{Run: bailoutLoop, Globals: []string{"g"}})
+    cc.Add(code[0], 4, "y", &CompiledLoop{Run: bailoutLoop, Globals: []string{"g", "h"}})
+    cc.Add(code[1], 4, "", &CompiledLoop{Run: bailoutLoop, Globals: []string{"h"}})
+    if n := cc.InvalidateGlobal("h"); n != 2 || cc.Len() != 1 || code[0].Decoded()[4].Op != ENTERJIT {
+        t.Errorf("expected 2 loops to be dropped, got %v, leaving %v", n, cc.Len())
+    }
+    if code[1].Decoded()[4].Op != GT || cc.Invalidations != 2 {
+        t.Errorf("expected the head without loops to be unpatched")
+    }
+    if n := cc.InvalidateGlobal("h"); n != 0 {
+        t.Errorf("expected nothing left to drop, got %v", n)
+    }
+    cc.InvalidateCode(code[0])
+    if cc.Len() != 0 || code[0].Decoded()[4].Op != GT {
+        t.Errorf("expected every loop of the code to be dropped, got %v", cc.Len())
+    }
+
+    // Decoding the code again drops its loops from the cache.
+    cc.Add(code[2], 4, "", &CompiledLoop{Run: bailoutLoop, Size: 10})
+    code[2].WriteHalt(4, false, 0)
+    code[2].Decoded()
+    if cc.Len() != 0 || cc.Size() != 0 {
+        t.Errorf("expected the decoded code's loop to be dropped, got %v", cc.Len())
+    }
+
+    // A retired loop is dropped and isn't compiled again.
+    cc.Add(code[1], 4, "", &CompiledLoop{Run: bailoutLoop})
+    cc.Retire(code[1], 4, "")
+    if !cc.Retired(code[1], 4, "") || cc.Len() != 0 || cc.Retired(code[1], 4, "x") {
+        t.Errorf("expected only the loop for the signature to be retired")
+    }
+}
+
+func TestSpecializingJit(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 100)
+
+    // The loop is compiled for the types in its registers, and assumes the global g
+    // stays bound.
+    c := new (sumLoopCompiler)
+    cc := NewCodeCache(0)
+    compile := func(loop HotLoop) (*CompiledLoop, os.Error) {
+        run, err := c.compile(loop)
+        return &CompiledLoop{Run: run, Size: 64, Globals: []string{"g"}}, err
+    }
+    m := new (Machine)
+    m.SetSpecializingJit(10, compile, cc)
+    if result, err := m.Run(s); err != nil || result.AsString() != "5050" || c.runs != 1 {
+        t.Fatalf("expected 5050 from the compiled loop, got %v, %v", result, err)
+    }
+    sig := c.loops[0].Signature
+    if sig == "" || cc.Lookup(s, 4, sig) == nil || cc.Size() != 64 || m.JitCache() != cc {
+        t.Errorf("expected the loop to be cached for its signature %q", sig)
+    }
+
+    // A loop for another signature isn't entered from this one.
+    e := cc.Lookup(s, 4, sig)
+    cc.Add(s, 4, "other", &CompiledLoop{Run: bailoutLoop})
+    if loop := s.jitted[4]; loop == nil || len(loop.specs) != 2 {
+        t.Fatalf("expected two loops at the head")
+    }
+    if result, err := new (Machine).Run(s); err != nil || result.AsString() != "5050" || c.runs != 2 {
+        t.Errorf("expected 5050 from the loop for the signature, got %v, %v", result, err)
+    }
+    cc.Retire(s, 4, "other")
+
+    // Binding g again drops the loop, which is compiled again once it is hot, by any
+    // machine that shares the cache.
+    m.BindGlobal("g", intObject(1))
+    if cc.Lookup(s, 4, sig) != nil || s.Decoded()[4].Op != GT || cc.Invalidations != 1 {
+        t.Errorf("expected %v to be invalidated", e)
+    }
+    m = new (Machine)
+    m.SetSpecializingJit(10, compile, cc)
+    if result, err := m.Run(s); err != nil || result.AsString() != "5050" || len(c.loops) != 2 {
+        t.Errorf("expected the loop to be compiled again, got %v, %v", result, err)
+    }
+}
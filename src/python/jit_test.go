@@ -0,0 +1,203 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the JIT hook.
+
+*/
+
+package python
+
+import (
+        "bytes"
+        "os"
+        "strings"
+        "testing"
+)
+
+// Compiles the loop written by writeSumLoop into a handler that runs the rest of it in
+// Go, and counts the loops it is given and the times the handler runs.
+type sumLoopCompiler struct {
+    loops   []HotLoop
+    runs    int
+    bailout bool
+}
+
+func (s *sumLoopCompiler) compile(loop HotLoop) (Handler, os.Error) {
+    s.loops = append(s.loops, loop)
+    return func(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+        s.runs++
+        if s.bailout {
+            return JitBailout
+        }
+        
+        one := intObject(1)
+        for f.Register[3].Gt(intObject(0)).IsTrue() {
+            var err os.Error
+            if f.Register[4], err = f.Register[4].Add(f.Register[3]); err != nil {
+                return err
+            }
+            if f.Register[3], err = f.Register[3].Sub(one); err != nil {
+                return err
+            }
+        }
+        m.NextInstruction = loop.End+1
+        return nil
+    }, nil
+}
+
+func TestJit(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 100)
+    
+    // The loop is compiled once it has been jumped back to 10 times, and the compiled
+    // code runs the rest of it the next time round.
+    c := new (sumLoopCompiler)
+    m := new (Machine)
+    m.SetJit(10, c.compile)
+    if result, err := m.Run(s); err != nil || result.AsString() != "5050" {
+        t.Fatalf("expected 5050, got %v, %v", result, err)
+    }
+    if len(c.loops) != 1 || c.runs != 1 {
+        t.Fatalf("expected the loop to be compiled and run once, got %v and %v", c.loops, c.runs)
+    }
+    if loop := c.loops[0]; loop.Code != s || loop.Head != 4 || loop.End != 8 || loop.Count != 10 {
+        t.Errorf("expected the loop from 4 to 8, got %+v", loop)
+    }
+    if s.Decoded()[4].Op != ENTERJIT {
+        t.Errorf("expected the head of the loop to be patched")
+    }
+    out := new (bytes.Buffer)
+    Disassemble(s, out)
+    if !strings.Contains(out.String(), "ENTERJIT") {
+        t.Errorf("expected the patched head to be disassembled, got:\n%v", out)
+    }
+    
+    // Another machine enters the compiled loop straight away, without a JIT of its own.
+    m = new (Machine)
+    if result, err := m.Run(s); err != nil || result.AsString() != "5050" || c.runs != 2 {
+        t.Errorf("expected 5050 from the compiled loop, got %v, %v", result, err)
+    }
+    
+    // A profiled machine interprets the loop.
+    m = new (Machine)
+    m.SetProfiling(true)
+    if result, err := m.Run(s); err != nil || result.AsString() != "5050" || c.runs != 2 {
+        t.Errorf("expected 5050 from the interpreter, got %v, %v", result, err)
+    }
+    if m.Profile().Opcodes[ENTERJIT] != 0 || m.Profile().Opcodes[GT] != 101 {
+        t.Errorf("expected the head to be counted as itself, got %v", m.Profile().Opcodes[GT])
+    }
+    
+    // A handler that bails out leaves the loop to the interpreter, each time round.
+    c.bailout = true
+    m = new (Machine)
+    if result, err := m.Run(s); err != nil || result.AsString() != "5050" || c.runs != 103 {
+        t.Errorf("expected 5050 after 101 bailouts, got %v, %v and %v runs", result, err, c.runs)
+    }
+    
+    // Writing more code undoes the patch.
+    s.WriteHalt(4, false, 0)
+    if s.Decoded()[4].Op != GT {
+        t.Errorf("expected the head to be decoded again")
+    }
+}
+
+func TestJitDeclined(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 100)
+    
+    // A loop the compiler declines is handed to it only once.
+    declined := 0
+    m := new (Machine)
+    m.SetJit(0, func(loop HotLoop) (Handler, os.Error) {
+        declined++
+        return nil, nil
+    })
+    m.jit.threshold = 5
+    if result, err := m.Run(s); err != nil || result.AsString() != "5050" || declined != 1 {
+        t.Errorf("expected 5050 and one compile, got %v, %v and %v", result, err, declined)
+    }
+    
+    // An error from the compiler stops the machine.
+    failed := os.NewError("can't compile")
+    s = new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 100)
+    m = new (Machine)
+    m.SetJit(5, func(loop HotLoop) (Handler, os.Error) {
+        return nil, failed
+    })
+    if _, err := m.Run(s); err != failed {
+        t.Errorf("expected the compiler's error, got %v", err)
+    }
+}
+
+func TestJitSideExit(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 100)
+    
+    // The compiled loop only handles counts above 50, and leaves the rest of the loop
+    // to the interpreter.
+    runs := 0
+    m := new (Machine)
+    m.SetJit(10, func(loop HotLoop) (Handler, os.Error) {
+        return func(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+            runs++
+            count, sum := f.Register[3], f.Register[4]
+            for count.Gt(intObject(50)).IsTrue() {
+                var err os.Error
+                if sum, err = sum.Add(count); err != nil {
+                    return err
+                }
+                if count, err = count.Sub(intObject(1)); err != nil {
+                    return err
+                }
+            }
+            return &SideExit{loop.Head, "count too small",
+                             []ExitValue{{Kind: EXIT_OBJECT, Register: 3, Object: count},
+                                         {Kind: EXIT_OBJECT, Register: 4, Object: sum}}}
+        }, nil
+    })
+    if result, err := m.Run(s); err != nil || result.AsString() != "5050" {
+        t.Fatalf("expected 5050, got %v, %v", result, err)
+    }
+    
+    // The head is reached again after each side exit, so the loop keeps exiting until
+    // it is given up on.
+    if runs != MaxSideExits || s.Decoded()[4].Op != GT {
+        t.Errorf("expected the loop to be unpatched after %v side exits, got %v", MaxSideExits, runs)
+    }
+    if result, err := new (Machine).Run(s); err != nil || result.AsString() != "5050" || runs != MaxSideExits {
+        t.Errorf("expected 5050 from the interpreter, got %v, %v", result, err)
+    }
+    
+    // A side exit that doesn't fit the frame stops the machine.
+    s = new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 100)
+    m = new (Machine)
+    m.SetJit(10, func(loop HotLoop) (Handler, os.Error) {
+        return func(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+            return &SideExit{loop.Head, "bad", []ExitValue{{Kind: EXIT_OBJECT, Register: 100}}}
+        }, nil
+    })
+    if _, err := m.Run(s); err == nil {
+        t.Errorf("expected a side exit to a missing register to fail")
+    }
+}
@@ -0,0 +1,319 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the list built-in object
+   type.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+        "strings"
+)
+
+type ListObject struct {
+    ObjectData
+    Items []Object
+}
+
+func NewList(items []Object) (*ListObject) {
+    l := new(ListObject)
+    l.ObjectData.Init()
+    l.Items = items
+    
+    return l
+}
+
+// A list can't be converted to a number
+func (o *ListObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *ListObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert list to string
+func (o *ListObject) AsString() (string) {
+    items := make([]string, len(o.Items))
+    for i, item := range o.Items {
+        items[i] = item.AsString()
+    }
+    
+    return "[" + strings.Join(items, ", ") + "]"
+}
+
+// Iterate over the items of the list
+func (o *ListObject) Iter() (Iterator) {
+    return NewIterator(o.Items)
+}
+
+// Returns the item at the index key, or a new list of the items the slice key takes.
+func (o *ListObject) GetItem(key Object) (Object, os.Error) {
+    if s, ok := key.(*SliceObject); ok {
+        items, err := sliceItems(o.Items, s)
+        if err != nil {
+            return nil, err
+        }
+        return NewList(items), nil
+    }
+    
+    i, err := sequenceIndex(key, len(o.Items), "list")
+    if err != nil {
+        return nil, err
+    }
+    return o.Items[i], nil
+}
+
+// Replaces the item at the index key, or the items the slice key takes with the items
+// of value.  A slice with a step of 1 can be replaced by any number of items, which
+// grows or shrinks the list, but any other slice has to be replaced item for item.
+func (o *ListObject) SetItem(key, value Object) (os.Error) {
+    if s, ok := key.(*SliceObject); ok {
+        return o.setSlice(s, value)
+    }
+    
+    i, err := sequenceIndex(key, len(o.Items), "list")
+    if err != nil {
+        return err
+    }
+    o.Items[i] = value
+    return nil
+}
+
+func (o *ListObject) setSlice(s *SliceObject, value Object) (os.Error) {
+    start, step, length, err := s.Indices(len(o.Items))
+    if err != nil {
+        return err
+    }
+    iterable, ok := value.(Iterable)
+    if !ok {
+        return Raise(TypeErrorClass, "can only assign an iterable")
+    }
+    
+    // The items are taken first, in case value is the list itself.
+    var items []Object
+    it := iterable.Iter()
+    for item, more := it.Next(); more; item, more = it.Next() {
+        items = append(items, item)
+    }
+    
+    // Indices only gives a step long enough to step past the end, so the step of the
+    // slice itself tells an extended slice from one that isn't.
+    if simple, _ := sliceBound(s.Step, 1); simple == 1 {
+        result := make([]Object, 0, len(o.Items)-length+len(items))
+        result = append(result, o.Items[:start]...)
+        result = append(result, items...)
+        o.Items = append(result, o.Items[start+length:]...)
+        return nil
+    }
+    if len(items) != length {
+        return Raise(ValueErrorClass, fmt.Sprintf("attempt to assign sequence of size %v to extended slice of size %v", len(items), length))
+    }
+    for i, item := range items {
+        o.Items[start+i*step] = item
+    }
+    return nil
+}
+
+///////// Rich Comparison Interface ///////////
+
+// Compares two lists item by item.  A list is only compared with a list.
+func (o *ListObject) compare(op uint32, r Object) (Object) {
+    l, ok := r.(*ListObject)
+    if !ok {
+        return NotImplemented
+    }
+    return compareItems(op, o.Items, l.Items)
+}
+
+func (o *ListObject) Lt(r Object) (Object) {
+    return o.compare(LT, r)
+}
+
+func (o *ListObject) Gt(r Object) (Object) {
+    return o.compare(GT, r)
+}
+
+func (o *ListObject) Eq(r Object) (Object) {
+    return o.compare(EQ, r)
+}
+
+func (o *ListObject) Neq(r Object) (Object) {
+    return o.compare(NE, r)
+}
+
+func (o *ListObject) Lte(r Object) (Object) {
+    return o.compare(LE, r)
+}
+
+func (o *ListObject) Gte(r Object) (Object) {
+    return o.compare(GE, r)
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+// Concatenates two lists into a new one.  Anything else can't be added to a list.
+func (o *ListObject) Add(r Object) (Object, os.Error) {
+    l, ok := r.(*ListObject)
+    if !ok {
+        return nil, nil
+    }
+    
+    items := make([]Object, 0, len(o.Items)+len(l.Items))
+    items = append(items, o.Items...)
+    return NewList(append(items, l.Items...)), nil
+}
+
+func (o *ListObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+// Repeats the items.  A negative number of repeats gives no items.
+func (o *ListObject) Mul(r Object) (Object, os.Error) {
+    n, ok := r.(*IntObject)
+    if !ok {
+        return nil, nil
+    }
+    
+    var items []Object
+    reps := n.Int64()
+    
+    for i:=int64(0); i < reps; i+=1 {
+        items = append(items, o.Items...)
+    }
+    return NewList(items), nil
+}
+
+func (o *ListObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ListObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ListObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ListObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// In-Place Arithmetic Interface ///////////
+
+// Extends the list with the items of any iterable, as l += r does.
+func (o *ListObject) IAdd(r Object) (Object, os.Error) {
+    iterable, ok := r.(Iterable)
+    if !ok {
+        return nil, nil
+    }
+    
+    it := iterable.Iter()
+    for item, more := it.Next(); more; item, more = it.Next() {
+        o.Items = append(o.Items, item)
+    }
+    return o, nil
+}
+
+func (o *ListObject) ISub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+// Repeats the items in place.  A negative number of repeats empties the list.
+func (o *ListObject) IMul(r Object) (Object, os.Error) {
+    n, ok := r.(*IntObject)
+    if !ok {
+        return nil, nil
+    }
+    
+    items := o.Items
+    reps := n.Int64()
+    
+    o.Items = nil
+    for i:=int64(0); i < reps; i+=1 {
+        o.Items = append(o.Items, items...)
+    }
+    return o, nil
+}
+
+func (o *ListObject) IDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ListObject) IFloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ListObject) IMod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ListObject) IPow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *ListObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ListObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ListObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A list is true unless it is empty
+func (o *ListObject) IsTrue() (bool) {
+    return len(o.Items) > 0
+}
+
+///////// Protocol Interface ///////////
+
+// A list can be changed, so it can't be hashed.
+func (o *ListObject) Hash() (uint64, os.Error) {
+    return 0, Raise(TypeErrorClass, "unhashable type: 'list'")
+}
+
+// The items are written as Python writes them, so strings are quoted.
+func (o *ListObject) Repr() (string) {
+    items := make([]string, len(o.Items))
+    for i, item := range o.Items {
+        items[i] = item.Repr()
+    }
+    
+    return "[" + strings.Join(items, ", ") + "]"
+}
+
+func (o *ListObject) Str() (string) {
+    return o.Repr()
+}
+
+func (o *ListObject) Len() (int, os.Error) {
+    return len(o.Items), nil
+}
+
+func (o *ListObject) AsBool() (bool) {
+    return o.IsTrue()
+}
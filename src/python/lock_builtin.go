@@ -0,0 +1,210 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the lock built-in object type,
+   for Python threads to take turns with.  A thread that waits to acquire a
+   lock lets go of the lock of the interpreter while it waits, so the thread
+   holding the lock can get on and release it.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+type LockObject struct {
+    ObjectData
+    
+    // Holds a value while the lock is held.
+    held    chan bool
+}
+
+// Returns a lock that isn't held, with the methods acquire, release and locked.
+func NewLock() (*LockObject) {
+    l := new(LockObject)
+    l.ObjectData.Init()
+    l.held = make(chan bool, 1)
+    
+    l.SetAttr("acquire", NewBuiltinFunction("acquire", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) > 1 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("acquire() takes at most 1 argument (%v given)", len(args)))
+        }
+        if len(args) == 1 && !args[0].IsTrue() {
+            return pyBool(l.TryAcquire()), nil
+        }
+        if err := m.BlockingWait(l.acquire); err != nil {
+            return nil, err
+        }
+        return pyBool(true), nil
+    }))
+    l.SetAttr("release", NewBuiltinFunction("release", func(m *Machine, args []Object) (Object, os.Error) {
+        return nil, l.Release()
+    }))
+    l.SetAttr("locked", NewBuiltinFunction("locked", func(m *Machine, args []Object) (Object, os.Error) {
+        return pyBool(l.Locked()), nil
+    }))
+    return l
+}
+
+// Waits until the lock isn't held, and takes it.
+func (o *LockObject) Acquire() {
+    o.held <- true
+}
+
+// Waits until the lock isn't held, and takes it, unless wake gets a value first.
+// Returns whether it took the lock.
+func (o *LockObject) acquire(wake <-chan bool) (bool) {
+    select {
+        case o.held <- true:
+            return true
+        case <-wake:
+    }
+    return false
+}
+
+// Takes the lock if it isn't held, and returns whether it did.
+func (o *LockObject) TryAcquire() (bool) {
+    select {
+        case o.held <- true:
+            return true
+        default:
+    }
+    return false
+}
+
+func (o *LockObject) Release() (os.Error) {
+    select {
+        case <-o.held:
+            return nil
+        default:
+    }
+    return Raise(RuntimeErrorClass, "release unlocked lock")
+}
+
+func (o *LockObject) Locked() (bool) {
+    return len(o.held) > 0
+}
+
+// A lock can't be converted to a number
+func (o *LockObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *LockObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert lock to string
+func (o *LockObject) AsString() (string) {
+    if o.Locked() {
+        return "<locked lock>"
+    }
+    return "<unlocked lock>"
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A lock is only equal to itself, and locks are not ordered.
+func (o *LockObject) Eq(r Object) (Object) {
+    l, ok := r.(*LockObject)
+    return pyBool(ok && l == o)
+}
+
+func (o *LockObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *LockObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *LockObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *LockObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *LockObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *LockObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *LockObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *LockObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *LockObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *LockObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *LockObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *LockObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *LockObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *LockObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *LockObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A lock is always true
+func (o *LockObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *LockObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *LockObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *LockObject) AsBool() (bool) {
+    return o.IsTrue()
+}
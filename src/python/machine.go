@@ -20,7 +20,14 @@
 
 package python
 
-import "encoding/binary"
+import (
+    "big"
+    "fmt"
+    "math"
+    "os"
+    "runtime"
+    "time"
+)
 
 // All instruction types
 const instruction_mask  uint32 = 0x000003f
@@ -39,6 +46,25 @@ const source_reg1_shift uint32 = 12
 const source_reg2_shift uint32 = 16
 const target_reg_shift  uint32 = 20
 
+// Comparisons target a predicate register, with one more bit
+const pred_target_mask  uint32 = 0x1F00000
+
+// CALLFN counts its keyword arguments above the target
+const call_kw_mask      uint32 = 0xF000000
+const call_kw_shift     uint32 = 24
+
+// IALU and FALU keep the arithmetic opcode above the target
+const raw_op_mask       uint32 = 0x3F000000
+const raw_op_shift      uint32 = 24
+
+// ADD to MOD set this bit above the target for an augmented assignment
+const inplace_mask      uint32 = 0x1000000
+const inplace_shift     uint32 = 24
+
+// SPILL and FILL keep a spill slot where the second source and the target would be
+const spill_slot_mask   uint32 = 0xFFFF0000
+const spill_slot_shift  uint32 = 16
+
 
 // Immediate mode instruction types
 const imm_target_reg_mask   uint32 = 0x0000F000
@@ -48,56 +74,1751 @@ const imm_target_reg_shift  uint32 = 12
 const immediate_val_shift   uint32 = 16
 
 
+// Returned by Run when the code doesn't halt within the machine's StepLimit.
+var StepLimitExceeded = os.NewError("step limit exceeded")
+
+// Returned by Run when a call would make the frame stack deeper than the machine's
+// RecursionLimit.
+var RecursionError = Raise(RecursionErrorClass, "maximum recursion depth exceeded")
+
+// The RecursionLimit of a machine that doesn't set one, which is the same as Python's.
+const DefaultRecursionLimit = 1000
+
+// The most registers a frame can have.  Instructions name a register in four bits.
+const MaxRegisters = 16
+
+// The state of a single call of a function.  The locals are indexed by the names of the
+// code object.  A frame without locals runs at module level, and binds its names in the
+// globals, which are shared by every frame of the module.
+type Frame struct {
+    Register    []Object
+    Locals      map[uint16]Object
+    Globals     map[string]Object
+    
+    // The slots that SPILL and FILL move registers to and from.
+    Spill       []Object
+    
+    // The code the frame is executing, the instruction the caller continues at when
+    // the frame returns, and the caller's register that receives the value returned.
+    Code            *CodeObject
+    ReturnAddress   uint32
+    ResultRegister  uint32
+    
+    // The cells of the code's cell variables, followed by the closure of the function.
+    Cells           []*Cell
+    
+    // The raw registers, which hold values that have been unboxed.
+    Ints            [16]int64
+    Longs           [16]*big.Int
+    Floats          [16]float64
+    Strings         [16]string
+    
+    // The line and the instruction last traced in the frame.
+    traceLine       int
+    tracePC         uint32
+}
+
+// Gives the frame the registers and the spill slots that the code c needs, keeping the
+// values already in them.
+func (f *Frame) Reserve(c *CodeObject) {
+    if n := c.RegisterCount(); len(f.Register) < n {
+        registers := make([]Object, n)
+        copy(registers, f.Register)
+        f.Register = registers
+    }
+    if len(f.Spill) < c.NumSpillSlots {
+        spill := make([]Object, c.NumSpillSlots)
+        copy(spill, f.Spill)
+        f.Spill = spill
+    }
+}
+
+// The machine executes the innermost frame, which it embeds, and keeps the frames of
+// the callers on a stack.  The predicate registers are not part of a frame, so they
+// are not preserved across a call.
 type Machine struct {
-    Register    [16]Object     
+    Frame
     Pred        [32]bool
     
+    // The index of the next instruction to execute in the current code object.
     NextInstruction uint32
+    
+    // The frames of the callers of the current frame, innermost last.
+    Frames      []Frame
+    
+    // The deepest the frame stack can get, counting the current frame.  0 means the
+    // DefaultRecursionLimit.
+    RecursionLimit int
+    
+    // Run gives up after executing this many instructions.  0 means there is no limit.
+    StepLimit   int
+    
+    // Set when a HALT instruction is executed, together with the value it returns.
+    Halted      bool
+    Result      Object
+    
+    // Set when Run stops with an error, to the frames that were running.
+    Traceback   *Traceback
+    
+    // The handlers this machine uses instead of the default ones, once SetHandler
+    // has been called.
+    handlers    *[64]Handler
+    
+    // The function set by SetTrace.
+    trace       func(event TraceEvent)
+    
+    // The counts of the profiler, while profiling is on.
+    profile     *Profile
+    
+    // The JIT that hot loops are compiled by, once SetJit has been called.
+    jit         *jit
+    
+    // The breakpoints and watchpoints, once one has been set.
+    debug       *debugger
+    
+    // The flags that stop the machine, as described for Machine.signals, and the timer
+    // of its deadline, if it has one.
+    own         signals
+    shared      *signals
+    deadline    *time.Timer
+    
+    // The budget of the run, if it has one, and the frames of the machines that resumed
+    // the generator or the coroutine the machine runs, which count towards its depth.
+    budget      *budget
+    budgetDepth int
+    
+    // The interpreter the machine runs code for, whose builtins it can use, if any, and
+    // whether the machine holds its lock.
+    Interpreter *Interpreter
+    locked      bool
+    
+    // The frame of the generator or the coroutine the machine is resuming, if it was
+    // made to run one.
+    suspended   *suspendedFrame
 }
 
-func (m *Machine) Dispatch(c* CodeStream) {
-    var instruction uint32     
-    binary.Read(c, binary.LittleEndian, &instruction)
+// An instruction, decoded into its fields.  The registers and the immediate that an
+// instruction's format doesn't have are 0.
+type DecodedIns struct {
+    Op                  uint32
+    Reg1, Reg2, Reg3    uint32
+    Imm                 uint16
+    
+    // The predicate, as described for Machine.predicated.
+    PredExec            bool
+    PredReg             uint32
+    
+    // The opcode of the first instruction of a superinstruction, whose opcode is Op.
+    Fused               uint32
+}
+
+// Decodes instruction based on our instruction formats.
+func Decode(instruction uint32) (ins DecodedIns) {
+    ins.Op       = instruction & instruction_mask
+    ins.PredExec = instruction & pred_execute_mask != 0
+    ins.PredReg  = (instruction & pred_reg_mask)>>pred_reg_shift
+    
+    op := ins.Op
+    switch {
+        case op == CALLFN:
+            ins.Reg1 = (instruction & source_reg1_mask)>>source_reg1_shift
+            ins.Reg2 = (instruction & source_reg2_mask)>>source_reg2_shift
+            ins.Reg3 = (instruction & target_reg_mask)>>target_reg_shift
+            ins.Imm  = uint16((instruction & call_kw_mask)>>call_kw_shift)
+            
+        case op == FORITER:
+            ins.Reg1 = (instruction & imm_target_reg_mask)>>imm_target_reg_shift
+            ins.Imm  = uint16((instruction & immediate_val_mask)>>immediate_val_shift)
+            
+        case op <=15:
+            ins.Reg1 = (instruction & source_reg1_mask)>>source_reg1_shift
+            ins.Reg2 = (instruction & source_reg2_mask)>>source_reg2_shift
+            ins.Reg3 = (instruction & target_reg_mask)>>target_reg_shift
         
-    pred_exec := instruction & pred_execute_mask
-    pred_reg  := (instruction & pred_reg_mask)>>pred_reg_shift
+        case op <=32:
+            ins.Reg3 = (instruction & imm_target_reg_mask)>>imm_target_reg_shift
+            ins.Imm  = uint16((instruction & immediate_val_mask)>>immediate_val_shift)
+            
+        case op == IALU || op == FALU:
+            ins.Reg1 = (instruction & source_reg1_mask)>>source_reg1_shift
+            ins.Reg2 = (instruction & source_reg2_mask)>>source_reg2_shift
+            ins.Reg3 = (instruction & target_reg_mask)>>target_reg_shift
+            ins.Imm  = uint16((instruction & raw_op_mask)>>raw_op_shift)
+            
+        case op >= EQ && op <= GE || op == NOT:
+            ins.Reg1 = (instruction & source_reg1_mask)>>source_reg1_shift
+            ins.Reg2 = (instruction & source_reg2_mask)>>source_reg2_shift
+            ins.Reg3 = (instruction & pred_target_mask)>>target_reg_shift
+            
+        case op >= ADD && op <= MOD:
+            ins.Reg1 = (instruction & source_reg1_mask)>>source_reg1_shift
+            ins.Reg2 = (instruction & source_reg2_mask)>>source_reg2_shift
+            ins.Reg3 = (instruction & target_reg_mask)>>target_reg_shift
+            ins.Imm  = uint16((instruction & inplace_mask)>>inplace_shift)
+            
+        case op == SPILL || op == FILL:
+            ins.Reg1 = (instruction & source_reg1_mask)>>source_reg1_shift
+            ins.Imm  = uint16((instruction & spill_slot_mask)>>spill_slot_shift)
+            
+        default:
+            ins.Reg1 = (instruction & source_reg1_mask)>>source_reg1_shift
+            ins.Reg2 = (instruction & source_reg2_mask)>>source_reg2_shift
+            ins.Reg3 = (instruction & target_reg_mask)>>target_reg_shift
+    }
     
-    // Decide if we should execute this instruction.  If the specified predicate register is
-    // equal to 0 then always execute it. If the pred_exec flag is set and the pred register is false, then 
-    // don't execute.  If the pred_exec flag is clear and the pred register is true, don't execute it.   
-    if pred_reg > 0 && (pred_exec!=0 && !m.Pred[pred_reg]) || (pred_exec==0 && m.Pred[pred_reg]) {
-        return
+    return
+}
+
+// Returns the highest register the instruction names.  The predicate a comparison sets,
+// the raw registers of IALU and FALU, and the counts of CALLFN and the BUILD
+// instructions are not registers.  The registers that hold the arguments of a call or
+// the values of a container are checked when it runs.
+func (ins *DecodedIns) highestRegister() (reg uint32) {
+    regs := []uint32{ins.Reg1, ins.Reg2, ins.Reg3}
+    switch op := ins.Op; {
+        case op == IALU || op == FALU:
+            return 0
+        case op == CALLFN || op >= BUILDLIST && op <= BUILDSET:
+            regs = []uint32{ins.Reg1, ins.Reg3}
+        case op >= EQ && op <= GE || op == NOT:
+            regs = regs[0:2]
     }
     
-    op := instruction & instruction_mask
+    for _, r := range regs {
+        if r > reg {
+            reg = r
+        }
+    }
+    return
+}
+
+// Decide if we should execute this instruction.  If the specified predicate register is
+// equal to 0 then always execute it. If the pred_exec flag is set and the pred register is false, then 
+// don't execute.  If the pred_exec flag is clear and the pred register is true, don't execute it.   
+func (m *Machine) predicated(ins *DecodedIns) (bool) {
+    return ins.PredReg == 0 || m.Pred[ins.PredReg] == ins.PredExec
+}
+
+// Executes the instruction at NextInstruction, and moves on to the next one.  The code
+// is decoded the first time it runs, and the decoded instructions are kept with it.
+func (m *Machine) Dispatch(c* CodeObject) (os.Error) {
+    if m.Code == nil {
+        m.Code = c
+    }
+    if m.Globals == nil {
+        m.Globals = make(map[string]Object, 16)
+    }
+    m.Frame.Reserve(c)
+    
+    code := c.Decoded()
+    pc   := m.NextInstruction
+    
+    if int(pc) >= len(code) {
+        return os.NewError(fmt.Sprintf("no instruction at %v", pc))
+    }
+    
+    ins := &code[pc]
+    if ins.Op == ENTERJIT && !m.entersJit() {
+        ins = c.unpatched(pc)
+    }
+    m.NextInstruction++
     
-    var reg1, reg2, reg3 uint32  
-    var imm              uint16     
+    if m.profile != nil {
+        m.profile.count(c, pc, ins.Op)
+    }
     
-    // Decoder stage - decodes the instruction based on our instruction formats.
+    runs := m.predicated(ins)
+    if m.budget != nil {
+        if err := m.budget.charge(ins.Op, runs); err != nil {
+            return err
+        }
+    }
+    if !runs {
+        return nil
+    }
+    if m.Interpreter != nil && allocates[ins.Op] {
+        m.Interpreter.allocated(m)
+    }
+    
+    h := m.handler(ins.Op)
+    if h == nil {
+        return os.NewError(fmt.Sprintf("instruction %v has an unsupported opcode %v", pc, ins.Op))
+    }
+    return h(m, &m.Frame, *ins)
+}
+
+// Returns the handler the machine uses for op.
+func (m *Machine) handler(op uint32) (Handler) {
+    if m.handlers != nil {
+        return m.handlers[op]
+    }
+    return handlers[op]
+}
+
+// Executes a single decoded instruction in f, the current frame of m.  NextInstruction
+// has already moved past the instruction.
+type Handler func(m *Machine, f *Frame, ins DecodedIns) (os.Error)
+
+// The handler of each opcode.  Opcodes without one are unsupported.
+var handlers [64]Handler
+
+// Calls, generators, coroutines, superinstructions and ENTERJIT all dispatch through the
+// table again, so the handlers refer back to it, and it can only be filled in once the
+// package has been initialized.
+func init() {
+    handlers = [64]Handler{
+        NOP:            func(m *Machine, f *Frame, ins DecodedIns) (os.Error) { return nil },
+        LOAD:           execLoad,
+        BIND:           execBind,
+        CONST:          execConst,
+        JMP:            execJump,
+        CALL:           execCall,
+        CALLFN:         execCallFunction,
+        MAKECLOSURE:    execMakeClosure,
+        RET:            execRet,
+        HALT:           execHalt,
+        GET:            execAttribute,
+        SET:            execAttribute,
+        BOXI:           execBox,
+        BOXL:           execBox,
+        BOXF:           execBox,
+        BOXS:           execBox,
+        BOXB:           execBox,
+        UNBOXI:         execUnbox,
+        UNBOXL:         execUnbox,
+        UNBOXF:         execUnbox,
+        UNBOXS:         execUnbox,
+        UNBOXB:         execUnbox,
+        IALU:           execIntAlu,
+        FALU:           execFloatAlu,
+        NEG:            execUnary,
+        POS:            execUnary,
+        INVERT:         execUnary,
+        NOT:            execNot,
+        INDEX:          execIndex,
+        STOREINDEX:     execIndex,
+        BUILDLIST:      execBuild,
+        BUILDTUPLE:     execBuild,
+        BUILDDICT:      execBuild,
+        BUILDSET:       execBuild,
+        MOVE:           execMove,
+        YIELD:          execYield,
+        SPILL:          execSpill,
+        FILL:           execFill,
+        GETITER:        execGetIter,
+        LOADDEREF:      execLoadDeref,
+        STOREDEREF:     execStoreDeref,
+        ADD:            execArithmetic,
+        SUB:            execArithmetic,
+        MUL:            execArithmetic,
+        DIV:            execArithmetic,
+        FDIV:           execArithmetic,
+        MOD:            execArithmetic,
+        EQ:             execCompare,
+        NE:             execCompare,
+        LT:             execCompare,
+        LE:             execCompare,
+        GT:             execCompare,
+        GE:             execCompare,
+        FORITER:        execForIter,
+        AWAIT:          execAwait,
+        LOADALU:        execFused,
+        CONSTALU:       execFused,
+        CMPJMP:         execFused,
+        ENTERJIT:       execEnterJit,
+    }
+}
+
+// Replaces the handler of the opcode op on this machine only, and returns the handler it
+// replaced, so a hook can pass the instruction on to it.
+func (m *Machine) SetHandler(op uint32, h Handler) (Handler) {
+    if m.handlers == nil {
+        m.handlers = new ([64]Handler)
+        *m.handlers = handlers
+    }
+    
+    old := m.handlers[op]
+    m.handlers[op] = h
+    return old
+}
+
+// The error for the instruction just dispatched reading a register that holds nothing.
+func (m *Machine) emptyRegister() (os.Error) {
+    return os.NewError(fmt.Sprintf("instruction %v reads an empty register", m.NextInstruction-1))
+}
+
+func execLoad(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    return m.load(f.Code, ins.Imm, ins.Reg3)
+}
+
+func execBind(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    var old Object
+    if f.Locals != nil {
+        old = f.Locals[ins.Imm]
+        f.Locals[ins.Imm] = f.Register[ins.Reg3]
+    } else {
+        old = f.Globals[f.Code.Names[ins.Imm]]
+        f.Globals[f.Code.Names[ins.Imm]] = f.Register[ins.Reg3]
+        m.invalidateGlobal(f.Code.Names[ins.Imm])
+    }
+    
+    if m.debug != nil {
+        m.debug.bound(m, f, ins.Imm, old, f.Register[ins.Reg3])
+    }
+    return nil
+}
+
+func execConst(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    f.Register[ins.Reg3] = f.Code.Constants[ins.Imm]
+    return nil
+}
+
+// A jump back to an earlier instruction is the back edge of a loop, which the JIT
+// counts.
+func execJump(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if m.jit != nil && uint32(ins.Imm) < m.NextInstruction {
+        if err := m.jit.backEdge(f.Code, f, uint32(ins.Imm), m.NextInstruction-1); err != nil {
+            return err
+        }
+    }
+    m.NextInstruction = uint32(ins.Imm)
+    return nil
+}
+
+func execCall(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    return m.call(uint32(ins.Imm), ins.Reg3)
+}
+
+func execCallFunction(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    return m.callFunction(ins.Reg1, ins.Reg2, uint32(ins.Imm), ins.Reg3)
+}
+
+func execMakeClosure(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    return m.makeClosure(f.Code, ins.Reg1, ins.Reg3)
+}
+
+func execRet(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    m.ret(f.Register[ins.Reg1])
+    return nil
+}
+
+func execHalt(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    m.Halted = true
+    m.Result = f.Register[ins.Reg1]
+    return nil
+}
+
+// GET and SET
+func execAttribute(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    obj, key := f.Register[ins.Reg1], f.Register[ins.Reg2]
+    if obj == nil || key == nil {
+        return m.emptyRegister()
+    }
+    name, ok := key.(*StringObject)
+    if !ok {
+        return Raise(TypeErrorClass, fmt.Sprintf("attribute name must be string, not '%v'", key))
+    }
+    
+    if ins.Op == SET {
+        if err := m.setAttr(obj, name.Value, f.Register[ins.Reg3]); err != nil {
+            return err
+        }
+        if name.Value == "__del__" && m.Interpreter != nil {
+            m.Interpreter.finalizeDel(obj)
+        }
+        return nil
+    }
+    value, err := m.getAttr(obj, name.Value)
+    if err != nil {
+        return err
+    }
+    f.Register[ins.Reg3] = value
+    return nil
+}
+
+func execBox(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if int(ins.Imm) >= len(f.Ints) {
+        return os.NewError(fmt.Sprintf("instruction %v refers to a missing raw register %v", m.NextInstruction-1, ins.Imm))
+    }
+    f.Register[ins.Reg3] = m.box(ins.Op, ins.Imm)
+    return nil
+}
+
+func execUnbox(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if int(ins.Imm) >= len(f.Ints) {
+        return os.NewError(fmt.Sprintf("instruction %v refers to a missing raw register %v", m.NextInstruction-1, ins.Imm))
+    }
+    if f.Register[ins.Reg3] == nil {
+        return m.emptyRegister()
+    }
+    return m.unbox(ins.Op, f.Register[ins.Reg3], ins.Imm)
+}
+
+func execIntAlu(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    result, err := rawIntArithmetic(uint32(ins.Imm), f.Ints[ins.Reg1], f.Ints[ins.Reg2])
+    if err != nil {
+        return err
+    }
+    f.Ints[ins.Reg3] = result
+    return nil
+}
+
+func execFloatAlu(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    result, err := rawFloatArithmetic(uint32(ins.Imm), f.Floats[ins.Reg1], f.Floats[ins.Reg2])
+    if err != nil {
+        return err
+    }
+    f.Floats[ins.Reg3] = result
+    return nil
+}
+
+// NEG, POS and INVERT
+func execUnary(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if f.Register[ins.Reg1] == nil {
+        return m.emptyRegister()
+    }
+    result, err := unary(ins.Op, f.Register[ins.Reg1])
+    if err != nil {
+        return err
+    }
+    if result == nil {
+        return Raise(TypeErrorClass, fmt.Sprintf("bad operand type for instruction %v", m.NextInstruction-1))
+    }
+    f.Register[ins.Reg3] = result
+    return nil
+}
+
+func execNot(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if f.Register[ins.Reg1] == nil {
+        return m.emptyRegister()
+    }
+    // Predicate register 0 means "always", so it can't be set.
+    if ins.Reg3 != 0 {
+        m.Pred[ins.Reg3] = !f.Register[ins.Reg1].IsTrue()
+    }
+    return nil
+}
+
+// INDEX and STOREINDEX
+func execIndex(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if f.Register[ins.Reg1] == nil || f.Register[ins.Reg2] == nil {
+        return m.emptyRegister()
+    }
+    return m.index(ins.Op, f.Register[ins.Reg1], f.Register[ins.Reg2], ins.Reg3)
+}
+
+func execBuild(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    return m.build(ins.Op, ins.Reg1, ins.Reg2, ins.Reg3)
+}
+
+func execMove(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    f.Register[ins.Reg3] = f.Register[ins.Reg1]
+    return nil
+}
+
+// SPILL and FILL fail on a slot beyond the spill area of the frame, which is as big as
+// the NumSpillSlots of its code.
+func execSpill(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if int(ins.Imm) >= len(f.Spill) {
+        return os.NewError(fmt.Sprintf("instruction %v spills to slot %v, but there are only %v", m.NextInstruction-1, ins.Imm, len(f.Spill)))
+    }
+    f.Spill[ins.Imm] = f.Register[ins.Reg1]
+    return nil
+}
+
+func execFill(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if int(ins.Imm) >= len(f.Spill) {
+        return os.NewError(fmt.Sprintf("instruction %v fills from slot %v, but there are only %v", m.NextInstruction-1, ins.Imm, len(f.Spill)))
+    }
+    f.Register[ins.Reg1] = f.Spill[ins.Imm]
+    return nil
+}
+
+// YIELD halts the machine running the generator, with the value yielded as its result.
+func execYield(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if m.suspended == nil || m.suspended.kind != "generator" {
+        return os.NewError(fmt.Sprintf("instruction %v yields outside a generator", m.NextInstruction-1))
+    }
+    
+    m.suspended.yielded = true
+    m.suspended.sendReg = ins.Reg3
+    m.Halted = true
+    m.Result = f.Register[ins.Reg1]
+    return nil
+}
+
+// AWAIT halts the machine running the coroutine while what it awaits isn't done, with
+// the future it is waiting for as its result, and runs again when the coroutine is
+// resumed.  A coroutine that awaits another passes the value sent in on to it.
+func execAwait(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if m.suspended == nil || m.suspended.kind != "coroutine" {
+        return os.NewError(fmt.Sprintf("instruction %v awaits outside a coroutine", m.NextInstruction-1))
+    }
+    sent := m.suspended.sent
+    m.suspended.sent = nil
+    
+    var waiting Object
+    switch a := f.Register[ins.Reg1].(type) {
+        case *CoroutineObject:
+            if a.finished {
+                return Raise(RuntimeErrorClass, "cannot reuse already awaited coroutine")
+            }
+            value, err := a.resume(m, sent)
+            switch {
+                case err == StopIteration:
+                    f.Register[ins.Reg3] = a.Value
+                    return nil
+                case err != nil:
+                    return err
+            }
+            waiting = value
+        
+        case *FutureObject:
+            if a.Done {
+                f.Register[ins.Reg3] = a.Result
+                return a.Err
+            }
+            waiting = a
+        
+        default:
+            return Raise(TypeErrorClass, fmt.Sprintf("object %v can't be used in 'await' expression", f.Register[ins.Reg1]))
+    }
+    
+    m.suspended.yielded = true
+    m.suspended.awaiting = true
+    m.NextInstruction--
+    m.Halted = true
+    m.Result = waiting
+    return nil
+}
+
+func execGetIter(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    it, err := m.iter(f.Register[ins.Reg1])
+    if err != nil {
+        return err
+    }
+    f.Register[ins.Reg3] = it
+    return nil
+}
+
+func execForIter(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    pc := m.NextInstruction-1
+    if int(ins.Reg1)+1 >= len(f.Register) {
+        return os.NewError(fmt.Sprintf("instruction %v has no register for the next item", pc))
+    }
+    
+    value, more, err := m.next(f.Register[ins.Reg1])
     switch {
-        case op <=15:
+        case err != nil:
+            return err
+        case more:
+            f.Register[ins.Reg1+1] = value
+        default:
+            m.NextInstruction = uint32(ins.Imm)
+    }
+    return nil
+}
+
+func execLoadDeref(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if int(ins.Imm) >= len(f.Cells) {
+        return os.NewError(fmt.Sprintf("instruction %v refers to a missing cell %v", m.NextInstruction-1, ins.Imm))
+    }
+    if f.Cells[ins.Imm].Value == nil {
+        return Raise(NameErrorClass, fmt.Sprintf("free variable '%v' referenced before assignment", f.Code.DerefName(ins.Imm)))
+    }
+    f.Register[ins.Reg3] = f.Cells[ins.Imm].Value
+    return nil
+}
+
+func execStoreDeref(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if int(ins.Imm) >= len(f.Cells) {
+        return os.NewError(fmt.Sprintf("instruction %v refers to a missing cell %v", m.NextInstruction-1, ins.Imm))
+    }
+    f.Cells[ins.Imm].Value = f.Register[ins.Reg3]
+    return nil
+}
+
+// ADD, SUB, MUL, DIV, FDIV and MOD.  Those of an augmented assignment, which have their
+// in-place flag set, try to change the left operand in place.
+func execArithmetic(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if f.Register[ins.Reg1] == nil || f.Register[ins.Reg2] == nil {
+        return m.emptyRegister()
+    }
+    var result Object
+    var err os.Error
+    if ins.Imm != 0 {
+        result, err = m.inPlaceOp(ins.Op, f.Register[ins.Reg1], f.Register[ins.Reg2])
+    } else {
+        result, err = m.binaryOp(ins.Op, f.Register[ins.Reg1], f.Register[ins.Reg2])
+    }
+    if err != nil {
+        return err
+    }
+    f.Register[ins.Reg3] = result
+    return nil
+}
+
+// EQ, NE, LT, LE, GT and GE
+func execCompare(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+    if f.Register[ins.Reg1] == nil || f.Register[ins.Reg2] == nil {
+        return m.emptyRegister()
+    }
+    result, err := m.richCompare(ins.Op, f.Register[ins.Reg1], f.Register[ins.Reg2])
+    if err != nil {
+        return err
+    }
+    // Predicate register 0 means "always", so it can't be set.
+    if ins.Reg3 != 0 {
+        m.Pred[ins.Reg3] = result.IsTrue()
+    }
+    return nil
+}
+
+// Loads the name with the index imm in the code c into reg.  Names that aren't bound in
+// the frame are looked up in the globals, and then in the builtins of the interpreter.
+func (m *Machine) load(c *CodeObject, imm uint16, reg uint32) (os.Error) {
+    if value, present := m.Locals[imm]; present {
+        m.Register[reg] = value
+        return nil
+    }
+    
+    value, present := m.Globals[c.Names[imm]]
+    if !present && m.Interpreter != nil {
+        value, present = m.Interpreter.Builtins[c.Names[imm]]
+    }
+    if !present {
+        return Raise(NameErrorClass, fmt.Sprintf("name '%v' is not defined", c.Names[imm]))
+    }
+    
+    m.Register[reg] = value
+    return nil
+}
+
+// Binds name in the globals of the machine.
+func (m *Machine) BindGlobal(name string, value Object) {
+    if m.Globals == nil {
+        m.Globals = make(map[string]Object, 16)
+    }
+    m.Globals[name] = value
+    m.invalidateGlobal(name)
+}
+
+// Makes sure a frame can have as many registers as the code c needs, and that c doesn't
+// name a register beyond them.
+func (m *Machine) checkRegisters(c *CodeObject) (os.Error) {
+    n := c.RegisterCount()
+    if n > MaxRegisters {
+        return os.NewError(fmt.Sprintf("%v needs %v registers, but a frame can only have %v", c.Name, n, MaxRegisters))
+    }
+    if c.Decoded(); c.usedRegisters > n {
+        return os.NewError(fmt.Sprintf("%v uses %v registers, but only has %v", c.Name, c.usedRegisters, n))
+    }
+    return nil
+}
+
+// Saves the current frame on the stack, so a call can replace it.
+func (m *Machine) pushFrame() (os.Error) {
+    limit := m.RecursionLimit
+    if limit <= 0 {
+        limit = DefaultRecursionLimit
+    }
+    if len(m.Frames)+1 >= limit {
+        return RecursionError
+    }
+    if m.budget != nil {
+        if err := m.budget.enter(m.budgetDepth + len(m.Frames) + 2); err != nil {
+            return err
+        }
+    }
+    
+    m.Frames = append(m.Frames, m.Frame)
+    return nil
+}
+
+// Pushes a frame for a call of the code at target, whose result goes in result_reg.
+// The callee starts with a copy of the caller's registers, which is how the arguments
+// are passed, and with no locals and an empty spill area.
+func (m *Machine) call(target, result_reg uint32) (os.Error) {
+    if err := m.pushFrame(); err != nil {
+        return err
+    }
+    
+    m.Register = append([]Object(nil), m.Register...)
+    m.Spill = make([]Object, m.Code.NumSpillSlots)
+    m.Locals = make(map[uint16]Object, 16)
+    m.ReturnAddress = m.NextInstruction
+    m.ResultRegister = result_reg
+    m.NextInstruction = target
+    if m.trace != nil {
+        m.traceCall()
+    }
+    return nil
+}
+
+// Calls the function in fn_reg with the arguments in the registers after it, as
+// described for CodeObject.WriteCallFunction, and starts executing its code in a new frame.
+func (m *Machine) callFunction(fn_reg, nargs, nkw, result_reg uint32) (os.Error) {
+    first := int(fn_reg) + 1
+    last := first + int(nargs+nkw)
+    if nkw > 0 {
+        last++
+    }
+    if last > len(m.Register) {
+        return os.NewError(fmt.Sprintf("the arguments of a call in r%v don't fit in the registers", fn_reg))
+    }
+    
+    args := m.Register[first : first+int(nargs)]
+    kwargs := m.Register[first+int(nargs) : first+int(nargs+nkw)]
+    
+    var kwnames []string
+    if nkw > 0 {
+        names, ok := m.Register[last-1].(*TupleObject)
+        if !ok || len(names.Items) != int(nkw) {
+            return os.NewError(fmt.Sprintf("the keyword arguments of a call in r%v have no names", fn_reg))
+        }
+        for _, name := range names.Items {
+            kwnames = append(kwnames, name.AsString())
+        }
+    }
+    
+    return m.invoke(m.Register[fn_reg], args, kwnames, kwargs, result_reg)
+}
+
+// Calls fn with the arguments args and the keyword arguments kwargs named by kwnames.
+// A function starts executing in a new frame, as does the function of a bound method,
+// and any other Callable object is called right away.  The result goes in result_reg.
+func (m *Machine) invoke(fn Object, args []Object, kwnames []string, kwargs []Object, result_reg uint32) (os.Error) {
+    switch f := fn.(type) {
+        case *FunctionObject:
+            return m.enter(f, args, kwnames, kwargs, result_reg)
         
-        case op <=31:
-            reg3 = (instruction & imm_target_reg_mask)>>imm_target_reg_shift
-            imm  = uint16((instruction & immediate_val_mask)>>immediate_val_shift)
-            
+        case *BoundMethodObject:
+            return m.invoke(f.Fn, append([]Object{f.Self}, args...), kwnames, kwargs, result_reg)
+        
+        case Callable:
+            // The arguments are in the registers, which the callee may outlive.
+            args = append([]Object(nil), args...)
+            kwargs = append([]Object(nil), kwargs...)
+            result, err := f.Call(m, args, kwnames, kwargs)
+            if err != nil {
+                return err
+            }
+            if result == nil {
+                result = None
+            }
+            m.Register[result_reg] = result
+            return nil
+    }
+    return Raise(TypeErrorClass, fmt.Sprintf("'%v' is not callable", fn))
+}
+
+// Returns an iterator over the items of o, as iter() does.  An instance is iterated by
+// what the __iter__ method of its class returns, which has to have a __next__ method.
+func (m *Machine) iter(o Object) (Object, os.Error) {
+    switch i := o.(type) {
+        case Iterable:
+            return i.Iter(), nil
+        
+        case *InstanceObject:
+            method, present := i.Class.Lookup("__iter__")
+            if !present {
+                break
+            }
+            it, err := m.callNested(method, []Object{i})
+            if err != nil {
+                return nil, err
+            }
+            if _, ok := it.(Iterator); !ok {
+                if c, ok := it.(*InstanceObject); !ok || !hasMethod(c, "__next__") {
+                    return nil, Raise(TypeErrorClass, fmt.Sprintf("iter() returned non-iterator '%v'", it.AsString()))
+                }
+            }
+            return it, nil
+    }
+    return nil, Raise(TypeErrorClass, fmt.Sprintf("'%v' is not iterable", o))
+}
+
+func hasMethod(o *InstanceObject, name string) (bool) {
+    _, present := o.Class.Lookup(name)
+    return present
+}
+
+// Returns the next item of the iterator it, or false once there are no more.  Unlike
+// Next, it returns the error a generator or a __next__ method fails with.  A __next__
+// method raises StopIteration when there are no more items.
+func (m *Machine) next(it Object) (Object, bool, os.Error) {
+    switch i := it.(type) {
+        case *GeneratorObject:
+            value, err := i.resume(m, None)
+            if err == StopIteration {
+                return nil, false, nil
+            }
+            return value, err == nil, err
+        
+        case Iterator:
+            value, more := i.Next()
+            return value, more, nil
+        
+        case *InstanceObject:
+            method, present := i.Class.Lookup("__next__")
+            if !present {
+                break
+            }
+            value, err := m.callNested(method, []Object{i})
+            if err != nil && IsException(err, StopIterationClass) {
+                return nil, false, nil
+            }
+            return value, err == nil, err
+    }
+    return nil, false, Raise(TypeErrorClass, fmt.Sprintf("'%v' is not an iterator", it))
+}
+
+// Calls fn with each item of o in turn, as a for loop does, until fn fails.
+func (m *Machine) forEach(o Object, fn func(item Object) (os.Error)) (os.Error) {
+    it, err := m.iter(o)
+    if err != nil {
+        return err
+    }
+    for {
+        item, more, err := m.next(it)
+        if err != nil || !more {
+            return err
+        }
+        if err = fn(item); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Passes the hooks of the machine, and what is left of its recursion limit, on to the
+// machine m, which runs code on its behalf.
+func (parent *Machine) inherit(m *Machine) (os.Error) {
+    m.locked = parent.locked
+    limit := parent.RecursionLimit
+    if limit <= 0 {
+        limit = DefaultRecursionLimit
+    }
+    m.RecursionLimit = limit - len(parent.Frames) - 1
+    if m.RecursionLimit <= 1 {
+        return RecursionError
+    }
+    m.handlers = parent.handlers
+    m.trace = parent.trace
+    m.profile = parent.profile
+    m.shared = parent.signals()
+    m.budget = parent.budget
+    m.budgetDepth = parent.budgetDepth + len(parent.Frames) + 1
+    return nil
+}
+
+// Calls fn with args in the middle of an instruction, and returns the value it returns.
+// The call runs on a machine of its own, so the frames of this one are left alone.
+func (m *Machine) callNested(fn Object, args []Object) (Object, os.Error) {
+    return m.callNestedKeywords(fn, args, nil, nil)
+}
+
+// Calls fn with args and the keyword arguments kwargs named by kwnames, as callNested
+// does.
+func (m *Machine) callNestedKeywords(fn Object, args []Object, kwnames []string, kwargs []Object) (Object, os.Error) {
+    nested := new (Machine)
+    nested.Interpreter = m.Interpreter
+    if err := m.inherit(nested); err != nil {
+        return nil, err
+    }
+    return nested.CallObjectKeywords(fn, args, kwnames, kwargs)
+}
+
+// Calls fn with args from Go, and returns the value it returns.  A function runs on
+// the machine until it returns, in a frame of its own, after which the machine is
+// left halted.  The machine holds the lock of the interpreter during the call.
+func (m *Machine) CallObject(fn Object, args []Object) (Object, os.Error) {
+    return m.CallObjectKeywords(fn, args, nil, nil)
+}
+
+// Calls fn with args and the keyword arguments kwargs named by kwnames from Go, as
+// CallObject does.
+func (m *Machine) CallObjectKeywords(fn Object, args []Object, kwnames []string, kwargs []Object) (Object, os.Error) {
+    defer m.lock()()
+    
+    // The function returns to a trampoline, which halts with its result.
+    trampoline := new (CodeObject)
+    trampoline.Init()
+    trampoline.Name = "<call>"
+    trampoline.NumRegisters = 1
+    trampoline.WriteHalt(0, false, 0)
+    
+    m.Frame = Frame{Code: trampoline, Register: make([]Object, 1)}
+    if f, ok := fn.(*FunctionObject); ok {
+        m.Globals = f.Globals
+    }
+    m.Frames = nil
+    m.NextInstruction = 0
+    if err := m.invoke(fn, args, kwnames, kwargs, 0); err != nil {
+        return nil, err
+    }
+    return m.Run(trampoline)
+}
+
+// Starts executing fn in a new frame, with the arguments args and the keyword arguments
+// kwargs named by kwnames.  The value it returns goes in result_reg.
+func (m *Machine) enter(fn *FunctionObject, args []Object, kwnames []string, kwargs []Object, result_reg uint32) (os.Error) {
+    values, err := fn.bindArguments(args, kwnames, kwargs)
+    if err != nil {
+        return err
+    }
+    if len(values) >= fn.Code.RegisterCount() {
+        return os.NewError(fmt.Sprintf("%v() has too many parameters to pass in registers", fn.Code.Name))
+    }
+    if err := m.checkRegisters(fn.Code); err != nil {
+        return err
+    }
+    if len(fn.Closure) != len(fn.Code.FreeVars) {
+        return os.NewError(fmt.Sprintf("%v() has free variables, and has to be made by MAKECLOSURE", fn.Code.Name))
+    }
+    
+    f := Frame{
+        Locals:         make(map[uint16]Object, 16),
+        Globals:        fn.Globals,
+        Register:       make([]Object, fn.Code.RegisterCount()),
+        Spill:          make([]Object, fn.Code.NumSpillSlots),
+        Code:           fn.Code,
+        ReturnAddress:  m.NextInstruction,
+        ResultRegister: result_reg,
+    }
+    for i, value := range values {
+        f.Register[i+1] = value
+        f.Locals[uint16(i)] = value
+    }
+    
+    // A parameter that a nested function uses starts out in its cell.
+    f.Cells = make([]*Cell, len(fn.Code.CellVars), len(fn.Code.CellVars)+len(fn.Closure))
+    for i, name := range fn.Code.CellVars {
+        f.Cells[i] = new (Cell)
+        if index, present := fn.Code.NameIndices[name]; present && int(index) < len(values) {
+            f.Cells[i].Value = values[index]
+        }
+    }
+    f.Cells = append(f.Cells, fn.Closure...)
+    
+    // The frame of a generator or a coroutine is kept by it, until it is run.
+    switch {
+        case fn.Code.Generator:
+            g := NewGenerator(f)
+            g.interp = m.Interpreter
+            m.Register[result_reg] = g
+            return nil
+        case fn.Code.Coroutine:
+            c := NewCoroutine(f)
+            c.interp = m.Interpreter
+            m.Register[result_reg] = c
+            return nil
+    }
+    
+    if err := m.pushFrame(); err != nil {
+        return err
+    }
+    m.Frame = f
+    m.NextInstruction = 0
+    if m.trace != nil {
+        m.traceCall()
+    }
+    return nil
+}
+
+// Executes INDEX, which puts obj[key] in reg, or STOREINDEX, which sets obj[key] to the
+// value in reg.  Objects that aren't Indexers are subscripted by calling their
+// __getitem__ or __setitem__ attribute with the object and the key, and the value.
+func (m *Machine) index(op uint32, obj, key Object, reg uint32) (os.Error) {
+    if i, ok := obj.(Indexer); ok {
+        if op == STOREINDEX {
+            return i.SetItem(key, m.Register[reg])
+        }
+        value, err := i.GetItem(key)
+        if err != nil {
+            return err
+        }
+        m.Register[reg] = value
+        return nil
+    }
+    
+    // Register 0 is never allocated, so it can take whatever __setitem__ returns.
+    name, args := "__getitem__", []Object{obj, key}
+    if op == STOREINDEX {
+        name, args = "__setitem__", append(args, m.Register[reg])
+        reg = 0
+    }
+    
+    method, present := obj.GetAttr(name)
+    if !present {
+        return Raise(TypeErrorClass, fmt.Sprintf("'%v' does not support %v", obj.AsString(), name))
+    }
+    return m.invoke(method, args, nil, nil, reg)
+}
+
+// Makes a copy of the function in fn_reg whose closure holds the cells of its free
+// variables, taken from the current frame by name, and puts it in target_reg.
+func (m *Machine) makeClosure(c *CodeObject, fn_reg, target_reg uint32) (os.Error) {
+    fn, ok := m.Register[fn_reg].(*FunctionObject)
+    if !ok {
+        return os.NewError(fmt.Sprintf("MAKECLOSURE needs a function, not '%v'", m.Register[fn_reg]))
+    }
+    
+    closure := make([]*Cell, len(fn.Code.FreeVars))
+    for i, name := range fn.Code.FreeVars {
+        index, present := c.DerefIndex(name)
+        if !present || int(index) >= len(m.Cells) {
+            return os.NewError(fmt.Sprintf("%v() uses '%v', which %v doesn't keep in a cell", fn.Code.Name, name, c.Name))
+        }
+        closure[i] = m.Cells[index]
+    }
+    
+    f := NewFunction(fn.Code, fn.Defaults, m.Globals)
+    f.Closure = closure
+    m.Register[target_reg] = f
+    return nil
+}
+
+// Builds a container of the type op from the values in count registers, starting with
+// first, as described for CodeObject.WriteBuild, and puts it in target.
+func (m *Machine) build(op, first, count, target uint32) (os.Error) {
+    n := count
+    if op == BUILDDICT {
+        n *= 2
+    }
+    if int(first+n) > len(m.Register) {
+        return os.NewError(fmt.Sprintf("the %v values from r%v don't fit in the registers", n, first))
+    }
+    
+    values := make([]Object, n)
+    for i := range values {
+        values[i] = m.Register[first+uint32(i)]
+        if values[i] == nil {
+            return os.NewError(fmt.Sprintf("a container is built from an empty register r%v", first+uint32(i)))
+        }
+    }
+    
+    switch op {
+        case BUILDLIST:
+            m.Register[target] = NewList(values)
+        case BUILDTUPLE:
+            m.Register[target] = NewTuple(values)
+        case BUILDDICT:
+            d := NewDict()
+            d.key = m.hashKey()
+            for i := 0; i < len(values); i += 2 {
+                if err := d.Set(values[i], values[i+1]); err != nil {
+                    return err
+                }
+            }
+            m.Register[target] = d
+        case BUILDSET:
+            s := NewSet()
+            s.key = m.hashKey()
+            for _, value := range values {
+                if err := s.Insert(value); err != nil {
+                    return err
+                }
+            }
+            m.Register[target] = s
+    }
+    return nil
+}
+
+// Pops the current frame, and passes value back to the caller.  Returning from the
+// outermost frame halts the machine.
+func (m *Machine) ret(value Object) {
+    if len(m.Frames) == 0 {
+        m.Halted = true
+        m.Result = value
+        return
+    }
+    if m.trace != nil {
+        m.traceReturn(value)
+    }
+    
+    callee := m.Frame
+    m.Frame = m.Frames[len(m.Frames)-1]
+    m.Frames = m.Frames[0 : len(m.Frames)-1]
+    
+    m.Register[callee.ResultRegister] = value
+    m.NextInstruction = callee.ReturnAddress
+}
+
+// Takes the lock of the interpreter, unless the machine has no interpreter or holds the
+// lock already, and returns the function that lets go of it again.
+func (m *Machine) lock() (func()) {
+    if m.Interpreter == nil || m.locked {
+        return func() {}
+    }
+    
+    m.Interpreter.Lock()
+    m.locked = true
+    return func() {
+        m.locked = false
+        m.Interpreter.Unlock()
+    }
+}
+
+// Calls fn with the lock of the interpreter released, if the machine holds it, so other
+// machines can run while fn waits for something.  fn must not use any objects.
+func (m *Machine) Blocking(fn func()) {
+    if !m.locked {
+        fn()
+        return
+    }
+    
+    m.Interpreter.Unlock()
+    fn()
+    m.Interpreter.Lock()
+}
+
+// Executes the code from NextInstruction until it halts, and returns the value it
+// returned.  Running off the end of a function returns from it without a value, and
+// running off the end of the outermost code halts.  If an instruction fails, Run stops
+// there and returns the error, and the Traceback of the machine shows where it failed,
+// as it does when the machine is interrupted or its deadline passes.  If the debugger
+// pauses the machine, Run returns Paused, and running it again carries on.  A machine
+// with an Interpreter holds the lock of the interpreter while it runs, except that it
+// lets go of it every SwitchInterval instructions, to let other machines run.
+func (m *Machine) Run(c *CodeObject) (Object, os.Error) {
+    m.Halted = false
+    m.Result = nil
+    m.Traceback = nil
+    defer m.lock()()
+    
+    if m.Code == nil {
+        m.Code = c
+    }
+    if err := m.checkRegisters(m.Code); err != nil {
+        return nil, err
+    }
+    m.Frame.Reserve(m.Code)
+    if m.trace != nil && m.NextInstruction == 0 && len(m.Frames) == 0 {
+        m.traceCall()
+    }
+    
+    for steps := 0; !m.Halted; steps++ {
+        if int(m.NextInstruction) >= len(m.Code.Decoded()) {
+            if len(m.Frames) == 0 {
+                break
+            }
+            m.ret(nil)
+            continue
+        }
+        if m.StepLimit > 0 && steps >= m.StepLimit {
+            return nil, StepLimitExceeded
+        }
+        if m.locked && steps > 0 && steps % SwitchInterval == 0 {
+            m.Blocking(runtime.Gosched)
+        }
+        if m.debug != nil && m.debug.breakpoint(m) {
+            return nil, Paused
+        }
+        if m.trace != nil {
+            m.traceLine()
+        }
+        err := m.poll()
+        if err == nil {
+            err = m.Dispatch(m.Code)
+        }
+        if err != nil {
+            m.Traceback = m.traceback(err)
+            if m.trace != nil {
+                m.traceException(err)
+            }
+            return nil, err
+        }
+        if m.debug != nil && m.debug.paused() {
+            return nil, Paused
+        }
+    }
+    
+    if m.trace != nil {
+        m.traceReturn(m.Result)
+    }
+    return m.Result, nil
+}
+
+// Python converts an int to a float when the other operand is a float, and an int or a
+// float to a complex when the other operand is a complex.  The builtins convert the
+// right operand to the type of the left one, so the left one has to be converted first.
+func promoteOperands(l, r Object) (Object, Object) {
+    _, l_int := l.(*IntObject)
+    _, l_float := l.(*FloatObject)
+    _, r_float := r.(*FloatObject)
+    _, r_complex := r.(*ComplexObject)
+    
+    if (l_int || l_float) && r_complex {
+        l = NewComplex(complex(l.AsFloat(), 0))
+    } else if l_int && r_float {
+        l = NewFloat(l.AsFloat())
+    }
+    
+    return l, r
+}
+
+// The methods of the arithmetic instructions, and their reflected methods, which are
+// called on the right operand with the left one.
+var binaryMethods = map[uint32][2]string{
+    ADD:    {"__add__", "__radd__"},
+    SUB:    {"__sub__", "__rsub__"},
+    MUL:    {"__mul__", "__rmul__"},
+    DIV:    {"__truediv__", "__rtruediv__"},
+    FDIV:   {"__floordiv__", "__rfloordiv__"},
+    MOD:    {"__mod__", "__rmod__"},
+}
+
+var binarySymbols = map[uint32]string{
+    ADD: "+", SUB: "-", MUL: "*", DIV: "/", FDIV: "//", MOD: "%",
+}
+
+// Executes the arithmetic instruction op on l and r, as Python does.  An operand with
+// the method of op, as an attribute, has it called with the operands, and otherwise the
+// built-in operation is used.  If the left operand doesn't support the right one, which
+// its method says by returning NotImplemented, the reflected method of the right
+// operand is tried, and if that doesn't support it either, op raises a TypeError.
+func (m *Machine) binaryOp(op uint32, l, r Object) (Object, os.Error) {
+    names := binaryMethods[op]
+    
+    if err := m.allocate(resultSize(op, l, r)); err != nil {
+        return nil, err
+    }
+    result, found, err := m.dunder(l, names[0], r)
+    if !found {
+        result, err = arithmetic(op, l, r)
+    }
+    if err != nil || result != nil {
+        return result, err
+    }
+    
+    result, found, err = m.dunder(r, names[1], l)
+    if !found {
+        result, err = reflectedArithmetic(op, l, r)
+    }
+    if err != nil || result != nil {
+        return result, err
+    }
+    
+    return nil, Raise(TypeErrorClass, fmt.Sprintf("unsupported operand types for %v: %v and %v",
+        binarySymbols[op], l.Repr(), r.Repr()))
+}
+
+var inPlaceMethods = map[uint32]string{
+    ADD:    "__iadd__",
+    SUB:    "__isub__",
+    MUL:    "__imul__",
+    DIV:    "__itruediv__",
+    FDIV:   "__ifloordiv__",
+    MOD:    "__imod__",
+}
+
+// Executes the arithmetic instruction op of an augmented assignment, like l += r.  The
+// in-place method of l is tried first, and then its InPlaceArithmetic, either of which
+// may change l and return it.  If l has neither, or they don't support r, op is done
+// as binaryOp does it, and the assignment rebinds the target to a new object.
+func (m *Machine) inPlaceOp(op uint32, l, r Object) (Object, os.Error) {
+    result, found, err := m.dunder(l, inPlaceMethods[op], r)
+    if !found {
+        if a, ok := l.(InPlaceArithmetic); ok {
+            if err = m.allocate(resultSize(op, l, r)); err != nil {
+                return nil, err
+            }
+            result, err = inPlaceArithmetic(a, op, r)
+        }
+    }
+    if err != nil || result != nil {
+        return result, err
+    }
+    
+    return m.binaryOp(op, l, r)
+}
+
+// Executes the arithmetic instruction op on a in place.
+func inPlaceArithmetic(a InPlaceArithmetic, op uint32, r Object) (Object, os.Error) {
+    switch op {
+        case ADD:  return a.IAdd(r)
+        case SUB:  return a.ISub(r)
+        case MUL:  return a.IMul(r)
+        case DIV:  return a.IDiv(r)
+        case FDIV: return a.IFloorDiv(r)
+        case MOD:  return a.IMod(r)
+    }
+    
+    return nil, nil
+}
+
+// Calls the method name of o with o and other, and returns what it returns, or nil if
+// it returns NotImplemented.  found is false if o doesn't have the method.
+func (m *Machine) dunder(o Object, name string, other Object) (result Object, found bool, err os.Error) {
+    method, present := o.GetAttr(name)
+    if !present {
+        return nil, false, nil
+    }
+    result, err = m.callNested(method, []Object{o, other})
+    if err != nil || result == NotImplemented {
+        return nil, true, err
+    }
+    return result, true, nil
+}
+
+// Executes the arithmetic instruction op on the built-in operands l and r, from the
+// right operand, which is how an int times a sequence repeats the sequence.  The other
+// built-in operations either convert the left operand first or aren't reflected.
+func reflectedArithmetic(op uint32, l, r Object) (Object, os.Error) {
+    if _, ok := l.(*IntObject); !ok || op != MUL {
+        return nil, nil
+    }
+    switch r.(type) {
+        case *StringObject, *ListObject, *TupleObject:
+            return r.Mul(l)
+    }
+    return nil, nil
+}
+
+// Executes the arithmetic instruction op on the boxed operands l and r.  The result is
+// nil, with no error, if the operands don't support op.
+func arithmetic(op uint32, l, r Object) (Object, os.Error) {
+    var a BinaryArithmetic
+    
+    l, r = promoteOperands(l, r)
+    a = l
+    
+    switch op {
+        case ADD:  return a.Add(r)
+        case SUB:  return a.Sub(r)
+        case MUL:  return a.Mul(r)
+        case DIV:  return a.Div(r)
+        case FDIV: return a.FloorDiv(r)
+        case MOD:  return a.Mod(r)
+    }
+    
+    return nil, nil
+}
+
+// Raises l to the power r, as l ** r and pow(l, r) do.  The methods __pow__ and
+// __rpow__ are called as binaryOp calls the methods of the arithmetic instructions.
+func (m *Machine) power(l, r Object) (Object, os.Error) {
+    result, found, err := m.dunder(l, "__pow__", r)
+    if !found {
+        if err := m.allocate(powerSize(l, r)); err != nil {
+            return nil, err
+        }
+        l, r := promoteOperands(l, r)
+        result, err = l.Pow(r)
+    }
+    if err != nil || result != nil {
+        return result, err
+    }
+    
+    result, _, err = m.dunder(r, "__rpow__", l)
+    if err != nil || result != nil {
+        return result, err
+    }
+    
+    return nil, Raise(TypeErrorClass, fmt.Sprintf("unsupported operand types for ** or pow(): %v and %v",
+        l.Repr(), r.Repr()))
+}
+
+// Returns the tuple of l // r and l % r, as divmod(l, r) does, calling __divmod__ and
+// __rdivmod__ if the operands have them.
+func (m *Machine) divmod(l, r Object) (Object, os.Error) {
+    result, found, err := m.dunder(l, "__divmod__", r)
+    if !found {
+        promoted, _ := promoteOperands(l, r)
+        switch n := promoted.(type) {
+            case *IntObject:
+                result, err = n.Divmod(r)
+            case *FloatObject:
+                result, err = n.Divmod(r)
+            case *ComplexObject:
+                return nil, Raise(TypeErrorClass, "can't take floor or mod of complex number.")
+        }
+    }
+    if err != nil || result != nil {
+        return result, err
+    }
+    
+    result, _, err = m.dunder(r, "__rdivmod__", l)
+    if err != nil || result != nil {
+        return result, err
+    }
+    
+    return nil, Raise(TypeErrorClass, fmt.Sprintf("unsupported operand types for divmod(): %v and %v",
+        l.Repr(), r.Repr()))
+}
+
+// The instructions of the SSA arithmetic operations the machine has an instruction for.
+var ssaMachineOps = map[uint]uint32{
+    SSA_ADD: ADD,
+    SSA_SUB: SUB,
+    SSA_MUL: MUL,
+    SSA_DIV: DIV,
+    SSA_MOD: MOD,
+}
+
+// Performs the SSA arithmetic operation op on two objects, which is what the helper
+// X86_HELPER_BINARY does for generated code.  SSA_POW is done by power, like pow(),
+// and op may have X86_INPLACE set for an augmented assignment.
+func (m *Machine) SsaArithmetic(op uint, l, r Object) (Object, os.Error) {
+    in_place := op&X86_INPLACE != 0
+    op &^= X86_INPLACE
+    
+    if op == SSA_POW {
+        return m.power(l, r)
+    }
+    ins, present := ssaMachineOps[op]
+    if !present {
+        return nil, Raise(TypeErrorClass, fmt.Sprintf("SSA operation %v is not supported on objects", opName(op)))
+    }
+    if in_place {
+        return m.inPlaceOp(ins, l, r)
+    }
+    return m.binaryOp(ins, l, r)
+}
+
+// Wraps the value in the raw register raw, of the bank used by the BOX instruction op,
+// in an object.
+func (m *Machine) box(op uint32, raw uint16) (Object) {
+    switch op {
+        case BOXI:
+            return NewInt(m.Ints[raw])
+        case BOXL:
+            if m.Longs[raw] == nil {
+                return NewIntObject()
+            }
+            return NewBigInt(new (big.Int).Set(m.Longs[raw]))
+        case BOXF:
+            return NewFloat(m.Floats[raw])
+        case BOXS:
+            return NewString(m.Strings[raw])
+    }
+    
+    return pyBool(m.Pred[raw])
+}
+
+// Takes the raw value out of o, and puts it in the raw register raw, of the bank used by
+// the UNBOX instruction op.
+func (m *Machine) unbox(op uint32, o Object, raw uint16) (os.Error) {
+    switch op {
+        case UNBOXI:
+            i, ok := o.(*IntObject)
+            if !ok {
+                return Raise(TypeErrorClass, fmt.Sprintf("can't unbox '%v' as an int", o))
+            }
+            if !i.IsSmall() {
+                return Raise(OverflowErrorClass, fmt.Sprintf("%v doesn't fit in a raw int", i))
+            }
+            m.Ints[raw] = i.Small
+        case UNBOXL:
+            i, ok := o.(*IntObject)
+            if !ok {
+                return Raise(TypeErrorClass, fmt.Sprintf("can't unbox '%v' as an int", o))
+            }
+            m.Longs[raw] = new (big.Int).Set(i.AsInt())
+        case UNBOXF:
+            switch o.(type) {
+                case *IntObject, *FloatObject:
+                    m.Floats[raw] = o.AsFloat()
+                default:
+                    return Raise(TypeErrorClass, fmt.Sprintf("can't unbox '%v' as a float", o))
+            }
+        case UNBOXS:
+            s, ok := o.(*StringObject)
+            if !ok {
+                return Raise(TypeErrorClass, fmt.Sprintf("can't unbox '%v' as a string", o))
+            }
+            m.Strings[raw] = s.Value
+        case UNBOXB:
+            // Predicate register 0 means "always", so it can't be set.
+            if raw != 0 {
+                m.Pred[raw] = o.IsTrue()
+            }
+    }
+    return nil
+}
+
+// Executes the arithmetic opcode op on the raw ints l and r.  Floor division and modulo
+// round towards negative infinity, as in Python.
+func rawIntArithmetic(op uint32, l, r int64) (int64, os.Error) {
+    var result int64
+    ok := true
+    
+    switch op {
+        case ADD:
+            result, ok = addInt64(l, r)
+        case SUB:
+            result, ok = subInt64(l, r)
+        case MUL:
+            result, ok = mulInt64(l, r)
+        case FDIV, MOD:
+            if r == 0 {
+                return 0, Raise(ZeroDivisionErrorClass, "integer division or modulo by zero")
+            }
+            if l == math.MinInt64 && r == -1 && op == MOD {
+                return 0, nil
+            }
+            var q, m int64
+            q, m, ok = floorDivModInt64(l, r)
+            result = m
+            if op == FDIV {
+                result = q
+            }
         default:
-            reg1 = (instruction & source_reg1_mask)>>source_reg1_shift
-            reg2 = (instruction & source_reg2_mask)>>source_reg2_shift
-            reg3 = (instruction & target_reg_mask)>>target_reg_shift
+            return 0, os.NewError(fmt.Sprintf("opcode %v is not raw int arithmetic", op))
     }
     
-    // Execution stage - actually processes the instructions.
+    if !ok {
+        return 0, Raise(OverflowErrorClass, "raw int arithmetic overflowed")
+    }
+    return result, nil
+}
+
+// Executes the arithmetic opcode op on the raw floats l and r.
+func rawFloatArithmetic(op uint32, l, r float64) (float64, os.Error) {
     switch op {
-        case NOP:
-        case LOAD: m.Register[reg3] = c.Locals[imm]            
-        case BIND: c.Locals[imm] = m.Register[reg3]
-        case ADD:  m.Register[reg3] = m.Register[reg1].Add(m.Register[reg2])       
-        case SUB:  m.Register[reg3] = m.Register[reg1].Sub(m.Register[reg2])            
-        case MUL:  m.Register[reg3] = m.Register[reg1].Mul(m.Register[reg2])
-        case DIV:  m.Register[reg3] = m.Register[reg1].Div(m.Register[reg2])
-        case FDIV: m.Register[reg3] = m.Register[reg1].FloorDiv(m.Register[reg2])
-        case MOD:  m.Register[reg3] = m.Register[reg1].Mod(m.Register[reg2])
+        case ADD: return l + r, nil
+        case SUB: return l - r, nil
+        case MUL: return l * r, nil
+    }
+    
+    if op != DIV && op != FDIV && op != MOD {
+        return 0, os.NewError(fmt.Sprintf("opcode %v is not raw float arithmetic", op))
+    }
+    if r == 0 {
+        return 0, Raise(ZeroDivisionErrorClass, "float division by zero")
+    }
+    
+    if op == DIV {
+        return l / r, nil
+    }
+    
+    q, m := floatDivMod(l, r)
+    if op == FDIV {
+        return q, nil
+    }
+    return m, nil
+}
+
+// Executes the unary instruction op on the boxed operand o.  The result is nil, with no
+// error, if the operand doesn't support op.
+func unary(op uint32, o Object) (Object, os.Error) {
+    switch op {
+        case NEG:    return o.Neg()
+        case POS:    return o.Pos()
+        case INVERT: return o.Invert()
+    }
+    
+    return nil, nil
+}
+
+// The methods of the comparison instructions, and the reflected methods, which are
+// called on the right operand with the left one.
+var compareMethods = map[uint32][2]string{
+    EQ:     {"__eq__", "__eq__"},
+    NE:     {"__ne__", "__ne__"},
+    LT:     {"__lt__", "__gt__"},
+    LE:     {"__le__", "__ge__"},
+    GT:     {"__gt__", "__lt__"},
+    GE:     {"__ge__", "__le__"},
+}
+
+// The comparison instructions that give the same result with the operands swapped.
+var reflectedCompares = map[uint32]uint32{EQ: EQ, NE: NE, LT: GT, LE: GE, GT: LT, GE: LE}
+
+var compareSymbols = map[uint32]string{EQ: "==", NE: "!=", LT: "<", LE: "<=", GT: ">", GE: ">="}
+
+// Executes the comparison instruction op, the way Python does.  The comparison method
+// of l is tried first, and then the reflected method of r.  If neither supports the
+// other operand, == and != compare identity, and the others are a TypeError.
+func (m *Machine) richCompare(op uint32, l, r Object) (Object, os.Error) {
+    names := compareMethods[op]
+    
+    result, found, err := m.compareDunder(l, names[0], r)
+    if !found {
+        result = compare(op, l, r)
+    }
+    if err != nil || result != nil && result != NotImplemented {
+        return result, err
     }
+    
+    result, found, err = m.compareDunder(r, names[1], l)
+    if !found {
+        result = compare(reflectedCompares[op], r, l)
+    }
+    if err != nil || result != nil && result != NotImplemented {
+        return result, err
+    }
+    
+    switch op {
+        case EQ: return pyBool(l == r), nil
+        case NE: return pyBool(l != r), nil
+    }
+    return nil, Raise(TypeErrorClass, fmt.Sprintf("'%v' not supported between %v and %v",
+        compareSymbols[op], l.Repr(), r.Repr()))
+}
+
+// Calls the comparison method name of o with other, as dunder does.  An object with
+// __eq__ and no __ne__ gives the opposite of __eq__ for !=, as in Python.
+func (m *Machine) compareDunder(o Object, name string, other Object) (result Object, found bool, err os.Error) {
+    result, found, err = m.dunder(o, name, other)
+    if found || name != "__ne__" {
+        return
+    }
+    
+    result, found, err = m.dunder(o, "__eq__", other)
+    if result != nil {
+        result = pyBool(!result.IsTrue())
+    }
+    return
+}
+
+// Executes the comparison instruction op on the built-in operands l and r.  The result
+// is NotImplemented if l doesn't support comparing with r.  The operands aren't
+// promoted as they are for arithmetic, since an int converted to a float may not be
+// equal to it any more; the numbers compare themselves with each other.
+func compare(op uint32, l, r Object) (Object) {
+    var c RichComparer
+    
+    c = l
+    
+    switch op {
+        case EQ: return c.Eq(r)
+        case NE: return c.Neq(r)
+        case LT: return c.Lt(r)
+        case LE: return c.Lte(r)
+        case GT: return c.Gt(r)
+        case GE: return c.Gte(r)
+    }
+    
+    return NotImplemented
+}
+
+// Compares the built-in operands l and r with op, and then r and l with the reflected
+// comparison if l doesn't support r.  This is how the items of containers are compared,
+// without a machine to call methods on.
+func builtinCompare(op uint32, l, r Object) (Object) {
+    if result := compare(op, l, r); result != NotImplemented {
+        return result
+    }
+    return compare(reflectedCompares[op], r, l)
+}
+
+// Returns true if l == r.  Objects that can't be compared are equal if they are the
+// same object, as in Python, which is also tried first, as Python's containers do.
+func equal(l, r Object) (bool) {
+    if l == r {
+        return true
+    }
+    result := builtinCompare(EQ, l, r)
+    return result != NotImplemented && result.IsTrue()
+}
+
+// Runs the body of the module mod, with its globals as the scope.
+func (m *Machine) RunModule(mod *ModuleCode) (Object, os.Error) {
+    m.Frame = Frame{Globals: mod.Globals, Code: mod.Code[0]}
+    m.Frames = nil
+    m.NextInstruction = 0
+    
+    return m.Run(mod.Code[0])
 }
@@ -23,6 +23,12 @@ package python
 
 import (
         "big"
+        "bytes"
+        "encoding/binary"
+        "fmt"
+        "math"
+        "os"
+        "strings"
         "testing"            
 )
 
@@ -64,15 +70,14 @@ func checkFloatValueResult(t *testing.T, m *Machine, register int, wanted float6
 
 func TestDispatchInstructions(t *testing.T) {
     
-    s := new (CodeStream)
+    s := new (CodeObject)
     s.Init()
     
     m := new (Machine)
     
-    io1 := new(IntObject)
-    io1.Int = big.NewInt(10)
+    io1 := NewInt(10)
             
-    s.BindLocal("a", io1)    
+    m.BindGlobal("a", io1)
 
     s.WriteLoad("a", 3, false, 0)
     s.WriteBind("b", 3, false, 0)
@@ -118,3 +123,2468 @@ func TestDispatchInstructions(t *testing.T) {
     checkIntValueResult(t, m, 9, big.NewInt(10), "MOD r3, r7, r9")
     
 }
+
+func TestDispatchMixedArithmetic(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    
+    m := new (Machine)
+    
+    i := NewInt(2)
+    f := new(FloatObject)
+    f.Value = 0.5
+    
+    m.BindGlobal("i", i)
+    m.BindGlobal("f", f)
+    
+    s.WriteLoad("i", 1, false, 0)
+    s.WriteLoad("f", 2, false, 0)
+    s.WriteAluIns(ADD,1,2,3,false,0)
+    s.WriteAluIns(SUB,1,2,4,false,0)
+    s.WriteAluIns(MUL,2,1,5,false,0)
+    s.WriteAluIns(DIV,2,1,6,false,0)
+    
+    for j:=0; j<6; j++ {
+        m.Dispatch(s)
+    }
+    
+    // An int on either side of a float gives a float.
+    checkFloatValueResult(t, m, 3, 2.5, "ADD r1, r2, r3")
+    checkFloatValueResult(t, m, 4, 1.5, "SUB r1, r2, r4")
+    checkFloatValueResult(t, m, 5, 1, "MUL r2, r1, r5")
+    checkFloatValueResult(t, m, 6, 0.25, "DIV r2, r1, r6")
+}
+
+func TestRunArithmetic(t *testing.T) {
+    tests := []struct {
+        op      uint32
+        l, r    Object
+        result  string
+    }{
+        {FDIV, intObject(-7), intObject(2), "-4"},
+        {MOD, intObject(-7), intObject(2), "1"},
+        {MOD, intObject(7), intObject(-2), "-1"},
+        {DIV, intObject(1), intObject(4), "0.25"},
+        {FDIV, floatObject(7), intObject(2), "3"},
+        {MOD, floatObject(-7), intObject(2), "1"},
+        {MOD, floatObject(1), floatObject(0), "ZeroDivisionError"},
+        {FDIV, intObject(1), intObject(0), "ZeroDivisionError"},
+        {MUL, NewString("ab"), intObject(2), "abab"},
+        {MUL, NewString("ab"), intObject(-1), ""},
+        {MUL, intObject(3), NewString("é"), "ééé"},
+        {MUL, NewString("ab"), intObject(math.MaxInt64), "OverflowError"},
+        {ADD, NewString(""), NewString("b"), "b"},
+        {ADD, NewString("a"), NewString("b"), "ab"},
+        {ADD, NewString("a"), intObject(1), "TypeError"},
+        {SUB, NewString("a"), NewString("b"), "TypeError"},
+        {MUL, NewString("a"), NewString("b"), "TypeError"},
+        {MUL, NewList([]Object{intObject(1)}), intObject(2), "[1, 1]"},
+        {ADD, intObject(1), NewString("a"), "TypeError"},
+    }
+    for i, test := range tests {
+        s := new (CodeObject)
+        s.Init()
+        s.WriteConst(test.l, 1, false, 0)
+        s.WriteConst(test.r, 2, false, 0)
+        s.WriteAluIns(test.op, 1, 2, 3, false, 0)
+        s.WriteHalt(3, false, 0)
+        
+        result, err := new (Machine).Run(s)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("test %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("test %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+}
+
+func TestFloorDivMod(t *testing.T) {
+    // Python's answers for each combination of signs.
+    tests := []struct {
+        l, r    int64
+        q, m    int64
+    }{
+        {7, 2, 3, 1},
+        {-7, 2, -4, 1},
+        {7, -2, -4, -1},
+        {-7, -2, 3, -1},
+        {6, 3, 2, 0},
+        {-6, 3, -2, 0},
+        {0, -3, 0, 0},
+        {math.MinInt64, -1, 0, 0},
+    }
+    for i, test := range tests {
+        l, r := intObject(test.l), intObject(test.r)
+        if test.l != math.MinInt64 {
+            q, err := l.FloorDiv(r)
+            if err != nil || q.AsString() != fmt.Sprint(test.q) {
+                t.Errorf("test %v: expected %v // %v to be %v, got %v, %v", i, test.l, test.r, test.q, q, err)
+            }
+            if q, _ := rawIntArithmetic(FDIV, test.l, test.r); q != test.q {
+                t.Errorf("test %v: expected the raw %v // %v to be %v, got %v", i, test.l, test.r, test.q, q)
+            }
+        }
+        if m, err := l.Mod(r); err != nil || m.AsString() != fmt.Sprint(test.m) {
+            t.Errorf("test %v: expected %v %% %v to be %v, got %v, %v", i, test.l, test.r, test.m, m, err)
+        }
+        if m, err := rawIntArithmetic(MOD, test.l, test.r); err != nil || m != test.m {
+            t.Errorf("test %v: expected the raw %v %% %v to be %v, got %v, %v", i, test.l, test.r, test.m, m, err)
+        }
+        if m := foldInt(SSA_MOD, l.AsInt(), r.AsInt()); m == nil || m.Int64() != test.m {
+            t.Errorf("test %v: expected %v %% %v to fold to %v, got %v", i, test.l, test.r, test.m, m)
+        }
+    }
+    
+    floats := []struct {
+        l, r    float64
+        q, m    string
+    }{
+        {7.5, 2, "3.0", "1.5"},
+        {-7.5, 2, "-4.0", "0.5"},
+        {7.5, -2, "-4.0", "-0.5"},
+        {-7.5, -2, "3.0", "-1.5"},
+        {6, -3, "-2.0", "-0.0"},
+        {-6, 3, "-2.0", "0.0"},
+        {-0.5, 3, "-1.0", "2.5"},
+        {1, 0.1, "9.0", "0.09999999999999995"},
+    }
+    for i, test := range floats {
+        l, r := floatObject(test.l), floatObject(test.r)
+        if q, err := l.FloorDiv(r); err != nil || q.Repr() != test.q {
+            t.Errorf("test %v: expected %v // %v to be %v, got %v, %v", i, test.l, test.r, test.q, q, err)
+        }
+        if m, err := l.Mod(r); err != nil || m.Repr() != test.m {
+            t.Errorf("test %v: expected %v %% %v to be %v, got %v, %v", i, test.l, test.r, test.m, m, err)
+        }
+    }
+}
+
+func TestRunComplex(t *testing.T) {
+    half := new (FloatObject)
+    half.Value = 0.5
+    
+    tests := []struct {
+        op      uint32
+        l, r    Object
+        result  string
+    }{
+        {ADD, NewComplex(1+2i), NewComplex(3-1i), "(4+1j)"},
+        {ADD, intObject(2), NewComplex(1i), "(2+1j)"},
+        {SUB, half, NewComplex(2i), "(0.5-2j)"},
+        {MUL, NewComplex(2i), intObject(3), "6j"},
+        {DIV, NewComplex(4+2i), NewComplex(2), "(2+1j)"},
+        {DIV, NewComplex(1), intObject(0), "ZeroDivisionError"},
+        {FDIV, NewComplex(1), intObject(2), "TypeError"},
+        {MOD, intObject(2), NewComplex(1), "TypeError"},
+        {ADD, NewComplex(1), NewString("a"), "TypeError"},
+    }
+    for i, test := range tests {
+        s := new (CodeObject)
+        s.Init()
+        s.WriteConst(test.l, 1, false, 0)
+        s.WriteConst(test.r, 2, false, 0)
+        s.WriteAluIns(test.op, 1, 2, 3, false, 0)
+        s.WriteHalt(3, false, 0)
+        
+        result, err := new (Machine).Run(s)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("test %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("test %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+    
+    // Complex numbers can be equal to ints and floats, but they aren't ordered.
+    comparisons := []struct {
+        op      uint32
+        l, r    Object
+        result  string
+    }{
+        {EQ, NewComplex(2), intObject(2), "true"},
+        {EQ, intObject(2), NewComplex(2), "true"},
+        {NE, half, NewComplex(0.5+1i), "true"},
+        {LT, NewComplex(1), NewComplex(2), "TypeError"},
+        {GE, intObject(1), NewComplex(2), "TypeError"},
+    }
+    for i, test := range comparisons {
+        s := new (CodeObject)
+        s.Init()
+        s.WriteConst(test.l, 1, false, 0)
+        s.WriteConst(test.r, 2, false, 0)
+        s.WriteCompare(test.op, 1, 2, 5, false, 0)
+        
+        m := new (Machine)
+        _, err := m.Run(s)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("comparison %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && fmt.Sprint(m.Pred[5]) != test.result:
+                t.Errorf("comparison %v: expected %v, got %v", i, test.result, m.Pred[5])
+        }
+    }
+    
+    abs := NewInterpreter().Builtins["abs"].(*BuiltinFunctionObject)
+    if result, err := abs.Call(new (Machine), []Object{NewComplex(3+4i)}, nil, nil); err != nil || result.AsFloat() != 5 {
+        t.Errorf("abs(3+4j) should be 5, got %v, %v", result, err)
+    }
+}
+
+func TestRun(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    
+    io1 := NewInt(10)
+    
+    s.WriteLoad("a", 1, false, 0)
+    s.WriteAluIns(ADD,1,1,2,false,0)
+    s.WriteHalt(2, false, 0)
+    s.WriteAluIns(MUL,2,2,3,false,0)
+    
+    m := new (Machine)
+    m.BindGlobal("a", io1)
+    result, err := m.Run(s)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if !m.Halted || result == nil || result.AsInt().Cmp(big.NewInt(20)) != 0 {
+        t.Errorf("expected the run to halt with 20, got '%v'", result)
+    }
+    if m.NextInstruction != 3 || m.Register[3] != nil {
+        t.Errorf("the run should stop after the HALT, at %v", m.NextInstruction)
+    }
+    
+    // Resuming after the HALT runs off the end of the code.
+    result, err = m.Run(s)
+    if err != nil || result != nil || m.Halted {
+        t.Errorf("running off the end should stop without a value, got '%v', %v", result, err)
+    }
+    checkIntValueResult(t, m, 3, big.NewInt(400), "MUL r2, r2, r3")
+    
+    m = new (Machine)
+    m.BindGlobal("a", io1)
+    m.StepLimit = 2
+    if _, err = m.Run(s); err != StepLimitExceeded {
+        t.Errorf("expected the step limit to be exceeded, got %v", err)
+    }
+    if m.NextInstruction != 2 {
+        t.Errorf("expected to stop at instruction 2, got %v", m.NextInstruction)
+    }
+}
+
+func TestRunErrors(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    s.WriteAluIns(ADD,1,2,3,false,0)
+    
+    m := new (Machine)
+    if _, err := m.Run(s); err == nil {
+        t.Errorf("adding empty registers should fail")
+    }
+    
+    s = new (CodeObject)
+    s.Init()
+    s.WriteLen(1, 2, false, 0)
+    
+    m = new (Machine)
+    if _, err := m.Run(s); err == nil {
+        t.Errorf("an unsupported instruction should fail")
+    }
+    if err := m.Dispatch(s); err == nil {
+        t.Errorf("dispatching past the end of the code should fail")
+    }
+}
+
+func TestExceptions(t *testing.T) {
+    interp := NewInterpreter()
+    class, ok := interp.Builtins["KeyError"].(*ExceptionClassObject)
+    if !ok {
+        t.Fatalf("KeyError should be a builtin exception class")
+    }
+    if !class.IsSubclass(LookupErrorClass) || !class.IsSubclass(BaseExceptionClass) || class.IsSubclass(TypeErrorClass) {
+        t.Errorf("KeyError should derive from LookupError and BaseException only")
+    }
+    
+    e, err := class.Call(new (Machine), []Object{NewString("k")}, nil, nil)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if s := e.(os.Error).String(); s != "KeyError: k" {
+        t.Errorf("expected the error KeyError: k, got %v", s)
+    }
+    if s := e.Repr(); s != "KeyError('k')" {
+        t.Errorf("expected the repr KeyError('k'), got %v", s)
+    }
+    if args, _ := e.GetAttr("args"); args.Repr() != "('k',)" {
+        t.Errorf("expected the args ('k',), got %v", args.Repr())
+    }
+    
+    // The machine raises exceptions of the built-in classes.
+    tests := []struct {
+        l, r    Object
+        op      uint32
+        class   *ExceptionClassObject
+    }{
+        {intObject(1), intObject(0), MOD, ZeroDivisionErrorClass},
+        {NewComplex(1), NewComplex(0), DIV, ArithmeticErrorClass},
+        {NewString("a"), intObject(1), SUB, TypeErrorClass},
+        {NewDict(), intObject(1), INDEX, LookupErrorClass},
+        {NewList(nil), intObject(1), INDEX, IndexErrorClass},
+    }
+    for i, test := range tests {
+        s := new (CodeObject)
+        s.Init()
+        s.WriteConst(test.l, 1, false, 0)
+        s.WriteConst(test.r, 2, false, 0)
+        s.WriteAluIns(test.op, 1, 2, 3, false, 0)
+        
+        _, err := new (Machine).Run(s)
+        if !IsException(err, test.class) {
+            t.Errorf("test %v: expected a %v, got %v", i, test.class.Name, err)
+        }
+    }
+    
+    if !IsException(StopIteration, ExceptionClass) || IsException(KeyboardInterrupt, ExceptionClass) {
+        t.Errorf("StopIteration should be an Exception, and KeyboardInterrupt shouldn't")
+    }
+}
+
+func TestRunJumps(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    
+    io1 := NewInt(3)
+    
+    s.WriteLoad("a", 1, false, 0)
+    
+    // Jump over the first add, always.
+    skip := s.WriteJump(false, 0)
+    s.WriteAluIns(ADD,1,1,2,false,0)
+    s.PatchJump(skip, s.Here())
+    
+    // Jump over the multiply if p1 is set, and over the subtract if it isn't.
+    taken := s.WriteJump(true, 1)
+    s.WriteAluIns(MUL,1,1,3,false,0)
+    s.PatchJump(taken, s.Here())
+    not_taken := s.WriteJump(false, 1)
+    s.WriteAluIns(SUB,1,1,4,false,0)
+    s.PatchJump(not_taken, s.Here())
+    s.WriteHalt(1, false, 0)
+    
+    m := new (Machine)
+    m.BindGlobal("a", io1)
+    m.Pred[1] = true
+    if _, err := m.Run(s); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if m.Register[2] != nil || m.Register[3] != nil {
+        t.Errorf("jumped over instructions were executed")
+    }
+    checkIntValueResult(t, m, 4, big.NewInt(0), "SUB r1, r1, r4")
+    
+    // A jump back to itself never ends.
+    s = new (CodeObject)
+    s.Init()
+    s.PatchJump(s.WriteJump(false, 0), 0)
+    
+    m = new (Machine)
+    m.StepLimit = 100
+    if _, err := m.Run(s); err != StepLimitExceeded || m.NextInstruction != 0 {
+        t.Errorf("expected the loop to run until the step limit, got %v", err)
+    }
+}
+
+func TestPredicatedExecution(t *testing.T) {
+    tests := []struct {
+        pred_bit    bool
+        pred_reg    uint32
+        value       bool
+        executed    bool
+    }{
+        {false, 0, true, true},
+        {true, 0, false, true},
+        {true, 5, true, true},
+        {true, 5, false, false},
+        {false, 5, false, true},
+        {false, 5, true, false},
+        {true, 31, true, true},
+    }
+    
+    io1 := NewInt(7)
+    
+    for i, test := range tests {
+        s := new (CodeObject)
+        s.Init()
+        s.WriteAluIns(ADD,1,1,2,test.pred_bit,test.pred_reg)
+        
+        m := new (Machine)
+        m.Reserve(s)
+        m.Register[1] = io1
+        m.Pred[test.pred_reg] = test.value
+        if err := m.Dispatch(s); err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        
+        if executed := m.Register[2] != nil; executed != test.executed {
+            t.Errorf("test %v: expected executed to be %v with p%v = %v", i, test.executed, test.pred_reg, test.value)
+        }
+        if m.NextInstruction != 1 {
+            t.Errorf("test %v: a skipped instruction must still advance", i)
+        }
+    }
+}
+
+func TestDispatchCompare(t *testing.T) {
+    one := NewInt(1)
+    two := NewInt(2)
+    half := new(FloatObject)
+    half.Value = 1.5
+    
+    // 2**53 + 1 has no float, and rounds to 2**53.
+    odd := NewBigInt(new (big.Int).Add(new (big.Int).Lsh(big.NewInt(1), 53), big.NewInt(1)))
+    even := NewFloat(1 << 53)
+    huge := NewBigInt(new (big.Int).Lsh(big.NewInt(3), 80))
+    nan := NewFloat(math.NaN())
+    
+    tests := []struct {
+        op      uint32
+        l, r    Object
+        result  bool
+    }{
+        {EQ, one, one, true},
+        {EQ, one, two, false},
+        {NE, one, two, true},
+        {LT, one, two, true},
+        {LT, two, one, false},
+        {LE, two, two, true},
+        {GT, two, one, true},
+        {GE, one, two, false},
+        {LT, one, half, true},
+        {GT, two, half, true},
+        {LT, half, two, true},
+        {EQ, odd, even, false},
+        {NE, even, odd, true},
+        {GT, odd, even, true},
+        {LT, even, odd, true},
+        {EQ, huge, NewFloat(3 << 80), true},
+        {GT, huge, NewFloat(3 << 80 - 1 << 29), true},
+        {LT, NewFloat(-0.5), NewInt(0), true},
+        {GE, NewFloat(-0.5), NewInt(-1), true},
+        {EQ, nan, one, false},
+        {NE, one, nan, true},
+        {LT, nan, one, false},
+        {GE, nan, nan, false},
+    }
+    
+    for i, test := range tests {
+        s := new (CodeObject)
+        s.Init()
+        s.WriteCompare(test.op, 1, 2, 17, false, 0)
+        s.WriteCompare(test.op, 1, 2, 0, false, 0)
+        
+        m := new (Machine)
+        m.Reserve(s)
+        m.Register[1] = test.l
+        m.Register[2] = test.r
+        m.Pred[17] = !test.result
+        if _, err := m.Run(s); err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        
+        if m.Pred[17] != test.result {
+            t.Errorf("test %v: expected p17 to be %v", i, test.result)
+        }
+        if m.Pred[0] {
+            t.Errorf("test %v: p0 was set", i)
+        }
+    }
+}
+
+func TestRunLoop(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    
+    zero := NewIntObject()
+    one := NewInt(1)
+    n := NewInt(10)
+    
+    // total = 0; while n > 0: total += n; n -= 1
+    s.WriteLoad("zero", 1, false, 0)
+    s.WriteLoad("one", 2, false, 0)
+    s.WriteLoad("n", 3, false, 0)
+    s.WriteAluIns(ADD,1,1,4,false,0)
+    top := s.Here()
+    s.WriteCompare(GT, 3, 1, 1, false, 0)
+    exit := s.WriteJump(false, 1)
+    s.WriteAluIns(ADD,4,3,4,false,0)
+    s.WriteAluIns(SUB,3,2,3,false,0)
+    s.PatchJump(s.WriteJump(false, 0), top)
+    s.PatchJump(exit, s.Here())
+    s.WriteHalt(4, false, 0)
+    
+    m := new (Machine)
+    m.BindGlobal("zero", zero)
+    m.BindGlobal("one", one)
+    m.BindGlobal("n", n)
+    m.StepLimit = 1000
+    result, err := m.Run(s)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if result.AsInt().Cmp(big.NewInt(55)) != 0 {
+        t.Errorf("expected the loop to sum to 55, got '%v'", result)
+    }
+}
+
+// Returns an instance of a class whose instances are iterators, which count down from
+// n to 1.
+func newCountdown(n int64) (Object) {
+    ns := NewDict()
+    ns.Set(NewString("__iter__"), NewBuiltinFunction("__iter__", func(m *Machine, args []Object) (Object, os.Error) {
+        return args[0], nil
+    }))
+    ns.Set(NewString("__next__"), NewBuiltinFunction("__next__", func(m *Machine, args []Object) (Object, os.Error) {
+        n, _ := args[0].GetAttr("n")
+        if !n.IsTrue() {
+            return nil, Raise(StopIterationClass, "")
+        }
+        next, _ := n.Sub(intObject(1))
+        args[0].SetAttr("n", next)
+        return n, nil
+    }))
+    countdown, _ := NewType("Countdown", nil, ns)
+    
+    o := NewInstance(countdown)
+    o.SetAttr("n", intObject(n))
+    return o
+}
+
+func TestRunForLoop(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    
+    // total = 0; for x in items: total = x + total
+    s.WriteLoad("total", 1, false, 0)
+    s.WriteLoad("items", 2, false, 0)
+    s.WriteGetIter(2, 3, false, 0)
+    top := s.Here()
+    exit := s.WriteForIter(3, false, 0)
+    s.WriteAluIns(ADD,4,1,1,false,0)
+    s.PatchJump(s.WriteJump(false, 0), top)
+    s.PatchJump(exit, s.Here())
+    s.WriteHalt(1, false, 0)
+    
+    d := NewDict()
+    d.Set(NewString("a"), intObject(1))
+    d.Set(NewString("b"), intObject(2))
+    r, _ := NewRange(1, 7, 2)
+    
+    tests := []struct {
+        total, items Object
+        result       string
+    }{
+        {intObject(0), NewTuple([]Object{intObject(1), intObject(2), intObject(3)}), "6"},
+        {NewString(""), NewString("abc"), "cba"},
+        {NewString("!"), d, "ba!"},
+        {intObject(7), NewTuple(nil), "7"},
+        {intObject(0), r, "9"},
+        {intObject(0), newCountdown(3), "6"},
+    }
+    for i, test := range tests {
+        m := new (Machine)
+        m.BindGlobal("total", test.total)
+        m.BindGlobal("items", test.items)
+        m.StepLimit = 1000
+        result, err := m.Run(s)
+        if err != nil {
+            t.Errorf("test %v: unexpected error: %v", i, err)
+        } else if result.AsString() != test.result {
+            t.Errorf("test %v: expected '%v', got '%v'", i, test.result, result)
+        }
+    }
+    
+    m := new (Machine)
+    m.BindGlobal("total", intObject(0))
+    m.BindGlobal("items", intObject(3))
+    if _, err := m.Run(s); err == nil || !strings.HasPrefix(err.String(), "TypeError") {
+        t.Errorf("iterating over an int should be a TypeError, got %v", err)
+    }
+}
+
+func TestRunBuild(t *testing.T) {
+    tests := []struct {
+        op, count uint32
+        result    string
+    }{
+        {BUILDLIST, 3, "[1, 2, 1]"},
+        {BUILDTUPLE, 1, "(1,)"},
+        {BUILDTUPLE, 0, "()"},
+        {BUILDDICT, 2, "{1: 2, 1.5: 2}"},
+        {BUILDSET, 4, "{1, 2, 1.5}"},
+        {BUILDSET, 0, "set()"},
+    }
+    
+    half := new (FloatObject)
+    half.Value = 1.5
+    
+    for i, test := range tests {
+        s := new (CodeObject)
+        s.Init()
+        s.WriteConst(intObject(1), 1, false, 0)
+        s.WriteConst(intObject(2), 2, false, 0)
+        s.WriteConst(intObject(1), 3, false, 0)
+        s.WriteConst(half, 3, true, 1)
+        s.WriteConst(intObject(2), 4, false, 0)
+        s.WriteBuild(test.op, 1, test.count, 5, false, 0)
+        s.WriteHalt(5, false, 0)
+        
+        m := new (Machine)
+        m.Pred[1] = test.op == BUILDDICT || test.op == BUILDSET
+        result, err := m.Run(s)
+        if err != nil {
+            t.Errorf("test %v: unexpected error: %v", i, err)
+        } else if result.AsString() != test.result {
+            t.Errorf("test %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+    
+    // A dict needs two registers for each entry.
+    s := new (CodeObject)
+    s.Init()
+    s.WriteBuild(BUILDDICT, 10, 4, 1, false, 0)
+    if _, err := new (Machine).Run(s); err == nil {
+        t.Errorf("expected an error building a dict past the last register")
+    }
+}
+
+func TestRunAttributes(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    
+    // o.x = 3; return o.x + o.y
+    s.WriteLoad("o", 1, false, 0)
+    s.WriteConst(NewString("x"), 2, false, 0)
+    s.WriteConst(intObject(3), 3, false, 0)
+    s.WriteSet(1, 2, 3, false, 0)
+    s.WriteGet(1, 2, 4, false, 0)
+    s.WriteConst(NewString("y"), 2, false, 0)
+    s.WriteGet(1, 2, 5, false, 0)
+    s.WriteAluIns(ADD,4,5,6,false,0)
+    s.WriteHalt(6, false, 0)
+    
+    o := NewTuple(nil)
+    o.SetAttr("y", intObject(4))
+    m := new (Machine)
+    m.BindGlobal("o", o)
+    result, err := m.Run(s)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if result.AsString() != "7" {
+        t.Errorf("expected 3 + 4, got %v", result.AsString())
+    }
+    if x, present := o.GetAttr("x"); !present || x.AsString() != "3" {
+        t.Errorf("SET should have bound x on the object")
+    }
+    
+    m = new (Machine)
+    m.BindGlobal("o", NewTuple(nil))
+    if _, err = m.Run(s); err == nil || !strings.HasPrefix(err.String(), "AttributeError") {
+        t.Errorf("expected an AttributeError for the missing y, got %v", err)
+    }
+}
+
+func TestRunIndex(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    
+    // o[k] = v; return o[k]
+    s.WriteLoad("o", 1, false, 0)
+    s.WriteLoad("k", 2, false, 0)
+    s.WriteLoad("v", 3, false, 0)
+    s.WriteStoreIndex(1, 2, 3, false, 0)
+    s.WriteIndex(1, 2, 4, false, 0)
+    s.WriteHalt(4, false, 0)
+    
+    items := func() ([]Object) {
+        return []Object{intObject(1), intObject(2), intObject(3)}
+    }
+    
+    tests := []struct {
+        o, k, v Object
+        result  string
+    }{
+        {NewList(items()), intObject(1), intObject(7), "7"},
+        {NewList(items()), intObject(-1), NewString("x"), "x"},
+        {NewDict(), NewString("a"), intObject(2), "2"},
+        {NewList(items()), intObject(3), intObject(7), "IndexError"},
+        {NewList(items()), NewString("a"), intObject(7), "TypeError"},
+        {NewTuple(items()), intObject(1), intObject(7), "TypeError"},
+        {NewString("abc"), intObject(1), intObject(7), "TypeError"},
+        {intObject(1), intObject(1), intObject(7), "TypeError"},
+    }
+    for i, test := range tests {
+        m := new (Machine)
+        m.BindGlobal("o", test.o)
+        m.BindGlobal("k", test.k)
+        m.BindGlobal("v", test.v)
+        result, err := m.Run(s)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("test %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("test %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+    
+    // Strings and tuples can only be read.
+    s = new (CodeObject)
+    s.Init()
+    s.WriteLoad("o", 1, false, 0)
+    s.WriteLoad("k", 2, false, 0)
+    s.WriteIndex(1, 2, 3, false, 0)
+    s.WriteHalt(3, false, 0)
+    
+    d := NewDict()
+    d.Set(intObject(1), NewString("one"))
+    
+    reads := []struct {
+        o, k   Object
+        result string
+    }{
+        {NewString("héllo"), intObject(-4), "é"},
+        {NewTuple(items()), intObject(-3), "1"},
+        {d, intObject(1), "one"},
+        {d, intObject(2), "KeyError"},
+    }
+    for i, test := range reads {
+        m := new (Machine)
+        m.BindGlobal("o", test.o)
+        m.BindGlobal("k", test.k)
+        result, err := m.Run(s)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("read %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("read %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+}
+
+func TestRunGetItemMethod(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    
+    // def __getitem__(self, key): return key * key
+    g := mod.NewCode("__getitem__")
+    g.NameIndex("self")
+    g.NameIndex("key")
+    g.NumParams = 2
+    g.WriteAluIns(MUL,2,2,3,false,0)
+    g.WriteRet(3, false, 0)
+    
+    // Any object with a __getitem__ attribute can be subscripted.
+    o := intObject(1)
+    o.SetAttr("__getitem__", NewFunction(g, nil, mod.Globals))
+    mod.Globals["o"] = o
+    
+    body := mod.NewCode("<module>")
+    mod.Code[0], mod.Code[1] = body, g
+    body.WriteLoad("o", 1, false, 0)
+    body.WriteConst(intObject(6), 2, false, 0)
+    body.WriteIndex(1, 2, 3, false, 0)
+    body.WriteHalt(3, false, 0)
+    
+    result, err := new (Machine).RunModule(mod)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if result.AsString() != "36" {
+        t.Errorf("expected __getitem__ to return 36, got %v", result.AsString())
+    }
+}
+
+func TestRunBinaryMethods(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    mod.NewCode("<module>")
+    
+    // def __add__(self, other): return NotImplemented
+    add := mod.NewCode("__add__")
+    add.NameIndex("self")
+    add.NameIndex("other")
+    add.NumParams = 2
+    add.WriteConst(NotImplemented, 3, false, 0)
+    add.WriteRet(3, false, 0)
+    
+    // def __radd__(self, other): return other * 10
+    radd := mod.NewCode("__radd__")
+    radd.NameIndex("self")
+    radd.NameIndex("other")
+    radd.NumParams = 2
+    radd.WriteConst(intObject(10), 3, false, 0)
+    radd.WriteAluIns(MUL,2,3,4,false,0)
+    radd.WriteRet(4, false, 0)
+    
+    a := NewString("a")
+    a.SetAttr("__add__", NewFunction(add, nil, mod.Globals))
+    b := NewList(nil)
+    b.SetAttr("__radd__", NewFunction(radd, nil, mod.Globals))
+    
+    tests := []struct {
+        op      uint32
+        l, r    Object
+        result  string
+    }{
+        // __add__ returns NotImplemented, so __radd__ is called.
+        {ADD, a, b, "aaaaaaaaaa"},
+        {ADD, intObject(1), b, "10"},
+        {ADD, a, NewString("b"), "TypeError"},
+        {SUB, intObject(1), b, "TypeError"},
+        {MUL, intObject(2), NewList([]Object{intObject(1)}), "[1, 1]"},
+        {MUL, intObject(3), NewString("ab"), "ababab"},
+    }
+    for i, test := range tests {
+        mod.Globals["l"], mod.Globals["r"] = test.l, test.r
+        body := mod.NewCode("<module>")
+        mod.Code[0] = body
+        body.WriteLoad("l", 1, false, 0)
+        body.WriteLoad("r", 2, false, 0)
+        body.WriteAluIns(test.op, 1, 2, 3, false, 0)
+        body.WriteHalt(3, false, 0)
+        
+        result, err := new (Machine).RunModule(mod)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("test %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("test %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+}
+
+func TestRunCompareMethods(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    mod.NewCode("<module>")
+    
+    // def __lt__(self, other): return NotImplemented
+    lt := mod.NewCode("__lt__")
+    lt.NameIndex("self")
+    lt.NameIndex("other")
+    lt.NumParams = 2
+    lt.WriteConst(NotImplemented, 3, false, 0)
+    lt.WriteRet(3, false, 0)
+    
+    // def __gt__(self, other): return 1
+    gt := mod.NewCode("__gt__")
+    gt.NameIndex("self")
+    gt.NameIndex("other")
+    gt.NumParams = 2
+    gt.WriteConst(intObject(1), 3, false, 0)
+    gt.WriteRet(3, false, 0)
+    
+    // def __eq__(self, other): return 1
+    eq := mod.NewCode("__eq__")
+    eq.NameIndex("self")
+    eq.NameIndex("other")
+    eq.NumParams = 2
+    eq.WriteConst(intObject(1), 3, false, 0)
+    eq.WriteRet(3, false, 0)
+    
+    a := NewString("a")
+    a.SetAttr("__lt__", NewFunction(lt, nil, mod.Globals))
+    b := NewList(nil)
+    b.SetAttr("__gt__", NewFunction(gt, nil, mod.Globals))
+    b.SetAttr("__eq__", NewFunction(eq, nil, mod.Globals))
+    
+    tests := []struct {
+        op      uint32
+        l, r    Object
+        result  string
+    }{
+        // __lt__ returns NotImplemented, so the reflected __gt__ is called.
+        {LT, a, b, "true"},
+        {EQ, intObject(1), b, "true"},
+        {NE, b, intObject(1), "false"},
+        {LT, a, intObject(1), "TypeError"},
+        {EQ, a, intObject(1), "false"},
+        {NE, NewString("1"), intObject(1), "true"},
+        {LT, NewList([]Object{intObject(1)}), NewList([]Object{NewString("a")}), "TypeError"},
+        {LT, NewTuple([]Object{intObject(1), NewString("a")}), NewTuple([]Object{floatObject(1), NewString("b")}), "true"},
+        {EQ, NewList([]Object{floatObject(math.NaN())}), NewList([]Object{floatObject(math.NaN())}), "false"},
+        {NE, floatObject(math.NaN()), floatObject(math.NaN()), "true"},
+        {GE, NewSet(), NewList(nil), "TypeError"},
+    }
+    for i, test := range tests {
+        mod.Globals["l"], mod.Globals["r"] = test.l, test.r
+        body := mod.NewCode("<module>")
+        mod.Code[0] = body
+        body.WriteLoad("l", 1, false, 0)
+        body.WriteLoad("r", 2, false, 0)
+        body.WriteCompare(test.op, 1, 2, 5, false, 0)
+        body.WriteHalt(1, false, 0)
+        
+        m := new (Machine)
+        _, err := m.RunModule(mod)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("test %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && fmt.Sprint(m.Pred[5]) != test.result:
+                t.Errorf("test %v: expected %v, got %v", i, test.result, m.Pred[5])
+        }
+    }
+}
+
+func TestRunInPlace(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    mod.NewCode("<module>")
+    
+    // def __iadd__(self, other): return other
+    iadd := mod.NewCode("__iadd__")
+    iadd.NameIndex("self")
+    iadd.NameIndex("other")
+    iadd.NumParams = 2
+    iadd.WriteRet(2, false, 0)
+    
+    a := NewString("a")
+    a.SetAttr("__iadd__", NewFunction(iadd, nil, mod.Globals))
+    
+    one := func() (*SetObject) {
+        s := NewSet()
+        s.Insert(intObject(1))
+        return s
+    }
+    
+    tests := []struct {
+        op      uint32
+        l, r    Object
+        result  string
+        same    bool
+    }{
+        // A list is changed in place, whatever it is extended with.
+        {ADD, NewList([]Object{intObject(1)}), NewTuple([]Object{intObject(2)}), "[1, 2]", true},
+        {ADD, NewList([]Object{intObject(1)}), NewString("ab"), "[1, 'a', 'b']", true},
+        {MUL, NewList([]Object{intObject(1)}), intObject(2), "[1, 1]", true},
+        {SUB, one(), one(), "set()", true},
+        
+        // The others fall back to the binary operation, which makes a new object.
+        {ADD, NewTuple([]Object{intObject(1)}), NewTuple([]Object{intObject(2)}), "(1, 2)", false},
+        {ADD, intObject(1), intObject(2), "3", false},
+        {MUL, NewString("ab"), intObject(2), "'abab'", false},
+        {ADD, a, NewString("b"), "'b'", false},
+        {ADD, NewList(nil), intObject(1), "TypeError", false},
+    }
+    for i, test := range tests {
+        mod.Globals["l"], mod.Globals["r"] = test.l, test.r
+        body := mod.NewCode("<module>")
+        mod.Code[0] = body
+        body.WriteLoad("l", 1, false, 0)
+        body.WriteLoad("r", 2, false, 0)
+        body.WriteInPlaceAluIns(test.op, 1, 2, 1, false, 0)
+        body.WriteHalt(1, false, 0)
+        
+        result, err := new (Machine).RunModule(mod)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("test %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.Repr() != test.result:
+                t.Errorf("test %v: expected %v, got %v", i, test.result, result.Repr())
+            case err == nil && (result == test.l) != test.same:
+                t.Errorf("test %v: the result should be the left operand: %v", i, test.same)
+        }
+    }
+}
+
+func TestPowAndDivmod(t *testing.T) {
+    builtins := NewInterpreter().Builtins
+    
+    tests := []struct {
+        fn      string
+        args    []Object
+        result  string
+    }{
+        {"pow", []Object{intObject(2), intObject(10)}, "1024"},
+        {"pow", []Object{intObject(2), floatObject(0.5)}, "1.4142135623730951"},
+        {"pow", []Object{floatObject(2), intObject(-1)}, "0.5"},
+        {"pow", []Object{intObject(3), intObject(200), intObject(7)}, "2"},
+        {"pow", []Object{intObject(-3), intObject(3), intObject(5)}, "3"},
+        {"pow", []Object{intObject(3), intObject(3), intObject(-5)}, "-3"},
+        {"pow", []Object{intObject(3), intObject(3), intObject(0)}, "ValueError"},
+        {"pow", []Object{intObject(3), intObject(-1), intObject(5)}, "ValueError"},
+        {"pow", []Object{floatObject(3), intObject(3), intObject(5)}, "TypeError"},
+        {"pow", []Object{NewString("a"), intObject(2)}, "TypeError"},
+        {"divmod", []Object{intObject(7), intObject(2)}, "(3, 1)"},
+        {"divmod", []Object{intObject(-7), intObject(2)}, "(-4, 1)"},
+        {"divmod", []Object{intObject(7), floatObject(-2)}, "(-4.0, -1.0)"},
+        {"divmod", []Object{floatObject(7.5), intObject(2)}, "(3.0, 1.5)"},
+        {"divmod", []Object{intObject(1), intObject(0)}, "ZeroDivisionError"},
+        {"divmod", []Object{NewComplex(1), intObject(1)}, "TypeError"},
+        {"divmod", []Object{NewString("a"), intObject(1)}, "TypeError"},
+    }
+    for i, test := range tests {
+        fn := builtins[test.fn].(*BuiltinFunctionObject)
+        result, err := fn.Call(new (Machine), test.args, nil, nil)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("test %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.Repr() != test.result:
+                t.Errorf("test %v: expected %v, got %v", i, test.result, result.Repr())
+        }
+    }
+    
+    // Generated code does ** with the same promotion.
+    m := new (Machine)
+    if result, err := m.SsaArithmetic(SSA_POW, intObject(4), floatObject(0.5)); err != nil || result.Repr() != "2.0" {
+        t.Errorf("4 ** 0.5 should be 2.0, got %v, %v", result, err)
+    }
+    l := NewList(nil)
+    if result, err := m.SsaArithmetic(SSA_ADD|X86_INPLACE, l, NewList([]Object{None})); err != nil || result != l {
+        t.Errorf("+= should extend the list in place, got %v, %v", result, err)
+    }
+}
+
+func TestRunUnary(t *testing.T) {
+    half := new (FloatObject)
+    half.Value = 0.5
+    
+    tests := []struct {
+        op      uint32
+        operand Object
+        result  string
+    }{
+        {NEG, intObject(3), "-3"},
+        {POS, intObject(3), "3"},
+        {INVERT, intObject(5), "-6"},
+        {INVERT, intObject(-1), "0"},
+        {NEG, half, "-0.5"},
+        {INVERT, half, "TypeError"},
+        {NEG, NewString("a"), "TypeError"},
+    }
+    for i, test := range tests {
+        s := new (CodeObject)
+        s.Init()
+        s.WriteConst(test.operand, 1, false, 0)
+        s.WriteUnary(test.op, 1, 2, false, 0)
+        s.WriteHalt(2, false, 0)
+        
+        result, err := new (Machine).Run(s)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("test %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("test %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+    
+    // not x
+    truths := []struct {
+        operand Object
+        not     bool
+    }{
+        {intObject(0), true},
+        {intObject(2), false},
+        {NewString(""), true},
+        {NewList([]Object{intObject(0)}), false},
+        {NewDict(), true},
+    }
+    for i, test := range truths {
+        s := new (CodeObject)
+        s.Init()
+        s.WriteConst(test.operand, 1, false, 0)
+        s.WriteNot(1, 3, false, 0)
+        
+        m := new (Machine)
+        if _, err := m.Run(s); err != nil {
+            t.Errorf("not %v: unexpected error: %v", i, err)
+        } else if m.Pred[3] != test.not {
+            t.Errorf("not %v: expected %v, got %v", i, test.not, m.Pred[3])
+        }
+    }
+}
+
+func TestRunRawArithmetic(t *testing.T) {
+    tests := []struct {
+        alu, unbox, box uint32
+        l, r            Object
+        op              uint32
+        result          string
+    }{
+        {IALU, UNBOXI, BOXI, intObject(7), intObject(-2), ADD, "5"},
+        {IALU, UNBOXI, BOXI, intObject(7), intObject(-2), MUL, "-14"},
+        {IALU, UNBOXI, BOXI, intObject(-7), intObject(2), FDIV, "-4"},
+        {IALU, UNBOXI, BOXI, intObject(-7), intObject(2), MOD, "1"},
+        {IALU, UNBOXI, BOXI, intObject(7), intObject(0), MOD, "ZeroDivisionError"},
+        {IALU, UNBOXI, BOXI, intObject(1 << 62), intObject(2), MUL, "OverflowError"},
+        {IALU, UNBOXI, BOXI, intObject(-1 << 62), intObject(1 << 62 + 1), SUB, "OverflowError"},
+        {IALU, UNBOXI, BOXI, intObject(7), intObject(2), DIV, "opcode"},
+        {FALU, UNBOXF, BOXF, intObject(7), intObject(2), DIV, "3.5"},
+        {FALU, UNBOXF, BOXF, intObject(-7), intObject(2), MOD, "1"},
+        {FALU, UNBOXF, BOXF, NewString("a"), intObject(2), ADD, "TypeError"},
+    }
+    
+    for i, test := range tests {
+        s := new (CodeObject)
+        s.Init()
+        s.WriteConst(test.l, 1, false, 0)
+        s.WriteConst(test.r, 2, false, 0)
+        s.WriteUnbox(test.unbox, 1, 3, false, 0)
+        s.WriteUnbox(test.unbox, 2, 4, false, 0)
+        s.WriteRawAluIns(test.alu, test.op, 3, 4, 5, false, 0)
+        s.WriteBox(test.box, 5, 6, false, 0)
+        s.WriteHalt(6, false, 0)
+        
+        result, err := new (Machine).Run(s)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("test %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("test %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+    
+    // Big ints only go in the long registers, and anything has a truth value.
+    big_int := NewBigInt(new (big.Int).Mul(big.NewInt(1 << 62), big.NewInt(1 << 62)))
+    
+    s := new (CodeObject)
+    s.Init()
+    s.WriteConst(big_int, 1, false, 0)
+    s.WriteUnbox(UNBOXL, 1, 2, false, 0)
+    s.WriteBox(BOXL, 2, 3, false, 0)
+    s.WriteUnbox(UNBOXB, 1, 4, false, 0)
+    s.WriteBox(BOXB, 4, 5, false, 0)
+    s.WriteConst(NewString("s"), 6, false, 0)
+    s.WriteUnbox(UNBOXS, 6, 2, false, 0)
+    s.WriteBox(BOXS, 2, 7, false, 0)
+    s.WriteUnbox(UNBOXI, 1, 2, false, 0)
+    
+    m := new (Machine)
+    _, err := m.Run(s)
+    if err == nil || !strings.HasPrefix(err.String(), "OverflowError") {
+        t.Errorf("expected an OverflowError unboxing a big int as an int64, got %v", err)
+    }
+    if !m.Register[3].Eq(big_int).IsTrue() || m.Register[3] == Object(big_int) {
+        t.Errorf("expected a copy of the big int, got %v", m.Register[3])
+    }
+    if m.Register[5].AsString() != "1" || m.Register[7].AsString() != "s" {
+        t.Errorf("expected the bool and the string to be boxed again, got %v and %v", m.Register[5], m.Register[7])
+    }
+}
+
+func TestDecodedInvalidation(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    s.WriteConst(intObject(1), 1, false, 0)
+    jump := s.WriteJump(false, 0)
+    s.WriteHalt(1, false, 0)
+    
+    if n := len(s.Decoded()); n != 3 {
+        t.Fatalf("expected 3 decoded instructions, got %v", n)
+    }
+    
+    // The jump was decoded with a target of 0, and would loop forever.
+    s.WriteConst(intObject(2), 1, false, 0)
+    s.WriteHalt(1, false, 0)
+    s.PatchJump(jump, 3)
+    
+    m := new (Machine)
+    m.StepLimit = 100
+    result, err := m.Run(s)
+    if err != nil || result.AsString() != "2" {
+        t.Errorf("expected the patched jump to reach the new code, got %v, %v", result, err)
+    }
+}
+
+func TestSetHandler(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 10)
+    
+    // Count the additions, and pass them on.
+    m := new (Machine)
+    adds := 0
+    var add Handler
+    add = m.SetHandler(ADD, func(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+        adds++
+        return add(m, f, ins)
+    })
+    
+    result, err := m.Run(s)
+    if err != nil || result.AsString() != "55" {
+        t.Fatalf("expected the loop to sum to 55, got %v, %v", result, err)
+    }
+    if adds != 11 {
+        t.Errorf("expected 11 additions, got %v", adds)
+    }
+    
+    // Other machines keep the default handlers.
+    if _, err = new (Machine).Run(s); err != nil || adds != 11 {
+        t.Errorf("the hook should only apply to the machine it was set on")
+    }
+    
+    m = new (Machine)
+    m.SetHandler(SUB, nil)
+    if _, err = m.Run(s); err == nil {
+        t.Errorf("expected an error once SUB has no handler")
+    }
+}
+
+// Builds a loop that adds up the numbers from n down to 1.
+func writeSumLoop(s *CodeObject, n int64) {
+    s.WriteConst(intObject(0), 1, false, 0)
+    s.WriteConst(intObject(1), 2, false, 0)
+    s.WriteConst(intObject(n), 3, false, 0)
+    s.WriteAluIns(ADD,1,1,4,false,0)
+    top := s.Here()
+    s.WriteCompare(GT, 3, 1, 1, false, 0)
+    exit := s.WriteJump(false, 1)
+    s.WriteAluIns(ADD,4,3,4,false,0)
+    s.WriteAluIns(SUB,3,2,3,false,0)
+    s.PatchJump(s.WriteJump(false, 0), top)
+    s.PatchJump(exit, s.Here())
+    s.WriteHalt(4, false, 0)
+}
+
+// Measures the dispatch of the loop, which runs about 5 instructions per iteration.
+func BenchmarkRunLoop(b *testing.B) {
+    s := new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 1000)
+    
+    for i := 0; i < b.N; i++ {
+        m := new (Machine)
+        m.Run(s)
+    }
+}
+
+// Measures decoding every instruction of the loop from the raw stream, which is what
+// each step of Dispatch did before the code was decoded once up front.
+func BenchmarkDecodeLoop(b *testing.B) {
+    s := new (CodeObject)
+    s.Init()
+    writeSumLoop(s, 1000)
+    code := s.Bytes()
+    
+    for i := 0; i < b.N; i++ {
+        for j := 0; j < 5000; j++ {
+            pc := j % (len(code)/4)
+            Decode(binary.LittleEndian.Uint32(code[pc*4:]))
+        }
+    }
+}
+
+// Writes a program computing n! with a recursive call.
+func writeFactorial(s *CodeObject) {
+    // r1 = n, r2 = 1
+    s.WriteLoad("one", 2, false, 0)
+    s.WriteLoad("n", 1, false, 0)
+    fact := s.WriteCall(3, false, 0)
+    s.WriteHalt(3, false, 0)
+    
+    // if n <= 1: return 1
+    entry := s.Here()
+    s.PatchJump(fact, entry)
+    s.WriteCompare(LE, 1, 2, 1, false, 0)
+    s.WriteRet(2, true, 1)
+    
+    // return n * fact(n - 1)
+    s.WriteAluIns(MUL,1,2,4,false,0)
+    s.WriteAluIns(SUB,1,2,1,false,0)
+    s.PatchJump(s.WriteCall(5, false, 0), entry)
+    s.WriteAluIns(MUL,4,5,5,false,0)
+    s.WriteRet(5, false, 0)
+}
+
+func TestRunCalls(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    
+    one := NewInt(1)
+    n := NewInt(10)
+    writeFactorial(s)
+    
+    m := new (Machine)
+    m.BindGlobal("one", one)
+    m.BindGlobal("n", n)
+    result, err := m.Run(s)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if result.AsInt().Cmp(big.NewInt(3628800)) != 0 {
+        t.Errorf("expected 10! to be 3628800, got '%v'", result)
+    }
+    if len(m.Frames) != 0 {
+        t.Errorf("expected every frame to have returned, %v are left", len(m.Frames))
+    }
+    
+    // The caller's registers are restored when the callee returns.
+    checkIntValueResult(t, m, 1, big.NewInt(10), "LOAD n, r1")
+    
+    m = new (Machine)
+    m.BindGlobal("one", one)
+    m.BindGlobal("n", n)
+    m.RecursionLimit = 5
+    if _, err = m.Run(s); err != RecursionError {
+        t.Errorf("expected a RecursionError, got %v", err)
+    }
+    if len(m.Frames) != 4 {
+        t.Errorf("expected 5 frames when the limit was hit, got %v", len(m.Frames)+1)
+    }
+}
+
+func TestRunReturnHalts(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    
+    one := NewInt(1)
+    s.WriteLoad("one", 1, false, 0)
+    s.WriteRet(1, false, 0)
+    s.WriteLoad("one", 2, false, 0)
+    
+    m := new (Machine)
+    m.BindGlobal("one", one)
+    result, err := m.Run(s)
+    if err != nil || result != one || m.Register[2] != nil {
+        t.Errorf("returning from the outermost frame should halt with its value, got '%v', %v", result, err)
+    }
+}
+
+func TestRunSpill(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    s.NumRegisters = 3
+    s.NumSpillSlots = 2
+    
+    // r1 = one, spilled to slot 1 while r1 holds two, then filled into r2.
+    s.WriteLoad("one", 1, false, 0)
+    s.WriteSpill(1, 1, false, 0)
+    s.WriteLoad("two", 1, false, 0)
+    s.WriteFill(1, 2, false, 0)
+    s.WriteAluIns(SUB,1,2,2,false,0)
+    s.WriteHalt(2, false, 0)
+    
+    m := new (Machine)
+    m.BindGlobal("one", intObject(1))
+    m.BindGlobal("two", intObject(2))
+    result, err := m.Run(s)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if result.AsInt().Cmp(big.NewInt(1)) != 0 {
+        t.Errorf("expected 2 - 1 to be 1, got '%v'", result)
+    }
+    if len(m.Register) != 3 || len(m.Spill) != 2 {
+        t.Errorf("expected 3 registers and 2 spill slots, got %v and %v", len(m.Register), len(m.Spill))
+    }
+    
+    s.NumSpillSlots = 1
+    m = new (Machine)
+    m.BindGlobal("one", intObject(1))
+    m.BindGlobal("two", intObject(2))
+    if _, err = m.Run(s); err == nil {
+        t.Errorf("spilling beyond the spill area should fail")
+    }
+    
+    s.NumRegisters = 2
+    if _, err = new (Machine).Run(s); err == nil {
+        t.Errorf("running code that uses more registers than it has should fail")
+    }
+}
+
+// Every call gets its own spill area, so the recursive calls of a factorial that keeps
+// n in a spill slot across each call don't overwrite it.
+func TestRunSpillRecursion(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    s.NumRegisters = 6
+    s.NumSpillSlots = 1
+    
+    s.WriteLoad("one", 2, false, 0)
+    s.WriteLoad("n", 1, false, 0)
+    fact := s.WriteCall(3, false, 0)
+    s.WriteHalt(3, false, 0)
+    
+    entry := s.Here()
+    s.PatchJump(fact, entry)
+    s.WriteCompare(LE, 1, 2, 1, false, 0)
+    s.WriteRet(2, true, 1)
+    
+    // r4 = n is spilled, and clobbered, while fact(n - 1) runs.
+    s.WriteAluIns(MUL,1,2,4,false,0)
+    s.WriteSpill(4, 0, false, 0)
+    s.WriteLoad("one", 4, false, 0)
+    s.WriteAluIns(SUB,1,2,1,false,0)
+    s.PatchJump(s.WriteCall(5, false, 0), entry)
+    s.WriteFill(0, 4, false, 0)
+    s.WriteAluIns(MUL,4,5,5,false,0)
+    s.WriteRet(5, false, 0)
+    
+    m := new (Machine)
+    m.BindGlobal("one", intObject(1))
+    m.BindGlobal("n", intObject(6))
+    result, err := m.Run(s)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if result.AsInt().Cmp(big.NewInt(720)) != 0 {
+        t.Errorf("expected 6! to be 720, got '%v'", result)
+    }
+}
+
+func TestFunctionFrameSize(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    
+    s := mod.NewCode("f")
+    s.NameIndex("a")
+    s.NumParams = 1
+    s.NumRegisters = 3
+    s.NumSpillSlots = 1
+    s.WriteSpill(1, 0, false, 0)
+    s.WriteFill(0, 2, false, 0)
+    s.WriteRet(2, false, 0)
+    
+    var registers, spill int
+    m := new (Machine)
+    m.SetHandler(RET, func(m *Machine, f *Frame, ins DecodedIns) (os.Error) {
+        registers, spill = len(f.Register), len(f.Spill)
+        return execRet(m, f, ins)
+    })
+    
+    body := mod.NewCode("<module>")
+    mod.Code[0], mod.Code[1] = body, mod.Code[0]
+    body.WriteConst(NewFunction(s, nil, mod.Globals), 1, false, 0)
+    body.WriteConst(intObject(4), 2, false, 0)
+    body.WriteCallFunction(1, 1, 0, 15, false, 0)
+    body.WriteHalt(15, false, 0)
+    
+    result, err := m.RunModule(mod)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if result.AsInt().Cmp(big.NewInt(4)) != 0 {
+        t.Errorf("expected f(4) to return 4, got '%v'", result)
+    }
+    if registers != 3 || spill != 1 {
+        t.Errorf("expected f to run with 3 registers and 1 spill slot, got %v and %v", registers, spill)
+    }
+    if len(m.Register) != MaxRegisters {
+        t.Errorf("expected the module to run with %v registers, got %v", MaxRegisters, len(m.Register))
+    }
+}
+
+func TestRunModule(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    s := mod.NewCode("<module>")
+    
+    five := NewInt(5)
+    one := NewInt(1)
+    y := NewInt(40)
+    mod.Globals["y"] = y
+    
+    // x = 5; return f()
+    s.WriteConst(five, 1, false, 0)
+    s.WriteBind("x", 1, false, 0)
+    f := s.WriteCall(2, false, 0)
+    s.WriteHalt(2, false, 0)
+    
+    // def f(): x = 1; return x + y
+    s.PatchJump(f, s.Here())
+    s.WriteConst(one, 3, false, 0)
+    s.WriteBind("x", 3, false, 0)
+    s.WriteLoad("x", 4, false, 0)
+    s.WriteLoad("y", 5, false, 0)
+    s.WriteAluIns(ADD,4,5,6,false,0)
+    s.WriteRet(6, false, 0)
+    
+    m := new (Machine)
+    result, err := m.RunModule(mod)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if result.AsInt().Cmp(big.NewInt(41)) != 0 {
+        t.Errorf("f should see its own x and the global y, got '%v'", result)
+    }
+    if mod.Globals["x"] != five {
+        t.Errorf("the module should bind x in the globals, and f in its locals")
+    }
+    if len(s.Constants) != 2 || len(s.Names) != 2 {
+        t.Errorf("expected 2 constants and 2 names, got %v and %v", s.Constants, s.Names)
+    }
+    
+    s = mod.NewCode("undefined")
+    s.WriteLoad("z", 1, false, 0)
+    m = new (Machine)
+    if _, err = m.Run(s); err == nil {
+        t.Errorf("loading an unbound name should fail")
+    }
+    
+    s.NumRegisters = 17
+    m = new (Machine)
+    if _, err = m.Run(s); err == nil {
+        t.Errorf("running code that needs more registers than the machine has should fail")
+    }
+}
+
+func intObject(v int64) (*IntObject) {
+    o := NewInt(v)
+    return o
+}
+
+// Builds def f(a, b=10, *args, **kwargs): return a + b
+func newTestFunction(mod *ModuleCode) (*FunctionObject) {
+    s := mod.NewCode("f")
+    for _, name := range []string{"a", "b", "args", "kwargs"} {
+        s.NameIndex(name)
+    }
+    s.NumParams = 2
+    s.VarArgs = true
+    s.VarKeywords = true
+    
+    s.WriteAluIns(ADD,1,2,5,false,0)
+    s.WriteRet(5, false, 0)
+    
+    return NewFunction(s, []Object{intObject(10)}, mod.Globals)
+}
+
+// Calls fn from the body of mod, with the arguments args and the keyword arguments kw.
+func callTestFunction(mod *ModuleCode, fn Object, args []Object, kwnames []string, kw []Object) (*Machine, Object, os.Error) {
+    body := mod.NewCode("<module>")
+    mod.Code[0], mod.Code[len(mod.Code)-1] = body, mod.Code[0]
+    
+    body.WriteConst(fn, 1, false, 0)
+    reg := uint32(2)
+    for _, arg := range append(args, kw...) {
+        body.WriteConst(arg, reg, false, 0)
+        reg++
+    }
+    if len(kw) > 0 {
+        var names []Object
+        for _, name := range kwnames {
+            names = append(names, NewString(name))
+        }
+        body.WriteConst(NewTuple(names), reg, false, 0)
+    }
+    body.WriteCallFunction(1, uint32(len(args)), uint32(len(kw)), 15, false, 0)
+    body.WriteHalt(15, false, 0)
+    
+    m := new (Machine)
+    result, err := m.RunModule(mod)
+    return m, result, err
+}
+
+func TestCallFunction(t *testing.T) {
+    tests := []struct {
+        args    []int64
+        kwnames []string
+        kw      []int64
+        result  int64
+    }{
+        {[]int64{1}, nil, nil, 11},
+        {[]int64{1, 2, 3, 4}, nil, nil, 3},
+        {nil, []string{"b", "a"}, []int64{5, 6}, 11},
+        {[]int64{1}, []string{"c"}, []int64{7}, 11},
+    }
+    
+    for i, test := range tests {
+        mod := new (ModuleCode)
+        mod.Init("test")
+        fn := newTestFunction(mod)
+        
+        var args, kw []Object
+        for _, v := range test.args {
+            args = append(args, intObject(v))
+        }
+        for _, v := range test.kw {
+            kw = append(kw, intObject(v))
+        }
+        
+        m, result, err := callTestFunction(mod, fn, args, test.kwnames, kw)
+        if err != nil {
+            t.Errorf("test %v: unexpected error: %v", i, err)
+            continue
+        }
+        if result.AsInt().Cmp(big.NewInt(test.result)) != 0 {
+            t.Errorf("test %v: expected %v, got '%v'", i, test.result, result)
+        }
+        if len(m.Frames) != 0 || m.Code != mod.Code[0] {
+            t.Errorf("test %v: the call didn't return to the module", i)
+        }
+    }
+}
+
+func TestBindArguments(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    fn := newTestFunction(mod)
+    
+    values, err := fn.bindArguments([]Object{intObject(1), intObject(2), intObject(3)}, []string{"c"}, []Object{intObject(4)})
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if len(values) != 4 {
+        t.Fatalf("expected a, b, *args and **kwargs, got %v", values)
+    }
+    if s := values[2].AsString(); s != "(3,)" {
+        t.Errorf("expected *args to be (3,), got %v", s)
+    }
+    if s := values[3].AsString(); s != "{c: 4}" {
+        t.Errorf("expected **kwargs to be {c: 4}, got %v", s)
+    }
+    
+    // Without *args and **kwargs, anything left over is an error.
+    fn.Code.VarArgs = false
+    fn.Code.VarKeywords = false
+    
+    bad := []struct {
+        args    []Object
+        kwnames []string
+        kw      []Object
+    }{
+        {[]Object{intObject(1), intObject(2), intObject(3)}, nil, nil},
+        {[]Object{intObject(1)}, []string{"c"}, []Object{intObject(2)}},
+        {[]Object{intObject(1)}, []string{"a"}, []Object{intObject(2)}},
+        {nil, []string{"b"}, []Object{intObject(2)}},
+    }
+    for i, test := range bad {
+        if _, err := fn.bindArguments(test.args, test.kwnames, test.kw); err == nil {
+            t.Errorf("test %v: expected a TypeError", i)
+        } else if !strings.HasPrefix(err.String(), "TypeError") {
+            t.Errorf("test %v: expected a TypeError, got %v", i, err)
+        }
+    }
+}
+
+func TestCallFunctionErrors(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    
+    // Functions run in their own frame, and return nothing when they run off the end.
+    s := mod.NewCode("g")
+    s.NameIndex("x")
+    s.NumParams = 1
+    s.WriteLoad("x", 2, false, 0)
+    s.WriteLoad("y", 3, false, 0)
+    s.WriteBind("z", 3, false, 0)
+    g := NewFunction(s, nil, mod.Globals)
+    mod.Globals["y"] = intObject(2)
+    
+    m, result, err := callTestFunction(mod, g, []Object{intObject(1)}, nil, nil)
+    if err != nil || result != nil {
+        t.Errorf("expected g to return nothing, got '%v', %v", result, err)
+    }
+    if _, present := mod.Globals["z"]; present || m.Register[3] != nil {
+        t.Errorf("g should bind z, and use registers, in its own frame")
+    }
+    
+    if _, _, err = callTestFunction(mod, g, nil, nil, nil); err == nil {
+        t.Errorf("calling g without x should fail")
+    }
+    if _, _, err = callTestFunction(mod, intObject(1), nil, nil, nil); err == nil {
+        t.Errorf("calling an int should fail")
+    }
+}
+
+// Builds the code of
+//
+//     def outer(a):
+//         b = a + a
+//         def inner(c):
+//             return a * (b + c)
+//         return inner
+//
+// with its cell and free variables taken from the scopes.
+func newClosureTest(mod *ModuleCode, t *testing.T) (*FunctionObject) {
+    _, ast := parseSource(t, "def outer(a):\n    b = a + a\n    def inner(c):\n        return a * (b + c)\n    return inner\n")
+    outer_scope := AnalyzeScopes(ast).Children[0]
+    
+    inner := mod.NewCode("inner")
+    inner.SetScope(outer_scope.Children[0])
+    inner.NameIndex("c")
+    inner.NumParams = 1
+    a, _ := inner.DerefIndex("a")
+    b, _ := inner.DerefIndex("b")
+    inner.WriteLoadDeref(uint32(b), 2, false, 0)
+    inner.WriteAluIns(ADD,2,1,3,false,0)
+    inner.WriteLoadDeref(uint32(a), 2, false, 0)
+    inner.WriteAluIns(MUL,2,3,3,false,0)
+    inner.WriteRet(3, false, 0)
+    
+    outer := mod.NewCode("outer")
+    outer.SetScope(outer_scope)
+    outer.NameIndex("a")
+    outer.NumParams = 1
+    b, _ = outer.DerefIndex("b")
+    outer.WriteAluIns(ADD,1,1,2,false,0)
+    outer.WriteStoreDeref(uint32(b), 2, false, 0)
+    outer.WriteConst(NewFunction(inner, nil, nil), 3, false, 0)
+    outer.WriteMakeClosure(3, 4, false, 0)
+    outer.WriteBind("inner", 4, false, 0)
+    outer.WriteRet(4, false, 0)
+    
+    return NewFunction(outer, nil, mod.Globals)
+}
+
+func TestClosures(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    outer := newClosureTest(mod, t)
+    
+    if s := fmt.Sprint(outer.Code.CellVars, mod.Code[0].FreeVars); s != "[a b] [a b]" {
+        t.Fatalf("expected a and b to be in cells, got %v", s)
+    }
+    
+    // inner = outer(5); inner(1)
+    body := mod.NewCode("<module>")
+    mod.Code[0], mod.Code[len(mod.Code)-1] = body, mod.Code[0]
+    body.WriteConst(outer, 1, false, 0)
+    body.WriteConst(intObject(5), 2, false, 0)
+    body.WriteCallFunction(1, 1, 0, 3, false, 0)
+    body.WriteConst(intObject(1), 4, false, 0)
+    body.WriteCallFunction(3, 1, 0, 5, false, 0)
+    body.WriteHalt(5, false, 0)
+    
+    m := new (Machine)
+    result, err := m.RunModule(mod)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if result.AsString() != "55" {
+        t.Errorf("expected 5 * (10 + 1), got %v", result.AsString())
+    }
+    
+    // The cell of a holds the parameter, and the cell of b the value outer stored in it.
+    inner, ok := m.Register[3].(*FunctionObject)
+    if !ok || len(inner.Closure) != 2 || inner.Closure[1].Value.AsString() != "10" {
+        t.Errorf("inner should have captured a and b, got %v", m.Register[3])
+    }
+    
+    // A function with free variables can't be called without a closure.
+    if !ok {
+        return
+    }
+    if _, _, err = callTestFunction(mod, NewFunction(inner.Code, nil, nil), []Object{intObject(1)}, nil, nil); err == nil {
+        t.Errorf("calling inner without its closure should fail")
+    }
+}
+
+// Builds a generator function that yields n, then n plus the value sent in, and then
+// fails on an undefined name.
+func newTestGenerator(mod *ModuleCode) (*FunctionObject) {
+    s := mod.NewCode("gen")
+    s.NameIndex("n")
+    s.NumParams = 1
+    s.Generator = true
+    
+    s.WriteYield(1, 2, false, 0)
+    s.WriteAluIns(ADD,1,2,3,false,0)
+    s.WriteYield(3, 2, false, 0)
+    s.WriteLoad("missing", 4, false, 0)
+    
+    return NewFunction(s, nil, mod.Globals)
+}
+
+func TestGenerators(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    gen := newTestGenerator(mod)
+    
+    m, result, err := callTestFunction(mod, gen, []Object{intObject(7)}, nil, nil)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    g, ok := result.(*GeneratorObject)
+    if !ok || len(m.Frames) != 0 {
+        t.Fatalf("calling gen should make a generator, without running it, got %v", result)
+    }
+    
+    if _, err = g.Send(intObject(1)); err == nil {
+        t.Errorf("sending a value to a generator that hasn't started should fail")
+    }
+    if value, more := g.Next(); !more || value.AsString() != "7" {
+        t.Errorf("expected the generator to yield 7, got %v", value)
+    }
+    if value, err := g.Send(intObject(2)); err != nil || value.AsString() != "9" {
+        t.Errorf("expected the generator to yield 9, got %v, %v", value, err)
+    }
+    if _, err = g.Send(None); err == nil || !strings.HasPrefix(err.String(), "NameError") {
+        t.Errorf("expected the generator to fail with a NameError, got %v", err)
+    }
+    if _, err = g.Send(None); err != StopIteration || g.Err == nil {
+        t.Errorf("a generator that failed should be finished, got %v", err)
+    }
+    
+    // A for loop over a generator fails when the generator does.  The loop resumes it
+    // with None, so it fails adding None to n, before it gets to the undefined name.
+    s := new (CodeObject)
+    s.Init()
+    s.WriteLoad("items", 2, false, 0)
+    s.WriteGetIter(2, 3, false, 0)
+    top := s.Here()
+    exit := s.WriteForIter(3, false, 0)
+    s.PatchJump(s.WriteJump(false, 0), top)
+    s.PatchJump(exit, s.Here())
+    
+    _, result, _ = callTestFunction(mod, gen, []Object{intObject(7)}, nil, nil)
+    m = new (Machine)
+    m.BindGlobal("items", result)
+    if _, err = m.Run(s); err == nil || !strings.HasPrefix(err.String(), "TypeError") {
+        t.Errorf("expected the loop to fail with a TypeError, got %v", err)
+    }
+    
+    // YIELD only runs in a generator.
+    s = new (CodeObject)
+    s.Init()
+    s.WriteYield(1, 1, false, 0)
+    if _, err = new (Machine).Run(s); err == nil {
+        t.Errorf("yielding outside a generator should fail")
+    }
+}
+
+func TestAwaitErrors(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    
+    // async def wait(x): return await x
+    s := mod.NewCode("wait")
+    s.NameIndex("x")
+    s.NumParams = 1
+    s.Coroutine = true
+    s.WriteAwait(1, 2, false, 0)
+    s.WriteRet(2, false, 0)
+    wait := NewFunction(s, nil, mod.Globals)
+    
+    newWait := func(x Object) (*CoroutineObject) {
+        _, result, err := callTestFunction(mod, wait, []Object{x}, nil, nil)
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        return result.(*CoroutineObject)
+    }
+    
+    if _, err := NewEventLoop().RunUntilComplete(newWait(intObject(1))); err == nil || !strings.HasPrefix(err.String(), "TypeError") {
+        t.Errorf("awaiting an int should be a TypeError, got %v", err)
+    }
+    
+    f := NewFuture()
+    f.SetError(os.NewError("ValueError: failed"))
+    if _, err := NewEventLoop().RunUntilComplete(newWait(f)); err == nil || err.String() != "ValueError: failed" {
+        t.Errorf("awaiting a future that failed should fail the same way, got %v", err)
+    }
+    if f.SetResult(None) == nil {
+        t.Errorf("setting the result of a future that is done should fail")
+    }
+    
+    f = NewFuture()
+    f.SetResult(intObject(1))
+    inner := newWait(f)
+    if _, err := NewEventLoop().RunUntilComplete(inner); err != nil || inner.Value.AsString() != "1" {
+        t.Errorf("expected the coroutine to return 1, got %v, %v", inner.Value, err)
+    }
+    if _, err := NewEventLoop().RunUntilComplete(newWait(inner)); err == nil {
+        t.Errorf("awaiting a coroutine that has finished should fail")
+    }
+    
+    s = new (CodeObject)
+    s.Init()
+    s.WriteAwait(1, 1, false, 0)
+    if _, err := new (Machine).Run(s); err == nil {
+        t.Errorf("awaiting outside a coroutine should fail")
+    }
+}
+
+func TestClasses(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    mod.NewCode("<module>")
+    
+    // def __init__(self, x): self.x = x
+    init := mod.NewCode("__init__")
+    init.NameIndex("self")
+    init.NameIndex("x")
+    init.NumParams = 2
+    init.WriteConst(NewString("x"), 3, false, 0)
+    init.WriteSet(1, 3, 2, false, 0)
+    init.WriteConst(None, 4, false, 0)
+    init.WriteRet(4, false, 0)
+    
+    // def __init__(self): return 1
+    bad_init := mod.NewCode("__init__")
+    bad_init.NameIndex("self")
+    bad_init.NumParams = 1
+    bad_init.WriteConst(intObject(1), 2, false, 0)
+    bad_init.WriteRet(2, false, 0)
+    
+    ns := NewDict()
+    ns.Set(NewString("__init__"), NewFunction(init, nil, mod.Globals))
+    ns.Set(NewString("kind"), NewString("a"))
+    a, err := NewType("A", nil, ns)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    b, _ := NewType("B", []Object{a}, nil)
+    c, _ := NewType("C", []Object{a}, nil)
+    d, _ := NewType("D", []Object{b, c}, nil)
+    
+    // The instances of B are made and set up by the __init__ of A.
+    m := new (Machine)
+    o, err := m.CallObjectKeywords(b, nil, []string{"x"}, []Object{intObject(5)})
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if x, present := o.GetAttr("x"); !present || x.AsString() != "5" {
+        t.Errorf("__init__ should have set x to 5, got %v", x)
+    }
+    if kind, present := o.GetAttr("kind"); !present || kind.AsString() != "a" {
+        t.Errorf("the instance should find kind in its class, got %v", kind)
+    }
+    o.SetAttr("kind", NewString("o"))
+    if kind, _ := o.GetAttr("kind"); kind.AsString() != "o" || a.Repr() != "<class 'A'>" || o.Repr() != "<B object>" {
+        t.Errorf("the attribute of the instance should hide the one of its class, got %v", kind)
+    }
+    
+    // B derives from A alone, and D from both sides of the diamond B and C make.
+    mros := []struct {
+        class   *TypeObject
+        repr    string
+    }{
+        {b, "(<class 'B'>, <class 'A'>, <class 'object'>)"},
+        {d, "(<class 'D'>, <class 'B'>, <class 'C'>, <class 'A'>, <class 'object'>)"},
+    }
+    for _, test := range mros {
+        if test.class == nil {
+            t.Fatalf("the classes deriving from A should have been made")
+        }
+        if mro, _ := test.class.GetAttr("__mro__"); mro.Repr() != test.repr {
+            t.Errorf("%v: unexpected method resolution order %v", test.class.Name, mro.Repr())
+        }
+    }
+    if _, err = NewType("E", []Object{a, b}, nil); err == nil || !strings.HasPrefix(err.String(), "TypeError") {
+        t.Errorf("a class can't come before a class that derives from it, got %v", err)
+    }
+    if _, err = NewType("E", []Object{intObject(1)}, nil); err == nil {
+        t.Errorf("a base has to be a class")
+    }
+    
+    bad, _ := NewType("Bad", nil, nil)
+    bad.SetAttr("__init__", NewFunction(bad_init, nil, mod.Globals))
+    errors := []struct {
+        class   Object
+        args    []Object
+    }{
+        {a, nil},
+        {ObjectClass, []Object{intObject(1)}},
+        {bad, nil},
+    }
+    for i, test := range errors {
+        if _, err := new (Machine).CallObject(test.class, test.args); err == nil || !strings.HasPrefix(err.String(), "TypeError") {
+            t.Errorf("call %v: expected a TypeError, got %v", i, err)
+        }
+    }
+    
+    interp := NewInterpreter()
+    isinstance, issubclass := interp.Builtins["isinstance"], interp.Builtins["issubclass"]
+    checks := []struct {
+        fn      Object
+        args    []Object
+        result  string
+    }{
+        {isinstance, []Object{o, a}, "1"},
+        {isinstance, []Object{o, d}, "0"},
+        {isinstance, []Object{o, NewTuple([]Object{c, NewTuple([]Object{b})})}, "1"},
+        {isinstance, []Object{intObject(5), a}, "0"},
+        {isinstance, []Object{intObject(5), ObjectClass}, "1"},
+        {isinstance, []Object{NewException(KeyErrorClass), LookupErrorClass}, "1"},
+        {isinstance, []Object{o, intObject(5)}, "TypeError"},
+        {issubclass, []Object{d, c}, "1"},
+        {issubclass, []Object{a, b}, "0"},
+        {issubclass, []Object{o, a}, "TypeError"},
+    }
+    for i, test := range checks {
+        result, err := new (Machine).CallObject(test.fn, test.args)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("check %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("check %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+}
+
+func TestDescriptors(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    mod.NewCode("<module>")
+    
+    // def get_x(o): return o.x
+    get_x := mod.NewCode("get_x")
+    get_x.NameIndex("o")
+    get_x.NumParams = 1
+    get_x.WriteConst(NewString("x"), 2, false, 0)
+    get_x.WriteGet(1, 2, 3, false, 0)
+    get_x.WriteRet(3, false, 0)
+    
+    // def set_x(o, v): o.x = v
+    set_x := mod.NewCode("set_x")
+    set_x.NameIndex("o")
+    set_x.NameIndex("v")
+    set_x.NumParams = 2
+    set_x.WriteConst(NewString("x"), 3, false, 0)
+    set_x.WriteSet(1, 3, 2, false, 0)
+    set_x.WriteConst(None, 4, false, 0)
+    set_x.WriteRet(4, false, 0)
+    
+    // The property x keeps its value doubled in _x.
+    getter := NewBuiltinFunction("getter", func(m *Machine, args []Object) (Object, os.Error) {
+        v, _ := args[0].GetAttr("_x")
+        return v.FloorDiv(intObject(2))
+    })
+    setter := NewBuiltinFunction("setter", func(m *Machine, args []Object) (Object, os.Error) {
+        v, _ := args[1].Mul(intObject(2))
+        args[0].SetAttr("_x", v)
+        return None, nil
+    })
+    first := NewBuiltinFunction("first", func(m *Machine, args []Object) (Object, os.Error) {
+        return args[0], nil
+    })
+    
+    // A class whose instances describe an attribute as the class the attribute was
+    // got from, and another whose instances also refuse to be set.
+    interp := NewInterpreter()
+    m := new (Machine)
+    m.Interpreter = interp
+    ns := NewDict()
+    ns.Set(NewString("__get__"), NewBuiltinFunction("__get__", func(m *Machine, args []Object) (Object, os.Error) {
+        return args[2], nil
+    }))
+    owner, _ := NewType("Owner", nil, ns)
+    ns.Set(NewString("__set__"), NewBuiltinFunction("__set__", func(m *Machine, args []Object) (Object, os.Error) {
+        return nil, Raise(AttributeErrorClass, "read-only")
+    }))
+    read_only, _ := NewType("ReadOnly", nil, ns)
+    
+    ns = NewDict()
+    ns.Set(NewString("x"), NewProperty(getter, setter, nil, nil))
+    ns.Set(NewString("y"), NewProperty(getter, nil, nil, nil))
+    ns.Set(NewString("s"), NewStaticMethod(first))
+    ns.Set(NewString("c"), NewClassMethod(first))
+    ns.Set(NewString("owner"), NewInstance(owner))
+    ns.Set(NewString("read_only"), NewInstance(read_only))
+    a, _ := NewType("A", nil, ns)
+    o := NewInstance(a)
+    
+    if _, err := m.CallObject(NewFunction(set_x, nil, mod.Globals), []Object{o, intObject(3)}); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if v, _ := o.ObjectData.GetAttr("_x"); v == nil || v.AsString() != "6" {
+        t.Errorf("the setter should have set _x to 6, got %v", v)
+    }
+    if v, err := m.CallObject(NewFunction(get_x, nil, mod.Globals), []Object{o}); err != nil || v.AsString() != "3" {
+        t.Errorf("the getter should give 3, got %v (%v)", v, err)
+    }
+    if _, present := o.ObjectData.GetAttr("x"); present {
+        t.Errorf("a property shouldn't set the attribute of the instance")
+    }
+    
+    // An attribute of the instance hides a descriptor without __set__, but not one
+    // with it.
+    o.SetAttr("owner", intObject(1))
+    o.SetAttr("read_only", intObject(1))
+    
+    getattr, delattr, hasattr := interp.Builtins["getattr"], interp.Builtins["delattr"], interp.Builtins["hasattr"]
+    calls := []struct {
+        fn      Object
+        args    []Object
+        result  string
+    }{
+        {getattr, []Object{a, NewString("x")}, "<property object>"},
+        {getattr, []Object{o, NewString("y")}, "3"},
+        {getattr, []Object{o, NewString("owner")}, "1"},
+        {getattr, []Object{o, NewString("read_only")}, "<class 'A'>"},
+        {getattr, []Object{a, NewString("owner")}, "<class 'A'>"},
+        {getattr, []Object{a, NewString("s")}, "<built-in function first>"},
+        {getattr, []Object{o, NewString("s")}, "<built-in function first>"},
+        {getattr, []Object{o, NewString("c")}, "<bound method first of <class 'A'>>"},
+        {getattr, []Object{o, NewString("z")}, "AttributeError"},
+        {getattr, []Object{o, NewString("z"), None}, "None"},
+        {getattr, []Object{a, NewString("__name__")}, "A"},
+        {interp.Builtins["setattr"], []Object{o, NewString("y"), intObject(1)}, "AttributeError"},
+        {interp.Builtins["setattr"], []Object{o, NewString("read_only"), intObject(1)}, "AttributeError"},
+        {delattr, []Object{o, NewString("x")}, "AttributeError"},
+        {delattr, []Object{o, NewString("owner")}, "None"},
+        {hasattr, []Object{o, NewString("owner")}, "1"},
+        {delattr, []Object{o, NewString("owner")}, "AttributeError"},
+        {hasattr, []Object{o, NewString("z")}, "0"},
+        
+        // The built-in classes are shared by every interpreter, so they can't be changed.
+        {interp.Builtins["setattr"], []Object{IntClass, NewString("z"), intObject(1)}, "TypeError"},
+        {interp.Builtins["setattr"], []Object{ValueErrorClass, NewString("z"), intObject(1)}, "TypeError"},
+        {delattr, []Object{ObjectClass, NewString("__getattribute__")}, "TypeError"},
+        {hasattr, []Object{IntClass, NewString("z")}, "0"},
+        {interp.Builtins["setattr"], []Object{a, NewString("z"), intObject(1)}, "None"},
+        {delattr, []Object{a, NewString("z")}, "None"},
+    }
+    for i, test := range calls {
+        result, err := m.CallObject(test.fn, test.args)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("call %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("call %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+    
+    // A class method is called with the class, even from an instance.
+    c, _ := m.getAttr(o, "c")
+    if result, err := m.CallObject(c, nil); err != nil || result != Object(a) {
+        t.Errorf("the class method should be called with the class, got %v (%v)", result, err)
+    }
+}
+
+func TestAttributeHooks(t *testing.T) {
+    interp := NewInterpreter()
+    m := new (Machine)
+    m.Interpreter = interp
+    
+    // __getattr__ names the attribute it was asked for, __getattribute__ makes up a,
+    // refuses b, and leaves the rest to object.__getattribute__.
+    fallback := NewBuiltinFunction("__getattr__", func(m *Machine, args []Object) (Object, os.Error) {
+        return NewString("missing " + args[1].AsString()), nil
+    })
+    lookup, _ := ObjectClass.GetAttr("__getattribute__")
+    override := NewBuiltinFunction("__getattribute__", func(m *Machine, args []Object) (Object, os.Error) {
+        switch args[1].AsString() {
+            case "a":
+                return NewString("made up"), nil
+            case "b":
+                return nil, Raise(TypeErrorClass, "refused")
+        }
+        return m.callNested(lookup, args)
+    })
+    unreadable := NewProperty(nil, nil, nil, nil)
+    
+    ns := NewDict()
+    ns.Set(NewString("__getattr__"), fallback)
+    ns.Set(NewString("p"), unreadable)
+    a, _ := NewType("A", nil, ns)
+    ns = NewDict()
+    ns.Set(NewString("__getattribute__"), override)
+    b, _ := NewType("B", nil, ns)
+    c, _ := NewType("C", []Object{b, a}, nil)
+    
+    o, p, q := NewInstance(a), NewInstance(b), NewInstance(c)
+    o.SetAttr("x", intObject(1))
+    q.SetAttr("x", intObject(2))
+    
+    getattr := interp.Builtins["getattr"]
+    calls := []struct {
+        args    []Object
+        result  string
+    }{
+        {[]Object{o, NewString("x")}, "1"},
+        {[]Object{o, NewString("y")}, "missing y"},
+        {[]Object{o, NewString("p")}, "missing p"},
+        {[]Object{p, NewString("a")}, "made up"},
+        {[]Object{p, NewString("b")}, "TypeError"},
+        {[]Object{p, NewString("y")}, "AttributeError"},
+        {[]Object{p, NewString("y"), None}, "None"},
+        {[]Object{q, NewString("a")}, "made up"},
+        {[]Object{q, NewString("b")}, "TypeError"},
+        {[]Object{q, NewString("x")}, "2"},
+        {[]Object{q, NewString("y")}, "missing y"},
+        {[]Object{a, NewString("y")}, "AttributeError"},
+    }
+    for i, test := range calls {
+        result, err := m.CallObject(getattr, test.args)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("call %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("call %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+}
+
+func TestBoundMethods(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    mod.NewCode("<module>")
+    
+    // def scale(self, k): return self.x * k
+    scale := mod.NewCode("scale")
+    scale.NameIndex("self")
+    scale.NameIndex("k")
+    scale.NumParams = 2
+    scale.WriteConst(NewString("x"), 3, false, 0)
+    scale.WriteGet(1, 3, 4, false, 0)
+    scale.WriteAluIns(MUL, 4, 2, 5, false, 0)
+    scale.WriteRet(5, false, 0)
+    
+    // def call(o, k): return o.scale(k)
+    call := mod.NewCode("call")
+    call.NameIndex("o")
+    call.NameIndex("k")
+    call.NumParams = 2
+    call.WriteConst(NewString("scale"), 3, false, 0)
+    call.WriteGet(1, 3, 4, false, 0)
+    call.WriteMove(2, 5, false, 0)
+    call.WriteCallFunction(4, 1, 0, 6, false, 0)
+    call.WriteRet(6, false, 0)
+    
+    fn := NewFunction(scale, nil, mod.Globals)
+    ns := NewDict()
+    ns.Set(NewString("scale"), fn)
+    a, _ := NewType("A", nil, ns)
+    o := NewInstance(a)
+    o.SetAttr("x", intObject(3))
+    
+    m := new (Machine)
+    if result, err := m.CallObject(NewFunction(call, nil, mod.Globals), []Object{o, intObject(2)}); err != nil || result.AsString() != "6" {
+        t.Errorf("o.scale(2) should be 6, got %v (%v)", result, err)
+    }
+    
+    method, err := m.getAttr(o, "scale")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if method.Repr() != "<bound method scale of <A object>>" {
+        t.Errorf("unexpected bound method %v", method.Repr())
+    }
+    if result, err := m.CallObjectKeywords(method, nil, []string{"k"}, []Object{intObject(4)}); err != nil || result.AsString() != "12" {
+        t.Errorf("o.scale(k=4) should be 12, got %v (%v)", result, err)
+    }
+    if result, err := fn.Call(m, []Object{o, intObject(5)}, nil, nil); err != nil || result.AsString() != "15" {
+        t.Errorf("calling the function from Go should give 15, got %v (%v)", result, err)
+    }
+    
+    // Each lookup makes a new bound method, but they are equal.
+    other, _ := m.getAttr(o, "scale")
+    h1, _ := method.Hash()
+    h2, _ := other.Hash()
+    if method == other || !method.Eq(other).IsTrue() || h1 != h2 {
+        t.Errorf("the bound methods should be distinct, equal and have the same hash")
+    }
+    if unbound, _ := m.getAttr(a, "scale"); unbound != Object(fn) {
+        t.Errorf("a function got from the class should be the function, got %v", unbound)
+    }
+    o.SetAttr("f", fn)
+    if f, _ := m.getAttr(o, "f"); f != Object(fn) {
+        t.Errorf("a function got from the instance itself shouldn't be bound, got %v", f)
+    }
+}
+
+func TestIterationBuiltins(t *testing.T) {
+    interp := NewInterpreter()
+    items := NewList([]Object{intObject(3), intObject(1), intObject(2)})
+    r, _ := NewRange(10, 0, -3)
+    strs := NewTuple([]Object{NewString("b"), NewString("c"), NewString("a")})
+    
+    calls := []struct {
+        fn      string
+        args    []Object
+        result  string
+    }{
+        {"sum", []Object{items}, "6"},
+        {"sum", []Object{items, floatObject(0.5)}, "6.5"},
+        {"sum", []Object{r}, "22"},
+        {"sum", []Object{newCountdown(4)}, "10"},
+        {"sum", []Object{NewList(nil)}, "0"},
+        {"sum", []Object{strs, NewString("")}, "TypeError"},
+        {"sum", []Object{intObject(1)}, "TypeError"},
+        {"min", []Object{items}, "1"},
+        {"max", []Object{items}, "3"},
+        {"min", []Object{strs}, "a"},
+        {"max", []Object{intObject(2), floatObject(2.5), intObject(1)}, "2.5"},
+        {"min", []Object{newCountdown(3)}, "1"},
+        {"max", []Object{NewTuple(nil)}, "ValueError"},
+        {"max", []Object{NewTuple([]Object{intObject(1), NewString("a")})}, "TypeError"},
+        {"min", nil, "TypeError"},
+        {"next", []Object{newCountdown(0), None}, "None"},
+        {"next", []Object{newCountdown(0)}, "StopIteration"},
+        {"next", []Object{items}, "TypeError"},
+        {"iter", []Object{intObject(1)}, "TypeError"},
+    }
+    for i, test := range calls {
+        result, err := new (Machine).CallObject(interp.Builtins[test.fn], test.args)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("call %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("call %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+    
+    m := new (Machine)
+    it, err := m.CallObject(interp.Builtins["iter"], []Object{items})
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    for _, expected := range []string{"3", "1"} {
+        if item, err := m.CallObject(interp.Builtins["next"], []Object{it}); err != nil || item.AsString() != expected {
+            t.Errorf("expected the next item to be %v, got %v (%v)", expected, item, err)
+        }
+    }
+}
+
+func TestBuiltins(t *testing.T) {
+    var out bytes.Buffer
+    interp := NewInterpreter()
+    interp.Stdout = &out
+    
+    // A class with __len__ and __repr__, and one whose methods return the wrong types.
+    ns := NewDict()
+    ns.Set(NewString("__len__"), NewBuiltinFunction("__len__", func(m *Machine, args []Object) (Object, os.Error) {
+        return intObject(4), nil
+    }))
+    ns.Set(NewString("__repr__"), NewBuiltinFunction("__repr__", func(m *Machine, args []Object) (Object, os.Error) {
+        return NewString("Box()"), nil
+    }))
+    box, _ := NewType("Box", nil, ns)
+    ns = NewDict()
+    ns.Set(NewString("__len__"), NewBuiltinFunction("__len__", func(m *Machine, args []Object) (Object, os.Error) {
+        return intObject(-1), nil
+    }))
+    ns.Set(NewString("__str__"), NewBuiltinFunction("__str__", func(m *Machine, args []Object) (Object, os.Error) {
+        return intObject(1), nil
+    }))
+    bad, _ := NewType("Bad", nil, ns)
+    plain, _ := NewType("Plain", nil, nil)
+    
+    calls := []struct {
+        fn      string
+        args    []Object
+        result  string
+    }{
+        {"len", []Object{NewString("héllo")}, "5"},
+        {"len", []Object{NewDict()}, "0"},
+        {"len", []Object{NewInstance(box)}, "4"},
+        {"len", []Object{NewInstance(bad)}, "ValueError"},
+        {"len", []Object{NewInstance(plain)}, "TypeError"},
+        {"len", []Object{intObject(1)}, "TypeError"},
+        {"repr", []Object{NewString("a")}, "'a'"},
+        {"repr", []Object{NewInstance(box)}, "Box()"},
+        {"repr", []Object{NewInstance(plain)}, "<Plain object>"},
+        {"type", []Object{intObject(1)}, "<class 'int'>"},
+        {"type", []Object{NewInstance(box)}, "<class 'Box'>"},
+        {"type", []Object{box}, "<class 'type'>"},
+        {"type", []Object{NewString("C"), NewTuple([]Object{box}), NewDict()}, "<class 'C'>"},
+        {"type", []Object{intObject(1), intObject(2)}, "TypeError"},
+        {"int", nil, "TypeError"},
+        {"isinstance", []Object{intObject(1), interp.Builtins["int"]}, "1"},
+        {"isinstance", []Object{floatObject(1), NewTuple([]Object{interp.Builtins["int"], interp.Builtins["str"]})}, "0"},
+        {"isinstance", []Object{box, interp.Builtins["type"]}, "1"},
+        {"print", []Object{NewInstance(bad)}, "TypeError"},
+    }
+    for i, test := range calls {
+        result, err := interp.NewMachine().CallObject(interp.Builtins[test.fn], test.args)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("call %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.AsString() != test.result:
+                t.Errorf("call %v: expected %v, got %v", i, test.result, result.AsString())
+        }
+    }
+    if _, err := NewType("D", []Object{interp.Builtins["list"]}, nil); err == nil {
+        t.Errorf("a class shouldn't derive from list yet")
+    }
+    
+    // print() writes the str() of its arguments, which is the repr() of an instance
+    // without __str__.
+    out.Reset()
+    m := interp.NewMachine()
+    args := []Object{NewString("a"), intObject(1), NewInstance(box)}
+    if _, err := m.CallObjectKeywords(interp.Builtins["print"], args, []string{"sep", "end"}, []Object{NewString("-"), None}); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if _, err := m.CallObject(interp.Builtins["print"], nil); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if out.String() != "a-1-Box()\n\n" {
+        t.Errorf("expected print to write \"a-1-Box()\\n\\n\", got %q", out.String())
+    }
+    if _, err := m.CallObjectKeywords(interp.Builtins["print"], nil, []string{"color"}, []Object{None}); err == nil {
+        t.Errorf("print shouldn't take the keyword argument color")
+    }
+}
+
+func TestGoFunc(t *testing.T) {
+    add := NewGoFunc("add", func(a, b int) int { return a + b })
+    small := NewGoFunc("small", func(a int8) int8 { return a })
+    sum := NewGoFunc("sum", func(xs ...float64) float64 {
+        total := 0.0
+        for _, x := range xs {
+            total += x
+        }
+        return total
+    })
+    join := NewGoFunc("join", strings.Join)
+    keys := NewGoFunc("keys", func(m map[string]int) int { return len(m) })
+    pair := NewGoFunc("pair", func() (int, string) { return 1, "a" })
+    check := NewGoFunc("check", func(n uint) (uint, os.Error) {
+        switch n {
+            case 0:
+                return 0, os.NewError("zero")
+            case 1:
+                return 0, Raise(ValueErrorClass, "one")
+        }
+        return n, nil
+    })
+    same := NewGoFunc("same", func(o Object) Object { return o })
+    kind := NewGoFunc("kind", func(v interface{}) string { return fmt.Sprintf("%T", v) })
+    counts := NewGoFunc("counts", func() map[string][]int { return map[string][]int{"a": {1, 2}} })
+    
+    d := NewDict()
+    d.Set(NewString("a"), intObject(1))
+    words := NewList([]Object{NewString("a"), NewString("b")})
+    o := NewList(nil)
+    
+    calls := []struct {
+        fn      Object
+        args    []Object
+        result  string
+    }{
+        {add, []Object{intObject(2), intObject(3)}, "5"},
+        {add, []Object{intObject(2)}, "TypeError"},
+        {add, []Object{NewString("a"), intObject(3)}, "TypeError"},
+        {small, []Object{intObject(127)}, "127"},
+        {small, []Object{intObject(128)}, "OverflowError"},
+        {sum, nil, "0.0"},
+        {sum, []Object{intObject(1), floatObject(0.5)}, "1.5"},
+        {join, []Object{words, NewString("-")}, "'a-b'"},
+        {join, []Object{NewTuple(words.Items), NewString("")}, "'ab'"},
+        {join, []Object{NewString("xyz"), NewString(",")}, "'x,y,z'"},
+        {join, []Object{NewList([]Object{intObject(1)}), NewString("")}, "TypeError"},
+        {keys, []Object{d}, "1"},
+        {keys, []Object{words}, "TypeError"},
+        {pair, nil, "(1, 'a')"},
+        {check, []Object{intObject(2)}, "2"},
+        {check, []Object{intObject(0)}, "RuntimeError: zero"},
+        {check, []Object{intObject(1)}, "ValueError: one"},
+        {check, []Object{intObject(-1)}, "OverflowError"},
+        {same, []Object{o}, "[]"},
+        {kind, []Object{intObject(1)}, "'int64'"},
+        {kind, []Object{words}, "'[]interface {}'"},
+        {kind, []Object{None}, "'<nil>'"},
+        {kind, []Object{NewInstance(ObjectClass)}, "'*python.InstanceObject'"},
+        {counts, nil, "{'a': [1, 2]}"},
+    }
+    for i, test := range calls {
+        result, err := new (Machine).CallObject(test.fn, test.args)
+        switch {
+            case err != nil && !strings.HasPrefix(err.String(), test.result):
+                t.Errorf("call %v: expected %v, got the error %v", i, test.result, err)
+            case err == nil && result.Repr() != test.result:
+                t.Errorf("call %v: expected %v, got %v", i, test.result, result.Repr())
+        }
+    }
+    
+    if result, _ := new (Machine).CallObject(same, []Object{o}); result != Object(o) {
+        t.Errorf("an object should be passed to an Object parameter as itself")
+    }
+    if _, err := new (Machine).CallObjectKeywords(add, nil, []string{"a"}, []Object{intObject(1)}); err == nil {
+        t.Errorf("Go functions shouldn't take keyword arguments")
+    }
+}
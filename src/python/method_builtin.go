@@ -0,0 +1,188 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the bound method object type,
+   which is a function together with the object it was got from.  Calling it
+   calls the function with the object before the other arguments.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+type BoundMethodObject struct {
+    ObjectData
+    Fn, Self Object
+}
+
+func NewBoundMethod(fn, self Object) (*BoundMethodObject) {
+    b := new(BoundMethodObject)
+    b.ObjectData.Init()
+    b.Fn, b.Self = fn, self
+    
+    return b
+}
+
+// Calls the function with the object and the arguments.  The machine doesn't come
+// here, but calls the function in place of the method.
+func (o *BoundMethodObject) Call(m *Machine, args []Object, kwnames []string, kwargs []Object) (Object, os.Error) {
+    return m.callNestedKeywords(o.Fn, append([]Object{o.Self}, args...), kwnames, kwargs)
+}
+
+func (o *BoundMethodObject) GetAttr(name string) (value Object, present bool) {
+    switch name {
+        case "__func__":
+            return o.Fn, true
+        case "__self__":
+            return o.Self, true
+    }
+    return o.ObjectData.GetAttr(name)
+}
+
+// Returns the name of the function fn.
+func functionName(fn Object) (string) {
+    switch f := fn.(type) {
+        case *FunctionObject:
+            return f.Code.Name
+        case *BuiltinFunctionObject:
+            return f.Name
+        case *GoFuncObject:
+            return f.Name
+    }
+    return fn.Repr()
+}
+
+// A bound method can't be converted to a number
+func (o *BoundMethodObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *BoundMethodObject) AsFloat() (float64) {
+    return 0
+}
+
+func (o *BoundMethodObject) AsString() (string) {
+    return fmt.Sprintf("<bound method %v of %v>", functionName(o.Fn), o.Self.Repr())
+}
+
+///////// Rich Comparison Interface ///////////
+
+// Bound methods are equal if they bind equal functions to the same object.  They
+// are not ordered.
+func (o *BoundMethodObject) Eq(r Object) (Object) {
+    b, ok := r.(*BoundMethodObject)
+    return pyBool(ok && b.Self == o.Self && equal(b.Fn, o.Fn))
+}
+
+func (o *BoundMethodObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *BoundMethodObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *BoundMethodObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *BoundMethodObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *BoundMethodObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *BoundMethodObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BoundMethodObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BoundMethodObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BoundMethodObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BoundMethodObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BoundMethodObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BoundMethodObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *BoundMethodObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BoundMethodObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BoundMethodObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *BoundMethodObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+// Equal bound methods have the same hash, which comes from the function and the
+// identity of the object.
+func (o *BoundMethodObject) Hash() (uint64, os.Error) {
+    h, err := o.Fn.Hash()
+    if err != nil {
+        return 0, err
+    }
+    if d, ok := o.Self.(interface { objectData() (*ObjectData) }); ok {
+        id, _ := d.objectData().Hash()
+        h ^= id * 1000003
+    }
+    return h, nil
+}
+
+func (o *BoundMethodObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *BoundMethodObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *BoundMethodObject) AsBool() (bool) {
+    return o.IsTrue()
+}
@@ -20,16 +20,129 @@
 
 package python
 
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
 type ModuleObject struct {
     ObjectData
     Path string // The path of the file that the module was created from     
 }
 
-func NewModule(name string, path string) {
+func NewModule(name string, path string) (*ModuleObject) {
     module := new(ModuleObject)
     module.ObjectData.Init()
+    module.Path = path
+    
+    module.SetAttr("__file__", NewString(path))
+    module.SetAttr("__name__", NewString(name))
     
-    module.Attrs["__file__"] = NewString(path)
-    module.Attrs["__name__"] = NewString(name)
+    return module
+}
+
+// A module can't be converted to a number
+func (o *ModuleObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *ModuleObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert module to string
+func (o *ModuleObject) AsString() (string) {
+    return fmt.Sprintf("<module %v from %v>", o.Attrs["__name__"].Repr(), NewString(o.Path).Repr())
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A module is only equal to itself, and modules are not ordered.
+func (o *ModuleObject) Eq(r Object) (Object) {
+    t, ok := r.(*ModuleObject)
+    return pyBool(ok && t == o)
+}
+
+func (o *ModuleObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *ModuleObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ModuleObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ModuleObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ModuleObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *ModuleObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ModuleObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
 }
 
+func (o *ModuleObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ModuleObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ModuleObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ModuleObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ModuleObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *ModuleObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ModuleObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ModuleObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A module is always true
+func (o *ModuleObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *ModuleObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *ModuleObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *ModuleObject) AsBool() (bool) {
+    return o.IsTrue()
+}
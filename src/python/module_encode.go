@@ -0,0 +1,449 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the on-disk format of a compiled module, the .gpyc
+   file, so that a module only has to be compiled again when its source has
+   changed.  It uses the same little endian encoding as the SSA cache, and
+   starts with a magic number and a version, followed by a stamp of the source
+   the module was compiled from.  The strings the code objects use as names
+   are written once, in a table that the code objects refer to by index, and
+   so are their constants, in the pool of the module.  The constants are
+   tagged with their type, and a function constant refers to its code by its
+   index in the module.  The globals are not saved, since they are only filled in when
+   the module runs.
+*/
+
+package python
+
+import (
+        "big"
+        "hash/crc32"
+        "io"
+        "io/ioutil"
+        "math"
+        "os"
+        "path/filepath"
+)
+
+const (
+    gpycMagic       = 0x43595047 // "GPYC"
+    gpycVersion     = 6
+)
+
+// The tags of the constants.
+const (
+    gpycInt = iota
+    gpycFloat
+    gpycString
+    gpycTuple
+    gpycFunction
+    gpycNone
+    gpycBool
+    gpycBuiltin
+)
+
+// The builtin functions that translated code has among its constants, which are saved
+// by name.
+var savedBuiltins = map[string]*BuiltinFunctionObject{
+    "slice":    sliceBuiltin,
+    "pow":      powBuiltin,
+}
+
+// Identifies the source a module was compiled from.  A cached module is only used if
+// the stamp of its source still matches.
+type SourceStamp struct {
+    Mtime   int64
+    Size    int64
+    Hash    uint32
+}
+
+// Returns the stamp of the source src, last modified at mtime.
+func StampSource(src []byte, mtime int64) (SourceStamp) {
+    return SourceStamp{Mtime: mtime, Size: int64(len(src)), Hash: crc32.ChecksumIEEE(src)}
+}
+
+// Returns the path of the compiled file cached for the source file at path.
+func CachePath(path string) (string) {
+    if len(path) > 3 && path[len(path)-3:] == ".py" {
+        path = path[0:len(path)-3]
+    }
+    return path + ".gpyc"
+}
+
+func (mod *ModuleCode) codeIndex(c *CodeObject) (int) {
+    for i, code := range mod.Code {
+        if code == c {
+            return i
+        }
+    }
+    return -1
+}
+
+func (mod *ModuleCode) putConstant(e *ssaEncoder, o Object) {
+    switch c := o.(type) {
+        case *IntObject:
+            if c.IsBool() {
+                e.putInt(gpycBool)
+                e.putInt(int(c.Small))
+                break
+            }
+            e.putInt(gpycInt)
+            e.putString(c.String())
+        
+        case *FloatObject:
+            e.putInt(gpycFloat)
+            e.putInt(int(math.Float64bits(c.Value)))
+        
+        case *StringObject:
+            e.putInt(gpycString)
+            e.putString(c.Value)
+        
+        case *TupleObject:
+            e.putInt(gpycTuple)
+            e.putInt(len(c.Items))
+            for _, item := range c.Items {
+                mod.putConstant(e, item)
+            }
+        
+        case *NoneObject:
+            e.putInt(gpycNone)
+        
+        case *FunctionObject:
+            index := mod.codeIndex(c.Code)
+            if index < 0 || len(c.Closure) > 0 {
+                if e.err == nil {
+                    e.err = os.NewError("gpyc: function constant not from the module")
+                }
+                return
+            }
+            e.putInt(gpycFunction)
+            e.putInt(index)
+            e.putInt(len(c.Defaults))
+            for _, d := range c.Defaults {
+                mod.putConstant(e, d)
+            }
+        
+        case *BuiltinFunctionObject:
+            if savedBuiltins[c.Name] != c {
+                if e.err == nil {
+                    e.err = os.NewError("gpyc: builtin function constant can't be saved")
+                }
+                return
+            }
+            e.putInt(gpycBuiltin)
+            e.putString(c.Name)
+        
+        default:
+            if e.err == nil {
+                e.err = os.NewError("gpyc: constant can't be saved")
+            }
+    }
+}
+
+func putStrings(e *ssaEncoder, l []string) {
+    e.putInt(len(l))
+    for _, s := range l {
+        e.putString(s)
+    }
+}
+
+// Writes the strings in l as their indices in the pool.
+func putStringIndices(e *ssaEncoder, p *constantPool, l []string) {
+    indices := make([]int, len(l))
+    for i, s := range l {
+        indices[i] = p.stringIndex(s)
+    }
+    e.putInts(indices)
+}
+
+func putBool(e *ssaEncoder, b bool) {
+    if b {
+        e.putInt(1)
+    } else {
+        e.putInt(0)
+    }
+}
+
+// Writes the module, compiled from the source with the stamp, to w.
+func (mod *ModuleCode) Save(w io.Writer, stamp SourceStamp) (os.Error) {
+    e := &ssaEncoder{w: w}
+    
+    e.putInt(gpycMagic)
+    e.putInt(gpycVersion)
+    e.putInt(int(stamp.Mtime))
+    e.putInt(int(stamp.Size))
+    e.putInt(int(stamp.Hash))
+    
+    // The strings are pooled first, so the table can be written before the code.
+    p := newConstantPool()
+    for _, c := range mod.Code {
+        for _, l := range [][]string{[]string{c.Name, c.Filename}, c.Names, c.CellVars, c.FreeVars} {
+            for _, s := range l {
+                p.stringIndex(s)
+            }
+        }
+    }
+    
+    e.putString(mod.Name)
+    putStrings(e, p.Strings)
+    e.putInt(len(mod.Code))
+    for _, c := range mod.Code {
+        putStringIndices(e, p, []string{c.Name, c.Filename})
+        e.putInt(c.FirstLine)
+        e.putString(string(c.LineTable))
+        
+        putStringIndices(e, p, c.Names)
+        putStringIndices(e, p, c.CellVars)
+        putStringIndices(e, p, c.FreeVars)
+        
+        e.putInts([]int{c.NumRegisters, c.NumSpillSlots, c.NumParams})
+        putBool(e, c.VarArgs)
+        putBool(e, c.VarKeywords)
+        putBool(e, c.Generator)
+        putBool(e, c.Coroutine)
+        e.putString(string(c.Bytes()))
+    }
+    
+    // The constants come last, since a function can refer to any code object.
+    tables := make([][]int, len(mod.Code))
+    for i, c := range mod.Code {
+        for _, o := range c.Constants {
+            tables[i] = append(tables[i], p.objectIndex(o))
+        }
+    }
+    e.putInt(len(p.Objects))
+    for _, o := range p.Objects {
+        mod.putConstant(e, o)
+    }
+    for _, table := range tables {
+        e.putInts(table)
+    }
+    
+    return e.err
+}
+
+func (mod *ModuleCode) getConstant(d *ssaDecoder, depth int) (Object) {
+    if depth > 64 && d.err == nil {
+        d.err = os.NewError("gpyc: constants nested too deeply")
+    }
+    
+    tag := d.getInt()
+    if d.err != nil {
+        return nil
+    }
+    
+    switch tag {
+        case gpycInt:
+            v, ok := new (big.Int).SetString(d.getString(), 10)
+            if !ok {
+                if d.err == nil {
+                    d.err = os.NewError("gpyc: bad integer constant")
+                }
+                return NewIntObject()
+            }
+            return NewBigInt(v)
+        
+        case gpycFloat:
+            return NewFloat(math.Float64frombits(uint64(d.getInt())))
+        
+        case gpycString:
+            return NewString(d.getString())
+        
+        case gpycTuple:
+            items := make([]Object, d.getLength())
+            for i := range items {
+                items[i] = mod.getConstant(d, depth+1)
+            }
+            return NewTuple(items)
+        
+        case gpycFunction:
+            index := d.getInt()
+            d.check(index, len(mod.Code))
+            defaults := make([]Object, d.getLength())
+            for i := range defaults {
+                defaults[i] = mod.getConstant(d, depth+1)
+            }
+            if d.err != nil {
+                return nil
+            }
+            return NewFunction(mod.Code[index], defaults, mod.Globals)
+        
+        case gpycNone:
+            return None
+        
+        case gpycBool:
+            return pyBool(d.getInt() != 0)
+        
+        case gpycBuiltin:
+            if fn, present := savedBuiltins[d.getString()]; present {
+                return fn
+            }
+    }
+    
+    d.err = os.NewError("gpyc: bad constant")
+    return nil
+}
+
+func getStrings(d *ssaDecoder) ([]string) {
+    var l []string
+    for n := d.getLength(); n > 0 && d.err == nil; n-- {
+        l = append(l, d.getString())
+    }
+    return l
+}
+
+// Reads strings written by putStringIndices, as indices in the table strings.
+func getStringIndices(d *ssaDecoder, strings []string) ([]string) {
+    var l []string
+    for _, i := range d.getInts() {
+        if d.check(i, len(strings)); d.err != nil {
+            return nil
+        }
+        l = append(l, strings[i])
+    }
+    return l
+}
+
+// Reads a module written by Save from r into mod, replacing its contents, and returns
+// the stamp of the source it was compiled from.
+func (mod *ModuleCode) Load(r io.Reader) (SourceStamp, os.Error) {
+    d := &ssaDecoder{r: r}
+    var stamp SourceStamp
+    
+    if d.getInt() != gpycMagic && d.err == nil {
+        return stamp, os.NewError("gpyc: not a compiled module")
+    }
+    if d.getInt() != gpycVersion && d.err == nil {
+        return stamp, os.NewError("gpyc: unknown version")
+    }
+    stamp.Mtime = int64(d.getInt())
+    stamp.Size = int64(d.getInt())
+    stamp.Hash = uint32(d.getInt())
+    
+    mod.Init(d.getString())
+    mod.Code = nil
+    strings := getStrings(d)
+    for i, s := range strings {
+        strings[i] = mod.InternString(s)
+    }
+    
+    for n := d.getLength(); n > 0 && d.err == nil; n-- {
+        names := getStringIndices(d, strings)
+        if len(names) != 2 && d.err == nil {
+            d.err = os.NewError("gpyc: bad code object")
+        }
+        if d.err != nil {
+            break
+        }
+        c := mod.NewCode(names[0])
+        c.Filename = names[1]
+        c.FirstLine = d.getInt()
+        c.LineTable = []byte(d.getString())
+        
+        for _, name := range getStringIndices(d, strings) {
+            c.NameIndex(name)
+        }
+        c.CellVars = getStringIndices(d, strings)
+        c.FreeVars = getStringIndices(d, strings)
+        
+        counts := d.getInts()
+        if len(counts) != 3 && d.err == nil {
+            d.err = os.NewError("gpyc: bad code object")
+        }
+        if d.err != nil {
+            break
+        }
+        c.NumRegisters, c.NumSpillSlots, c.NumParams = counts[0], counts[1], counts[2]
+        c.VarArgs = d.getInt() != 0
+        c.VarKeywords = d.getInt() != 0
+        c.Generator = d.getInt() != 0
+        c.Coroutine = d.getInt() != 0
+        
+        code := d.getString()
+        if len(code) % 4 != 0 && d.err == nil {
+            d.err = os.NewError("gpyc: bad instructions")
+        }
+        c.WriteString(code)
+    }
+    
+    // The tables are read as they were written, since a code object may have the same
+    // constant more than once.
+    var objects []Object
+    for n := d.getLength(); n > 0 && d.err == nil; n-- {
+        objects = append(objects, mod.InternConstant(mod.getConstant(d, 0)))
+    }
+    for _, c := range mod.Code {
+        for _, i := range d.getInts() {
+            if d.check(i, len(objects)); d.err != nil {
+                break
+            }
+            c.Constants = append(c.Constants, objects[i])
+        }
+    }
+    
+    if d.err == nil && len(mod.Code) == 0 {
+        d.err = os.NewError("gpyc: module has no code")
+    }
+    return stamp, d.err
+}
+
+// Writes the module, compiled from the source with the stamp, to the file at path.  The
+// module is written to a temporary file, which then replaces the file at path, so a
+// reader never sees half of a module, and when several write the same module at once,
+// one of them wins.
+func (mod *ModuleCode) SaveCached(path string, stamp SourceStamp) (os.Error) {
+    dir, file := filepath.Split(path)
+    if dir == "" {
+        dir = "."
+    }
+    f, err := ioutil.TempFile(dir, file)
+    if err != nil {
+        return err
+    }
+    
+    err = mod.Save(f, stamp)
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(f.Name(), path)
+    }
+    if err != nil {
+        os.Remove(f.Name())
+    }
+    return err
+}
+
+// Reads the module cached in the file at path, if it was compiled from the source
+// with the stamp.  It fails if the file is missing, damaged or stale, and the module
+// has to be compiled again.
+func LoadCached(path string, stamp SourceStamp) (*ModuleCode, os.Error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    
+    mod := new (ModuleCode)
+    saved, err := mod.Load(f)
+    if err != nil {
+        return nil, err
+    }
+    if saved != stamp {
+        return nil, os.NewError("gpyc: source has changed")
+    }
+    return mod, nil
+}
@@ -0,0 +1,176 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the compiled module format.
+
+*/
+
+package python
+
+import (
+        "big"
+        "bytes"
+        "os"
+        "path"
+        "testing"
+)
+
+// Builds a module whose body calls f(1, 2.5), with a few other kinds of constant.
+func newSavedModule() (*ModuleCode) {
+    mod := new (ModuleCode)
+    mod.Init("saved")
+    body := mod.NewCode("<module>")
+    body.Filename = "saved.py"
+    fn := newTestFunction(mod)
+    
+    v, _ := new (big.Int).SetString("123456789012345678901234567890", 10)
+    huge := NewBigInt(v)
+    half := new (FloatObject)
+    half.Value = 2.5
+    
+    body.SetLine(1)
+    body.WriteConst(NewTuple([]Object{huge, NewString("hello"), True}), 4, false, 0)
+    body.WriteBind("t", 4, false, 0)
+    body.SetLine(2)
+    body.WriteConst(fn, 1, false, 0)
+    body.WriteConst(intObject(1), 2, false, 0)
+    body.WriteConst(half, 3, false, 0)
+    body.WriteCallFunction(1, 2, 0, 15, false, 0)
+    body.WriteHalt(15, false, 0)
+    
+    return mod
+}
+
+func TestSaveLoad(t *testing.T) {
+    original := newSavedModule()
+    stamp := StampSource([]byte("t = (123456789012345678901234567890, 'hello', True)\nf(1, 2.5)\n"), 1234)
+    
+    buf := new (bytes.Buffer)
+    if err := original.Save(buf, stamp); err != nil {
+        t.Fatalf("save failed: %v", err)
+    }
+    data := buf.Bytes()
+    
+    mod := new (ModuleCode)
+    saved, err := mod.Load(bytes.NewBuffer(data))
+    if err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+    if saved != stamp {
+        t.Errorf("expected the stamp %v, got %v", stamp, saved)
+    }
+    if mod.Name != "saved" || len(mod.Code) != len(original.Code) {
+        t.Fatalf("expected %v code objects, got %v", len(original.Code), len(mod.Code))
+    }
+    
+    for i, c := range mod.Code {
+        o := original.Code[i]
+        want, got := new (bytes.Buffer), new (bytes.Buffer)
+        Disassemble(o, want)
+        Disassemble(c, got)
+        if got.String() != want.String() {
+            t.Errorf("code %v changed:\n%v\nwanted:\n%v", i, got, want)
+        }
+        if c.NumParams != o.NumParams || c.VarArgs != o.VarArgs || c.VarKeywords != o.VarKeywords || c.Line(3) != o.Line(3) {
+            t.Errorf("code %v lost its metadata", i)
+        }
+        if len(c.Constants) != len(o.Constants) {
+            t.Errorf("code %v has %v constants, wanted %v", i, len(c.Constants), len(o.Constants))
+        }
+    }
+    
+    fn, ok := mod.Code[0].Constants[1].(*FunctionObject)
+    if !ok || fn.Code != mod.Code[1] || len(fn.Defaults) != 1 {
+        t.Fatalf("the function constant should refer to the loaded code, got %v", mod.Code[0].Constants[1])
+    }
+    tuple := mod.Code[0].Constants[0].(*TupleObject)
+    if tuple.AsString() != original.Code[0].Constants[0].AsString() || tuple.Items[2] != Object(True) {
+        t.Errorf("expected the tuple %v, got %v", original.Code[0].Constants[0].AsString(), tuple.AsString())
+    }
+    
+    // The constants and the names are pooled by the loaded module.
+    if mod.InternConstant(intObject(1)) != mod.Code[0].Constants[2] || mod.InternString("a") != mod.Code[1].Names[0] {
+        t.Errorf("the loaded constants should be pooled")
+    }
+    
+    m := new (Machine)
+    result, err := m.RunModule(mod)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if result.AsFloat() != 3.5 {
+        t.Errorf("expected 3.5, got %v", result.AsString())
+    }
+    
+    // Every truncation of the file must be an error, not a panic.
+    for n := 0; n < len(data); n += 5 {
+        if _, err := new (ModuleCode).Load(bytes.NewBuffer(data[0:n])); err == nil {
+            t.Errorf("loading %v of %v bytes succeeded", n, len(data))
+        }
+    }
+    
+    // A closure is made at run time, so it can't be a constant.
+    fn = NewFunction(original.Code[1], nil, original.Globals)
+    fn.Closure = []*Cell{new (Cell)}
+    original.Code[0].Constant(fn)
+    if err := original.Save(new (bytes.Buffer), stamp); err == nil {
+        t.Errorf("saving a closure constant should fail")
+    }
+    
+    // The builtins that translated code calls are saved by name.
+    builtins := newSavedModule()
+    builtins.Code[0].Constant(powBuiltin)
+    buf = new (bytes.Buffer)
+    if err := builtins.Save(buf, stamp); err != nil {
+        t.Fatalf("save failed: %v", err)
+    }
+    mod = new (ModuleCode)
+    if _, err := mod.Load(buf); err != nil {
+        t.Fatalf("load failed: %v", err)
+    }
+    if constants := mod.Code[0].Constants; constants[len(constants)-1] != Object(powBuiltin) {
+        t.Errorf("expected pow() to be loaded, got %v", constants[len(constants)-1])
+    }
+    builtins.Code[0].Constant(NewBuiltinFunction("pow", nil))
+    if err := builtins.Save(new (bytes.Buffer), stamp); err == nil {
+        t.Errorf("saving a builtin that isn't known by its name should fail")
+    }
+}
+
+func TestLoadCached(t *testing.T) {
+    file := path.Join(os.TempDir(), "gpyc_test.gpyc")
+    defer os.Remove(file)
+    
+    src := []byte("f(1, 2.5)\n")
+    stamp := StampSource(src, 1234)
+    if err := newSavedModule().SaveCached(file, stamp); err != nil {
+        t.Fatalf("save failed: %v", err)
+    }
+    
+    if mod, err := LoadCached(file, stamp); err != nil || mod.Name != "saved" {
+        t.Errorf("the cached module should be used, got %v", err)
+    }
+    
+    for _, changed := range []SourceStamp{StampSource(src, 1235), StampSource([]byte("f(2, 2.5)\n"), 1234)} {
+        if _, err := LoadCached(file, changed); err == nil {
+            t.Errorf("a stale module should not be used")
+        }
+    }
+    
+    if CachePath("dir/mod.py") != "dir/mod.gpyc" || CachePath("script") != "script.gpyc" {
+        t.Errorf("wrong cache paths %v and %v", CachePath("dir/mod.py"), CachePath("script"))
+    }
+}
@@ -0,0 +1,141 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the None built-in object.
+   There is only one None, so it can be compared by identity.
+*/
+
+package python
+
+import (
+        "big"
+        "os"
+)
+
+type NoneObject struct {
+    ObjectData
+}
+
+// The one None.
+var None = new(NoneObject)
+
+// None is shared by every interpreter, so it has no attributes that can be set.
+func (o *NoneObject) SetAttr(name string, value Object) {
+}
+
+// None can't be converted to a number
+func (o *NoneObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *NoneObject) AsFloat() (float64) {
+    return 0
+}
+
+func (o *NoneObject) AsString() (string) {
+    return "None"
+}
+
+///////// Rich Comparison Interface ///////////
+
+// None is only equal to itself, and it is not ordered.
+func (o *NoneObject) Eq(r Object) (Object) {
+    _, ok := r.(*NoneObject)
+    return pyBool(ok)
+}
+
+func (o *NoneObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *NoneObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *NoneObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *NoneObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *NoneObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *NoneObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NoneObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NoneObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NoneObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NoneObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NoneObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NoneObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *NoneObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NoneObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NoneObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// None is always false
+func (o *NoneObject) IsTrue() (bool) {
+    return false
+}
+
+///////// Protocol Interface ///////////
+
+func (o *NoneObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *NoneObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *NoneObject) AsBool() (bool) {
+    return o.IsTrue()
+}
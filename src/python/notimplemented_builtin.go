@@ -0,0 +1,144 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the NotImplemented built-in
+   object, which the methods of the binary operators return when they
+   don't support their operands, so that the reflected method of the other
+   operand is tried.  There is only one NotImplemented, so it can be
+   compared by identity.
+*/
+
+package python
+
+import (
+        "big"
+        "os"
+)
+
+type NotImplementedObject struct {
+    ObjectData
+}
+
+// The one NotImplemented.
+var NotImplemented = new(NotImplementedObject)
+
+// NotImplemented is shared by every interpreter, so it has no attributes that can be set.
+func (o *NotImplementedObject) SetAttr(name string, value Object) {
+}
+
+// NotImplemented can't be converted to a number
+func (o *NotImplementedObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *NotImplementedObject) AsFloat() (float64) {
+    return 0
+}
+
+func (o *NotImplementedObject) AsString() (string) {
+    return "NotImplemented"
+}
+
+///////// Rich Comparison Interface ///////////
+
+// NotImplemented is only equal to itself, and it is not ordered.
+func (o *NotImplementedObject) Eq(r Object) (Object) {
+    _, ok := r.(*NotImplementedObject)
+    return pyBool(ok)
+}
+
+func (o *NotImplementedObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *NotImplementedObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *NotImplementedObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *NotImplementedObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *NotImplementedObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *NotImplementedObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NotImplementedObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NotImplementedObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NotImplementedObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NotImplementedObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NotImplementedObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NotImplementedObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *NotImplementedObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NotImplementedObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *NotImplementedObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// NotImplemented is always true
+func (o *NotImplementedObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *NotImplementedObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *NotImplementedObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *NotImplementedObject) AsBool() (bool) {
+    return o.IsTrue()
+}
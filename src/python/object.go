@@ -20,10 +20,27 @@
 
 package python
 
-import "big"
+import (
+    "big"
+    "os"
+    "sync/atomic"
+)
 
 type ObjectData struct {    
     Attrs map[string]Object 
+    
+    // Refers to the cleanups registered with Interpreter.Finalize, if there are any.
+    sentinel *sentinel
+    
+    // The identity of the object, which is given out the first time it is hashed.
+    id uint64
+}
+
+// The last identity given to an object.
+var lastObjectId uint64
+
+func (o *ObjectData) objectData() (*ObjectData) {
+    return o
 }
 
 //  Object attribute getting interface.
@@ -36,23 +53,54 @@ type Setter interface {
     SetAttr(name string, value Object)     
 }
 
-// Object rich comparison interface
+// Object rich comparison interface.  The comparisons return True or False, or
+// NotImplemented when they don't support the type of r, so that the reflected
+// comparison of r is tried, as in Python.  If neither supports the other, == and !=
+// compare identity, and the machine raises a TypeError for the others.
 type RichComparer interface {
-    Lt(r Object) (bool)
-    Gt(r Object) (bool)
-    Eq(r Object) (bool)
-    Neq(r Object) (bool)
-    Lte(r Object) (bool)
-    Gte(r Object) (bool)
+    Lt(r Object) (Object)
+    Gt(r Object) (Object)
+    Eq(r Object) (Object)
+    Neq(r Object) (Object)
+    Lte(r Object) (Object)
+    Gte(r Object) (Object)
 }
 
+// Object binary arithmetic interface.  The operations return nil and no error when
+// they don't support the type of r, which the machine raises as a TypeError, and the
+// exception when they raise one, such as a ZeroDivisionError.
 type BinaryArithmetic interface {
-    Add(r Object) (Object)
-    Sub(r Object) (Object)
-    Mul(r Object) (Object)
-    Div(r Object) (Object)
-    FloorDiv(r Object) (Object)
-    Mod(r Object) (Object)
+    Add(r Object) (Object, os.Error)
+    Sub(r Object) (Object, os.Error)
+    Mul(r Object) (Object, os.Error)
+    Div(r Object) (Object, os.Error)
+    FloorDiv(r Object) (Object, os.Error)
+    Mod(r Object) (Object, os.Error)
+    Pow(r Object) (Object, os.Error)
+}
+
+// The arithmetic of augmented assignments, like x += y, for the objects that can be
+// changed in place.  The operations change the object and return it, or return nil and
+// no error when they don't support the type of r, and the machine then does the binary
+// operation instead.
+type InPlaceArithmetic interface {
+    IAdd(r Object) (Object, os.Error)
+    ISub(r Object) (Object, os.Error)
+    IMul(r Object) (Object, os.Error)
+    IDiv(r Object) (Object, os.Error)
+    IFloorDiv(r Object) (Object, os.Error)
+    IMod(r Object) (Object, os.Error)
+    IPow(r Object) (Object, os.Error)
+}
+
+// Object unary arithmetic interface, for -x, +x and ~x, which return nil and no error
+// when the object doesn't support them.  IsTrue gives the truth value of the object,
+// which "not" negates.
+type UnaryArithmetic interface {
+    Neg() (Object, os.Error)
+    Pos() (Object, os.Error)
+    Invert() (Object, os.Error)
+    IsTrue() (bool)
 }
 
 type Converter interface {
@@ -61,18 +109,145 @@ type Converter interface {
     AsString()  (string)    
 }
 
+// Object protocol interface, for hash(), repr(), str() and len(), and the truth value
+// that bool() gives.  Objects that can't be hashed, or that have no length, return a
+// TypeError.  Objects that are equal have the same hash.
+type Protocol interface {
+    Hash()      (uint64, os.Error)
+    Repr()      (string)
+    Str()       (string)
+    Len()       (int, os.Error)
+    AsBool()    (bool)
+}
+
+// Object subscription interface, for a[key] and a[key] = value.  Objects that can't
+// be changed return an error from SetItem.
+type Indexer interface {
+    GetItem(key Object) (Object, os.Error)
+    SetItem(key, value Object) (os.Error)
+}
+
+// Implemented by the objects a for loop can step through.
+type Iterable interface {
+    Iter() (Iterator)
+}
+
+// Object iteration interface.  Next returns the next item, and false once there are
+// no more.
+type Iterator interface {
+    Object
+    Next() (Object, bool)
+}
+
+// Implemented by the objects that can be called.  Call is given the machine that calls
+// the object, and returns the result of the call.
+type Callable interface {
+    Call(m *Machine, args []Object, kwnames []string, kwargs []Object) (Object, os.Error)
+}
+
+// Object descriptor interface, for the objects that decide what they give when they
+// are got as an attribute of a class, or of an instance of it.  instance is nil when
+// the attribute is got from the class owner itself.
+type Descriptor interface {
+    Get(m *Machine, instance Object, owner *TypeObject) (Object, os.Error)
+}
+
+// Implemented by the descriptors that also decide what setting and deleting them as an
+// attribute of an instance does.  They take precedence over the attributes of the
+// instance.
+type DataDescriptor interface {
+    Descriptor
+    Set(m *Machine, instance, value Object) (os.Error)
+    Delete(m *Machine, instance Object) (os.Error)
+}
+
 // Object composite interface
 type Object interface {
     Getter
     Setter
     RichComparer
     BinaryArithmetic
+    UnaryArithmetic
     Converter
+    Protocol
 }
 
+// The built-in types implement the interfaces, which the compiler checks here.
+var (
+    _ Object    = (*IntObject)(nil)
+    _ Object    = (*FloatObject)(nil)
+    _ Object    = (*ComplexObject)(nil)
+    _ Object    = (*StringObject)(nil)
+    _ Object    = (*SliceObject)(nil)
+    _ Object    = (*RangeObject)(nil)
+    _ Object    = (*RangeIteratorObject)(nil)
+    _ Object    = (*NoneObject)(nil)
+    _ Object    = (*TupleObject)(nil)
+    _ Object    = (*ListObject)(nil)
+    _ Object    = (*DictObject)(nil)
+    _ Object    = (*SetObject)(nil)
+    _ Object    = (*IteratorObject)(nil)
+    _ Object    = (*GeneratorObject)(nil)
+    _ Object    = (*FunctionObject)(nil)
+    _ Object    = (*BuiltinFunctionObject)(nil)
+    _ Object    = (*GoFuncObject)(nil)
+    _ Object    = (*CoroutineObject)(nil)
+    _ Object    = (*FutureObject)(nil)
+    _ Object    = (*EventLoopObject)(nil)
+    _ Object    = (*LockObject)(nil)
+    _ Object    = (*ThreadObject)(nil)
+    _ Object    = (*ModuleObject)(nil)
+    _ Object    = (*BaseExceptionObject)(nil)
+    _ Object    = (*TypeObject)(nil)
+    _ Object    = (*InstanceObject)(nil)
+    _ Object    = (*PropertyObject)(nil)
+    _ Object    = (*StaticMethodObject)(nil)
+    _ Object    = (*ClassMethodObject)(nil)
+    _ Object    = (*BoundMethodObject)(nil)
+
+    _ Indexer   = (*StringObject)(nil)
+    _ Indexer   = (*TupleObject)(nil)
+    _ Indexer   = (*ListObject)(nil)
+    _ Indexer   = (*DictObject)(nil)
+    _ Indexer   = (*RangeObject)(nil)
+    _ Iterable  = (*StringObject)(nil)
+    _ Iterable  = (*TupleObject)(nil)
+    _ Iterable  = (*ListObject)(nil)
+    _ Iterable  = (*DictObject)(nil)
+    _ Iterable  = (*SetObject)(nil)
+    _ Iterable  = (*RangeObject)(nil)
+    _ Iterable  = (*RangeIteratorObject)(nil)
+    _ Iterable  = (*IteratorObject)(nil)
+    _ Iterable  = (*GeneratorObject)(nil)
+    _ Iterator  = (*IteratorObject)(nil)
+    _ Iterator  = (*RangeIteratorObject)(nil)
+    _ Iterator  = (*GeneratorObject)(nil)
+    _ Callable  = (*FunctionObject)(nil)
+    _ Callable  = (*BuiltinFunctionObject)(nil)
+    _ Callable  = (*GoFuncObject)(nil)
+    _ Callable  = (*TypeObject)(nil)
+    _ Callable  = (*BoundMethodObject)(nil)
+    
+    _ DataDescriptor    = (*PropertyObject)(nil)
+    _ Descriptor        = (*FunctionObject)(nil)
+    _ Descriptor        = (*StaticMethodObject)(nil)
+    _ Descriptor        = (*ClassMethodObject)(nil)
+    
+    _ InPlaceArithmetic = (*ListObject)(nil)
+    _ InPlaceArithmetic = (*SetObject)(nil)
+)
+
+// Returns the data of a new object.  An object has no attributes to begin with, and
+// the map of them is only made when the first one is set, because most objects never
+// have any.
+func NewObjectData() (ObjectData) {
+    return ObjectData{}
+}
+
+// Sets up the data of a new object, as NewObjectData does.  The constructors of the
+// built-in types call it on the ObjectData they embed.
 func (o *ObjectData) Init() {
-    o.Attrs = make(map[string]Object, 16)
-    return  
+    *o = NewObjectData()
 }
 
 // Get the value of an object's attribute.
@@ -83,81 +258,53 @@ func (o *ObjectData) GetAttr(name string) (value Object, present bool) {
 
 // Set the value of an object's attribute.
 func (o *ObjectData) SetAttr(name string, value Object) {
+    if o.Attrs == nil {
+        o.Attrs = make(map[string]Object)
+    }
     o.Attrs[name] = value
     return  
 }
 
-/*
-// Lookup the less than operator and execute it, if one exists.
-func (o *Object) Lt(l, r *Object) (bool) {
-    if cmp, present := o.GetAttr("__lt__"); present {
-        // Execute the rich comparison operator.
-        return false
+// Delete an object's attribute, and return false if it didn't have it.
+func (o *ObjectData) DelAttr(name string) (present bool) {
+    if _, present = o.Attrs[name]; present {
+        o.Attrs[name] = nil, false
     }
-    
-    // Default to comparing the pointer values.  This
-    // is probably wrong;
-    return false//l  < r
+    return
 }
 
-// Lookup the greater than operator and execute it, if one exists.
-func (o *Object) Gt(l, r *Object) (bool) {
-    if cmp, present := o.GetAttr("__gt__"); present {
-        // Execute the rich comparison operator.
-        return false
+// Objects are hashed by their identity, unless their type says otherwise.
+func (o *ObjectData) Hash() (uint64, os.Error) {
+    if o.id == 0 {
+        o.id = atomic.AddUint64(&lastObjectId, 1)
     }
-    
-    // Default to comparing the pointer values.  This
-    // is probably wrong;
-    return false //l  > r
+    return o.id, nil
 }
 
-// Lookup the equal operator and execute it, if one exists.
-func (o *Object) Eq(l, r *Object) (bool) {
-    if cmp, present := o.GetAttr("__eq__"); present {
-        // Execute the rich comparison operator.
-        return false
-    }
-    
-    // Default to comparing the pointer values.  This
-    // is probably wrong;
-    return false //l  == r
-}
-
-// Lookup the not equal operator and execute it, if one exists.
-func (o *Object) Neq(l, r *Object) (bool) {
-    if cmp, present := o.GetAttr("__neq__"); present {
-        // Execute the rich comparison operator.
-        return false
-    }
-    
-    // Default to comparing the pointer values.  This
-    // is probably wrong;
-    return false //l != r
+// Objects have no length, unless their type says otherwise.
+func (o *ObjectData) Len() (int, os.Error) {
+    return 0, Raise(TypeErrorClass, "object has no len()")
 }
 
-// Lookup the less than or equal operator and execute it, if one exists.
-func (o *Object) Lte(l, r *Object) (bool) {
-    if cmp, present := o.GetAttr("__lte__"); present {
-        // Execute the rich comparison operator.
-        return false
+// Returns the result of the comparison op, given c, which is -1, 0 or 1 like
+// big.Int.Cmp.
+func comparison(op uint32, c int) (Object) {
+    switch op {
+        case EQ: return pyBool(c == 0)
+        case NE: return pyBool(c != 0)
+        case LT: return pyBool(c < 0)
+        case LE: return pyBool(c <= 0)
+        case GT: return pyBool(c > 0)
+        case GE: return pyBool(c >= 0)
     }
-    
-    // Default to comparing the pointer values.  This
-    // is probably wrong;
-    return false //l  <= r
+    return NotImplemented
 }
 
-// Lookup the greater than or equal operator and execute it, if one exists.
-func (o *Object) Gte(l, r *Object) (bool) {
-    if cmp, present := o.GetAttr("__gte__"); present {
-        // Execute the rich comparison operator.
-        return false
+// Returns the opposite of the result of a comparison, which is how != is made from ==.
+// NotImplemented stays NotImplemented.
+func invertComparison(result Object) (Object) {
+    if result == NotImplemented {
+        return result
     }
-    
-    // Default to comparing the pointer values.  This
-    // is probably wrong;
-    return false //l  >= r
+    return pyBool(!result.IsTrue())
 }
-
-*/
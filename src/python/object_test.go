@@ -0,0 +1,565 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the protocol methods the objects share.
+
+*/
+
+package python
+
+import (
+        "big"
+        "math"
+        "os"
+        "strings"
+        "testing"
+)
+
+func floatObject(v float64) (*FloatObject) {
+    return NewFloat(v)
+}
+
+func TestHash(t *testing.T) {
+    // Numbers that are equal have the same hash, whatever their type.
+    equal := [][]Object{
+        {intObject(1), floatObject(1), NewComplex(1)},
+        {intObject(-7), floatObject(-7), NewComplex(-7)},
+        {intObject(0), floatObject(0), floatObject(math.Copysign(0, -1)), NewComplex(0)},
+        {intObject(1 << 62), floatObject(1 << 62)},
+        {NewString("abc"), NewString("abc")},
+        {NewTuple([]Object{intObject(1), NewString("a")}), NewTuple([]Object{floatObject(1), NewString("a")})},
+    }
+    for i, objects := range equal {
+        want, err := objects[0].Hash()
+        if err != nil {
+            t.Fatalf("set %v: unexpected error: %v", i, err)
+        }
+        for _, o := range objects[1:] {
+            if h, err := o.Hash(); err != nil || h != want {
+                t.Errorf("set %v: %v hashed to %v, %v, wanted %v", i, o.Repr(), h, err, want)
+            }
+        }
+    }
+
+    // The hashes Python gives.
+    if h, _ := intObject(-1).Hash(); int64(h) != -2 {
+        t.Errorf("hash(-1) should be -2, got %v", int64(h))
+    }
+    if h, _ := floatObject(0.5).Hash(); h != 1<<60 {
+        t.Errorf("hash(0.5) should be 2**60, got %v", h)
+    }
+
+    unhashable := []Object{NewList(nil), NewDict(), NewSet(), NewTuple([]Object{NewList(nil)})}
+    for i, o := range unhashable {
+        if _, err := o.Hash(); err == nil || !strings.HasPrefix(err.String(), "TypeError") {
+            t.Errorf("object %v: expected a TypeError, got %v", i, err)
+        }
+    }
+
+    // Other objects are hashed by identity.
+    f, g := NewFuture(), NewFuture()
+    hf, _ := f.Hash()
+    hg, _ := g.Hash()
+    if again, _ := f.Hash(); hf == hg || hf != again {
+        t.Errorf("objects should hash by identity, got %v, %v and %v", hf, again, hg)
+    }
+}
+
+func TestStringHash(t *testing.T) {
+    // With PYTHONHASHSEED=0, CPython gives these hashes.
+    interp := NewInterpreter()
+    interp.SetHashSeed(0)
+    tests := []struct {
+        s    string
+        hash uint64
+    }{
+        {"", 0},
+        {"a", 4644417185603328019},
+        {"abc", 13851880170939887858},
+        {"abcdefgh", 4574395652268504554},
+        {"hello world!", 839851713330019024},
+    }
+    for _, test := range tests {
+        if h := hashString(interp.hashKey, test.s); h != test.hash {
+            t.Errorf("hash(%q) should be %v, got %v", test.s, test.hash, h)
+        }
+    }
+
+    // Each interpreter hashes with its own seed, in hash() and in the dicts and sets its
+    // machines build, and the same seed always gives the same hashes.
+    a, b := NewInterpreter(), NewInterpreter()
+    a.SetHashSeed(1)
+    b.SetHashSeed(2)
+    s := new (CodeObject)
+    s.Init()
+    s.WriteConst(NewString("abc"), 1, false, 0)
+    s.WriteConst(intObject(1), 2, false, 0)
+    s.WriteBuild(BUILDDICT, 1, 1, 3, false, 0)
+    s.WriteHalt(3, false, 0)
+    hash := func(interp *Interpreter) (uint64) {
+        h, err := interp.NewMachine().CallObject(interp.Builtins["hash"], []Object{NewString("abc")})
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        d, err := interp.NewMachine().Run(s)
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        if _, present := d.(*DictObject).index[uint64(h.(*IntObject).Small)]; !present {
+            t.Errorf("the dict should hash its key as hash() does")
+        }
+        return uint64(h.(*IntObject).Small)
+    }
+    h1, h2 := hash(a), hash(b)
+    a.SetHashSeed(2)
+    if h1 == h2 || h2 != hash(a) || h1 == tests[2].hash {
+        t.Errorf("the seed of the interpreter should decide the hash, got %v, %v and %v", h1, h2, hash(a))
+    }
+}
+
+func TestDictKeys(t *testing.T) {
+    // Numbers that are equal are the same key.
+    d := NewDict()
+    d.Set(intObject(1), NewString("int"))
+    d.Set(floatObject(1), NewString("float"))
+    d.Set(NewComplex(1), NewString("complex"))
+    d.Set(NewString("1"), NewString("str"))
+    if len(d.Keys) != 2 || d.Keys[0].Repr() != "1" || d.Values[0].Repr() != "'complex'" {
+        t.Errorf("expected {1: 'complex', '1': 'str'}, got %v", d.Repr())
+    }
+
+    // Tuples are found by their items.
+    d.Set(NewTuple([]Object{intObject(1), NewString("a")}), intObject(2))
+    if v, err := d.GetItem(NewTuple([]Object{floatObject(1), NewString("a")})); err != nil || v.Repr() != "2" {
+        t.Errorf("expected 2 for (1.0, 'a'), got %v, %v", v, err)
+    }
+    if _, err := d.GetItem(NewString("b")); err == nil || !strings.HasPrefix(err.String(), "KeyError") {
+        t.Errorf("expected a KeyError, got %v", err)
+    }
+
+    // A key that can't be hashed is a TypeError.
+    if err := d.SetItem(NewList(nil), intObject(0)); err == nil || !strings.HasPrefix(err.String(), "TypeError") {
+        t.Errorf("expected a TypeError setting a list key, got %v", err)
+    }
+    if _, err := d.GetItem(NewList(nil)); err == nil || !strings.HasPrefix(err.String(), "TypeError") {
+        t.Errorf("expected a TypeError getting a list key, got %v", err)
+    }
+
+    s := NewSet()
+    for _, item := range []Object{intObject(2), floatObject(2), NewString("a"), NewString("a"), intObject(3)} {
+        s.Insert(item)
+    }
+    if s.Repr() != "{2, 'a', 3}" {
+        t.Errorf("expected {2, 'a', 3}, got %v", s.Repr())
+    }
+    if err := s.Insert(NewDict()); err == nil || !strings.HasPrefix(err.String(), "TypeError") {
+        t.Errorf("expected a TypeError adding a dict to a set, got %v", err)
+    }
+
+    other := NewSet()
+    other.Insert(floatObject(3))
+    s.ISub(other)
+    if s.Repr() != "{2, 'a'}" || !s.Contains(NewString("a")) || s.Contains(intObject(3)) {
+        t.Errorf("expected {2, 'a'}, got %v", s.Repr())
+    }
+    s.ISub(s)
+    if len(s.Items) != 0 || s.Contains(intObject(2)) {
+        t.Errorf("expected an empty set, got %v", s.Repr())
+    }
+}
+
+func TestAttributes(t *testing.T) {
+    if d := NewObjectData(); d.Attrs != nil {
+        t.Errorf("a new object shouldn't have a map of attributes until one is set")
+    }
+    
+    // Objects made by their constructors, or as zero values, can have attributes set.
+    objects := []Object{NewFloat(1), NewInt(1), new (FloatObject), new (IntObject), NewString("a"),
+        NewComplex(1), NewList(nil), NewModule("m", "m.py")}
+    for i, o := range objects {
+        if _, present := o.GetAttr("x"); present {
+            t.Errorf("object %v: shouldn't have the attribute x yet", i)
+        }
+        o.SetAttr("x", None)
+        if x, present := o.GetAttr("x"); !present || x != None {
+            t.Errorf("object %v: expected the attribute x to be None, got %v", i, x)
+        }
+    }
+}
+
+func TestRepr(t *testing.T) {
+    tests := []struct {
+        o           Object
+        repr, str   string
+    }{
+        {intObject(-3), "-3", "-3"},
+        {floatObject(1), "1.0", "1.0"},
+        {floatObject(math.Copysign(0, -1)), "-0.0", "-0.0"},
+        {floatObject(1e6), "1000000.0", "1000000.0"},
+        {floatObject(1e16), "1e+16", "1e+16"},
+        {floatObject(2.5e-5), "2.5e-05", "2.5e-05"},
+        {NewComplex(1 - 2i), "(1-2j)", "(1-2j)"},
+        {NewComplex(0), "0j", "0j"},
+        {NewComplex(complex(math.Copysign(0, -1), math.Copysign(0, -1))), "(-0-0j)", "(-0-0j)"},
+        {NewComplex(complex(0, math.Copysign(0, -1))), "-0j", "-0j"},
+        {NewComplex(complex(1.5, math.Inf(1))), "(1.5+infj)", "(1.5+infj)"},
+        {NewComplex(1e16i), "1e+16j", "1e+16j"},
+        {NewString("a'b"), `"a'b"`, "a'b"},
+        {NewString("a\n\x01\\"), `'a\n\x01\\'`, "a\n\x01\\"},
+        {NewTuple([]Object{NewString("a")}), "('a',)", "('a',)"},
+        {NewList([]Object{intObject(1), NewString("b")}), "[1, 'b']", "[1, 'b']"},
+        {NewSet(), "set()", "set()"},
+        {None, "None", "None"},
+    }
+    for i, test := range tests {
+        if s := test.o.Repr(); s != test.repr {
+            t.Errorf("test %v: expected the repr %v, got %v", i, test.repr, s)
+        }
+        if s := test.o.Str(); s != test.str {
+            t.Errorf("test %v: expected the str %v, got %v", i, test.str, s)
+        }
+    }
+
+    d := NewDict()
+    d.Set(NewString("k"), floatObject(2))
+    if s := d.Repr(); s != "{'k': 2.0}" {
+        t.Errorf("expected the repr {'k': 2.0}, got %v", s)
+    }
+}
+
+func TestLen(t *testing.T) {
+    tests := []struct {
+        o       Object
+        length  int
+    }{
+        {NewString("héllo"), 5},
+        {NewList([]Object{None, None}), 2},
+        {NewTuple(nil), 0},
+        {NewDict(), 0},
+    }
+    for i, test := range tests {
+        if n, err := test.o.Len(); err != nil || n != test.length {
+            t.Errorf("test %v: expected %v, got %v, %v", i, test.length, n, err)
+        }
+        if test.o.AsBool() != (test.length > 0) {
+            t.Errorf("test %v: AsBool should be %v", i, test.length > 0)
+        }
+    }
+
+    if _, err := intObject(1).Len(); err == nil {
+        t.Errorf("an int should have no len()")
+    }
+}
+
+func TestStringIndexing(t *testing.T) {
+    none := Object(None)
+    tests := []struct {
+        s       string
+        key     Object
+        result  string
+    }{
+        {"héllo", intObject(1), "é"},
+        {"héllo", intObject(-1), "o"},
+        {"日本語", intObject(2), "語"},
+        {"héllo", intObject(5), "IndexError: string index out of range"},
+        {"héllo", NewSlice(intObject(1), intObject(3), nil), "él"},
+        {"héllo", NewSlice(none, none, intObject(-1)), "olléh"},
+        {"héllo", NewSlice(intObject(-4), none, intObject(2)), "él"},
+        {"hello", NewSlice(intObject(4), intObject(0), intObject(-2)), "ol"},
+        {"hello", NewSlice(intObject(-100), intObject(100), nil), "hello"},
+        {"日本語", NewSlice(intObject(3), intObject(1), nil), ""},
+        {"hello", NewSlice(nil, nil, intObject(0)), "ValueError: slice step cannot be zero"},
+        {"hello", NewSlice(NewString("a"), nil, nil), "TypeError: slice indices must be integers or None"},
+    }
+    for i, test := range tests {
+        result := ""
+        o, err := NewString(test.s).GetItem(test.key)
+        if err != nil {
+            result = err.String()
+        } else {
+            result = o.AsString()
+        }
+        if result != test.result {
+            t.Errorf("test %v: expected %v, got %v", i, test.result, result)
+        }
+    }
+    
+    var chars []string
+    for it := NewString("aé語").Iter(); ; {
+        c, ok := it.Next()
+        if !ok {
+            break
+        }
+        chars = append(chars, c.AsString())
+    }
+    if strings.Join(chars, ",") != "a,é,語" {
+        t.Errorf("iterating should give the code points, got %v", chars)
+    }
+}
+
+func TestListSlicing(t *testing.T) {
+    none := Object(None)
+    ints := func(values ...int64) (*ListObject) {
+        items := make([]Object, len(values))
+        for i, v := range values {
+            items[i] = intObject(v)
+        }
+        return NewList(items)
+    }
+    tests := []struct {
+        key, value  Object
+        result      string
+    }{
+        {NewSlice(intObject(1), intObject(3), nil), ints(7), "[0, 7, 3, 4]"},
+        {NewSlice(intObject(1), intObject(1), nil), ints(7, 8), "[0, 7, 8, 1, 2, 3, 4]"},
+        {NewSlice(none, none, nil), NewTuple(nil), "[]"},
+        {NewSlice(intObject(-1), intObject(0), nil), ints(7), "[0, 1, 2, 3, 7, 4]"},
+        {NewSlice(none, none, intObject(2)), ints(7, 8, 9), "[7, 1, 8, 3, 9]"},
+        {NewSlice(none, none, intObject(-2)), ints(7, 8, 9), "[9, 1, 8, 3, 7]"},
+        {NewSlice(none, none, intObject(2)), ints(7), "ValueError: attempt to assign sequence of size 1 to extended slice of size 3"},
+        {NewSlice(none, none, intObject(-2)), ints(7, 8, 9, 10), "ValueError: attempt to assign sequence of size 4 to extended slice of size 3"},
+        {NewSlice(none, none, nil), intObject(1), "TypeError: can only assign an iterable"},
+    }
+    for i, test := range tests {
+        l := ints(0, 1, 2, 3, 4)
+        result := ""
+        if err := l.SetItem(test.key, test.value); err != nil {
+            result = err.String()
+        } else {
+            result = l.AsString()
+        }
+        if result != test.result {
+            t.Errorf("test %v: expected %v, got %v", i, test.result, result)
+        }
+    }
+    
+    // Assigning a list to a slice of itself takes its items first.
+    l := ints(1, 2)
+    l.SetItem(NewSlice(intObject(1), nil, nil), l)
+    if l.AsString() != "[1, 1, 2]" {
+        t.Errorf("expected [1, 1, 2], got %v", l.AsString())
+    }
+    
+    reversed, _ := NewTuple(ints(1, 2, 3).Items).GetItem(NewSlice(none, none, intObject(-1)))
+    if reversed.AsString() != "(3, 2, 1)" {
+        t.Errorf("expected (3, 2, 1), got %v", reversed.AsString())
+    }
+}
+
+func TestRange(t *testing.T) {
+    none := Object(None)
+    r, _ := NewRange(2, 12, 3)
+    tests := []struct {
+        key     Object
+        result  string
+    }{
+        {intObject(0), "2"},
+        {intObject(-1), "11"},
+        {intObject(4), "IndexError: range object index out of range"},
+        {NewSlice(intObject(1), nil, nil), "range(5, 14, 3)"},
+        {NewSlice(none, none, intObject(-1)), "range(11, -1, -3)"},
+        {NewSlice(intObject(3), intObject(1), nil), "range(11, 11, 3)"},
+    }
+    for i, test := range tests {
+        result := ""
+        o, err := r.GetItem(test.key)
+        if err != nil {
+            result = err.String()
+        } else {
+            result = o.Repr()
+        }
+        if result != test.result {
+            t.Errorf("test %v: expected %v, got %v", i, test.result, result)
+        }
+    }
+    
+    var items []string
+    for it := r.Iter(); ; {
+        item, ok := it.Next()
+        if !ok {
+            break
+        }
+        items = append(items, item.AsString())
+    }
+    if n, _ := r.Len(); n != 4 || strings.Join(items, ",") != "2,5,8,11" {
+        t.Errorf("expected the 4 items 2,5,8,11, got %v", items)
+    }
+    
+    // Ranges with the same items are equal and have the same hash.
+    same, _ := NewRange(2, 13, 3)
+    empty, _ := NewRange(5, 0, 1)
+    other, _ := NewRange(0, -5, 2)
+    h1, _ := r.Hash()
+    h2, _ := same.Hash()
+    if !r.Eq(same).IsTrue() || h1 != h2 || !empty.Eq(other).IsTrue() || r.Eq(empty).IsTrue() || empty.IsTrue() {
+        t.Errorf("ranges should be equal when they have the same items")
+    }
+    if _, err := NewRange(0, 1, 0); err == nil || !strings.HasPrefix(err.String(), "ValueError") {
+        t.Errorf("a range with a zero step should be a ValueError, got %v", err)
+    }
+}
+
+func TestPow(t *testing.T) {
+    tests := []struct {
+        l, r    Object
+        result  string
+    }{
+        {intObject(2), intObject(100), "1267650600228229401496703205376"},
+        {intObject(2), intObject(-1), "0.5"},
+        {floatObject(4), floatObject(0.5), "2.0"},
+        {intObject(4), floatObject(0.5), "nil"},
+        {floatObject(-8), intObject(2), "64.0"},
+        {NewComplex(2), intObject(2), "(4+0j)"},
+        {intObject(0), intObject(-1), "ZeroDivisionError: 0.0 cannot be raised to a negative power"},
+        {NewString("a"), intObject(2), "nil"},
+        {intObject(2), NewString("a"), "nil"},
+    }
+    for i, test := range tests {
+        result := "nil"
+        o, err := test.l.Pow(test.r)
+        switch {
+            case err != nil:
+                result = err.String()
+            case o != nil:
+                result = o.Repr()
+        }
+        if result != test.result {
+            t.Errorf("test %v: expected %v, got %v", i, test.result, result)
+        }
+    }
+    
+    o, _ := floatObject(-8).Pow(floatObject(0.5))
+    if _, ok := o.(*ComplexObject); !ok {
+        t.Errorf("a fractional power of a negative float should be a complex")
+    }
+}
+
+func TestIntOverflow(t *testing.T) {
+    huge, _ := new (big.Int).SetString("9223372036854775808", 10)
+    
+    tests := []struct {
+        op      uint32
+        l, r    *IntObject
+        result  string
+        small   bool
+    }{
+        {ADD, intObject(math.MaxInt64), intObject(1), "9223372036854775808", false},
+        {SUB, intObject(math.MinInt64), intObject(1), "-9223372036854775809", false},
+        {MUL, intObject(1 << 32), intObject(1 << 32), "18446744073709551616", false},
+        {FDIV, intObject(math.MinInt64), intObject(-1), "9223372036854775808", false},
+        {MOD, intObject(math.MinInt64), intObject(-1), "0", true},
+        {ADD, intObject(2), intObject(3), "5", true},
+        
+        // A result that fits again goes back to an int64.
+        {SUB, NewBigInt(huge), intObject(1), "9223372036854775807", true},
+        {MUL, NewBigInt(huge), intObject(0), "0", true},
+    }
+    for i, test := range tests {
+        o, err := arithmetic(test.op, test.l, test.r)
+        if err != nil {
+            t.Errorf("test %v: unexpected error %v", i, err)
+            continue
+        }
+        n := o.(*IntObject)
+        if n.String() != test.result || n.IsSmall() != test.small {
+            t.Errorf("test %v: expected %v, small %v, got %v, small %v", i, test.result, test.small, n, n.IsSmall())
+        }
+    }
+    
+    if o, _ := intObject(3).Pow(intObject(40)); o.Repr() != "12157665459056928801" {
+        t.Errorf("3 ** 40 should be 12157665459056928801, got %v", o.Repr())
+    }
+    if o, _ := intObject(math.MinInt64).Neg(); o.Repr() != "9223372036854775808" {
+        t.Errorf("-(-2**63) should be 2**63, got %v", o.Repr())
+    }
+    if !NewBigInt(huge).Gt(intObject(math.MaxInt64)).IsTrue() || NewBigInt(huge).AsFloat() != 1<<63 {
+        t.Errorf("2**63 should compare and convert as a big int")
+    }
+    if h, _ := NewBigInt(huge).Hash(); h != 4 {
+        t.Errorf("hash(2**63) should be 4, got %v", h)
+    }
+}
+
+// Measures the arithmetic of ints that fit in an int64, which doesn't need a big.Int.
+func BenchmarkSmallIntArithmetic(b *testing.B) {
+    one, three := intObject(1), intObject(3)
+    for i := 0; i < b.N; i++ {
+        o, _ := one.Add(three)
+        o, _ = o.Mul(three)
+        o.Sub(one)
+    }
+}
+
+// Measures the same arithmetic on ints that have been promoted to big.Ints.
+func BenchmarkBigIntArithmetic(b *testing.B) {
+    v, _ := new (big.Int).SetString("100000000000000000000", 10)
+    one, three := NewBigInt(v), intObject(3)
+    for i := 0; i < b.N; i++ {
+        o, _ := one.Add(three)
+        o, _ = o.Mul(three)
+        o.Sub(one)
+    }
+}
+
+// Measures repeating a string many times, which should take time in proportion to the
+// length of the result.
+func BenchmarkStringRepeat(b *testing.B) {
+    s, reps := NewString("abc"), intObject(1 << 20)
+    for i := 0; i < b.N; i++ {
+        s.Mul(reps)
+    }
+}
+
+func BenchmarkStringConcat(b *testing.B) {
+    l, r := NewString(strings.Repeat("a", 1 << 16)), NewString(strings.Repeat("b", 1 << 16))
+    for i := 0; i < b.N; i++ {
+        l.Add(r)
+    }
+}
+
+func TestBool(t *testing.T) {
+    if pyBool(true) != True || pyBool(false) != False {
+        t.Errorf("pyBool should give the True and False singletons")
+    }
+    if True.Repr() != "True" || False.Str() != "False" {
+        t.Errorf("expected True and False, got %v and %v", True.Repr(), False.Str())
+    }
+    if typeOf(True) != BoolClass || typeOf(intObject(1)) != IntClass {
+        t.Errorf("True should be a bool, and 1 an int")
+    }
+    if ok, _ := IsInstance(True, IntClass); !ok {
+        t.Errorf("a bool should be an instance of int")
+    }
+    
+    // A bool is 1 or 0 as a number, but what an operation on it gives is an int.
+    if !True.Eq(intObject(1)).IsTrue() || !False.Eq(intObject(0)).IsTrue() {
+        t.Errorf("True should equal 1, and False 0")
+    }
+    if h, _ := True.Hash(); h != 1 {
+        t.Errorf("hash(True) should be 1, got %v", h)
+    }
+    for _, f := range []func() (Object, os.Error){True.Pos, True.Neg, func() (Object, os.Error) { return True.Add(True) }} {
+        if o, _ := f(); o.(*IntObject).IsBool() {
+            t.Errorf("an operation on a bool should give an int, got %v", o.Repr())
+        }
+    }
+    
+    // The interpreter doesn't share 1 and 0 in place of the bool constants.
+    interp := NewInterpreter()
+    if interp.internConstant(True) != Object(True) {
+        t.Errorf("True shouldn't be interned as 1")
+    }
+}
@@ -0,0 +1,1094 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   The parser turns the token stream produced by the Scanner into an ast.
+
+   The scanner returns operators one character at a time, and its indent/dedent
+   tracking is not reliable enough to build blocks from.  So the parser first
+   reads the whole token stream, gluing adjacent operator characters back
+   together, and then uses the column of the first token on each line to decide
+   where blocks begin and end.
+*/
+
+package python
+
+import (
+    "big"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "utf8"
+)
+
+// A token read from the scanner, along with where it came from.
+type Token struct {
+    Tok  int
+    Text string
+    Position
+    Stop Position
+}
+
+// Operators that the scanner returns as several single character tokens.
+// Longer operators must come first.
+var multiCharOps = []string{
+    "**=", "//=", ">>=", "<<=",
+    "**", "//", "<<", ">>", "<=", ">=", "==", "!=", "->",
+    "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "@=",
+}
+
+// Binary operator precedence, from loosest to tightest binding.
+var binaryPrecedence = map[string]int{
+    "|":  1,
+    "^":  2,
+    "&":  3,
+    "<<": 4, ">>": 4,
+    "+": 5, "-": 5,
+    "*": 6, "/": 6, "//": 6, "%": 6, "@": 6,
+}
+
+var augAssignOps = map[string]bool{
+    "+=": true, "-=": true, "*=": true, "/=": true, "//=": true, "%=": true, "**=": true,
+    ">>=": true, "<<=": true, "&=": true, "|=": true, "^=": true, "@=": true,
+}
+
+// Raised (via panic) to abandon the statement being parsed after an error has
+// been reported.
+type parseError struct{}
+
+type Parser struct {
+    filename string
+    src      io.Reader
+
+    tokens []Token
+    pos    int
+
+    // "# type:" comments, by the line they appear on, and the lines with a
+    // "# type: ignore" comment.
+    typeComments map[int]string
+    typeIgnores  []int
+
+    // Error is called for each error encountered. If no Error
+    // function is set, the error is reported to os.Stderr.
+    Error func(p *Parser, pos Position, msg string)
+
+    // ErrorCount is incremented by one for each error encountered.
+    ErrorCount int
+}
+
+// Init initializes a Parser with a new source and returns itself.
+// Error is set to nil, and ErrorCount is set to 0.
+func (p *Parser) Init(filename string, src io.Reader) *Parser {
+    p.filename = filename
+    p.src = src
+
+    p.Error = nil
+    p.ErrorCount = 0
+
+    return p
+}
+
+// Reads every token from src.  Token positions are made relative to base, which
+// is the position in the whole file of the first byte of src.
+func (p *Parser) tokenize(filename string, src io.Reader, base Position) {
+    s := new(Scanner).Init(src)
+    s.Filename = filename
+    s.Error = func(s *Scanner, msg string) {
+        p.error(s.Position, msg)
+    }
+
+    p.tokens = p.tokens[0:0]
+    p.pos = 0
+    p.typeComments = make(map[int]string, 8)
+    p.typeIgnores = make([]int, 0, 4)
+
+    for {
+        tok := s.Scan()
+        t := Token{Tok: tok, Position: s.Position}
+        if tok != EOF {
+            t.Text = s.TokenText()
+        }
+
+        // Glue operator characters back together
+        if n := len(p.tokens); n > 0 && tok >= 0 {
+            last := &p.tokens[n-1]
+            if last.Tok >= 0 && last.Stop.Offset == t.Offset && isOperatorPrefix(last.Text+t.Text) {
+                last.Text += t.Text
+                last.Stop = endOf(t.Position, t.Text)
+                continue
+            }
+        }
+
+        // The scanner's idea of where the file ends is not useful, so EOF is
+        // placed right after the last token.
+        if tok == EOF {
+            t.Position = Position{filename, 0, 1, 1}
+            if n := len(p.tokens); n > 0 {
+                t.Position = p.tokens[n-1].Stop
+            }
+        }
+
+        t.Stop = endOf(t.Position, t.Text)
+
+        if tok == Comment {
+            p.comment(relocate(t.Position, base).Line, t.Text)
+            continue
+        }
+
+        p.tokens = append(p.tokens, t)
+
+        if tok == EOF {
+            break
+        }
+    }
+
+    // Relocate the tokens to where the source lives in the file.
+    for i := range p.tokens {
+        p.tokens[i].Position = relocate(p.tokens[i].Position, base)
+        p.tokens[i].Stop = relocate(p.tokens[i].Stop, base)
+    }
+
+    p.joinBracketedLines()
+}
+
+// Comments are dropped from the token stream, but type comments are kept
+// so they can be attached to the statement on the same line.
+func (p *Parser) comment(line int, text string) {
+    text = strings.TrimSpace(text[1:])
+    if !strings.HasPrefix(text, "type:") {
+        return
+    }
+
+    text = strings.TrimSpace(text[len("type:"):])
+    if text == "ignore" || strings.HasPrefix(text, "ignore[") {
+        p.typeIgnores = append(p.typeIgnores, line)
+        return
+    }
+
+    p.typeComments[line] = text
+}
+
+func isOperatorPrefix(text string) bool {
+    for _, op := range multiCharOps {
+        if strings.HasPrefix(op, text) {
+            return true
+        }
+    }
+    return false
+}
+
+// Computes the position just after text, which starts at pos.
+func endOf(pos Position, text string) Position {
+    pos.Offset += len(text)
+    if i := strings.LastIndex(text, "\n"); i >= 0 {
+        pos.Line += strings.Count(text, "\n")
+        pos.Column = utf8.RuneCountInString(text[i+1:]) + 1
+    } else {
+        pos.Column += utf8.RuneCountInString(text)
+    }
+    return pos
+}
+
+// Makes pos, which is relative to the start of a fragment of source, relative
+// to the file that the fragment was taken from.
+func relocate(pos, base Position) Position {
+    if pos.Line == 1 {
+        pos.Column += base.Column - 1
+    }
+    pos.Offset += base.Offset
+    pos.Line += base.Line - 1
+    pos.Filename = base.Filename
+    return pos
+}
+
+func (p *Parser) error(pos Position, msg string) {
+    p.ErrorCount++
+    if p.Error != nil {
+        p.Error(p, pos, msg)
+        return
+    }
+    fmt.Fprintf(os.Stderr, "%s: %s\n", pos, msg)
+}
+
+// Reports an error at the current token and abandons the current statement.
+func (p *Parser) fail(msg string) {
+    p.failAt(p.tokens[p.pos].Position, msg)
+}
+
+// Reports an error at pos and abandons the current statement.
+func (p *Parser) failAt(pos Position, msg string) {
+    p.error(pos, msg)
+    panic(parseError{})
+}
+
+///////// Token helpers ///////////
+
+func (p *Parser) peek() *Token {
+    return &p.tokens[p.pos]
+}
+
+func (p *Parser) next() *Token {
+    t := &p.tokens[p.pos]
+    if t.Tok != EOF {
+        p.pos++
+    }
+    return t
+}
+
+// The position just after the most recently consumed token.
+func (p *Parser) lastEnd() Position {
+    if p.pos == 0 {
+        return p.tokens[0].Position
+    }
+    return p.tokens[p.pos-1].Stop
+}
+
+// Returns true if the current token is the operator, delimiter or keyword text.
+func (p *Parser) at(text string) bool {
+    t := p.peek()
+    return (t.Tok == Identifier || t.Tok >= 0) && t.Text == text
+}
+
+func (p *Parser) accept(text string) bool {
+    if p.at(text) {
+        p.next()
+        return true
+    }
+    return false
+}
+
+func (p *Parser) expect(text string) *Token {
+    if !p.at(text) {
+        p.fail(fmt.Sprintf("expected '%s', found '%s'", text, p.peek().Text))
+    }
+    return p.next()
+}
+
+func (p *Parser) expectName() *Token {
+    if p.peek().Tok != Identifier || keywords[p.peek().Text] {
+        p.fail(fmt.Sprintf("expected a name, found '%s'", p.peek().Text))
+    }
+    return p.next()
+}
+
+var keywords = map[string]bool{
+    "and": true, "as": true, "assert": true, "break": true, "class": true,
+    "continue": true, "def": true, "del": true, "elif": true, "else": true,
+    "except": true, "finally": true, "for": true, "from": true, "global": true,
+    "if": true, "import": true, "in": true, "is": true, "lambda": true,
+    "nonlocal": true, "not": true, "or": true, "pass": true, "raise": true,
+    "return": true, "try": true, "while": true, "with": true, "yield": true,
+}
+
+// Layout tokens are skipped by the parser, except for EOL, which ends a statement.
+func isLayout(tok int) bool {
+    return tok == Indent || tok == Dedent
+}
+
+// Moves past blank lines and layout tokens to the first token of the next line.
+func (p *Parser) skipBlankLines() {
+    for isLayout(p.peek().Tok) || p.peek().Tok == EOL {
+        p.next()
+    }
+}
+
+// Skips tokens until the next line whose indentation is no deeper than column.
+func (p *Parser) skipStatement(column int) {
+    for {
+        t := p.next()
+        if t.Tok == EOF {
+            return
+        }
+        if t.Tok == EOL {
+            p.skipBlankLines()
+            if p.peek().Column <= column {
+                return
+            }
+        }
+    }
+}
+
+// Inside of brackets newlines and indentation have no meaning.  This strips
+// them from the token stream up front so the expression parser never sees them.
+func (p *Parser) joinBracketedLines() {
+    depth := 0
+    out := p.tokens[0:0]
+    for _, t := range p.tokens {
+        switch t.Text {
+            case "(", "[", "{":
+                depth++
+            case ")", "]", "}":
+                if depth > 0 {
+                    depth--
+                }
+        }
+        if depth > 0 && (t.Tok == EOL || isLayout(t.Tok)) {
+            continue
+        }
+        out = append(out, t)
+    }
+    p.tokens = out
+}
+
+///////// Statements ///////////
+
+// Parse reads the whole source and returns the module.  Errors are reported
+// through the Error function; the statements that contained them are left out
+// of the tree.
+func (p *Parser) Parse() *ModuleNode {
+    p.tokenize(p.filename, p.src, Position{p.filename, 0, 1, 1})
+
+    mod := new(ModuleNode)
+    mod.Start = Position{p.filename, 0, 1, 1}
+    mod.Body = p.parseStatements(1)
+    mod.Stop = p.peek().Position
+    mod.TypeIgnores = p.typeIgnores
+
+    return mod
+}
+
+// Parses statements which all start at the given column.
+func (p *Parser) parseStatements(column int) []Ast {
+    body := make([]Ast, 0, 8)
+
+    for {
+        p.skipBlankLines()
+        t := p.peek()
+
+        if t.Tok == EOF || t.Column < column {
+            break
+        }
+        if t.Column > column {
+            p.error(t.Position, "unexpected indent")
+            p.skipStatement(column)
+            continue
+        }
+
+        body = p.parseStatement(body, column)
+    }
+
+    return body
+}
+
+// Parses one statement and appends it, and any others on the same line, to body.
+func (p *Parser) parseStatement(body []Ast, column int) (result []Ast) {
+    defer func() {
+        if e := recover(); e != nil {
+            if _, ok := e.(parseError); !ok {
+                panic(e)
+            }
+            p.skipStatement(column)
+            result = body
+        }
+    }()
+
+    if s := p.parseCompound(column); s != nil {
+        return append(body, s)
+    }
+    return p.parseSimpleStatements(body)
+}
+
+// Parses "small_stmt (';' small_stmt)* EOL".
+func (p *Parser) parseSimpleStatements(body []Ast) []Ast {
+    for {
+        body = append(body, p.parseSmall())
+        if !p.accept(";") || p.peek().Tok == EOL || p.peek().Tok == EOF {
+            break
+        }
+    }
+
+    p.endOfLine()
+    return body
+}
+
+func (p *Parser) endOfLine() {
+    switch p.peek().Tok {
+        case EOL:
+            p.next()
+        case EOF:
+        default:
+            p.fail(fmt.Sprintf("unexpected '%s' at end of statement", p.peek().Text))
+    }
+}
+
+func (p *Parser) parseSmall() Ast {
+    start := p.peek().Position
+
+    switch {
+        case p.accept("pass"):
+            n := new(PassNode)
+            n.Start, n.Stop = start, p.lastEnd()
+            return n
+
+        case p.accept("break"):
+            n := new(BreakNode)
+            n.Start, n.Stop = start, p.lastEnd()
+            return n
+
+        case p.accept("continue"):
+            n := new(ContinueNode)
+            n.Start, n.Stop = start, p.lastEnd()
+            return n
+
+        case p.accept("return"):
+            n := new(ReturnNode)
+            if !p.atEndOfStatement() {
+                n.Value = p.parseTestList()
+            }
+            n.Start, n.Stop = start, p.lastEnd()
+            return n
+    }
+
+    value := p.parseTestList()
+
+    if t := p.peek(); augAssignOps[t.Text] {
+        p.next()
+        n := new(AugAssignNode)
+        n.Target = value
+        n.Op = t.Text[0 : len(t.Text)-1]
+        n.Value = p.parseTestList()
+        n.Start, n.Stop = start, p.lastEnd()
+        return n
+    }
+
+    if p.at("=") {
+        n := new(AssignNode)
+        for p.accept("=") {
+            n.Targets = append(n.Targets, value)
+            value = p.parseTestList()
+        }
+        n.Value = value
+        n.Start, n.Stop = start, p.lastEnd()
+        if p.atEndOfLine() {
+            n.TypeComment = p.typeComments[n.Stop.Line]
+        }
+        return n
+    }
+
+    n := new(ExprStmtNode)
+    n.Value = value
+    n.Start, n.Stop = start, p.lastEnd()
+    return n
+}
+
+func (p *Parser) atEndOfLine() bool {
+    t := p.peek()
+    return t.Tok == EOL || t.Tok == EOF
+}
+
+func (p *Parser) atEndOfStatement() bool {
+    t := p.peek()
+    return t.Tok == EOL || t.Tok == EOF || t.Text == ";"
+}
+
+// Parses a compound statement, or returns nil if the next statement is not one.
+func (p *Parser) parseCompound(column int) Ast {
+    start := p.peek().Position
+
+    switch {
+        case p.accept("if"):
+            return p.parseIf(start, column)
+
+        case p.accept("while"):
+            n := new(WhileNode)
+            n.Test = p.parseTest()
+            n.Body = p.parseSuite(column)
+            n.Orelse = p.parseElse(column)
+            n.Start, n.Stop = start, p.bodyEnd()
+            return n
+
+        case p.accept("for"):
+            n := new(ForNode)
+            n.Target = p.parseExprList()
+            p.expect("in")
+            n.Iter = p.parseTestList()
+            n.TypeComment = p.suiteTypeComment()
+            n.Body = p.parseSuite(column)
+            n.Orelse = p.parseElse(column)
+            n.Start, n.Stop = start, p.bodyEnd()
+            return n
+
+        case p.accept("def"):
+            n := new(FunctionDefNode)
+            n.Name = p.expectName().Text
+            p.expect("(")
+            n.Args = p.parseParameters(")")
+            p.expect(")")
+            if p.accept("->") {
+                n.Returns = p.parseTest()
+            }
+            n.TypeComment = p.suiteTypeComment()
+            for _, a := range n.Args {
+                if a.Stop.Line != p.peek().Line {
+                    a.TypeComment = p.typeComments[a.Stop.Line]
+                }
+            }
+            n.Body = p.parseSuite(column)
+            n.Start, n.Stop = start, p.bodyEnd()
+            return n
+
+        case p.accept("class"):
+            n := new(ClassDefNode)
+            n.Name = p.expectName().Text
+            if p.accept("(") {
+                for !p.at(")") {
+                    n.Bases = append(n.Bases, p.parseTest())
+                    if !p.accept(",") {
+                        break
+                    }
+                }
+                p.expect(")")
+            }
+            n.Body = p.parseSuite(column)
+            n.Start, n.Stop = start, p.bodyEnd()
+            return n
+    }
+
+    return nil
+}
+
+// The end of a compound statement is the end of the last token in its body,
+// not the EOL that follows it.
+func (p *Parser) bodyEnd() Position {
+    for i := p.pos - 1; i >= 0; i-- {
+        if t := p.tokens[i]; t.Tok != EOL && !isLayout(t.Tok) {
+            return t.Stop
+        }
+    }
+    return p.lastEnd()
+}
+
+func (p *Parser) parseIf(start Position, column int) Ast {
+    n := new(IfNode)
+    n.Test = p.parseTest()
+    n.Body = p.parseSuite(column)
+
+    p.skipBlankLines()
+    if elif := p.peek(); elif.Column == column && p.at("elif") {
+        p.next()
+        n.Orelse = []Ast{p.parseIf(elif.Position, column)}
+    } else {
+        n.Orelse = p.parseElse(column)
+    }
+
+    n.Start, n.Stop = start, p.bodyEnd()
+    return n
+}
+
+func (p *Parser) parseElse(column int) []Ast {
+    save := p.pos
+    p.skipBlankLines()
+    if p.peek().Column == column && p.accept("else") {
+        return p.parseSuite(column)
+    }
+    p.pos = save
+    return nil
+}
+
+// Returns the type comment for a compound statement whose ':' is the current
+// token.  The comment may follow the ':', or be on a line of its own before
+// the first statement in the body.
+func (p *Parser) suiteTypeComment() string {
+    colon := p.peek()
+    if text, present := p.typeComments[colon.Line]; present {
+        return text
+    }
+
+    if p.tokens[p.pos+1].Tok != EOL {
+        return ""
+    }
+
+    i := p.pos + 1
+    for p.tokens[i].Tok == EOL || isLayout(p.tokens[i].Tok) {
+        i++
+    }
+    for line := colon.Line + 1; line < p.tokens[i].Line; line++ {
+        if text, present := p.typeComments[line]; present {
+            return text
+        }
+    }
+    return ""
+}
+
+// Parses ": simple_stmt" or ": EOL <indented block>".  column is the column of the
+// statement that owns the suite.
+func (p *Parser) parseSuite(column int) []Ast {
+    p.expect(":")
+
+    if p.peek().Tok != EOL {
+        return p.parseSimpleStatements(make([]Ast, 0, 1))
+    }
+
+    p.next()
+    p.skipBlankLines()
+
+    indent := p.peek().Column
+    if indent <= column || p.peek().Tok == EOF {
+        p.fail("expected an indented block")
+    }
+
+    return p.parseStatements(indent)
+}
+
+// Parses function parameters up to (but not including) the closing token.
+func (p *Parser) parseParameters(closer string) []*ArgNode {
+    args := make([]*ArgNode, 0, 4)
+
+    for !p.at(closer) {
+        a := new(ArgNode)
+        a.Start = p.peek().Position
+
+        if p.accept("*") {
+            a.Star = "*"
+        } else if p.accept("**") {
+            a.Star = "**"
+        }
+
+        a.Name = p.expectName().Text
+        if closer == ")" && p.accept(":") {
+            a.Annotation = p.parseTest()
+        }
+        if p.accept("=") {
+            a.Default = p.parseTest()
+        }
+        a.Stop = p.lastEnd()
+        args = append(args, a)
+
+        if !p.accept(",") {
+            break
+        }
+    }
+
+    return args
+}
+
+///////// Expressions ///////////
+
+// Parses "test (',' test)* [',']", producing a tuple if there is a comma.
+func (p *Parser) parseTestList() Ast {
+    return p.parseSequence(p.parseTest)
+}
+
+// Parses a target list, as used by "for".  Comparisons are not allowed, so
+// that "in" is left for the for statement.
+func (p *Parser) parseExprList() Ast {
+    return p.parseSequence(func() Ast { return p.parseBinary(1) })
+}
+
+func (p *Parser) parseSequence(item func() Ast) Ast {
+    start := p.peek().Position
+    first := item()
+    if !p.at(",") {
+        return first
+    }
+
+    n := new(TupleNode)
+    n.Elts = []Ast{first}
+    for p.accept(",") && p.startsExpression() {
+        n.Elts = append(n.Elts, item())
+    }
+    n.Start, n.Stop = start, p.lastEnd()
+    return n
+}
+
+// Returns true if the current token can begin an expression.
+func (p *Parser) startsExpression() bool {
+    t := p.peek()
+    switch t.Tok {
+        case Identifier:
+            return !keywords[t.Text] || t.Text == "not" || t.Text == "lambda"
+        case Integer, Long, Float, Imaginary, String:
+            return true
+    }
+    switch t.Text {
+        case "(", "[", "{", "-", "+", "~":
+            return true
+    }
+    return false
+}
+
+// Parses "or_test ['if' or_test 'else' test]".
+func (p *Parser) parseTest() Ast {
+    start := p.peek().Position
+    body := p.parseOr()
+
+    if !p.accept("if") {
+        return body
+    }
+
+    n := new(IfExpNode)
+    n.Body = body
+    n.Test = p.parseOr()
+    p.expect("else")
+    n.Orelse = p.parseTest()
+    n.Start, n.Stop = start, p.lastEnd()
+    return n
+}
+
+func (p *Parser) parseOr() Ast {
+    return p.parseBoolOp("or", p.parseAnd)
+}
+
+func (p *Parser) parseAnd() Ast {
+    return p.parseBoolOp("and", p.parseNot)
+}
+
+func (p *Parser) parseBoolOp(op string, operand func() Ast) Ast {
+    start := p.peek().Position
+    left := operand()
+    for p.accept(op) {
+        n := new(BinOpNode)
+        n.Op = op
+        n.Left = left
+        n.Right = operand()
+        n.Start, n.Stop = start, p.lastEnd()
+        left = n
+    }
+    return left
+}
+
+func (p *Parser) parseNot() Ast {
+    start := p.peek().Position
+    if p.accept("not") {
+        n := new(UnaryOpNode)
+        n.Op = "not"
+        n.Operand = p.parseNot()
+        n.Start, n.Stop = start, p.lastEnd()
+        return n
+    }
+    return p.parseComparison()
+}
+
+// Returns the comparison operator at the current token, consuming it, or "" if there is none.
+func (p *Parser) acceptComparison() string {
+    t := p.peek()
+    switch t.Text {
+        case "<", ">", "==", ">=", "<=", "!=", "in":
+            p.next()
+            return t.Text
+        case "is":
+            p.next()
+            if p.accept("not") {
+                return "is not"
+            }
+            return "is"
+        case "not":
+            if p.tokens[p.pos+1].Text == "in" {
+                p.pos += 2
+                return "not in"
+            }
+    }
+    return ""
+}
+
+func (p *Parser) parseComparison() Ast {
+    start := p.peek().Position
+    left := p.parseBinary(1)
+
+    op := p.acceptComparison()
+    if op == "" {
+        return left
+    }
+
+    n := new(CompareNode)
+    n.Left = left
+    for ; op != ""; op = p.acceptComparison() {
+        n.Ops = append(n.Ops, op)
+        n.Comparators = append(n.Comparators, p.parseBinary(1))
+    }
+    n.Start, n.Stop = start, p.lastEnd()
+    return n
+}
+
+// Precedence climbing over the arithmetic and bitwise operators.
+func (p *Parser) parseBinary(precedence int) Ast {
+    start := p.peek().Position
+    left := p.parseFactor()
+
+    for {
+        op := p.peek().Text
+        prec, present := binaryPrecedence[op]
+        if !present || prec < precedence {
+            break
+        }
+        p.next()
+
+        n := new(BinOpNode)
+        n.Op = op
+        n.Left = left
+        n.Right = p.parseBinary(prec + 1)
+        n.Start, n.Stop = start, p.lastEnd()
+        left = n
+    }
+
+    return left
+}
+
+func (p *Parser) parseFactor() Ast {
+    start := p.peek().Position
+
+    switch t := p.peek(); t.Text {
+        case "-", "+", "~":
+            if t.Tok < 0 {
+                break
+            }
+            p.next()
+            n := new(UnaryOpNode)
+            n.Op = t.Text
+            n.Operand = p.parseFactor()
+            n.Start, n.Stop = start, p.lastEnd()
+            return n
+    }
+
+    return p.parsePower()
+}
+
+// Parses "atom trailer* ['**' factor]".
+func (p *Parser) parsePower() Ast {
+    start := p.peek().Position
+    value := p.parseAtom()
+
+    for trailer := true; trailer; {
+        switch {
+            case p.accept("("):
+                n := new(CallNode)
+                n.Func = value
+                p.parseArguments(n)
+                p.expect(")")
+                n.Start, n.Stop = start, p.lastEnd()
+                value = n
+
+            case p.accept("["):
+                n := new(SubscriptNode)
+                n.Value = value
+                n.Index = p.parseSubscript()
+                p.expect("]")
+                n.Start, n.Stop = start, p.lastEnd()
+                value = n
+
+            case p.accept("."):
+                n := new(AttributeNode)
+                n.Value = value
+                n.Attr = p.expectName().Text
+                n.Start, n.Stop = start, p.lastEnd()
+                value = n
+
+            default:
+                trailer = false
+        }
+    }
+
+    if p.accept("**") {
+        n := new(BinOpNode)
+        n.Op = "**"
+        n.Left = value
+        n.Right = p.parseFactor()
+        n.Start, n.Stop = start, p.lastEnd()
+        return n
+    }
+
+    return value
+}
+
+func (p *Parser) parseArguments(call *CallNode) {
+    for !p.at(")") {
+        start := p.peek().Position
+
+        switch {
+            case p.at("*") || p.at("**"):
+                n := new(StarredNode)
+                n.Op = p.next().Text
+                n.Value = p.parseTest()
+                n.Start, n.Stop = start, p.lastEnd()
+                call.Args = append(call.Args, n)
+
+            case p.peek().Tok == Identifier && p.tokens[p.pos+1].Text == "=":
+                n := new(KeywordNode)
+                n.Arg = p.next().Text
+                p.next()
+                n.Value = p.parseTest()
+                n.Start, n.Stop = start, p.lastEnd()
+                call.Keywords = append(call.Keywords, n)
+
+            default:
+                call.Args = append(call.Args, p.parseTest())
+        }
+
+        if !p.accept(",") {
+            break
+        }
+    }
+}
+
+// Parses the inside of a subscript, which may be a slice.
+func (p *Parser) parseSubscript() Ast {
+    start := p.peek().Position
+
+    var lower Ast
+    if !p.at(":") {
+        lower = p.parseTestList()
+        if !p.at(":") {
+            return lower
+        }
+    }
+
+    n := new(SliceNode)
+    n.Lower = lower
+    p.expect(":")
+    if !p.at(":") && !p.at("]") {
+        n.Upper = p.parseTest()
+    }
+    if p.accept(":") && !p.at("]") {
+        n.Step = p.parseTest()
+    }
+    n.Start, n.Stop = start, p.lastEnd()
+    return n
+}
+
+func (p *Parser) parseAtom() Ast {
+    t := p.peek()
+    start := t.Position
+
+    switch t.Tok {
+        case Identifier:
+            if keywords[t.Text] {
+                break
+            }
+            p.next()
+            n := new(NameNode)
+            n.Id = t.Text
+            n.Start, n.Stop = start, t.Stop
+            return n
+
+        case Integer:
+            p.next()
+            n := new(LiteralIntNode)
+            n.Value = big.NewInt(0)
+            if _, ok := n.Value.SetString(t.Text, 0); !ok {
+                p.error(start, fmt.Sprintf("invalid integer literal '%s'", t.Text))
+            }
+            n.Start, n.Stop = start, t.Stop
+            return n
+
+        case String:
+            return p.parseStrings()
+    }
+
+    switch {
+        case p.accept("("):
+            if p.accept(")") {
+                n := new(TupleNode)
+                n.Start, n.Stop = start, p.lastEnd()
+                return n
+            }
+            value := p.parseTestList()
+            p.expect(")")
+            return value
+
+        case p.accept("["):
+            n := new(ListNode)
+            for !p.at("]") {
+                n.Elts = append(n.Elts, p.parseTest())
+                if !p.accept(",") {
+                    break
+                }
+            }
+            p.expect("]")
+            n.Start, n.Stop = start, p.lastEnd()
+            return n
+
+        case p.accept("{"):
+            n := new(DictNode)
+            for !p.at("}") {
+                n.Keys = append(n.Keys, p.parseTest())
+                p.expect(":")
+                n.Values = append(n.Values, p.parseTest())
+                if !p.accept(",") {
+                    break
+                }
+            }
+            p.expect("}")
+            n.Start, n.Stop = start, p.lastEnd()
+            return n
+    }
+
+    if t.Tok == EOF {
+        p.fail("unexpected end of file")
+    }
+    p.fail(fmt.Sprintf("unexpected '%s'", t.Text))
+    return nil
+}
+
+// Parses one or more adjacent string literals, which are concatenated.  If any
+// of them is an f-string the result is a JoinedStrNode.
+func (p *Parser) parseStrings() Ast {
+    start := p.peek().Position
+
+    parts := make([]Ast, 0, 4)
+    formatted := false
+    for p.peek().Tok == String {
+        t := p.next()
+        prefix, first, last := stringParts(t.Text)
+
+        if strings.ContainsAny(prefix, "fF") {
+            formatted = true
+            parts = append(parts, p.parseFString(t.Text, first, last, t.Position, 0)...)
+            continue
+        }
+
+        n := new(LiteralStringNode)
+        n.Value = t.Text[first:last]
+        n.Raw = strings.ContainsAny(prefix, "rR")
+        n.Start, n.Stop = t.Position, t.Stop
+        parts = append(parts, n)
+    }
+
+    if !formatted {
+        n := parts[0].(*LiteralStringNode)
+        for _, part := range parts[1:] {
+            n.Value += part.(*LiteralStringNode).Value
+            n.Raw = n.Raw || part.(*LiteralStringNode).Raw
+        }
+        n.Start, n.Stop = start, p.lastEnd()
+        return n
+    }
+
+    n := new(JoinedStrNode)
+    n.Values = joinLiterals(parts)
+    n.Start, n.Stop = start, p.lastEnd()
+    return n
+}
+
+// Splits the text of a string token into its prefix, and the offsets of the
+// first and last bytes of its contents.
+func stringParts(text string) (prefix string, first, last int) {
+    for first < len(text) && text[first] != '"' && text[first] != '\'' {
+        first++
+    }
+    prefix = text[0:first]
+
+    quote := 1
+    if strings.HasPrefix(text[first:], `"""`) || strings.HasPrefix(text[first:], "'''") {
+        quote = 3
+    }
+
+    first += quote
+    last = len(text) - quote
+    if last < first {
+        last = first
+    }
+    return
+}
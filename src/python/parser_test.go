@@ -0,0 +1,264 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the parser and incremental reparsing.
+
+*/
+
+package python
+
+import (
+        "fmt"
+        "strings"
+        "testing"
+)
+
+func parseSource(t *testing.T, src string) (*Parser, *ModuleNode) {
+    p := new(Parser).Init("test.py", strings.NewReader(src))
+    p.Error = func(p *Parser, pos Position, msg string) {
+        t.Errorf("%v: %v", pos, msg)
+    }
+
+    return p, p.Parse()
+}
+
+const parserSource = `x = 1
+def f(a, b=2):
+    if a < b:
+        return a + b * 3
+    else:
+        return f(b, a)
+
+y = x ** 2
+`
+
+func TestParseStatements(t *testing.T) {
+    _, mod := parseSource(t, parserSource)
+
+    if len(mod.Body) != 3 {
+        t.Fatalf("expected 3 statements, got %v", len(mod.Body))
+    }
+
+    def, ok := mod.Body[1].(*FunctionDefNode)
+    if !ok {
+        t.Fatalf("expected a function definition, got %T", mod.Body[1])
+    }
+
+    if def.Name != "f" || len(def.Args) != 2 || def.Args[1].Default == nil {
+        t.Errorf("function definition parsed incorrectly: %v %v", def.Name, def.Args)
+    }
+
+    if_stmt, ok := def.Body[0].(*IfNode)
+    if !ok || len(if_stmt.Orelse) != 1 {
+        t.Fatalf("expected an if/else statement, got %T", def.Body[0])
+    }
+
+    ret := if_stmt.Body[0].(*ReturnNode)
+    sum, ok := ret.Value.(*BinOpNode)
+    if !ok || sum.Op != "+" {
+        t.Fatalf("expected a + b * 3, got %T", ret.Value)
+    }
+
+    if product, ok := sum.Right.(*BinOpNode); !ok || product.Op != "*" {
+        t.Errorf("multiplication should bind tighter than addition")
+    }
+
+    if pos := def.Pos(); pos.Line != 2 || pos.Column != 1 {
+        t.Errorf("function definition has the wrong position: %v", pos)
+    }
+
+    if end := def.End(); end.Line != 6 {
+        t.Errorf("function definition has the wrong end: %v", end)
+    }
+}
+
+func TestParseErrorRecovery(t *testing.T) {
+    p := new(Parser).Init("test.py", strings.NewReader("x = 1 +\ny = 2\nz = 3\n"))
+    p.Error = func(p *Parser, pos Position, msg string) {}
+
+    mod := p.Parse()
+
+    if p.ErrorCount == 0 {
+        t.Errorf("expected a parse error")
+    }
+
+    if len(mod.Body) != 2 {
+        t.Errorf("expected the parser to recover after the error")
+    }
+}
+
+// Checks that an incremental reparse produces the same tree as parsing from scratch.
+func checkReparse(t *testing.T, src string, start, end int, text string) {
+    p, mod := parseSource(t, src)
+
+    new_src := src[0:start] + text + src[end:]
+    mod = p.Reparse(mod, new_src, start, end, start+len(text))
+
+    _, want := parseSource(t, new_src)
+
+    got_nodes := make([]Ast, 0, 32)
+    Walk(mod, func(n Ast) bool { got_nodes = append(got_nodes, n); return true })
+
+    want_nodes := make([]Ast, 0, 32)
+    Walk(want, func(n Ast) bool { want_nodes = append(want_nodes, n); return true })
+
+    if fmt.Sprint(mod.TypeIgnores) != fmt.Sprint(want.TypeIgnores) {
+        t.Errorf("reparse of %q has type: ignore lines %v, wanted %v", text, mod.TypeIgnores, want.TypeIgnores)
+    }
+
+    if len(got_nodes) != len(want_nodes) {
+        t.Fatalf("reparse of %q produced %v nodes, wanted %v", text, len(got_nodes), len(want_nodes))
+    }
+
+    for i := range got_nodes {
+        if got_nodes[i].Pos() != want_nodes[i].Pos() || got_nodes[i].End() != want_nodes[i].End() {
+            t.Errorf("reparse of %q: node %v (%T) at %v-%v, wanted %v-%v", text, i, got_nodes[i],
+                got_nodes[i].Pos(), got_nodes[i].End(), want_nodes[i].Pos(), want_nodes[i].End())
+        }
+    }
+}
+
+func TestReparse(t *testing.T) {
+    body := strings.Index(parserSource, "a + b")
+    last := strings.Index(parserSource, "y = ")
+
+    // Edit inside a function body
+    checkReparse(t, parserSource, body, body+1, "a - 1")
+
+    // Add lines to the first statement
+    checkReparse(t, parserSource, 1, 1, "\nz = 3\nw")
+
+    // Delete the blank line before the last statement
+    checkReparse(t, parserSource, last-1, last, "")
+
+    // Add a statement at the end of the file
+    checkReparse(t, parserSource, len(parserSource), len(parserSource), "print(y)\n")
+
+    // Indent the last statement into the function, so the whole file has to be
+    // read again
+    checkReparse(t, parserSource, last-1, last, "    x = 2\n")
+}
+
+func TestParseFString(t *testing.T) {
+    _, mod := parseSource(t, "s = f'a{x!r:>{width}}b{y + 1}' 'c'\n")
+
+    value := mod.Body[0].(*AssignNode).Value
+    joined, ok := value.(*JoinedStrNode)
+    if !ok {
+        t.Fatalf("expected a JoinedStrNode, got %T", value)
+    }
+
+    if len(joined.Values) != 5 {
+        t.Fatalf("expected 5 parts, got %v", len(joined.Values))
+    }
+
+    for i, want := range map[int]string{0: "a", 2: "b", 4: "c"} {
+        if lit, ok := joined.Values[i].(*LiteralStringNode); !ok || lit.Value != want {
+            t.Errorf("expected the literal '%v', got %v", want, joined.Values[i])
+        }
+    }
+
+    field, ok := joined.Values[1].(*FormattedValueNode)
+    if !ok {
+        t.Fatalf("expected a FormattedValueNode, got %T", joined.Values[1])
+    }
+
+    if name, ok := field.Value.(*NameNode); !ok || name.Id != "x" || name.Pos().Column != 9 {
+        t.Errorf("replacement field expression parsed incorrectly: %v", field.Value)
+    }
+
+    if field.Conversion != 'r' {
+        t.Errorf("expected the !r conversion, got %v", field.Conversion)
+    }
+
+    spec, ok := field.FormatSpec.(*JoinedStrNode)
+    if !ok || len(spec.Values) != 2 {
+        t.Fatalf("format spec parsed incorrectly: %v", field.FormatSpec)
+    }
+
+    if _, ok := spec.Values[1].(*FormattedValueNode); !ok {
+        t.Errorf("expected a nested replacement field in the format spec, got %T", spec.Values[1])
+    }
+
+    if sum, ok := joined.Values[3].(*FormattedValueNode); !ok {
+        t.Errorf("expected a FormattedValueNode, got %T", joined.Values[3])
+    } else if _, ok := sum.Value.(*BinOpNode); !ok {
+        t.Errorf("expected y + 1, got %T", sum.Value)
+    }
+}
+
+func TestParseFStringErrors(t *testing.T) {
+    for _, src := range []string{"f'{}'\n", "f'{x!z}'\n", "f'}'\n", "f'{x'\n"} {
+        p := new(Parser).Init("test.py", strings.NewReader(src))
+        p.Error = func(p *Parser, pos Position, msg string) {}
+        p.Parse()
+
+        if p.ErrorCount == 0 {
+            t.Errorf("expected an error parsing %q", src)
+        }
+    }
+}
+
+const typeCommentSource = `x = []  # type: List[int]
+def f(a,  # type: int
+      b):
+    # type: (...) -> str
+    return a
+
+def g(a, b):  # type: (int, int) -> None
+    for i in a:  # type: int
+        pass
+
+y = f(x)  # type: ignore
+`
+
+func TestParseTypeComments(t *testing.T) {
+    _, mod := parseSource(t, typeCommentSource)
+
+    if c := mod.Body[0].(*AssignNode).TypeComment; c != "List[int]" {
+        t.Errorf("wrong type comment for assignment: '%v'", c)
+    }
+
+    f := mod.Body[1].(*FunctionDefNode)
+    if f.TypeComment != "(...) -> str" {
+        t.Errorf("wrong type comment for function on the line after def: '%v'", f.TypeComment)
+    }
+
+    if f.Args[0].TypeComment != "int" || f.Args[1].TypeComment != "" {
+        t.Errorf("wrong type comments for arguments: '%v' '%v'", f.Args[0].TypeComment, f.Args[1].TypeComment)
+    }
+
+    g := mod.Body[2].(*FunctionDefNode)
+    if g.TypeComment != "(int, int) -> None" {
+        t.Errorf("wrong type comment for function: '%v'", g.TypeComment)
+    }
+
+    if c := g.Body[0].(*ForNode).TypeComment; c != "int" {
+        t.Errorf("wrong type comment for loop: '%v'", c)
+    }
+
+    if c := mod.Body[3].(*AssignNode).TypeComment; c != "" {
+        t.Errorf("type: ignore should not be a type comment, got '%v'", c)
+    }
+
+    if len(mod.TypeIgnores) != 1 || mod.TypeIgnores[0] != 11 {
+        t.Errorf("wrong type: ignore lines: %v", mod.TypeIgnores)
+    }
+
+    // Adding lines to the first function moves the type: ignore comment
+    body := strings.Index(typeCommentSource, "return a")
+    checkReparse(t, typeCommentSource, body, body, "a += 1\n    ")
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module writes the perf map of the JIT, so that Linux perf can put the
+   samples it takes in compiled loops down to the Python code they were
+   compiled from.  perf knows nothing of code that isn't in a file it can read
+   symbols from, but it looks for /tmp/perf-PID.map for a process, whose lines
+   each give the start address, the size and the name of a region of code, in
+   hex and text:
+
+       7f3a2c001000 1a0 py::fib@fib.py:3
+
+   A code cache with a perf map adds a line for each loop it is given that has
+   an address.  The lines are never taken back when a loop is evicted, since
+   perf reads the whole file when it reports, and the region may have been
+   sampled while the loop was there.
+*/
+
+package python
+
+import (
+    "fmt"
+    "io"
+    "os"
+)
+
+// Writes the regions of compiled code to a perf map.  Err is the first error writing
+// it, after which nothing more is written.
+type PerfMap struct {
+    w       io.Writer
+    Err     os.Error
+}
+
+// Returns a perf map that writes to w.
+func NewPerfMap(w io.Writer) (*PerfMap) {
+    return &PerfMap{w, nil}
+}
+
+// Creates /tmp/perf-PID.map for the process, where perf looks for it.
+func CreatePerfMap() (*PerfMap, os.Error) {
+    f, err := os.Create(PerfMapPath(os.Getpid()))
+    if err != nil {
+        return nil, err
+    }
+    return NewPerfMap(f), nil
+}
+
+// Returns the path of the perf map of the process pid.
+func PerfMapPath(pid int) (string) {
+    return fmt.Sprintf("/tmp/perf-%d.map", pid)
+}
+
+// Adds the region of size bytes at start, with the name.
+func (p *PerfMap) Add(start uintptr, size int, name string) (os.Error) {
+    if p.Err == nil {
+        _, p.Err = fmt.Fprintf(p.w, "%x %x %s\n", start, size, name)
+    }
+    return p.Err
+}
+
+// Closes the writer of the map, if it can be closed, and returns the first error writing
+// the map or closing it.
+func (p *PerfMap) Close() (os.Error) {
+    if c, ok := p.w.(io.Closer); ok {
+        if err := c.Close(); p.Err == nil {
+            p.Err = err
+        }
+    }
+    return p.Err
+}
+
+// Returns the name perf shows for the loop at head in c, which names the function and
+// the source line of the loop.
+func PerfName(c *CodeObject, head uint32) (string) {
+    name := c.Name
+    if name == "" {
+        name = "<code>"
+    }
+    if c.Filename == "" {
+        return fmt.Sprintf("py::%v@%v", name, head)
+    }
+    return fmt.Sprintf("py::%v@%v:%v", name, c.Filename, c.Line(head))
+}
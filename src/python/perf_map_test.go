@@ -0,0 +1,55 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the perf map of the JIT.
+
+*/
+
+package python
+
+import (
+        "bytes"
+        "testing"
+)
+
+func TestPerfMap(t *testing.T) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    s := mod.NewCode("sum")
+    s.Filename = "sum.py"
+    s.FirstLine = 10
+    writeSumLoop(s, 100)
+    other := new (CodeObject)
+    other.Init()
+    writeSumLoop(other, 100)
+
+    // Only the loops with an address are written to the map.
+    out := new (bytes.Buffer)
+    cc := NewCodeCache(0)
+    cc.PerfMap = NewPerfMap(out)
+    cc.Add(s, 4, "", &CompiledLoop{Run: bailoutLoop, Addr: 0x7f0000001000, Size: 0x1a0})
+    cc.Add(other, 4, "", &CompiledLoop{Run: bailoutLoop, Addr: 0x7f0000002000, Size: 16})
+    cc.Add(other, 4, "x", &CompiledLoop{Run: bailoutLoop})
+    want := "7f0000001000 1a0 py::sum@sum.py:10\n" +
+            "7f0000002000 10 py::<code>@4\n"
+    if out.String() != want || cc.PerfMap.Close() != nil {
+        t.Errorf("expected:\n%v\ngot:\n%v", want, out.String())
+    }
+
+    if path := PerfMapPath(1234); path != "/tmp/perf-1234.map" {
+        t.Errorf("expected /tmp/perf-1234.map, got %v", path)
+    }
+}
@@ -0,0 +1,159 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the profiler of the machine.  While profiling is on,
+   the machine counts the instructions it dispatches, by opcode and by the
+   address of each instruction in its code object, so the report shows both
+   the hot spots of the program and which instructions the dispatch loop
+   spends its time on.  An instruction is counted whether or not its predicate
+   lets it run, since it costs a dispatch either way.
+*/
+
+package python
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "sort"
+)
+
+// The counts gathered by the profiler.
+type Profile struct {
+    Total       uint64
+    Opcodes     [64]uint64
+    
+    // The count of each instruction, by its code object and address.
+    counts      map[*CodeObject][]uint64
+}
+
+// The count of a single instruction.
+type ProfileEntry struct {
+    Code        *CodeObject
+    Address     uint32
+    Count       uint64
+}
+
+type profileEntries []ProfileEntry
+
+func (l profileEntries) Len() (int) {
+    return len(l)
+}
+
+func (l profileEntries) Less(i, j int) (bool) {
+    return l[i].Count > l[j].Count
+}
+
+func (l profileEntries) Swap(i, j int) {
+    l[i], l[j] = l[j], l[i]
+}
+
+// Turns profiling on, with all the counts at 0, or off.
+func (m *Machine) SetProfiling(on bool) {
+    m.profile = nil
+    if on {
+        m.profile = &Profile{counts: make(map[*CodeObject][]uint64)}
+    }
+}
+
+// Returns the counts gathered since profiling was turned on, or nil if it is off.
+func (m *Machine) Profile() (*Profile) {
+    return m.profile
+}
+
+// Counts the dispatch of the instruction at pc in c.
+func (p *Profile) count(c *CodeObject, pc uint32, op uint32) {
+    p.Total++
+    p.Opcodes[op]++
+    
+    counts := p.counts[c]
+    if int(pc) >= len(counts) {
+        grown := make([]uint64, len(c.Decoded()))
+        copy(grown, counts)
+        counts = grown
+        p.counts[c] = counts
+    }
+    counts[pc]++
+}
+
+// Returns the number of times the instruction at address in c was dispatched.
+func (p *Profile) Count(c *CodeObject, address uint32) (uint64) {
+    counts := p.counts[c]
+    if int(address) < len(counts) {
+        return counts[address]
+    }
+    return 0
+}
+
+// Returns the n instructions dispatched the most, the most first, or all of them if
+// n is 0.
+func (p *Profile) Hottest(n int) ([]ProfileEntry) {
+    var entries profileEntries
+    for c, counts := range p.counts {
+        for pc, count := range counts {
+            if count > 0 {
+                entries = append(entries, ProfileEntry{c, uint32(pc), count})
+            }
+        }
+    }
+    sort.Sort(entries)
+    
+    if n > 0 && n < len(entries) {
+        entries = entries[0:n]
+    }
+    return entries
+}
+
+// Writes a report of the counts of the opcodes, and of the n instructions dispatched the
+// most, to w.
+func (p *Profile) Report(w io.Writer, n int) (os.Error) {
+    percent := func(count uint64) (float64) {
+        if p.Total == 0 {
+            return 0
+        }
+        return 100 * float64(count) / float64(p.Total)
+    }
+    
+    var opcodes profileEntries
+    for op, count := range p.Opcodes {
+        if count > 0 {
+            opcodes = append(opcodes, ProfileEntry{nil, uint32(op), count})
+        }
+    }
+    sort.Sort(opcodes)
+    
+    if _, err := fmt.Fprintf(w, "%v instructions dispatched\n\n%-11v %10v %6v\n", p.Total, "opcode", "count", "%"); err != nil {
+        return err
+    }
+    for _, e := range opcodes {
+        if _, err := fmt.Fprintf(w, "%-11v %10v %6.1f\n", OpcodeName(e.Address), e.Count, percent(e.Count)); err != nil {
+            return err
+        }
+    }
+    
+    if _, err := fmt.Fprintf(w, "\n%10v %6v  %-20v %4v  instruction\n", "count", "%", "code", "line"); err != nil {
+        return err
+    }
+    for _, e := range p.Hottest(n) {
+        ins := e.Code.Decoded()[e.Address]
+        where := fmt.Sprintf("%v:%v", e.Code.Name, e.Address)
+        _, err := fmt.Fprintf(w, "%10v %6.1f  %-20v %4v  %v\n", e.Count, percent(e.Count), where, e.Code.Line(e.Address), formatInstruction(e.Code, &ins))
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
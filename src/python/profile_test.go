@@ -0,0 +1,80 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the profiler.
+
+*/
+
+package python
+
+import (
+        "bytes"
+        "strings"
+        "testing"
+)
+
+func TestProfile(t *testing.T) {
+    s := new (CodeObject)
+    s.Init()
+    s.Name = "loop"
+    writeSumLoop(s, 10)
+    
+    m := new (Machine)
+    if m.Profile() != nil {
+        t.Errorf("profiling should be off until it is turned on")
+    }
+    m.SetProfiling(true)
+    if _, err := m.Run(s); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    
+    // The comparison and the exit run once more than the body of the loop.
+    p := m.Profile()
+    if p.Total != 57 || p.Opcodes[JMP] != 21 || p.Opcodes[ADD] != 11 || p.Opcodes[CONST] != 3 {
+        t.Errorf("expected 57 instructions, 21 jumps, 11 adds and 3 constants, got %v, %v, %v and %v",
+            p.Total, p.Opcodes[JMP], p.Opcodes[ADD], p.Opcodes[CONST])
+    }
+    counts := []uint64{1, 1, 1, 1, 11, 11, 10, 10, 10, 1}
+    for pc, count := range counts {
+        if p.Count(s, uint32(pc)) != count {
+            t.Errorf("expected instruction %v to run %v times, got %v", pc, count, p.Count(s, uint32(pc)))
+        }
+    }
+    
+    hottest := p.Hottest(2)
+    if len(hottest) != 2 || hottest[0].Count != 11 || hottest[1].Count != 11 || hottest[0].Code != s {
+        t.Errorf("expected the comparison and the exit to be hottest, got %v", hottest)
+    }
+    
+    buf := new (bytes.Buffer)
+    if err := p.Report(buf, 3); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    report := buf.String()
+    for _, expected := range []string{"57 instructions dispatched", "JMP                 21   36.8", "loop:4", "GT          r3, r1 -> p1"} {
+        if !strings.Contains(report, expected) {
+            t.Errorf("expected the report to contain '%v':\n%v", expected, report)
+        }
+    }
+    if strings.Contains(report, "loop:0") {
+        t.Errorf("the report should only list 3 instructions:\n%v", report)
+    }
+    
+    m.SetProfiling(false)
+    if m.Profile() != nil {
+        t.Errorf("profiling should be off")
+    }
+}
@@ -0,0 +1,363 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module reads the .pyc files written by CPython 3.11, which hold a code
+   object in CPython's marshal format behind a short header.  The values are
+   read into plain Go values: nil for None, bool, *big.Int, float64, string
+   for str, []byte for bytes, []interface{} for tuples and lists, and
+   *PycCode for code objects.  TranslatePyc turns the code objects into code
+   this machine can run.
+*/
+
+package python
+
+import (
+        "big"
+        "encoding/binary"
+        "fmt"
+        "io"
+        "math"
+        "os"
+)
+
+// The magic number of the .pyc files of CPython 3.11.
+const PycMagic = 3495
+
+// The marshal type codes.  A code with pycFlagRef set is remembered, so that a later
+// pycRef can refer back to it.
+const (
+    pycNull         = '0'
+    pycNone         = 'N'
+    pycFalse        = 'F'
+    pycTrue         = 'T'
+    pycStopIter     = 'S'
+    pycEllipsis     = '.'
+    pycInt          = 'i'
+    pycLong         = 'l'
+    pycFloat        = 'f'
+    pycBinaryFloat  = 'g'
+    pycComplex      = 'x'
+    pycBinaryComplex = 'y'
+    pycBytes        = 's'
+    pycInterned     = 't'
+    pycRef          = 'r'
+    pycTuple        = '('
+    pycSmallTuple   = ')'
+    pycList         = '['
+    pycDict         = '{'
+    pycCode         = 'c'
+    pycUnicode      = 'u'
+    pycSet          = '<'
+    pycFrozenSet    = '>'
+    pycAscii        = 'a'
+    pycAsciiInterned = 'A'
+    pycShortAscii   = 'z'
+    pycShortAsciiInterned = 'Z'
+    
+    pycFlagRef      = 0x80
+)
+
+// The kinds of the local variables of a code object.
+const (
+    PycFastLocal    = 0x20
+    PycFastCell     = 0x40
+    PycFastFree     = 0x80
+)
+
+// The flags of a code object.
+const (
+    PycVarArgs      = 0x04
+    PycVarKeywords  = 0x08
+    PycGenerator    = 0x20
+    PycCoroutine    = 0x80
+    PycIterableCoroutine = 0x100
+    PycAsyncGenerator = 0x200
+)
+
+// A code object, as CPython 3.11 writes it.  The local variables, the cell variables
+// and the free variables are all in LocalsPlusNames, and LocalsPlusKinds says which
+// is which.
+type PycCode struct {
+    ArgCount        int
+    PosOnlyArgCount int
+    KwOnlyArgCount  int
+    StackSize       int
+    Flags           int
+    
+    // The instructions, two bytes each, and the values they refer to.
+    Code            []byte
+    Consts          []interface{}
+    Names           []string
+    
+    LocalsPlusNames []string
+    LocalsPlusKinds []byte
+    
+    Filename        string
+    Name            string
+    QualName        string
+    FirstLine       int
+    LineTable       []byte
+    ExceptionTable  []byte
+}
+
+// Reads a marshalled value, and keeps the values flagged to be referred back to.
+type pycReader struct {
+    r       io.Reader
+    err     os.Error
+    refs    []interface{}
+    depth   int
+}
+
+func (p *pycReader) fail(msg string) {
+    if p.err == nil {
+        p.err = os.NewError("pyc: " + msg)
+    }
+}
+
+func (p *pycReader) bytes(n int) ([]byte) {
+    if p.err != nil {
+        return nil
+    }
+    if n < 0 || n > 1<<28 {
+        p.fail("corrupt length")
+        return nil
+    }
+    
+    buf := make([]byte, n)
+    _, p.err = io.ReadFull(p.r, buf)
+    return buf
+}
+
+func (p *pycReader) byte() (int) {
+    if b := p.bytes(1); b != nil {
+        return int(b[0])
+    }
+    return 0
+}
+
+func (p *pycReader) long() (int) {
+    if b := p.bytes(4); b != nil {
+        return int(int32(binary.LittleEndian.Uint32(b)))
+    }
+    return 0
+}
+
+// Reads an int made of 15 bit digits, least significant first, preceded by the number
+// of digits, which is negative if the int is.
+func (p *pycReader) bigInt() (*big.Int) {
+    n := p.long()
+    negative := n < 0
+    if negative {
+        n = -n
+    }
+    
+    digits := p.bytes(2*n)
+    v := new(big.Int)
+    for i := n-1; i >= 0 && p.err == nil; i-- {
+        v.Lsh(v, 15)
+        v.Add(v, big.NewInt(int64(binary.LittleEndian.Uint16(digits[2*i:]))))
+    }
+    if negative {
+        v.Neg(v)
+    }
+    return v
+}
+
+func (p *pycReader) float() (float64) {
+    var f float64
+    if _, err := fmt.Sscan(string(p.bytes(p.byte())), &f); err != nil {
+        p.fail("bad float")
+    }
+    return f
+}
+
+// Reads a value that has to be a string, like the name of a code object.
+func (p *pycReader) str() (string) {
+    s, ok := p.value().(string)
+    if !ok {
+        p.fail("expected a string")
+    }
+    return s
+}
+
+func (p *pycReader) strs() ([]string) {
+    items, ok := p.value().([]interface{})
+    if !ok {
+        p.fail("expected a tuple of strings")
+        return nil
+    }
+    
+    l := make([]string, len(items))
+    for i, item := range items {
+        if l[i], ok = item.(string); !ok {
+            p.fail("expected a tuple of strings")
+        }
+    }
+    return l
+}
+
+func (p *pycReader) byteString() ([]byte) {
+    b, ok := p.value().([]byte)
+    if !ok {
+        p.fail("expected bytes")
+    }
+    return b
+}
+
+func (p *pycReader) items(n int) ([]interface{}) {
+    if n < 0 || n > 1<<24 {
+        p.fail("corrupt length")
+        return nil
+    }
+    
+    items := make([]interface{}, n)
+    for i := range items {
+        items[i] = p.value()
+    }
+    return items
+}
+
+func (p *pycReader) code() (*PycCode) {
+    c := new(PycCode)
+    c.ArgCount = p.long()
+    c.PosOnlyArgCount = p.long()
+    c.KwOnlyArgCount = p.long()
+    c.StackSize = p.long()
+    c.Flags = p.long()
+    c.Code = p.byteString()
+    
+    consts, ok := p.value().([]interface{})
+    if !ok {
+        p.fail("expected a tuple of constants")
+    }
+    c.Consts = consts
+    c.Names = p.strs()
+    c.LocalsPlusNames = p.strs()
+    c.LocalsPlusKinds = p.byteString()
+    c.Filename = p.str()
+    c.Name = p.str()
+    c.QualName = p.str()
+    c.FirstLine = p.long()
+    c.LineTable = p.byteString()
+    c.ExceptionTable = p.byteString()
+    
+    if p.err == nil && len(c.LocalsPlusNames) != len(c.LocalsPlusKinds) {
+        p.fail("the local variables don't match their kinds")
+    }
+    return c
+}
+
+// Reads the next value.
+func (p *pycReader) value() (v interface{}) {
+    code := p.byte()
+    if p.err != nil {
+        return nil
+    }
+    
+    p.depth++
+    defer func() { p.depth-- }()
+    if p.depth > 200 {
+        p.fail("values nested too deeply")
+        return nil
+    }
+    
+    // The reference is reserved before the contents are read, since they can have
+    // references of their own.
+    ref := -1
+    if code & pycFlagRef != 0 {
+        ref = len(p.refs)
+        p.refs = append(p.refs, nil)
+        code &^= pycFlagRef
+    }
+    
+    switch code {
+        case pycNone:
+            v = nil
+        case pycFalse:
+            v = false
+        case pycTrue:
+            v = true
+        case pycInt:
+            v = big.NewInt(int64(p.long()))
+        case pycLong:
+            v = p.bigInt()
+        case pycFloat:
+            v = p.float()
+        case pycBinaryFloat:
+            if b := p.bytes(8); b != nil {
+                v = math.Float64frombits(binary.LittleEndian.Uint64(b))
+            }
+        case pycBytes:
+            v = p.bytes(p.long())
+        case pycUnicode, pycInterned, pycAscii, pycAsciiInterned:
+            v = string(p.bytes(p.long()))
+        case pycShortAscii, pycShortAsciiInterned:
+            v = string(p.bytes(p.byte()))
+        case pycTuple, pycList:
+            v = p.items(p.long())
+        case pycSmallTuple:
+            v = p.items(p.byte())
+        case pycCode:
+            v = p.code()
+        
+        case pycRef:
+            i := p.long()
+            if p.err == nil && (i < 0 || i >= len(p.refs)) {
+                p.fail("bad reference")
+                return nil
+            }
+            if p.err == nil {
+                v = p.refs[i]
+            }
+        
+        default:
+            p.fail(fmt.Sprintf("unsupported value of type '%c'", code))
+    }
+    
+    if ref >= 0 {
+        p.refs[ref] = v
+    }
+    return v
+}
+
+// Reads a marshalled value from r.
+func Unmarshal(r io.Reader) (interface{}, os.Error) {
+    p := &pycReader{r: r}
+    v := p.value()
+    return v, p.err
+}
+
+// Reads the .pyc file in r, and returns the code object of the module in it.  The file
+// has to be written by CPython 3.11, since the instructions change with each version.
+func ReadPyc(r io.Reader) (*PycCode, os.Error) {
+    header := make([]byte, 16)
+    if _, err := io.ReadFull(r, header); err != nil {
+        return nil, err
+    }
+    if binary.LittleEndian.Uint16(header) != PycMagic || header[2] != '\r' || header[3] != '\n' {
+        return nil, os.NewError(fmt.Sprintf("pyc: not a CPython 3.11 file (magic number %v)", binary.LittleEndian.Uint16(header)))
+    }
+    
+    v, err := Unmarshal(r)
+    if err != nil {
+        return nil, err
+    }
+    code, ok := v.(*PycCode)
+    if !ok {
+        return nil, os.NewError("pyc: the file doesn't hold a code object")
+    }
+    return code, nil
+}
@@ -0,0 +1,312 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the CPython bytecode importer.  The .pyc files in test_data were
+  compiled by CPython 3.11 from the .py files next to them.
+
+*/
+
+package python
+
+import (
+        "bytes"
+        "big"
+        "fmt"
+        "os"
+        "testing"
+)
+
+func importPyc(t *testing.T, filename string) (*ModuleCode) {
+    f, err := os.Open(filename)
+    if err != nil {
+        t.Fatalf("can't open %v: %v", filename, err)
+    }
+    defer f.Close()
+    
+    py, err := ReadPyc(f)
+    if err != nil {
+        t.Fatalf("can't read %v: %v", filename, err)
+    }
+    mod, err := TranslatePyc("sample", py)
+    if err != nil {
+        t.Fatalf("can't translate %v: %v", filename, err)
+    }
+    return mod
+}
+
+func TestUnmarshal(t *testing.T) {
+    // (None, True, -5, 2**40, 1.5, 'hi', b'\x00', ('hi',)), with the string
+    // referred back to.
+    data := []byte{
+        ')', 8,
+        'N', 'T',
+        'i', 0xfb, 0xff, 0xff, 0xff,
+        'l', 3, 0, 0, 0, 0, 0, 0, 0, 0, 0x04,
+        'g', 0, 0, 0, 0, 0, 0, 0xf8, 0x3f,
+        'z' | 0x80, 2, 'h', 'i',
+        's', 1, 0, 0, 0, 0,
+        ')', 1, 'r', 0, 0, 0, 0,
+    }
+    v, err := Unmarshal(bytes.NewBuffer(data))
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    
+    items := v.([]interface{})
+    if len(items) != 8 || items[0] != nil || items[1] != true {
+        t.Fatalf("wrong values %v", items)
+    }
+    if items[2].(*big.Int).Int64() != -5 || items[3].(*big.Int).Cmp(new(big.Int).Lsh(big.NewInt(1), 40)) != 0 {
+        t.Errorf("expected -5 and 2**40, got %v and %v", items[2], items[3])
+    }
+    if items[4].(float64) != 1.5 || items[5].(string) != "hi" || len(items[6].([]byte)) != 1 {
+        t.Errorf("expected 1.5, 'hi' and b'\\x00', got %v", items[4:7])
+    }
+    if items[7].([]interface{})[0].(string) != "hi" {
+        t.Errorf("the reference should be to 'hi', got %v", items[7])
+    }
+    
+    // Every truncation must be an error, not a panic.
+    for n := 0; n < len(data); n++ {
+        if _, err := Unmarshal(bytes.NewBuffer(data[0:n])); err == nil {
+            t.Errorf("reading %v of %v bytes succeeded", n, len(data))
+        }
+    }
+    if _, err := Unmarshal(bytes.NewBuffer([]byte{'r', 5, 0, 0, 0})); err == nil {
+        t.Errorf("a reference to nothing should fail")
+    }
+}
+
+func TestImportPyc(t *testing.T) {
+    mod := importPyc(t, "test_data/pyc_sample.pyc")
+    
+    m := new (Machine)
+    result, err := m.RunModule(mod)
+    if err != nil {
+        t.Fatalf("unexpected error: %v\n%v", err, m.Traceback)
+    }
+    if result != None {
+        t.Errorf("the module should return None, got %v", result)
+    }
+    
+    // The values the module computes under CPython.
+    tests := []struct {
+        name    string
+        value   string
+    }{
+        {"xs", "(11, 5)"},
+        {"t", "1"},
+        {"x", "-5"},
+        {"y", "-5"},
+        {"z", "7"},
+        {"first", "11"},
+        {"second", "5"},
+        {"items", "[11, 5, 2]"},
+        {"d", "{a: 1, b: 2}"},
+        {"got", "1"},
+        {"flag", "1"},
+        {"s", "{1}"},
+    }
+    for _, test := range tests {
+        value, present := mod.Globals[test.name]
+        if !present {
+            t.Errorf("%v is not bound", test.name)
+            continue
+        }
+        if value.AsString() != test.value {
+            t.Errorf("expected %v to be %v, got %v", test.name, test.value, value.AsString())
+        }
+    }
+    
+    add := mod.Globals["add"].(*FunctionObject)
+    if add.Code.NumParams != 2 || len(add.Defaults) != 1 || add.Code.Filename != "sample.py" {
+        t.Errorf("add should take 2 parameters, with a default")
+    }
+    if line := add.Code.Line(add.Code.Here()-1); line != 2 {
+        t.Errorf("the return of add should be on line 2, got %v", line)
+    }
+}
+
+func TestImportPycGenerator(t *testing.T) {
+    mod := importPyc(t, "test_data/pyc_generator.pyc")
+    
+    m := new (Machine)
+    if _, err := m.RunModule(mod); err != nil {
+        t.Fatalf("unexpected error: %v\n%v", err, m.Traceback)
+    }
+    for name, value := range map[string]string{"total": "10", "sum_squares": "14", "empty": "0"} {
+        if got, present := mod.Globals[name]; !present || got.AsString() != value {
+            t.Errorf("expected %v to be %v, got %v", name, value, got)
+        }
+    }
+    
+    // count(5) restarts from the value sent in, and returns where it stopped.
+    count := mod.Globals["count"].(*FunctionObject)
+    m = new (Machine)
+    m.Frame.Reserve(count.Code)
+    if err := m.enter(count, []Object{intObject(5)}, nil, nil, 1); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    g, ok := m.Register[1].(*GeneratorObject)
+    if !ok {
+        t.Fatalf("calling count should make a generator, got %v", m.Register[1])
+    }
+    
+    var got []string
+    for _, send := range []Object{None, None, intObject(3)} {
+        value, err := g.Send(send)
+        if err != nil {
+            t.Fatalf("unexpected error: %v", err)
+        }
+        got = append(got, value.AsString())
+    }
+    if fmt.Sprint(got) != "[0 1 4]" {
+        t.Errorf("expected the generator to yield [0 1 4], got %v", got)
+    }
+    if _, err := g.Send(None); err != StopIteration || g.Value.AsString() != "5" {
+        t.Errorf("expected the generator to stop with 5, got %v and %v", err, g.Value)
+    }
+}
+
+func TestImportPycSlice(t *testing.T) {
+    mod := importPyc(t, "test_data/pyc_slice.pyc")
+    
+    m := new (Machine)
+    if _, err := m.RunModule(mod); err != nil {
+        t.Fatalf("unexpected error: %v\n%v", err, m.Traceback)
+    }
+    
+    // The values the module computes under CPython.
+    tests := map[string]string{
+        "head":     "[1, 2]",
+        "tail":     "[4, 5]",
+        "evens":    "[1, 3, 5]",
+        "back":     "olléh",
+        "mid":      "(2, 3)",
+        "items":    "[0, 20, 30, 0, 4, 5]",
+    }
+    for name, value := range tests {
+        if got, present := mod.Globals[name]; !present || got.AsString() != value {
+            t.Errorf("expected %v to be %v, got %v", name, value, got)
+        }
+    }
+}
+
+// The names KW_NAMES sets have to reach the CALL after the PRECALL between them.
+func TestImportPycKeywords(t *testing.T) {
+    mod := importPyc(t, "test_data/pyc_keywords.pyc")
+    
+    m := new (Machine)
+    if _, err := m.RunModule(mod); err != nil {
+        t.Fatalf("unexpected error: %v\n%v", err, m.Traceback)
+    }
+    
+    // The values the module computes under CPython.
+    for name, value := range map[string]string{"a": "3", "b": "7", "c": "8"} {
+        if got, present := mod.Globals[name]; !present || got.AsString() != value {
+            t.Errorf("expected %v to be %v, got %v", name, value, got)
+        }
+    }
+}
+
+func TestImportPycBuiltins(t *testing.T) {
+    mod := importPyc(t, "test_data/pyc_builtins.pyc")
+    
+    var out bytes.Buffer
+    interp := NewInterpreter()
+    interp.Stdout = &out
+    m := interp.NewMachine()
+    if _, err := m.RunModule(mod); err != nil {
+        t.Fatalf("unexpected error: %v\n%v", err, m.Traceback)
+    }
+    
+    // What the module prints under CPython.
+    expected := "len: 3\n\"it's\" [3, 1, 2]!\nlist float type\nint\n10 1 7 2\n\nTrue False True bool True 2\n59049 0.3333333333333333 81\n"
+    if out.String() != expected {
+        t.Errorf("expected the module to print %q, got %q", expected, out.String())
+    }
+}
+
+// Calls the coroutine function in the global name of mod with args.
+func newPycCoroutine(t *testing.T, mod *ModuleCode, name string, args ...Object) (*CoroutineObject) {
+    fn := mod.Globals[name].(*FunctionObject)
+    m := new (Machine)
+    m.Frame.Reserve(fn.Code)
+    if err := m.enter(fn, args, nil, nil, 1); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    c, ok := m.Register[1].(*CoroutineObject)
+    if !ok {
+        t.Fatalf("calling %v should make a coroutine, got %v", name, m.Register[1])
+    }
+    return c
+}
+
+func TestImportPycCoroutine(t *testing.T) {
+    mod := importPyc(t, "test_data/pyc_coroutine.pyc")
+    if _, err := new (Machine).RunModule(mod); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    
+    // add(a, b) waits for a, which is done, and then for b, which is set by the loop
+    // while add waits for it.
+    loop := NewEventLoop()
+    a, b := NewFuture(), NewFuture()
+    a.SetResult(intObject(3))
+    loop.CallSoon(func() { b.SetResult(intObject(4)) })
+    
+    result, err := loop.RunUntilComplete(newPycCoroutine(t, mod, "add", a, b))
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if result.AsString() != "14" {
+        t.Errorf("expected add to return 14, got %v", result)
+    }
+    
+    // One task can await another.
+    loop = NewEventLoop()
+    b = NewFuture()
+    b.SetResult(intObject(5))
+    a = loop.CreateTask(newPycCoroutine(t, mod, "double", b))
+    if result, err = loop.RunUntilComplete(newPycCoroutine(t, mod, "add", a, b)); err != nil || result.AsString() != "30" {
+        t.Errorf("expected add to return 30, got %v, %v", result, err)
+    }
+    
+    // Nothing sets a future that is never done, so the loop runs out of things to do.
+    if _, err = NewEventLoop().RunUntilComplete(newPycCoroutine(t, mod, "double", NewFuture())); err == nil {
+        t.Errorf("waiting for a future that is never done should fail")
+    }
+}
+
+func TestImportPycErrors(t *testing.T) {
+    f, err := os.Open("test_data/pyc_try.pyc")
+    if err != nil {
+        t.Fatalf("can't open the file: %v", err)
+    }
+    defer f.Close()
+    
+    py, err := ReadPyc(f)
+    if err != nil {
+        t.Fatalf("can't read the file: %v", err)
+    }
+    if _, err := TranslatePyc("try", py); err == nil {
+        t.Errorf("translating a try statement should fail")
+    }
+    
+    if _, err := ReadPyc(bytes.NewBufferString("not a pyc file at all")); err == nil {
+        t.Errorf("reading a file with the wrong magic number should fail")
+    }
+}
@@ -0,0 +1,1054 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module translates the stack based instructions of CPython 3.11 into
+   the register instructions of this machine, so that a module compiled by
+   CPython can run here.  The depth of CPython's stack is known at every
+   instruction, so each slot of the stack simply becomes a register: the
+   bottom slot is r1, the next r2, and so on.  A function whose stack doesn't
+   fit in the registers can't be translated.
+
+   The translator keeps track of what is in each slot as it goes.  Some
+   values never need to be in a register: the NULL that CPython pushes below
+   a function that isn't a method, the code of a function that is about to be
+   made, and the cells that are gathered up for a closure.  A function is made
+   from a constant, with its default values, if any, also taken from a
+   constant, which is the way CPython compiles them unless a default isn't a
+   constant.
+
+   Only a part of the instruction set is supported: the instructions for
+   names, constants, arithmetic, comparisons, calls, containers, loops,
+   closures, generators and coroutines.  Exception handling, async
+   generators, classes and imports are not, and a code object that uses them
+   fails to translate.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+// The CPython 3.11 opcodes that are translated.
+const (
+    pyCache                 = 0
+    pyPopTop                = 1
+    pyPushNull              = 2
+    pyNop                   = 9
+    pyUnaryPositive         = 10
+    pyUnaryNegative         = 11
+    pyUnaryNot              = 12
+    pyUnaryInvert           = 15
+    pyBinarySubscr          = 25
+    pyStoreSubscr           = 60
+    pyGetIter               = 68
+    pyReturnGenerator       = 75
+    pyReturnValue           = 83
+    pyYieldValue            = 86
+    pyStoreName             = 90
+    pyUnpackSequence        = 92
+    pyForIter               = 93
+    pyStoreAttr             = 95
+    pyStoreGlobal           = 97
+    pySwap                  = 99
+    pyLoadConst             = 100
+    pyLoadName              = 101
+    pyBuildTuple            = 102
+    pyBuildList             = 103
+    pyBuildSet              = 104
+    pyBuildMap              = 105
+    pyLoadAttr              = 106
+    pyCompareOp             = 107
+    pyJumpForward           = 110
+    pyJumpIfFalseOrPop      = 111
+    pyJumpIfTrueOrPop       = 112
+    pyPopJumpForwardIfFalse = 114
+    pyPopJumpForwardIfTrue  = 115
+    pyLoadGlobal            = 116
+    pyCopy                  = 120
+    pySend                  = 123
+    pyBinaryOp              = 122
+    pyLoadFast              = 124
+    pyStoreFast             = 125
+    pyPopJumpForwardIfNotNone = 128
+    pyPopJumpForwardIfNone  = 129
+    pyGetAwaitable          = 131
+    pyMakeFunction          = 132
+    pyBuildSlice            = 133
+    pyJumpBackwardNoInterrupt = 134
+    pyMakeCell              = 135
+    pyLoadClosure           = 136
+    pyLoadDeref             = 137
+    pyStoreDeref            = 138
+    pyJumpBackward          = 140
+    pyExtendedArg           = 144
+    pyCopyFreeVars          = 149
+    pyResume                = 151
+    pyBuildConstKeyMap      = 156
+    pyLoadMethod            = 160
+    pyListExtend            = 162
+    pyPrecall               = 166
+    pyCall                  = 171
+    pyKwNames               = 172
+    pyPopJumpBackwardIfNotNone = 173
+    pyPopJumpBackwardIfNone = 174
+    pyPopJumpBackwardIfFalse = 175
+    pyPopJumpBackwardIfTrue = 176
+)
+
+// The operators of COMPARE_OP, and of BINARY_OP that have an instruction here.  The
+// in-place forms of the binary operators follow the others.
+var pyCompareOps = []uint32{LT, LE, EQ, NE, GT, GE}
+
+var pyBinaryOps = map[int]uint32{
+    0: ADD, 2: FDIV, 5: MUL, 6: MOD, 10: SUB, 11: DIV,
+}
+
+const pyInPlaceOps = 13
+
+// The BINARY_OP of **, which pow() does.
+const pyBinaryPow = 8
+
+// What a slot of the stack holds.
+const (
+    pySlotValue = iota
+    pySlotNull
+    pySlotCode
+    pySlotCell
+    pySlotClosure
+    pySlotEmptyList
+)
+
+type pySlot struct {
+    kind    int
+    
+    // The index in CPython's constants of the constant loaded into the slot, or -1.
+    konst   int
+}
+
+// The predicate register used for branches.
+const pyPred = 1
+
+type pycJump struct {
+    fixup   JumpFixup
+    target  int
+}
+
+type pycTranslator struct {
+    mod     *ModuleCode
+    py      *PycCode
+    c       *CodeObject
+    module  bool
+    
+    // The constants of the code converted to objects, and their indices in c.  The
+    // code objects are translated to functions.
+    consts  []Object
+    indices []uint16
+    
+    // The strings for the attribute names, by the index of the name.
+    attrs   map[int]uint16
+    
+    stack   []pySlot
+    dead    bool
+    pc      int
+    
+    // The address of each CPython instruction, by its index, whether it has been
+    // translated, and the stack at the targets of the jumps forward.
+    addr    []uint32
+    done    []bool
+    states  map[int][]pySlot
+    jumps   []pycJump
+    
+    // The names of the keyword arguments of the next CALL, or -1.
+    kwnames int
+    
+    // Set when pyPred holds the truth value of the top of the stack.
+    truth   bool
+    
+    err     os.Error
+}
+
+func (t *pycTranslator) fail(msg string) {
+    if t.err == nil {
+        t.err = os.NewError(fmt.Sprintf("%v: %v", t.py.Name, msg))
+    }
+}
+
+// Returns the register of the slot i, and makes sure the code has room for it.
+func (t *pycTranslator) reg(i int) (uint32) {
+    if i < 0 {
+        t.fail("stack underflow")
+        return 0
+    }
+    r := i + 1
+    if r >= MaxRegisters {
+        t.fail("the stack doesn't fit in the registers")
+        return 0
+    }
+    if r >= t.c.NumRegisters {
+        t.c.NumRegisters = r + 1
+    }
+    return uint32(r)
+}
+
+// The register of the slot n from the top of the stack, starting with 1.
+func (t *pycTranslator) top(n int) (uint32) {
+    return t.reg(len(t.stack) - n)
+}
+
+func (t *pycTranslator) push(kind, konst int) {
+    t.stack = append(t.stack, pySlot{kind, konst})
+}
+
+func (t *pycTranslator) pop(n int) {
+    if n > len(t.stack) {
+        t.fail("stack underflow")
+        n = len(t.stack)
+    }
+    t.stack = t.stack[0 : len(t.stack)-n]
+}
+
+// Returns the slot n from the top of the stack, starting with 1.
+func (t *pycTranslator) slot(n int) (pySlot) {
+    if n > len(t.stack) {
+        t.fail("stack underflow")
+        return pySlot{pySlotValue, -1}
+    }
+    return t.stack[len(t.stack)-n]
+}
+
+// Makes sure the slot n from the top holds a value, rather than something that has
+// no register.
+func (t *pycTranslator) value(n int) (uint32) {
+    if t.slot(n).kind != pySlotValue && t.slot(n).kind != pySlotEmptyList {
+        t.fail("unsupported use of the stack")
+    }
+    return t.top(n)
+}
+
+func (t *pycTranslator) copyStack() ([]pySlot) {
+    s := make([]pySlot, len(t.stack))
+    copy(s, t.stack)
+    return s
+}
+
+// Jumps to the CPython instruction target, if the predicate is set.  A jump forward
+// is patched once the target has been translated.
+func (t *pycTranslator) jump(target int, pred_bit bool, pred_reg uint32) {
+    t.branch(t.c.WriteJump(pred_bit, pred_reg), target)
+}
+
+func (t *pycTranslator) branch(fixup JumpFixup, target int) {
+    if target < 0 || target >= len(t.addr) {
+        t.fail("jump out of the code")
+        return
+    }
+    if target <= t.pc && !t.done[target] {
+        t.fail("jump back to unreachable code")
+        return
+    }
+    
+    if _, present := t.states[target]; !present {
+        t.states[target] = t.copyStack()
+    }
+    t.jumps = append(t.jumps, pycJump{fixup, target})
+}
+
+// Sets pyPred to the truth value of the top of the stack, unless it already has it,
+// and returns the value of the predicate that means true.
+func (t *pycTranslator) test() (bool) {
+    if t.truth {
+        return true
+    }
+    t.c.WriteNot(t.value(1), pyPred, false, 0)
+    return false
+}
+
+// Loads the constant with the index i into reg.
+func (t *pycTranslator) loadConst(i int, reg uint32) {
+    if i < 0 || i >= len(t.consts) {
+        t.fail("constant out of range")
+        return
+    }
+    t.c.WriteConstIndex(t.indices[i], reg, false, 0)
+}
+
+// Returns the index of the constant holding the name with the index i, for GET and SET.
+func (t *pycTranslator) attr(i int) (uint16) {
+    if i >= len(t.py.Names) {
+        t.fail("name out of range")
+        return 0
+    }
+    index, present := t.attrs[i]
+    if !present {
+        index = t.c.Constant(NewString(t.py.Names[i]))
+        t.attrs[i] = index
+    }
+    return index
+}
+
+func (t *pycTranslator) name(i int) (string) {
+    if i >= len(t.py.Names) {
+        t.fail("name out of range")
+        return ""
+    }
+    return t.py.Names[i]
+}
+
+func (t *pycTranslator) local(i int) (string) {
+    if i >= len(t.py.LocalsPlusNames) {
+        t.fail("local variable out of range")
+        return ""
+    }
+    return t.py.LocalsPlusNames[i]
+}
+
+func (t *pycTranslator) deref(i int) (uint32) {
+    index, present := t.c.DerefIndex(t.local(i))
+    if !present {
+        t.fail(fmt.Sprintf("'%v' is not kept in a cell", t.local(i)))
+    }
+    return uint32(index)
+}
+
+func pyInt(v int64) (*IntObject) {
+    return NewInt(v)
+}
+
+// Converts a constant read from a .pyc file to an object.  Code objects are
+// translated, and become functions.
+func (t *pycTranslator) convert(v interface{}) (Object) {
+    switch v := v.(type) {
+        case nil:
+            return None
+        case bool:
+            return pyBool(v)
+        case *big.Int:
+            return NewBigInt(v)
+        case float64:
+            return NewFloat(v)
+        case string:
+            return NewString(v)
+        case []byte:
+            return NewString(string(v))
+        case []interface{}:
+            items := make([]Object, len(v))
+            for i, item := range v {
+                if _, ok := item.(*PycCode); ok {
+                    t.fail("code in a tuple constant")
+                    return nil
+                }
+                items[i] = t.convert(item)
+            }
+            return NewTuple(items)
+        case *PycCode:
+            code, err := translatePyc(t.mod, v, false)
+            if err != nil {
+                t.fail(err.String())
+                return nil
+            }
+            return NewFunction(code, nil, t.mod.Globals)
+    }
+    
+    t.fail(fmt.Sprintf("unsupported constant %v", v))
+    return nil
+}
+
+// Works out the source line of each instruction from the line table of CPython 3.11.
+// Each entry of the table covers a number of instructions, and has a code that says how
+// the line changes, followed by the columns, which aren't needed here.  Instructions
+// without a line get 0.
+func pycLines(py *PycCode) ([]int) {
+    lines := make([]int, len(py.Code)/2)
+    table := py.LineTable
+    
+    i := 0
+    next := func() (int) {
+        if i >= len(table) {
+            return 0
+        }
+        i++
+        return int(table[i-1])
+    }
+    varint := func() (int) {
+        b := next()
+        v, shift := b & 63, uint(6)
+        for b & 64 != 0 && i < len(table) {
+            b = next()
+            v |= (b & 63) << shift
+            shift += 6
+        }
+        return v
+    }
+    svarint := func() (int) {
+        v := varint()
+        if v & 1 != 0 {
+            return -(v >> 1)
+        }
+        return v >> 1
+    }
+    
+    line, pc := py.FirstLine, 0
+    for i < len(table) {
+        b := next()
+        code, length := (b >> 3) & 15, (b & 7) + 1
+        
+        l := line
+        switch {
+            case code == 15:
+                l = 0
+            case code == 14:
+                line += svarint()
+                l = line
+                varint()
+                varint()
+                varint()
+            case code == 13:
+                line += svarint()
+                l = line
+            case code >= 10:
+                line += code - 10
+                l = line
+                next()
+                next()
+            default:
+                next()
+        }
+        
+        for ; length > 0 && pc < len(lines); length-- {
+            lines[pc] = l
+            pc++
+        }
+    }
+    return lines
+}
+
+// Returns the instructions that are the targets of jumps.
+func pycTargets(py *PycCode) ([]bool) {
+    targets := make([]bool, len(py.Code)/2)
+    arg := 0
+    for i := range targets {
+        op := int(py.Code[2*i])
+        arg |= int(py.Code[2*i+1])
+        
+        target := -1
+        switch op {
+            case pyExtendedArg:
+                arg <<= 8
+                continue
+            case pyForIter, pySend, pyJumpForward, pyJumpIfFalseOrPop, pyJumpIfTrueOrPop,
+                    pyPopJumpForwardIfFalse, pyPopJumpForwardIfTrue, pyPopJumpForwardIfNone,
+                    pyPopJumpForwardIfNotNone:
+                target = i+1+arg
+            case pyJumpBackward, pyJumpBackwardNoInterrupt, pyPopJumpBackwardIfFalse, pyPopJumpBackwardIfTrue,
+                    pyPopJumpBackwardIfNone, pyPopJumpBackwardIfNotNone:
+                target = i+1-arg
+        }
+        if target >= 0 && target < len(targets) {
+            targets[target] = true
+        }
+        arg = 0
+    }
+    return targets
+}
+
+// Translates one instruction.  The index of the next instruction is i+1, which is where
+// the jumps are relative to.
+func (t *pycTranslator) translate(i, op, arg int) {
+    c := t.c
+    truth := false
+    
+    switch op {
+        case pyNop, pyResume, pyMakeCell, pyCopyFreeVars:
+            truth = t.truth
+        
+        case pyPrecall:
+            // The names KW_NAMES set before PRECALL are for the CALL after it.
+            return
+        
+        case pyPopTop:
+            t.pop(1)
+        
+        case pyPushNull:
+            t.push(pySlotNull, -1)
+        
+        case pyReturnGenerator:
+            // The generator is made when the function is called, so there is
+            // nothing to do but push what the POP_TOP after this pops.
+            t.push(pySlotNull, -1)
+        
+        case pyYieldValue:
+            c.WriteYield(t.value(1), t.top(1), false, 0)
+        
+        case pyGetAwaitable:
+            // AWAIT checks what it awaits.
+            t.value(1)
+        
+        case pySend:
+            // CPython awaits in a loop that sends values in until the awaitable
+            // is done, and jumps out of it with the result.  AWAIT is the whole
+            // of the loop, so the rest of it is never reached.
+            t.pop(1)
+            c.WriteAwait(t.value(1), t.top(1), false, 0)
+            t.jump(i+1+arg, false, 0)
+            t.dead = true
+        
+        case pyLoadConst:
+            if arg >= len(t.consts) {
+                t.fail("constant out of range")
+                return
+            }
+            if _, ok := t.py.Consts[arg].(*PycCode); ok {
+                t.push(pySlotCode, arg)
+                break
+            }
+            t.push(pySlotValue, arg)
+            t.loadConst(arg, t.top(1))
+        
+        case pyLoadName:
+            t.push(pySlotValue, -1)
+            c.WriteLoad(t.name(arg), t.top(1), false, 0)
+        
+        case pyLoadGlobal:
+            if arg & 1 != 0 {
+                t.push(pySlotNull, -1)
+            }
+            t.push(pySlotValue, -1)
+            c.WriteLoad(t.name(arg >> 1), t.top(1), false, 0)
+        
+        case pyLoadFast:
+            t.push(pySlotValue, -1)
+            c.WriteLoad(t.local(arg), t.top(1), false, 0)
+        
+        case pyStoreName, pyStoreFast, pyStoreGlobal:
+            if op == pyStoreGlobal && !t.module {
+                t.fail("global statements are not supported")
+            }
+            var name string
+            if op == pyStoreFast {
+                name = t.local(arg)
+            } else {
+                name = t.name(arg)
+            }
+            c.WriteBind(name, t.value(1), false, 0)
+            t.pop(1)
+        
+        case pyLoadDeref:
+            t.push(pySlotValue, -1)
+            c.WriteLoadDeref(t.deref(arg), t.top(1), false, 0)
+        
+        case pyStoreDeref:
+            c.WriteStoreDeref(t.deref(arg), t.value(1), false, 0)
+            t.pop(1)
+        
+        case pyLoadClosure:
+            t.deref(arg)
+            t.push(pySlotCell, -1)
+        
+        case pyLoadAttr:
+            obj, name := t.value(1), t.reg(len(t.stack))
+            c.WriteConstIndex(t.attr(arg), name, false, 0)
+            c.WriteGet(obj, name, obj, false, 0)
+            t.stack[len(t.stack)-1].konst = -1
+        
+        case pyLoadMethod:
+            // Getting a method from an instance binds it, so it is called like
+            // any other function, with a NULL below it.
+            obj, name := t.value(1), t.reg(len(t.stack))
+            c.WriteConstIndex(t.attr(arg), name, false, 0)
+            c.WriteGet(obj, name, name, false, 0)
+            t.stack[len(t.stack)-1] = pySlot{pySlotNull, -1}
+            t.push(pySlotValue, -1)
+        
+        case pyStoreAttr:
+            obj, value, name := t.value(1), t.value(2), t.reg(len(t.stack))
+            c.WriteConstIndex(t.attr(arg), name, false, 0)
+            c.WriteSet(obj, name, value, false, 0)
+            t.pop(2)
+        
+        case pyBinarySubscr:
+            c.WriteIndex(t.value(2), t.value(1), t.top(2), false, 0)
+            t.pop(2)
+            t.push(pySlotValue, -1)
+        
+        case pyBuildSlice:
+            // There is no instruction that makes a slice, so slice() is called
+            // with copies of the bounds, above the stack.
+            if arg != 2 && arg != 3 {
+                t.fail(fmt.Sprintf("BUILD_SLICE of %v bounds", arg))
+                return
+            }
+            fn := t.reg(len(t.stack))
+            c.WriteConst(sliceBuiltin, fn, false, 0)
+            for n := arg; n >= 1; n-- {
+                c.WriteMove(t.value(n), t.reg(len(t.stack)+1+arg-n), false, 0)
+            }
+            c.WriteCallFunction(fn, uint32(arg), 0, t.top(arg), false, 0)
+            t.pop(arg)
+            t.push(pySlotValue, -1)
+        
+        case pyStoreSubscr:
+            c.WriteStoreIndex(t.value(2), t.value(1), t.value(3), false, 0)
+            t.pop(3)
+        
+        case pyBinaryOp:
+            if arg == pyBinaryPow || arg == pyBinaryPow + pyInPlaceOps {
+                // There is no instruction for **, so pow() is called with copies of
+                // the operands, above the stack, as slice() is for BUILD_SLICE.
+                fn := t.reg(len(t.stack))
+                c.WriteConst(powBuiltin, fn, false, 0)
+                c.WriteMove(t.value(2), t.reg(len(t.stack)+1), false, 0)
+                c.WriteMove(t.value(1), t.reg(len(t.stack)+2), false, 0)
+                c.WriteCallFunction(fn, 2, 0, t.top(2), false, 0)
+                t.pop(2)
+                t.push(pySlotValue, -1)
+                break
+            }
+            alu_op, present := pyBinaryOps[arg]
+            in_place := !present
+            if in_place {
+                alu_op, present = pyBinaryOps[arg - pyInPlaceOps]
+            }
+            if !present {
+                t.fail(fmt.Sprintf("unsupported binary operator %v", arg))
+                return
+            }
+            if in_place {
+                c.WriteInPlaceAluIns(alu_op, t.value(2), t.value(1), t.top(2), false, 0)
+            } else {
+                c.WriteAluIns(alu_op, t.value(2), t.value(1), t.top(2), false, 0)
+            }
+            t.pop(2)
+            t.push(pySlotValue, -1)
+        
+        case pyCompareOp:
+            if arg >= len(pyCompareOps) {
+                t.fail(fmt.Sprintf("unsupported comparison %v", arg))
+                return
+            }
+            c.WriteCompare(pyCompareOps[arg], t.value(2), t.value(1), pyPred, false, 0)
+            c.WriteBox(BOXB, pyPred, t.top(2), false, 0)
+            t.pop(2)
+            t.push(pySlotValue, -1)
+            truth = true
+        
+        case pyUnaryNegative, pyUnaryPositive, pyUnaryInvert:
+            unary_op := map[int]uint32{pyUnaryNegative: NEG, pyUnaryPositive: POS, pyUnaryInvert: INVERT}[op]
+            c.WriteUnary(unary_op, t.value(1), t.top(1), false, 0)
+            t.stack[len(t.stack)-1].konst = -1
+        
+        case pyUnaryNot:
+            c.WriteNot(t.value(1), pyPred, false, 0)
+            c.WriteBox(BOXB, pyPred, t.top(1), false, 0)
+            t.stack[len(t.stack)-1].konst = -1
+            truth = true
+        
+        case pyPopJumpForwardIfFalse, pyPopJumpForwardIfTrue, pyPopJumpBackwardIfFalse, pyPopJumpBackwardIfTrue:
+            is_true := t.test()
+            if op == pyPopJumpForwardIfFalse || op == pyPopJumpBackwardIfFalse {
+                is_true = !is_true
+            }
+            t.pop(1)
+            if op == pyPopJumpForwardIfFalse || op == pyPopJumpForwardIfTrue {
+                t.jump(i+1+arg, is_true, pyPred)
+            } else {
+                t.jump(i+1-arg, is_true, pyPred)
+            }
+        
+        case pyPopJumpForwardIfNone, pyPopJumpForwardIfNotNone, pyPopJumpBackwardIfNone, pyPopJumpBackwardIfNotNone:
+            none := t.reg(len(t.stack))
+            c.WriteConst(None, none, false, 0)
+            c.WriteCompare(EQ, none, t.value(1), pyPred, false, 0)
+            t.pop(1)
+            is_none := op == pyPopJumpForwardIfNone || op == pyPopJumpBackwardIfNone
+            if op == pyPopJumpForwardIfNone || op == pyPopJumpForwardIfNotNone {
+                t.jump(i+1+arg, is_none, pyPred)
+            } else {
+                t.jump(i+1-arg, is_none, pyPred)
+            }
+        
+        case pyJumpIfFalseOrPop, pyJumpIfTrueOrPop:
+            is_true := t.test()
+            if op == pyJumpIfFalseOrPop {
+                is_true = !is_true
+            }
+            t.jump(i+1+arg, is_true, pyPred)
+            t.pop(1)
+        
+        case pyJumpForward:
+            t.jump(i+1+arg, false, 0)
+            t.dead = true
+        
+        case pyJumpBackward, pyJumpBackwardNoInterrupt:
+            t.jump(i+1-arg, false, 0)
+            t.dead = true
+        
+        case pyReturnValue:
+            if t.module {
+                c.WriteHalt(t.value(1), false, 0)
+            } else {
+                c.WriteRet(t.value(1), false, 0)
+            }
+            t.pop(1)
+            t.dead = true
+        
+        case pyGetIter:
+            c.WriteGetIter(t.value(1), t.top(1), false, 0)
+            t.stack[len(t.stack)-1].konst = -1
+        
+        case pyForIter:
+            // The iterator is popped when it is exhausted.
+            iter := t.value(1)
+            t.reg(len(t.stack))
+            t.pop(1)
+            t.branch(c.WriteForIter(iter, false, 0), i+1+arg)
+            t.push(pySlotValue, -1)
+            t.push(pySlotValue, -1)
+        
+        case pyBuildTuple, pyBuildList, pyBuildSet:
+            closure := arg > 0 && op == pyBuildTuple
+            for n := 1; n <= arg; n++ {
+                closure = closure && t.slot(n).kind == pySlotCell
+            }
+            if closure {
+                t.pop(arg)
+                t.push(pySlotClosure, -1)
+                break
+            }
+            
+            build_op := map[int]uint32{pyBuildTuple: BUILDTUPLE, pyBuildList: BUILDLIST, pyBuildSet: BUILDSET}[op]
+            for n := 1; n <= arg; n++ {
+                t.value(n)
+            }
+            first := t.reg(len(t.stack) - arg)
+            c.WriteBuild(build_op, first, uint32(arg), first, false, 0)
+            t.pop(arg)
+            if op == pyBuildList && arg == 0 {
+                t.push(pySlotEmptyList, -1)
+            } else {
+                t.push(pySlotValue, -1)
+            }
+        
+        case pyBuildMap:
+            for n := 1; n <= 2*arg; n++ {
+                t.value(n)
+            }
+            first := t.reg(len(t.stack) - 2*arg)
+            c.WriteBuild(BUILDDICT, first, uint32(arg), first, false, 0)
+            t.pop(2*arg)
+            t.push(pySlotValue, -1)
+        
+        case pyBuildConstKeyMap:
+            // The keys are a tuple constant on top of the values.  The values are
+            // spread out to make room for the keys between them, last first so
+            // that none is overwritten before it is moved.
+            keys, ok := t.constItems(t.slot(1).konst)
+            if !ok || len(keys) != arg {
+                t.fail("the keys of a dict should be a tuple")
+                return
+            }
+            for n := 2; n <= arg+1; n++ {
+                t.value(n)
+            }
+            base := len(t.stack) - arg - 1
+            for n := arg-1; n >= 0; n-- {
+                c.WriteMove(t.reg(base + n), t.reg(base + 2*n + 1), false, 0)
+                c.WriteConst(keys[n], t.reg(base + 2*n), false, 0)
+            }
+            c.WriteBuild(BUILDDICT, t.reg(base), uint32(arg), t.reg(base), false, 0)
+            t.pop(arg+1)
+            t.push(pySlotValue, -1)
+        
+        case pyListExtend:
+            // A list display of constants is built as an empty list extended with a
+            // tuple, which is rebuilt here from the items of the tuple.
+            items, ok := t.constItems(t.slot(1).konst)
+            if arg != 1 || t.slot(2).kind != pySlotEmptyList || !ok {
+                t.fail("unsupported list extension")
+                return
+            }
+            first := t.top(2)
+            for n, item := range items {
+                c.WriteConst(item, t.reg(len(t.stack) - 2 + n), false, 0)
+            }
+            c.WriteBuild(BUILDLIST, first, uint32(len(items)), first, false, 0)
+            t.pop(2)
+            t.push(pySlotValue, -1)
+        
+        case pyUnpackSequence:
+            // The items are pushed last first.  The sequence is overwritten by the
+            // last item, so that one is fetched last.
+            seq := t.value(1)
+            index := t.reg(len(t.stack) - 1 + arg)
+            t.pop(1)
+            for n := 0; n < arg; n++ {
+                c.WriteConst(pyInt(int64(n)), index, false, 0)
+                c.WriteIndex(seq, index, t.reg(len(t.stack) + arg - 1 - n), false, 0)
+            }
+            for n := 0; n < arg; n++ {
+                t.push(pySlotValue, -1)
+            }
+        
+        case pyCopy:
+            s := t.slot(arg)
+            if s.kind == pySlotValue || s.kind == pySlotEmptyList {
+                c.WriteMove(t.top(arg), t.reg(len(t.stack)), false, 0)
+            }
+            t.push(s.kind, s.konst)
+        
+        case pySwap:
+            a, b := t.slot(1), t.slot(arg)
+            if a.kind != pySlotValue || b.kind != pySlotValue {
+                t.fail("unsupported use of the stack")
+                return
+            }
+            temp := t.reg(len(t.stack))
+            c.WriteMove(t.top(1), temp, false, 0)
+            c.WriteMove(t.top(arg), t.top(1), false, 0)
+            c.WriteMove(temp, t.top(arg), false, 0)
+            t.stack[len(t.stack)-1], t.stack[len(t.stack)-arg] = b, a
+        
+        case pyMakeFunction:
+            t.makeFunction(arg)
+        
+        case pyKwNames:
+            t.kwnames = arg
+            return
+        
+        case pyCall:
+            t.call(arg)
+        
+        default:
+            t.fail(fmt.Sprintf("unsupported CPython instruction %v at offset %v", op, 2*i))
+    }
+    
+    t.truth = truth
+    t.kwnames = -1
+}
+
+// Returns the items of the tuple constant with the index i.
+func (t *pycTranslator) constItems(i int) ([]Object, bool) {
+    if i < 0 {
+        return nil, false
+    }
+    tuple, ok := t.consts[i].(*TupleObject)
+    if !ok {
+        return nil, false
+    }
+    return tuple.Items, true
+}
+
+// MAKE_FUNCTION takes the code from the top of the stack, and below it the closure, the
+// annotations, the keyword defaults and the defaults, for the flags that are set.
+func (t *pycTranslator) makeFunction(flags int) {
+    code := t.slot(1)
+    if code.kind != pySlotCode {
+        t.fail("MAKE_FUNCTION needs the code of a function")
+        return
+    }
+    fn := t.consts[code.konst].(*FunctionObject)
+    t.pop(1)
+    
+    closure := flags & 0x08 != 0
+    if closure {
+        if t.slot(1).kind != pySlotClosure {
+            t.fail("unsupported closure")
+        }
+        t.pop(1)
+    }
+    // The annotations are only kept for introspection, so they are dropped.
+    if flags & 0x04 != 0 {
+        t.pop(1)
+    }
+    if flags & 0x02 != 0 {
+        t.fail("keyword defaults are not supported")
+        return
+    }
+    if flags & 0x01 != 0 {
+        defaults, ok := t.constItems(t.slot(1).konst)
+        if !ok {
+            t.fail("defaults that aren't constants are not supported")
+            return
+        }
+        fn = NewFunction(fn.Code, defaults, fn.Globals)
+        t.pop(1)
+    }
+    
+    t.push(pySlotValue, -1)
+    reg := t.top(1)
+    if fn == t.consts[code.konst] {
+        t.loadConst(code.konst, reg)
+    } else {
+        t.c.WriteConst(fn, reg, false, 0)
+    }
+    if closure {
+        t.c.WriteMakeClosure(reg, reg, false, 0)
+    }
+}
+
+// CALL finds the function and its argc arguments on the stack.  Below them is either a
+// NULL and the function, or a method and the object it is called on, which is its first
+// argument.  The names of the keyword arguments are set by KW_NAMES.
+func (t *pycTranslator) call(argc int) {
+    nargs := argc
+    fn := len(t.stack) - argc - 2
+    if fn < 0 {
+        t.fail("stack underflow")
+        return
+    }
+    if t.stack[fn].kind == pySlotNull {
+        fn++
+    } else {
+        nargs++
+    }
+    for n := 1; n <= len(t.stack) - fn; n++ {
+        t.value(n)
+    }
+    
+    nkw := 0
+    if t.kwnames >= 0 {
+        names, ok := t.constItems(t.kwnames)
+        if !ok {
+            t.fail("the keyword names should be a tuple")
+            return
+        }
+        nkw = len(names)
+        nargs -= nkw
+        t.loadConst(t.kwnames, t.reg(len(t.stack)))
+    }
+    
+    result := t.reg(len(t.stack) - argc - 2)
+    t.c.WriteCallFunction(t.reg(fn), uint32(nargs), uint32(nkw), result, false, 0)
+    t.pop(argc + 2)
+    t.push(pySlotValue, -1)
+}
+
+// Translates the CPython code py into a new code object in mod.  The body of a module
+// halts where CPython returns.
+func translatePyc(mod *ModuleCode, py *PycCode, module bool) (*CodeObject, os.Error) {
+    t := &pycTranslator{mod: mod, py: py, module: module, kwnames: -1}
+    t.c = mod.NewCode(py.Name)
+    t.c.Filename = py.Filename
+    t.attrs = make(map[int]uint16)
+    t.states = make(map[int][]pySlot)
+    
+    if py.Flags & (PycIterableCoroutine | PycAsyncGenerator) != 0 {
+        t.fail("async generators and generator-based coroutines are not supported")
+    }
+    if py.KwOnlyArgCount > 0 {
+        t.fail("keyword-only parameters are not supported")
+    }
+    if len(py.ExceptionTable) > 0 {
+        t.fail("exception handling is not supported")
+    }
+    if t.err != nil {
+        return nil, t.err
+    }
+    
+    // The parameters come first in the locals, followed by *args and **kwargs.
+    t.c.NumParams = py.ArgCount
+    t.c.VarArgs = py.Flags & PycVarArgs != 0
+    t.c.VarKeywords = py.Flags & PycVarKeywords != 0
+    t.c.Generator = py.Flags & PycGenerator != 0
+    t.c.Coroutine = py.Flags & PycCoroutine != 0
+    nparams := py.ArgCount
+    if t.c.VarArgs {
+        nparams++
+    }
+    if t.c.VarKeywords {
+        nparams++
+    }
+    for i, name := range py.LocalsPlusNames {
+        if i < nparams {
+            t.c.NameIndex(name)
+        }
+        switch {
+            case py.LocalsPlusKinds[i] & PycFastCell != 0:
+                t.c.CellVars = append(t.c.CellVars, name)
+            case py.LocalsPlusKinds[i] & PycFastFree != 0:
+                t.c.FreeVars = append(t.c.FreeVars, name)
+        }
+    }
+    if t.c.NumRegisters < nparams+1 {
+        t.c.NumRegisters = nparams+1
+    }
+    
+    t.consts = make([]Object, len(py.Consts))
+    t.indices = make([]uint16, len(py.Consts))
+    for i, v := range py.Consts {
+        t.consts[i] = t.convert(v)
+        t.indices[i] = t.c.Constant(t.consts[i])
+    }
+    
+    lines := pycLines(py)
+    targets := pycTargets(py)
+    t.addr = make([]uint32, len(py.Code)/2)
+    t.done = make([]bool, len(t.addr))
+    arg := 0
+    for i := range t.addr {
+        t.addr[i] = t.c.Here()
+        t.pc = i
+        op := int(py.Code[2*i])
+        arg |= int(py.Code[2*i+1])
+        
+        if op == pyCache {
+            arg = 0
+            continue
+        }
+        if op == pyExtendedArg {
+            arg <<= 8
+            continue
+        }
+        
+        if state, present := t.states[i]; present && t.dead {
+            t.stack = state
+            t.dead = false
+        }
+        if targets[i] {
+            t.truth = false
+        }
+        if !t.dead {
+            if lines[i] > 0 {
+                t.c.SetLine(lines[i])
+            }
+            t.done[i] = true
+            t.translate(i, op, arg)
+        }
+        arg = 0
+        
+        if t.err != nil {
+            return nil, t.err
+        }
+    }
+    
+    for _, j := range t.jumps {
+        t.c.PatchJump(j.fixup, t.addr[j.target])
+    }
+    return t.c, nil
+}
+
+// Translates the code of a module read by ReadPyc into a compiled module with the name.
+func TranslatePyc(name string, py *PycCode) (*ModuleCode, os.Error) {
+    mod := new (ModuleCode)
+    mod.Init(name)
+    
+    if _, err := translatePyc(mod, py, true); err != nil {
+        return nil, err
+    }
+    return mod, nil
+}
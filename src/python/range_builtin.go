@@ -0,0 +1,413 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the range built-in object type,
+   and of the iterator that steps through it.  A range works out its items
+   as they are asked for, so it takes no more room however long it is.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "math"
+        "os"
+)
+
+type RangeObject struct {
+    ObjectData
+    Start, Stop, Step int64
+    
+    // The number of items, worked out once.
+    length int
+}
+
+// Returns the range from start up to stop, in steps of step, which mustn't be zero.
+func NewRange(start, stop, step int64) (*RangeObject, os.Error) {
+    if step == 0 {
+        return nil, Raise(ValueErrorClass, "range() arg 3 must not be zero")
+    }
+    
+    // The distance between start and stop always fits in a uint64.
+    var n uint64
+    switch {
+        case step > 0 && start < stop:
+            n = (uint64(stop)-uint64(start)-1)/uint64(step) + 1
+        case step < 0 && stop < start:
+            n = (uint64(start)-uint64(stop)-1)/(-uint64(step)) + 1
+    }
+    if n > uint64(maxInt) {
+        return nil, Raise(OverflowErrorClass, "range() result has too many items")
+    }
+    
+    r := new(RangeObject)
+    r.ObjectData.Init()
+    r.Start, r.Stop, r.Step = start, stop, step
+    r.length = int(n)
+    
+    return r, nil
+}
+
+// Returns the item at i, which has to be in the range.
+func (o *RangeObject) item(i int) (int64) {
+    return o.Start + int64(i)*o.Step
+}
+
+// Iterate over the items of the range
+func (o *RangeObject) Iter() (Iterator) {
+    return NewRangeIterator(o)
+}
+
+// Returns the item at the index key, or the range of the items the slice key takes.
+func (o *RangeObject) GetItem(key Object) (Object, os.Error) {
+    if s, ok := key.(*SliceObject); ok {
+        start, step, length, err := s.Indices(o.length)
+        if err != nil {
+            return nil, err
+        }
+        first := o.item(start)
+        return NewRange(first, first+int64(length)*int64(step)*o.Step, int64(step)*o.Step)
+    }
+    
+    i, err := sequenceIndex(key, o.length, "range object")
+    if err != nil {
+        return nil, err
+    }
+    return NewInt(o.item(i)), nil
+}
+
+func (o *RangeObject) SetItem(key, value Object) (os.Error) {
+    return Raise(TypeErrorClass, "'range' object does not support item assignment")
+}
+
+func (o *RangeObject) GetAttr(name string) (value Object, present bool) {
+    switch name {
+        case "start":
+            return NewInt(o.Start), true
+        case "stop":
+            return NewInt(o.Stop), true
+        case "step":
+            return NewInt(o.Step), true
+    }
+    return o.ObjectData.GetAttr(name)
+}
+
+// A range can't be converted to a number
+func (o *RangeObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *RangeObject) AsFloat() (float64) {
+    return 0
+}
+
+func (o *RangeObject) AsString() (string) {
+    if o.Step == 1 {
+        return fmt.Sprintf("range(%v, %v)", o.Start, o.Stop)
+    }
+    return fmt.Sprintf("range(%v, %v, %v)", o.Start, o.Stop, o.Step)
+}
+
+///////// Rich Comparison Interface ///////////
+
+// Ranges are equal if they have the same items, as in Python, whatever their bounds.
+// They are not ordered.
+func (o *RangeObject) Eq(r Object) (Object) {
+    r2, ok := r.(*RangeObject)
+    if !ok {
+        return NotImplemented
+    }
+    switch {
+        case o.length != r2.length:
+            return pyBool(false)
+        case o.length == 0:
+            return pyBool(true)
+        case o.Start != r2.Start:
+            return pyBool(false)
+    }
+    return pyBool(o.length == 1 || o.Step == r2.Step)
+}
+
+func (o *RangeObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *RangeObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *RangeObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *RangeObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *RangeObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *RangeObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *RangeObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeObject) IsTrue() (bool) {
+    return o.length > 0
+}
+
+///////// Protocol Interface ///////////
+
+// Equal ranges have the same hash, which comes from their length, their first item
+// and their step, as far as they matter.
+func (o *RangeObject) Hash() (uint64, os.Error) {
+    items := []Object{NewInt(int64(o.length)), None, None}
+    if o.length > 0 {
+        items[1] = NewInt(o.Start)
+    }
+    if o.length > 1 {
+        items[2] = NewInt(o.Step)
+    }
+    return NewTuple(items).Hash()
+}
+
+func (o *RangeObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *RangeObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *RangeObject) Len() (int, os.Error) {
+    return o.length, nil
+}
+
+func (o *RangeObject) AsBool() (bool) {
+    return o.IsTrue()
+}
+
+// Steps through the items of a range.
+type RangeIteratorObject struct {
+    ObjectData
+    
+    // The range, and the index of the next item.
+    Range   *RangeObject
+    Index   int
+}
+
+func NewRangeIterator(r *RangeObject) (*RangeIteratorObject) {
+    it := new(RangeIteratorObject)
+    it.ObjectData.Init()
+    it.Range = r
+    
+    return it
+}
+
+// An iterator is its own iterator, as in Python.
+func (o *RangeIteratorObject) Iter() (Iterator) {
+    return o
+}
+
+// Returns the next item, or false once there are no more.
+func (o *RangeIteratorObject) Next() (Object, bool) {
+    if o.Index >= o.Range.length {
+        return nil, false
+    }
+    
+    o.Index++
+    return NewInt(o.Range.item(o.Index-1)), true
+}
+
+// An iterator can't be converted to a number
+func (o *RangeIteratorObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *RangeIteratorObject) AsFloat() (float64) {
+    return 0
+}
+
+func (o *RangeIteratorObject) AsString() (string) {
+    return fmt.Sprintf("<range iterator at %v of %v>", o.Index, o.Range.length)
+}
+
+///////// Rich Comparison Interface ///////////
+
+// An iterator is only equal to itself, and iterators are not ordered.
+func (o *RangeIteratorObject) Eq(r Object) (Object) {
+    it, ok := r.(*RangeIteratorObject)
+    return pyBool(ok && it == o)
+}
+
+func (o *RangeIteratorObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *RangeIteratorObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *RangeIteratorObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *RangeIteratorObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *RangeIteratorObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *RangeIteratorObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeIteratorObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeIteratorObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeIteratorObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeIteratorObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeIteratorObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeIteratorObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *RangeIteratorObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeIteratorObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeIteratorObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *RangeIteratorObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *RangeIteratorObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *RangeIteratorObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *RangeIteratorObject) AsBool() (bool) {
+    return o.IsTrue()
+}
+
+// Returns the int o as an int64, for range().
+func rangeArgument(o Object) (int64, os.Error) {
+    i, ok := o.(*IntObject)
+    if !ok {
+        return 0, Raise(TypeErrorClass, fmt.Sprintf("'%v' object cannot be interpreted as an integer", o.AsString()))
+    }
+    if !i.IsSmall() || i.Small == math.MinInt64 {
+        return 0, Raise(OverflowErrorClass, "Python int too large to convert to C ssize_t")
+    }
+    return i.Small, nil
+}
+
+// Adds range() to the builtins of the interpreter.
+func (interp *Interpreter) addRangeBuiltins() {
+    interp.Builtins["range"] = NewBuiltinFunction("range", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) < 1 || len(args) > 3 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("range expected 1 to 3 arguments, got %v", len(args)))
+        }
+        bounds := []int64{0, 0, 1}
+        for i, arg := range args {
+            v, err := rangeArgument(arg)
+            if err != nil {
+                return nil, err
+            }
+            bounds[i] = v
+        }
+        if len(args) == 1 {
+            bounds[0], bounds[1] = 0, bounds[0]
+        }
+        if err := m.allocate(3 * wordSize); err != nil {
+            return nil, err
+        }
+        return NewRange(bounds[0], bounds[1], bounds[2])
+    })
+}
@@ -0,0 +1,147 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   Incremental reparsing.  An editor changes a few characters at a time, and
+   re-parsing the whole file on every keystroke is wasteful.  Since top-level
+   statements always start in the first column, an edit can only affect the
+   top-level statements it touches.  We reparse just that region and splice
+   the result into the old module, moving the statements after it to their new
+   positions.
+*/
+
+package python
+
+import "strings"
+
+// Reparse updates mod, which was produced by parsing an earlier version of the
+// source, after the bytes [start, oldEnd) of the earlier version were replaced
+// by the bytes [start, newEnd) of src.  src is the complete new source.  The
+// module is updated in place and returned.
+//
+// If the edited region cannot be parsed on its own (for instance the edit
+// opened a bracket that is closed further down the file) the whole of src
+// is parsed instead.
+func (p *Parser) Reparse(mod *ModuleNode, src string, start, oldEnd, newEnd int) *ModuleNode {
+    delta := newEnd - oldEnd
+    body := mod.Body
+
+    // The affected statements are body[first:last].  An edit touching the end of
+    // a statement affects it, since the statement may have been extended.
+    first := 0
+    for first < len(body) && body[first].End().Offset < start {
+        first++
+    }
+    last := first
+    for last < len(body) && body[last].Pos().Offset <= oldEnd {
+        last++
+    }
+
+    // The region starts just after the last unaffected statement, and ends
+    // where the first unaffected statement after the edit starts.
+    regionStart := Position{p.filename, 0, 1, 1}
+    if first > 0 {
+        regionStart = body[first-1].End()
+    }
+
+    regionEnd := len(src)
+    if last < len(body) {
+        regionEnd = body[last].Pos().Offset + delta
+    }
+
+    // The statement after the region must start a line of its own, or we
+    // would need to fix up columns as well.
+    if last < len(body) && body[last].Pos().Column != 1 {
+        return p.reparseAll(mod, src)
+    }
+
+    if regionEnd < regionStart.Offset || regionEnd > len(src) {
+        return p.reparseAll(mod, src)
+    }
+
+    // Parse the region quietly; any errors mean that we need to see the
+    // whole file.
+    errors, errorCount := p.Error, p.ErrorCount
+    p.Error = func(*Parser, Position, string) {}
+
+    region := src[regionStart.Offset:regionEnd]
+    p.tokenize(regionStart.Filename, strings.NewReader(region), regionStart)
+    stmts := p.parseStatements(1)
+    ok := p.ErrorCount == errorCount && p.peek().Tok == EOF
+
+    p.Error, p.ErrorCount = errors, errorCount
+    if !ok {
+        return p.reparseAll(mod, src)
+    }
+
+    // Move the statements after the region.  Columns never change since the
+    // region always ends at the start of a line.
+    after := body[last:]
+    ignores := make([]int, 0, len(mod.TypeIgnores))
+    for _, line := range mod.TypeIgnores {
+        if line < regionStart.Line {
+            ignores = append(ignores, line)
+        }
+    }
+    ignores = append(ignores, p.typeIgnores...)
+
+    if len(after) > 0 {
+        lines := regionStart.Line + strings.Count(region, "\n") - after[0].Pos().Line
+        for _, line := range mod.TypeIgnores {
+            if line >= after[0].Pos().Line {
+                ignores = append(ignores, line+lines)
+            }
+        }
+        for _, stmt := range after {
+            shiftPositions(stmt, delta, lines)
+        }
+        mod.Stop.Offset += delta
+        mod.Stop.Line += lines
+    } else {
+        mod.Stop = p.peek().Position
+    }
+    mod.TypeIgnores = ignores
+
+    newBody := make([]Ast, 0, first+len(stmts)+len(after))
+    newBody = append(newBody, body[0:first]...)
+    newBody = append(newBody, stmts...)
+    newBody = append(newBody, after...)
+    mod.Body = newBody
+
+    return mod
+}
+
+func (p *Parser) reparseAll(mod *ModuleNode, src string) *ModuleNode {
+    p.src = strings.NewReader(src)
+    full := p.Parse()
+
+    mod.Body = full.Body
+    mod.Start, mod.Stop = full.Start, full.Stop
+    mod.TypeIgnores = full.TypeIgnores
+
+    return mod
+}
+
+// Moves every node in the tree rooted at n by offset bytes and lines lines.
+func shiftPositions(n Ast, offset, lines int) {
+    Walk(n, func(c Ast) bool {
+        d := c.node()
+        d.Start.Offset += offset
+        d.Start.Line += lines
+        d.Stop.Offset += offset
+        d.Stop.Line += lines
+        return true
+    })
+}
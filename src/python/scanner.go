@@ -300,6 +300,14 @@ func isHexDigit(ch int) bool {
 	return false
 }
 
+func isStringPrefix(ch int) bool {
+    switch ch {
+        case 'r', 'R', 'u', 'U', 'f', 'F':
+            return true
+    }
+    return false
+}
+
 func (s *Scanner) scanNumber(ch int) (int, int) {
 	// Not a decimal number
 	if ch == '0' {
@@ -405,9 +413,13 @@ redo:
         case unicode.IsLetter(ch) || ch == '_':            
             scan_identifier := true
             
-            // Handle raw strings, which look like identifiers at the beginning.
-            if (ch == 'r' || ch=='u') {
+            // Handle raw and format strings, which look like identifiers at the beginning.
+            // A prefix may be two letters long, as in rf"..."
+            if isStringPrefix(ch) {
                 ch = s.next()
+                if isStringPrefix(ch) {
+                    ch = s.next()
+                }
                 if ch == '"' || ch == '\'' {
                     scan_identifier = false
                     s.scanString(ch)
@@ -484,6 +496,12 @@ redo:
                     s.scanString(ch)
                     tok = String
                     ch = s.next()
+                case '#':
+                    // Comments run to the end of the line, but do not include it.
+                    for ch != '\n' && ch != '\r' && ch != EOF {
+                        ch = s.next()
+                    }
+                    tok = Comment
                 default:
                     ch = s.next()
             }
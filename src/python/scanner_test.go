@@ -50,6 +50,11 @@ var tokenList = []token{
     token{String, "'''test2\nand\ntest2'''"},
     token{String, "r'raw_test2'"},
     token{String, "r\"raw_test\""},     
+    token{String, "f'{format_test}'"},
+    token{String, "rf\"{raw_format_test!r}\""},
+    token{Identifier, "fr"},
+    token{Identifier, "format"},
+    token{Comment, "# type: int"},
     
 }
 
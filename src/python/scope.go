@@ -0,0 +1,205 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the symbol table analysis, which works out where
+   each name used in a module is bound.  A name bound in a function is local
+   to it, unless a function nested in it uses the name too.  Then the name is
+   a cell variable of the outer function, kept in a cell that the nested
+   function captures when it is created, and a free variable of the nested
+   function and of every function in between.  Names bound in a class body are
+   not visible to the functions in it, and names that aren't bound in any
+   enclosing function are globals.
+*/
+
+package python
+
+// The body of a module, class or function, with the names bound and used in it.  The
+// names in each list are in the order they first appear.
+type Scope struct {
+    Node     Ast
+    Parent   *Scope
+    Children []*Scope
+
+    Bound    []string
+    Used     []string
+
+    // The names bound here that nested functions use, and the names used here or in a
+    // nested function that are bound in an enclosing function.
+    CellVars []string
+    FreeVars []string
+
+    bound    map[string]bool
+    used     map[string]bool
+}
+
+func newScope(n Ast, parent *Scope) *Scope {
+    s := &Scope{Node: n, Parent: parent}
+    s.bound = make(map[string]bool)
+    s.used = make(map[string]bool)
+    if parent != nil {
+        parent.Children = append(parent.Children, s)
+    }
+    return s
+}
+
+// Returns true if name is bound in the scope.
+func (s *Scope) IsBound(name string) bool {
+    return s.bound[name]
+}
+
+func (s *Scope) isFunction() bool {
+    _, ok := s.Node.(*FunctionDefNode)
+    return ok
+}
+
+func (s *Scope) bind(name string) {
+    if !s.bound[name] {
+        s.bound[name] = true
+        s.Bound = append(s.Bound, name)
+    }
+}
+
+func (s *Scope) use(name string) {
+    if !s.used[name] {
+        s.used[name] = true
+        s.Used = append(s.Used, name)
+    }
+}
+
+// Binds the names assigned to by the target of an assignment or a for loop.
+func (s *Scope) bindTarget(target Ast) {
+    switch t := target.(type) {
+        case *NameNode:
+            s.bind(t.Id)
+        case *TupleNode:
+            for _, elt := range t.Elts {
+                s.bindTarget(elt)
+            }
+        case *ListNode:
+            for _, elt := range t.Elts {
+                s.bindTarget(elt)
+            }
+        case *StarredNode:
+            s.bindTarget(t.Value)
+    }
+}
+
+// Records the names bound and used by n, which runs in the scope.
+func (s *Scope) collect(n Ast) {
+    Walk(n, func(n Ast) bool {
+        switch n := n.(type) {
+            case *NameNode:
+                s.use(n.Id)
+
+            case *AssignNode:
+                for _, target := range n.Targets {
+                    s.bindTarget(target)
+                }
+
+            case *AugAssignNode:
+                s.bindTarget(n.Target)
+
+            case *ForNode:
+                s.bindTarget(n.Target)
+
+            case *FunctionDefNode:
+                // The defaults and annotations are evaluated where the
+                // function is defined, and only the body runs in its scope.
+                s.bind(n.Name)
+                for _, arg := range n.Args {
+                    s.collect(arg.Default)
+                    s.collect(arg.Annotation)
+                }
+                s.collect(n.Returns)
+
+                child := newScope(n, s)
+                for _, arg := range n.Args {
+                    child.bind(arg.Name)
+                }
+                for _, stmt := range n.Body {
+                    child.collect(stmt)
+                }
+                return false
+
+            case *ClassDefNode:
+                s.bind(n.Name)
+                for _, base := range n.Bases {
+                    s.collect(base)
+                }
+
+                child := newScope(n, s)
+                for _, stmt := range n.Body {
+                    child.collect(stmt)
+                }
+                return false
+        }
+        return true
+    })
+}
+
+// Returns true if name is bound in a function enclosing the scope.
+func (s *Scope) boundOutside(name string) bool {
+    for p := s.Parent; p != nil; p = p.Parent {
+        if p.isFunction() && p.bound[name] {
+            return true
+        }
+    }
+    return false
+}
+
+// Works out the cell and free variables of the scope and everything in it.
+func (s *Scope) resolve() {
+    free := make(map[string]bool)
+    addFree := func(name string) {
+        if !free[name] && s.boundOutside(name) {
+            free[name] = true
+            s.FreeVars = append(s.FreeVars, name)
+        }
+    }
+
+    for _, name := range s.Used {
+        if !s.bound[name] {
+            addFree(name)
+        }
+    }
+
+    cells := make(map[string]bool)
+    for _, child := range s.Children {
+        child.resolve()
+
+        for _, name := range child.FreeVars {
+            switch {
+                case s.isFunction() && s.bound[name]:
+                    if !cells[name] {
+                        cells[name] = true
+                        s.CellVars = append(s.CellVars, name)
+                    }
+                default:
+                    addFree(name)
+            }
+        }
+    }
+}
+
+// Builds the scopes of a module, and of every class and function in it.
+func AnalyzeScopes(mod *ModuleNode) *Scope {
+    top := newScope(mod, nil)
+    for _, stmt := range mod.Body {
+        top.collect(stmt)
+    }
+    top.resolve()
+    return top
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the symbol table analysis.
+
+*/
+
+package python
+
+import (
+        "fmt"
+        "testing"
+)
+
+const scopeSource = `z = 1
+def f(x):
+    y = x + z
+    def g():
+        def h(w):
+            return w + x + y + z
+        return h
+    class C:
+        x = 2
+        def m(self):
+            return x
+    return g
+`
+
+func TestAnalyzeScopes(t *testing.T) {
+    _, mod := parseSource(t, scopeSource)
+    top := AnalyzeScopes(mod)
+
+    if len(top.Children) != 1 {
+        t.Fatalf("expected the module to hold a single function, got %v", len(top.Children))
+    }
+    f := top.Children[0]
+    g, c := f.Children[0], f.Children[1]
+    h, m := g.Children[0], c.Children[0]
+
+    tests := []struct {
+        scope      *Scope
+        cell, free string
+    }{
+        {top, "[]", "[]"},
+        {f, "[x y]", "[]"},
+        {g, "[]", "[x y]"},
+        {h, "[]", "[x y]"},
+        {c, "[]", "[x]"},
+        {m, "[]", "[x]"},
+    }
+    for i, test := range tests {
+        if s := fmt.Sprint(test.scope.CellVars); s != test.cell {
+            t.Errorf("scope %v: expected the cell variables %v, got %v", i, test.cell, s)
+        }
+        if s := fmt.Sprint(test.scope.FreeVars); s != test.free {
+            t.Errorf("scope %v: expected the free variables %v, got %v", i, test.free, s)
+        }
+    }
+
+    if !top.IsBound("f") || !f.IsBound("g") || !c.IsBound("x") || !g.IsBound("h") {
+        t.Errorf("definitions and assignments should bind their names")
+    }
+    if f.IsBound("z") || h.IsBound("x") {
+        t.Errorf("names that are only used shouldn't be bound")
+    }
+}
@@ -0,0 +1,308 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the set built-in object
+   type.  The items are kept in the order they were added, and are
+   found by their hash the same way as the keys of a dict.
+*/
+
+package python
+
+import (
+        "big"
+        "os"
+        "strings"
+)
+
+type SetObject struct {
+    ObjectData
+    Items []Object
+    index map[uint64][]int
+    
+    // The key the strings in the set are hashed with, which is the default one if it
+    // is nil.  See hash.go.
+    key   *sipKey
+}
+
+func NewSet() (*SetObject) {
+    s := new(SetObject)
+    s.ObjectData.Init()
+    
+    return s
+}
+
+// Returns the index of item in the set, or -1 if it isn't there, and the hash of item.
+// An item that can't be hashed gives a TypeError.
+func (o *SetObject) find(item Object) (int, uint64, os.Error) {
+    h, err := hashObject(item, o.key)
+    if err != nil {
+        return -1, 0, err
+    }
+    for _, i := range o.index[h] {
+        if sameKey(o.Items[i], item) {
+            return i, h, nil
+        }
+    }
+    return -1, h, nil
+}
+
+// Returns true if item is in the set.  An item that can't be hashed never is.
+func (o *SetObject) Contains(item Object) (bool) {
+    i, _, _ := o.find(item)
+    return i >= 0
+}
+
+// Adds item to the set, unless it is already there.
+func (o *SetObject) Insert(item Object) (os.Error) {
+    i, h, err := o.find(item)
+    if err != nil || i >= 0 {
+        return err
+    }
+    
+    if o.index == nil {
+        o.index = make(map[uint64][]int)
+    }
+    o.index[h] = append(o.index[h], len(o.Items))
+    o.Items = append(o.Items, item)
+    return nil
+}
+
+// Returns true if every item of the set is in s.
+func (o *SetObject) subsetOf(s *SetObject) (bool) {
+    for _, item := range o.Items {
+        if !s.Contains(item) {
+            return false
+        }
+    }
+    return true
+}
+
+// A set can't be converted to a number
+func (o *SetObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *SetObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert set to string.  The empty set has no literal, since {} is a dict.
+func (o *SetObject) AsString() (string) {
+    if len(o.Items) == 0 {
+        return "set()"
+    }
+    
+    items := make([]string, len(o.Items))
+    for i, item := range o.Items {
+        items[i] = item.AsString()
+    }
+    
+    return "{" + strings.Join(items, ", ") + "}"
+}
+
+// Iterate over the items of the set
+func (o *SetObject) Iter() (Iterator) {
+    return NewIterator(o.Items)
+}
+
+///////// Rich Comparison Interface ///////////
+
+// Sets are ordered by inclusion, as in Python, so a set is less than the sets that
+// hold all of its items and more.  A set is only compared with a set.
+func (o *SetObject) Lt(r Object) (Object) {
+    s, ok := r.(*SetObject)
+    if !ok {
+        return NotImplemented
+    }
+    return pyBool(len(o.Items) < len(s.Items) && o.subsetOf(s))
+}
+
+func (o *SetObject) Gt(r Object) (Object) {
+    s, ok := r.(*SetObject)
+    if !ok {
+        return NotImplemented
+    }
+    return s.Lt(o)
+}
+
+func (o *SetObject) Eq(r Object) (Object) {
+    s, ok := r.(*SetObject)
+    if !ok {
+        return NotImplemented
+    }
+    return pyBool(len(o.Items) == len(s.Items) && o.subsetOf(s))
+}
+
+func (o *SetObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *SetObject) Lte(r Object) (Object) {
+    s, ok := r.(*SetObject)
+    if !ok {
+        return NotImplemented
+    }
+    return pyBool(o.subsetOf(s))
+}
+
+func (o *SetObject) Gte(r Object) (Object) {
+    s, ok := r.(*SetObject)
+    if !ok {
+        return NotImplemented
+    }
+    return pyBool(s.subsetOf(o))
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *SetObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+// The difference of two sets.
+func (o *SetObject) Sub(r Object) (Object, os.Error) {
+    s, ok := r.(*SetObject)
+    if !ok {
+        return nil, nil
+    }
+    
+    d := NewSet()
+    d.key = o.key
+    for _, item := range o.Items {
+        if !s.Contains(item) {
+            d.Insert(item)
+        }
+    }
+    return d, nil
+}
+
+func (o *SetObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SetObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SetObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SetObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SetObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// In-Place Arithmetic Interface ///////////
+
+func (o *SetObject) IAdd(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+// Removes the items of r from the set, as s -= r does.
+func (o *SetObject) ISub(r Object) (Object, os.Error) {
+    s, ok := r.(*SetObject)
+    if !ok {
+        return nil, nil
+    }
+    
+    var items []Object
+    for _, item := range o.Items {
+        if !s.Contains(item) {
+            items = append(items, item)
+        }
+    }
+    o.Items, o.index = nil, nil
+    for _, item := range items {
+        o.Insert(item)
+    }
+    return o, nil
+}
+
+func (o *SetObject) IMul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SetObject) IDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SetObject) IFloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SetObject) IMod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SetObject) IPow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *SetObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SetObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SetObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A set is true unless it is empty
+func (o *SetObject) IsTrue() (bool) {
+    return len(o.Items) > 0
+}
+
+///////// Protocol Interface ///////////
+
+// A set can be changed, so it can't be hashed.
+func (o *SetObject) Hash() (uint64, os.Error) {
+    return 0, Raise(TypeErrorClass, "unhashable type: 'set'")
+}
+
+// The items are written as Python writes them, so strings are quoted.
+func (o *SetObject) Repr() (string) {
+    if len(o.Items) == 0 {
+        return "set()"
+    }
+    
+    items := make([]string, len(o.Items))
+    for i, item := range o.Items {
+        items[i] = item.Repr()
+    }
+    
+    return "{" + strings.Join(items, ", ") + "}"
+}
+
+func (o *SetObject) Str() (string) {
+    return o.Repr()
+}
+
+func (o *SetObject) Len() (int, os.Error) {
+    return len(o.Items), nil
+}
+
+func (o *SetObject) AsBool() (bool) {
+    return o.IsTrue()
+}
@@ -0,0 +1,266 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the slice built-in object
+   type, which is the key of a[start:stop:step].  Each of the bounds may be
+   None, and Indices works them out for a sequence of a given length the way
+   Python does.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "math"
+        "os"
+)
+
+type SliceObject struct {
+    ObjectData
+    Start, Stop, Step Object
+}
+
+// Returns the slice start:stop:step.  A bound that is nil is None.
+func NewSlice(start, stop, step Object) (*SliceObject) {
+    s := new(SliceObject)
+    s.ObjectData.Init()
+    s.Start, s.Stop, s.Step = orNone(start), orNone(stop), orNone(step)
+    
+    return s
+}
+
+func orNone(o Object) (Object) {
+    if o == nil {
+        return None
+    }
+    return o
+}
+
+// Returns the value of the bound o, or def if it is None.  An int too big for an
+// int64 is clamped, which gives the same indices because no sequence is that long.
+func sliceBound(o Object, def int64) (int64, os.Error) {
+    if o == None {
+        return def, nil
+    }
+    i, ok := o.(*IntObject)
+    if !ok {
+        return 0, Raise(TypeErrorClass, "slice indices must be integers or None")
+    }
+    switch {
+        case i.IsSmall() && i.Small != math.MinInt64:
+            return i.Small, nil
+        case i.Sign() < 0:
+            return -math.MaxInt64, nil
+    }
+    return math.MaxInt64, nil
+}
+
+// Clamps the bound i of a sequence of length n, after a negative one has been counted
+// from the end.
+func clampBound(i, n, step int64) (int64) {
+    if i < 0 {
+        i += n
+        if i < 0 {
+            if step < 0 {
+                return -1
+            }
+            return 0
+        }
+    } else if i >= n {
+        if step < 0 {
+            return n - 1
+        }
+        return n
+    }
+    return i
+}
+
+// Returns the start, the step and the number of the items the slice takes from a
+// sequence of length n.
+func (o *SliceObject) Indices(n int) (start, step, length int, err os.Error) {
+    step64, err := sliceBound(o.Step, 1)
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    if step64 == 0 {
+        return 0, 0, 0, Raise(ValueErrorClass, "slice step cannot be zero")
+    }
+    
+    def_start, def_stop := int64(0), int64(n)
+    if step64 < 0 {
+        def_start, def_stop = int64(n)-1, -1
+    }
+    start64, err := sliceBound(o.Start, def_start)
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    stop64, err := sliceBound(o.Stop, def_stop)
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    if o.Start != None {
+        start64 = clampBound(start64, int64(n), step64)
+    }
+    if o.Stop != None {
+        stop64 = clampBound(stop64, int64(n), step64)
+    }
+    
+    var length64 int64
+    switch {
+        case step64 < 0 && stop64 < start64:
+            length64 = (start64-stop64-1)/(-step64) + 1
+        case step64 > 0 && start64 < stop64:
+            length64 = (stop64-start64-1)/step64 + 1
+    }
+    
+    // The step only needs to reach past the end of the sequence.
+    if step64 > int64(n) {
+        step64 = int64(n) + 1
+    } else if step64 < -int64(n) {
+        step64 = -int64(n) - 1
+    }
+    return int(start64), int(step64), int(length64), nil
+}
+
+// A slice can't be converted to a number
+func (o *SliceObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *SliceObject) AsFloat() (float64) {
+    return 0
+}
+
+func (o *SliceObject) AsString() (string) {
+    return fmt.Sprintf("slice(%v, %v, %v)", o.Start.Repr(), o.Stop.Repr(), o.Step.Repr())
+}
+
+///////// Rich Comparison Interface ///////////
+
+// Slices are equal if their bounds are.  They aren't ordered.
+func (o *SliceObject) Eq(r Object) (Object) {
+    s, ok := r.(*SliceObject)
+    if !ok {
+        return NotImplemented
+    }
+    return pyBool(equal(o.Start, s.Start) && equal(o.Stop, s.Stop) && equal(o.Step, s.Step))
+}
+
+func (o *SliceObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *SliceObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *SliceObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *SliceObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *SliceObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *SliceObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SliceObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SliceObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SliceObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SliceObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SliceObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SliceObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *SliceObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SliceObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SliceObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *SliceObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+// Slices aren't hashable, as in Python before 3.12.
+func (o *SliceObject) Hash() (uint64, os.Error) {
+    return 0, Raise(TypeErrorClass, "unhashable type: 'slice'")
+}
+
+func (o *SliceObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *SliceObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *SliceObject) AsBool() (bool) {
+    return o.IsTrue()
+}
+
+// slice(), which the translated CPython code calls to make the slices of a[start:stop].
+var sliceBuiltin = NewBuiltinFunction("slice", func(m *Machine, args []Object) (Object, os.Error) {
+    switch len(args) {
+        case 1:
+            return NewSlice(nil, args[0], nil), nil
+        case 2:
+            return NewSlice(args[0], args[1], nil), nil
+        case 3:
+            return NewSlice(args[0], args[1], args[2]), nil
+    }
+    return nil, Raise(TypeErrorClass, fmt.Sprintf("slice expected 1 to 3 arguments, got %v", len(args)))
+})
+
+// Adds slice() to the builtins of the interpreter.
+func (interp *Interpreter) addSliceBuiltins() {
+    interp.Builtins["slice"] = sliceBuiltin
+}
@@ -23,12 +23,13 @@ package python
 
 import (
 	"big"
-	"container/vector"
 	"fmt"
+	"sort"
 )
 
 const (
-	SSA_CALL = iota
+	SSA_NOP = iota
+	SSA_CALL
 	SSA_SPILL
 	SSA_FILL
 	SSA_LOAD
@@ -47,6 +48,23 @@ const (
 	SSA_GET
 	SSA_SET
 	SSA_IDX
+	SSA_EQ
+	SSA_NE
+	SSA_LT
+	SSA_LE
+	SSA_GT
+	SSA_GE
+	SSA_JUMP
+	SSA_BRANCH
+	SSA_RETURN
+	SSA_COPY
+	SSA_MOVE
+	SSA_ARG
+
+	// int(x), which truncates a float toward zero, and float(x).  Like SSA_NOT, a
+	// conversion has a single operand, but reads it as both.
+	SSA_TO_INT
+	SSA_TO_FLOAT
 )
 
 const (
@@ -60,11 +78,13 @@ const (
 	SSA_TYPE_BOOL
 	SSA_TYPE_NONE
 	SSA_TYPE_UNKNOWN
+	SSA_TYPE_BLOCK
+	SSA_TYPE_NAME
 )
 
 // The SsaElement is a single assignment, which may include
 // a single operation.  The element represents the result of
-// the operation.  The simplest operation is just "SSA_ASSIGN"
+// the operation.  The simplest operation is just "SSA_COPY"
 // which causes this element to take on the value of the src1
 // operand.  All other elements involve both operands, and the
 // results of some operation on them. 
@@ -82,9 +102,19 @@ type SsaElement struct {
 	// constant at compile time.  By definition an element is always written to,
 	// since an SSA element will never be created without a write.
 	// Pinned means that the instruction will always be emitted (never optimized
-	// away.)
+	// away.)  Elements with side effects are pinned when they are written.
 	WasRead, IsConst, Pinned bool
 
+	// The type of the value this element produces, one of SSA_TYPE_XXX, and whether
+	// the value can be kept as a raw machine int or float instead of an object.  Both
+	// are set by AnalyzeUnboxing.
+	ValueType uint
+	Unboxed   bool
+
+	// Set if the element is an int that always fits in an int64, so code generation
+	// never needs a big.Int for it.  Set by AnalyzeRanges.
+	SmallInt bool
+
 	// These indicate at what point this element becomes live (is first initialized)
 	// and when it dies (is never used again.)  These are important values to know
 	// so that we can maintain the active list during register allocation.  The value
@@ -99,8 +129,91 @@ type SsaElement struct {
 	// mapped back in as a _source_ to different registers.  
 	DstRegister, Src1Register, Src2Register int
 
+	// Constraints on DstRegister for the allocator.  FixedRegister is a register the
+	// element must be given, like an argument or return value register of a calling
+	// convention.  HintRegister is a register the element should be given if it is
+	// free.  0 means there is no constraint.
+	FixedRegister, HintRegister int
+
 	// The address of this element in the current code stream
 	Address int
+
+	// The id of the basic block this element belongs to
+	Block int
+
+	// For an SSA_BRANCH fused with the comparison that computed its condition, the
+	// comparison, one of SSA_EQ to SSA_GE.  Src1 and Src2 are then the operands of the
+	// comparison.  Set by Peephole, and 0 for any other element.
+	Cond uint
+
+	// Set for the arithmetic of an augmented assignment, like x += y, which changes x
+	// in place if it can.  Set by the lowering.
+	InPlace bool
+
+	// The deepest loop depth of the blocks that read this element, set by FindLoops.
+	// The allocator would rather spill elements that aren't read inside of loops.
+	LoopDepth int
+
+	// The positions where the element is live, set by ComputeLiveness.  LiveStart
+	// and LiveEnd are then the ends of the interval.
+	Interval *LiveInterval
+}
+
+// Returns true if operand n (1 or 2) of the element refers to another element.  Only
+// calls, stores and the operations past SSA_ALU_MARK read other elements; the operands
+// of the rest are constants, names or spill slots.  Branch targets are blocks, not elements.
+func (el *SsaElement) ReadsElement(n int) bool {
+	if el.Op <= SSA_ALU_MARK && el.Op != SSA_STORE && el.Op != SSA_CALL {
+		return false
+	}
+	if n == 1 {
+		return el.Src1Type == SSA_TYPE_ELEMENT
+	}
+	return el.Src2Type == SSA_TYPE_ELEMENT
+}
+
+// Gives el, a spill, fill or move the allocator made of the value of src, the type of
+// that value, so code generation knows how the value is kept.
+func (el *SsaElement) holdValueOf(src *SsaElement) {
+	el.ValueType, el.Unboxed, el.SmallInt = src.ValueType, src.Unboxed, src.SmallInt
+}
+
+// Returns true for the comparison operations, which produce a bool.
+func isComparison(op uint) bool {
+	return op >= SSA_EQ && op <= SSA_GE
+}
+
+// Returns true for the operations that end a basic block.
+func isTerminator(op uint) bool {
+	return op == SSA_JUMP || op == SSA_BRANCH || op == SSA_RETURN
+}
+
+// Returns true if the operation does something other than produce its value, so it
+// must be run even when nothing reads it: it binds a name, changes an object, calls
+// code that may do either, or transfers control.
+func hasSideEffects(op uint) bool {
+	return isTerminator(op) || op == SSA_STORE || op == SSA_SET || op == SSA_CALL
+}
+
+// A basic block is a straight run of elements with a single entry at the top.  Every
+// block ends in a terminator (SSA_JUMP, SSA_BRANCH or SSA_RETURN) which transfers
+// control to its successors, or out of the function.
+type BasicBlock struct {
+	Id int
+
+	// The ids of the elements in this block, in execution order.
+	Elements []int
+
+	// The control flow edges into and out of this block.  For a block that ends
+	// in an SSA_BRANCH, Succs[0] is taken when the condition is true and
+	// Succs[1] when it is false.
+	Preds, Succs []*BasicBlock
+
+	// The elements live on entry to and exit from this block, set by ComputeLiveness.
+	LiveIn, LiveOut map[int]bool
+
+	// The number of loops this block is in, set by FindLoops.
+	LoopDepth int
 }
 
 // Helps to track items which had to be spilled
@@ -108,45 +221,96 @@ type SsaElement struct {
 type SsaMapContext struct {
 
 	// Storage for the free spill slots 
-	FreeSpillSlots *vector.IntVector
+	FreeSpillSlots []int
 
 	// At any given time, some elements
 	// must not be spilled because they
 	// are needed by the current instruction
 	NoSpillElements map[int]bool
 
-	// Map of spill slots to SSA element
+	// Map of spilled SSA elements to the slots
+	// they were spilled to
 	SpillMap map[int]int
 
+	// The spill slot of each value, by the id of its element in the
+	// old context.  A value keeps its slot until it dies, so the slot
+	// still holds it after it is filled, and every path through the
+	// function spills it to the same place.
+	Slots map[int]int
+
 	// Tracks old_ssa_id -> new_ssa_id values so
 	// we can rename the parameters correctly during rewrite.
+	// When a value is spilled and filled again, the
+	// new id is that of the latest fill, since that is the
+	// element which holds the value in a register.
 	RenameMap map[int]int
 
+	// Tracks new_ssa_id -> old_ssa_id values, the reverse
+	// of RenameMap, including the fills and moves of a value.
+	OwnerMap map[int]int
+
 	// The list of free regs is kept here
-	FreeRegs *vector.IntVector
+	FreeRegs []int
 
 	// Store the active SSA elements in this list.
-	ActiveElements *vector.Vector
+	ActiveElements []*SsaElement
 }
 
 
 func (s *SsaMapContext) Init() {
-	s.FreeSpillSlots = new(vector.IntVector)
-	s.FreeRegs = new(vector.IntVector)
-	s.ActiveElements = new(vector.Vector)
+	s.FreeSpillSlots = make([]int, 0, 8)
+	s.FreeRegs = make([]int, 0, 16)
+	s.ActiveElements = make([]*SsaElement, 0, 16)
 
 	s.NoSpillElements = make(map[int]bool, 8)
 	s.SpillMap = make(map[int]int, 8)
+	s.Slots = make(map[int]int, 8)
 	s.RenameMap = make(map[int]int, 8)
+	s.OwnerMap = make(map[int]int, 8)
+}
+
+// Elements are allocated this many at a time.
+const elementPoolSize = 128
+
+// Hands out new elements from a slab, which saves an allocation per element.  There is
+// no locking, since a context is only ever built by one goroutine.
+type elementPool struct {
+	slab []SsaElement
 }
 
+func (p *elementPool) get() *SsaElement {
+	if len(p.slab) == 0 {
+		p.slab = make([]SsaElement, elementPoolSize)
+	}
+
+	el := &p.slab[0]
+	p.slab = p.slab[1:]
+	return el
+}
+
+// Returns a new, zeroed element.  It isn't part of the stream until it is written.
+func (ctx *SsaContext) NewElement() *SsaElement {
+	return ctx.pool.get()
+}
+
+// An SsaContext holds the code of a single function.  It shares nothing with any other
+// context, so different functions can be compiled on different goroutines at once, though
+// each context must only be used by one goroutine at a time.
 type SsaContext struct {
 	LastElementId int
 	Elements      []*SsaElement
-	Ints          *vector.Vector
-	Floats        *vector.Vector
-	Strings       *vector.StringVector
-	Names         *vector.StringVector
+
+	// The control flow graph.  Blocks is kept in layout order, which is the order
+	// the allocator visits them in.  New elements are written to Current.
+	Blocks  []*BasicBlock
+	Current *BasicBlock
+
+	// The constant pools.  A load refers to its constant by its
+	// index in one of these.
+	Ints    []*big.Int
+	Floats  []float64
+	Strings []string
+	Names   []string
 
 	// The maps below are actually maps from
 	// the values to the SsaElements created
@@ -158,39 +322,176 @@ type SsaContext struct {
 	StringIdx map[string]int
 	NameIdx   map[string]int
 
+	// The live interval of each element, indexed by id,
+	// set by ComputeLiveness
+	Intervals []*LiveInterval
+
 	// How many slots are needed for some
 	// code object in order to spill
 	SpillRoomNeeded int
 
+	// The names only ever bound by the function's own stores, set by the front end.
+	// Parameters aren't among them, since the caller binds those.  Anything else
+	// may be bound to any value behind our back.
+	LocalNames map[string]bool
+
+	// The largest Strahler number of the expressions lowered
+	// into this context, or 0 if the front end didn't say.
+	// See Strahler.
+	Strahler int
+
+	// Set to make the spill heuristic ignore loops, so the benchmarks
+	// can compare the two.
+	SpillIgnoresLoops bool
+
 	// This is set when the live checks performed
 	// in Write should be turned off.  This is
 	// useful during register allocation and optimization.
 	DisableLiveCheck bool
+
+	// Where new elements come from
+	pool elementPool
 }
 
 func (ctx *SsaContext) Init() {
-	ctx.Elements = make([]*SsaElement, 128, 128)
-	ctx.Ints = new(vector.Vector)
-	ctx.Floats = new(vector.Vector)
-	ctx.Strings = new(vector.StringVector)
-	ctx.Names = new(vector.StringVector)
+	ctx.Elements = make([]*SsaElement, 0, 128)
+	ctx.Ints = make([]*big.Int, 0, 16)
+	ctx.Floats = make([]float64, 0, 16)
+	ctx.Strings = make([]string, 0, 16)
+	ctx.Names = make([]string, 0, 16)
 
 	ctx.IntIdx = make(map[*big.Int]int, 16)
 	ctx.FloatIdx = make(map[float64]int, 16)
 	ctx.StringIdx = make(map[string]int, 16)
 	ctx.NameIdx = make(map[string]int, 16)
+
+	ctx.Blocks = make([]*BasicBlock, 0, 8)
+	ctx.Current = ctx.NewBlock()
 }
 
-func (ctx *SsaContext) Write(el *SsaElement) int {
-	// Grow the element slice if we are out of space
-	if ctx.LastElementId >= len(ctx.Elements) {
-		tmp := make([]*SsaElement, ctx.LastElementId+128, ctx.LastElementId+128)
+// Make room for at least n more elements, so that writing them doesn't have to grow
+// the stream.  Lowering code which knows roughly how big a function will be can use this
+// to avoid copying the stream as it grows.
+func (ctx *SsaContext) Reserve(n int) {
+	if need := len(ctx.Elements) + n; need > cap(ctx.Elements) {
+		tmp := make([]*SsaElement, len(ctx.Elements), need)
+		copy(tmp, ctx.Elements)
+		ctx.Elements = tmp
+	}
 
-		for i := 0; i < ctx.LastElementId; i++ {
-			tmp[i] = ctx.Elements[i]
-		}
+	if n > len(ctx.pool.slab) {
+		ctx.pool.slab = make([]SsaElement, n)
+	}
+}
 
-		ctx.Elements = tmp
+// Create a new, empty basic block and add it to the end of the layout.  Use
+// SetBlock to start writing elements into it.
+func (ctx *SsaContext) NewBlock() *BasicBlock {
+	b := new(BasicBlock)
+	b.Id = len(ctx.Blocks)
+	b.Elements = make([]int, 0, 16)
+
+	ctx.Blocks = append(ctx.Blocks, b)
+	return b
+}
+
+// Direct subsequent writes into block b.
+func (ctx *SsaContext) SetBlock(b *BasicBlock) {
+	ctx.Current = b
+}
+
+func addEdge(from, to *BasicBlock) {
+	from.Succs = append(from.Succs, to)
+	to.Preds = append(to.Preds, from)
+}
+
+// Returns true if the block already ends in a jump or branch.
+func (ctx *SsaContext) IsTerminated(b *BasicBlock) bool {
+	if len(b.Elements) == 0 {
+		return false
+	}
+
+	return isTerminator(ctx.Elements[b.Elements[len(b.Elements)-1]].Op)
+}
+
+// Terminate the current block with an unconditional jump to target.
+func (ctx *SsaContext) Jump(target *BasicBlock) int {
+	el := ctx.NewElement()
+
+	el.Op = SSA_JUMP
+	el.Src1 = target.Id
+	el.Src1Type = SSA_TYPE_BLOCK
+	el.Src2Type = SSA_TYPE_NONE
+
+	addEdge(ctx.Current, target)
+	return ctx.Write(el)
+}
+
+// Terminate the current block with a branch to if_true when the element cond
+// is true, and to if_false otherwise.
+func (ctx *SsaContext) Branch(cond int, if_true, if_false *BasicBlock) int {
+	el := ctx.NewElement()
+
+	el.Op = SSA_BRANCH
+	el.Src1 = cond
+	el.Src1Type = SSA_TYPE_ELEMENT
+	el.Src2 = if_true.Id
+	el.Src2Type = SSA_TYPE_BLOCK
+
+	addEdge(ctx.Current, if_true)
+	addEdge(ctx.Current, if_false)
+	return ctx.Write(el)
+}
+
+// Terminate the current block by returning the element value from the function.  Pass
+// -1 to return without a value.
+func (ctx *SsaContext) Return(value int) int {
+	el := ctx.NewElement()
+
+	el.Op = SSA_RETURN
+	el.Src1 = value
+	el.Src1Type = SSA_TYPE_ELEMENT
+	el.Src2Type = SSA_TYPE_NONE
+
+	if value < 0 {
+		el.Src1 = 0
+		el.Src1Type = SSA_TYPE_NONE
+	}
+
+	return ctx.Write(el)
+}
+
+// Returns true if the element produces a value, and so needs a register.
+func producesValue(op uint) bool {
+	return !isTerminator(op) && op != SSA_NOP && op != SSA_SPILL && op != SSA_STORE && op != SSA_ARG
+}
+
+// Keeps the element id from being removed even if it is never read, for example because
+// it may raise an exception.
+func (ctx *SsaContext) Pin(id int) {
+	ctx.Elements[id].Pinned = true
+}
+
+// Lets the element id be removed if it is never read.  This is for elements that are
+// known to have no effect after all, like a call of a builtin function without side
+// effects.  Terminators always stay pinned.
+func (ctx *SsaContext) Unpin(id int) {
+	el := ctx.Elements[id]
+	el.Pinned = isTerminator(el.Op)
+}
+
+// Returns the ids of all elements, block by block, in layout order.
+func (ctx *SsaContext) linearOrder() []int {
+	order := make([]int, 0, ctx.LastElementId)
+	for _, b := range ctx.Blocks {
+		order = append(order, b.Elements...)
+	}
+	return order
+}
+
+func (ctx *SsaContext) Write(el *SsaElement) int {
+	if hasSideEffects(el.Op) {
+		el.Pinned = true
 	}
 
 	if !ctx.DisableLiveCheck {
@@ -200,21 +501,21 @@ func (ctx *SsaContext) Write(el *SsaElement) int {
 
 		// Update the element(s) that this element references as having been read, and
 		// update their live range too.
-		if el.Op > SSA_ALU_MARK {
-			if el.Src1Type == SSA_TYPE_ELEMENT {
-				ctx.Elements[el.Src1].WasRead = true
-				ctx.Elements[el.Src1].LiveEnd = ctx.LastElementId
-			}
-			if el.Src2Type == SSA_TYPE_ELEMENT {
-				ctx.Elements[el.Src2].WasRead = true
-				ctx.Elements[el.Src2].LiveEnd = ctx.LastElementId
-			}
+		if el.ReadsElement(1) {
+			ctx.Elements[el.Src1].WasRead = true
+			ctx.Elements[el.Src1].LiveEnd = ctx.LastElementId
+		}
+		if el.ReadsElement(2) {
+			ctx.Elements[el.Src2].WasRead = true
+			ctx.Elements[el.Src2].LiveEnd = ctx.LastElementId
 		}
 	}
 
 	// Write a new element    
 	el.Address = ctx.LastElementId
-	ctx.Elements[ctx.LastElementId] = el
+	el.Block = ctx.Current.Id
+	ctx.Elements = append(ctx.Elements, el)
+	ctx.Current.Elements = append(ctx.Current.Elements, el.Address)
 	ctx.LastElementId++
 
 	return el.Address
@@ -222,7 +523,7 @@ func (ctx *SsaContext) Write(el *SsaElement) int {
 
 func (ctx *SsaContext) Eval(op uint, src1, src2 int) int {
 
-	el := new(SsaElement)
+	el := ctx.NewElement()
 
 	el.Op = op
 	el.Src1 = src1
@@ -236,9 +537,108 @@ func (ctx *SsaContext) Eval(op uint, src1, src2 int) int {
 	return ctx.Write(el)
 }
 
+// Create an element that moves the value of the element src from register from_register into
+// to_register.  These are only created by the allocator.
+func (ctx *SsaContext) Move(src, from_register, to_register int) int {
+
+	el := ctx.NewElement()
+
+	el.Op = SSA_MOVE
+	el.Src1 = src
+	el.Src1Type = SSA_TYPE_ELEMENT
+	el.Src2Type = SSA_TYPE_NONE
+	el.Src1Register = from_register
+	el.DstRegister = to_register
+
+	return ctx.Write(el)
+}
+
+// Create an element that takes on the value of the element src.
+func (ctx *SsaContext) Copy(src int) int {
+
+	el := ctx.NewElement()
+
+	el.Op = SSA_COPY
+	el.Src1 = src
+	el.Src1Type = SSA_TYPE_ELEMENT
+	el.Src2Type = SSA_TYPE_NONE
+
+	return ctx.Write(el)
+}
+
+// Calls the element callee with the elements args as its positional arguments.  The call
+// element is the return value.
+//
+// Each argument is passed by an SSA_ARG element, whose Src1 is the value and whose Src2
+// is the previous argument, if there is one.  The call reads the function in Src1 and the
+// last argument in Src2, so the arguments form a chain that keeps every value live until
+// it has been passed, without the call needing more than two operands.
+func (ctx *SsaContext) Call(callee int, args []int) int {
+	prev := -1
+	for _, arg := range args {
+		el := ctx.NewElement()
+
+		el.Op = SSA_ARG
+		el.Src1 = arg
+		el.Src1Type = SSA_TYPE_ELEMENT
+		el.Src2 = prev
+		el.Src2Type = SSA_TYPE_ELEMENT
+		if prev < 0 {
+			el.Src2 = 0
+			el.Src2Type = SSA_TYPE_NONE
+		}
+
+		prev = ctx.Write(el)
+	}
+
+	el := ctx.NewElement()
+
+	el.Op = SSA_CALL
+	el.Src1 = callee
+	el.Src1Type = SSA_TYPE_ELEMENT
+	el.Src2 = prev
+	el.Src2Type = SSA_TYPE_ELEMENT
+	if prev < 0 {
+		el.Src2 = 0
+		el.Src2Type = SSA_TYPE_NONE
+	}
+
+	return ctx.Write(el)
+}
+
+// Returns the elements passed as the arguments of the call element call, in order.
+func (ctx *SsaContext) CallArgs(call int) []int {
+	var args []int
+
+	el := ctx.Elements[call]
+	for el.ReadsElement(2) {
+		el = ctx.Elements[el.Src2]
+		args = append(args, el.Src1)
+	}
+
+	// The chain runs from the last argument back to the first.
+	for i, j := 0, len(args)-1; i < j; i, j = i+1, j-1 {
+		args[i], args[j] = args[j], args[i]
+	}
+
+	return args
+}
+
+// Require the element id to be allocated to the register reg.  The allocator will move
+// whatever else is in reg out of the way.  To pass a value in a specific register, copy
+// it and precolor the copy.
+func (ctx *SsaContext) Precolor(id, reg int) {
+	ctx.Elements[id].FixedRegister = reg
+}
+
+// Ask for the element id to be allocated to the register reg, if it is free.
+func (ctx *SsaContext) Hint(id, reg int) {
+	ctx.Elements[id].HintRegister = reg
+}
+
 func (ctx *SsaContext) Spill(to_slot, from_register int) int {
 
-	el := new(SsaElement)
+	el := ctx.NewElement()
 
 	el.Op = SSA_SPILL
 	el.Src1 = to_slot
@@ -249,7 +649,7 @@ func (ctx *SsaContext) Spill(to_slot, from_register int) int {
 
 func (ctx *SsaContext) Fill(from_slot, to_register int) int {
 
-	el := new(SsaElement)
+	el := ctx.NewElement()
 
 	el.Op = SSA_FILL
 	el.Src1 = from_slot
@@ -264,12 +664,12 @@ func (ctx *SsaContext) LoadInt(v *big.Int) int {
 	if !present {
 		// Save the integer in the array so we know what the actual
 		// value should be        
-		idx = len(ctx.IntIdx)
-		ctx.Ints.Push(v)
+		idx = len(ctx.Ints)
+		ctx.Ints = append(ctx.Ints, v)
 
 		// Create a new SSA element to store the actual action of 
 		// loading a literal int
-		el := new(SsaElement)
+		el := ctx.NewElement()
 
 		el.Op = SSA_LOAD
 		el.Src1 = idx
@@ -283,9 +683,102 @@ func (ctx *SsaContext) LoadInt(v *big.Int) int {
 	return idx
 }
 
+func (ctx *SsaContext) LoadFloat(v float64) int {
+	idx, present := ctx.FloatIdx[v]
+
+	if !present {
+		idx = len(ctx.Floats)
+		ctx.Floats = append(ctx.Floats, v)
+
+		el := ctx.NewElement()
+
+		el.Op = SSA_LOAD
+		el.Src1 = idx
+		el.Src1Type = SSA_TYPE_FLOAT
+
+		idx = ctx.Write(el)
+		ctx.FloatIdx[v] = idx
+	}
+
+	return idx
+}
+
+func (ctx *SsaContext) LoadString(v string) int {
+	idx, present := ctx.StringIdx[v]
+
+	if !present {
+		idx = len(ctx.Strings)
+		ctx.Strings = append(ctx.Strings, v)
+
+		el := ctx.NewElement()
+
+		el.Op = SSA_LOAD
+		el.Src1 = idx
+		el.Src1Type = SSA_TYPE_STRING
+
+		idx = ctx.Write(el)
+		ctx.StringIdx[v] = idx
+	}
+
+	return idx
+}
+
+// Returns the index of name in the Names pool, adding it if needed.
+func (ctx *SsaContext) nameIndex(name string) int {
+	for i, n := range ctx.Names {
+		if n == name {
+			return i
+		}
+	}
+
+	ctx.Names = append(ctx.Names, name)
+	return len(ctx.Names) - 1
+}
+
+// Loads the value bound to name.  Unlike constants, loads of a name are not shared,
+// since the name may be bound to something else in between.
+func (ctx *SsaContext) LoadName(name string) int {
+	el := ctx.NewElement()
+
+	el.Op = SSA_LOAD
+	el.Src1 = ctx.nameIndex(name)
+	el.Src1Type = SSA_TYPE_NAME
+	el.Src2Type = SSA_TYPE_NONE
+
+	return ctx.Write(el)
+}
+
+// Binds name to the element value.
+func (ctx *SsaContext) Store(name string, value int) int {
+	el := ctx.NewElement()
+
+	el.Op = SSA_STORE
+	el.Src1 = value
+	el.Src1Type = SSA_TYPE_ELEMENT
+	el.Src2 = ctx.nameIndex(name)
+	el.Src2Type = SSA_TYPE_NAME
+
+	return ctx.Write(el)
+}
+
+// Returns true if a is a better choice to spill at pos than b.  A value read in a more deeply
+// nested loop would be filled on every trip around it, so it is kept in its register, unless
+// ignore_loops is set.
+func spillPreferred(a, b *SsaElement, pos int, ignore_loops bool) bool {
+	a_hole := a.Interval != nil && !a.Interval.Covers(pos)
+	b_hole := b.Interval != nil && !b.Interval.Covers(pos)
+	if a_hole != b_hole {
+		return a_hole
+	}
+	if a.LoopDepth != b.LoopDepth && !ignore_loops {
+		return a.LoopDepth < b.LoopDepth
+	}
+	return b.LiveEnd < a.LiveEnd
+}
+
 // Generates a spill instruction.  Decides what to spill, and generates an instruction to save
-// the spilled value.  The return value is the newly freed register.  
-func (ctx *SsaContext) generateSpill(mc *SsaMapContext) int {
+// the spilled value.  The return value is the newly freed register.
+func (ctx *SsaContext) generateSpill(pos int, mc *SsaMapContext) int {
 
 	// Find a register to spill.  Our heuristic is to
 	// choose the register with the longest lifetime. That
@@ -295,102 +788,376 @@ func (ctx *SsaContext) generateSpill(mc *SsaMapContext) int {
 	var spill_el *SsaElement = nil
 	spilled_el_index := 0
 
-	for i := 0; i < mc.ActiveElements.Len(); i++ {
-		candidate_el := mc.ActiveElements.At(i).(*SsaElement)
+	for i := 0; i < len(mc.ActiveElements); i++ {
+		candidate_el := mc.ActiveElements[i]
 
-		if _, present := mc.NoSpillElements[candidate_el.Address]; present {
-			// If we don't have an element to spill yet, or if the current
-			// element is a better candidate, choose it.
-			if spill_el == nil || spill_el.LiveEnd < candidate_el.LiveEnd {
-				spill_el = candidate_el
-				spilled_el_index = i
-			}
+		// The operands of the current instruction must stay put.
+		if mc.NoSpillElements[candidate_el.Address] {
+			continue
+		}
+
+		// Precolored elements are only spilled as a last resort, since
+		// they would have to be moved back into their register.
+		if candidate_el.FixedRegister != 0 && spill_el != nil && spill_el.FixedRegister == 0 {
+			continue
+		}
+
+		// If we don't have an element to spill yet, or if the current
+		// element is a better candidate, choose it.  An element in a
+		// hole in its live interval isn't needed for a while, which
+		// makes it a better candidate than one which is, and one read
+		// in fewer loops is cheaper to fill.
+		if spill_el == nil || (spill_el.FixedRegister != 0 && candidate_el.FixedRegister == 0) ||
+			spillPreferred(candidate_el, spill_el, pos, ctx.SpillIgnoresLoops) {
+			spill_el = candidate_el
+			spilled_el_index = i
 		}
 	}
-	
+
 	if spill_el == nil {
 	   panic("There are no spillable registers.")
 	}
 
-	free_slot := 0
+	return ctx.spillActive(spilled_el_index, mc)
+}
+
+// Spills the element at index i of the active list, and returns the register it held.
+func (ctx *SsaContext) spillActive(i int, mc *SsaMapContext) int {
+	spill_el := mc.ActiveElements[i]
 
 	// Once we've chose a register, we need to figure out where to spill the
-	// data to.  We try to make this reasonably optimal, but we can grow the
-	// spill area as needed.  (Something not true about our register set. :-D)
-	if mc.FreeSpillSlots.Len() == 0 {
-		// No free spill slots, grow it.
-		free_slot = len(mc.SpillMap)
-	} else {
-		free_slot = mc.FreeSpillSlots.Pop()
+	// data to.  A value that was spilled before goes back to the same slot.
+	owner := mc.OwnerMap[spill_el.Address]
+	free_slot, present := mc.Slots[owner]
+	if !present {
+		free_slot = ctx.newSlot(mc)
+		mc.Slots[owner] = free_slot
 	}
 
 	mc.SpillMap[spill_el.Address] = free_slot
 
 	// Now emit a spill instruction
-	// so that we don't lose the work done.            
-	ctx.Spill(free_slot, spill_el.DstRegister)
-
-	// Make sure to track how much spill room is needed
-	if ctx.SpillRoomNeeded < len(mc.SpillMap) {
-		ctx.SpillRoomNeeded = len(mc.SpillMap)
-	}
+	// so that we don't lose the work done.
+	spill_id := ctx.Spill(free_slot, spill_el.DstRegister)
+	ctx.Elements[spill_id].holdValueOf(spill_el)
 
 	// Remove it from the active list
-	mc.ActiveElements.Delete(spilled_el_index)
+	mc.ActiveElements = append(mc.ActiveElements[:i], mc.ActiveElements[i+1:]...)
 
-	fmt.Printf("spilled: %v\n", spill_el.Address)
-
-	// Return the newly freed register number    
+	// Return the newly freed register number
 	return spill_el.DstRegister
 }
 
+// Returns a free spill slot.  We try to reuse the slots of dead values, but we can grow the
+// spill area as needed.  (Something not true about our register set. :-D)
+func (ctx *SsaContext) newSlot(mc *SsaMapContext) int {
+	if len(mc.FreeSpillSlots) > 0 {
+		return popInt(&mc.FreeSpillSlots)
+	}
+
+	// Make sure to track how much spill room is needed
+	ctx.SpillRoomNeeded++
+	return ctx.SpillRoomNeeded - 1
+}
+
 // Generates a fill instruction.  Previously the value must have been spilled out to the save area.  An
 // instruction is emitted to load it back into the register set.  Other registers may be spilled in order
 // to bring the spilled value back in.  Returns the id of the element that generated the fill.  This id
 // should be used as the new source value of an SsaElement that depends on the spilled value.
-func (ctx *SsaContext) generateFill(el *SsaElement, mc *SsaMapContext) int {
+//
+// The fill takes over the live range of the spilled element and is made active in its place, so it can
+// be spilled and filled again like any other element.
+func (ctx *SsaContext) generateFill(el *SsaElement, pos int, mc *SsaMapContext) int {
 
-	// Figure out where the element was 
+	// Figure out where the element was
 	// spilled to.
 	free_slot := mc.SpillMap[el.Address]
-	mc.FreeSpillSlots.Push(free_slot)
-
-	target_reg := 0
 
-	// Find a free register (possibly by spilling another register.)
-	if mc.FreeRegs.Len() == 0 {
-		target_reg = ctx.generateSpill(mc)
-	} else {
-		target_reg = mc.FreeRegs.Pop()
-	}
+	// Find a free register (possibly by spilling another register.)  The slot
+	// keeps the value, and is only released when the value dies.  A precolored
+	// element goes back to its register.
+	target_reg := ctx.takeRegister(el, pos, mc)
 
 	// Remove the element from the map
 	mc.SpillMap[el.Address] = 0, false
 
-	// Activate the element.
-	mc.ActiveElements.Push(el)
+	// Write the fill instruction
+	fill_id := ctx.Fill(free_slot, target_reg)
+
+	// Activate the fill.
+	fill_el := ctx.Elements[fill_id]
+	fill_el.LiveStart = pos
+	fill_el.LiveEnd = el.LiveEnd
+	fill_el.Interval = el.Interval
+	fill_el.ActiveStart = pos
+	fill_el.FixedRegister = el.FixedRegister
+	fill_el.LoopDepth = el.LoopDepth
+	fill_el.holdValueOf(el)
+	mc.ActiveElements = append(mc.ActiveElements, fill_el)
+	mc.OwnerMap[fill_id] = mc.OwnerMap[el.Address]
+
+	return fill_id
+}
+
+// Removes and returns the last entry of the list.
+func popInt(l *[]int) int {
+	v := (*l)[len(*l)-1]
+	*l = (*l)[0 : len(*l)-1]
+	return v
+}
 
-	fmt.Printf("filled: %v\n", el.Address)
+// Removes reg from the free list.  Returns false if it isn't free.
+func takeFreeRegister(reg int, mc *SsaMapContext) bool {
+	for i := 0; i < len(mc.FreeRegs); i++ {
+		if mc.FreeRegs[i] == reg {
+			mc.FreeRegs = append(mc.FreeRegs[:i], mc.FreeRegs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
 
-	// Write the fill instruction
-	return ctx.Fill(free_slot, target_reg)
+// Finds a register for el, honoring its FixedRegister and HintRegister.  Without a
+// constraint any free register will do, and if there is none a register is spilled.
+func (ctx *SsaContext) takeRegister(el *SsaElement, pos int, mc *SsaMapContext) int {
+	if reg := el.FixedRegister; reg != 0 {
+		if !takeFreeRegister(reg, mc) {
+			ctx.evictRegister(reg, pos, mc)
+		}
+		return reg
+	}
+
+	if reg := el.HintRegister; reg != 0 && takeFreeRegister(reg, mc) {
+		return reg
+	}
+
+	if len(mc.FreeRegs) == 0 {
+		return ctx.generateSpill(pos, mc)
+	}
+	return popInt(&mc.FreeRegs)
+}
+
+// Frees reg, which is held by an active element, for a precolored element.  The value in
+// reg is moved to a free register if there is one, and spilled otherwise.  Later uses of the
+// value are renamed to the move.  The value stays in reg until the precolored element is
+// written, so the current instruction may still read it there.
+func (ctx *SsaContext) evictRegister(reg, pos int, mc *SsaMapContext) {
+	for i := 0; i < len(mc.ActiveElements); i++ {
+		holder := mc.ActiveElements[i]
+		if holder.DstRegister != reg {
+			continue
+		}
+
+		// Two elements that need the same register can't both hold it,
+		// and a move needs somewhere to go.
+		if holder.FixedRegister == reg || len(mc.FreeRegs) == 0 {
+			if mc.NoSpillElements[holder.Address] {
+				panic("A precolored register is held by an operand of the same instruction.")
+			}
+			ctx.spillActive(i, mc)
+			return
+		}
+
+		move_id := ctx.Move(holder.Address, reg, popInt(&mc.FreeRegs))
+
+		move_el := ctx.Elements[move_id]
+		move_el.LiveStart = pos
+		move_el.LiveEnd = holder.LiveEnd
+		move_el.Interval = holder.Interval
+		move_el.ActiveStart = pos
+		move_el.LoopDepth = holder.LoopDepth
+		move_el.holdValueOf(holder)
+
+		holder.ActiveEnd = pos
+		mc.ActiveElements[i] = move_el
+
+		owner := mc.OwnerMap[holder.Address]
+		mc.RenameMap[owner] = move_id
+		mc.OwnerMap[move_id] = owner
+		if mc.NoSpillElements[holder.Address] {
+			mc.NoSpillElements[move_id] = true
+		}
+		return
+	}
+
+	panic(fmt.Sprintf("Register r%v is neither free nor in use.", reg))
+}
+
+// Removes the elements whose live range ends before pos from the active list and returns
+// their registers to the free list.  With inclusive set, elements whose last use is at pos
+// are released too, so that the result of the instruction at pos can reuse their register.
+// The spill slots of values that are dead are released as well.
+func (ctx *SsaContext) expireElements(pos int, inclusive bool, mc *SsaMapContext) {
+	new_active_elements := mc.ActiveElements[0:0]
+
+	for i := 0; i < len(mc.ActiveElements); i++ {
+		candidate_el := mc.ActiveElements[i]
+
+		if candidate_el.LiveEnd > pos || (candidate_el.LiveEnd == pos && !inclusive) {
+			new_active_elements = append(new_active_elements, candidate_el)
+		} else {
+			// Indicate that this register is free again
+			mc.FreeRegs = append(mc.FreeRegs, candidate_el.DstRegister)
+			candidate_el.ActiveEnd = pos
+		}
+	}
+
+	// Use the new list as our active elements list
+	mc.ActiveElements = new_active_elements
+
+	for id := range mc.SpillMap {
+		if ctx.Elements[id].LiveEnd < pos {
+			mc.SpillMap[id] = 0, false
+		}
+	}
+	for owner, slot := range mc.Slots {
+		if ctx.Elements[mc.RenameMap[owner]].LiveEnd < pos {
+			mc.Slots[owner] = 0, false
+			mc.FreeSpillSlots = append(mc.FreeSpillSlots, slot)
+		}
+	}
+}
+
+// Renames operand n (1 or 2) of el, a copy of old_el, to the element that currently holds
+// its value, filling the value from the spill area if needed.
+func (ctx *SsaContext) resolveOperand(el, old_el *SsaElement, n, pos int, mc *SsaMapContext) {
+	if !el.ReadsElement(n) {
+		return
+	}
+
+	old_src := old_el.Src1
+	if n == 2 {
+		old_src = old_el.Src2
+	}
+
+	src, present := mc.RenameMap[old_src]
+	if !present {
+		panic("Element read before it was written.")
+	}
+
+	if _, spilled := mc.SpillMap[src]; spilled {
+		src = ctx.generateFill(ctx.Elements[src], pos, mc)
+		mc.RenameMap[old_src] = src
+	}
+
+	// The other operand may need a fill too, which must not spill this one.
+	mc.NoSpillElements[src] = true
+
+	if n == 1 {
+		el.Src1 = src
+		el.Src1Register = ctx.Elements[src].DstRegister
+	} else {
+		el.Src2 = src
+		el.Src2Register = ctx.Elements[src].DstRegister
+	}
+}
+
+// Points the operands of el, a copy of old_el, at the elements that hold their values now.
+func (ctx *SsaContext) refreshOperands(el, old_el *SsaElement, mc *SsaMapContext) {
+	if el.ReadsElement(1) {
+		el.Src1 = mc.RenameMap[old_el.Src1]
+		el.Src1Register = ctx.Elements[el.Src1].DstRegister
+	}
+	if el.ReadsElement(2) {
+		el.Src2 = mc.RenameMap[old_el.Src2]
+		el.Src2Register = ctx.Elements[el.Src2].DstRegister
+	}
 }
 
+// Assigns registers to the elements of the context without rewriting it.  This is only
+// possible when the register pressure is never more than the free registers, since
+// then nothing is spilled, and there are no precolored elements.
+func (ctx *SsaContext) allocateInPlace(order []int, num_regs int) {
+	mc := new(SsaMapContext)
+	mc.Init()
+
+	for i := 1; i < num_regs; i++ {
+		mc.FreeRegs = append(mc.FreeRegs, i)
+	}
+
+	for pos, ssa_id := range order {
+		el := ctx.Elements[ssa_id]
+		el.ActiveStart = pos
+
+		ctx.expireElements(pos, true, mc)
+
+		if producesValue(el.Op) {
+			el.DstRegister = ctx.takeRegister(el, pos, mc)
+			mc.ActiveElements = append(mc.ActiveElements, el)
+		}
+	}
+
+	// Operands may be defined later in the layout than their users, around a
+	// loop, so they are filled in once everything has a register.
+	for _, ssa_id := range order {
+		el := ctx.Elements[ssa_id]
+		if el.ReadsElement(1) {
+			el.Src1Register = ctx.Elements[el.Src1].DstRegister
+		}
+		if el.ReadsElement(2) {
+			el.Src2Register = ctx.Elements[el.Src2].DstRegister
+		}
+	}
+
+	ctx.SpillRoomNeeded = 0
+}
 
 // Performs a linear-scan allocation of registers.  Only one pass is used to allocate registers to all
-// SSA instructions.
+// SSA instructions.  The blocks of the control flow graph are visited in layout order, and the
+// new context has the same blocks and edges as the old one, except for the blocks resolveEdges
+// puts on edges.
+//
+// Operands are renamed to the element that holds their value at the point of use.  When a value
+// is spilled, the next use fills it into a new element, and later uses read that fill instead,
+// until it is spilled again.  Src1Register and Src2Register are set to the registers read.
+//
+// Elements with a FixedRegister always get that register.  Whatever held it before is moved
+// to another register, or spilled if there is no other register.
+//
+// When the function provably fits in num_regs registers, registers are assigned in place and
+// ctx itself is returned.
 func (ctx *SsaContext) AllocateRegisters(num_regs int) *SsaContext {
 
-	// We create a new context so that we can rewrite the SSA stream into it.  This is because
-	// we expect that we will need to spill at least one SSA into a temporary space.  A possible
-	// future optimization of this code would be to have the Strahler number calculated by the
-	// AST traversal phase so we know if we will need to spill or not.  Of course, we also take
-	// this opportunity to do some optimizations that require rewriting the stream anyway (like 
-	// dead code elimination.)
+	// Elements that are never read don't need a register, and neither do
+	// copies, once their users read the original.
+	ctx.PropagateCopies()
+	ctx.Eliminate()
+
+	// The blocks are visited in layout order, so the live ranges must be
+	// positions in that order rather than in the order the elements were written,
+	// and must account for values that are live around loops.
+	order := ctx.linearOrder()
+	ctx.ComputeLiveness(order)
+	ctx.FindLoops()
+
+	// An expression with a Strahler number of n can't be evaluated in fewer than n
+	// registers, so there is no point in measuring the pressure when the front end has
+	// told us it is too high.  Otherwise the pressure tells us for sure whether we will
+	// need to spill.
+	rewrite := ctx.Strahler >= num_regs
+	for i := 0; i < len(order) && !rewrite; i++ {
+		el := ctx.Elements[order[i]]
+		rewrite = el.FixedRegister != 0 || el.Op == SSA_CALL
+	}
+	if !rewrite && ctx.registerPressure(order) < num_regs {
+		ctx.allocateInPlace(order, num_regs)
+		return ctx
+	}
+
+	// We create a new context so that we can rewrite the SSA stream into it, since
+	// the spills and fills have to be inserted between the existing elements.
 
 	new_ctx := new(SsaContext)
 	new_ctx.Init()
 	new_ctx.DisableLiveCheck = true
+	new_ctx.SpillIgnoresLoops = ctx.SpillIgnoresLoops
+	new_ctx.Reserve(len(order))
+
+	// The loads in the new context refer to the same constants.
+	new_ctx.Ints = ctx.Ints
+	new_ctx.Floats = ctx.Floats
+	new_ctx.Strings = ctx.Strings
+	new_ctx.Names = ctx.Names
 
 	// The list of spilled elements is kept here
 	mc := new(SsaMapContext)
@@ -399,115 +1166,278 @@ func (ctx *SsaContext) AllocateRegisters(num_regs int) *SsaContext {
 	// Push all the registers except 0 onto the free list. We assume the 0 register
 	// is reserved for the 0 value, thus it is never available.
 	for i := 1; i < num_regs; i++ {
-		mc.FreeRegs.Push(i)
+		mc.FreeRegs = append(mc.FreeRegs, i)
 	}
 
-	for ssa_id := 0; ssa_id < ctx.LastElementId; ssa_id++ {
-		old_el := ctx.Elements[ssa_id]
+	// Mirror the control flow graph in the new context, so that each rewritten
+	// element lands in the same block as the original.
+	for len(new_ctx.Blocks) < len(ctx.Blocks) {
+		new_ctx.NewBlock()
+	}
+	for _, b := range ctx.Blocks {
+		new_ctx.Blocks[b.Id].LoopDepth = b.LoopDepth
+		for _, succ := range b.Succs {
+			addEdge(new_ctx.Blocks[b.Id], new_ctx.Blocks[succ.Id])
+		}
+	}
 
-		// First, check to see if this element is ever read.
-		if !old_el.Pinned && !old_el.WasRead {
-			// This element was never looked at, so we can
-			// skip it.
-			continue
+	// Where the values live into and out of each block are when the
+	// allocation gets there, for resolveEdges.
+	entry := make([]map[int]valueLocation, len(ctx.Blocks))
+	exit := make([]map[int]valueLocation, len(ctx.Blocks))
+
+	pos := 0
+	for _, b := range ctx.Blocks {
+		new_ctx.SetBlock(new_ctx.Blocks[b.Id])
+		entry[b.Id] = mc.locations(new_ctx, b.LiveIn)
+
+		for _, ssa_id := range b.Elements {
+			new_ctx.allocateElement(ctx.Elements[ssa_id], pos, mc)
+			pos++
+		}
+
+		exit[b.Id] = mc.locations(new_ctx, b.LiveOut)
+	}
+
+	new_ctx.resolveEdges(entry, exit, mc)
+	return new_ctx
+}
+
+// Rewrites old_el, at position pos of the layout, into the current block of the context,
+// with registers for its operands and its result.
+func (ctx *SsaContext) allocateElement(old_el *SsaElement, pos int, mc *SsaMapContext) {
+
+	// Create a new element to copy the
+	// old one into
+	el := ctx.NewElement()
+	*el = *old_el
+
+	// First remove any elements whose live range ended before the
+	// current position, so that fills can use their registers.
+	ctx.expireElements(pos, false, mc)
+
+	// Update the active start address
+	el.ActiveStart = pos
+
+	// Rename the operands to the elements that hold their values now,
+	// filling them from the spill area if they were spilled.  We _may_
+	// need to spill one or two registers in order to have the space we
+	// need to fill for this instruction.  Branch targets are block ids,
+	// which never change.
+	ctx.resolveOperand(el, old_el, 1, pos, mc)
+	ctx.resolveOperand(el, old_el, 2, pos, mc)
+
+	// Operands that die here give their registers up to the result.
+	ctx.expireElements(pos, true, mc)
+
+	// Every register is caller-saved, so whatever is still live across a
+	// call is spilled before it, and filled again where it is next used.
+	// The operands stay in their registers until the call reads them.
+	if el.Op == SSA_CALL {
+		for len(mc.ActiveElements) > 0 {
+			ctx.spillActive(len(mc.ActiveElements)-1, mc)
 		}
+	}
 
-		// Create a new element to copy the
-		// old one into
-		el := new(SsaElement)
-		*el = *old_el
+	// Filling the second operand may have moved the first out of the way of a
+	// precolored register, so look them up again.
+	ctx.refreshOperands(el, old_el, mc)
 
-		///////////////////
+	// Figure out what register this instruction should go into.  Jumps and
+	// branches don't produce a value, so they don't need one.
+	if producesValue(el.Op) {
+		el.DstRegister = ctx.takeRegister(el, pos, mc)
+	}
 
-		new_active_elements := new(vector.Vector)
+	// Track the register in the new and old context.
+	old_el.DstRegister = el.DstRegister
 
-		// First remove any elements whose LiveEnd value is less than the 
-		// current ssa_id index
-		for i := 0; i < mc.ActiveElements.Len(); i++ {
+	// Write the possibly renamed element into the new context
+	mc.RenameMap[old_el.Address] = ctx.Write(el)
+	mc.OwnerMap[el.Address] = old_el.Address
 
-			candidate_el := mc.ActiveElements.At(i).(*SsaElement)
+	// Push the current eement into the active elements list.
+	// Do this here so that it does not get considered for
+	// spilling.
+	if producesValue(el.Op) {
+		mc.ActiveElements = append(mc.ActiveElements, el)
+	}
 
-			fmt.Printf("%v: live: %v,%v\n", ssa_id, candidate_el.LiveStart, candidate_el.LiveEnd)
+	// Clear out the no-spill list.
+	mc.NoSpillElements = make(map[int]bool, 8)
+}
 
-			if candidate_el.LiveEnd >= ssa_id {
-				new_active_elements.Push(candidate_el)
-			} else {
-				// Indicate that this register is free again
-				mc.FreeRegs.Push(candidate_el.DstRegister)
-				el.ActiveEnd = ssa_id
-			}
+// Where a value is at the start or the end of a block: in the register reg, which the
+// element id holds it in, or in the spill slot slot if reg is 0.
+type valueLocation struct {
+	id, reg, slot int
+}
+
+// Returns where the values ids, by the ids of their elements in the old context, are now.
+// A value that isn't written yet isn't anywhere.
+func (mc *SsaMapContext) locations(ctx *SsaContext, ids map[int]bool) map[int]valueLocation {
+	locs := make(map[int]valueLocation, len(ids))
+	for owner := range ids {
+		id, present := mc.RenameMap[owner]
+		if !present {
+			continue
 		}
 
-		// Use the new list as our active elements list
-		mc.ActiveElements = new_active_elements
+		if slot, spilled := mc.SpillMap[id]; spilled {
+			locs[owner] = valueLocation{id, 0, slot}
+		} else {
+			locs[owner] = valueLocation{id, ctx.Elements[id].DstRegister, 0}
+		}
+	}
+	return locs
+}
 
-		// Update the active start address
-		el.ActiveStart = ssa_id
+// Moves a value across an edge from where the predecessor leaves it to where the
+// successor expects it.
+type edgeMove struct {
+	from, to valueLocation
+}
 
-		// Process any renames and fills
-		if el.Op > SSA_ALU_MARK {
-			// Check for (and perform) any needed renames.
-			if new_src1_name, present := mc.RenameMap[el.Src1]; present {
-				el.Src1 = new_src1_name
+// Makes the predecessors of every block leave its live values where the block expects
+// them.  The allocator visits the blocks in layout order, so each block starts out with
+// the values where the block before it in the layout left them, which needn't be where
+// its predecessors in the control flow graph leave them.  Where they differ the values
+// are spilled, moved and filled on the edge: at the end of the predecessor if the edge
+// is its only way out, at the start of the successor if the edge is its only way in,
+// and otherwise in a new block that splits the edge.
+func (ctx *SsaContext) resolveEdges(entry, exit []map[int]valueLocation, mc *SsaMapContext) {
+	// Slots to break cycles of moves with.  They can't be free slots of values that
+	// are dead at the end of the layout, since those may be live on the edge.
+	var scratch []int
+
+	for _, p := range ctx.Blocks[0:len(entry)] {
+		for k := 0; k < len(p.Succs); k++ {
+			s := p.Succs[k]
+
+			owners := make([]int, 0, len(entry[s.Id]))
+			for owner := range entry[s.Id] {
+				owners = append(owners, owner)
+			}
+			sort.Ints(owners)
+
+			var spills, moves, fills []edgeMove
+			for _, owner := range owners {
+				to := entry[s.Id][owner]
+				from, present := exit[p.Id][owner]
+				switch {
+				case !present || to.reg == from.reg && (to.reg != 0 || to.slot == from.slot):
+				case to.reg == 0:
+					spills = append(spills, edgeMove{from, to})
+				case from.reg == 0:
+					fills = append(fills, edgeMove{from, to})
+				default:
+					moves = append(moves, edgeMove{from, to})
+				}
+			}
+			if len(spills) == 0 && len(moves) == 0 && len(fills) == 0 {
+				continue
 			}
 
-			if new_src2_name, present := mc.RenameMap[el.Src2]; present {
-				el.Src2 = new_src2_name
+			// The entry block is also entered from outside of the function.
+			var b *BasicBlock
+			at := 0
+			switch {
+			case len(p.Succs) == 1:
+				b = p
+				at = len(b.Elements) - 1
+			case len(s.Preds) == 1 && s.Id != 0:
+				b = s
+			default:
+				b = ctx.splitEdge(p, k)
 			}
+			ctx.SetBlock(b)
+			start := len(b.Elements)
 
-			mc.NoSpillElements[el.Src1] = true
-			mc.NoSpillElements[el.Src2] = true
+			// Values are spilled before the moves overwrite their registers, and
+			// filled after the moves have read theirs.
+			for _, m := range spills {
+				ctx.Elements[ctx.Spill(m.to.slot, m.from.reg)].holdValueOf(ctx.Elements[m.from.id])
+			}
 
-			// Check to see if we need to fill some registers from the
-			// spill area in order to process this instruction.  If so, 
-			// we _may_ need to spill one or two registers in order to
-			// have the space we need to fill for this instruction.	        
-			if _, spilled := mc.SpillMap[el.Src1]; spilled {
-				el.Src1 = new_ctx.generateFill(new_ctx.Elements[el.Src1], mc)
+			cycles := 0
+			for len(moves) > 0 {
+				// Find a move into a register that no other move still reads.
+				i := 0
+				for ; i < len(moves); i++ {
+					read := false
+					for j, m := range moves {
+						read = read || j != i && m.from.reg == moves[i].to.reg
+					}
+					if !read {
+						break
+					}
+				}
+
+				// Otherwise the moves form cycles, and one value waits in a
+				// scratch slot until the rest of its cycle has moved.
+				if i == len(moves) {
+					if cycles == len(scratch) {
+						ctx.SpillRoomNeeded++
+						scratch = append(scratch, ctx.SpillRoomNeeded-1)
+					}
+					m := moves[0]
+					m.from.slot = scratch[cycles]
+					cycles++
+
+					ctx.Elements[ctx.Spill(m.from.slot, m.from.reg)].holdValueOf(ctx.Elements[m.from.id])
+					fills = append(fills, m)
+					moves = moves[1:]
+					continue
+				}
+
+				m := moves[i]
+				ctx.Elements[ctx.Move(m.from.id, m.from.reg, m.to.reg)].holdValueOf(ctx.Elements[m.from.id])
+				moves = append(moves[:i], moves[i+1:]...)
 			}
 
-			if _, spilled := mc.SpillMap[el.Src2]; spilled {
-				el.Src2 = new_ctx.generateFill(new_ctx.Elements[el.Src2], mc)
+			for _, m := range fills {
+				ctx.Elements[ctx.Fill(m.from.slot, m.to.reg)].holdValueOf(ctx.Elements[m.to.id])
 			}
-			
-			//// PROBLEM:
-			// Some instruction results are swapped in and out of the register
-			// file.  This means that at certain points they have been moved
-			// to different registers.  We need to keep track of the fact that
-			// the register is different during various intervals.  We need to
-			// know WHAT it is and WHEN it is that value.
-			// This means that we need to put the filled values into the activated
-			// records and rename the first src to the filled src.  The filled src's
-			// live range should be set to end at the same place as the original source
-			// to maintain the heuristic.  If we spill the filled record, then we should 
-			// delete the rename map too.  However, the original source may have been
-			// renamed due to optimizations or dead-code elimination.  So somehow we need
-			// to get back to the original rename.
-			
-		}
 
-		// Figure out what register this instruction should go into
-		if mc.FreeRegs.Len() == 0 {
-			el.DstRegister = new_ctx.generateSpill(mc)
-		} else {
-			el.DstRegister = mc.FreeRegs.Pop()
+			// Put the new elements in their place in the block.
+			ids := make([]int, len(b.Elements)-start)
+			copy(ids, b.Elements[start:])
+			rest := make([]int, start-at)
+			copy(rest, b.Elements[at:start])
+			b.Elements = append(append(b.Elements[:at], ids...), rest...)
 		}
+	}
+}
 
-		// Track the register in the new and old context.
-		old_el.DstRegister = el.DstRegister
-
-		// Write the possibly renamed element into the new context                
-		mc.RenameMap[ssa_id] = new_ctx.Write(el)
-
-		// Push the current eement into the active elements list.
-		// Do this here so that it does not get considered for 
-		// spilling.
-		mc.ActiveElements.Push(el)
+// Puts a new block, which jumps to the successor k of p, on the edge from p to it.
+func (ctx *SsaContext) splitEdge(p *BasicBlock, k int) *BasicBlock {
+	s := p.Succs[k]
 
-		// Clear out the no-spill list.
-		mc.NoSpillElements[el.Src1] = false, false
-		mc.NoSpillElements[el.Src2] = false, false
+	b := ctx.NewBlock()
+	b.LoopDepth = p.LoopDepth
+	if s.LoopDepth < b.LoopDepth {
+		b.LoopDepth = s.LoopDepth
+	}
+	ctx.SetBlock(b)
+	ctx.Jump(s)
+
+	// The new block takes the place of p among the predecessors of s.
+	for i, pred := range s.Preds {
+		if pred == p {
+			s.Preds[i] = b
+			break
+		}
+	}
+	s.Preds = s.Preds[0 : len(s.Preds)-1]
+	p.Succs[k] = b
+	b.Preds = append(b.Preds, p)
+
+	// A branch that wasn't fused with its comparison names the block it takes
+	// when its condition is true.
+	term := ctx.Elements[p.Elements[len(p.Elements)-1]]
+	if k == 0 && term.Op == SSA_BRANCH && term.Cond == 0 {
+		term.Src2 = b.Id
 	}
 
-	return new_ctx
+	return b
 }
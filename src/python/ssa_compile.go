@@ -0,0 +1,150 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the compilation pipeline of a module.  Each function
+   is lowered into its own SsaContext and taken through the optimization passes
+   and the register allocator on its own, so the functions of a module are
+   compiled by a pool of goroutines, one function at a time, and the results are
+   gathered up in source order.  A large module can use every core.
+*/
+
+package python
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Lowers the body of fn into ctx, which is empty.  A Lowerer may be called from several
+// goroutines at once, for different functions, so it must not change anything but ctx.
+type Lowerer func(fn *FunctionDefNode, ctx *SsaContext) os.Error
+
+// A compiled function.  Name is qualified by the classes and functions it is nested
+// in, as in "Class.method" or "outer.inner".
+type CompiledFunction struct {
+	Name string
+	Def  *FunctionDefNode
+	Code *SsaContext
+
+	// The registers and the spill slots a frame needs to run the code.
+	NumRegisters  int
+	NumSpillSlots int
+}
+
+// The compiled functions of a module, in source order.
+type CompiledModule struct {
+	Name      string
+	Functions []*CompiledFunction
+}
+
+// Returns the last function compiled under name, which is the one the name is
+// bound to once the module has run, or nil if there is none.
+func (m *CompiledModule) Lookup(name string) *CompiledFunction {
+	for i := len(m.Functions) - 1; i >= 0; i-- {
+		if m.Functions[i].Name == name {
+			return m.Functions[i]
+		}
+	}
+	return nil
+}
+
+// Appends the functions defined anywhere in body to fns, nested functions after the
+// function they are in.
+func collectFunctions(prefix string, body []Ast, fns []*CompiledFunction) []*CompiledFunction {
+	for _, stmt := range body {
+		Walk(stmt, func(n Ast) bool {
+			switch n := n.(type) {
+			case *FunctionDefNode:
+				fn := &CompiledFunction{Name: prefix + n.Name, Def: n}
+				fns = append(fns, fn)
+				fns = collectFunctions(fn.Name+".", n.Body, fns)
+				return false
+			case *ClassDefNode:
+				fns = collectFunctions(prefix+n.Name+".", n.Body, fns)
+				return false
+			}
+			return true
+		})
+	}
+	return fns
+}
+
+// Takes a single function through the pipeline.
+func compileFunction(fn *CompiledFunction, lower Lowerer, num_regs int) os.Error {
+	ctx := new(SsaContext)
+	ctx.Init()
+
+	if err := lower(fn.Def, ctx); err != nil {
+		return err
+	}
+
+	ctx.FoldConstants()
+	for ctx.Eliminate() > 0 {
+	}
+	ctx.AnalyzeUnboxing()
+	ctx.AnalyzeRanges()
+
+	fn.Code = ctx.AllocateRegisters(num_regs)
+	fn.Code.Peephole()
+	fn.NumRegisters = num_regs
+	fn.NumSpillSlots = fn.Code.SpillRoomNeeded
+	return nil
+}
+
+// Compiles every function in mod with workers goroutines, or one per processor if workers
+// is 0 or less.  If any function fails to compile, the error of the first one in source
+// order is returned.
+func CompileModule(name string, mod *ModuleNode, lower Lowerer, num_regs, workers int) (*CompiledModule, os.Error) {
+	m := &CompiledModule{Name: name}
+	m.Functions = collectFunctions("", mod.Body, nil)
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(m.Functions) {
+		workers = len(m.Functions)
+	}
+
+	jobs := make(chan int, len(m.Functions))
+	for i := range m.Functions {
+		jobs <- i
+	}
+	close(jobs)
+
+	errors := make([]os.Error, len(m.Functions))
+	done := make(chan bool)
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				errors[i] = compileFunction(m.Functions[i], lower, num_regs)
+			}
+			done <- true
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		<-done
+	}
+
+	for i, err := range errors {
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("%v: %v", m.Functions[i].Name, err.String()))
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the module compilation pipeline.
+
+*/
+
+package python
+
+import (
+        "os"
+        "strings"
+        "testing"
+)
+
+const compileSource = `def f(a, b):
+    return a + b
+
+class C:
+    def method(self, x, y, z):
+        def inner(q):
+            return q
+        return x
+
+def g():
+    pass
+
+def f(a, b, c):
+    return c
+`
+
+// Sums the arguments of the function, and returns the sum.
+func lowerArgSum(fn *FunctionDefNode, ctx *SsaContext) os.Error {
+    if fn.Name == "broken" {
+        return os.NewError("can't lower this")
+    }
+
+    sum := -1
+    for _, arg := range fn.Args {
+        v := ctx.LoadName(arg.Name)
+        if sum < 0 {
+            sum = v
+        } else {
+            sum = ctx.Eval(SSA_ADD, sum, v)
+        }
+    }
+    ctx.Return(sum)
+    return nil
+}
+
+func TestCompileModule(t *testing.T) {
+    _, mod := parseSource(t, compileSource)
+
+    serial, err := CompileModule("test", mod, lowerArgSum, 4, 1)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+
+    names := []string{"f", "C.method", "C.method.inner", "g", "f"}
+    if len(serial.Functions) != len(names) {
+        t.Fatalf("expected %v functions, got %v", len(names), len(serial.Functions))
+    }
+    for i, fn := range serial.Functions {
+        if fn.Name != names[i] {
+            t.Errorf("function %v should be %v, got %v", i, names[i], fn.Name)
+        }
+        if fn.Code == nil {
+            t.Errorf("%v was not compiled", fn.Name)
+        } else if fn.NumRegisters != 4 || fn.NumSpillSlots != fn.Code.SpillRoomNeeded {
+            t.Errorf("%v needs 4 registers and %v spill slots, got %v and %v", fn.Name, fn.Code.SpillRoomNeeded, fn.NumRegisters, fn.NumSpillSlots)
+        }
+    }
+
+    if fn := serial.Lookup("f"); fn == nil || len(fn.Def.Args) != 3 {
+        t.Errorf("Lookup should find the last definition of f")
+    }
+    if serial.Lookup("h") != nil {
+        t.Errorf("Lookup found a function that doesn't exist")
+    }
+
+    // Compiling in parallel must give exactly the same code.
+    parallel, err := CompileModule("test", mod, lowerArgSum, 4, 0)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    for i, fn := range parallel.Functions {
+        if fn.Code.String() != serial.Functions[i].Code.String() {
+            t.Errorf("%v differs when compiled in parallel:\n%v\n%v", fn.Name, fn.Code, serial.Functions[i].Code)
+        }
+    }
+}
+
+func TestCompileModuleError(t *testing.T) {
+    _, mod := parseSource(t, "def ok(a):\n    pass\ndef broken(a):\n    pass\n")
+
+    m, err := CompileModule("test", mod, lowerArgSum, 4, 2)
+    if err == nil || m != nil {
+        t.Fatalf("expected an error")
+    }
+    if !strings.Contains(err.String(), "broken") {
+        t.Errorf("the error should name the function, got %v", err)
+    }
+}
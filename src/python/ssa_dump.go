@@ -0,0 +1,225 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module prints the SSA stream in a readable form, for debugging the
+   optimizer and the register allocator.  Each block is printed with its edges,
+   followed by its elements, like:
+
+       b0: succs b1 b2
+           %12 = ADD %3, %7 [live 3..19, reg r4]
+*/
+
+package python
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ssaOpNames = []string{
+	SSA_NOP:    "NOP",
+	SSA_CALL:   "CALL",
+	SSA_SPILL:  "SPILL",
+	SSA_FILL:   "FILL",
+	SSA_LOAD:   "LOAD",
+	SSA_STORE:  "STORE",
+	SSA_ADD:    "ADD",
+	SSA_SUB:    "SUB",
+	SSA_MUL:    "MUL",
+	SSA_DIV:    "DIV",
+	SSA_MOD:    "MOD",
+	SSA_POW:    "POW",
+	SSA_AND:    "AND",
+	SSA_OR:     "OR",
+	SSA_XOR:    "XOR",
+	SSA_NOT:    "NOT",
+	SSA_GET:    "GET",
+	SSA_SET:    "SET",
+	SSA_IDX:    "IDX",
+	SSA_EQ:     "EQ",
+	SSA_NE:     "NE",
+	SSA_LT:     "LT",
+	SSA_LE:     "LE",
+	SSA_GT:     "GT",
+	SSA_GE:     "GE",
+	SSA_JUMP:   "JUMP",
+	SSA_BRANCH: "BRANCH",
+	SSA_RETURN: "RETURN",
+	SSA_COPY:   "COPY",
+	SSA_MOVE:   "MOVE",
+	SSA_ARG:    "ARG",
+
+	SSA_TO_INT:   "TO_INT",
+	SSA_TO_FLOAT: "TO_FLOAT",
+}
+
+func opName(op uint) string {
+	if op < uint(len(ssaOpNames)) && ssaOpNames[op] != "" {
+		return ssaOpNames[op]
+	}
+	return fmt.Sprintf("OP%v", op)
+}
+
+// Formats operand n (1 or 2) of el.
+func (ctx *SsaContext) formatOperand(el *SsaElement, n int) string {
+	v, kind := el.Src1, el.Src1Type
+	if n == 2 {
+		v, kind = el.Src2, el.Src2Type
+	}
+
+	switch kind {
+	case SSA_TYPE_ELEMENT:
+		return fmt.Sprintf("%%%v", v)
+	case SSA_TYPE_BLOCK:
+		return fmt.Sprintf("b%v", v)
+	case SSA_TYPE_INTEGER:
+		if v < len(ctx.Ints) {
+			return fmt.Sprintf("int %v", ctx.Ints[v])
+		}
+	case SSA_TYPE_FLOAT:
+		if v < len(ctx.Floats) {
+			return fmt.Sprintf("float %v", ctx.Floats[v])
+		}
+	case SSA_TYPE_STRING:
+		if v < len(ctx.Strings) {
+			return fmt.Sprintf("str %q", ctx.Strings[v])
+		}
+	case SSA_TYPE_NAME:
+		if v < len(ctx.Names) {
+			return fmt.Sprintf("name %v", ctx.Names[v])
+		}
+	}
+
+	return fmt.Sprintf("#%v", v)
+}
+
+// Formats a single element, without the trailing newline.
+func (ctx *SsaContext) formatElement(el *SsaElement) string {
+	buf := new(bytes.Buffer)
+
+	if producesValue(el.Op) {
+		fmt.Fprintf(buf, "%%%v = ", el.Address)
+	}
+	buf.WriteString(opName(el.Op))
+
+	switch {
+	case el.Op == SSA_NOP:
+
+	case el.Op == SSA_SPILL:
+		fmt.Fprintf(buf, " slot %v, r%v", el.Src1, el.DstRegister)
+		return buf.String()
+
+	case el.Op == SSA_FILL:
+		fmt.Fprintf(buf, " slot %v", el.Src1)
+
+	case el.Op == SSA_BRANCH && el.Cond != 0:
+		// A fused branch only has its targets in the edges.
+		fmt.Fprintf(buf, " %v %v, %v", opName(el.Cond), ctx.formatOperand(el, 1), ctx.formatOperand(el, 2))
+		for _, s := range ctx.Blocks[el.Block].Succs {
+			fmt.Fprintf(buf, ", b%v", s.Id)
+		}
+
+	case el.Op == SSA_BRANCH:
+		// The false target isn't stored in the element, only in the edges.
+		fmt.Fprintf(buf, " %v, %v", ctx.formatOperand(el, 1), ctx.formatOperand(el, 2))
+		if b := ctx.Blocks[el.Block]; len(b.Succs) > 1 {
+			fmt.Fprintf(buf, ", b%v", b.Succs[1].Id)
+		}
+
+	case el.Op == SSA_LOAD || el.Op == SSA_JUMP || el.Op == SSA_COPY || el.Op == SSA_MOVE || el.Op == SSA_NOT ||
+		isConversion(el.Op):
+		fmt.Fprintf(buf, " %v", ctx.formatOperand(el, 1))
+
+	case el.Op == SSA_CALL:
+		fmt.Fprintf(buf, " %v(", ctx.formatOperand(el, 1))
+		for i, arg := range ctx.CallArgs(el.Address) {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(buf, "%%%v", arg)
+		}
+		buf.WriteString(")")
+
+	case el.Op == SSA_ARG:
+		fmt.Fprintf(buf, " %v", ctx.formatOperand(el, 1))
+
+	case el.Op == SSA_RETURN:
+		if el.Src1Type != SSA_TYPE_NONE {
+			fmt.Fprintf(buf, " %v", ctx.formatOperand(el, 1))
+		}
+
+	default:
+		fmt.Fprintf(buf, " %v, %v", ctx.formatOperand(el, 1), ctx.formatOperand(el, 2))
+	}
+
+	if producesValue(el.Op) {
+		fmt.Fprintf(buf, " [live %v..%v", el.LiveStart, el.LiveEnd)
+		if el.DstRegister != 0 {
+			fmt.Fprintf(buf, ", reg r%v", el.DstRegister)
+		}
+		if el.IsConst {
+			buf.WriteString(", const")
+		}
+		if el.Unboxed {
+			buf.WriteString(", raw")
+		}
+		if el.SmallInt {
+			buf.WriteString(", small")
+		}
+		buf.WriteString("]")
+	}
+
+	return buf.String()
+}
+
+// Writes the blocks and elements of the context to w in layout order.
+func (ctx *SsaContext) Dump(w io.Writer) os.Error {
+	for _, b := range ctx.Blocks {
+		header := fmt.Sprintf("b%v:", b.Id)
+		if len(b.Preds) > 0 {
+			header += " preds"
+			for _, p := range b.Preds {
+				header += fmt.Sprintf(" b%v", p.Id)
+			}
+		}
+		if len(b.Succs) > 0 {
+			header += " succs"
+			for _, s := range b.Succs {
+				header += fmt.Sprintf(" b%v", s.Id)
+			}
+		}
+
+		if _, err := fmt.Fprintln(w, header); err != nil {
+			return err
+		}
+
+		for _, id := range b.Elements {
+			if _, err := fmt.Fprintf(w, "    %v\n", ctx.formatElement(ctx.Elements[id])); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (ctx *SsaContext) String() string {
+	buf := new(bytes.Buffer)
+	ctx.Dump(buf)
+	return buf.String()
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the SSA printer.
+
+*/
+
+package python
+
+import (
+        "big"
+        "testing"
+)
+
+func TestDump(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    then_block := ctx.NewBlock()
+    else_block := ctx.NewBlock()
+
+    a := ctx.LoadInt(big.NewInt(3))
+    b := ctx.LoadInt(big.NewInt(7))
+    cond := ctx.Eval(SSA_LT, a, b)
+    ctx.Branch(cond, then_block, else_block)
+
+    ctx.SetBlock(then_block)
+    ctx.Return(ctx.Eval(SSA_ADD, a, b))
+
+    ctx.SetBlock(else_block)
+    ctx.Return(-1)
+
+    ctx.Elements[a].DstRegister = 4
+
+    expected := "b0: succs b1 b2\n" +
+                "    %0 = LOAD int 3 [live 0..4, reg r4]\n" +
+                "    %1 = LOAD int 7 [live 1..4]\n" +
+                "    %2 = LT %0, %1 [live 2..3]\n" +
+                "    BRANCH %2, b1, b2\n" +
+                "b1: preds b0\n" +
+                "    %4 = ADD %0, %1 [live 4..5]\n" +
+                "    RETURN %4\n" +
+                "b2: preds b0\n" +
+                "    RETURN\n"
+
+    if s := ctx.String(); s != expected {
+        t.Errorf("dump was:\n%v\nwanted:\n%v", s, expected)
+    }
+}
@@ -0,0 +1,374 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the on-disk format of an SsaContext, so that the
+   front end can cache the compiled form of a module and skip parsing it when
+   the source hasn't changed.  Everything is written little endian.  The format
+   starts with a magic number and a version, and a reader rejects any version
+   it doesn't know, so a stale cache is simply rebuilt.
+
+   The live intervals are not saved, since ComputeLiveness rebuilds them.
+*/
+
+package python
+
+import (
+	"big"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	ssaMagic   = 0x41535350 // "PSSA"
+	ssaVersion = 4
+)
+
+// Element flags, packed into a single word.
+const (
+	ssaFlagWasRead = 1 << iota
+	ssaFlagIsConst
+	ssaFlagPinned
+	ssaFlagUnboxed
+	ssaFlagSmallInt
+	ssaFlagInPlace
+)
+
+// Tracks the first error, so the callers can check once at the end.
+type ssaEncoder struct {
+	w   io.Writer
+	err os.Error
+}
+
+func (e *ssaEncoder) putInt(v int) {
+	if e.err == nil {
+		e.err = binary.Write(e.w, binary.LittleEndian, int64(v))
+	}
+}
+
+func (e *ssaEncoder) putString(s string) {
+	e.putInt(len(s))
+	if e.err == nil {
+		_, e.err = io.WriteString(e.w, s)
+	}
+}
+
+func (e *ssaEncoder) putInts(l []int) {
+	e.putInt(len(l))
+	for _, v := range l {
+		e.putInt(v)
+	}
+}
+
+type ssaDecoder struct {
+	r   io.Reader
+	err os.Error
+}
+
+func (d *ssaDecoder) getInt() int {
+	var v int64
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.LittleEndian, &v)
+	}
+	return int(v)
+}
+
+// Reads a length, and checks that it is sane, so that a corrupt file can't make us
+// allocate huge amounts of memory.
+func (d *ssaDecoder) getLength() int {
+	n := d.getInt()
+	if d.err == nil && (n < 0 || n > 1<<28) {
+		d.err = os.NewError("ssa: corrupt length")
+		return 0
+	}
+	return n
+}
+
+func (d *ssaDecoder) getString() string {
+	n := d.getLength()
+	if d.err != nil {
+		return ""
+	}
+
+	buf := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, buf)
+	return string(buf)
+}
+
+func (d *ssaDecoder) getInts() []int {
+	l := make([]int, d.getLength())
+	for i := range l {
+		l[i] = d.getInt()
+	}
+	return l
+}
+
+// Returns an error if id isn't a valid index of a list of length n.
+func (d *ssaDecoder) check(id, n int) {
+	if d.err == nil && (id < 0 || id >= n) {
+		d.err = os.NewError("ssa: index out of range")
+	}
+}
+
+// Writes the context to w.
+func (ctx *SsaContext) Encode(w io.Writer) os.Error {
+	e := &ssaEncoder{w: w}
+
+	e.putInt(ssaMagic)
+	e.putInt(ssaVersion)
+
+	// Constant pools
+	e.putInt(len(ctx.Ints))
+	for i := 0; i < len(ctx.Ints); i++ {
+		e.putString(ctx.Ints[i].String())
+	}
+	e.putInt(len(ctx.Floats))
+	for i := 0; i < len(ctx.Floats); i++ {
+		e.putInt(int(math.Float64bits(ctx.Floats[i])))
+	}
+	e.putInt(len(ctx.Strings))
+	for i := 0; i < len(ctx.Strings); i++ {
+		e.putString(ctx.Strings[i])
+	}
+	e.putInt(len(ctx.Names))
+	for i := 0; i < len(ctx.Names); i++ {
+		e.putString(ctx.Names[i])
+	}
+
+	// Elements
+	e.putInt(ctx.LastElementId)
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+
+		flags := 0
+		if el.WasRead {
+			flags |= ssaFlagWasRead
+		}
+		if el.IsConst {
+			flags |= ssaFlagIsConst
+		}
+		if el.Pinned {
+			flags |= ssaFlagPinned
+		}
+		if el.Unboxed {
+			flags |= ssaFlagUnboxed
+		}
+		if el.SmallInt {
+			flags |= ssaFlagSmallInt
+		}
+		if el.InPlace {
+			flags |= ssaFlagInPlace
+		}
+
+		e.putInts([]int{
+			int(el.Op), el.Src1, el.Src2, int(el.Src1Type), int(el.Src2Type), flags,
+			el.LiveStart, el.LiveEnd, el.ActiveStart, el.ActiveEnd,
+			el.DstRegister, el.Src1Register, el.Src2Register, el.FixedRegister, el.HintRegister,
+			el.Block, int(el.ValueType), int(el.Cond),
+		})
+	}
+
+	// Blocks
+	e.putInt(len(ctx.Blocks))
+	for _, b := range ctx.Blocks {
+		e.putInts(b.Elements)
+
+		for _, edges := range [][]*BasicBlock{b.Preds, b.Succs} {
+			e.putInt(len(edges))
+			for _, other := range edges {
+				e.putInt(other.Id)
+			}
+		}
+	}
+	e.putInt(ctx.Current.Id)
+
+	// The constant maps, as the elements that load each constant.
+	e.putInt(len(ctx.IntIdx))
+	for _, id := range ctx.IntIdx {
+		e.putInt(id)
+	}
+	e.putInt(len(ctx.FloatIdx))
+	for _, id := range ctx.FloatIdx {
+		e.putInt(id)
+	}
+	e.putInt(len(ctx.StringIdx))
+	for s, id := range ctx.StringIdx {
+		e.putString(s)
+		e.putInt(id)
+	}
+	e.putInt(len(ctx.NameIdx))
+	for s, id := range ctx.NameIdx {
+		e.putString(s)
+		e.putInt(id)
+	}
+
+	// Spill metadata
+	e.putInt(ctx.SpillRoomNeeded)
+
+	return e.err
+}
+
+// Reads a context written by Encode from r into ctx, replacing its contents.
+func (ctx *SsaContext) Decode(r io.Reader) os.Error {
+	d := &ssaDecoder{r: r}
+
+	if d.getInt() != ssaMagic && d.err == nil {
+		return os.NewError("ssa: not an SSA file")
+	}
+	if d.getInt() != ssaVersion && d.err == nil {
+		return os.NewError("ssa: unknown version")
+	}
+
+	ctx.Init()
+	ctx.Blocks = ctx.Blocks[0:0]
+
+	for n := d.getLength(); n > 0 && d.err == nil; n-- {
+		v, ok := new(big.Int).SetString(d.getString(), 10)
+		if !ok && d.err == nil {
+			d.err = os.NewError("ssa: bad integer constant")
+		}
+		ctx.Ints = append(ctx.Ints, v)
+	}
+	for n := d.getLength(); n > 0 && d.err == nil; n-- {
+		ctx.Floats = append(ctx.Floats, math.Float64frombits(uint64(d.getInt())))
+	}
+	for n := d.getLength(); n > 0 && d.err == nil; n-- {
+		ctx.Strings = append(ctx.Strings, d.getString())
+	}
+	for n := d.getLength(); n > 0 && d.err == nil; n-- {
+		ctx.Names = append(ctx.Names, d.getString())
+	}
+
+	count := d.getLength()
+	ctx.Reserve(count)
+
+	for id := 0; id < count && d.err == nil; id++ {
+		f := d.getInts()
+		if len(f) != 18 && d.err == nil {
+			d.err = os.NewError("ssa: bad element")
+		}
+		if d.err != nil {
+			break
+		}
+
+		el := ctx.NewElement()
+		el.Op, el.Src1, el.Src2, el.Src1Type, el.Src2Type = uint(f[0]), f[1], f[2], uint(f[3]), uint(f[4])
+		el.WasRead = f[5]&ssaFlagWasRead != 0
+		el.IsConst = f[5]&ssaFlagIsConst != 0
+		el.Pinned = f[5]&ssaFlagPinned != 0
+		el.Unboxed = f[5]&ssaFlagUnboxed != 0
+		el.SmallInt = f[5]&ssaFlagSmallInt != 0
+		el.InPlace = f[5]&ssaFlagInPlace != 0
+		el.LiveStart, el.LiveEnd, el.ActiveStart, el.ActiveEnd = f[6], f[7], f[8], f[9]
+		el.DstRegister, el.Src1Register, el.Src2Register = f[10], f[11], f[12]
+		el.FixedRegister, el.HintRegister = f[13], f[14]
+		el.Block, el.ValueType, el.Cond = f[15], uint(f[16]), uint(f[17])
+		el.Address = id
+
+		// Make sure the operands point at something.
+		if el.ReadsElement(1) {
+			d.check(el.Src1, count)
+		}
+		if el.ReadsElement(2) {
+			d.check(el.Src2, count)
+		}
+		if el.Op == SSA_LOAD {
+			switch el.Src1Type {
+			case SSA_TYPE_INTEGER:
+				d.check(el.Src1, len(ctx.Ints))
+			case SSA_TYPE_FLOAT:
+				d.check(el.Src1, len(ctx.Floats))
+			case SSA_TYPE_STRING:
+				d.check(el.Src1, len(ctx.Strings))
+			case SSA_TYPE_NAME:
+				d.check(el.Src1, len(ctx.Names))
+			}
+		}
+		if el.Op == SSA_STORE {
+			d.check(el.Src2, len(ctx.Names))
+		}
+
+		ctx.Elements = append(ctx.Elements, el)
+	}
+	ctx.LastElementId = len(ctx.Elements)
+
+	num_blocks := d.getLength()
+	for i := 0; i < num_blocks; i++ {
+		ctx.NewBlock()
+	}
+
+	for _, b := range ctx.Blocks {
+		b.Elements = d.getInts()
+		for _, id := range b.Elements {
+			d.check(id, count)
+		}
+
+		for _, edges := range []*[]*BasicBlock{&b.Preds, &b.Succs} {
+			for n := d.getLength(); n > 0 && d.err == nil; n-- {
+				other := d.getInt()
+				d.check(other, num_blocks)
+				if d.err == nil {
+					*edges = append(*edges, ctx.Blocks[other])
+				}
+			}
+		}
+	}
+
+	current := d.getInt()
+	d.check(current, num_blocks)
+	if d.err != nil {
+		return d.err
+	}
+	ctx.Current = ctx.Blocks[current]
+
+	for id := 0; id < count; id++ {
+		d.check(ctx.Elements[id].Block, num_blocks)
+	}
+
+	for n := d.getLength(); n > 0 && d.err == nil; n-- {
+		id := d.getInt()
+		d.check(id, count)
+		if d.err == nil {
+			d.check(ctx.Elements[id].Src1, len(ctx.Ints))
+		}
+		if d.err == nil {
+			ctx.IntIdx[ctx.Ints[ctx.Elements[id].Src1]] = id
+		}
+	}
+	for n := d.getLength(); n > 0 && d.err == nil; n-- {
+		id := d.getInt()
+		d.check(id, count)
+		if d.err == nil {
+			d.check(ctx.Elements[id].Src1, len(ctx.Floats))
+		}
+		if d.err == nil {
+			ctx.FloatIdx[ctx.Floats[ctx.Elements[id].Src1]] = id
+		}
+	}
+	for _, m := range []map[string]int{ctx.StringIdx, ctx.NameIdx} {
+		for n := d.getLength(); n > 0 && d.err == nil; n-- {
+			s := d.getString()
+			id := d.getInt()
+			d.check(id, count)
+			m[s] = id
+		}
+	}
+
+	ctx.SpillRoomNeeded = d.getInt()
+
+	return d.err
+}
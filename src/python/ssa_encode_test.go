@@ -0,0 +1,104 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the SSA file format.
+
+*/
+
+package python
+
+import (
+        "big"
+        "bytes"
+        "testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+    ctx, _ := buildDiamond()
+
+    huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+    ctx.SetBlock(ctx.Blocks[3])
+    product := ctx.Eval(SSA_MUL, ctx.LoadInt(huge), ctx.LoadFloat(2.5))
+    ctx.Elements[product].InPlace = true
+    ctx.Return(product)
+
+    ctx.Strings = append(ctx.Strings, "hello")
+    ctx.StringIdx["hello"] = 0
+    ctx.Names = append(ctx.Names, "x")
+
+    allocated := ctx.AllocateRegisters(4)
+
+    for _, original := range []*SsaContext{ctx, allocated} {
+        buf := new(bytes.Buffer)
+        if err := original.Encode(buf); err != nil {
+            t.Fatalf("encode failed: %v", err)
+        }
+
+        decoded := new(SsaContext)
+        if err := decoded.Decode(buf); err != nil {
+            t.Fatalf("decode failed: %v", err)
+        }
+
+        // The dump covers the elements, blocks, edges and constants.
+        if decoded.String() != original.String() {
+            t.Errorf("round trip changed the context:\n%v\nwanted:\n%v", decoded, original)
+        }
+
+        if decoded.SpillRoomNeeded != original.SpillRoomNeeded || decoded.Current.Id != original.Current.Id {
+            t.Errorf("round trip lost the context metadata")
+        }
+
+        // The intervals aren't saved.
+        for id := 0; id < original.LastElementId; id++ {
+            want := *original.Elements[id]
+            want.Interval = nil
+            if *decoded.Elements[id] != want {
+                t.Errorf("element %v changed: %v, wanted %v", id, *decoded.Elements[id], want)
+            }
+        }
+
+        if len(decoded.IntIdx) != len(original.IntIdx) || decoded.StringIdx["hello"] != original.StringIdx["hello"] {
+            t.Errorf("constant maps were not restored")
+        }
+        for v, id := range decoded.IntIdx {
+            if original.Ints[original.Elements[id].Src1].Cmp(v) != 0 {
+                t.Errorf("int map points element %v at %v", id, v)
+            }
+        }
+    }
+}
+
+func TestDecodeErrors(t *testing.T) {
+    ctx, _ := buildDiamond()
+
+    buf := new(bytes.Buffer)
+    ctx.Encode(buf)
+    data := buf.Bytes()
+
+    // Every truncation of the file must be an error, not a panic.
+    for n := 0; n < len(data); n += 7 {
+        if err := new(SsaContext).Decode(bytes.NewBuffer(data[0:n])); err == nil {
+            t.Errorf("decoding %v of %v bytes succeeded", n, len(data))
+        }
+    }
+
+    bad := make([]byte, len(data))
+    copy(bad, data)
+    bad[0] ^= 0xff
+    if err := new(SsaContext).Decode(bytes.NewBuffer(bad)); err == nil {
+        t.Errorf("decoded a file with a bad magic number")
+    }
+}
@@ -0,0 +1,243 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements liveness analysis over the control flow graph.  The
+   live ranges kept by Write are only right for straight line code, since a
+   value used inside of a loop must stay live around the back edge, and a value
+   used on only one side of a branch is dead on the other side.  Here we solve
+   the usual backward dataflow problem to find the elements live into each
+   block, and then build a live interval for every element in terms of the
+   positions of the linear order the register allocator visits.
+*/
+
+package python
+
+// A run of positions over which a value is live, including both ends.
+type LiveRange struct {
+	Start, End int
+}
+
+// The positions over which a value is live.  The ranges are sorted and don't
+// touch, so the gaps between them are the holes where the value is dead, like
+// the other side of a branch.
+type LiveInterval struct {
+	Ranges []LiveRange
+}
+
+func (iv *LiveInterval) Start() int {
+	return iv.Ranges[0].Start
+}
+
+func (iv *LiveInterval) End() int {
+	return iv.Ranges[len(iv.Ranges)-1].End
+}
+
+// Returns true if the value is live at pos, and not in a hole.
+func (iv *LiveInterval) Covers(pos int) bool {
+	for _, r := range iv.Ranges {
+		if pos < r.Start {
+			return false
+		}
+		if pos <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the positions start to end to the interval, merging it with any ranges it
+// overlaps or touches.
+func (iv *LiveInterval) addRange(start, end int) {
+	ranges := make([]LiveRange, 0, len(iv.Ranges)+1)
+	added := false
+
+	for _, r := range iv.Ranges {
+		switch {
+		case r.End+1 < start:
+			ranges = append(ranges, r)
+		case end+1 < r.Start:
+			if !added {
+				ranges = append(ranges, LiveRange{start, end})
+				added = true
+			}
+			ranges = append(ranges, r)
+		default:
+			if r.Start < start {
+				start = r.Start
+			}
+			if r.End > end {
+				end = r.End
+			}
+		}
+	}
+
+	if !added {
+		ranges = append(ranges, LiveRange{start, end})
+	}
+
+	iv.Ranges = ranges
+}
+
+// Moves the start of the interval to the definition at pos.  The interval was
+// built back to front, so the first range is the one holding the definition.
+func (iv *LiveInterval) setStart(pos int) {
+	if len(iv.Ranges) == 0 {
+		iv.Ranges = append(iv.Ranges, LiveRange{pos, pos})
+		return
+	}
+	iv.Ranges[0].Start = pos
+}
+
+// Computes the blocks' LiveIn and LiveOut sets, and the live interval of every element, in
+// terms of positions in order, which must list the elements block by block in layout order.
+// The LiveStart and LiveEnd of each element are set to the ends of its interval.
+func (ctx *SsaContext) ComputeLiveness(order []int) {
+	// Find the positions of each block in the order.
+	first := make([]int, len(ctx.Blocks))
+	pos := 0
+	for _, b := range ctx.Blocks {
+		first[b.Id] = pos
+		pos += len(b.Elements)
+	}
+
+	// The values each block reads before defining them, and the values it defines.
+	uses := make([]map[int]bool, len(ctx.Blocks))
+	defs := make([]map[int]bool, len(ctx.Blocks))
+
+	for _, b := range ctx.Blocks {
+		uses[b.Id] = make(map[int]bool)
+		defs[b.Id] = make(map[int]bool)
+
+		for _, id := range b.Elements {
+			el := ctx.Elements[id]
+			if el.ReadsElement(1) && !defs[b.Id][el.Src1] {
+				uses[b.Id][el.Src1] = true
+			}
+			if el.ReadsElement(2) && !defs[b.Id][el.Src2] {
+				uses[b.Id][el.Src2] = true
+			}
+			defs[b.Id][id] = true
+		}
+
+		b.LiveIn = make(map[int]bool)
+		b.LiveOut = make(map[int]bool)
+	}
+
+	// Iterate to a fixed point.  Visiting the blocks in reverse gets there
+	// quickly, since most edges point forward in the layout.
+	for changed := true; changed; {
+		changed = false
+
+		for i := len(ctx.Blocks) - 1; i >= 0; i-- {
+			b := ctx.Blocks[i]
+
+			for _, s := range b.Succs {
+				for id := range s.LiveIn {
+					if !b.LiveOut[id] {
+						b.LiveOut[id] = true
+						changed = true
+					}
+				}
+			}
+
+			for id := range uses[b.Id] {
+				if !b.LiveIn[id] {
+					b.LiveIn[id] = true
+					changed = true
+				}
+			}
+			for id := range b.LiveOut {
+				if !defs[b.Id][id] && !b.LiveIn[id] {
+					b.LiveIn[id] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	// Build the intervals back to front.  A value live out of a block is live
+	// over the whole block, until we find its definition.
+	ctx.Intervals = make([]*LiveInterval, ctx.LastElementId)
+	interval := func(id int) *LiveInterval {
+		if ctx.Intervals[id] == nil {
+			ctx.Intervals[id] = new(LiveInterval)
+		}
+		return ctx.Intervals[id]
+	}
+
+	for i := len(ctx.Blocks) - 1; i >= 0; i-- {
+		b := ctx.Blocks[i]
+		if len(b.Elements) == 0 {
+			continue
+		}
+
+		from, to := first[b.Id], first[b.Id]+len(b.Elements)-1
+		for id := range b.LiveOut {
+			interval(id).addRange(from, to)
+		}
+
+		for j := len(b.Elements) - 1; j >= 0; j-- {
+			id := b.Elements[j]
+			el := ctx.Elements[id]
+
+			interval(id).setStart(from + j)
+
+			if el.ReadsElement(1) {
+				interval(el.Src1).addRange(from, from+j)
+			}
+			if el.ReadsElement(2) {
+				interval(el.Src2).addRange(from, from+j)
+			}
+		}
+	}
+
+	for _, id := range order {
+		el := ctx.Elements[id]
+		el.Interval = ctx.Intervals[id]
+		el.LiveStart = el.Interval.Start()
+		el.LiveEnd = el.Interval.End()
+	}
+}
+
+// Returns the most registers needed at any position in order, using the live ranges set by
+// ComputeLiveness.  An element needs its register from its definition until the position
+// before its last use, since the result of that use can take the register over.
+func (ctx *SsaContext) registerPressure(order []int) int {
+	delta := make([]int, len(order)+1)
+	for _, id := range order {
+		el := ctx.Elements[id]
+		if !producesValue(el.Op) {
+			continue
+		}
+
+		last := el.LiveEnd - 1
+		if last < el.LiveStart {
+			last = el.LiveStart
+		}
+		delta[el.LiveStart]++
+		delta[last+1]--
+	}
+
+	most, live := 0, 0
+	for _, d := range delta {
+		live += d
+		if live > most {
+			most = live
+		}
+	}
+
+	return most
+}
@@ -0,0 +1,130 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the liveness analysis.
+
+*/
+
+package python
+
+import (
+        "big"
+        "testing"
+)
+
+func TestLivenessAroundLoop(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    header := ctx.NewBlock()
+    body := ctx.NewBlock()
+    exit := ctx.NewBlock()
+
+    a := ctx.LoadInt(big.NewInt(1))
+    b := ctx.LoadInt(big.NewInt(2))
+    ctx.Jump(header)
+
+    ctx.SetBlock(header)
+    c := ctx.Eval(SSA_LT, a, b)
+    ctx.Branch(c, body, exit)
+
+    ctx.SetBlock(body)
+    d := ctx.Eval(SSA_ADD, a, b)
+    ctx.Elements[d].Pinned = true
+    ctx.Jump(header)
+
+    ctx.SetBlock(exit)
+    ctx.Return(b)
+
+    ctx.ComputeLiveness(ctx.linearOrder())
+
+    // a is last read in the body, but the body loops back to the header,
+    // which reads it again.
+    if iv := ctx.Intervals[a]; len(iv.Ranges) != 1 || iv.Start() != 0 || iv.End() != 6 {
+        t.Errorf("a should be live from 0 to 6, got %v", iv.Ranges)
+    }
+    if ctx.Elements[a].LiveEnd != 6 {
+        t.Errorf("live end of a was not updated, got %v", ctx.Elements[a].LiveEnd)
+    }
+
+    if iv := ctx.Intervals[b]; iv.Start() != 1 || iv.End() != 7 {
+        t.Errorf("b should be live from 1 to 7, got %v", iv.Ranges)
+    }
+
+    if !header.LiveIn[a] || !body.LiveOut[a] || exit.LiveIn[a] {
+        t.Errorf("wrong live sets for a")
+    }
+
+    if iv := ctx.Intervals[c]; iv.Start() != 3 || iv.End() != 4 {
+        t.Errorf("c should be live from 3 to 4, got %v", iv.Ranges)
+    }
+}
+
+func TestLivenessHoles(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    then_block := ctx.NewBlock()
+    else_block := ctx.NewBlock()
+
+    x := ctx.LoadInt(big.NewInt(5))
+    y := ctx.LoadInt(big.NewInt(6))
+    ctx.Branch(ctx.Eval(SSA_LT, x, y), then_block, else_block)
+
+    ctx.SetBlock(then_block)
+    ctx.Return(y)
+
+    ctx.SetBlock(else_block)
+    ctx.Return(x)
+
+    ctx.ComputeLiveness(ctx.linearOrder())
+
+    // x is dead in the then block, which is laid out between its uses.
+    iv := ctx.Intervals[x]
+    if len(iv.Ranges) != 2 || iv.Ranges[0] != (LiveRange{0, 3}) || iv.Ranges[1] != (LiveRange{5, 5}) {
+        t.Fatalf("x should be live over 0..3 and 5..5, got %v", iv.Ranges)
+    }
+
+    if iv.Covers(4) || !iv.Covers(3) || !iv.Covers(5) || iv.Covers(6) {
+        t.Errorf("Covers disagrees with the ranges of x")
+    }
+
+    if iv := ctx.Intervals[y]; len(iv.Ranges) != 1 || iv.End() != 4 {
+        t.Errorf("y should be live over 1..4, got %v", iv.Ranges)
+    }
+}
+
+func TestLiveIntervalAddRange(t *testing.T) {
+    iv := new(LiveInterval)
+    iv.addRange(10, 12)
+    iv.addRange(2, 4)
+    iv.addRange(6, 6)
+
+    if len(iv.Ranges) != 3 || iv.Start() != 2 || iv.End() != 12 {
+        t.Fatalf("ranges were not kept in order: %v", iv.Ranges)
+    }
+
+    // Touching ranges merge, so there is no hole at 5.
+    iv.addRange(5, 5)
+    if len(iv.Ranges) != 2 || iv.Ranges[0] != (LiveRange{2, 6}) {
+        t.Errorf("touching ranges were not merged: %v", iv.Ranges)
+    }
+
+    iv.addRange(0, 20)
+    if len(iv.Ranges) != 1 || iv.Ranges[0] != (LiveRange{0, 20}) {
+        t.Errorf("covering range was not merged: %v", iv.Ranges)
+    }
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module finds the loops in the control flow graph.  A back edge is an
+   edge to a block which is still being visited by a depth first search from
+   the entry block, and the loop it closes is the header it points to, plus
+   every block which can reach the edge without passing through the header.
+   The loop depth of a block is the number of loops it is in, which the register
+   allocator uses to keep the values read in hot loops in registers.
+*/
+
+package python
+
+// Finds the back edges reachable from b, and calls found with each one.
+func findBackEdges(b *BasicBlock, visiting, visited []bool, found func(from, to *BasicBlock)) {
+	visiting[b.Id] = true
+	visited[b.Id] = true
+
+	for _, s := range b.Succs {
+		if visiting[s.Id] {
+			found(b, s)
+		} else if !visited[s.Id] {
+			findBackEdges(s, visiting, visited, found)
+		}
+	}
+
+	visiting[b.Id] = false
+}
+
+// Sets the LoopDepth of every block, and of every element to the deepest loop depth of the
+// blocks that read it.  Loops that share a header are treated as one loop.
+func (ctx *SsaContext) FindLoops() {
+	if len(ctx.Blocks) == 0 {
+		return
+	}
+
+	for _, b := range ctx.Blocks {
+		b.LoopDepth = 0
+	}
+
+	// The blocks of each loop, by header.
+	loops := make(map[int][]bool)
+
+	visiting := make([]bool, len(ctx.Blocks))
+	visited := make([]bool, len(ctx.Blocks))
+	findBackEdges(ctx.Blocks[0], visiting, visited, func(from, to *BasicBlock) {
+		body, present := loops[to.Id]
+		if !present {
+			body = make([]bool, len(ctx.Blocks))
+			body[to.Id] = true
+			loops[to.Id] = body
+		}
+
+		// Walk backwards from the end of the edge until we reach the header.
+		work := []*BasicBlock{from}
+		for len(work) > 0 {
+			b := work[len(work)-1]
+			work = work[0 : len(work)-1]
+
+			if body[b.Id] {
+				continue
+			}
+			body[b.Id] = true
+			work = append(work, b.Preds...)
+		}
+	})
+
+	for _, body := range loops {
+		for id, in := range body {
+			if in {
+				ctx.Blocks[id].LoopDepth++
+			}
+		}
+	}
+
+	for id := 0; id < ctx.LastElementId; id++ {
+		ctx.Elements[id].LoopDepth = 0
+	}
+	for _, b := range ctx.Blocks {
+		for _, id := range b.Elements {
+			el := ctx.Elements[id]
+			for n := 1; n <= 2; n++ {
+				if !el.ReadsElement(n) {
+					continue
+				}
+
+				src := ctx.Elements[el.Src1]
+				if n == 2 {
+					src = ctx.Elements[el.Src2]
+				}
+				if src.LoopDepth < b.LoopDepth {
+					src.LoopDepth = b.LoopDepth
+				}
+			}
+		}
+	}
+}
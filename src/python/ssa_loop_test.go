@@ -0,0 +1,147 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for loop detection and the loop aware spill heuristic.
+
+*/
+
+package python
+
+import (
+        "big"
+        "testing"
+)
+
+// Builds two nested loops.  The y values are read in the inner loop and the x values
+// only after the loops, but the y values are read last, so they live the longest.
+//
+//      entry: x1, x2, x3, y1, y2; jump outer
+//      outer: branch y1 < y2, inner, exit
+//      inner: branch y2 < y1, body, latch
+//      body:  y1 + y2; jump inner
+//      latch: jump outer
+//      exit:  return x1 + x2 + x3 + y1 + y2
+func buildNestedLoops() *SsaContext {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    outer := ctx.NewBlock()
+    inner := ctx.NewBlock()
+    body := ctx.NewBlock()
+    latch := ctx.NewBlock()
+    exit := ctx.NewBlock()
+
+    x1 := ctx.LoadInt(big.NewInt(1))
+    x2 := ctx.LoadInt(big.NewInt(2))
+    x3 := ctx.LoadInt(big.NewInt(3))
+    y1 := ctx.LoadInt(big.NewInt(4))
+    y2 := ctx.LoadInt(big.NewInt(5))
+    ctx.Jump(outer)
+
+    ctx.SetBlock(outer)
+    ctx.Branch(ctx.Eval(SSA_LT, y1, y2), inner, exit)
+
+    ctx.SetBlock(inner)
+    ctx.Branch(ctx.Eval(SSA_LT, y2, y1), body, latch)
+
+    ctx.SetBlock(body)
+    ctx.Elements[ctx.Eval(SSA_ADD, y1, y2)].Pinned = true
+    ctx.Jump(inner)
+
+    ctx.SetBlock(latch)
+    ctx.Jump(outer)
+
+    ctx.SetBlock(exit)
+    sum := ctx.Eval(SSA_ADD, x1, x2)
+    sum = ctx.Eval(SSA_ADD, sum, x3)
+    sum = ctx.Eval(SSA_ADD, sum, y1)
+    ctx.Return(ctx.Eval(SSA_ADD, sum, y2))
+
+    return ctx
+}
+
+// Returns the number of spills and fills that the allocation of ctx put inside of loops.
+func countLoopSpills(ctx, new_ctx *SsaContext) int {
+    count := 0
+    for id := 0; id < new_ctx.LastElementId; id++ {
+        el := new_ctx.Elements[id]
+        if (el.Op == SSA_SPILL || el.Op == SSA_FILL) && new_ctx.Blocks[el.Block].LoopDepth > 0 {
+            count++
+        }
+    }
+    return count
+}
+
+func TestFindLoops(t *testing.T) {
+    ctx := buildNestedLoops()
+    ctx.FindLoops()
+
+    depths := []int{0, 1, 2, 2, 1, 0}
+    for i, b := range ctx.Blocks {
+        if b.LoopDepth != depths[i] {
+            t.Errorf("block %v should have loop depth %v, got %v", i, depths[i], b.LoopDepth)
+        }
+    }
+
+    // x1 is only read after the loops, y1 in the inner loop.
+    if d := ctx.Elements[0].LoopDepth; d != 0 {
+        t.Errorf("x1 should have loop depth 0, got %v", d)
+    }
+    if d := ctx.Elements[3].LoopDepth; d != 2 {
+        t.Errorf("y1 should have loop depth 2, got %v", d)
+    }
+}
+
+func TestLoopAwareSpill(t *testing.T) {
+    ctx := buildNestedLoops()
+    new_ctx := ctx.AllocateRegisters(4)
+    aware := countLoopSpills(ctx, new_ctx)
+    checkRegisterAssignment(t, new_ctx)
+
+    // The loops need all three registers, so one x value is spilled in the outer
+    // loop header, and filled again in the latch for the next trip around the outer
+    // loop, but the y values must never be filled in the loops.
+    for id := 0; id < new_ctx.LastElementId; id++ {
+        el := new_ctx.Elements[id]
+        if el.Op == SSA_FILL && new_ctx.Blocks[el.Block].LoopDepth > 0 && el.Block != 4 {
+            t.Errorf("element %v fills a value inside a loop", id)
+        }
+    }
+
+    ctx = buildNestedLoops()
+    ctx.SpillIgnoresLoops = true
+    if blind := countLoopSpills(ctx, ctx.AllocateRegisters(4)); blind <= aware {
+        t.Errorf("expected fewer spills and fills inside the loops than %v, got %v", blind, aware)
+    }
+}
+
+func benchmarkNestedLoops(b *testing.B, ignore_loops bool) {
+    count := 0
+    for i := 0; i < b.N; i++ {
+        ctx := buildNestedLoops()
+        ctx.SpillIgnoresLoops = ignore_loops
+        count = countLoopSpills(ctx, ctx.AllocateRegisters(4))
+    }
+    b.Logf("%v spills and fills inside loops", count)
+}
+
+func BenchmarkAllocateNestedLoops(b *testing.B) {
+    benchmarkNestedLoops(b, false)
+}
+
+func BenchmarkAllocateNestedLoopsIgnoringDepth(b *testing.B) {
+    benchmarkNestedLoops(b, true)
+}
@@ -0,0 +1,378 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module lowers the body of a function from the ast into the SSA stream.
+   Every variable is a name, which is loaded where it is read and stored where
+   it is assigned, so there is no need for phi functions: a value only crosses
+   a block boundary on the single path from where it is computed to where it is
+   used.  The "and", "or" and conditional expressions pick one of two values,
+   so they store whichever one they pick to a hidden temporary name.
+
+   Only the parts of the language the SSA form can express yet are handled.
+   Anything else is reported as an error, and the function has to be run by
+   the interpreter instead.
+*/
+
+package python
+
+import (
+	"big"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ssaBinaryOps = map[string]uint{
+	"+":  SSA_ADD,
+	"-":  SSA_SUB,
+	"*":  SSA_MUL,
+	"/":  SSA_DIV,
+	"%":  SSA_MOD,
+	"**": SSA_POW,
+	"&":  SSA_AND,
+	"|":  SSA_OR,
+	"^":  SSA_XOR,
+}
+
+var ssaCompareOps = map[string]uint{
+	"==": SSA_EQ,
+	"!=": SSA_NE,
+	"<":  SSA_LT,
+	"<=": SSA_LE,
+	">":  SSA_GT,
+	">=": SSA_GE,
+}
+
+// The targets of break and continue in the innermost loop.
+type loopTargets struct {
+	brk, cont *BasicBlock
+}
+
+type lowering struct {
+	ctx   *SsaContext
+	loops []loopTargets
+	temps int
+	err   os.Error
+}
+
+// Records an error about n, unless there already is one.
+func (l *lowering) fail(n Ast, format string, args ...interface{}) {
+	if l.err == nil {
+		l.err = os.NewError(fmt.Sprintf("%v: %v", n.Pos(), fmt.Sprintf(format, args...)))
+	}
+}
+
+// Starts writing into b.  A constant loaded in one block may not have been loaded on
+// the way to another, so loads of constants are only shared within a block.
+func (l *lowering) setBlock(b *BasicBlock) {
+	l.ctx.SetBlock(b)
+	l.ctx.IntIdx = make(map[*big.Int]int, 16)
+	l.ctx.FloatIdx = make(map[float64]int, 16)
+	l.ctx.StringIdx = make(map[string]int, 16)
+}
+
+// Ends the current block with a jump to target, unless it already ends.
+func (l *lowering) jump(target *BasicBlock) {
+	if !l.ctx.IsTerminated(l.ctx.Current) {
+		l.ctx.Jump(target)
+	}
+}
+
+// Returns a new hidden name, for a value that is picked on one of two paths.
+func (l *lowering) temp() string {
+	name := fmt.Sprintf("$t%v", l.temps)
+	l.temps++
+	l.ctx.LocalNames[name] = true
+	return name
+}
+
+// Lowers the expression n, and returns the element holding its value.
+func (l *lowering) expr(n Ast) int {
+	ctx := l.ctx
+
+	switch n := n.(type) {
+	case *NameNode:
+		return ctx.LoadName(n.Id)
+
+	case *LiteralIntNode:
+		return ctx.LoadInt(n.Value)
+
+	case *LiteralStringNode:
+		// The parser leaves escapes as they are.
+		if !n.Raw && strings.Contains(n.Value, "\\") {
+			l.fail(n, "string escapes are not supported")
+		}
+		return ctx.LoadString(n.Value)
+
+	case *BinOpNode:
+		if n.Op == "and" || n.Op == "or" {
+			return l.boolOp(n)
+		}
+		op, present := ssaBinaryOps[n.Op]
+		if !present {
+			l.fail(n, "the %v operator is not supported", n.Op)
+			return ctx.LoadInt(big.NewInt(0))
+		}
+		return l.operands(op, n.Left, n.Right)
+
+	case *UnaryOpNode:
+		v := l.expr(n.Operand)
+		switch n.Op {
+		case "+":
+			return v
+		case "-":
+			return ctx.Eval(SSA_SUB, ctx.LoadInt(big.NewInt(0)), v)
+		case "~":
+			// NOT has a single operand, but reads both.
+			return ctx.Eval(SSA_NOT, v, v)
+		}
+		l.fail(n, "the %v operator is not supported", n.Op)
+		return v
+
+	case *CompareNode:
+		if len(n.Ops) != 1 {
+			l.fail(n, "chained comparisons are not supported")
+			return ctx.LoadInt(big.NewInt(0))
+		}
+		op, present := ssaCompareOps[n.Ops[0]]
+		if !present {
+			l.fail(n, "the %v operator is not supported", n.Ops[0])
+			return ctx.LoadInt(big.NewInt(0))
+		}
+		return l.operands(op, n.Left, n.Comparators[0])
+
+	case *IfExpNode:
+		t := l.temp()
+		then_block, else_block, join := ctx.NewBlock(), ctx.NewBlock(), ctx.NewBlock()
+
+		ctx.Branch(l.expr(n.Test), then_block, else_block)
+
+		l.setBlock(then_block)
+		ctx.Store(t, l.expr(n.Body))
+		l.jump(join)
+
+		l.setBlock(else_block)
+		ctx.Store(t, l.expr(n.Orelse))
+		l.jump(join)
+
+		l.setBlock(join)
+		return ctx.LoadName(t)
+
+	case *CallNode:
+		if len(n.Keywords) > 0 {
+			l.fail(n, "keyword arguments are not supported")
+		}
+		callee := l.expr(n.Func)
+		args := make([]int, len(n.Args))
+		for i, arg := range n.Args {
+			if _, starred := arg.(*StarredNode); starred {
+				l.fail(arg, "starred arguments are not supported")
+			}
+			args[i] = l.expr(arg)
+		}
+		return ctx.Call(callee, args)
+	}
+
+	l.fail(n, "%T is not supported", n)
+	return ctx.LoadInt(big.NewInt(0))
+}
+
+// Lowers the operation op on the expressions left and right.  Python evaluates the left
+// operand first, and so do we, unless it is a literal, whose load has no effects and
+// can't fail.  Then the right operand is evaluated first if its Strahler number says
+// it needs more than one register, so it has every register to itself, and the
+// literal is only loaded into one once the right operand is done with the rest.
+func (l *lowering) operands(op uint, left, right Ast) int {
+	switch left.(type) {
+	case *LiteralIntNode, *LiteralStringNode:
+		if Strahler(right) > 1 {
+			r := l.expr(right)
+			return l.ctx.Eval(op, l.expr(left), r)
+		}
+	}
+	v := l.expr(left)
+	return l.ctx.Eval(op, v, l.expr(right))
+}
+
+// Lowers "a and b" or "a or b".  The right operand is only evaluated when the left
+// one doesn't decide the result, which is then the value of the left operand.
+func (l *lowering) boolOp(n *BinOpNode) int {
+	ctx := l.ctx
+	t := l.temp()
+	right, join := ctx.NewBlock(), ctx.NewBlock()
+
+	left := l.expr(n.Left)
+	ctx.Store(t, left)
+	if n.Op == "and" {
+		ctx.Branch(left, right, join)
+	} else {
+		ctx.Branch(left, join, right)
+	}
+
+	l.setBlock(right)
+	ctx.Store(t, l.expr(n.Right))
+	l.jump(join)
+
+	l.setBlock(join)
+	return ctx.LoadName(t)
+}
+
+// Lowers a list of statements.
+func (l *lowering) body(stmts []Ast) {
+	for _, stmt := range stmts {
+		// Anything after a return, break or continue is never run, but it
+		// still has to go somewhere.
+		if l.ctx.IsTerminated(l.ctx.Current) {
+			l.setBlock(l.ctx.NewBlock())
+		}
+		l.stmt(stmt)
+	}
+}
+
+func (l *lowering) stmt(n Ast) {
+	ctx := l.ctx
+
+	switch n := n.(type) {
+	case *PassNode:
+
+	case *ExprStmtNode:
+		l.expr(n.Value)
+
+	case *AssignNode:
+		v := l.expr(n.Value)
+		for _, target := range n.Targets {
+			name, ok := target.(*NameNode)
+			if !ok {
+				l.fail(target, "assignment to %T is not supported", target)
+				continue
+			}
+			ctx.Store(name.Id, v)
+		}
+
+	case *AugAssignNode:
+		name, ok := n.Target.(*NameNode)
+		op, present := ssaBinaryOps[n.Op]
+		if !ok || !present {
+			l.fail(n, "augmented assignment with %v to %T is not supported", n.Op, n.Target)
+			return
+		}
+		v := ctx.LoadName(name.Id)
+		result := ctx.Eval(op, v, l.expr(n.Value))
+		ctx.Elements[result].InPlace = true
+		ctx.Store(name.Id, result)
+
+	case *ReturnNode:
+		if n.Value == nil {
+			ctx.Return(-1)
+		} else {
+			ctx.Return(l.expr(n.Value))
+		}
+
+	case *IfNode:
+		then_block, else_block, join := ctx.NewBlock(), ctx.NewBlock(), ctx.NewBlock()
+		ctx.Branch(l.expr(n.Test), then_block, else_block)
+
+		l.setBlock(then_block)
+		l.body(n.Body)
+		l.jump(join)
+
+		l.setBlock(else_block)
+		l.body(n.Orelse)
+		l.jump(join)
+
+		l.setBlock(join)
+
+	case *WhileNode:
+		header, body, orelse, exit := ctx.NewBlock(), ctx.NewBlock(), ctx.NewBlock(), ctx.NewBlock()
+		l.jump(header)
+
+		l.setBlock(header)
+		ctx.Branch(l.expr(n.Test), body, orelse)
+
+		l.setBlock(body)
+		l.loops = append(l.loops, loopTargets{exit, header})
+		l.body(n.Body)
+		l.loops = l.loops[0 : len(l.loops)-1]
+		l.jump(header)
+
+		// The else clause runs when the loop ends without a break.
+		l.setBlock(orelse)
+		l.body(n.Orelse)
+		l.jump(exit)
+
+		l.setBlock(exit)
+
+	case *BreakNode, *ContinueNode:
+		if len(l.loops) == 0 {
+			l.fail(n, "break or continue outside of a loop")
+			return
+		}
+		targets := l.loops[len(l.loops)-1]
+		if _, brk := n.(*BreakNode); brk {
+			ctx.Jump(targets.brk)
+		} else {
+			ctx.Jump(targets.cont)
+		}
+
+	default:
+		l.fail(n, "%T is not supported", n)
+	}
+}
+
+// Lowers the body of fn into ctx.  This is a Lowerer.  The names the function assigns
+// to, other than its parameters, are its LocalNames.
+func LowerFunction(fn *FunctionDefNode, ctx *SsaContext) os.Error {
+	l := &lowering{ctx: ctx}
+
+	params := make(map[string]bool)
+	for _, arg := range fn.Args {
+		params[arg.Name] = true
+	}
+
+	ctx.LocalNames = make(map[string]bool)
+	for _, stmt := range fn.Body {
+		Walk(stmt, func(n Ast) bool {
+			var targets []Ast
+			switch n := n.(type) {
+			case *AssignNode:
+				targets = n.Targets
+			case *AugAssignNode:
+				targets = []Ast{n.Target}
+			case *FunctionDefNode, *ClassDefNode:
+				// Their names are bound by the statement, and their
+				// bodies are separate functions.
+				return false
+			}
+			for _, target := range targets {
+				if name, ok := target.(*NameNode); ok && !params[name.Id] {
+					ctx.LocalNames[name.Id] = true
+				}
+			}
+			return true
+		})
+	}
+
+	// The allocator skips measuring the register pressure when an expression
+	// needs more registers than it has.
+	ctx.Strahler = Strahler(fn)
+
+	l.body(fn.Body)
+	if !ctx.IsTerminated(ctx.Current) {
+		ctx.Return(-1)
+	}
+
+	return l.err
+}
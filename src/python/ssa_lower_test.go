@@ -0,0 +1,180 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for lowering function bodies, and for calls.
+
+*/
+
+package python
+
+import (
+        "os"
+        "strings"
+        "testing"
+)
+
+// Parses src, which defines a single function, and lowers it.
+func lowerSource(t *testing.T, src string) (*SsaContext, os.Error) {
+    _, mod := parseSource(t, src)
+
+    ctx := new (SsaContext)
+    ctx.Init()
+    return ctx, LowerFunction(mod.Body[0].(*FunctionDefNode), ctx)
+}
+
+func TestLowerCall(t *testing.T) {
+    ctx, err := lowerSource(t, "def f(a, b):\n    return a * b + g(a, b - 1)\n")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+
+    call := -1
+    for id := 0; id < ctx.LastElementId; id++ {
+        if ctx.Elements[id].Op == SSA_CALL {
+            call = id
+        }
+    }
+    if call < 0 {
+        t.Fatalf("no call in:\n%v", ctx)
+    }
+
+    args := ctx.CallArgs(call)
+    if len(args) != 2 {
+        t.Fatalf("expected 2 arguments, got %v", args)
+    }
+    if el := ctx.Elements[args[0]]; el.Op != SSA_LOAD || el.Src1Type != SSA_TYPE_NAME {
+        t.Errorf("the first argument should load a, got %v", ctx.formatElement(el))
+    }
+    if el := ctx.Elements[args[1]]; el.Op != SSA_SUB {
+        t.Errorf("the second argument should be b - 1, got %v", ctx.formatElement(el))
+    }
+    if callee := ctx.Elements[ctx.Elements[call].Src1]; callee.Src1Type != SSA_TYPE_NAME {
+        t.Errorf("the callee should be the name g, got %v", ctx.formatElement(callee))
+    }
+
+    // a * b is live across the call, so it has to be spilled before it and
+    // filled after it, however many registers there are.
+    new_ctx := ctx.AllocateRegisters(8)
+    spill, fill := -1, -1
+    for id := 0; id < new_ctx.LastElementId; id++ {
+        switch new_ctx.Elements[id].Op {
+        case SSA_CALL:
+            call = id
+        case SSA_SPILL:
+            spill = id
+        case SSA_FILL:
+            fill = id
+        }
+    }
+    if spill < 0 || spill > call || fill < call {
+        t.Errorf("expected a spill before the call and a fill after it:\n%v", new_ctx)
+    }
+}
+
+func TestLowerControlFlow(t *testing.T) {
+    ctx, err := lowerSource(t, `def f(n):
+    total = 1
+    while n > 1:
+        if n % 7 == 3:
+            break
+        elif n % 2:
+            n -= 1
+            continue
+        total += n and 2 or 3
+        n -= 1
+    else:
+        total = -total
+    return total
+`)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+
+    for _, b := range ctx.Blocks {
+        if !ctx.IsTerminated(b) {
+            t.Errorf("block %v is not terminated:\n%v", b.Id, ctx)
+        }
+    }
+    if !ctx.LocalNames["total"] || ctx.LocalNames["n"] {
+        t.Errorf("total should be local, and the parameter n shouldn't be: %v", ctx.LocalNames)
+    }
+
+    ctx.FindLoops()
+    depth := 0
+    for _, b := range ctx.Blocks {
+        if b.LoopDepth > depth {
+            depth = b.LoopDepth
+        }
+    }
+    if depth != 1 {
+        t.Errorf("expected a single loop, got a depth of %v:\n%v", depth, ctx)
+    }
+}
+
+// A literal operand is loaded after an operand that needs more registers, but any
+// other operand is evaluated first, as Python does.
+func TestLowerOperandOrder(t *testing.T) {
+    ctx, err := lowerSource(t, "def f(a, b, c, d):\n    return 2 * (a * b + c * d) - a * (b + c)\n")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if ctx.Strahler != 3 {
+        t.Errorf("expected a Strahler number of 3, got %v", ctx.Strahler)
+    }
+
+    for id := 0; id < ctx.LastElementId; id++ {
+        el := ctx.Elements[id]
+        if el.Op != SSA_MUL {
+            continue
+        }
+        left, right := ctx.Elements[el.Src1], ctx.Elements[el.Src2]
+        switch {
+        case left.Src1Type == SSA_TYPE_INTEGER && el.Src1 < el.Src2:
+            t.Errorf("2 should be loaded after the sum:\n%v", ctx)
+        case left.Src1Type == SSA_TYPE_NAME && right.Op == SSA_ADD && el.Src1 > el.Src2:
+            t.Errorf("a should be loaded before b + c:\n%v", ctx)
+        }
+    }
+}
+
+func TestLowerUnsupported(t *testing.T) {
+    sources := []string{
+        "def f(x):\n    for i in x:\n        pass\n",
+        "def f(x):\n    return x.y\n",
+        "def f(x):\n    break\n",
+        "def f(x):\n    return g(y=x)\n",
+    }
+
+    for _, src := range sources {
+        if _, err := lowerSource(t, src); err == nil {
+            t.Errorf("expected an error lowering %q", src)
+        } else if !strings.HasPrefix(err.String(), "test.py:") {
+            t.Errorf("the error should have a position, got %v", err)
+        }
+    }
+}
+
+func TestCompileModuleLowered(t *testing.T) {
+    _, mod := parseSource(t, "def f(a, b):\n    return g(a) + b\n\ndef g(x):\n    return x if x > 1 else -x\n")
+
+    m, err := CompileModule("test", mod, LowerFunction, 4, 0)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if n := countOps(m.Lookup("f").Code, SSA_CALL); n != 1 {
+        t.Errorf("f should make a single call, got %v", n)
+    }
+}
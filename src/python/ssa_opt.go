@@ -0,0 +1,347 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the optimization passes over the SSA stream.  Each
+   pass rewrites the context in place, and can be run on its own.
+*/
+
+package python
+
+import (
+	"big"
+	"math"
+	"strconv"
+)
+
+// Removes every element that is never read and is not pinned, then compacts the
+// stream so that the element ids are dense again.  Operands, blocks and the
+// constant maps are renamed to match.  Returns the number of elements removed.
+//
+// Removing an element can leave the elements it read unused, so callers that
+// want all dead code gone should repeat the pass until it returns 0.
+func (ctx *SsaContext) Eliminate() int {
+	return ctx.compact(func(el *SsaElement) bool {
+		return !el.Pinned && !el.WasRead
+	})
+}
+
+// Removes the elements for which remove returns true, and renames everything
+// else to match.  The caller must make sure nothing still reads a removed element.
+func (ctx *SsaContext) compact(remove func(el *SsaElement) bool) int {
+	rename := make([]int, ctx.LastElementId)
+	elements := make([]*SsaElement, ctx.LastElementId, cap(ctx.Elements))
+	count := 0
+
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+
+		if remove(el) {
+			rename[id] = -1
+			continue
+		}
+
+		rename[id] = count
+		el.Address = count
+		elements[count] = el
+		count++
+	}
+
+	removed := ctx.LastElementId - count
+	if removed == 0 {
+		return 0
+	}
+
+	for id := 0; id < count; id++ {
+		el := elements[id]
+		if el.ReadsElement(1) {
+			el.Src1 = rename[el.Src1]
+		}
+		if el.ReadsElement(2) {
+			el.Src2 = rename[el.Src2]
+		}
+	}
+
+	for _, b := range ctx.Blocks {
+		kept := b.Elements[0:0]
+		for _, id := range b.Elements {
+			if rename[id] >= 0 {
+				kept = append(kept, rename[id])
+			}
+		}
+		b.Elements = kept
+	}
+
+	// The constant maps point at the elements that load each constant.
+	for v, id := range ctx.IntIdx {
+		if rename[id] < 0 {
+			ctx.IntIdx[v] = 0, false
+		} else {
+			ctx.IntIdx[v] = rename[id]
+		}
+	}
+	for v, id := range ctx.FloatIdx {
+		if rename[id] < 0 {
+			ctx.FloatIdx[v] = 0, false
+		} else {
+			ctx.FloatIdx[v] = rename[id]
+		}
+	}
+	for v, id := range ctx.StringIdx {
+		if rename[id] < 0 {
+			ctx.StringIdx[v] = 0, false
+		} else {
+			ctx.StringIdx[v] = rename[id]
+		}
+	}
+	for v, id := range ctx.NameIdx {
+		if rename[id] < 0 {
+			ctx.NameIdx[v] = 0, false
+		} else {
+			ctx.NameIdx[v] = rename[id]
+		}
+	}
+
+	ctx.Elements = elements[0:count]
+	ctx.LastElementId = count
+	ctx.recomputeReads()
+
+	return removed
+}
+
+// Returns the element that id is a copy of, following chains of copies.  A copy into a
+// precolored register is kept, since it puts the value where it has to be.
+func (ctx *SsaContext) copySource(id int) int {
+	for ctx.Elements[id].Op == SSA_COPY && ctx.Elements[id].FixedRegister == 0 {
+		id = ctx.Elements[id].Src1
+	}
+	return id
+}
+
+// Performs copy propagation.  Every operand that refers to an SSA_COPY is
+// rewritten to refer to the original element instead, following chains of
+// copies.  The copies are then unread, and are dropped unless they are pinned.
+// Returns the number of copies dropped.
+func (ctx *SsaContext) PropagateCopies() int {
+	rewritten := false
+
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+		if el.ReadsElement(1) && ctx.copySource(el.Src1) != el.Src1 {
+			el.Src1 = ctx.copySource(el.Src1)
+			rewritten = true
+		}
+		if el.ReadsElement(2) && ctx.copySource(el.Src2) != el.Src2 {
+			el.Src2 = ctx.copySource(el.Src2)
+			rewritten = true
+		}
+	}
+
+	if rewritten {
+		ctx.recomputeReads()
+	}
+
+	return ctx.compact(func(el *SsaElement) bool {
+		return el.Op == SSA_COPY && !el.Pinned && !el.WasRead
+	})
+}
+
+// Recompute the WasRead flags and the write-order live ranges of every element,
+// as Write would have set them.
+func (ctx *SsaContext) recomputeReads() {
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+		el.WasRead = false
+		el.LiveStart = id
+		el.LiveEnd = id
+	}
+
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+		if el.ReadsElement(1) {
+			ctx.Elements[el.Src1].WasRead = true
+			ctx.Elements[el.Src1].LiveEnd = id
+		}
+		if el.ReadsElement(2) {
+			ctx.Elements[el.Src2].WasRead = true
+			ctx.Elements[el.Src2].LiveEnd = id
+		}
+	}
+}
+
+// The largest integer power we will compute at compile time, in bits.  Anything
+// bigger is left for the runtime, so that "2 ** 10000000" doesn't stall the compiler.
+const maxFoldedPowBits = 4096
+
+// Returns true if the element loads a number whose value is known at compile time.
+func (ctx *SsaContext) isNumericConst(id int) bool {
+	el := ctx.Elements[id]
+	return el.IsConst && el.Op == SSA_LOAD && (el.Src1Type == SSA_TYPE_INTEGER || el.Src1Type == SSA_TYPE_FLOAT)
+}
+
+// Returns the value of a constant float load, converting integers the same way
+// IntObject.AsFloat does.  ok is false for an integer too large for a float, which
+// raises an OverflowError at runtime.
+func (ctx *SsaContext) constFloat(el *SsaElement) (v float64, ok bool) {
+	if el.Src1Type != SSA_TYPE_INTEGER {
+		return ctx.Floats[el.Src1], true
+	}
+	v, err := strconv.Atof64(ctx.Ints[el.Src1].String())
+	return v, err == nil
+}
+
+// Folds an operation on two integer constants.  Returns nil if the operation
+// can't be folded, either because it raises at runtime or because the result
+// would be too large.
+func foldInt(op uint, l, r *big.Int) *big.Int {
+	result := new(big.Int)
+
+	switch op {
+		case SSA_ADD:
+			return result.Add(l, r)
+		case SSA_SUB:
+			return result.Sub(l, r)
+		case SSA_MUL:
+			return result.Mul(l, r)
+		case SSA_MOD:
+			// Modulo by zero raises at runtime.
+			if r.Sign() == 0 {
+				return nil
+			}
+			_, result = floorDivMod(l, r)
+			return result
+		case SSA_POW:
+			// A negative power produces a float.
+			if r.Sign() < 0 || int64(l.BitLen())*r.Int64() > maxFoldedPowBits || r.BitLen() > 32 {
+				return nil
+			}
+			return result.Exp(l, r, nil)
+		case SSA_AND:
+			return result.And(l, r)
+		case SSA_OR:
+			return result.Or(l, r)
+		case SSA_XOR:
+			return result.Xor(l, r)
+	}
+
+	return nil
+}
+
+// Folds an operation on two float constants.  ok is false if the operation can't be folded.
+func foldFloat(op uint, l, r float64) (result float64, ok bool) {
+	switch op {
+		case SSA_ADD:
+			return l + r, true
+		case SSA_SUB:
+			return l - r, true
+		case SSA_MUL:
+			return l * r, true
+		case SSA_DIV:
+			// Division by zero raises at runtime.
+			if r == 0 {
+				return 0, false
+			}
+			return l / r, true
+		case SSA_POW:
+			// Zero to a negative power raises, a negative number to a fractional
+			// power is complex, and a result too large for a float raises an
+			// OverflowError, so all of these are left for the runtime.
+			if l == 0 && r < 0 || l < 0 && r != math.Floor(r) {
+				return 0, false
+			}
+			result = math.Pow(l, r)
+			if math.IsInf(result, 0) || math.IsNaN(result) {
+				return 0, false
+			}
+			return result, true
+	}
+
+	return 0, false
+}
+
+// Performs constant propagation and folding.  Every load of a literal number or
+// string is marked IsConst.  Then each arithmetic operation whose operands are
+// both numeric constants is evaluated, and the element is rewritten in place into
+// a load of the result, which is itself constant.  Since the element keeps its id,
+// its users now read the folded constant, and results fold through chains of
+// operations.  Returns the number of elements folded.
+//
+// The elements that fed a folded operation are left behind unread, so run
+// Eliminate afterwards to remove them.
+func (ctx *SsaContext) FoldConstants() int {
+	folded := 0
+
+	// Operands are always written before the elements that read them, so a
+	// single pass in id order sees every operand folded before its users.
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+
+		if el.Op == SSA_LOAD {
+			switch el.Src1Type {
+				case SSA_TYPE_INTEGER, SSA_TYPE_FLOAT, SSA_TYPE_STRING:
+					el.IsConst = true
+			}
+			continue
+		}
+
+		if el.Op <= SSA_ALU_MARK || !el.ReadsElement(1) || !el.ReadsElement(2) {
+			continue
+		}
+
+		if !ctx.isNumericConst(el.Src1) || !ctx.isNumericConst(el.Src2) {
+			continue
+		}
+
+		left, right := ctx.Elements[el.Src1], ctx.Elements[el.Src2]
+
+		// Integer operations stay integers, except for true division.
+		if left.Src1Type == SSA_TYPE_INTEGER && right.Src1Type == SSA_TYPE_INTEGER && el.Op != SSA_DIV {
+			v := foldInt(el.Op, ctx.Ints[left.Src1], ctx.Ints[right.Src1])
+			if v == nil {
+				continue
+			}
+
+			el.Src1 = len(ctx.Ints)
+			el.Src1Type = SSA_TYPE_INTEGER
+			ctx.Ints = append(ctx.Ints, v)
+		} else {
+			l, l_ok := ctx.constFloat(left)
+			r, r_ok := ctx.constFloat(right)
+			if !l_ok || !r_ok {
+				continue
+			}
+			v, ok := foldFloat(el.Op, l, r)
+			if !ok {
+				continue
+			}
+
+			el.Src1 = len(ctx.Floats)
+			el.Src1Type = SSA_TYPE_FLOAT
+			ctx.Floats = append(ctx.Floats, v)
+		}
+
+		el.Op = SSA_LOAD
+		el.Src2 = 0
+		el.Src2Type = SSA_TYPE_NONE
+		el.IsConst = true
+		folded++
+	}
+
+	if folded > 0 {
+		ctx.recomputeReads()
+	}
+
+	return folded
+}
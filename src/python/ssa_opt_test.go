@@ -0,0 +1,293 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the SSA optimization passes.
+
+*/
+
+package python
+
+import (
+        "big"
+        "testing"
+)
+
+func TestEliminate(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    one, two, three := big.NewInt(1), big.NewInt(2), big.NewInt(3)
+
+    a := ctx.LoadInt(one)
+    b := ctx.LoadInt(two)
+    c := ctx.LoadInt(three)
+
+    // dead reads c, so c only becomes dead once dead is gone.
+    dead := ctx.Eval(SSA_MUL, c, c)
+    sum := ctx.Eval(SSA_ADD, a, b)
+    ctx.Return(sum)
+
+    if removed := ctx.Eliminate(); removed != 1 {
+        t.Errorf("first pass removed %v elements, wanted 1", removed)
+    }
+
+    if ctx.LastElementId != 5 || len(ctx.Current.Elements) != 5 {
+        t.Fatalf("stream was not compacted, %v elements left", ctx.LastElementId)
+    }
+
+    if removed := ctx.Eliminate(); removed != 1 {
+        t.Errorf("second pass removed %v elements, wanted 1", removed)
+    }
+
+    if removed := ctx.Eliminate(); removed != 0 {
+        t.Errorf("third pass removed %v elements, wanted none", removed)
+    }
+
+    if ctx.LastElementId != 4 {
+        t.Fatalf("expected 4 elements to remain, got %v", ctx.LastElementId)
+    }
+
+    // The add moved from id 4 to id 2 and the return refers to it.
+    ret := ctx.Elements[3]
+    if ret.Op != SSA_RETURN || ret.Src1 != 2 || ctx.Elements[2].Op != SSA_ADD {
+        t.Errorf("operands were not renamed, return reads %v", ret.Src1)
+    }
+
+    for id := 0; id < ctx.LastElementId; id++ {
+        if ctx.Elements[id].Address != id || ctx.Current.Elements[id] != id {
+            t.Errorf("element %v has address %v", id, ctx.Elements[id].Address)
+        }
+    }
+
+    if _, present := ctx.IntIdx[three]; present {
+        t.Errorf("the removed load is still in the constant map")
+    }
+
+    // Loading a constant again after elimination must give the renamed element.
+    if id := ctx.LoadInt(two); id != 1 {
+        t.Errorf("constant map points at the wrong element: %v", id)
+    }
+
+    // A new constant must not reuse the slot of a removed one.
+    four := big.NewInt(4)
+    if el := ctx.Elements[ctx.LoadInt(four)]; ctx.Ints[el.Src1] != four {
+        t.Errorf("new constant loads the wrong value")
+    }
+
+    _ = dead
+}
+
+func TestEliminateKeepsEffects(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    x := ctx.LoadName("x")
+    f := ctx.LoadName("f")
+
+    // Nothing reads any of these, but they all do something.
+    store := ctx.Store("y", x)
+    call := ctx.Call(f, []int{x})
+    set := ctx.Eval(SSA_SET, f, x)
+
+    // This does nothing, unless it is pinned.
+    div := ctx.Eval(SSA_DIV, x, x)
+    ctx.Pin(div)
+    ctx.Eval(SSA_MUL, x, x)
+    ctx.Return(-1)
+
+    for _, id := range []int{store, call, set} {
+        if !ctx.Elements[id].Pinned {
+            t.Errorf("%v should have been pinned", ctx.formatElement(ctx.Elements[id]))
+        }
+    }
+
+    for ctx.Eliminate() > 0 {
+    }
+
+    expected := []uint{SSA_STORE, SSA_CALL, SSA_ARG, SSA_SET, SSA_DIV, SSA_RETURN}
+    for _, op := range expected {
+        if countOps(ctx, op) != 1 {
+            t.Errorf("expected a single %v to survive:\n%v", ssaOpNames[op], ctx)
+        }
+    }
+    if countOps(ctx, SSA_MUL) != 0 {
+        t.Errorf("the multiplication should have been removed:\n%v", ctx)
+    }
+
+    // Once the call is known to have no effect, it goes too, and so does the
+    // load of the function it called.
+    for id := 0; id < ctx.LastElementId; id++ {
+        if op := ctx.Elements[id].Op; op == SSA_CALL || op == SSA_RETURN {
+            ctx.Unpin(id)
+        }
+    }
+    for ctx.Eliminate() > 0 {
+    }
+
+    if countOps(ctx, SSA_CALL) != 0 || countOps(ctx, SSA_ARG) != 0 {
+        t.Errorf("the call should have been removed:\n%v", ctx)
+    }
+    if countOps(ctx, SSA_RETURN) != 1 || countOps(ctx, SSA_LOAD) != 2 {
+        t.Errorf("the return and both loads should remain:\n%v", ctx)
+    }
+}
+
+func TestFoldConstants(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    // (2 + 3) * 4 folds all the way down to 20.
+    two := ctx.LoadInt(big.NewInt(2))
+    three := ctx.LoadInt(big.NewInt(3))
+    four := ctx.LoadInt(big.NewInt(4))
+    sum := ctx.Eval(SSA_ADD, two, three)
+    product := ctx.Eval(SSA_MUL, sum, four)
+
+    // 7 / 2 is a true division, and gives a float.
+    seven := ctx.LoadInt(big.NewInt(7))
+    quotient := ctx.Eval(SSA_DIV, seven, two)
+
+    // Division by zero must be left for the runtime to raise.
+    zero := ctx.LoadInt(big.NewInt(0))
+    by_zero := ctx.Eval(SSA_DIV, seven, zero)
+
+    // Strings are constant, but aren't folded.
+    ctx.Strings = append(ctx.Strings, "x")
+    load := new(SsaElement)
+    load.Op = SSA_LOAD
+    load.Src1Type = SSA_TYPE_STRING
+    x := ctx.Write(load)
+    unknown := ctx.Eval(SSA_ADD, x, product)
+
+    half := ctx.LoadFloat(0.5)
+    mixed := ctx.Eval(SSA_MUL, half, four)
+
+    if folded := ctx.FoldConstants(); folded != 4 {
+        t.Errorf("folded %v elements, wanted 4", folded)
+    }
+
+    el := ctx.Elements[product]
+    if el.Op != SSA_LOAD || !el.IsConst || el.Src1Type != SSA_TYPE_INTEGER {
+        t.Fatalf("product was not folded")
+    }
+    if v := ctx.Ints[el.Src1]; v.Int64() != 20 {
+        t.Errorf("(2 + 3) * 4 folded to %v", v)
+    }
+
+    el = ctx.Elements[quotient]
+    if el.Op != SSA_LOAD || el.Src1Type != SSA_TYPE_FLOAT || ctx.Floats[el.Src1] != 3.5 {
+        t.Errorf("7 / 2 was not folded to 3.5")
+    }
+
+    el = ctx.Elements[mixed]
+    if el.Op != SSA_LOAD || el.Src1Type != SSA_TYPE_FLOAT || ctx.Floats[el.Src1] != 2 {
+        t.Errorf("0.5 * 4 was not folded to 2.0")
+    }
+
+    if !ctx.Elements[x].IsConst {
+        t.Errorf("string load was not marked constant")
+    }
+
+    if ctx.Elements[by_zero].Op != SSA_DIV || ctx.Elements[unknown].Op != SSA_ADD {
+        t.Errorf("folded an operation that isn't constant")
+    }
+
+    // The sum is no longer read by anything, but the users of the folded
+    // product still refer to it.
+    if ctx.Elements[sum].WasRead || !ctx.Elements[product].WasRead {
+        t.Errorf("reads were not recomputed after folding")
+    }
+    if ctx.Elements[unknown].Src2 != product {
+        t.Errorf("the user of the product was changed")
+    }
+}
+
+// The operations whose float results Python raises for, or gives a complex for, are
+// left for the runtime, and integers too big for an int64 are still converted exactly.
+func TestFoldFloatLimits(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    one := ctx.LoadFloat(1)
+    huge := ctx.LoadInt(new (big.Int).Lsh(big.NewInt(1), 70))
+    scaled := ctx.Eval(SSA_MUL, huge, one)
+    too_big := ctx.LoadInt(new (big.Int).Lsh(big.NewInt(1), 1100))
+    overflow := ctx.Eval(SSA_MUL, too_big, one)
+
+    cube := ctx.Eval(SSA_POW, ctx.LoadFloat(-2), ctx.LoadFloat(3))
+    root := ctx.Eval(SSA_POW, ctx.LoadFloat(-8), ctx.LoadFloat(0.5))
+    inf := ctx.Eval(SSA_POW, ctx.LoadFloat(10), ctx.LoadFloat(400))
+
+    if folded := ctx.FoldConstants(); folded != 2 {
+        t.Errorf("folded %v elements, wanted 2", folded)
+    }
+
+    el := ctx.Elements[scaled]
+    if el.Op != SSA_LOAD || el.Src1Type != SSA_TYPE_FLOAT || ctx.Floats[el.Src1] != 1 << 70 {
+        t.Errorf("2 ** 70 * 1.0 was not folded to 2.0 ** 70")
+    }
+    el = ctx.Elements[cube]
+    if el.Op != SSA_LOAD || el.Src1Type != SSA_TYPE_FLOAT || ctx.Floats[el.Src1] != -8 {
+        t.Errorf("-2.0 ** 3.0 was not folded to -8.0")
+    }
+    for _, id := range []int{overflow, root, inf} {
+        if ctx.Elements[id].Op == SSA_LOAD {
+            t.Errorf("folded %v, which has to be left for the runtime", id)
+        }
+    }
+}
+
+func TestPropagateCopies(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    a := ctx.LoadInt(big.NewInt(1))
+    b := ctx.LoadInt(big.NewInt(2))
+
+    // c is a copy of a copy of a.
+    c := ctx.Copy(ctx.Copy(a))
+    d := ctx.Copy(b)
+    sum := ctx.Eval(SSA_ADD, c, d)
+    ctx.Return(sum)
+
+    if removed := ctx.PropagateCopies(); removed != 3 {
+        t.Errorf("dropped %v copies, wanted 3", removed)
+    }
+
+    if ctx.LastElementId != 4 {
+        t.Fatalf("expected 4 elements to remain, got %v", ctx.LastElementId)
+    }
+
+    el := ctx.Elements[2]
+    if el.Op != SSA_ADD || el.Src1 != a || el.Src2 != b {
+        t.Errorf("add reads %v and %v, wanted %v and %v", el.Src1, el.Src2, a, b)
+    }
+
+    if ret := ctx.Elements[3]; ret.Op != SSA_RETURN || ret.Src1 != 2 {
+        t.Errorf("return reads %v, wanted 2", ret.Src1)
+    }
+
+    for id := 0; id < ctx.LastElementId; id++ {
+        if ctx.Elements[id].Op == SSA_COPY {
+            t.Errorf("copy left behind at %v", id)
+        }
+    }
+
+    // Nothing is left to propagate.
+    if removed := ctx.PropagateCopies(); removed != 0 {
+        t.Errorf("second pass dropped %v copies", removed)
+    }
+}
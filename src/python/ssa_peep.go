@@ -0,0 +1,148 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the peephole optimizer, which is run on the stream
+   after registers are allocated, just before it is handed to the Machine or the
+   JIT.  Lowering each statement on its own, and spilling each value where it
+   is needed, leaves behind small patterns that are easy to clean up once we
+   know which register holds what:
+
+       LOAD name x into a register that already holds x
+       STORE x from the register it was just loaded into
+       SPILL a register into the slot it was just filled from
+       a comparison read only by the branch after it
+
+   The first three are removed, and the last is fused into the branch.  The
+   pass only looks within a block, since a register may hold something else
+   when the block is entered from a different predecessor.
+*/
+
+package python
+
+// Forgets every entry of m that says something is in reg.
+func forgetRegister(m map[int]int, reg int) {
+	for k, r := range m {
+		if r == reg {
+			m[k] = 0, false
+		}
+	}
+}
+
+// Runs the peephole optimizations on an allocated stream.  The live ranges are
+// recomputed in write order, as after Eliminate.  Returns the number of elements
+// removed.
+func (ctx *SsaContext) Peephole() int {
+	dead := make([]bool, ctx.LastElementId)
+
+	// Loads that were removed, and the element that already held their value.
+	replace := make(map[int]int)
+
+	users := make([]int, ctx.LastElementId)
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+		if el.ReadsElement(1) {
+			users[el.Src1]++
+		}
+		if el.ReadsElement(2) {
+			users[el.Src2]++
+		}
+	}
+
+	for _, b := range ctx.Blocks {
+		// The element that wrote each register, the register holding the value
+		// bound to each name, and the register holding the value of each spill
+		// slot.  Register 0 is never allocated, so it means we don't know.
+		holder := make(map[int]int)
+		bound := make(map[int]int)
+		slots := make(map[int]int)
+
+		for i, id := range b.Elements {
+			el := ctx.Elements[id]
+
+			switch {
+			case el.Op == SSA_LOAD && el.Src1Type == SSA_TYPE_NAME:
+				if reg := bound[el.Src1]; reg != 0 && reg == el.DstRegister && !el.Pinned {
+					dead[id] = true
+					replace[id] = holder[reg]
+					continue
+				}
+
+			case el.Op == SSA_STORE:
+				if reg := bound[el.Src2]; reg != 0 && reg == el.Src1Register {
+					dead[id] = true
+					continue
+				}
+				bound[el.Src2] = el.Src1Register
+
+			case el.Op == SSA_SPILL:
+				if reg := slots[el.Src1]; reg != 0 && reg == el.DstRegister {
+					dead[id] = true
+					continue
+				}
+				slots[el.Src1] = el.DstRegister
+
+			case el.Op == SSA_BRANCH && el.Cond == 0 && el.ReadsElement(1) && i > 0:
+				// The operands of the comparison are still in their registers,
+				// since the comparison is the only thing between them and us.
+				cond := ctx.Elements[el.Src1]
+				if b.Elements[i-1] == cond.Address && isComparison(cond.Op) && users[cond.Address] == 1 && !cond.Pinned {
+					el.Cond = cond.Op
+					el.Src1, el.Src1Type, el.Src1Register = cond.Src1, cond.Src1Type, cond.Src1Register
+					el.Src2, el.Src2Type, el.Src2Register = cond.Src2, cond.Src2Type, cond.Src2Register
+					dead[cond.Address] = true
+				}
+
+			case el.Op == SSA_CALL:
+				// The call may bind any name, and overwrite any register.
+				holder = make(map[int]int)
+				bound = make(map[int]int)
+				slots = make(map[int]int)
+			}
+
+			if !producesValue(el.Op) || el.DstRegister == 0 {
+				continue
+			}
+
+			// Whatever was in the register is gone now.
+			forgetRegister(bound, el.DstRegister)
+			forgetRegister(slots, el.DstRegister)
+			holder[el.DstRegister] = id
+
+			switch {
+			case el.Op == SSA_LOAD && el.Src1Type == SSA_TYPE_NAME:
+				bound[el.Src1] = el.DstRegister
+			case el.Op == SSA_FILL:
+				slots[el.Src1] = el.DstRegister
+			}
+		}
+	}
+
+	// The users of a removed load read the same register, so only the
+	// element they refer to changes.
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+		if src, present := replace[el.Src1]; present && el.ReadsElement(1) {
+			el.Src1 = src
+		}
+		if src, present := replace[el.Src2]; present && el.ReadsElement(2) {
+			el.Src2 = src
+		}
+	}
+
+	return ctx.compact(func(el *SsaElement) bool {
+		return dead[el.Address]
+	})
+}
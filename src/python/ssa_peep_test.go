@@ -0,0 +1,135 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the peephole optimizer.
+
+*/
+
+package python
+
+import (
+        "big"
+        "strings"
+        "testing"
+)
+
+// Returns the number of elements in ctx with the operation op.
+func countOps(ctx *SsaContext, op uint) int {
+    count := 0
+    for id := 0; id < ctx.LastElementId; id++ {
+        if ctx.Elements[id].Op == op {
+            count++
+        }
+    }
+    return count
+}
+
+func TestPeepholeLoadStore(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    // a = a
+    // x = a + b
+    // y = x * x
+    a := ctx.LoadName("a")
+    ctx.Store("a", a)
+    b := ctx.LoadName("b")
+    ctx.Store("x", ctx.Eval(SSA_ADD, a, b))
+    x := ctx.LoadName("x")
+    ctx.Store("y", ctx.Eval(SSA_MUL, x, x))
+    ctx.Return(-1)
+
+    ctx = ctx.AllocateRegisters(4)
+    t.Logf("before:\n%v", ctx)
+
+    if removed := ctx.Peephole(); removed != 2 {
+        t.Errorf("expected 2 elements removed, got %v", removed)
+    }
+    t.Logf("after:\n%v", ctx)
+
+    if n := countOps(ctx, SSA_STORE); n != 2 {
+        t.Errorf("expected the store to a to be removed, %v stores are left", n)
+    }
+    if n := countOps(ctx, SSA_LOAD); n != 2 {
+        t.Errorf("expected the load of x to be removed, %v loads are left", n)
+    }
+
+    // The multiply reads the sum, which is where x was loaded from.
+    for id := 0; id < ctx.LastElementId; id++ {
+        if el := ctx.Elements[id]; el.Op == SSA_MUL && ctx.Elements[el.Src1].Op != SSA_ADD {
+            t.Errorf("the multiply should read the sum, got %v", ctx.formatElement(el))
+        }
+    }
+    checkRegisterAssignment(t, ctx)
+}
+
+func TestPeepholeFillSpill(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    ctx.Fill(0, 1)
+    ctx.Spill(0, 1)
+
+    // r1 is overwritten in between, so this spill must stay.
+    ctx.Fill(1, 1)
+    ctx.Elements[ctx.LoadInt(big.NewInt(5))].DstRegister = 1
+    ctx.Spill(1, 1)
+
+    if removed := ctx.Peephole(); removed != 1 {
+        t.Errorf("expected 1 element removed, got %v", removed)
+    }
+    if n := countOps(ctx, SSA_SPILL); n != 1 || ctx.Elements[ctx.LastElementId-1].Op != SSA_SPILL {
+        t.Errorf("expected only the last spill to be left:\n%v", ctx)
+    }
+}
+
+func TestPeepholeFuseBranch(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    then_block := ctx.NewBlock()
+    else_block := ctx.NewBlock()
+
+    a := ctx.LoadInt(big.NewInt(3))
+    b := ctx.LoadInt(big.NewInt(7))
+    ctx.Branch(ctx.Eval(SSA_LT, a, b), then_block, else_block)
+
+    ctx.SetBlock(then_block)
+    ctx.Return(a)
+
+    ctx.SetBlock(else_block)
+    ctx.Return(b)
+
+    ctx = ctx.AllocateRegisters(4)
+    if removed := ctx.Peephole(); removed != 1 {
+        t.Errorf("expected 1 element removed, got %v", removed)
+    }
+
+    if n := countOps(ctx, SSA_LT); n != 0 {
+        t.Errorf("expected the comparison to be fused into the branch")
+    }
+
+    br := ctx.Elements[ctx.Blocks[0].Elements[len(ctx.Blocks[0].Elements)-1]]
+    if br.Op != SSA_BRANCH || br.Cond != SSA_LT || br.Src1 != a || br.Src2 != b {
+        t.Fatalf("expected a fused branch, got %v", ctx.formatElement(br))
+    }
+    if br.Src1Register != ctx.Elements[a].DstRegister || br.Src2Register != ctx.Elements[b].DstRegister {
+        t.Errorf("the fused branch reads the wrong registers")
+    }
+    if s := ctx.String(); !strings.Contains(s, "BRANCH LT %0, %1, b1, b2") {
+        t.Errorf("unexpected dump:\n%v", s)
+    }
+}
@@ -0,0 +1,539 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the integer range analysis.  A Python int can grow
+   without limit, so in general every int operation has to be ready to switch
+   to a big.Int.  Most ints never get anywhere near that, though, and if we can
+   prove that an element always fits in an int64, code generation can use plain
+   machine arithmetic for it, without any overflow checks.
+
+   The range of each element is worked out from the ranges of its operands.
+   Values only flow around loops through names, so the range of a local name is
+   the union of the ranges of everything stored to it, and a load of the name
+   gets that range.  A branch on a comparison also narrows the ranges of the
+   compared elements in the block it leads to, which is what bounds a loop
+   counter like the "i" in "while i < 10: i = i + 1".
+
+   Loops are solved by iterating until nothing changes.  A range that is still
+   growing after a few passes is widened to be unbounded on that side, so that
+   we don't go round a loop a billion times, and a few more passes then narrow
+   it back down where a branch bounds it.
+*/
+
+package python
+
+import "big"
+
+// The number of passes after which growing ranges are widened, and the number of
+// passes used to narrow them back down afterwards.
+const (
+	rangeWidenAfter   = 3
+	rangeNarrowPasses = 2
+)
+
+// A range of int values, from lo to hi inclusive.  A nil bound is unbounded.  An empty
+// range holds no value at all, which is the range of something that has not been
+// reached yet.  A nil *intRange is a value that isn't known to be an int.
+type intRange struct {
+	empty  bool
+	lo, hi *big.Int
+}
+
+var emptyRange = &intRange{empty: true}
+var anyInt = &intRange{}
+
+var minInt64 = big.NewInt(-1 << 63)
+var maxInt64 = big.NewInt(1<<63 - 1)
+
+// The smaller of a and b, where nil is smaller than anything.
+func minBound(a, b *big.Int) *big.Int {
+	if a == nil || b == nil {
+		return nil
+	}
+	if a.Cmp(b) < 0 {
+		return a
+	}
+	return b
+}
+
+// The larger of a and b, where nil is larger than anything.
+func maxBound(a, b *big.Int) *big.Int {
+	if a == nil || b == nil {
+		return nil
+	}
+	if a.Cmp(b) > 0 {
+		return a
+	}
+	return b
+}
+
+// Returns a + b, or nil if either is unbounded.
+func addBound(a, b *big.Int) *big.Int {
+	if a == nil || b == nil {
+		return nil
+	}
+	return new(big.Int).Add(a, b)
+}
+
+// Returns a + n, or nil if a is unbounded.
+func addBoundInt(a *big.Int, n int64) *big.Int {
+	if a == nil {
+		return nil
+	}
+	return new(big.Int).Add(a, big.NewInt(n))
+}
+
+// Returns -a, or nil if a is unbounded.
+func negBound(a *big.Int) *big.Int {
+	if a == nil {
+		return nil
+	}
+	return new(big.Int).Neg(a)
+}
+
+func boundsEqual(a, b *big.Int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Cmp(b) == 0
+}
+
+// Returns the range from lo to hi, which is empty if lo is above hi.
+func makeRange(lo, hi *big.Int) *intRange {
+	if lo != nil && hi != nil && lo.Cmp(hi) > 0 {
+		return emptyRange
+	}
+	return &intRange{lo: lo, hi: hi}
+}
+
+// Returns the smallest range holding both r and o.
+func (r *intRange) join(o *intRange) *intRange {
+	switch {
+	case r == nil || o == nil:
+		return nil
+	case r.empty:
+		return o
+	case o.empty:
+		return r
+	}
+	return &intRange{lo: minBound(r.lo, o.lo), hi: maxBound(r.hi, o.hi)}
+}
+
+func (r *intRange) equal(o *intRange) bool {
+	if r == nil || o == nil {
+		return r == o
+	}
+	if r.empty || o.empty {
+		return r.empty == o.empty
+	}
+	return boundsEqual(r.lo, o.lo) && boundsEqual(r.hi, o.hi)
+}
+
+// Returns true if every value in the range fits in an int64.
+func (r *intRange) fitsInt64() bool {
+	return r != nil && !r.empty && r.lo != nil && r.hi != nil &&
+		r.lo.Cmp(minInt64) >= 0 && r.hi.Cmp(maxInt64) <= 0
+}
+
+// Returns new, with any bound that moved outwards from old made unbounded.
+func widen(old, new *intRange) *intRange {
+	if old == nil || new == nil || old.empty || new.empty {
+		return new
+	}
+
+	lo, hi := new.lo, new.hi
+	if old.lo == nil || (lo != nil && lo.Cmp(old.lo) < 0) {
+		lo = nil
+	}
+	if old.hi == nil || (hi != nil && hi.Cmp(old.hi) > 0) {
+		hi = nil
+	}
+	return &intRange{lo: lo, hi: hi}
+}
+
+// Works out the range of the result of op on two ranges, neither of which is empty.
+func arithmeticRange(op uint, l, r *intRange) *intRange {
+	switch op {
+	case SSA_ADD:
+		return makeRange(addBound(l.lo, r.lo), addBound(l.hi, r.hi))
+
+	case SSA_SUB:
+		return makeRange(addBound(l.lo, negBound(r.hi)), addBound(l.hi, negBound(r.lo)))
+
+	case SSA_MUL:
+		if l.lo == nil || l.hi == nil || r.lo == nil || r.hi == nil {
+			return anyInt
+		}
+		lo := new(big.Int).Mul(l.lo, r.lo)
+		hi := lo
+		for _, p := range []*big.Int{new(big.Int).Mul(l.lo, r.hi), new(big.Int).Mul(l.hi, r.lo), new(big.Int).Mul(l.hi, r.hi)} {
+			lo, hi = minBound(lo, p), maxBound(hi, p)
+		}
+		return makeRange(lo, hi)
+
+	case SSA_MOD:
+		// Python's modulus takes the sign of the divisor.
+		switch {
+		case r.lo != nil && r.lo.Sign() > 0:
+			return makeRange(big.NewInt(0), addBoundInt(r.hi, -1))
+		case r.hi != nil && r.hi.Sign() < 0:
+			return makeRange(addBoundInt(r.lo, 1), big.NewInt(0))
+		}
+		return anyInt
+
+	case SSA_AND:
+		// Anding with something that isn't negative can't set any more bits.
+		l_pos, r_pos := l.lo != nil && l.lo.Sign() >= 0, r.lo != nil && r.lo.Sign() >= 0
+		switch {
+		case l_pos && r_pos:
+			return makeRange(big.NewInt(0), tighterHi(l.hi, r.hi))
+		case l_pos:
+			return makeRange(big.NewInt(0), l.hi)
+		case r_pos:
+			return makeRange(big.NewInt(0), r.hi)
+		}
+		return anyInt
+
+	case SSA_OR, SSA_XOR:
+		if l.lo == nil || r.lo == nil || l.hi == nil || r.hi == nil || l.lo.Sign() < 0 || r.lo.Sign() < 0 {
+			return anyInt
+		}
+		bits := l.hi.BitLen()
+		if r.hi.BitLen() > bits {
+			bits = r.hi.BitLen()
+		}
+		hi := new(big.Int).Lsh(big.NewInt(1), uint(bits))
+		return makeRange(big.NewInt(0), hi.Sub(hi, big.NewInt(1)))
+	}
+
+	// Division gives a float, and a negative power does too.
+	return nil
+}
+
+// The relation that holds between b and a when a op b holds.
+func swapComparison(op uint) uint {
+	switch op {
+	case SSA_LT:
+		return SSA_GT
+	case SSA_LE:
+		return SSA_GE
+	case SSA_GT:
+		return SSA_LT
+	case SSA_GE:
+		return SSA_LE
+	}
+	return op
+}
+
+// The relation that holds when a op b doesn't.
+func negateComparison(op uint) uint {
+	switch op {
+	case SSA_EQ:
+		return SSA_NE
+	case SSA_NE:
+		return SSA_EQ
+	case SSA_LT:
+		return SSA_GE
+	case SSA_LE:
+		return SSA_GT
+	case SSA_GT:
+		return SSA_LE
+	case SSA_GE:
+		return SSA_LT
+	}
+	return op
+}
+
+// Something known to be true in a block because of the branch that led there: element x
+// is related to element y by the comparison op.  If x was loaded from a name, name is its
+// index, and the fact holds for other loads of the name too, until the name is stored to.
+// Otherwise name is -1.
+type rangeFact struct {
+	x, y int
+	op   uint
+	name int
+}
+
+// Returns the index of the name that element id loads, or -1 if it isn't a load of a name.
+func (ctx *SsaContext) loadedName(id int) int {
+	if el := ctx.Elements[id]; el.Op == SSA_LOAD && el.Src1Type == SSA_TYPE_NAME {
+		return el.Src1
+	}
+	return -1
+}
+
+// Returns r narrowed to the values which are related by op to some value in y.
+func narrowRange(r *intRange, op uint, y *intRange) *intRange {
+	if r == nil || r.empty || y == nil || y.empty {
+		return r
+	}
+
+	lo, hi := r.lo, r.hi
+	switch op {
+	case SSA_LT:
+		hi = tighterHi(hi, addBoundInt(y.hi, -1))
+	case SSA_LE:
+		hi = tighterHi(hi, y.hi)
+	case SSA_GT:
+		lo = tighterLo(lo, addBoundInt(y.lo, 1))
+	case SSA_GE:
+		lo = tighterLo(lo, y.lo)
+	case SSA_EQ:
+		lo, hi = tighterLo(lo, y.lo), tighterHi(hi, y.hi)
+	}
+	return makeRange(lo, hi)
+}
+
+// Returns the tighter of two upper bounds, where nil is unbounded.
+func tighterHi(a, b *big.Int) *big.Int {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return minBound(a, b)
+}
+
+// Returns the tighter of two lower bounds, where nil is unbounded.
+func tighterLo(a, b *big.Int) *big.Int {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return maxBound(a, b)
+}
+
+// Returns true if the block stores to the name with index name.
+func (ctx *SsaContext) storesName(b *BasicBlock, name int) bool {
+	for _, id := range b.Elements {
+		if el := ctx.Elements[id]; el.Op == SSA_STORE && el.Src2 == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the facts that hold in each block.  A block with a single predecessor knows
+// what its predecessor knows, and if the predecessor ends in a branch on a comparison,
+// whether or not the comparison held.
+func (ctx *SsaContext) rangeFacts() [][]rangeFact {
+	facts := make([][]rangeFact, len(ctx.Blocks))
+	done := make([]bool, len(ctx.Blocks))
+
+	var visit func(b *BasicBlock) []rangeFact
+	visit = func(b *BasicBlock) []rangeFact {
+		if done[b.Id] {
+			return facts[b.Id]
+		}
+		done[b.Id] = true
+
+		if len(b.Preds) != 1 {
+			return nil
+		}
+		pred := b.Preds[0]
+
+		// The facts are copied, so that the blocks don't share them.  Facts
+		// about names that the predecessor stores to no longer hold.
+		var known []rangeFact
+		for _, f := range visit(pred) {
+			if f.name < 0 || !ctx.storesName(pred, f.name) {
+				known = append(known, f)
+			}
+		}
+
+		if len(pred.Elements) > 0 && len(pred.Succs) == 2 && pred.Succs[0] != pred.Succs[1] {
+			br := ctx.Elements[pred.Elements[len(pred.Elements)-1]]
+			if br.Op == SSA_BRANCH && br.Cond == 0 && br.ReadsElement(1) {
+				cond := ctx.Elements[br.Src1]
+				if isComparison(cond.Op) {
+					op := cond.Op
+					if b == pred.Succs[1] {
+						op = negateComparison(op)
+					}
+					known = append(known, rangeFact{cond.Src1, cond.Src2, op, ctx.loadedName(cond.Src1)})
+					known = append(known, rangeFact{cond.Src2, cond.Src1, swapComparison(op), ctx.loadedName(cond.Src2)})
+				}
+			}
+		}
+
+		facts[b.Id] = known
+		return known
+	}
+
+	for _, b := range ctx.Blocks {
+		visit(b)
+	}
+
+	return facts
+}
+
+// Works out the range of every element from the ranges of the names.
+func (ctx *SsaContext) rangePass(names map[int]*intRange, facts [][]rangeFact) []*intRange {
+	ranges := make([]*intRange, ctx.LastElementId)
+
+	// The names stored to so far in each block.  The elements of a block are
+	// in id order, so this is what has been stored before the current element.
+	stored := make([]map[int]bool, len(ctx.Blocks))
+
+	// Operands are always written before the elements that read them.
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+
+		operand := func(src int) *intRange {
+			r := ranges[src]
+			for _, f := range facts[el.Block] {
+				if f.x == src {
+					r = narrowRange(r, f.op, ranges[f.y])
+				}
+			}
+			return r
+		}
+
+		var left, right *intRange
+		if el.ReadsElement(1) {
+			left = operand(el.Src1)
+		}
+		if el.ReadsElement(2) {
+			right = operand(el.Src2)
+		}
+
+		switch {
+		case el.Op == SSA_LOAD && el.Src1Type == SSA_TYPE_INTEGER:
+			ranges[id] = makeRange(ctx.Ints[el.Src1], ctx.Ints[el.Src1])
+
+		case el.Op == SSA_LOAD && el.Src1Type == SSA_TYPE_NAME:
+			r := names[el.Src1]
+			if !stored[el.Block][el.Src1] {
+				for _, f := range facts[el.Block] {
+					if f.name == el.Src1 {
+						r = narrowRange(r, f.op, ranges[f.y])
+					}
+				}
+			}
+			ranges[id] = r
+
+		case el.Op == SSA_STORE:
+			// Remember what the store sees, for the next pass.
+			ranges[id] = left
+			if stored[el.Block] == nil {
+				stored[el.Block] = make(map[int]bool)
+			}
+			stored[el.Block][el.Src2] = true
+
+		case el.Op == SSA_COPY || el.Op == SSA_MOVE:
+			ranges[id] = left
+
+		case el.Op == SSA_TO_INT && ctx.Elements[el.Src1].ValueType == SSA_TYPE_INTEGER:
+			// Only an int keeps its range; a float can be any int.
+			ranges[id] = left
+
+		case el.Op == SSA_NOT:
+			// ~x is -x - 1.
+			if left != nil && !left.empty {
+				ranges[id] = makeRange(addBoundInt(negBound(left.hi), -1), addBoundInt(negBound(left.lo), -1))
+			} else {
+				ranges[id] = left
+			}
+
+		case isArithmetic(el.Op) && left != nil && right != nil:
+			if left.empty || right.empty {
+				ranges[id] = emptyRange
+			} else {
+				ranges[id] = arithmeticRange(el.Op, left, right)
+			}
+		}
+	}
+
+	return ranges
+}
+
+// Returns the union of the ranges of the values stored to each local name.
+func (ctx *SsaContext) storedRanges(ranges []*intRange, names map[int]*intRange) map[int]*intRange {
+	stored := make(map[int]*intRange, len(names))
+	for idx := range names {
+		stored[idx] = emptyRange
+	}
+
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+		if r, present := stored[el.Src2]; present && el.Op == SSA_STORE && el.Src2Type == SSA_TYPE_NAME {
+			stored[el.Src2] = r.join(ranges[id])
+		}
+	}
+
+	return stored
+}
+
+// Works out the range of every element, or nil for those that aren't known to be ints.
+func (ctx *SsaContext) intRanges() []*intRange {
+	facts := ctx.rangeFacts()
+
+	// Only the names in LocalNames hold nothing but what we store to them.
+	names := make(map[int]*intRange)
+	for idx, name := range ctx.Names {
+		if ctx.LocalNames[name] {
+			names[idx] = emptyRange
+		}
+	}
+
+	// Grow the ranges of the names until they hold everything stored to them.
+	for pass := 0; ; pass++ {
+		stored := ctx.storedRanges(ctx.rangePass(names, facts), names)
+
+		changed := false
+		for idx, old := range names {
+			r := old.join(stored[idx])
+			if pass >= rangeWidenAfter {
+				r = widen(old, r)
+			}
+			if !r.equal(old) {
+				names[idx] = r
+				changed = true
+			}
+		}
+
+		if !changed {
+			break
+		}
+	}
+
+	// Every pass from here on only gives tighter ranges which are still safe.
+	for pass := 0; pass < rangeNarrowPasses; pass++ {
+		names = ctx.storedRanges(ctx.rangePass(names, facts), names)
+	}
+
+	return ctx.rangePass(names, facts)
+}
+
+// Finds the int elements whose values always fit in an int64, and sets their SmallInt flag.
+// Returns the number of elements tagged.
+func (ctx *SsaContext) AnalyzeRanges() int {
+	ranges := ctx.intRanges()
+
+	count := 0
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+		el.SmallInt = producesValue(el.Op) && ranges[id].fitsInt64()
+		if el.SmallInt {
+			count++
+		}
+	}
+
+	return count
+}
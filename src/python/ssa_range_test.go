@@ -0,0 +1,141 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the integer range analysis.
+
+*/
+
+package python
+
+import (
+        "big"
+        "testing"
+)
+
+// Checks that the range of element id is lo to hi.
+func checkRange(t *testing.T, ranges []*intRange, id int, lo, hi int64) {
+    r := ranges[id]
+    if r == nil || r.empty || r.lo == nil || r.hi == nil || r.lo.Int64() != lo || r.hi.Int64() != hi {
+        t.Errorf("element %v should have the range %v..%v, got %v", id, lo, hi, r)
+    }
+}
+
+// Builds
+//
+//      i = 0
+//      while i < limit:
+//          i = i + step
+//      return i
+func buildCountingLoop(limit, step int64) (ctx *SsaContext, header_i, body_i, sum, exit_i int) {
+    ctx = new (SsaContext)
+    ctx.Init()
+    ctx.LocalNames = map[string]bool{"i": true}
+
+    header := ctx.NewBlock()
+    body := ctx.NewBlock()
+    exit := ctx.NewBlock()
+
+    ctx.Store("i", ctx.LoadInt(big.NewInt(0)))
+    ctx.Jump(header)
+
+    ctx.SetBlock(header)
+    header_i = ctx.LoadName("i")
+    ctx.Branch(ctx.Eval(SSA_LT, header_i, ctx.LoadInt(big.NewInt(limit))), body, exit)
+
+    ctx.SetBlock(body)
+    body_i = ctx.LoadName("i")
+    sum = ctx.Eval(SSA_ADD, body_i, ctx.LoadInt(big.NewInt(step)))
+    ctx.Store("i", sum)
+    ctx.Jump(header)
+
+    ctx.SetBlock(exit)
+    exit_i = ctx.LoadName("i")
+    ctx.Return(exit_i)
+
+    return
+}
+
+func TestRangeLoopCounter(t *testing.T) {
+    ctx, header_i, body_i, sum, exit_i := buildCountingLoop(1000000, 1)
+    ranges := ctx.intRanges()
+
+    checkRange(t, ranges, header_i, 0, 1000000)
+    checkRange(t, ranges, body_i, 0, 999999)
+    checkRange(t, ranges, sum, 1, 1000000)
+    checkRange(t, ranges, exit_i, 1000000, 1000000)
+
+    ctx.AnalyzeRanges()
+    for _, id := range []int{header_i, body_i, sum, exit_i} {
+        if !ctx.Elements[id].SmallInt {
+            t.Errorf("element %v should be a small int", id)
+        }
+    }
+}
+
+func TestRangeUnbounded(t *testing.T) {
+    // Counting down from 0 while i < 10 never stops.
+    ctx, header_i, body_i, _, _ := buildCountingLoop(10, -1)
+    ranges := ctx.intRanges()
+
+    if r := ranges[header_i]; r == nil || r.lo != nil || r.hi == nil || r.hi.Int64() != 0 {
+        t.Errorf("i should have no lower bound, got %v", r)
+    }
+
+    ctx.AnalyzeRanges()
+    if ctx.Elements[body_i].SmallInt {
+        t.Errorf("an unbounded element was tagged")
+    }
+
+    // Without LocalNames, the name could hold anything.
+    ctx, header_i, _, _, _ = buildCountingLoop(10, 1)
+    ctx.LocalNames = nil
+    if ctx.AnalyzeRanges(); ctx.Elements[header_i].SmallInt {
+        t.Errorf("a name that isn't local was tagged")
+    }
+}
+
+func TestRangeArithmetic(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    a := ctx.LoadInt(big.NewInt(-3))
+    b := ctx.LoadInt(big.NewInt(7))
+    huge := ctx.LoadInt(new(big.Int).Lsh(big.NewInt(1), 70))
+    mul := ctx.Eval(SSA_MUL, a, b)
+    mod := ctx.Eval(SSA_MOD, huge, b)
+    and := ctx.Eval(SSA_AND, huge, b)
+    not := ctx.Eval(SSA_NOT, b, b)
+    div := ctx.Eval(SSA_DIV, a, b)
+    big_mul := ctx.Eval(SSA_MUL, huge, b)
+
+    ranges := ctx.intRanges()
+    checkRange(t, ranges, mul, -21, -21)
+    checkRange(t, ranges, mod, 0, 6)
+    checkRange(t, ranges, and, 0, 7)
+    checkRange(t, ranges, not, -8, -8)
+
+    if ranges[div] != nil {
+        t.Errorf("true division gives a float, not an int")
+    }
+
+    ctx.AnalyzeRanges()
+    if ctx.Elements[huge].SmallInt || ctx.Elements[big_mul].SmallInt {
+        t.Errorf("a value that doesn't fit in an int64 was tagged")
+    }
+    if !ctx.Elements[mod].SmallInt {
+        t.Errorf("the modulus of a huge value by a small one should be small")
+    }
+}
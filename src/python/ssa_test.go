@@ -22,7 +22,6 @@ package python
 
 import (   
         "big"
-        "fmt"     
         "testing"            
 )
 
@@ -88,29 +87,6 @@ func TestEval(t *testing.T) {
     }    
 }
 
-func dumpElements(ctx *SsaContext) {
-    for i:=0; i<len(ctx.Elements); i++ {
-        el := ctx.Elements[i]
-            
-        if el!=nil {
-            switch el.Op {
-                case SSA_LOAD:
-                    fmt.Printf("r%v(r%v) = LOAD  %v ; live=%v,%v active: %v,%v\n", i, el.DstRegister, el.Src1, el.LiveStart, el.LiveEnd, el.ActiveStart, el.ActiveEnd)
-                case SSA_STORE:
-                    fmt.Printf("r%v(r%v) = STORE %v\n", i, el.DstRegister, el.Src1)
-                case SSA_SPILL:
-                    fmt.Printf("r%v = SPILL %v <- r%v\n", i, el.Src1, el.DstRegister)
-                case SSA_FILL:
-                    fmt.Printf("r%v = FILL  %v -> r%v\n", i, el.Src1, el.DstRegister)
-                default:    
-                    if el.Op > SSA_ALU_MARK {            
-                        fmt.Printf("r%v(r%v) = r%v(r%v) OP r%v(r%v) ; live=%v,%v active: %v,%v\n", i, el.DstRegister, el.Src1, el.Src1Register, el.Src2, el.Src2Register, el.LiveStart, el.LiveEnd, el.ActiveStart, el.ActiveEnd)
-                    }
-            }
-       } 
-    }
-}
-
 func TestRegisterAllocation(t *testing.T) {    
     ctx := new (SsaContext)
     ctx.Init()
@@ -136,7 +112,618 @@ func TestRegisterAllocation(t *testing.T) {
     // spilling registers.
     new_ctx := ctx.AllocateRegisters(3)
     
-    dumpElements(ctx)
-    dumpElements(new_ctx)      
+    t.Logf("before allocation:\n%v", ctx)
+    t.Logf("after allocation:\n%v", new_ctx)
+}
+
+
+// Builds the diamond:
+//
+//      entry: c = 1 + 2; branch c
+//      then:  d = c - 1; jump join
+//      else:  e = c * 2; jump join
+//      join:  f = c + 2
+func buildDiamond() (*SsaContext, []*BasicBlock) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    entry := ctx.Current
+    then_block := ctx.NewBlock()
+    else_block := ctx.NewBlock()
+    join_block := ctx.NewBlock()
+
+    one := ctx.LoadInt(big.NewInt(1))
+    two := ctx.LoadInt(big.NewInt(2))
+    c := ctx.Eval(SSA_ADD, one, two)
+    ctx.Branch(c, then_block, else_block)
+
+    ctx.SetBlock(then_block)
+    ctx.Eval(SSA_SUB, c, one)
+    ctx.Jump(join_block)
+
+    ctx.SetBlock(else_block)
+    ctx.Eval(SSA_MUL, c, two)
+    ctx.Jump(join_block)
+
+    ctx.SetBlock(join_block)
+    f := ctx.Eval(SSA_ADD, c, two)
+    ctx.Elements[f].Pinned = true
+
+    return ctx, []*BasicBlock{entry, then_block, else_block, join_block}
+}
+
+func TestControlFlowGraph(t *testing.T) {
+    ctx, blocks := buildDiamond()
+
+    if len(blocks[0].Succs) != 2 || blocks[0].Succs[0] != blocks[1] || blocks[0].Succs[1] != blocks[2] {
+        t.Errorf("entry block has the wrong successors")
+    }
+
+    if len(blocks[3].Preds) != 2 || blocks[3].Preds[0] != blocks[1] || blocks[3].Preds[1] != blocks[2] {
+        t.Errorf("join block has the wrong predecessors")
+    }
+
+    for _, b := range blocks[0:3] {
+        if !ctx.IsTerminated(b) {
+            t.Errorf("block %v should end in a terminator", b.Id)
+        }
+    }
+
+    if ctx.IsTerminated(blocks[3]) {
+        t.Errorf("join block should not be terminated")
+    }
+
+    new_ctx := ctx.AllocateRegisters(8)
+
+    if len(new_ctx.Blocks) != len(ctx.Blocks) {
+        t.Fatalf("allocation produced %v blocks, wanted %v", len(new_ctx.Blocks), len(ctx.Blocks))
+    }
+
+    for i, b := range new_ctx.Blocks {
+        if len(b.Succs) != len(ctx.Blocks[i].Succs) {
+            t.Errorf("block %v lost its edges during allocation", i)
+        }
+
+        for _, id := range b.Elements {
+            el := new_ctx.Elements[id]
+            if el.Block != b.Id {
+                t.Errorf("element %v is in block %v but says it is in %v", id, b.Id, el.Block)
+            }
+            if (el.Op == SSA_JUMP || el.Op == SSA_BRANCH) && el.DstRegister != 0 {
+                t.Errorf("terminator %v was given a register", id)
+            }
+        }
+    }
+
+    branch := new_ctx.Elements[new_ctx.Blocks[0].Elements[len(new_ctx.Blocks[0].Elements)-1]]
+    if branch.Op != SSA_BRANCH || branch.Src2 != blocks[1].Id {
+        t.Errorf("branch was rewritten incorrectly")
+    }
+
+    if cond := new_ctx.Elements[branch.Src1]; cond.Op != SSA_ADD {
+        t.Errorf("branch condition was renamed incorrectly")
+    }
+}
+
+func TestComparisonBranchLiveness(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    small := ctx.NewBlock()
+    large := ctx.NewBlock()
+
+    // The unused element has the same id as the large block, which the branch
+    // refers to.  That must not mark it as read.
+    a := ctx.LoadInt(big.NewInt(10))
+    b := ctx.LoadInt(big.NewInt(20))
+    unused := ctx.LoadInt(big.NewInt(30))
+    cond := ctx.Eval(SSA_LT, a, b)
+    branch := ctx.Branch(cond, large, small)
+
+    ctx.SetBlock(small)
+    ret_small := ctx.Return(a)
+
+    ctx.SetBlock(large)
+    ctx.Return(-1)
+
+    if !ctx.Elements[cond].WasRead || ctx.Elements[cond].LiveEnd != branch {
+        t.Errorf("branch condition should be read by the branch, live end %v", ctx.Elements[cond].LiveEnd)
+    }
+
+    if ctx.Elements[unused].WasRead {
+        t.Errorf("element %v was never used but is marked as read", unused)
+    }
+
+    if ctx.Elements[a].LiveEnd != ret_small {
+        t.Errorf("returned value should live until the return, got %v wanted %v", ctx.Elements[a].LiveEnd, ret_small)
+    }
+
+    if !isComparison(ctx.Elements[cond].Op) {
+        t.Errorf("SSA_LT should be a comparison")
+    }
+
+    for _, blk := range ctx.Blocks {
+        if !ctx.IsTerminated(blk) {
+            t.Errorf("block %v should be terminated", blk.Id)
+        }
+    }
+
+    if len(small.Succs) != 0 {
+        t.Errorf("a block that returns should have no successors")
+    }
+
+    new_ctx := ctx.AllocateRegisters(8)
+
+    for _, id := range new_ctx.Blocks[2].Elements {
+        el := new_ctx.Elements[id]
+        if el.Op == SSA_RETURN && el.Src1Type != SSA_TYPE_NONE {
+            t.Errorf("return without a value was given an operand")
+        }
+    }
+
+    for _, id := range new_ctx.Blocks[0].Elements {
+        if new_ctx.Elements[id].Op == SSA_LOAD && new_ctx.Elements[id].Src1 == 2 {
+            t.Errorf("unused load was not removed")
+        }
+    }
+}
+
+// What the registers and the spill slots are known to hold at some point of the code, on
+// every path there.
+type registerFile struct {
+    regs, slots map[int]int
+}
+
+func newRegisterFile() *registerFile {
+    return &registerFile{make(map[int]int), make(map[int]int)}
+}
+
+func (f *registerFile) copy() *registerFile {
+    c := newRegisterFile()
+    for reg, v := range f.regs {
+        c.regs[reg] = v
+    }
+    for slot, v := range f.slots {
+        c.slots[slot] = v
+    }
+    return c
+}
+
+// Forgets what f and g don't agree on, and returns true if f changed.
+func (f *registerFile) meet(g *registerFile) bool {
+    changed := false
+    for _, m := range []struct{ mine, theirs map[int]int }{{f.regs, g.regs}, {f.slots, g.slots}} {
+        for k, v := range m.mine {
+            if w, present := m.theirs[k]; !present || w != v {
+                m.mine[k] = 0, false
+                changed = true
+            }
+        }
+    }
+    return changed
+}
+
+// Runs the allocated code through a model of the register file and the spill area along
+// every path through the control flow graph, and checks that every operand reads the
+// register that holds its value at that point on all of them.  A block starts out with
+// only what all of its predecessors agree on.
+func checkRegisterAssignment(t *testing.T, ctx *SsaContext) {
+    // The value of a fill or a move is the value it copies.
+    value := make(map[int]int)
+
+    // Runs the block b from the state f, checking the operands if check is set.
+    run := func(b *BasicBlock, f *registerFile, check bool) {
+        for _, id := range b.Elements {
+            el := ctx.Elements[id]
+
+            for n := 1; n <= 2 && check; n++ {
+                if !el.ReadsElement(n) {
+                    continue
+                }
+
+                src, reg := el.Src1, el.Src1Register
+                if n == 2 {
+                    src, reg = el.Src2, el.Src2Register
+                }
+
+                if reg != ctx.Elements[src].DstRegister {
+                    t.Errorf("element %v reads %v from r%v, but it is in r%v", id, src, reg, ctx.Elements[src].DstRegister)
+                }
+                want, known := value[src]
+                if got, present := f.regs[reg]; !known || !present || got != want {
+                    t.Errorf("element %v reads r%v for %v in block %v, but r%v doesn't hold it on every path", id, reg, src, b.Id, reg)
+                }
+            }
+
+            // Copies a known value from one map to another, or forgets it.
+            put := func(to map[int]int, k int, from map[int]int, j int) {
+                if v, present := from[j]; present {
+                    to[k] = v
+                } else {
+                    to[k] = 0, false
+                }
+            }
+
+            switch {
+                case el.Op == SSA_SPILL:
+                    put(f.slots, el.Src1, f.regs, el.DstRegister)
+                case el.Op == SSA_FILL:
+                    put(value, id, f.slots, el.Src1)
+                    put(f.regs, el.DstRegister, value, id)
+                case el.Op == SSA_MOVE:
+                    put(value, id, f.regs, el.Src1Register)
+                    put(f.regs, el.DstRegister, value, id)
+                case producesValue(el.Op):
+                    value[id] = id
+                    f.regs[el.DstRegister] = id
+            }
+        }
+    }
+
+    // Find what each block starts with, until nothing changes.
+    entry := make([]*registerFile, len(ctx.Blocks))
+    entry[0] = newRegisterFile()
+    for changed := true; changed; {
+        changed = false
+        for _, b := range ctx.Blocks {
+            if entry[b.Id] == nil {
+                continue
+            }
+
+            f := entry[b.Id].copy()
+            run(b, f, false)
+            for _, s := range b.Succs {
+                switch {
+                    case entry[s.Id] == nil:
+                        entry[s.Id] = f.copy()
+                        changed = true
+                    case entry[s.Id].meet(f):
+                        changed = true
+                }
+            }
+        }
+    }
+
+    for _, b := range ctx.Blocks {
+        if entry[b.Id] != nil {
+            run(b, entry[b.Id].copy(), true)
+        }
+    }
+}
+
+func TestRepeatedSpillAndFill(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    // Keep six values live the whole way through, and read them round robin
+    // so that each one is spilled and filled several times.
+    values := make([]int, 6)
+    for i := range values {
+        values[i] = ctx.LoadInt(big.NewInt(int64(i)))
+    }
+
+    sum := ctx.Eval(SSA_ADD, values[0], values[1])
+    for i := 0; i < 24; i++ {
+        sum = ctx.Eval(SSA_ADD, sum, values[i % len(values)])
+    }
+
+    for _, v := range values {
+        sum = ctx.Eval(SSA_ADD, sum, v)
+    }
+    ctx.Return(sum)
+
+    new_ctx := ctx.AllocateRegisters(4)
+
+    spills, fills := 0, 0
+    filled := make(map[int]int)
+    for id := 0; id < new_ctx.LastElementId; id++ {
+        switch new_ctx.Elements[id].Op {
+            case SSA_SPILL:
+                spills++
+            case SSA_FILL:
+                fills++
+        }
+    }
+
+    if spills < len(values) || fills < len(values) {
+        t.Errorf("expected repeated spills and fills, got %v spills and %v fills", spills, fills)
+    }
+
+    // Every fill must be read, or it was wasted.
+    for id := 0; id < new_ctx.LastElementId; id++ {
+        el := new_ctx.Elements[id]
+        if el.ReadsElement(1) {
+            filled[el.Src1]++
+        }
+        if el.ReadsElement(2) {
+            filled[el.Src2]++
+        }
+    }
+    for id := 0; id < new_ctx.LastElementId; id++ {
+        if new_ctx.Elements[id].Op == SSA_FILL && filled[id] == 0 {
+            t.Errorf("fill %v is never read", id)
+        }
+    }
+
+    checkRegisterAssignment(t, new_ctx)
+    t.Logf("after allocation:\n%v", new_ctx)
 }
 
+func TestPrecoloredRegisters(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    // a takes r1 first, so giving b r1 must move a out of the way.
+    a := ctx.LoadInt(big.NewInt(1))
+    b := ctx.LoadInt(big.NewInt(2))
+    ctx.Hint(a, 1)
+    ctx.Precolor(b, 1)
+
+    // Passing a in r2 needs a copy, which copy propagation must keep.
+    arg := ctx.Copy(a)
+    ctx.Precolor(arg, 2)
+
+    c := ctx.LoadInt(big.NewInt(3))
+    ctx.Hint(c, 5)
+
+    sum := ctx.Eval(SSA_ADD, a, b)
+    sum = ctx.Eval(SSA_ADD, sum, arg)
+    sum = ctx.Eval(SSA_ADD, sum, c)
+    ctx.Return(sum)
+
+    new_ctx := ctx.AllocateRegisters(8)
+
+    moves := 0
+    for id := 0; id < new_ctx.LastElementId; id++ {
+        el := new_ctx.Elements[id]
+
+        if el.FixedRegister != 0 && el.DstRegister != el.FixedRegister {
+            t.Errorf("element %v is in r%v, wanted r%v", id, el.DstRegister, el.FixedRegister)
+        }
+
+        switch el.Op {
+            case SSA_MOVE:
+                moves++
+            case SSA_COPY:
+                if el.DstRegister != 2 {
+                    t.Errorf("argument copy is in r%v, wanted r2", el.DstRegister)
+                }
+        }
+    }
+
+    if moves == 0 {
+        t.Errorf("no move was inserted to free r1")
+    }
+
+    if ctx.Elements[b].DstRegister != 1 {
+        t.Errorf("b is in r%v, wanted r1", ctx.Elements[b].DstRegister)
+    }
+
+    if ctx.Elements[c].DstRegister != 5 {
+        t.Errorf("hint was ignored, c is in r%v", ctx.Elements[c].DstRegister)
+    }
+
+    checkRegisterAssignment(t, new_ctx)
+    t.Logf("after allocation:\n%v", new_ctx)
+}
+
+func TestPrecoloredRegisterSpill(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    // With only r1 and r2 there is nowhere to move a to, so it is spilled
+    // to make room for b, and filled again for the add.
+    a := ctx.LoadInt(big.NewInt(1))
+    c := ctx.LoadInt(big.NewInt(3))
+    b := ctx.LoadInt(big.NewInt(2))
+    ctx.Precolor(a, 1)
+    ctx.Precolor(b, 1)
+
+    sum := ctx.Eval(SSA_ADD, b, c)
+    sum = ctx.Eval(SSA_ADD, sum, a)
+    ctx.Return(sum)
+
+    new_ctx := ctx.AllocateRegisters(3)
+
+    spills, fills := 0, 0
+    for id := 0; id < new_ctx.LastElementId; id++ {
+        el := new_ctx.Elements[id]
+        switch el.Op {
+            case SSA_SPILL:
+                spills++
+            case SSA_FILL:
+                fills++
+                if el.DstRegister != 1 {
+                    t.Errorf("precolored fill went to r%v, wanted r1", el.DstRegister)
+                }
+        }
+    }
+
+    if spills == 0 || fills == 0 {
+        t.Errorf("expected a to be spilled and filled, got %v spills and %v fills", spills, fills)
+    }
+
+    checkRegisterAssignment(t, new_ctx)
+    t.Logf("after allocation:\n%v", new_ctx)
+}
+
+func TestSpillOnOneSideOfBranch(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    then_block := ctx.NewBlock()
+    else_block := ctx.NewBlock()
+    join_block := ctx.NewBlock()
+
+    // With only three registers, the then block has to spill a or b to load
+    // x and y, and fill it again, but the else block and the join still read a
+    // and b from wherever the entry block left them when control comes through
+    // the else block.
+    a := ctx.LoadInt(big.NewInt(1))
+    b := ctx.LoadInt(big.NewInt(2))
+    ctx.Branch(a, then_block, else_block)
+
+    ctx.SetBlock(then_block)
+    x := ctx.LoadInt(big.NewInt(3))
+    y := ctx.LoadInt(big.NewInt(4))
+    z := ctx.Eval(SSA_ADD, ctx.Eval(SSA_ADD, x, y), b)
+    ctx.Pin(ctx.Eval(SSA_MUL, z, a))
+    ctx.Jump(join_block)
+
+    ctx.SetBlock(else_block)
+    ctx.Pin(ctx.Eval(SSA_SUB, a, b))
+    ctx.Jump(join_block)
+
+    ctx.SetBlock(join_block)
+    ctx.Return(ctx.Eval(SSA_ADD, a, b))
+
+    new_ctx := ctx.AllocateRegisters(4)
+
+    spilled := false
+    for _, id := range new_ctx.Blocks[then_block.Id].Elements {
+        spilled = spilled || new_ctx.Elements[id].Op == SSA_SPILL
+    }
+    if !spilled {
+        t.Errorf("expected the then block to spill")
+    }
+
+    checkRegisterAssignment(t, new_ctx)
+    t.Logf("after allocation:\n%v", new_ctx)
+}
+
+func TestSwapAcrossBackEdge(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    loop := ctx.NewBlock()
+    exit := ctx.NewBlock()
+
+    a := ctx.LoadInt(big.NewInt(1))
+    b := ctx.LoadInt(big.NewInt(2))
+    ctx.Hint(a, 1)
+    ctx.Hint(b, 2)
+    ctx.Jump(loop)
+
+    // Each precolored load moves a or b out of its way, which leaves a in r2
+    // and b in r1 at the end of the loop, the other way round from where the
+    // loop expects them.  Swapping them back is a cycle of moves.
+    ctx.SetBlock(loop)
+    for _, reg := range []int{1, 2, 4} {
+        el := ctx.LoadInt(big.NewInt(int64(10 + reg)))
+        ctx.Precolor(el, reg)
+        ctx.Pin(el)
+    }
+    ctx.Branch(ctx.Eval(SSA_LT, a, b), loop, exit)
+
+    ctx.SetBlock(exit)
+    ctx.Return(ctx.Eval(SSA_ADD, a, b))
+
+    new_ctx := ctx.AllocateRegisters(5)
+    if len(new_ctx.Blocks) != 4 {
+        t.Errorf("expected the back edge to be split, got %v blocks", len(new_ctx.Blocks))
+    }
+    checkRegisterAssignment(t, new_ctx)
+    t.Logf("after allocation:\n%v", new_ctx)
+}
+
+func TestReserve(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    ctx.LoadInt(big.NewInt(1))
+    ctx.Reserve(1000)
+
+    if cap(ctx.Elements) < 1001 || len(ctx.Elements) != 1 {
+        t.Fatalf("reserve gave len %v cap %v", len(ctx.Elements), cap(ctx.Elements))
+    }
+
+    // Writing the reserved elements must not move the stream.
+    first := &ctx.Elements[0]
+    for i := 0; i < 1000; i++ {
+        ctx.Eval(SSA_ADD, 0, 0)
+    }
+
+    if &ctx.Elements[0] != first || ctx.LastElementId != len(ctx.Elements) {
+        t.Errorf("the stream was reallocated")
+    }
+}
+
+// Builds a function of 100k elements, as a long chain of additions.
+func buildLargeFunction(ctx *SsaContext) {
+    one := ctx.LoadInt(big.NewInt(1))
+    sum := one
+
+    for i := 1; i < 100000; i++ {
+        sum = ctx.Eval(SSA_ADD, sum, one)
+    }
+}
+
+func BenchmarkWriteLargeFunction(b *testing.B) {
+    for i := 0; i < b.N; i++ {
+        ctx := new (SsaContext)
+        ctx.Init()
+        buildLargeFunction(ctx)
+    }
+}
+
+func BenchmarkWriteLargeFunctionReserved(b *testing.B) {
+    for i := 0; i < b.N; i++ {
+        ctx := new (SsaContext)
+        ctx.Init()
+        ctx.Reserve(100000)
+        buildLargeFunction(ctx)
+    }
+}
+
+func TestAllocateInPlace(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    // ((1 + 2) * (3 + 4)) needs three registers.
+    one := ctx.LoadInt(big.NewInt(1))
+    two := ctx.LoadInt(big.NewInt(2))
+    left := ctx.Eval(SSA_ADD, one, two)
+    three := ctx.LoadInt(big.NewInt(3))
+    four := ctx.LoadInt(big.NewInt(4))
+    right := ctx.Eval(SSA_ADD, three, four)
+    ctx.Return(ctx.Eval(SSA_MUL, left, right))
+
+    // There are three free registers, so nothing needs to be rewritten.
+    if new_ctx := ctx.AllocateRegisters(4); new_ctx != ctx {
+        t.Errorf("expected the allocation to be done in place")
+    }
+    for id := 0; id < ctx.LastElementId; id++ {
+        el := ctx.Elements[id]
+        if producesValue(el.Op) && el.DstRegister == 0 {
+            t.Errorf("element %v has no register", id)
+        }
+    }
+    checkRegisterAssignment(t, ctx)
+
+    // With two there must be a spill.
+    ctx = new (SsaContext)
+    ctx.Init()
+    one = ctx.LoadInt(big.NewInt(1))
+    two = ctx.LoadInt(big.NewInt(2))
+    left = ctx.Eval(SSA_ADD, one, two)
+    three = ctx.LoadInt(big.NewInt(3))
+    four = ctx.LoadInt(big.NewInt(4))
+    right = ctx.Eval(SSA_ADD, three, four)
+    ctx.Return(ctx.Eval(SSA_MUL, left, right))
+
+    new_ctx := ctx.AllocateRegisters(3)
+    if new_ctx == ctx {
+        t.Errorf("expected the stream to be rewritten")
+    }
+    checkRegisterAssignment(t, new_ctx)
+
+    // A Strahler number from the front end that is too high skips the check.
+    ctx = new (SsaContext)
+    ctx.Init()
+    ctx.Strahler = 8
+    ctx.Return(ctx.Eval(SSA_ADD, ctx.LoadInt(big.NewInt(1)), ctx.LoadInt(big.NewInt(2))))
+
+    if ctx.AllocateRegisters(4) == ctx {
+        t.Errorf("expected the Strahler number to force a rewrite")
+    }
+}
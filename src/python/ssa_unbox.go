@@ -0,0 +1,180 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the unboxing analysis.  Every Python value is an
+   object on the heap, but most of the ints and floats an arithmetic expression
+   produces are only ever used by more arithmetic.  Those never need to exist as
+   an IntObject or FloatObject at all, and code generation can keep them in
+   machine registers as raw values.  An int kept raw is still a Python int, so
+   the generated code must check for overflow and fall back to a big.Int.
+*/
+
+package python
+
+// Returns true for the arithmetic operations, which work on raw values.
+func isArithmetic(op uint) bool {
+	return op >= SSA_ADD && op <= SSA_NOT
+}
+
+// Returns true for the conversions of a number to an int or a float.
+func isConversion(op uint) bool {
+	return op == SSA_TO_INT || op == SSA_TO_FLOAT
+}
+
+// Returns true if the type is one that can be kept raw.
+func isNumericType(t uint) bool {
+	return t == SSA_TYPE_INTEGER || t == SSA_TYPE_FLOAT
+}
+
+// Works out the type of the value of each element, as far as that can be known at
+// compile time, and stores it in ValueType.  Anything that isn't known to be an int,
+// float or bool is SSA_TYPE_UNKNOWN.
+func (ctx *SsaContext) inferTypes() {
+	// Operands are always written before the elements that read them.
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+		el.ValueType = SSA_TYPE_UNKNOWN
+
+		left, right := uint(SSA_TYPE_UNKNOWN), uint(SSA_TYPE_UNKNOWN)
+		if el.ReadsElement(1) {
+			left = ctx.Elements[el.Src1].ValueType
+		}
+		if el.ReadsElement(2) {
+			right = ctx.Elements[el.Src2].ValueType
+		}
+
+		switch {
+		case el.Op == SSA_LOAD:
+			if isNumericType(el.Src1Type) {
+				el.ValueType = el.Src1Type
+			}
+
+		case el.Op == SSA_COPY || el.Op == SSA_MOVE:
+			el.ValueType = left
+
+		case isComparison(el.Op):
+			el.ValueType = SSA_TYPE_BOOL
+
+		case el.Op == SSA_NOT:
+			if left == SSA_TYPE_INTEGER {
+				el.ValueType = SSA_TYPE_INTEGER
+			}
+
+		case el.Op == SSA_TO_INT && isNumericType(left):
+			el.ValueType = SSA_TYPE_INTEGER
+
+		case el.Op == SSA_TO_FLOAT && isNumericType(left):
+			el.ValueType = SSA_TYPE_FLOAT
+
+		case isArithmetic(el.Op) && isNumericType(left) && isNumericType(right):
+			switch {
+			case el.Op == SSA_DIV:
+				// True division always gives a float.
+				el.ValueType = SSA_TYPE_FLOAT
+			case el.Op == SSA_POW:
+				// An int to a negative power is a float, which we
+				// can't tell apart at compile time.
+				if left == SSA_TYPE_FLOAT || right == SSA_TYPE_FLOAT {
+					el.ValueType = SSA_TYPE_FLOAT
+				}
+			case el.Op == SSA_AND || el.Op == SSA_OR || el.Op == SSA_XOR:
+				if left == SSA_TYPE_INTEGER && right == SSA_TYPE_INTEGER {
+					el.ValueType = SSA_TYPE_INTEGER
+				}
+			case left == SSA_TYPE_FLOAT || right == SSA_TYPE_FLOAT:
+				el.ValueType = SSA_TYPE_FLOAT
+			default:
+				el.ValueType = SSA_TYPE_INTEGER
+			}
+		}
+	}
+}
+
+// Returns true if user can read its operands as raw values.
+func (ctx *SsaContext) readsRaw(user *SsaElement) bool {
+	switch {
+	case user.Op == SSA_COPY || user.Op == SSA_MOVE:
+		// A copy of a boxed value is the box itself.
+		return user.Unboxed
+	case user.Op == SSA_NOT || isConversion(user.Op):
+		return isNumericType(ctx.Elements[user.Src1].ValueType)
+	case isArithmetic(user.Op) || isComparison(user.Op):
+		// An operation with something that isn't a number has to go
+		// through the object's methods.  One on two numbers works on raw
+		// values, even if its result has to be boxed afterwards.
+		return isNumericType(ctx.Elements[user.Src1].ValueType) &&
+			isNumericType(ctx.Elements[user.Src2].ValueType)
+	}
+
+	// Anything else, like a store, a call, or a return, hands the value to
+	// code which expects an object.
+	return false
+}
+
+// Finds the numeric elements that never escape, and sets their Unboxed flag and ValueType.
+// A value escapes if it is stored, passed to a call, returned, or used by any other
+// operation that needs an object.  Arithmetic on two numbers is done on raw machine
+// values, and only its result is boxed if it escapes.  Pinned elements are assumed to
+// escape.  Returns the number of elements tagged.
+func (ctx *SsaContext) AnalyzeUnboxing() int {
+	ctx.inferTypes()
+
+	users := make([][]int, ctx.LastElementId)
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+		if el.ReadsElement(1) {
+			users[el.Src1] = append(users[el.Src1], id)
+		}
+		if el.ReadsElement(2) && el.Src2 != el.Src1 {
+			users[el.Src2] = append(users[el.Src2], id)
+		}
+	}
+
+	// Start by assuming every number stays raw, and box anything with a
+	// user that needs an object, until nothing changes.
+	for id := 0; id < ctx.LastElementId; id++ {
+		el := ctx.Elements[id]
+		el.Unboxed = isNumericType(el.ValueType) && !el.Pinned
+	}
+
+	for changed := true; changed; {
+		changed = false
+
+		for id := 0; id < ctx.LastElementId; id++ {
+			el := ctx.Elements[id]
+			if !el.Unboxed {
+				continue
+			}
+
+			for _, user := range users[id] {
+				if !ctx.readsRaw(ctx.Elements[user]) {
+					el.Unboxed = false
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	count := 0
+	for id := 0; id < ctx.LastElementId; id++ {
+		if ctx.Elements[id].Unboxed {
+			count++
+		}
+	}
+
+	return count
+}
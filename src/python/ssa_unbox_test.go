@@ -0,0 +1,115 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the unboxing analysis.
+
+*/
+
+package python
+
+import (
+        "big"
+        "testing"
+)
+
+func TestAnalyzeUnboxing(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    one := ctx.LoadInt(big.NewInt(1))
+    half := ctx.LoadFloat(0.5)
+
+    // i and f are only used by more arithmetic, and stay raw.
+    i := ctx.Eval(SSA_ADD, one, one)
+    f := ctx.Eval(SSA_MUL, i, half)
+    q := ctx.Eval(SSA_DIV, i, one)
+
+    // A comparison of two numbers reads them raw, and gives a bool.
+    cond := ctx.Eval(SSA_LT, f, q)
+
+    // A raw copy of a value that is stored has to be boxed after all.
+    stored := ctx.Copy(q)
+    store := new(SsaElement)
+    store.Op = SSA_SET
+    store.Src1 = stored
+    store.Src2 = stored
+    ctx.Write(store)
+
+    // The result is returned, so it escapes even though its operands don't.
+    result := ctx.Eval(SSA_SUB, i, one)
+    body := ctx.NewBlock()
+    exit := ctx.NewBlock()
+    ctx.Branch(cond, body, exit)
+
+    ctx.SetBlock(body)
+    ctx.Return(result)
+
+    ctx.SetBlock(exit)
+    ctx.Return(-1)
+
+    ctx.AnalyzeUnboxing()
+
+    for _, id := range []int{one, half, i, f} {
+        if !ctx.Elements[id].Unboxed {
+            t.Errorf("element %v should be raw", id)
+        }
+    }
+
+    for _, id := range []int{q, stored, result, cond} {
+        if ctx.Elements[id].Unboxed {
+            t.Errorf("element %v escapes and should be boxed", id)
+        }
+    }
+
+    expected := map[int]uint {
+        one: SSA_TYPE_INTEGER,
+        half: SSA_TYPE_FLOAT,
+        i: SSA_TYPE_INTEGER,
+        f: SSA_TYPE_FLOAT,
+        q: SSA_TYPE_FLOAT,
+        cond: SSA_TYPE_BOOL,
+        result: SSA_TYPE_INTEGER,
+    }
+    for id, kind := range expected {
+        if ctx.Elements[id].ValueType != kind {
+            t.Errorf("element %v has type %v, wanted %v", id, ctx.Elements[id].ValueType, kind)
+        }
+    }
+}
+
+func TestUnboxingUnknownValues(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    // Adding to a string goes through the object, so neither side is raw.
+    ctx.Strings = append(ctx.Strings, "a")
+    load := new(SsaElement)
+    load.Op = SSA_LOAD
+    load.Src1Type = SSA_TYPE_STRING
+    s := ctx.Write(load)
+
+    one := ctx.LoadInt(big.NewInt(1))
+    sum := ctx.Eval(SSA_ADD, s, one)
+    ctx.Return(sum)
+
+    if count := ctx.AnalyzeUnboxing(); count != 0 {
+        t.Errorf("tagged %v elements, wanted none", count)
+    }
+
+    if ctx.Elements[sum].ValueType != SSA_TYPE_UNKNOWN {
+        t.Errorf("a string plus an int should have an unknown type")
+    }
+}
@@ -0,0 +1,890 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the x86 and x86-64 code generator, which turns an
+   allocated SsaContext into machine code with an X86Buffer.  Raw ints are kept
+   in general purpose registers and raw floats in xmm registers, and the
+   arithmetic on them is done inline.  Everything that needs an object, like
+   loading a name, boxing a raw value or adding two objects, is done by calling
+   a helper of the runtime.
+
+   Without a calling convention, the code runs with the address of a runtime
+   context in the context register.
+   The context starts with a table of the addresses of the helpers, indexed by
+   X86_HELPER_XXX, followed by X86_HELPER_ARGS words that the arguments of a
+   helper are stored in before it is called.  A helper returns its result in
+   eax, and preserves every register except eax, edx and the float scratch
+   registers.  A helper that raises an exception returns 0, and the code then
+   returns 0 at once, leaving the exception with the runtime.  Raw ints are only
+   kept on x86-64, and only when they are known to fit in 64 bits.  A target
+   with a calling convention is called and calls its helpers as functions of
+   that convention instead, see ssa_x86_abi.go.  Code for a target that
+   speculates can also return 1, when it leaves by a side exit, see
+   ssa_x86_guard.go.  The objects the code holds are handles rather than Go
+   pointers, and each call of a helper is a safepoint with a stack map, see
+   ssa_x86_safepoint.go.
+
+   The frame holds the spill slots, 8 bytes each, below the saved frame pointer,
+   then the words the side exits store the registers in, if the target
+   speculates, and below them the arguments of the calls the function makes,
+   which are passed to the call helper as an array.  See ssa_x86_frame.go.  On x86-64, raw float constants are
+   kept in a pool after the code, and loaded relative to the instruction pointer.
+*/
+
+package python
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+)
+
+// The runtime helpers, in the order of the table at the start of the runtime context.
+// The arguments are listed in the order they are stored in the argument words.
+const (
+	// (kind, index) loads constant index of ctx.Ints, ctx.Floats or ctx.Strings, where
+	// kind is SSA_TYPE_INTEGER, SSA_TYPE_FLOAT or SSA_TYPE_STRING, or None when kind is
+	// SSA_TYPE_NONE.
+	X86_HELPER_LOAD_CONST = iota
+
+	// (name) loads the value bound to ctx.Names[name].
+	X86_HELPER_LOAD_NAME
+
+	// (name, value) binds ctx.Names[name] to value, and returns something other than 0.
+	X86_HELPER_STORE_NAME
+
+	// (op, left, right) performs the SSA operation op on two objects.  op has
+	// X86_INPLACE set for an augmented assignment, which changes left in place if it
+	// can.
+	X86_HELPER_BINARY
+
+	// (op, left, right) compares two objects with the comparison op, giving a bool.
+	X86_HELPER_COMPARE
+
+	// (value) returns 1 if value is true, 0 if it isn't, and -1 if that raised.
+	X86_HELPER_TRUTH
+
+	// (raw) boxes a raw int, a raw float, which takes 8 bytes of argument words, or a
+	// raw bool, which is 0 or 1.
+	X86_HELPER_BOX_INT
+	X86_HELPER_BOX_FLOAT
+	X86_HELPER_BOX_BOOL
+
+	// (value) stores the raw value of an int or float object over its argument, or
+	// returns 0 without raising if value isn't one that fits.  Only the code of a
+	// target that speculates asks for a value that may not fit, and it takes a side
+	// exit then.
+	X86_HELPER_UNBOX_INT
+	X86_HELPER_UNBOX_FLOAT
+
+	// (callee, argc, argv) calls callee with the argc objects in the array at argv.
+	X86_HELPER_CALL
+
+	// (exit, words) records that the code is leaving by side exit number exit, with
+	// the values it stored in the words at the address words, and returns something
+	// other than 0.
+	X86_HELPER_SIDE_EXIT
+
+	// (op, value) converts value with int() or float(), for the conversion op
+	// SSA_TO_INT or SSA_TO_FLOAT.
+	X86_HELPER_CONVERT
+
+	X86_HELPER_COUNT
+)
+
+// The number of argument words in the runtime context.
+const X86_HELPER_ARGS = 4
+
+// Set on the operation X86_HELPER_BINARY is given for an augmented assignment.  It is
+// above every SSA operation.
+const X86_INPLACE = 0x100
+
+// A machine the code generator can generate code for.
+type X86Target struct {
+	X64 bool
+
+	// The general purpose registers that hold SSA registers 1 and up.  SSA register n
+	// is kept in xmm n when it holds a raw float.
+	Registers []RegisterId
+
+	// The register that holds the address of the runtime context.
+	Context RegisterId
+
+	// Two xmm registers that the code generator and the helpers may overwrite.
+	FloatScratch [2]RegisterId
+
+	// The calling convention of the code and of the helpers, or nil for the
+	// runtime's own.  Only x86-64 targets have one.
+	Convention *CallingConvention
+
+	// Set if ints that may not fit in 64 bits are kept raw too, behind guards.
+	Speculate bool
+
+	// The instruction set extensions the code may use, or nil to assume SSE2, which
+	// every x86-64 has.  Without SSE2, raw floats are kept boxed.  See cpu_x86.go.
+	Features *X86Features
+}
+
+// eax, edx and r11 are scratch registers, and ebp and esp hold the frame.
+var X86_32 = &X86Target{
+	X64:          false,
+	Registers:    []RegisterId{x86_ebx, x86_ecx, x86_edi},
+	Context:      x86_esi,
+	FloatScratch: [2]RegisterId{vec_xmm0, vec_xmm7},
+}
+
+var X86_64 = &X86Target{
+	X64: true,
+	Registers: []RegisterId{x86_ebx, x86_ecx, x86_esi, x86_edi, x64_r8, x64_r9, x64_r10,
+		x64_r12, x64_r13, x64_r14},
+	Context:      x64_r15,
+	FloatScratch: [2]RegisterId{vec_xmm0, 15},
+}
+
+// Returns the number of registers to allocate code for the target with, which
+// includes register 0.
+func (t *X86Target) NumRegisters() int {
+	return len(t.Registers) + 1
+}
+
+// How a value is kept by the generated code.
+const (
+	x86Boxed = iota
+	x86RawInt
+	x86RawFloat
+
+	// A raw 0 or 1, which is only ever the result of a comparison about to be boxed.
+	x86RawBool
+)
+
+var x86IntConditions = map[uint]uint8{
+	SSA_EQ: x86_conditionE,
+	SSA_NE: x86_conditionNE,
+	SSA_LT: x86_conditionL,
+	SSA_LE: x86_conditionLE,
+	SSA_GT: x86_conditionG,
+	SSA_GE: x86_conditionGE,
+}
+
+type x86Generator struct {
+	ctx    *SsaContext
+	target *X86Target
+	buf    *X86Buffer
+	word   int32
+
+	// The label of each block, and the labels of the code that returns 0 because
+	// a helper raised, and of the code that returns.
+	blocks     []*Label
+	fail, exit *Label
+
+	// The label of each float constant in the pool, by its index in ctx.Floats, and
+	// the indices in the order they were first used.
+	floats     map[int]*Label
+	floatOrder []int
+
+	// The length of the code, without the constant pool after it.
+	codeSize int
+
+	// The position of each SSA_ARG element in the arguments of its call, and the
+	// number of arguments of each call.
+	argIndex map[int]int
+	argCount map[int]int
+
+	// The layout of the frame.  See ssa_x86_frame.go.
+	frame *X86FrameLayout
+
+	// The registers the code writes to.  See ssa_x86_abi.go.
+	used      map[RegisterId]bool
+	usedFloat map[RegisterId]bool
+
+	// The side exits, and the element whose value is in each SSA register and spill
+	// slot so far.  See ssa_x86_guard.go.
+	exits []*x86Exit
+	holds map[int]int
+	slots map[int]int
+
+	// The stack maps of the calls of helpers so far, the call arguments stored for the
+	// next call, and the side exit whose code is being generated.  See
+	// ssa_x86_safepoint.go.
+	safepoints  []*X86Safepoint
+	pendingArgs map[int]bool
+	exiting     *x86Exit
+
+	err os.Error
+}
+
+// Records the first error.
+func (g *x86Generator) check(err os.Error) {
+	if g.err == nil {
+		g.err = err
+	}
+}
+
+// Returns how the value of el is kept.
+func (g *x86Generator) rep(el *SsaElement) int {
+	switch {
+	case !el.Unboxed:
+		return x86Boxed
+	case el.ValueType == SSA_TYPE_FLOAT && g.target.HasSSE2():
+		return x86RawFloat
+	case el.ValueType == SSA_TYPE_INTEGER && (el.SmallInt || g.target.Speculate) && g.target.X64:
+		return x86RawInt
+	}
+	return x86Boxed
+}
+
+func (g *x86Generator) gpr(reg int) RegisterId {
+	return g.target.Registers[reg-1]
+}
+
+func (g *x86Generator) xmm(reg int) RegisterId {
+	return RegisterId(reg)
+}
+
+func (g *x86Generator) helperOffset(h int) int32 {
+	return g.word * int32(h)
+}
+
+func (g *x86Generator) argOffset(i int) int32 {
+	return g.word * int32(X86_HELPER_COUNT+i)
+}
+
+// Word sized moves, which are 64-bit on x86-64.
+
+func (g *x86Generator) movRR(src, dst RegisterId) {
+	if g.target.X64 {
+		g.buf.MovqRR(src, dst)
+	} else {
+		g.buf.MovlRR(src, dst)
+	}
+}
+
+func (g *x86Generator) movMR(offset int32, base, dst RegisterId) {
+	if g.target.X64 {
+		g.buf.MovqMR(offset, base, dst)
+	} else {
+		g.buf.MovlMR(offset, base, dst)
+	}
+}
+
+func (g *x86Generator) movRM(src RegisterId, offset int32, base RegisterId) {
+	if g.target.X64 {
+		g.buf.MovqRM(src, offset, base)
+	} else {
+		g.buf.MovlRM(src, offset, base)
+	}
+}
+
+// Stores imm in argument word i.
+func (g *x86Generator) setArg(i int, imm int) {
+	if g.target.X64 {
+		g.buf.MovqIM(int32(imm), g.argOffset(i), g.target.Context)
+	} else {
+		g.buf.MovlIM(int32(imm), g.argOffset(i), g.target.Context)
+	}
+}
+
+// Stores reg in argument word i.
+func (g *x86Generator) setArgReg(i int, reg RegisterId) {
+	g.movRM(reg, g.argOffset(i), g.target.Context)
+}
+
+// Calls the helper h, and returns 0 from the function if it raised.
+func (g *x86Generator) call(h int) {
+	g.invoke(h)
+	g.buf.TestlRR(x86_eax, x86_eax)
+	g.check(g.buf.JccTo(x86_conditionE, g.fail))
+}
+
+// Returns the register holding the boxed value of src, which is in the SSA register
+// reg, boxing it into eax if it is raw.
+func (g *x86Generator) boxed(src *SsaElement, reg int) RegisterId {
+	switch g.rep(src) {
+	case x86RawInt:
+		g.setArgReg(0, g.gpr(reg))
+		g.call(X86_HELPER_BOX_INT)
+	case x86RawFloat:
+		g.buf.MovsdRM(g.xmm(reg), g.argOffset(0), g.target.Context)
+		g.call(X86_HELPER_BOX_FLOAT)
+	default:
+		return g.gpr(reg)
+	}
+	return x86_eax
+}
+
+// Returns the xmm register holding the value of src, which is in the SSA register reg,
+// converting it into scratch if it is a raw int.
+func (g *x86Generator) float(src *SsaElement, reg int, scratch RegisterId) RegisterId {
+	if g.rep(src) == x86RawInt {
+		g.buf.Cvtsi2sdqRR(g.gpr(reg), scratch)
+		return scratch
+	}
+	return g.xmm(reg)
+}
+
+// Moves the result of el, which is kept as have in eax or the first float scratch
+// register, into its register, converting it to the way el is kept.
+func (g *x86Generator) result(el *SsaElement, have int) {
+	if el.DstRegister == 0 {
+		return
+	}
+
+	scratch := g.target.FloatScratch[0]
+	want := g.rep(el)
+	switch {
+	case have == want && have == x86RawFloat:
+		g.buf.MovsdRR(scratch, g.xmm(el.DstRegister))
+		return
+	case have == want:
+		g.movRR(x86_eax, g.gpr(el.DstRegister))
+		return
+	case have == x86RawInt && want == x86RawFloat:
+		g.buf.Cvtsi2sdqRR(x86_eax, g.xmm(el.DstRegister))
+		return
+
+	case want == x86Boxed:
+		switch have {
+		case x86RawFloat:
+			g.buf.MovsdRM(scratch, g.argOffset(0), g.target.Context)
+			g.call(X86_HELPER_BOX_FLOAT)
+		case x86RawBool:
+			g.setArgReg(0, x86_eax)
+			g.call(X86_HELPER_BOX_BOOL)
+		default:
+			g.setArgReg(0, x86_eax)
+			g.call(X86_HELPER_BOX_INT)
+		}
+		g.movRR(x86_eax, g.gpr(el.DstRegister))
+		return
+
+	case have == x86Boxed && want == x86RawInt && g.speculative(el):
+		g.setArgReg(0, x86_eax)
+		g.invoke(X86_HELPER_UNBOX_INT)
+		g.buf.TestlRR(x86_eax, x86_eax)
+		g.guard(x86_conditionE, el, true, "not an int that fits in 64 bits")
+		g.movMR(g.argOffset(0), g.target.Context, g.gpr(el.DstRegister))
+		return
+
+	case have == x86Boxed && want == x86RawInt:
+		g.setArgReg(0, x86_eax)
+		g.call(X86_HELPER_UNBOX_INT)
+		g.movMR(g.argOffset(0), g.target.Context, g.gpr(el.DstRegister))
+		return
+
+	case have == x86Boxed && want == x86RawFloat:
+		g.setArgReg(0, x86_eax)
+		g.call(X86_HELPER_UNBOX_FLOAT)
+		g.buf.MovsdMR(g.argOffset(0), g.target.Context, g.xmm(el.DstRegister))
+		return
+	}
+
+	g.check(os.NewError(fmt.Sprintf("x86: can't keep the result of element %v raw", el.Address)))
+}
+
+// Calls the helper h with the SSA operation op and the boxed operands of el.
+func (g *x86Generator) helperOp(h int, op uint, el *SsaElement) {
+	left, right := g.ctx.Elements[el.Src1], g.ctx.Elements[el.Src2]
+
+	// Boxing uses the first argument word, so the operation is stored last.
+	g.setArgReg(1, g.boxed(left, el.Src1Register))
+	g.setArgReg(2, g.boxed(right, el.Src2Register))
+	g.setArg(0, int(op))
+	g.call(h)
+}
+
+// Returns true if both operands of el are raw, and at least one of them is raw with rep.
+func (g *x86Generator) rawOperands(el *SsaElement, rep int) bool {
+	l, r := g.rep(g.ctx.Elements[el.Src1]), g.rep(g.ctx.Elements[el.Src2])
+	return l != x86Boxed && r != x86Boxed && (l == rep || r == rep)
+}
+
+func (g *x86Generator) arithmetic(el *SsaElement) {
+	left, right := g.ctx.Elements[el.Src1], g.ctx.Elements[el.Src2]
+	l, r := g.rep(left), g.rep(right)
+
+	switch {
+	case l == x86RawInt && r == x86RawInt && (el.SmallInt || g.target.Speculate) && isArithmetic(el.Op) &&
+		el.Op != SSA_DIV && el.Op != SSA_MOD && el.Op != SSA_POW:
+		// Unless the result is known to fit, an overflow takes a side exit.
+		g.movRR(g.gpr(el.Src1Register), x86_eax)
+		src := g.gpr(el.Src2Register)
+		switch el.Op {
+		case SSA_ADD:
+			g.buf.AddqRR(src, x86_eax)
+		case SSA_SUB:
+			g.buf.SubqRR(src, x86_eax)
+		case SSA_MUL:
+			g.buf.ImulqRR(src, x86_eax)
+		case SSA_AND:
+			g.buf.AndqRR(src, x86_eax)
+		case SSA_OR:
+			g.buf.OrqRR(src, x86_eax)
+		case SSA_XOR:
+			g.buf.XorqRR(src, x86_eax)
+		case SSA_NOT:
+			g.buf.NotqR(x86_eax)
+		}
+		if !el.SmallInt && (el.Op == SSA_ADD || el.Op == SSA_SUB || el.Op == SSA_MUL) {
+			g.guard(x86_conditionO, el, false, "int overflow")
+		}
+		g.result(el, x86RawInt)
+
+	case (g.rawOperands(el, x86RawFloat) || g.rawOperands(el, x86RawInt) && el.Op == SSA_DIV) &&
+		el.Op >= SSA_ADD && el.Op <= SSA_DIV:
+		a, b := g.target.FloatScratch[0], g.target.FloatScratch[1]
+		if src := g.float(left, el.Src1Register, a); src != a {
+			g.buf.MovsdRR(src, a)
+		}
+		src := g.float(right, el.Src2Register, b)
+		switch el.Op {
+		case SSA_ADD:
+			g.buf.AddsdRR(src, a)
+		case SSA_SUB:
+			g.buf.SubsdRR(src, a)
+		case SSA_MUL:
+			g.buf.MulsdRR(src, a)
+		case SSA_DIV:
+			g.buf.DivsdRR(src, a)
+		}
+		g.result(el, x86RawFloat)
+
+	default:
+		op := el.Op
+		if el.InPlace {
+			op |= X86_INPLACE
+		}
+		g.helperOp(X86_HELPER_BINARY, op, el)
+		g.result(el, x86Boxed)
+	}
+}
+
+// Compares the raw float operands of el with the comparison op, and returns the condition
+// that holds if the comparison does.  A comparison with a NaN is unordered, which sets
+// the parity flag, and only != holds then, which the condition doesn't account for.
+// The flags are those of an unsigned comparison, so < and <= are done as > and >= the
+// other way round, which are false when unordered.
+func (g *x86Generator) compareFloats(op uint, el *SsaElement) uint8 {
+	a := g.float(g.ctx.Elements[el.Src1], el.Src1Register, g.target.FloatScratch[0])
+	b := g.float(g.ctx.Elements[el.Src2], el.Src2Register, g.target.FloatScratch[1])
+	switch op {
+	case SSA_LT:
+		g.buf.UcomisdRR(a, b)
+		return x86_conditionA
+	case SSA_LE:
+		g.buf.UcomisdRR(a, b)
+		return x86_conditionAE
+	case SSA_GT:
+		g.buf.UcomisdRR(b, a)
+		return x86_conditionA
+	case SSA_GE:
+		g.buf.UcomisdRR(b, a)
+		return x86_conditionAE
+	}
+	g.buf.UcomisdRR(b, a)
+	return x86IntConditions[op]
+}
+
+// Jumps to target if the comparison op of the raw operands of el holds.
+func (g *x86Generator) compare(op uint, el *SsaElement, target *Label) {
+	left, right := g.ctx.Elements[el.Src1], g.ctx.Elements[el.Src2]
+	if g.rep(left) == x86RawInt && g.rep(right) == x86RawInt {
+		g.buf.CmpqRR(g.gpr(el.Src2Register), g.gpr(el.Src1Register))
+		g.check(g.buf.JccTo(x86IntConditions[op], target))
+		return
+	}
+
+	cond := g.compareFloats(op, el)
+	switch op {
+	case SSA_EQ:
+		skip := new(Label)
+		g.check(g.buf.JccShortTo(x86_conditionP, skip))
+		g.check(g.buf.JccTo(cond, target))
+		g.check(g.buf.Bind(skip))
+	case SSA_NE:
+		g.check(g.buf.JccTo(x86_conditionP, target))
+		g.check(g.buf.JccTo(cond, target))
+	default:
+		g.check(g.buf.JccTo(cond, target))
+	}
+}
+
+// Sets eax to 1 if the comparison of the raw operands of el holds, and to 0 if it
+// doesn't, without branching.  Moves don't change the flags, so the value an unordered
+// float comparison gives is loaded into edx after the comparison, and replaces the
+// result if the parity flag is set.
+func (g *x86Generator) comparison(el *SsaElement) {
+	if !g.rawOperands(el, x86RawInt) && !g.rawOperands(el, x86RawFloat) {
+		g.helperOp(X86_HELPER_COMPARE, el.Op, el)
+		g.result(el, x86Boxed)
+		return
+	}
+
+	left, right := g.ctx.Elements[el.Src1], g.ctx.Elements[el.Src2]
+	if g.rep(left) == x86RawInt && g.rep(right) == x86RawInt {
+		g.buf.CmpqRR(g.gpr(el.Src2Register), g.gpr(el.Src1Register))
+		g.buf.Setcc(x86IntConditions[el.Op], x86_eax)
+		g.buf.MovzblRR(x86_eax, x86_eax)
+		g.result(el, x86RawBool)
+		return
+	}
+
+	g.buf.Setcc(g.compareFloats(el.Op, el), x86_eax)
+	g.buf.MovzblRR(x86_eax, x86_eax)
+	switch el.Op {
+	case SSA_EQ:
+		g.buf.MovlIR(0, x86_edx)
+		g.buf.Cmovcc(x86_conditionP, x86_edx, x86_eax)
+	case SSA_NE:
+		g.buf.MovlIR(1, x86_edx)
+		g.buf.Cmovcc(x86_conditionP, x86_edx, x86_eax)
+	}
+	g.result(el, x86RawBool)
+}
+
+// Jumps to target if the object in reg is true.
+func (g *x86Generator) truth(reg RegisterId, target *Label) {
+	g.setArgReg(0, reg)
+	g.invoke(X86_HELPER_TRUTH)
+	g.buf.TestlRR(x86_eax, x86_eax)
+	g.check(g.buf.JccTo(x86_conditionS, g.fail))
+	g.check(g.buf.JccTo(x86_conditionNE, target))
+}
+
+// Jumps to b, unless it comes next.
+func (g *x86Generator) jump(b *BasicBlock, next int) {
+	if b.Id != next {
+		g.check(g.buf.JmpTo(g.blocks[b.Id]))
+	}
+}
+
+func (g *x86Generator) branch(el *SsaElement, next int) {
+	b := g.ctx.Blocks[el.Block]
+	if_true, if_false := b.Succs[0], b.Succs[1]
+
+	switch {
+	case el.Cond == 0:
+		g.truth(g.boxed(g.ctx.Elements[el.Src1], el.Src1Register), g.blocks[if_true.Id])
+	case g.rawOperands(el, x86RawInt) || g.rawOperands(el, x86RawFloat):
+		g.compare(el.Cond, el, g.blocks[if_true.Id])
+	default:
+		g.helperOp(X86_HELPER_COMPARE, el.Cond, el)
+		g.truth(x86_eax, g.blocks[if_true.Id])
+	}
+
+	g.jump(if_false, next)
+}
+
+func (g *x86Generator) load(el *SsaElement) {
+	rep := g.rep(el)
+	switch {
+	case el.Src1Type == SSA_TYPE_NAME:
+		g.setArg(0, el.Src1)
+		g.call(X86_HELPER_LOAD_NAME)
+		g.result(el, x86Boxed)
+		return
+
+	case el.DstRegister == 0:
+		return
+
+	case rep == x86RawInt && fitsRaw(g.ctx.Ints[el.Src1]):
+		g.buf.MovqIR(g.ctx.Ints[el.Src1].Int64(), g.gpr(el.DstRegister))
+		return
+
+	case rep == x86RawFloat:
+		if g.target.X64 {
+			g.check(g.buf.MovsdPR(g.floatConstant(el.Src1), g.xmm(el.DstRegister)))
+			return
+		}
+		bits := math.Float64bits(g.ctx.Floats[el.Src1])
+		g.buf.MovlIM(int32(bits), g.argOffset(0), g.target.Context)
+		g.buf.MovlIM(int32(bits>>32), g.argOffset(0)+4, g.target.Context)
+		g.buf.MovsdMR(g.argOffset(0), g.target.Context, g.xmm(el.DstRegister))
+		return
+	}
+
+	g.setArg(0, int(el.Src1Type))
+	g.setArg(1, el.Src1)
+	g.call(X86_HELPER_LOAD_CONST)
+	g.result(el, x86Boxed)
+}
+
+// Returns the label of the float constant ctx.Floats[idx] in the pool.
+func (g *x86Generator) floatConstant(idx int) *Label {
+	l, present := g.floats[idx]
+	if !present {
+		l = new(Label)
+		g.floats[idx] = l
+		g.floatOrder = append(g.floatOrder, idx)
+	}
+	return l
+}
+
+// Places the float constants after the code.
+func (g *x86Generator) constantPool() {
+	if len(g.floatOrder) == 0 {
+		return
+	}
+
+	g.buf.Align(8)
+	for _, idx := range g.floatOrder {
+		g.check(g.buf.Bind(g.floats[idx]))
+		g.buf.Quad(math.Float64bits(g.ctx.Floats[idx]))
+	}
+}
+
+// Converts the operand of el to an int or a float.  A raw float that doesn't fit in 64
+// bits, or is a NaN or an infinity, truncates to the smallest int, and is converted by
+// the helper instead, which raises for the ones that aren't numbers.
+func (g *x86Generator) convert(el *SsaElement) {
+	src := g.ctx.Elements[el.Src1]
+	have := g.rep(src)
+	switch {
+	case el.Op == SSA_TO_FLOAT && have == x86RawFloat:
+		g.buf.MovsdRR(g.xmm(el.Src1Register), g.target.FloatScratch[0])
+		g.result(el, x86RawFloat)
+		return
+
+	case el.Op == SSA_TO_FLOAT && have == x86RawInt:
+		g.buf.Cvtsi2sdqRR(g.gpr(el.Src1Register), g.target.FloatScratch[0])
+		g.result(el, x86RawFloat)
+		return
+
+	case el.Op == SSA_TO_INT && have == x86RawInt:
+		g.movRR(g.gpr(el.Src1Register), x86_eax)
+		g.result(el, x86RawInt)
+		return
+
+	case el.Op == SSA_TO_INT && have == x86RawFloat && g.target.X64:
+		// Only the smallest int overflows when 1 is subtracted from it.
+		slow, done := new(Label), new(Label)
+		g.buf.Cvttsd2siqRR(g.xmm(el.Src1Register), x86_eax)
+		g.buf.CmpqIR(1, x86_eax)
+		g.check(g.buf.JccTo(x86_conditionO, slow))
+		g.result(el, x86RawInt)
+		g.check(g.buf.JmpTo(done))
+
+		g.check(g.buf.Bind(slow))
+		g.setArgReg(1, g.boxed(src, el.Src1Register))
+		g.setArg(0, int(el.Op))
+		g.call(X86_HELPER_CONVERT)
+		g.result(el, x86Boxed)
+		g.check(g.buf.Bind(done))
+		return
+	}
+
+	g.setArgReg(1, g.boxed(src, el.Src1Register))
+	g.setArg(0, int(el.Op))
+	g.call(X86_HELPER_CONVERT)
+	g.result(el, x86Boxed)
+}
+
+// Copies or moves the value of the element the operand of el refers to.
+func (g *x86Generator) copy(el *SsaElement) {
+	src := g.ctx.Elements[el.Src1]
+	have := g.rep(src)
+	if have == x86RawFloat {
+		g.buf.MovsdRR(g.xmm(el.Src1Register), g.target.FloatScratch[0])
+	} else {
+		g.movRR(g.gpr(el.Src1Register), x86_eax)
+	}
+	g.result(el, have)
+}
+
+func (g *x86Generator) element(el *SsaElement, next int) {
+	switch {
+	case el.Op == SSA_NOP:
+
+	case el.Op == SSA_LOAD:
+		g.load(el)
+
+	case el.Op == SSA_STORE:
+		g.setArgReg(1, g.boxed(g.ctx.Elements[el.Src1], el.Src1Register))
+		g.setArg(0, el.Src2)
+		g.call(X86_HELPER_STORE_NAME)
+
+	case el.Op == SSA_SPILL:
+		if g.rep(el) == x86RawFloat {
+			g.buf.MovsdRM(g.xmm(el.DstRegister), g.frame.SpillOffset(el.Src1), x86_ebp)
+		} else {
+			g.movRM(g.gpr(el.DstRegister), g.frame.SpillOffset(el.Src1), x86_ebp)
+		}
+
+	case el.Op == SSA_FILL:
+		if g.rep(el) == x86RawFloat {
+			g.buf.MovsdMR(g.frame.SpillOffset(el.Src1), x86_ebp, g.xmm(el.DstRegister))
+		} else {
+			g.movMR(g.frame.SpillOffset(el.Src1), x86_ebp, g.gpr(el.DstRegister))
+		}
+
+	case el.Op == SSA_COPY || el.Op == SSA_MOVE:
+		g.copy(el)
+
+	case el.Op == SSA_ARG:
+		reg := g.boxed(g.ctx.Elements[el.Src1], el.Src1Register)
+		g.movRM(reg, g.frame.ArgOffset(g.argIndex[el.Address]), x86_ebp)
+		g.pendingArgs[g.argIndex[el.Address]] = true
+
+	case el.Op == SSA_CALL:
+		g.setArgReg(0, g.boxed(g.ctx.Elements[el.Src1], el.Src1Register))
+		g.setArg(1, g.argCount[el.Address])
+		if g.target.X64 {
+			g.buf.LeaqMR(g.frame.ArgOffset(0), x86_ebp, x86_eax)
+		} else {
+			g.buf.LealMR(g.frame.ArgOffset(0), x86_ebp, x86_eax)
+		}
+		g.setArgReg(2, x86_eax)
+		g.call(X86_HELPER_CALL)
+		g.pendingArgs = make(map[int]bool)
+		g.result(el, x86Boxed)
+
+	case isComparison(el.Op):
+		g.comparison(el)
+
+	case isConversion(el.Op):
+		g.convert(el)
+
+	case el.Op > SSA_ALU_MARK && el.Op < SSA_EQ:
+		g.arithmetic(el)
+
+	case el.Op == SSA_JUMP:
+		g.jump(g.ctx.Blocks[el.Src1], next)
+
+	case el.Op == SSA_BRANCH:
+		g.branch(el, next)
+
+	case el.Op == SSA_RETURN:
+		if el.Src1Type == SSA_TYPE_NONE {
+			g.setArg(0, SSA_TYPE_NONE)
+			g.setArg(1, 0)
+			g.call(X86_HELPER_LOAD_CONST)
+		} else if reg := g.boxed(g.ctx.Elements[el.Src1], el.Src1Register); reg != x86_eax {
+			g.movRR(reg, x86_eax)
+		}
+		g.check(g.buf.JmpTo(g.exit))
+
+	default:
+		g.check(os.NewError(fmt.Sprintf("x86: element %v has an unknown operation %v", el.Address, el.Op)))
+	}
+}
+
+// Checks that every register the code uses exists on the target, finds the registers
+// it writes to, and works out where the arguments of each call go.
+func (g *x86Generator) prepare() {
+	max_reg := len(g.target.Registers)
+	max_args := 0
+
+	for _, b := range g.ctx.Blocks {
+		for _, id := range b.Elements {
+			el := g.ctx.Elements[id]
+			for _, reg := range []int{el.DstRegister, el.Src1Register, el.Src2Register} {
+				if reg > max_reg || g.rep(el) == x86RawFloat && RegisterId(reg) >= g.target.FloatScratch[1] {
+					g.check(os.NewError(fmt.Sprintf("x86: element %v uses r%v, which the target doesn't have", id, reg)))
+				}
+			}
+
+			switch {
+			case el.DstRegister == 0 || el.DstRegister > max_reg:
+			case g.rep(el) == x86RawFloat:
+				g.usedFloat[g.xmm(el.DstRegister)] = true
+			default:
+				g.used[g.gpr(el.DstRegister)] = true
+			}
+
+			if el.Op != SSA_CALL {
+				continue
+			}
+
+			n := len(g.ctx.CallArgs(id))
+			g.argCount[id] = n
+			for arg, i := el, n-1; arg.ReadsElement(2); i-- {
+				arg = g.ctx.Elements[arg.Src2]
+				g.argIndex[arg.Address] = i
+			}
+			if n > max_args {
+				max_args = n
+			}
+		}
+	}
+
+	g.layoutFrame(max_args)
+}
+
+// Generates the machine code of the function in ctx, whose registers must have been
+// allocated for the target.  Code with side exits needs GenerateX86Exits instead.
+func (ctx *SsaContext) GenerateX86(target *X86Target) ([]byte, os.Error) {
+	g, err := ctx.generateX86(target)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.exits) > 0 {
+		return nil, os.NewError("x86: the code has side exits, which only GenerateX86Exits describes")
+	}
+	return g.buf.Bytes(), nil
+}
+
+func (ctx *SsaContext) generateX86(target *X86Target) (*x86Generator, os.Error) {
+	g := &x86Generator{ctx: ctx, target: target, word: 4}
+	if target.X64 {
+		g.word = 8
+	}
+	g.buf = &X86Buffer{Buffer: new(bytes.Buffer), IsX64: target.X64}
+	g.fail, g.exit = new(Label), new(Label)
+	g.argIndex = make(map[int]int)
+	g.argCount = make(map[int]int)
+	g.used = make(map[RegisterId]bool)
+	g.floats = make(map[int]*Label)
+	g.usedFloat = make(map[RegisterId]bool)
+	g.holds = make(map[int]int)
+	g.slots = make(map[int]int)
+	g.pendingArgs = make(map[int]bool)
+
+	if target.Convention != nil && !target.X64 {
+		return nil, os.NewError("x86: calling conventions are only supported on x86-64")
+	}
+
+	g.prepare()
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	g.blocks = make([]*Label, len(ctx.Blocks))
+	for i := range g.blocks {
+		g.blocks[i] = new(Label)
+	}
+
+	g.prologue()
+	for i, b := range ctx.Blocks {
+		g.check(g.buf.Bind(g.blocks[b.Id]))
+		for _, id := range b.Elements {
+			g.element(ctx.Elements[id], i+1)
+			g.record(ctx.Elements[id])
+		}
+	}
+
+	g.check(g.buf.Bind(g.fail))
+	g.buf.XorlRR(x86_eax, x86_eax)
+	g.check(g.buf.Bind(g.exit))
+	g.frame.Epilogue(g.buf)
+	g.sideExits()
+	g.codeSize = g.buf.Len()
+	g.constantPool()
+
+	if g.err != nil {
+		return nil, g.err
+	}
+	return g, nil
+}
@@ -0,0 +1,196 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the calling conventions of x86-64, so that the code
+   generated for a function can be called from Go through a trampoline, and can
+   call helpers written in Go the same way.  Linux and macOS use the System V
+   convention, and Windows has its own.
+
+   A function generated for a convention takes the address of the runtime
+   context as its only argument, and returns its result like any function of
+   the convention.  The helpers are called the same way, with the address of the
+   runtime context as their only argument, and the other arguments are still
+   passed in the argument words of the context.  Any register the code uses that
+   the convention lets a helper overwrite is saved in the frame around each call
+   of a helper, and any register the convention says the code must preserve is
+   saved by the prologue and restored by the epilogue.
+
+   The frame below the saved frame pointer then holds, from the top down, the
+   general purpose registers pushed by the prologue, the xmm registers it saves,
+   the registers saved around helper calls, the spill slots, the arguments of
+   calls and the shadow space a Windows callee may write its register arguments
+   to.  The generator picks the registers, and X86FrameLayout places them.
+*/
+
+package python
+
+// How arguments are passed, and which registers are preserved, by the functions of a
+// platform.
+type CallingConvention struct {
+	Name string
+
+	// The registers that pass the first arguments, in order, and the register that
+	// holds an int or pointer result.
+	IntArgs   []RegisterId
+	FloatArgs []RegisterId
+	Return    RegisterId
+
+	// The registers a function must preserve for its caller.  A function may
+	// overwrite any other register.
+	CalleeSaved      []RegisterId
+	CalleeSavedFloat []RegisterId
+
+	// The alignment of the stack pointer at a call, and the space a caller must
+	// leave above the return address for the callee to save its register arguments.
+	StackAlign  int32
+	ShadowSpace int32
+}
+
+var SysVConvention = &CallingConvention{
+	Name:        "sysv",
+	IntArgs:     []RegisterId{x86_edi, x86_esi, x86_edx, x86_ecx, x64_r8, x64_r9},
+	FloatArgs:   []RegisterId{vec_xmm0, vec_xmm1, vec_xmm2, vec_xmm3, vec_xmm4, vec_xmm5, vec_xmm6, vec_xmm7},
+	Return:      x86_eax,
+	CalleeSaved: []RegisterId{x86_ebx, x86_ebp, x64_r12, x64_r13, x64_r14, x64_r15},
+	StackAlign:  16,
+}
+
+var WindowsConvention = &CallingConvention{
+	Name:      "windows",
+	IntArgs:   []RegisterId{x86_ecx, x86_edx, x64_r8, x64_r9},
+	FloatArgs: []RegisterId{vec_xmm0, vec_xmm1, vec_xmm2, vec_xmm3},
+	Return:    x86_eax,
+	CalleeSaved: []RegisterId{x86_ebx, x86_ebp, x86_edi, x86_esi, x64_r12, x64_r13, x64_r14,
+		x64_r15},
+	CalleeSavedFloat: []RegisterId{vec_xmm6, vec_xmm7, 8, 9, 10, 11, 12, 13, 14, 15},
+	StackAlign:       16,
+	ShadowSpace:      32,
+}
+
+// Returns the convention of the operating system goos, as named by runtime.GOOS.
+func ConventionFor(goos string) *CallingConvention {
+	if goos == "windows" {
+		return WindowsConvention
+	}
+	return SysVConvention
+}
+
+func registerIn(reg RegisterId, regs []RegisterId) bool {
+	for _, r := range regs {
+		if r == reg {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of the target whose code follows cc.
+func (t *X86Target) WithConvention(cc *CallingConvention) *X86Target {
+	c := *t
+	c.Convention = cc
+	return &c
+}
+
+// Works out which registers have to be saved, and lays out the frame.
+func (g *x86Generator) layoutFrame(max_args int) {
+	f := &X86FrameLayout{X64: g.target.X64, Spills: g.ctx.SpillRoomNeeded, Args: max_args}
+	g.frame = f
+
+	// The side exits of a target that speculates store the registers below the
+	// spill slots.
+	if g.target.Speculate {
+		f.ExitWords = len(g.target.Registers)
+	}
+
+	cc := g.target.Convention
+	if cc == nil {
+		f.Layout()
+		return
+	}
+
+	// The context register belongs to the caller too.
+	used := make(map[RegisterId]bool)
+	used[g.target.Context] = true
+	for reg := range g.used {
+		used[reg] = true
+	}
+
+	// The registers are visited in a fixed order, so the code is the same every
+	// time.
+	regs := make([]RegisterId, 0, len(g.target.Registers)+1)
+	regs = append(regs, g.target.Registers...)
+	for _, reg := range append(regs, g.target.Context) {
+		switch {
+		case !used[reg]:
+		case registerIn(reg, cc.CalleeSaved):
+			f.Pushed = append(f.Pushed, reg)
+		case reg != g.target.Context:
+			f.CallSaved = append(f.CallSaved, reg)
+		}
+	}
+
+	// The float scratch registers are written to by any float operation.
+	for reg := RegisterId(0); reg < 16; reg++ {
+		scratch := reg == g.target.FloatScratch[0] || reg == g.target.FloatScratch[1]
+		switch {
+		case registerIn(reg, cc.CalleeSavedFloat) && (scratch || g.usedFloat[reg]):
+			f.SavedFloat = append(f.SavedFloat, reg)
+		case g.usedFloat[reg] && !scratch:
+			f.CallSavedFloat = append(f.CallSavedFloat, reg)
+		}
+	}
+
+	f.Shadow = cc.ShadowSpace
+	f.Layout()
+}
+
+// Sets up the frame, saves the registers the convention says to, and takes the context
+// from the first argument.
+func (g *x86Generator) prologue() {
+	g.frame.Prologue(g.buf)
+	if cc := g.target.Convention; cc != nil {
+		g.movRR(cc.IntArgs[0], g.target.Context)
+	}
+}
+
+// Calls the helper h, saving the registers it may overwrite if there is a convention.
+func (g *x86Generator) invoke(h int) {
+	cc := g.target.Convention
+	if cc == nil {
+		g.buf.CallM(g.helperOffset(h), g.target.Context)
+		g.safepoint(h)
+		return
+	}
+
+	f := g.frame
+	for i, reg := range f.CallSaved {
+		g.movRM(reg, f.CallSaveOffset(i), x86_ebp)
+	}
+	for i, reg := range f.CallSavedFloat {
+		g.buf.MovsdRM(reg, f.CallSaveOffset(len(f.CallSaved)+i), x86_ebp)
+	}
+
+	g.movRR(g.target.Context, cc.IntArgs[0])
+	g.buf.CallM(g.helperOffset(h), g.target.Context)
+	g.safepoint(h)
+
+	for i, reg := range f.CallSaved {
+		g.movMR(f.CallSaveOffset(i), x86_ebp, reg)
+	}
+	for i, reg := range f.CallSavedFloat {
+		g.buf.MovsdMR(f.CallSaveOffset(len(f.CallSaved)+i), x86_ebp, reg)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the layout of the stack frame of the generated code.
+   The code generator says what the frame has to hold: the registers the
+   calling convention makes it save, the spill slots the allocator asked for,
+   the words the side exits store the registers in, and the arguments of the
+   calls the function makes.  The layout gives each of them an offset from the
+   frame pointer, and generates the prologue that sets the frame up and the
+   epilogue that takes it down.
+
+   From the saved frame pointer down, the frame holds the general purpose
+   registers pushed by the prologue, the xmm registers it saves, 16 bytes
+   each, the registers saved around calls of helpers, the spill slots and the
+   exit words, 8 bytes each, the call arguments, a word each, and the shadow
+   space a Windows callee may write its register arguments to.  The return
+   address and the frame pointer leave the stack aligned to 16 bytes, and the
+   frame keeps it that way.
+*/
+
+package python
+
+// The stack frame of a function of generated code.  The fields say what the frame
+// holds, and Layout works out where.
+type X86FrameLayout struct {
+	X64 bool
+
+	// The general purpose registers the prologue pushes, and the xmm registers it
+	// saves, which the epilogue restores.
+	Pushed     []RegisterId
+	SavedFloat []RegisterId
+
+	// The registers saved around each call of a helper.
+	CallSaved      []RegisterId
+	CallSavedFloat []RegisterId
+
+	// The number of spill slots, exit words and call arguments, and the bytes of
+	// shadow space below them.
+	Spills    int
+	ExitWords int
+	Args      int
+	Shadow    int32
+
+	floatBase, callBase, spillBase, exitBase, argBase int32
+
+	// How far the stack pointer is below the pushed registers.
+	size int32
+}
+
+// Returns the size of a word, which is what a call argument takes.
+func (f *X86FrameLayout) word() int32 {
+	if f.X64 {
+		return 8
+	}
+	return 4
+}
+
+// Works out the offsets of everything in the frame.  Must be called again if the
+// fields change.
+func (f *X86FrameLayout) Layout() {
+	top := f.word() * int32(len(f.Pushed))
+	f.floatBase = -top
+	f.callBase = f.floatBase - 16*int32(len(f.SavedFloat))
+	f.spillBase = f.callBase - 8*int32(len(f.CallSaved)+len(f.CallSavedFloat))
+	f.exitBase = f.spillBase - 8*int32(f.Spills+f.ExitWords)
+	f.argBase = f.exitBase - f.word()*int32(f.Args)
+	f.size = (-f.argBase+f.Shadow+15)&^15 - top
+}
+
+// Returns the number of bytes the prologue moves the stack pointer by, below the
+// registers it pushes.
+func (f *X86FrameLayout) Size() int32 {
+	return f.size
+}
+
+// Returns the offset from the frame pointer of the spill slot slot.
+func (f *X86FrameLayout) SpillOffset(slot int) int32 {
+	return f.spillBase - 8*int32(slot+1)
+}
+
+// Returns the offset of the exit word word.  The words go up from ExitOffset(0), below
+// the spill slots, which are exit words too.
+func (f *X86FrameLayout) ExitOffset(word int) int32 {
+	return f.exitBase + 8*int32(word)
+}
+
+// Returns the index of the exit word at offset, which is how a side exit refers to the
+// spill slots too.
+func (f *X86FrameLayout) ExitWord(offset int32) int {
+	return int(offset-f.exitBase) / 8
+}
+
+// Returns the offset of call argument i.  The arguments go up from ArgOffset(0), so that
+// they are an array.
+func (f *X86FrameLayout) ArgOffset(i int) int32 {
+	return f.argBase + f.word()*int32(i)
+}
+
+// Returns the offset of the save slot of the register saved around calls with index i,
+// counting the general purpose registers and then the xmm registers.
+func (f *X86FrameLayout) CallSaveOffset(i int) int32 {
+	return f.callBase - 8*int32(i+1)
+}
+
+// Returns the offset of the save slot of the xmm register SavedFloat[i].
+func (f *X86FrameLayout) FloatSaveOffset(i int) int32 {
+	return f.floatBase - 16*int32(i+1)
+}
+
+func (f *X86FrameLayout) movRR(buf *X86Buffer, src, dst RegisterId) {
+	if f.X64 {
+		buf.MovqRR(src, dst)
+	} else {
+		buf.MovlRR(src, dst)
+	}
+}
+
+// Sets up the frame, and saves the registers.
+func (f *X86FrameLayout) Prologue(buf *X86Buffer) {
+	buf.Push(x86_ebp)
+	f.movRR(buf, x86_esp, x86_ebp)
+	for _, reg := range f.Pushed {
+		buf.Push(reg)
+	}
+
+	if f.size > 0 {
+		if f.X64 {
+			buf.SubqIR(f.size, x86_esp)
+		} else {
+			buf.SublIR(f.size, x86_esp)
+		}
+	}
+
+	for i, reg := range f.SavedFloat {
+		buf.MovdquRM(reg, f.FloatSaveOffset(i), x86_ebp)
+	}
+}
+
+// Restores the saved registers, takes down the frame and returns.
+func (f *X86FrameLayout) Epilogue(buf *X86Buffer) {
+	for i, reg := range f.SavedFloat {
+		buf.MovdquMR(f.FloatSaveOffset(i), x86_ebp, reg)
+	}
+
+	if len(f.Pushed) > 0 {
+		if f.X64 {
+			buf.LeaqMR(-f.word()*int32(len(f.Pushed)), x86_ebp, x86_esp)
+		} else {
+			buf.LealMR(-f.word()*int32(len(f.Pushed)), x86_ebp, x86_esp)
+		}
+		for i := len(f.Pushed) - 1; i >= 0; i-- {
+			buf.Pop(f.Pushed[i])
+		}
+	} else {
+		f.movRR(buf, x86_ebp, x86_esp)
+	}
+
+	buf.Pop(x86_ebp)
+	buf.Ret()
+}
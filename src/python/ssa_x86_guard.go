@@ -0,0 +1,226 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the guards of the x86 code generator.  A target that
+   speculates keeps ints raw on x86-64 even when the range analysis can't show
+   that they fit in 64 bits, and guards the code against the ones that don't:
+   the arithmetic on them takes a side exit when it overflows, and so does
+   unboxing an object that isn't an int that fits.
+
+   A side exit stores the values in the SSA registers into the frame, next to
+   the spill slots, calls X86_HELPER_SIDE_EXIT with its index and the address
+   of the words, and then returns 1.  The X86SideExit with the same index says
+   what each word holds, so the runtime can rebuild the interpreter's frame
+   from them, as described in deopt.go.  An exit taken by the arithmetic
+   resumes at the element that overflowed, which the interpreter redoes with
+   its own ints, and an exit taken by unboxing resumes after the element, whose
+   object is among the words.
+*/
+
+package python
+
+import (
+	"big"
+	"fmt"
+	"math"
+	"os"
+)
+
+// A value a side exit stored.  Register is its SSA register, or its spill slot if
+// Spill is set, and Word is the index of the word that holds it.  Kind is EXIT_OBJECT
+// for an object, or EXIT_INT or EXIT_FLOAT for a raw value.
+type X86ExitValue struct {
+	Register int
+	Spill    bool
+	Kind     int
+	Word     int
+}
+
+// A side exit of the generated code.  The interpreter resumes at the element Element,
+// or after it if After is set.
+type X86SideExit struct {
+	Element int
+	After   bool
+	Reason  string
+	Values  []X86ExitValue
+}
+
+// A side exit while the code is generated, with the label of its code and the register
+// each value in a register is stored from.
+type x86Exit struct {
+	X86SideExit
+	label   *Label
+	sources []RegisterId
+
+	// Set if the value of the element is the object in the first argument word.
+	fromArg bool
+}
+
+// Returns the side exit that resumes the interpreter at the instruction pc, from the
+// words the exit stored.  object returns the object that a word holding one refers to.
+// Raw values are boxed, since the interpreter keeps the values of SSA registers and
+// spill slots as objects.
+func (e *X86SideExit) SideExit(pc uint32, words []uint64, object func(word uint64) Object) (*SideExit, os.Error) {
+	exit := &SideExit{PC: pc, Reason: e.Reason}
+	for _, v := range e.Values {
+		if v.Word >= len(words) {
+			return nil, os.NewError(fmt.Sprintf("x86: side exit at element %v needs %v words, got %v",
+				e.Element, v.Word+1, len(words)))
+		}
+
+		var o Object
+		switch v.Kind {
+		case EXIT_INT:
+			o = NewInt(int64(words[v.Word]))
+		case EXIT_FLOAT:
+			o = NewFloat(math.Float64frombits(words[v.Word]))
+		default:
+			o = object(words[v.Word])
+		}
+		exit.Values = append(exit.Values, ExitValue{Kind: EXIT_OBJECT, Register: uint32(v.Register),
+			Spill: v.Spill, Object: o})
+	}
+	return exit, nil
+}
+
+// Returns a copy of the target that speculates.
+func (t *X86Target) Speculating() *X86Target {
+	c := *t
+	c.Speculate = true
+	return &c
+}
+
+// Returns true if el is an int that is kept raw only because the target speculates.
+func (g *x86Generator) speculative(el *SsaElement) bool {
+	return g.rep(el) == x86RawInt && !el.SmallInt
+}
+
+// Returns the kind of exit value that el is kept as.
+func (g *x86Generator) exitKind(el *SsaElement) int {
+	switch g.rep(el) {
+	case x86RawInt:
+		return EXIT_INT
+	case x86RawFloat:
+		return EXIT_FLOAT
+	}
+	return EXIT_OBJECT
+}
+
+// Records that el has been computed, so the values in the registers and the spill
+// slots are known to the side exits after it.
+func (g *x86Generator) record(el *SsaElement) {
+	switch {
+	case el.Op == SSA_SPILL:
+		g.slots[el.Src1] = el.Address
+	case producesValue(el.Op) && el.DstRegister != 0:
+		g.holds[el.DstRegister] = el.Address
+	}
+}
+
+// Jumps to a new side exit if cond holds, while el is computed.  The exit stores the
+// values in the registers and the spill slots, and if after is set, el's object, which
+// is in the first argument word.
+func (g *x86Generator) guard(cond uint8, el *SsaElement, after bool, reason string) {
+	exit := &x86Exit{label: new(Label), fromArg: after}
+	exit.Element, exit.After, exit.Reason = el.Address, after, reason
+
+	for reg := 1; reg <= len(g.target.Registers); reg++ {
+		id, present := g.holds[reg]
+		if after && reg == el.DstRegister {
+			id, present = el.Address, true
+		}
+		if !present {
+			continue
+		}
+
+		kind := g.exitKind(g.ctx.Elements[id])
+		src := g.gpr(reg)
+		switch {
+		case after && reg == el.DstRegister:
+			kind, src = EXIT_OBJECT, x86_eax
+		case kind == EXIT_FLOAT:
+			src = g.xmm(reg)
+		}
+		exit.Values = append(exit.Values, X86ExitValue{reg, false, kind, reg - 1})
+		exit.sources = append(exit.sources, src)
+	}
+
+	for slot := 0; slot < g.ctx.SpillRoomNeeded; slot++ {
+		if id, present := g.slots[slot]; present {
+			kind := g.exitKind(g.ctx.Elements[id])
+			exit.Values = append(exit.Values, X86ExitValue{slot, true, kind, g.frame.ExitWord(g.frame.SpillOffset(slot))})
+		}
+	}
+
+	g.check(g.buf.JccTo(cond, exit.label))
+	g.exits = append(g.exits, exit)
+}
+
+// Generates the code of the side exits, which store the registers and return 1.  The
+// words of the registers are below the spill slots, one for each SSA register from 1.
+func (g *x86Generator) sideExits() {
+	for i, exit := range g.exits {
+		g.check(g.buf.Bind(exit.label))
+		if exit.fromArg {
+			g.movMR(g.argOffset(0), g.target.Context, x86_eax)
+		}
+
+		for j, v := range exit.Values {
+			if v.Spill {
+				continue
+			}
+			offset := g.frame.ExitOffset(v.Word)
+			if v.Kind == EXIT_FLOAT {
+				g.buf.MovsdRM(exit.sources[j], offset, x86_ebp)
+			} else {
+				g.movRM(exit.sources[j], offset, x86_ebp)
+			}
+		}
+
+		g.setArg(0, i)
+		if g.target.X64 {
+			g.buf.LeaqMR(g.frame.ExitOffset(0), x86_ebp, x86_eax)
+		} else {
+			g.buf.LealMR(g.frame.ExitOffset(0), x86_ebp, x86_eax)
+		}
+		g.setArgReg(1, x86_eax)
+		g.exiting = exit
+		g.invoke(X86_HELPER_SIDE_EXIT)
+		g.exiting = nil
+		g.buf.MovlIR(1, x86_eax)
+		g.check(g.buf.JmpTo(g.exit))
+	}
+}
+
+// Returns true if the int constant can be loaded raw.
+func fitsRaw(v *big.Int) bool {
+	return v.BitLen() < 64
+}
+
+// Generates the machine code of the function in ctx, as GenerateX86 does, and returns
+// the side exits of the code too, by their index.
+func (ctx *SsaContext) GenerateX86Exits(target *X86Target) ([]byte, []*X86SideExit, os.Error) {
+	g, err := ctx.generateX86(target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exits := make([]*X86SideExit, len(g.exits))
+	for i, exit := range g.exits {
+		exits[i] = &exit.X86SideExit
+	}
+	return g.buf.Bytes(), exits, nil
+}
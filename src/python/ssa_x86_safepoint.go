@@ -0,0 +1,193 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the contract between the generated code and Go's
+   garbage collector.  Go's collector doesn't know about the registers and the
+   frame of the generated code, so a Go pointer that only the code holds could
+   be collected while the code still uses it.  The code therefore never holds
+   one: every object it deals with is a handle, a word that indexes a
+   HandleTable the runtime keeps with the context.  The table refers to the
+   objects, so they stay reachable for as long as their handles are pinned.
+   The helpers take handles in the argument words and return a new handle, or
+   0 when they raise, which is why no object is ever handle 0.
+
+   The calls of the helpers are the safepoints of the code, the only places
+   where the runtime runs while the code is in the middle of a function.  The
+   code generator records a stack map for each of them, which lists the SSA
+   registers, the spill slots and the call arguments that hold handles the code
+   will go on to use.  Every register in a map must survive the call, either
+   because the helper preserves it or because it is saved around the call, and
+   the generator fails if one doesn't.  At a safepoint, the runtime may release
+   every handle that isn't in the map, or in the argument words of the context,
+   or the one the helper is about to return.  Everything else is released when
+   the code returns, except for the handle of its result.
+
+   At a side exit, the map lists the words the exit stores objects in, which the
+   runtime turns back into objects with HandleTable.Object.
+*/
+
+package python
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// The objects that the generated code refers to by handle.
+type HandleTable struct {
+	objects []Object
+	free    []uint64
+}
+
+// Pins o, and returns its handle, which is never 0.
+func (t *HandleTable) Pin(o Object) uint64 {
+	if n := len(t.free); n > 0 {
+		h := t.free[n-1]
+		t.free = t.free[:n-1]
+		t.objects[h-1] = o
+		return h
+	}
+	t.objects = append(t.objects, o)
+	return uint64(len(t.objects))
+}
+
+// Returns the object with the handle h, or nil if h isn't pinned.
+func (t *HandleTable) Object(h uint64) Object {
+	if h == 0 || h > uint64(len(t.objects)) {
+		return nil
+	}
+	return t.objects[h-1]
+}
+
+// Unpins the object with the handle h, so that the handle can be reused.
+func (t *HandleTable) Release(h uint64) {
+	if t.Object(h) == nil {
+		return
+	}
+	t.objects[h-1] = nil
+	t.free = append(t.free, h)
+}
+
+// Releases every handle that isn't in live.
+func (t *HandleTable) Sweep(live []uint64) {
+	keep := make(map[uint64]bool, len(live))
+	for _, h := range live {
+		keep[h] = true
+	}
+	for i := range t.objects {
+		if h := uint64(i + 1); !keep[h] {
+			t.Release(h)
+		}
+	}
+}
+
+// Returns the number of pinned objects.
+func (t *HandleTable) Len() int {
+	return len(t.objects) - len(t.free)
+}
+
+// The stack map of a call of a helper.  Offset is the offset of the return address in
+// the code.  Registers and Slots are the SSA registers and the spill slots that hold
+// handles, and Args the indices of the call arguments, or the exit words at a side
+// exit, that hold them.
+type X86Safepoint struct {
+	Offset    int
+	Helper    int
+	Registers []int
+	Slots     []int
+	Args      []int
+}
+
+// Returns the handles the safepoint says are live, given the values of the SSA registers
+// from 1, the spill slots and the argument words.
+func (sp *X86Safepoint) Live(registers, slots, args []uint64) []uint64 {
+	var live []uint64
+	for _, reg := range sp.Registers {
+		live = append(live, registers[reg-1])
+	}
+	for _, slot := range sp.Slots {
+		live = append(live, slots[slot])
+	}
+	for _, i := range sp.Args {
+		live = append(live, args[i])
+	}
+	return live
+}
+
+// Returns true if the helpers leave reg as it was.
+func (g *x86Generator) preserved(reg RegisterId) bool {
+	cc := g.target.Convention
+	if cc == nil {
+		return reg != x86_eax && reg != x86_edx
+	}
+	return registerIn(reg, cc.CalleeSaved) || registerIn(reg, g.frame.CallSaved)
+}
+
+// Records the stack map of the call of the helper h that was just generated.
+func (g *x86Generator) safepoint(h int) {
+	sp := &X86Safepoint{Offset: g.buf.Len(), Helper: h}
+
+	if g.exiting != nil {
+		for _, v := range g.exiting.Values {
+			if v.Kind == EXIT_OBJECT {
+				sp.Args = append(sp.Args, v.Word)
+			}
+		}
+		g.safepoints = append(g.safepoints, sp)
+		return
+	}
+
+	for reg := 1; reg <= len(g.target.Registers); reg++ {
+		id, present := g.holds[reg]
+		if !present || g.rep(g.ctx.Elements[id]) != x86Boxed {
+			continue
+		}
+		if !g.preserved(g.gpr(reg)) {
+			g.check(os.NewError(fmt.Sprintf("x86: r%v holds an object across a call of helper %v, which doesn't preserve it",
+				reg, h)))
+		}
+		sp.Registers = append(sp.Registers, reg)
+	}
+
+	for slot := 0; slot < g.ctx.SpillRoomNeeded; slot++ {
+		if id, present := g.slots[slot]; present && g.rep(g.ctx.Elements[id]) == x86Boxed {
+			sp.Slots = append(sp.Slots, slot)
+		}
+	}
+
+	for i := range g.pendingArgs {
+		sp.Args = append(sp.Args, i)
+	}
+	sort.Ints(sp.Args)
+
+	g.safepoints = append(g.safepoints, sp)
+}
+
+// Generates the machine code of the function in ctx, as GenerateX86Exits does, and
+// returns the stack maps of its safepoints too, in the order of the code.
+func (ctx *SsaContext) GenerateX86Safepoints(target *X86Target) ([]byte, []*X86SideExit, []*X86Safepoint, os.Error) {
+	g, err := ctx.generateX86(target)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	exits := make([]*X86SideExit, len(g.exits))
+	for i, exit := range g.exits {
+		exits[i] = &exit.X86SideExit
+	}
+	return g.buf.Bytes(), exits, g.safepoints, nil
+}
@@ -0,0 +1,482 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the x86 code generator.
+
+*/
+
+package python
+
+import (
+        "big"
+        "bytes"
+        "strings"
+        "testing"
+)
+
+// Takes ctx through the analyses and the allocator, for the target.
+func prepareX86(ctx *SsaContext, target *X86Target) *SsaContext {
+    ctx.AnalyzeUnboxing()
+    ctx.AnalyzeRanges()
+    ctx = ctx.AllocateRegisters(target.NumRegisters())
+    ctx.Peephole()
+    return ctx
+}
+
+// Takes ctx through the analyses and the allocator, and generates code for the target.
+func generateX86(t *testing.T, ctx *SsaContext, target *X86Target) []byte {
+    code, err := prepareX86(ctx, target).GenerateX86(target)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    return code
+}
+
+// Generates code for the target as generateX86 does, but only returns the instructions,
+// without the float constants after them, which can't be disassembled.
+func generateX86Instructions(t *testing.T, ctx *SsaContext, target *X86Target) []byte {
+    g, err := prepareX86(ctx, target).generateX86(target)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    return g.buf.Bytes()[:g.codeSize]
+}
+
+// Returns the encoding of a call of the helper h on x86-64.
+func helperCall64(h int) []byte {
+    return []byte{0x41, 0xff, 0x57, byte(8 * h)}
+}
+
+func TestGenerateX86Boxed(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+    ctx.Return(ctx.Eval(SSA_ADD, ctx.LoadName("a"), ctx.LoadName("b")))
+
+    code := generateX86(t, ctx, X86_64)
+    if !bytes.HasPrefix(code, []byte{0x55, 0x48, 0x89, 0xe5}) {
+        t.Errorf("expected the code to start by setting up the frame, got % x", code)
+    }
+    if !bytes.HasSuffix(code, []byte{0x31, 0xc0, 0x48, 0x89, 0xec, 0x5d, 0xc3}) {
+        t.Errorf("expected the code to end by returning, got % x", code)
+    }
+    if n := bytes.Count(code, helperCall64(X86_HELPER_LOAD_NAME)); n != 2 {
+        t.Errorf("expected 2 calls to load a name, got %v", n)
+    }
+    if !bytes.Contains(code, helperCall64(X86_HELPER_BINARY)) {
+        t.Errorf("expected the objects to be added by a helper, got % x", code)
+    }
+}
+
+func TestGenerateX86RawInt(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    two := ctx.LoadInt(big.NewInt(2))
+    sum := ctx.Eval(SSA_ADD, two, ctx.LoadInt(big.NewInt(3)))
+    ctx.Store("x", ctx.Eval(SSA_MUL, sum, two))
+    ctx.Return(-1)
+
+    code := generateX86(t, ctx, X86_64)
+    if !bytes.Contains(code, []byte{0x0f, 0xaf}) {
+        t.Errorf("expected an inline multiply, got % x", code)
+    }
+    if !bytes.Contains(code, helperCall64(X86_HELPER_BOX_INT)) {
+        t.Errorf("expected the stored product to be boxed, got % x", code)
+    }
+    if bytes.Contains(code, helperCall64(X86_HELPER_BINARY)) {
+        t.Errorf("expected no helper for the arithmetic, got % x", code)
+    }
+}
+
+func TestGenerateX86Float(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+    ctx.Store("x", ctx.Eval(SSA_ADD, ctx.LoadFloat(1.5), ctx.LoadInt(big.NewInt(2))))
+    ctx.Return(-1)
+
+    code := generateX86(t, ctx, X86_64)
+    if !bytes.Contains(code, []byte{0x0f, 0x2a}) {
+        t.Errorf("expected the int to be converted, got % x", code)
+    }
+    if !bytes.Contains(code, []byte{0x0f, 0x58}) {
+        t.Errorf("expected an inline add, got % x", code)
+    }
+    if !bytes.Contains(code, helperCall64(X86_HELPER_BOX_FLOAT)) {
+        t.Errorf("expected the sum to be boxed, got % x", code)
+    }
+    if !bytes.HasSuffix(code, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf8, 0x3f}) {
+        t.Errorf("expected 1.5 in the constant pool, got % x", code)
+    }
+}
+
+func TestGenerateX86Branch(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+
+    then_block, else_block := ctx.NewBlock(), ctx.NewBlock()
+    ctx.Branch(ctx.Eval(SSA_LT, ctx.LoadInt(big.NewInt(1)), ctx.LoadInt(big.NewInt(2))), then_block, else_block)
+    ctx.SetBlock(then_block)
+    ctx.Return(ctx.LoadString("yes"))
+    ctx.SetBlock(else_block)
+    ctx.Return(-1)
+
+    code := generateX86(t, ctx, X86_64)
+    if !bytes.Contains(code, []byte{0x39, 0xee, 0x0f, 0x8c}) {
+        t.Errorf("expected an inline comparison and a jump if less, got % x", code)
+    }
+    if bytes.Contains(code, helperCall64(X86_HELPER_COMPARE)) {
+        t.Errorf("expected no helper for the comparison, got % x", code)
+    }
+}
+
+func TestGenerateX86Call(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+    ctx.Return(ctx.Call(ctx.LoadName("f"), []int{ctx.LoadInt(big.NewInt(1)), ctx.LoadName("x")}))
+
+    code := generateX86(t, ctx, X86_32)
+    if !bytes.HasPrefix(code, []byte{0x55, 0x89, 0xe5}) {
+        t.Errorf("expected the code to start by setting up the frame, got % x", code)
+    }
+    if !bytes.Contains(code, []byte{0xff, 0x56, 4 * X86_HELPER_CALL}) {
+        t.Errorf("expected a call of the call helper, got % x", code)
+    }
+
+    // The allocator doesn't know about the target.
+    ctx = new (SsaContext)
+    ctx.Init()
+    ctx.Return(ctx.Eval(SSA_ADD, ctx.LoadName("a"), ctx.LoadName("b")))
+    ctx = ctx.AllocateRegisters(X86_64.NumRegisters())
+    if _, err := ctx.GenerateX86(X86_32); err == nil {
+        t.Errorf("expected registers the target doesn't have to fail")
+    }
+}
+
+func TestGenerateX86Comparison(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+    ctx.Store("x", ctx.Eval(SSA_LT, ctx.LoadInt(big.NewInt(1)), ctx.LoadInt(big.NewInt(2))))
+    ctx.Store("y", ctx.Eval(SSA_EQ, ctx.LoadFloat(1.5), ctx.LoadFloat(2.5)))
+    ctx.Return(-1)
+
+    code := generateX86Instructions(t, ctx, X86_64)
+    text := new(bytes.Buffer)
+    if err := DisassembleX86(code, true, text); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+
+    // The results are set from the flags, and an unordered == gives 0 with a move.
+    for _, want := range []string{"setl %al", "sete %al", "movzbl %al,%eax", "cmovpl %edx,%eax"} {
+        if !strings.Contains(text.String(), want) {
+            t.Errorf("expected %v in the code, got\n%v", want, text)
+        }
+    }
+    for _, jump := range []string{"jl ", "jp ", "jnp "} {
+        if strings.Contains(text.String(), jump) {
+            t.Errorf("expected the comparisons not to branch, got\n%v", text)
+        }
+    }
+    if n := bytes.Count(code, helperCall64(X86_HELPER_BOX_BOOL)); n != 2 {
+        t.Errorf("expected both results to be boxed as bools, got %v", n)
+    }
+}
+
+func TestGenerateX86Conversion(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+    f, i := ctx.LoadFloat(2.5), ctx.LoadInt(big.NewInt(3))
+    to_int, to_float := ctx.Eval(SSA_TO_INT, f, f), ctx.Eval(SSA_TO_FLOAT, i, i)
+    ctx.Store("x", to_int)
+    ctx.Store("y", to_float)
+    ctx.Return(-1)
+
+    code := generateX86Instructions(t, ctx, X86_64)
+    if ctx.Elements[to_int].ValueType != SSA_TYPE_INTEGER || ctx.Elements[to_float].ValueType != SSA_TYPE_FLOAT {
+        t.Errorf("expected the conversions to give an int and a float")
+    }
+    text := new(bytes.Buffer)
+    if err := DisassembleX86(code, true, text); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+
+    // The REX prefix depends on the registers the allocator picks, so the conversions
+    // are found by name, which only has the q suffix when the prefix has W set.
+    if !strings.Contains(text.String(), "cvttsd2siq ") {
+        t.Errorf("expected the float to be truncated inline, got\n%v", text)
+    }
+    if !strings.Contains(text.String(), "cvtsi2sdq ") {
+        t.Errorf("expected the int to be converted inline, got\n%v", text)
+    }
+
+    // Only a float that doesn't fit is left to the helper.
+    if n := bytes.Count(code, helperCall64(X86_HELPER_CONVERT)); n != 1 {
+        t.Errorf("expected 1 call of the conversion helper, got %v in % x", n, code)
+    }
+}
+
+// Returns the code of a function that adds a float to a name, and returns the sum of
+// two names, with the calling convention cc.
+func generateConvention(t *testing.T, cc *CallingConvention) []byte {
+    ctx := new (SsaContext)
+    ctx.Init()
+    ctx.Store("x", ctx.Eval(SSA_ADD, ctx.LoadFloat(1.5), ctx.LoadName("a")))
+    ctx.Return(ctx.Eval(SSA_ADD, ctx.LoadName("a"), ctx.LoadName("b")))
+    return generateX86(t, ctx, X86_64.WithConvention(cc))
+}
+
+func TestGenerateX86SysV(t *testing.T) {
+    code := generateConvention(t, SysVConvention)
+
+    // The registers the code uses that the caller expects to be preserved are pushed,
+    // and the frame keeps the stack aligned.  The context arrives in rdi.
+    prologue := []byte{0x55, 0x48, 0x89, 0xe5, 0x41, 0x55, 0x41, 0x56, 0x41, 0x57,
+                       0x48, 0x83, 0xec, 0x08, 0x49, 0x89, 0xff}
+    if !bytes.HasPrefix(code, prologue) {
+        t.Errorf("expected the prologue % x, got % x", prologue, code)
+    }
+
+    // Each helper gets the context in rdi.
+    call := append([]byte{0x4c, 0x89, 0xff}, helperCall64(X86_HELPER_BINARY)...)
+    if n := bytes.Count(code, call); n != 2 {
+        t.Errorf("expected 2 calls of the helper with the context, got %v in % x", n, code)
+    }
+
+    epilogue := []byte{0x48, 0x8d, 0x65, 0xe8, 0x41, 0x5f, 0x41, 0x5e, 0x41, 0x5d, 0x5d, 0xc3}
+    if !bytes.HasSuffix(code, epilogue) {
+        t.Errorf("expected the epilogue % x, got % x", epilogue, code)
+    }
+}
+
+func TestGenerateX86Windows(t *testing.T) {
+    code := generateConvention(t, WindowsConvention)
+
+    // The frame has room for the saved xmm15 and the shadow space, and the context
+    // arrives in rcx.
+    prologue := []byte{0x55, 0x48, 0x89, 0xe5, 0x41, 0x55, 0x41, 0x56, 0x41, 0x57,
+                       0x48, 0x83, 0xec, 0x38, 0xf3, 0x44, 0x0f, 0x7f, 0x7d, 0xd8, 0x49, 0x89, 0xcf}
+    if !bytes.HasPrefix(code, prologue) {
+        t.Errorf("expected the prologue % x, got % x", prologue, code)
+    }
+
+    call := append([]byte{0x4c, 0x89, 0xf9}, helperCall64(X86_HELPER_LOAD_NAME)...)
+    if n := bytes.Count(code, call); n != 3 {
+        t.Errorf("expected 3 calls of the helper with the context, got %v in % x", n, code)
+    }
+
+    epilogue := []byte{0xf3, 0x44, 0x0f, 0x6f, 0x7d, 0xd8, 0x48, 0x8d, 0x65, 0xe8}
+    if !bytes.Contains(code, epilogue) {
+        t.Errorf("expected xmm15 to be restored, got % x", code)
+    }
+
+    if ConventionFor("windows") != WindowsConvention || ConventionFor("darwin") != SysVConvention {
+        t.Errorf("expected the conventions of the platforms")
+    }
+    if _, err := new (SsaContext).GenerateX86(X86_32.WithConvention(SysVConvention)); err == nil {
+        t.Errorf("expected a convention on x86 to fail")
+    }
+}
+
+func TestX86FrameLayout(t *testing.T) {
+    f := &X86FrameLayout{X64: true, Pushed: []RegisterId{x64_r12, x64_r13}, SavedFloat: []RegisterId{15},
+                         CallSaved: []RegisterId{x86_esi}, Spills: 2, Args: 3, Shadow: 32}
+    f.Layout()
+
+    // Below the pushed registers are the saved xmm15, the save slot of rsi, the spill
+    // slots and the arguments, and the shadow space below them is rounded up.
+    if f.FloatSaveOffset(0) != -32 || f.CallSaveOffset(0) != -40 {
+        t.Errorf("expected the save slots at -32 and -40, got %v and %v", f.FloatSaveOffset(0), f.CallSaveOffset(0))
+    }
+    if f.SpillOffset(0) != -48 || f.SpillOffset(1) != -56 {
+        t.Errorf("expected the spill slots at -48 and -56, got %v and %v", f.SpillOffset(0), f.SpillOffset(1))
+    }
+    if f.ArgOffset(0) != -80 || f.ArgOffset(2) != -64 || f.Size() != 96 {
+        t.Errorf("expected the arguments from -80 in a frame of 96 bytes, got %v and %v", f.ArgOffset(0), f.Size())
+    }
+    if f.ExitWord(f.SpillOffset(1)) != 0 {
+        t.Errorf("expected the last spill slot to be exit word 0, got %v", f.ExitWord(f.SpillOffset(1)))
+    }
+
+    buf := &X86Buffer{Buffer: new(bytes.Buffer), IsX64: true}
+    f.Prologue(buf)
+    prologue := []byte{0x55, 0x48, 0x89, 0xe5, 0x41, 0x54, 0x41, 0x55, 0x48, 0x83, 0xec, 0x60,
+                       0xf3, 0x44, 0x0f, 0x7f, 0x7d, 0xe0}
+    if !bytes.Equal(buf.Bytes(), prologue) {
+        t.Errorf("expected the prologue % x, got % x", prologue, buf.Bytes())
+    }
+
+    buf.Reset()
+    f.Epilogue(buf)
+    epilogue := []byte{0xf3, 0x44, 0x0f, 0x6f, 0x7d, 0xe0, 0x48, 0x8d, 0x65, 0xf0, 0x41, 0x5d, 0x41, 0x5c, 0x5d, 0xc3}
+    if !bytes.Equal(buf.Bytes(), epilogue) {
+        t.Errorf("expected the epilogue % x, got % x", epilogue, buf.Bytes())
+    }
+}
+
+func TestGenerateX86Guards(t *testing.T) {
+    // The product of a huge constant doesn't fit in 64 bits, so the constant and the
+    // product are only kept raw when the target speculates.  Unboxing the constant is
+    // guarded then, and so is the multiply.
+    ctx := new (SsaContext)
+    ctx.Init()
+    huge := ctx.LoadInt(new(big.Int).Lsh(big.NewInt(1), 70))
+    product := ctx.Eval(SSA_MUL, huge, ctx.LoadInt(big.NewInt(3)))
+    ctx.Store("x", product)
+    ctx.Return(-1)
+
+    ctx.AnalyzeUnboxing()
+    ctx.AnalyzeRanges()
+    ctx = ctx.AllocateRegisters(X86_64.NumRegisters())
+    ctx.Peephole()
+
+    if code, err := ctx.GenerateX86(X86_64); err != nil || bytes.Contains(code, helperCall64(X86_HELPER_SIDE_EXIT)) {
+        t.Fatalf("expected code without side exits, got %v", err)
+    }
+    if _, err := ctx.GenerateX86(X86_64.Speculating()); err == nil {
+        t.Errorf("expected code with side exits to need GenerateX86Exits")
+    }
+
+    code, exits, err := ctx.GenerateX86Exits(X86_64.Speculating())
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if n := bytes.Count(code, helperCall64(X86_HELPER_SIDE_EXIT)); n != 2 || len(exits) != 2 {
+        t.Fatalf("expected 2 side exits, each calling the helper, got %v and %v calls", len(exits), n)
+    }
+    if !bytes.Contains(code, []byte{0x0f, 0x80}) {
+        t.Errorf("expected a jump on overflow, got % x", code)
+    }
+
+    // The unboxing exit keeps the constant's object, and resumes after it.
+    unbox, overflow := exits[0], exits[1]
+    if unbox.Element != huge || !unbox.After || overflow.Element != product || overflow.After {
+        t.Errorf("expected exits after the constant and at the product, got %+v and %+v", unbox, overflow)
+    }
+    reg := ctx.Elements[huge].DstRegister
+    if len(unbox.Values) != 1 || unbox.Values[0].Register != reg || unbox.Values[0].Spill ||
+        unbox.Values[0].Kind != EXIT_OBJECT || unbox.Values[0].Word != reg - 1 {
+        t.Errorf("expected the constant's object in r%v, got %+v", reg, unbox.Values)
+    }
+
+    // The overflow exit keeps both raw operands.
+    if len(overflow.Values) != 2 || overflow.Values[0].Kind != EXIT_INT || overflow.Values[1].Kind != EXIT_INT {
+        t.Errorf("expected two raw ints, got %+v", overflow.Values)
+    }
+}
+
+func TestX86SideExit(t *testing.T) {
+    exit := &X86SideExit{Element: 3, Reason: "int overflow", Values: []X86ExitValue{
+        {1, false, EXIT_INT, 0},
+        {2, false, EXIT_FLOAT, 1},
+        {0, true, EXIT_OBJECT, 3},
+    }}
+    name := NewString("x")
+    words := []uint64{42, 0x3ff8000000000000, 0, 7}
+    state, err := exit.SideExit(12, words, func(word uint64) Object {
+        if word != 7 {
+            t.Errorf("expected the object's word to be 7, got %v", word)
+        }
+        return name
+    })
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+
+    if state.PC != 12 || state.Reason != "int overflow" || len(state.Values) != 3 {
+        t.Fatalf("expected a side exit to 12 with 3 values, got %v", state)
+    }
+    if v := state.Values[0]; v.Kind != EXIT_OBJECT || v.Register != 1 || v.Object.AsString() != "42" {
+        t.Errorf("expected r1 to be boxed to 42, got %+v", v)
+    }
+    if v := state.Values[1]; v.Register != 2 || v.Object.AsString() != "1.5" {
+        t.Errorf("expected r2 to be boxed to 1.5, got %+v", v)
+    }
+    if v := state.Values[2]; !v.Spill || v.Object != name {
+        t.Errorf("expected the spilled object, got %+v", v)
+    }
+
+    if _, err := exit.SideExit(12, words[:2], nil); err == nil {
+        t.Errorf("expected too few words to fail")
+    }
+}
+
+func TestGenerateX86Safepoints(t *testing.T) {
+    ctx := new (SsaContext)
+    ctx.Init()
+    a := ctx.LoadName("a")
+    sum := ctx.Eval(SSA_ADD, a, ctx.LoadName("b"))
+    ctx.Store("x", sum)
+    ctx.Return(ctx.Call(ctx.LoadName("f"), []int{a}))
+
+    ctx.AnalyzeUnboxing()
+    ctx.AnalyzeRanges()
+    ctx = ctx.AllocateRegisters(X86_64.NumRegisters())
+    ctx.Peephole()
+
+    code, _, safepoints, err := ctx.GenerateX86Safepoints(X86_64.WithConvention(SysVConvention))
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+
+    // Every call of a helper has a stack map, which follows the call.
+    calls := 0
+    for h := 0; h < X86_HELPER_COUNT; h++ {
+        calls += bytes.Count(code, helperCall64(h))
+    }
+    if len(safepoints) != calls {
+        t.Fatalf("expected a safepoint for each of the %v calls, got %v", calls, len(safepoints))
+    }
+    for _, sp := range safepoints {
+        if !bytes.Equal(code[sp.Offset-4:sp.Offset], helperCall64(sp.Helper)) {
+            t.Errorf("expected the call of helper %v before offset %v, got % x", sp.Helper, sp.Offset, code)
+        }
+    }
+
+    // Loading b keeps a's object, and so does the call of f, which has a as its argument.
+    reg := ctx.Elements[a].DstRegister
+    if sp := safepoints[1]; sp.Helper != X86_HELPER_LOAD_NAME || len(sp.Registers) != 1 || sp.Registers[0] != reg {
+        t.Errorf("expected a's object in r%v while b is loaded, got %+v", reg, sp)
+    }
+    last := safepoints[len(safepoints)-1]
+    if last.Helper != X86_HELPER_CALL || len(last.Args) != 1 || last.Args[0] != 0 {
+        t.Errorf("expected the call to keep its argument, got %+v", last)
+    }
+
+    registers := make([]uint64, len(X86_64.Registers))
+    registers[reg-1] = 5
+    if live := safepoints[1].Live(registers, nil, nil); len(live) != 1 || live[0] != 5 {
+        t.Errorf("expected a's handle to be live, got %v", live)
+    }
+}
+
+func TestHandleTable(t *testing.T) {
+    table := new (HandleTable)
+    a, b := NewString("a"), NewString("b")
+    ha, hb := table.Pin(a), table.Pin(b)
+    if ha == 0 || hb == 0 || ha == hb {
+        t.Fatalf("expected two distinct handles other than 0, got %v and %v", ha, hb)
+    }
+    if table.Object(ha) != a || table.Object(hb) != b || table.Object(0) != nil {
+        t.Errorf("expected the handles to refer to their objects")
+    }
+
+    table.Sweep([]uint64{hb})
+    if table.Object(ha) != nil || table.Object(hb) != b || table.Len() != 1 {
+        t.Errorf("expected only b to stay pinned, got %v objects", table.Len())
+    }
+    if h := table.Pin(a); h != ha {
+        t.Errorf("expected the released handle %v to be reused, got %v", ha, h)
+    }
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module computes the Strahler numbers of expression trees.  The Strahler
+   number of an expression is the least number of registers needed to evaluate
+   it without spilling, when the larger operand is always evaluated first.  A
+   leaf needs one register, and a node needs as many as its hungriest child, or
+   one more if two children tie.  Nodes with more than two children, like calls,
+   hold on to the value of each child while evaluating the rest, so with the
+   children sorted hungriest first, child i needs i more registers than it
+   would alone.
+
+   When lowering a function the front end stores the largest number it finds in
+   SsaContext.Strahler, so that the register allocator knows up front when it
+   will have to spill.  It also uses the numbers to order the operands of an
+   operation, where Python's order of evaluation leaves it free to.
+*/
+
+package python
+
+// Returns the direct children of n, in the order Walk visits them.
+func astChildren(n Ast) []Ast {
+    var children []Ast
+
+    Walk(n, func(c Ast) bool {
+        if c == n {
+            return true
+        }
+        children = append(children, c)
+        return false
+    })
+
+    return children
+}
+
+// Returns true for the nodes that don't have a value of their own.
+func isStatement(n Ast) bool {
+    switch n.(type) {
+        case *ModuleNode, *ExprStmtNode, *AssignNode, *AugAssignNode, *ReturnNode,
+            *PassNode, *BreakNode, *ContinueNode, *IfNode, *WhileNode, *ForNode,
+            *ArgNode, *FunctionDefNode, *ClassDefNode:
+            return true
+    }
+    return false
+}
+
+// Returns the Strahler number of the expression n.  For a statement it is the largest
+// Strahler number of the expressions in it, or 0 if there are none.
+func Strahler(n Ast) int {
+    if n == nil {
+        return 0
+    }
+
+    children := astChildren(n)
+
+    if isStatement(n) {
+        most := 0
+        for _, c := range children {
+            if s := Strahler(c); s > most {
+                most = s
+            }
+        }
+        return most
+    }
+
+    if len(children) == 0 {
+        return 1
+    }
+
+    // Sort the children's numbers, largest first.  There are never many of
+    // them, so an insertion sort does fine.
+    numbers := make([]int, len(children))
+    for i, c := range children {
+        s := Strahler(c)
+
+        j := i
+        for ; j > 0 && numbers[j-1] < s; j-- {
+            numbers[j] = numbers[j-1]
+        }
+        numbers[j] = s
+    }
+
+    most := 0
+    for i, s := range numbers {
+        if s+i > most {
+            most = s + i
+        }
+    }
+
+    return most
+}
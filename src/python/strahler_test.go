@@ -0,0 +1,51 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the Strahler number computation.
+
+*/
+
+package python
+
+import (
+        "testing"
+)
+
+func TestStrahler(t *testing.T) {
+    tests := []struct {
+        src    string
+        number int
+    }{
+        {"pass\n", 0},
+        {"x\n", 1},
+        {"a + b\n", 2},
+        {"a + b + c + d\n", 2},
+        {"(a + b) * (c + d)\n", 3},
+        {"((a + b) * (c + d)) - ((e + f) * (g + h))\n", 4},
+        {"-(a + b)\n", 2},
+        {"f(a, b, c)\n", 4},
+        {"f(a + b)\n", 2},
+        {"x = a + b\ny = (a + b) * (c + d)\n", 3},
+        {"if a:\n    x = (a + b) * (c + d)\n", 3},
+    }
+
+    for _, test := range tests {
+        _, mod := parseSource(t, test.src)
+        if s := Strahler(mod); s != test.number {
+            t.Errorf("%q: expected a Strahler number of %v, got %v", test.src, test.number, s)
+        }
+    }
+}
@@ -22,18 +22,32 @@ package python
 
 import (
         "big"
+        "bytes"
         "fmt"
+        "os"
+        "strings"
+        "utf8"
 )
 
+// A string is indexed by code point, as in Python 3.  A string of ASCII has one byte
+// per code point, so Value is indexed directly.  Otherwise the code points are decoded
+// once, when the string is made, into runes, so that indexing and slicing don't have
+// to decode the UTF-8 again.  Strings are shared, so this can't be done lazily.
 type StringObject struct {
     ObjectData
     Value string 
+    runes []int
+    length int
 }
 
 func NewString(value string) (*StringObject) {
     str := new(StringObject)
     str.ObjectData.Init()
     str.Value = value
+    str.length = utf8.RuneCountInString(value)
+    if str.length != len(value) {
+        str.runes = []int(value)
+    }
     
     return str
 }
@@ -59,62 +73,258 @@ func (o *StringObject) AsString() (string) {
     return o.Value
 }
 
+// Returns the character at the code point i as a string.
+func (o *StringObject) char(i int) (*StringObject) {
+    if o.runes == nil {
+        return NewString(o.Value[i : i+1])
+    }
+    return NewString(string(o.runes[i]))
+}
+
+// Returns the code points from start to stop as a string.
+func (o *StringObject) substring(start, stop int) (*StringObject) {
+    if o.runes == nil {
+        return NewString(o.Value[start:stop])
+    }
+    return NewString(string(o.runes[start:stop]))
+}
+
+// Returns each of the characters of the string as a string.
+func (o *StringObject) chars() ([]Object) {
+    chars := make([]Object, o.length)
+    for i := range chars {
+        chars[i] = o.char(i)
+    }
+    return chars
+}
+
+// Iterating over a string gives each of its characters as a string.
+func (o *StringObject) Iter() (Iterator) {
+    return NewIterator(o.chars())
+}
+
+// Returns the character at the index key, or the characters the slice key takes, as a
+// string.  Both count code points, not bytes.
+func (o *StringObject) GetItem(key Object) (Object, os.Error) {
+    if s, ok := key.(*SliceObject); ok {
+        return o.slice(s)
+    }
+    
+    i, err := sequenceIndex(key, o.length, "string")
+    if err != nil {
+        return nil, err
+    }
+    return o.char(i), nil
+}
+
+func (o *StringObject) slice(s *SliceObject) (Object, os.Error) {
+    start, step, length, err := s.Indices(o.length)
+    if err != nil {
+        return nil, err
+    }
+    if step == 1 {
+        return o.substring(start, start+length), nil
+    }
+    
+    if o.runes == nil {
+        value := make([]byte, length)
+        for i := range value {
+            value[i] = o.Value[start+i*step]
+        }
+        return NewString(string(value)), nil
+    }
+    value := make([]int, length)
+    for i := range value {
+        value[i] = o.runes[start+i*step]
+    }
+    return NewString(string(value)), nil
+}
+
+// Strings can't be changed
+func (o *StringObject) SetItem(key, value Object) (os.Error) {
+    return Raise(TypeErrorClass, "'str' object does not support item assignment")
+}
+
 ///////// Rich Comparison Interface ///////////
 
-func (o *StringObject) Lt(r Object) (bool) {
-    return o.Value < r.AsString()
+// A string is only compared with a string.  Comparing the UTF-8 byte by byte orders the
+// strings by code point, as Python does.
+func (o *StringObject) compare(op uint32, r Object) (Object) {
+    s, ok := r.(*StringObject)
+    if !ok {
+        return NotImplemented
+    }
+    c := 0
+    switch {
+        case o.Value < s.Value:
+            c = -1
+        case o.Value > s.Value:
+            c = 1
+    }
+    return comparison(op, c)
+}
+
+func (o *StringObject) Lt(r Object) (Object) {
+    return o.compare(LT, r)
 }
 
-func (o *StringObject) Gt(r Object) (bool) {
-    return o.Value > r.AsString()
+func (o *StringObject) Gt(r Object) (Object) {
+    return o.compare(GT, r)
 }
 
-func (o *StringObject) Eq(r Object) (bool) {
-    return o.Value == r.AsString()
+func (o *StringObject) Eq(r Object) (Object) {
+    return o.compare(EQ, r)
 }
 
-func (o *StringObject) Neq(r Object) (bool) {
-    return o.Value != r.AsString()
+func (o *StringObject) Neq(r Object) (Object) {
+    return o.compare(NE, r)
 }
 
-func (o *StringObject) Lte(r Object) (bool) {
-    return o.Value <= r.AsString()
+func (o *StringObject) Lte(r Object) (Object) {
+    return o.compare(LE, r)
 }
 
-func (o *StringObject) Gte(r Object) (bool) {
-    return o.Value >= r.AsString()
+func (o *StringObject) Gte(r Object) (Object) {
+    return o.compare(GE, r)
 }
 
 ///////// Binary Arithmetic Interface ///////////
 
-func (o *StringObject) Add(r Object) (Object) {    
-    return NewString(o.Value + r.AsString())
+// Only a string can be added to a string.  Adding the empty string gives the other
+// string, without a copy.
+func (o *StringObject) Add(r Object) (Object, os.Error) {    
+    s, ok := r.(*StringObject)
+    switch {
+        case !ok:
+            return nil, nil
+        case len(s.Value) == 0:
+            return o, nil
+        case len(o.Value) == 0:
+            return s, nil
+    }
+    return NewString(o.Value + s.Value), nil
 }
 
-func (o *StringObject) Sub(r Object) (Object) {    
-    return NewString("")
+func (o *StringObject) Sub(r Object) (Object, os.Error) {    
+    return nil, nil
 }
 
-func (o *StringObject) Mul(r Object) (Object) { 
-    result := ""
-    reps   := r.AsInt().Int64()
-    
-    for i:=int64(0); i < reps; i+=1 {
-        result+=o.Value
-    } 
-    return NewString(result)
+// Repeats the string.  A negative number of repeats gives the empty string, as in
+// Python, and a result too long to make is an OverflowError.
+func (o *StringObject) Mul(r Object) (Object, os.Error) { 
+    reps, ok := r.(*IntObject)
+    switch {
+        case !ok:
+            return nil, nil
+        case reps.Sign() <= 0 || len(o.Value) == 0:
+            return NewString(""), nil
+        case !reps.IsSmall() || reps.Small > int64(maxInt / len(o.Value)):
+            return nil, Raise(OverflowErrorClass, "repeated string is too long")
+        case reps.Small == 1:
+            return o, nil
+    }
+    return NewString(repeatString(o.Value, int(reps.Small))), nil
 }
 
-func (o *StringObject) Div(r Object) (Object) {
-    return NewString("")
+// The largest int.
+const maxInt = int(^uint(0) >> 1)
+
+// Returns s repeated n times.  The result is allocated once, and filled by doubling
+// what has been copied so far, so it takes log n copies.
+func repeatString(s string, n int) (string) {
+    buf := make([]byte, len(s)*n)
+    done := copy(buf, s)
+    for done < len(buf) {
+        done += copy(buf[done:], buf[:done])
+    }
+    return string(buf)
 }
 
-func (o *StringObject) FloorDiv(r Object) (Object) {
-    return NewString("")
+func (o *StringObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
 }
 
-func (o *StringObject) Mod(r Object) (Object) {
-    return NewString(o.Value)
+func (o *StringObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
 }
 
+// Formatting strings with % isn't supported yet.
+func (o *StringObject) Mod(r Object) (Object, os.Error) {
+    return nil, Raise(NotImplementedErrorClass, "string formatting with %")
+}
+
+func (o *StringObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
 
+///////// Unary Arithmetic Interface ///////////
+
+func (o *StringObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *StringObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *StringObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A string is true unless it is empty
+func (o *StringObject) IsTrue() (bool) {
+    return len(o.Value) > 0
+}
+
+///////// Protocol Interface ///////////
+
+// Strings are hashed with the seeded hash of hash.go, and the default key.  The dicts
+// and sets of an interpreter hash them with its key instead.
+func (o *StringObject) Hash() (uint64, os.Error) {
+    return hashString(nil, o.Value), nil
+}
+
+// Returns the string as Python writes it as a literal, in single quotes unless it has
+// single quotes and no double ones.
+func (o *StringObject) Repr() (string) {
+    quote := '\''
+    if strings.IndexRune(o.Value, '\'') >= 0 && strings.IndexRune(o.Value, '"') < 0 {
+        quote = '"'
+    }
+    
+    var buf bytes.Buffer
+    buf.WriteRune(quote)
+    for _, c := range o.Value {
+        switch {
+            case c == quote || c == '\\':
+                buf.WriteRune('\\')
+                buf.WriteRune(c)
+            case c == '\n':
+                buf.WriteString("\\n")
+            case c == '\r':
+                buf.WriteString("\\r")
+            case c == '\t':
+                buf.WriteString("\\t")
+            case c < ' ' || c == 0x7f:
+                buf.WriteString(fmt.Sprintf("\\x%02x", c))
+            default:
+                buf.WriteRune(c)
+        }
+    }
+    buf.WriteRune(quote)
+    
+    return buf.String()
+}
+
+func (o *StringObject) Str() (string) {
+    return o.Value
+}
+
+// The length of a string is the number of characters in it.
+func (o *StringObject) Len() (int, os.Error) {
+    return o.length, nil
+}
+
+func (o *StringObject) AsBool() (bool) {
+    return o.IsTrue()
+}
@@ -0,0 +1,12 @@
+items = [3, 1, 2]
+print("len", len(items), sep=": ")
+print(repr("it's"), repr(items), end="!\n")
+print(type(items).__name__, type(1.5).__name__, type(type(1)).__name__)
+print("int" if isinstance(len(items), int) else "not int")
+print(sum(range(5)), min(items), max(3, 7), abs(-2))
+print()
+print(1 < 2, not 1, True, type(True).__name__, isinstance(False, int), True + 1)
+n = len(items)
+x = n ** 2
+x **= 2
+print(n ** 10, n ** -1, x)
@@ -0,0 +1,6 @@
+async def double(f):
+    x = await f
+    return x * 2
+
+async def add(a, b):
+    return await double(a) + await double(b)
@@ -0,0 +1,24 @@
+def count(n):
+    i = 0
+    while i < n:
+        got = yield i
+        if got is not None:
+            i = got
+        i += 1
+    return i
+
+def squares(xs):
+    for x in xs:
+        yield x * x
+
+total = 0
+for x in count(5):
+    total += x
+
+sum_squares = 0
+for y in squares((1, 2, 3)):
+    sum_squares += y
+
+empty = 0
+for z in count(0):
+    empty += 1
@@ -0,0 +1,6 @@
+def scale(x, factor=1, offset=0):
+    return x * factor + offset
+
+a = scale(2, offset=1)
+b = scale(2, factor=3, offset=1)
+c = scale(x=4, factor=2)
@@ -0,0 +1,30 @@
+def add(a, b=10):
+    return a + b
+
+def counter(n):
+    total = 1
+    def bump(k):
+        return total + k
+    for i in [1, 2, 3]:
+        if i < n:
+            total = total * 2
+    return bump(n)
+
+def pick(d, key):
+    if d is None:
+        return -1
+    return d[key]
+
+xs = (add(1), add(2, b=3))
+t = 5
+x = y = -t
+while t > 1:
+    t = t - 1
+z = counter(3) if t == 1 else None
+first, second = xs
+items = [first, second, 3.5]
+items[2] = items[0] // 4
+d = {"a": 1, "b": 2}
+got = pick(d, "b") + pick(None, "a")
+flag = not (x < y or x > y)
+s = {1, 2} - {2}
@@ -0,0 +1,10 @@
+items = [1, 2, 3, 4, 5]
+word = "héllo"
+t = (1, 2, 3)
+head = items[:2]
+tail = items[-2:]
+evens = items[::2]
+back = word[::-1]
+mid = t[1:]
+items[1:3] = [20, 30, 40]
+items[::3] = [0, 0]
@@ -0,0 +1,204 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the thread built-in object
+   type.  A thread calls a function on a machine of its own, on a goroutine
+   of its own, and the machines of the interpreter take turns holding its
+   lock.  Python code starts a thread with the start_new_thread builtin,
+   and waits for it to finish with the join method of the thread.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+)
+
+type ThreadObject struct {
+    ObjectData
+    
+    // Closed when the thread has finished, which sets the value the function returned,
+    // or the error it failed with.
+    done        chan bool
+    Result      Object
+    Err         os.Error
+}
+
+// Starts a thread that calls fn with args, and returns it.
+func (interp *Interpreter) StartThread(fn Object, args []Object) (*ThreadObject) {
+    t := new(ThreadObject)
+    t.ObjectData.Init()
+    t.done = make(chan bool)
+    t.SetAttr("join", NewBuiltinFunction("join", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 0 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("join() takes no arguments (%v given)", len(args)))
+        }
+        if err := m.BlockingWait(t.wait); err != nil {
+            return nil, err
+        }
+        return t.Result, t.Err
+    }))
+    
+    go func() {
+        t.Result, t.Err = interp.NewMachine().CallObject(fn, args)
+        close(t.done)
+    }()
+    return t
+}
+
+// Waits for the thread to finish.  Go code that holds the lock of the interpreter has
+// to let go of it first.
+func (o *ThreadObject) Wait() {
+    <-o.done
+}
+
+// Waits for the thread to finish, unless wake gets a value first.  Returns whether the
+// thread finished.
+func (o *ThreadObject) wait(wake <-chan bool) (bool) {
+    select {
+        case <-o.done:
+            return true
+        case <-wake:
+    }
+    return false
+}
+
+// Adds the builtins for threads and locks to the interpreter.
+func (interp *Interpreter) addThreadBuiltins() {
+    interp.Builtins["start_new_thread"] = NewBuiltinFunction("start_new_thread", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 2 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("start_new_thread() takes 2 arguments (%v given)", len(args)))
+        }
+        t, ok := args[1].(*TupleObject)
+        if !ok {
+            return nil, Raise(TypeErrorClass, "2nd arg must be a tuple")
+        }
+        return interp.StartThread(args[0], t.Items), nil
+    })
+    interp.Builtins["allocate_lock"] = NewBuiltinFunction("allocate_lock", func(m *Machine, args []Object) (Object, os.Error) {
+        if len(args) != 0 {
+            return nil, Raise(TypeErrorClass, fmt.Sprintf("allocate_lock() takes no arguments (%v given)", len(args)))
+        }
+        return NewLock(), nil
+    })
+}
+
+// A thread can't be converted to a number
+func (o *ThreadObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *ThreadObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert thread to string
+func (o *ThreadObject) AsString() (string) {
+    return "<thread>"
+}
+
+///////// Rich Comparison Interface ///////////
+
+// A thread is only equal to itself, and threads are not ordered.
+func (o *ThreadObject) Eq(r Object) (Object) {
+    t, ok := r.(*ThreadObject)
+    return pyBool(ok && t == o)
+}
+
+func (o *ThreadObject) Neq(r Object) (Object) {
+    return invertComparison(o.Eq(r))
+}
+
+func (o *ThreadObject) Lt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ThreadObject) Gt(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ThreadObject) Lte(r Object) (Object) {
+    return NotImplemented
+}
+
+func (o *ThreadObject) Gte(r Object) (Object) {
+    return NotImplemented
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+func (o *ThreadObject) Add(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ThreadObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ThreadObject) Mul(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ThreadObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ThreadObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ThreadObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ThreadObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *ThreadObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ThreadObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *ThreadObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A thread is always true
+func (o *ThreadObject) IsTrue() (bool) {
+    return true
+}
+
+///////// Protocol Interface ///////////
+
+func (o *ThreadObject) Repr() (string) {
+    return o.AsString()
+}
+
+func (o *ThreadObject) Str() (string) {
+    return o.AsString()
+}
+
+func (o *ThreadObject) AsBool() (bool) {
+    return o.IsTrue()
+}
@@ -0,0 +1,137 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module implements the tracing hook of the machine, which a debugger or
+   a coverage tool can use to follow the program, like sys.settrace in Python.
+   The hook is called when a frame is entered, before the first instruction of
+   each new source line, when a frame returns, and when an error stops the
+   machine.  A line event is also sent when the program jumps back to an
+   earlier instruction, so each pass through a loop is seen, even if the loop
+   is on a single line.  Line events are only sent for code that has a line
+   table.
+
+   When an error stops the machine, each frame that was running gets an
+   exception event and then a return event without a value, innermost first,
+   which is the order in which Python would unwind them.
+*/
+
+package python
+
+import (
+    "fmt"
+    "os"
+)
+
+// The kinds of trace event.
+const (
+    TraceCall = iota
+    TraceLine
+    TraceReturn
+    TraceException
+)
+
+var traceEventNames = []string{"call", "line", "return", "exception"}
+
+// An event passed to the trace function.  Frame is the frame the event happened in,
+// and is only valid until the trace function returns.  Instruction is the address of
+// the instruction about to run, or of the one that failed, and Line is its source line.
+// Value is the value returned by a return event, and Err is the error of an exception
+// event.
+type TraceEvent struct {
+    Kind        int
+    Frame       *Frame
+    Instruction uint32
+    Line        int
+    Value       Object
+    Err         os.Error
+}
+
+// Formats the event like "line 3 in f".
+func (e TraceEvent) String() (string) {
+    name := "?"
+    if e.Frame != nil && e.Frame.Code != nil {
+        name = e.Frame.Code.Name
+    }
+    return fmt.Sprintf("%v %v in %v", traceEventNames[e.Kind], e.Line, name)
+}
+
+// Sets the function called for each trace event, or turns tracing off if fn is nil.
+func (m *Machine) SetTrace(fn func(event TraceEvent)) {
+    m.trace = fn
+}
+
+func (m *Machine) traceEvent(kind int, f *Frame, pc uint32, value Object, err os.Error) {
+    line := 0
+    if f.Code != nil {
+        line = f.Code.Line(pc)
+    }
+    m.trace(TraceEvent{kind, f, pc, line, value, err})
+}
+
+// Sends the call event of the current frame, which is about to start.  Its line is the
+// first line of the code, as in Python, where it is the line of the def.
+func (m *Machine) traceCall() {
+    line := 0
+    if m.Code != nil {
+        line = m.Code.FirstLine
+    }
+    m.trace(TraceEvent{Kind: TraceCall, Frame: &m.Frame, Instruction: m.NextInstruction, Line: line})
+}
+
+// Sends a line event if the instruction at NextInstruction starts a new line, or if it
+// is reached by a jump back.
+func (m *Machine) traceLine() {
+    pc := m.NextInstruction
+    f := &m.Frame
+    line := f.Code.Line(pc)
+    if line == 0 {
+        return
+    }
+    
+    jumped_back := f.traceLine != 0 && pc <= f.tracePC
+    if line != f.traceLine || jumped_back {
+        m.traceEvent(TraceLine, f, pc, nil, nil)
+    }
+    f.traceLine = line
+    f.tracePC = pc
+}
+
+// Sends the return event of the current frame.
+func (m *Machine) traceReturn(value Object) {
+    pc := m.NextInstruction
+    if pc > 0 {
+        pc--
+    }
+    m.traceEvent(TraceReturn, &m.Frame, pc, value, nil)
+}
+
+// Sends the exception and return events of every frame, once err has stopped the
+// machine.
+func (m *Machine) traceException(err os.Error) {
+    pc := m.NextInstruction-1
+    m.traceEvent(TraceException, &m.Frame, pc, nil, err)
+    m.traceEvent(TraceReturn, &m.Frame, pc, nil, nil)
+    
+    for i := len(m.Frames)-1; i >= 0; i-- {
+        callee := &m.Frame
+        if i+1 < len(m.Frames) {
+            callee = &m.Frames[i+1]
+        }
+        pc = callee.ReturnAddress-1
+        m.traceEvent(TraceException, &m.Frames[i], pc, nil, err)
+        m.traceEvent(TraceReturn, &m.Frames[i], pc, nil, nil)
+    }
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for the tracing hook.
+
+*/
+
+package python
+
+import (
+        "strings"
+        "testing"
+)
+
+func TestTrace(t *testing.T) {
+    var events []string
+    m := new (Machine)
+    m.SetTrace(func(event TraceEvent) {
+        events = append(events, event.String())
+        if event.Kind == TraceException && event.Err == nil {
+            t.Errorf("an exception event should have the error")
+        }
+    })
+    
+    if _, err := m.RunModule(newFailingModule()); err == nil {
+        t.Fatalf("expected the undefined name to fail")
+    }
+    
+    expected := []string{
+        "call 1 in <module>",
+        "line 1 in <module>",
+        "line 3 in <module>",
+        "call 11 in f",
+        "line 11 in f",
+        "line 12 in f",
+        "exception 12 in f",
+        "return 12 in f",
+        "exception 3 in <module>",
+        "return 3 in <module>",
+    }
+    if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+        t.Errorf("expected the events:\n%v\ngot:\n%v", strings.Join(expected, "\n"), strings.Join(events, "\n"))
+    }
+}
+
+func TestTraceLoop(t *testing.T) {
+    mod := importPyc(t, "test_data/pyc_sample.pyc")
+    
+    counts := make(map[string]int)
+    var returned []string
+    m := new (Machine)
+    m.SetTrace(func(event TraceEvent) {
+        counts[event.String()]++
+        if event.Kind == TraceReturn && event.Frame.Code.Name == "add" {
+            returned = append(returned, event.Value.AsString())
+        }
+    })
+    if _, err := m.RunModule(mod); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    
+    // The while loop on lines 21 and 22 runs four times, and the for loop in counter
+    // three times, each jumping back to the line it is on.
+    tests := []struct {
+        event   string
+        count   int
+    }{
+        {"call 1 in add", 2},
+        {"line 2 in add", 2},
+        {"line 22 in <module>", 4},
+        {"line 21 in <module>", 5},
+        {"line 8 in counter", 4},
+        {"call 13 in pick", 2},
+        {"return 30 in <module>", 1},
+    }
+    for _, test := range tests {
+        if counts[test.event] != test.count {
+            t.Errorf("expected %v '%v' events, got %v", test.count, test.event, counts[test.event])
+        }
+    }
+    if strings.Join(returned, " ") != "11 5" {
+        t.Errorf("add should return 11 and 5, got %v", returned)
+    }
+    
+    // Turning the hook off stops the events.
+    m.SetTrace(nil)
+    counts = make(map[string]int)
+    if _, err := m.RunModule(mod); err != nil || len(counts) != 0 {
+        t.Errorf("expected no events, got %v", counts)
+    }
+}
@@ -0,0 +1,85 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This module builds the traceback of an error that stops the machine, which
+   lists the file, line and function of each frame that was running, with the
+   innermost frame last, the way Python prints it.
+*/
+
+package python
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+)
+
+// A single frame of a traceback.  The line is 0 if the code has no line table.
+type TracebackEntry struct {
+    Filename    string
+    Line        int
+    Function    string
+}
+
+// The frames that were running when Err stopped the machine, outermost first.
+type Traceback struct {
+    Entries     []TracebackEntry
+    Err         os.Error
+}
+
+// Builds the traceback of err, from the frames of the machine as they are when the
+// instruction before NextInstruction fails.
+func (m *Machine) traceback(err os.Error) (*Traceback) {
+    tb := &Traceback{Err: err}
+    
+    entry := func(c *CodeObject, pc uint32) (TracebackEntry) {
+        if c == nil {
+            return TracebackEntry{Function: "?"}
+        }
+        return TracebackEntry{c.Filename, c.Line(pc), c.Name}
+    }
+    
+    // Each caller is at the instruction before the one its callee returns to.
+    for i, f := range m.Frames {
+        callee := &m.Frame
+        if i+1 < len(m.Frames) {
+            callee = &m.Frames[i+1]
+        }
+        tb.Entries = append(tb.Entries, entry(f.Code, callee.ReturnAddress-1))
+    }
+    tb.Entries = append(tb.Entries, entry(m.Code, m.NextInstruction-1))
+    
+    return tb
+}
+
+// Formats the traceback like Python does.
+func (tb *Traceback) String() (string) {
+    buf := new (bytes.Buffer)
+    buf.WriteString("Traceback (most recent call last):\n")
+    
+    for _, e := range tb.Entries {
+        filename := e.Filename
+        if filename == "" {
+            filename = "<unknown>"
+        }
+        fmt.Fprintf(buf, "  File \"%v\", line %v, in %v\n", filename, e.Line, e.Function)
+    }
+    
+    if err := tb.Err; err != nil {
+        buf.WriteString(err.String())
+    }
+    return buf.String()
+}
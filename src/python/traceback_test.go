@@ -0,0 +1,96 @@
+/*
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+  Tests for tracebacks, and for the source lines of the disassembler.
+
+*/
+
+package python
+
+import (
+        "bytes"
+        "testing"
+)
+
+// Builds a module whose body calls f on line 3, which fails on line 12.
+func newFailingModule() (*ModuleCode) {
+    mod := new (ModuleCode)
+    mod.Init("test")
+    
+    f := mod.NewCode("f")
+    f.Filename = "test.py"
+    f.NameIndex("x")
+    f.NumParams = 1
+    f.SetLine(11)
+    f.WriteConst(intObject(2), 2, false, 0)
+    f.SetLine(12)
+    f.WriteLoad("y", 3, false, 0)
+    f.WriteRet(3, false, 0)
+    
+    body := mod.NewCode("<module>")
+    body.Filename = "test.py"
+    body.SetLine(1)
+    body.WriteConst(NewFunction(f, nil, mod.Globals), 1, false, 0)
+    body.WriteConst(intObject(1), 2, false, 0)
+    body.SetLine(3)
+    body.WriteCallFunction(1, 1, 0, 3, false, 0)
+    body.WriteHalt(3, false, 0)
+    
+    mod.Code[0], mod.Code[1] = body, f
+    return mod
+}
+
+func TestTraceback(t *testing.T) {
+    m := new (Machine)
+    if _, err := m.RunModule(newFailingModule()); err == nil {
+        t.Fatalf("expected the undefined name to fail")
+    }
+    
+    expected := `Traceback (most recent call last):
+  File "test.py", line 3, in <module>
+  File "test.py", line 12, in f
+NameError: name 'y' is not defined`
+    if m.Traceback == nil || m.Traceback.String() != expected {
+        t.Errorf("expected:\n%v\ngot:\n%v", expected, m.Traceback)
+    }
+    
+    // A run that succeeds leaves no traceback behind.
+    s := new (CodeObject)
+    s.Init()
+    s.WriteHalt(0, false, 0)
+    m.Frame = Frame{}
+    m.Frames = nil
+    m.NextInstruction = 0
+    if _, err := m.Run(s); err != nil || m.Traceback != nil {
+        t.Errorf("expected the traceback to be cleared, got %v and %v", err, m.Traceback)
+    }
+}
+
+func TestDisassembleLines(t *testing.T) {
+    expected := `   1      0         CONST       r1, 0 (<function f>)
+          1         CONST       r2, 1 (1)
+   3      2         CALLFN      r1(1, 0 kw) -> r3
+          3         HALT        r3
+`
+    
+    buf := new (bytes.Buffer)
+    if err := Disassemble(newFailingModule().Code[0], buf); err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if buf.String() != expected {
+        t.Errorf("expected:\n%v\ngot:\n%v", expected, buf.String())
+    }
+}
@@ -0,0 +1,302 @@
+/* 
+   Copyright 2010 Christopher Nelson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+   --------------------------------------------------------------------
+
+   This file provides the implementation of the tuple built-in object
+   type.
+*/
+
+package python
+
+import (
+        "big"
+        "fmt"
+        "os"
+        "strings"
+)
+
+type TupleObject struct {
+    ObjectData
+    Items []Object
+}
+
+func NewTuple(items []Object) (*TupleObject) {
+    t := new(TupleObject)
+    t.ObjectData.Init()
+    t.Items = items
+    
+    return t
+}
+
+// A tuple can't be converted to a number
+func (o *TupleObject) AsInt() (*big.Int) {
+    return big.NewInt(0)
+}
+
+func (o *TupleObject) AsFloat() (float64) {
+    return 0
+}
+
+// Convert tuple to string
+func (o *TupleObject) AsString() (string) {
+    items := make([]string, len(o.Items))
+    for i, item := range o.Items {
+        items[i] = item.AsString()
+    }
+    
+    if len(items) == 1 {
+        return "(" + items[0] + ",)"
+    }
+    return "(" + strings.Join(items, ", ") + ")"
+}
+
+// Iterate over the items of the tuple
+func (o *TupleObject) Iter() (Iterator) {
+    return NewIterator(o.Items)
+}
+
+// Returns the item at the index key, or a tuple of the items the slice key takes.
+func (o *TupleObject) GetItem(key Object) (Object, os.Error) {
+    if s, ok := key.(*SliceObject); ok {
+        items, err := sliceItems(o.Items, s)
+        if err != nil {
+            return nil, err
+        }
+        return NewTuple(items), nil
+    }
+    
+    i, err := sequenceIndex(key, len(o.Items), "tuple")
+    if err != nil {
+        return nil, err
+    }
+    return o.Items[i], nil
+}
+
+// Tuples can't be changed
+func (o *TupleObject) SetItem(key, value Object) (os.Error) {
+    return Raise(TypeErrorClass, "'tuple' object does not support item assignment")
+}
+
+///////// Rich Comparison Interface ///////////
+
+// Checks that key is an index into a sequence of n items, and returns it.  Negative
+// indices count from the end, as in Python.  kind names the sequence in the errors.
+func sequenceIndex(key Object, n int, kind string) (int, os.Error) {
+    i, ok := key.(*IntObject)
+    if !ok {
+        return 0, Raise(TypeErrorClass, fmt.Sprintf("%v indices must be integers, not '%v'", kind, key))
+    }
+    
+    if !i.IsSmall() {
+        return 0, Raise(IndexErrorClass, fmt.Sprintf("%v index out of range", kind))
+    }
+    
+    index := i.Small
+    if index < 0 {
+        index += int64(n)
+    }
+    if index < 0 || index >= int64(n) {
+        return 0, Raise(IndexErrorClass, fmt.Sprintf("%v index out of range", kind))
+    }
+    return int(index), nil
+}
+
+// Returns a copy of the items the slice s takes from items.
+func sliceItems(items []Object, s *SliceObject) ([]Object, os.Error) {
+    start, step, length, err := s.Indices(len(items))
+    if err != nil {
+        return nil, err
+    }
+    result := make([]Object, length)
+    for i := range result {
+        result[i] = items[start+i*step]
+    }
+    return result, nil
+}
+
+// Compares the sequences a and b with op, the way Python does.  The first items that
+// aren't equal are compared with op, and if there are none, the lengths are.  The
+// result is NotImplemented if those items can't be compared with op.
+func compareItems(op uint32, a, b []Object) (Object) {
+    if (op == EQ || op == NE) && len(a) != len(b) {
+        return pyBool(op == NE)
+    }
+    
+    for i := 0; i < len(a) && i < len(b); i++ {
+        if !equal(a[i], b[i]) {
+            if op == EQ || op == NE {
+                return pyBool(op == NE)
+            }
+            return builtinCompare(op, a[i], b[i])
+        }
+    }
+    
+    c := 0
+    switch {
+        case len(a) < len(b):
+            c = -1
+        case len(a) > len(b):
+            c = 1
+    }
+    return comparison(op, c)
+}
+
+// Compares two tuples item by item.  A tuple is only compared with a tuple.
+func (o *TupleObject) compare(op uint32, r Object) (Object) {
+    t, ok := r.(*TupleObject)
+    if !ok {
+        return NotImplemented
+    }
+    return compareItems(op, o.Items, t.Items)
+}
+
+func (o *TupleObject) Lt(r Object) (Object) {
+    return o.compare(LT, r)
+}
+
+func (o *TupleObject) Gt(r Object) (Object) {
+    return o.compare(GT, r)
+}
+
+func (o *TupleObject) Eq(r Object) (Object) {
+    return o.compare(EQ, r)
+}
+
+func (o *TupleObject) Neq(r Object) (Object) {
+    return o.compare(NE, r)
+}
+
+func (o *TupleObject) Lte(r Object) (Object) {
+    return o.compare(LE, r)
+}
+
+func (o *TupleObject) Gte(r Object) (Object) {
+    return o.compare(GE, r)
+}
+
+///////// Binary Arithmetic Interface ///////////
+
+// Concatenates two tuples.  Anything else can't be added to a tuple.
+func (o *TupleObject) Add(r Object) (Object, os.Error) {
+    t, ok := r.(*TupleObject)
+    if !ok {
+        return nil, nil
+    }
+    
+    items := make([]Object, 0, len(o.Items)+len(t.Items))
+    items = append(items, o.Items...)
+    return NewTuple(append(items, t.Items...)), nil
+}
+
+func (o *TupleObject) Sub(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+// Repeats the items.  A negative number of repeats gives no items.
+func (o *TupleObject) Mul(r Object) (Object, os.Error) {
+    n, ok := r.(*IntObject)
+    if !ok {
+        return nil, nil
+    }
+    
+    var items []Object
+    reps := n.Int64()
+    
+    for i:=int64(0); i < reps; i+=1 {
+        items = append(items, o.Items...)
+    }
+    return NewTuple(items), nil
+}
+
+func (o *TupleObject) Div(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TupleObject) FloorDiv(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TupleObject) Mod(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TupleObject) Pow(r Object) (Object, os.Error) {
+    return nil, nil
+}
+
+///////// Unary Arithmetic Interface ///////////
+
+func (o *TupleObject) Neg() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TupleObject) Pos() (Object, os.Error) {
+    return nil, nil
+}
+
+func (o *TupleObject) Invert() (Object, os.Error) {
+    return nil, nil
+}
+
+// A tuple is true unless it is empty
+func (o *TupleObject) IsTrue() (bool) {
+    return len(o.Items) > 0
+}
+
+///////// Protocol Interface ///////////
+
+// A tuple is hashed from the hashes of its items, so it can't be hashed if one of them
+// can't.
+func (o *TupleObject) Hash() (uint64, os.Error) {
+    return o.hash(nil)
+}
+
+// Hashes the tuple with the strings in it hashed with the key k.  See hash.go.
+func (o *TupleObject) hash(k *sipKey) (uint64, os.Error) {
+    h := uint64(0x345678)
+    for _, item := range o.Items {
+        ih, err := hashObject(item, k)
+        if err != nil {
+            return 0, err
+        }
+        h = (h ^ ih) * 1000003
+    }
+    return h ^ uint64(len(o.Items)), nil
+}
+
+// The items are written as Python writes them, so strings are quoted.
+func (o *TupleObject) Repr() (string) {
+    items := make([]string, len(o.Items))
+    for i, item := range o.Items {
+        items[i] = item.Repr()
+    }
+    
+    if len(items) == 1 {
+        return "(" + items[0] + ",)"
+    }
+    return "(" + strings.Join(items, ", ") + ")"
+}
+
+func (o *TupleObject) Str() (string) {
+    return o.Repr()
+}
+
+func (o *TupleObject) Len() (int, os.Error) {
+    return len(o.Items), nil
+}
+
+func (o *TupleObject) AsBool() (bool) {
+    return o.IsTrue()
+}